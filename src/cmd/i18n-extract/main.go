@@ -0,0 +1,219 @@
+// main.go - i18n-extract
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// i18n-extract extracts the translatable user interface strings from the Go
+// sources and the Gtk+ Builder files, and prints the catalog template, or
+// merges the strings into existing catalogs.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"html"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// i18nKeywords are the `i18n` package routines that take a msgid.
+	i18nKeywords = map[string]bool{
+		"T":       true,
+		"Sprintf": true,
+	}
+
+	// uiKeywords are the user interface methods (with any receiver) that
+	// translate their first argument.
+	uiKeywords = map[string]bool{
+		"ask":            true,
+		"bitch":          true,
+		"inform":         true,
+		"setTitle":       true,
+		"setText":        true,
+		"UpdateProgress": true,
+	}
+
+	translatableRe = regexp.MustCompile(`<property [^>]*translatable="yes"[^>]*>([^<]*)</property>`)
+
+	// verbsOnlyRe matches format strings with nothing to translate.
+	verbsOnlyRe = regexp.MustCompile(`^(%[-+# 0-9.]*[a-zA-Z]|\s)*$`)
+)
+
+func main() {
+	update := flag.Bool("update", false, "Merge the strings into the catalogs given via -catalogs instead of printing a template.")
+	catalogs := flag.String("catalogs", "", "Space separated list of catalogs to update.")
+	flag.Parse()
+
+	msgids := make(map[string]bool)
+	for _, root := range flag.Args() {
+		if err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch {
+			case fi.IsDir():
+				if fi.Name() == "vendor" {
+					return filepath.SkipDir
+				}
+			case strings.HasSuffix(path, "_test.go"):
+			case strings.HasSuffix(path, ".go"):
+				return extractGo(path, msgids)
+			case strings.HasSuffix(path, ".ui"):
+				return extractBuilder(path, msgids)
+			}
+			return nil
+		}); err != nil {
+			log.Fatalf("i18n-extract: %v", err)
+		}
+	}
+
+	if !*update {
+		template := make(map[string]string)
+		for id := range msgids {
+			template[id] = ""
+		}
+		os.Stdout.Write(encodeCatalog(template))
+		return
+	}
+	for _, path := range strings.Fields(*catalogs) {
+		if err := mergeCatalog(path, msgids); err != nil {
+			log.Fatalf("i18n-extract: %v: %v", path, err)
+		}
+	}
+}
+
+func extractGo(path string, msgids map[string]bool) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "i18n" {
+			if !i18nKeywords[sel.Sel.Name] {
+				return true
+			}
+		} else if !uiKeywords[sel.Sel.Name] {
+			return true
+		}
+		if s, ok := stringLiteral(call.Args[0]); ok && !verbsOnlyRe.MatchString(s) {
+			msgids[s] = true
+		}
+		return true
+	})
+	return nil
+}
+
+// stringLiteral returns the value of a string literal, or a concatenation of
+// string literals.
+func stringLiteral(e ast.Expr) (string, bool) {
+	switch v := e.(type) {
+	case *ast.BasicLit:
+		if v.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(v.Value)
+		return s, err == nil
+	case *ast.BinaryExpr:
+		if v.Op != token.ADD {
+			return "", false
+		}
+		x, ok := stringLiteral(v.X)
+		if !ok {
+			return "", false
+		}
+		y, ok := stringLiteral(v.Y)
+		return x + y, ok
+	case *ast.ParenExpr:
+		return stringLiteral(v.X)
+	}
+	return "", false
+}
+
+func extractBuilder(path string, msgids map[string]bool) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, m := range translatableRe.FindAllStringSubmatch(string(b), -1) {
+		if s := html.UnescapeString(m[1]); s != "" {
+			msgids[s] = true
+		}
+	}
+	return nil
+}
+
+// mergeCatalog adds the new strings to the catalog, and removes the ones
+// that are no longer used, keeping the existing translations.
+func mergeCatalog(path string, msgids map[string]bool) error {
+	old := make(map[string]string)
+	if b, err := ioutil.ReadFile(path); err != nil {
+		return err
+	} else if err = json.Unmarshal(b, &old); err != nil {
+		return err
+	}
+
+	merged := make(map[string]string)
+	added, untranslated := 0, 0
+	for id := range msgids {
+		s, ok := old[id]
+		if !ok {
+			added++
+		}
+		if s == "" {
+			untranslated++
+		}
+		merged[id] = s
+	}
+	removed := 0
+	for id := range old {
+		if !msgids[id] {
+			removed++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%v: %d added, %d removed, %d/%d untranslated\n", path, added, removed, untranslated, len(merged))
+
+	return ioutil.WriteFile(path, encodeCatalog(merged), 0644)
+}
+
+func encodeCatalog(c map[string]string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
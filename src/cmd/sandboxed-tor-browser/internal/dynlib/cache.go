@@ -26,6 +26,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"sync"
+	"time"
 
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
@@ -67,6 +69,11 @@ type FilterFunc func(string) error
 // Cache is a representation of the `ld.so.cache` file.
 type Cache struct {
 	store map[string]cacheEntries
+
+	// imports is the memoized ELF imports of each file examined by
+	// ResolveLibraries.
+	importsLock sync.Mutex
+	imports     map[string][]string
 }
 
 // GetLibraryPath returns the path to the given library, if any.  This routine
@@ -88,6 +95,7 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 	searchPaths := filepath.SplitList(ldLibraryPath)
 	fallbackSearchPaths := filepath.SplitList(fallbackSearchPath)
 	libraries := make(map[string]string)
+	startTime := time.Now()
 
 	// Breadth-first iteration of all the binaries, and their dependencies.
 	checkedFile := make(map[string]bool)
@@ -98,19 +106,25 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 		if len(toCheck) == 0 {
 			break
 		}
-		for _, fn := range toCheck {
-			if filterFn != nil {
+		if filterFn != nil {
+			for _, fn := range toCheck {
 				if err := filterFn(fn); err != nil {
 					Debugf("dynlib error filterFn: %v", err)
 					return nil, err
 				}
 			}
+		}
 
-			impLibs, err := getLibraries(fn)
-			if err != nil {
-				Debugf("dynlib error getLibraries: %v", err)
-				return nil, err
-			}
+		// Parsing the ELF headers dominates the run time on a cold
+		// filesystem cache, so each level is parsed in parallel.
+		allImpLibs, err := c.getLibrariesParallel(toCheck)
+		if err != nil {
+			Debugf("dynlib error getLibraries: %v", err)
+			return nil, err
+		}
+
+		for i, fn := range toCheck {
+			impLibs := allImpLibs[i]
 			Debugf("dynlib: %v imports: %v", fn, impLibs)
 			checkedFile[fn] = true
 
@@ -118,7 +132,7 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 			// so just append them to the first binary.
 			if extraLibs != nil {
 				Debugf("dynlib: Appending extra libs: %v", extraLibs)
-				impLibs = append(impLibs, extraLibs...)
+				impLibs = append(append([]string{}, impLibs...), extraLibs...)
 				extraLibs = nil
 			}
 
@@ -178,6 +192,7 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 			toCheck = append(toCheck, k)
 		}
 	}
+	Debugf("dynlib: Resolved %d files in %v", len(checkedFile), time.Since(startTime))
 
 	// De-dup the libraries map by figuring out what can be symlinked.
 	ret := make(map[string][]string)
@@ -268,6 +283,70 @@ func getNewLdCache(b []byte) ([]byte, int, error) {
 	return b[padLen:], nlibs, nil
 }
 
+// getLibrariesParallel returns the imported libraries of each of the files,
+// in order, using a bounded number of workers.
+func (c *Cache) getLibrariesParallel(fns []string) ([][]string, error) {
+	const maxWorkers = 8
+
+	ret := make([][]string, len(fns))
+	errs := make([]error, len(fns))
+
+	nWorkers := runtime.NumCPU()
+	if nWorkers > maxWorkers {
+		nWorkers = maxWorkers
+	}
+	if nWorkers > len(fns) {
+		nWorkers = len(fns)
+	}
+
+	var wg sync.WaitGroup
+	idxCh := make(chan int)
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxCh {
+				ret[idx], errs[idx] = c.getLibraries(fns[idx])
+			}
+		}()
+	}
+	for i := range fns {
+		idxCh <- i
+	}
+	close(idxCh)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// getLibraries returns the imported libraries of a file, memoized.
+func (c *Cache) getLibraries(fn string) ([]string, error) {
+	c.importsLock.Lock()
+	impLibs, ok := c.imports[fn]
+	c.importsLock.Unlock()
+	if ok {
+		return impLibs, nil
+	}
+
+	impLibs, err := getLibraries(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	c.importsLock.Lock()
+	defer c.importsLock.Unlock()
+	if c.imports == nil {
+		c.imports = make(map[string][]string)
+	}
+	c.imports[fn] = impLibs
+	return impLibs, nil
+}
+
 // LoadCache loads and parses the `ld.so.cache` file.
 //
 // See `sysdeps/generic/dl-cache.h` in the glibc source tree for details
@@ -0,0 +1,152 @@
+// cache_test.go - Library resolution tests and benchmarks.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// testSearchPath is the search path used instead of the host ld.so.cache,
+// which may be in a format or location that LoadCache does not support.
+var testSearchPath = strings.Join([]string{
+	"/lib/x86_64-linux-gnu",
+	"/usr/lib/x86_64-linux-gnu",
+	"/lib64",
+	"/usr/lib64",
+	"/lib",
+	"/usr/lib",
+}, ":")
+
+// testBinaries returns the host binaries to resolve, with a reasonably large
+// set of dependencies between them.
+func testBinaries(tb testing.TB) []string {
+	if runtime.GOOS != "linux" || !IsSupported() {
+		tb.Skip("dynlib: unsupported platform")
+	}
+	var bins []string
+	for _, fn := range []string{
+		"/usr/bin/curl",
+		"/usr/bin/ssh",
+		"/usr/bin/git",
+		"/usr/bin/python3",
+		"/bin/ls",
+	} {
+		if FileExists(fn) {
+			bins = append(bins, fn)
+		}
+	}
+	if len(bins) == 0 {
+		tb.Skip("dynlib: no host binaries to resolve")
+	}
+	return bins
+}
+
+func newTestCache() *Cache {
+	return &Cache{store: make(map[string]cacheEntries)}
+}
+
+// testClosure returns every file that resolving the binaries examines.
+func testClosure(tb testing.TB) []string {
+	libs, err := newTestCache().ResolveLibraries(testBinaries(tb), nil, "", testSearchPath, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fns := testBinaries(tb)
+	for fn := range libs {
+		fns = append(fns, fn)
+	}
+	return fns
+}
+
+func TestGetLibrariesParallel(t *testing.T) {
+	fns := testClosure(t)
+	got, err := newTestCache().getLibrariesParallel(fns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, fn := range fns {
+		want, err := getLibraries(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got[i], want) {
+			t.Errorf("%v: got %q, want %q", fn, got[i], want)
+		}
+	}
+
+	if _, err = newTestCache().getLibrariesParallel(append(fns, "/nonexistent")); err == nil {
+		t.Errorf("getLibrariesParallel: missing file did not fail")
+	}
+}
+
+// BenchmarkGetLibrariesSerial is the per file ELF parsing, one file at a
+// time, as done prior to the worker pool.
+func BenchmarkGetLibrariesSerial(b *testing.B) {
+	fns := testClosure(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, fn := range fns {
+			if _, err := getLibraries(fn); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkGetLibrariesParallel is the per file ELF parsing via the worker
+// pool, without the benefit of memoization.
+func BenchmarkGetLibrariesParallel(b *testing.B) {
+	fns := testClosure(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := newTestCache().getLibrariesParallel(fns); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkResolveLibraries is a full resolution with a fresh cache, as on
+// the first launch.
+func BenchmarkResolveLibraries(b *testing.B) {
+	bins := testBinaries(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := newTestCache().ResolveLibraries(bins, nil, "", testSearchPath, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkResolveLibrariesMemoized is a full resolution reusing the cache,
+// as on subsequent launches (eg: the SQLite helper, and the browser).
+func BenchmarkResolveLibrariesMemoized(b *testing.B) {
+	bins := testBinaries(b)
+	c := newTestCache()
+	if _, err := c.ResolveLibraries(bins, nil, "", testSearchPath, nil); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ResolveLibraries(bins, nil, "", testSearchPath, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -48,20 +48,115 @@ func ValidateLibraryClass(fn string) error {
 	}
 	defer f.Close()
 
+	if err = ValidateClass(f); err != nil {
+		return fmt.Errorf("%v: %v", fn, err)
+	}
+	return nil
+}
+
+// ValidateClass ensures that the ELF object matches the current
+// architecture.
+func ValidateClass(f *elf.File) error {
 	var expectedClass elf.Class
+	var expectedMachine elf.Machine
 	switch runtime.GOARCH {
 	case "amd64":
 		expectedClass = elf.ELFCLASS64
+		expectedMachine = elf.EM_X86_64
 	default:
 		return errUnsupported
 	}
 
 	if f.Class != expectedClass {
-		return fmt.Errorf("unsupported class: %v: %v", fn, f.Class)
+		return fmt.Errorf("unsupported class: %v", f.Class)
+	}
+	if f.Machine != expectedMachine {
+		return fmt.Errorf("unsupported machine: %v", f.Machine)
 	}
 	return nil
 }
 
+// ValidateSymbolVersions ensures that the libraries the ELF object needs
+// exist, and that every versioned symbol it imports is provided by one of
+// the libraries that will be loaded, as resolved via the cache.  Like the
+// dynamic linker, the symbols are looked up across every library in the
+// `DT_NEEDED` closure, and not just the library named by the version
+// requirement, since as of glibc 2.34 the likes of `libpthread` and `libdl`
+// are empty stubs, with the symbols provided by `libc`.
+func ValidateSymbolVersions(f *elf.File, cache *Cache) error {
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]bool)
+	provided := make(map[string]bool)
+	for len(needed) > 0 {
+		lib := needed[0]
+		needed = needed[1:]
+		if loaded[lib] {
+			continue
+		}
+		loaded[lib] = true
+
+		fn := cache.GetLibraryPath(lib)
+		if fn == "" {
+			return fmt.Errorf("missing library: %v", lib)
+		}
+		defs, libNeeded, err := definedSymbols(fn)
+		if err != nil {
+			return err
+		}
+		for k := range defs {
+			provided[k] = true
+		}
+		needed = append(needed, libNeeded...)
+	}
+
+	imported, err := f.ImportedSymbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range imported {
+		if sym.Version == "" || sym.Library == "" {
+			continue
+		}
+		if !loaded[sym.Library] {
+			return fmt.Errorf("symbol %v@%v is imported from %v, which is not needed", sym.Name, sym.Version, sym.Library)
+		}
+		if !provided[sym.Name+"@"+sym.Version] {
+			return fmt.Errorf("no library provides %v@%v (%v)", sym.Name, sym.Version, sym.Library)
+		}
+	}
+	return nil
+}
+
+// definedSymbols returns the versioned symbols that the library defines, and
+// the libraries that it needs.
+func definedSymbols(fn string) (map[string]bool, []string, error) {
+	f, err := elf.Open(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, nil, err
+	}
+	syms, err := f.DynamicSymbols()
+	if err != nil {
+		return nil, nil, err
+	}
+	defs := make(map[string]bool)
+	for _, sym := range syms {
+		if sym.Section != elf.SHN_UNDEF {
+			defs[sym.Name+"@"+sym.Version] = true
+		}
+	}
+	return defs, needed, nil
+}
+
 // FindLdSo returns the path to the `ld.so` dynamic linker for the current
 // architecture, which is usually a symlink
 func FindLdSo(cache *Cache) (string, string, error) {
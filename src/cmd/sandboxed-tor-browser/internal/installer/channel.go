@@ -0,0 +1,171 @@
+// channel.go - MAR channel pinning.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	updateSettingsFile    = "update-settings.ini"
+	applicationIniFile    = "application.ini"
+	acceptedMARChannelKey = "ACCEPTED_MAR_CHANNEL_IDS"
+	marChannelPrefix      = "torbrowser-torproject-"
+)
+
+// MARChannelID returns the MAR channel ID corresponding to a launcher
+// channel.
+func MARChannelID(channel string) string {
+	return marChannelPrefix + channel
+}
+
+// AcceptedMARChannelIDs returns the MAR channel IDs that the installed
+// bundle's `update-settings.ini` will accept.
+func AcceptedMARChannelIDs(cfg *config.Config) ([]string, error) {
+	return acceptedMARChannelIDs(cfg.BundleInstallDir)
+}
+
+func acceptedMARChannelIDs(bundleDir string) ([]string, error) {
+	s, err := readIniValue(filepath.Join(bundleDir, "Browser", updateSettingsFile), "Settings", acceptedMARChannelKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ids = append(ids, v)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%v: empty %v", updateSettingsFile, acceptedMARChannelKey)
+	}
+	return ids, nil
+}
+
+// FirefoxMajorVersion returns the major version of the firefox in the
+// bundle installed in bundleDir, from the bundle's `application.ini`.
+func FirefoxMajorVersion(bundleDir string) (int, error) {
+	v, err := readIniValue(filepath.Join(bundleDir, "Browser", applicationIniFile), "App", "Version")
+	if err != nil {
+		return 0, err
+	}
+	if idx := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); idx != -1 {
+		v = v[:idx]
+	}
+	major, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%v: malformed Version", applicationIniFile)
+	}
+	return major, nil
+}
+
+func readIniValue(path, section, key string) (string, error) {
+	_, fn := filepath.Split(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// This is a trivial subset of the ini format, but it's what firefox
+	// itself expects for these files.
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		switch {
+		case l == "", strings.HasPrefix(l, ";"), strings.HasPrefix(l, "#"):
+		case strings.HasPrefix(l, "["):
+			inSection = l == "["+section+"]"
+		case inSection:
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) != key {
+				continue
+			}
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%v: missing %v", fn, key)
+}
+
+// ChannelMismatchError is the error returned when the installed bundle is
+// from a different channel than the configured one.
+type ChannelMismatchError struct {
+	// Installed is the list of MAR channel IDs accepted by the bundle.
+	Installed []string
+
+	// Configured is the configured channel.
+	Configured string
+}
+
+func (e *ChannelMismatchError) Error() string {
+	return fmt.Sprintf("installed bundle channel (%v) does not match the configured channel (%v), reinstall required", strings.Join(e.Installed, ","), e.Configured)
+}
+
+// VerifyBundleChannel validates that the installed bundle's accepted MAR
+// channels include the configured launcher channel.
+func VerifyBundleChannel(cfg *config.Config) error {
+	return verifyBundleChannel(cfg.BundleInstallDir, cfg.Channel)
+}
+
+func verifyBundleChannel(bundleDir, channel string) error {
+	ids, err := acceptedMARChannelIDs(bundleDir)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle channel: %v", err)
+	}
+
+	expected := MARChannelID(channel)
+	for _, v := range ids {
+		if v == expected {
+			return nil
+		}
+	}
+	return &ChannelMismatchError{Installed: ids, Configured: channel}
+}
+
+// VerifyMARChannel validates that the MAR's channel is accepted by the
+// installed bundle, mirroring the check done by the firefox updater.
+func VerifyMARChannel(cfg *config.Config, mar []byte) error {
+	ids, err := AcceptedMARChannelIDs(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle channel: %v", err)
+	}
+	marChannel, err := MARChannel(mar)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range ids {
+		if v == marChannel {
+			return nil
+		}
+	}
+	return fmt.Errorf("MAR channel (%v) not accepted by bundle (%v)", marChannel, strings.Join(ids, ","))
+}
@@ -0,0 +1,89 @@
+// dryrun.go - Installation pre-flight checks.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	// extractedSizeFactor is a conservative estimate of the ratio of the
+	// extracted bundle size to the compressed bundle size.
+	extractedSizeFactor = 4
+
+	// defaultBundleSize is the assumed compressed bundle size, when the
+	// server does not provide one.
+	defaultBundleSize = 128 * 1024 * 1024
+)
+
+// InstallSpaceRequired returns the estimated amount of disk space in bytes
+// required to install a bundle of the given compressed size.  The bundle is
+// held in memory while extracting, so only the extracted size counts.
+func InstallSpaceRequired(bundleSize int64) int64 {
+	if bundleSize <= 0 {
+		bundleSize = defaultBundleSize
+	}
+	return bundleSize * extractedSizeFactor
+}
+
+// InsufficientSpaceError is the error returned when there is not enough free
+// space to install the bundle.
+type InsufficientSpaceError struct {
+	// Dir is the directory that was checked.
+	Dir string
+
+	// Available is the free space in bytes.
+	Available int64
+
+	// Required is the space in bytes required for the install.
+	Required int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space: %d MiB available, %d MiB required", e.Available/(1024*1024), e.Required/(1024*1024))
+}
+
+// CheckInstallDir validates that the bundle install directory is writable,
+// and that there is enough free space to install a bundle of the given
+// compressed size.
+func CheckInstallDir(cfg *config.Config, bundleSize int64) error {
+	// The install directory gets obliterated and recreated, so it is the
+	// parent that needs to be writable.
+	dir := filepath.Dir(cfg.BundleInstallDir)
+	f, err := ioutil.TempFile(dir, ".install-check")
+	if err != nil {
+		return fmt.Errorf("install directory is not writable: %v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(dir, &fs); err != nil {
+		return err
+	}
+	avail := int64(fs.Bavail) * int64(fs.Bsize)
+	if need := InstallSpaceRequired(bundleSize); avail < need {
+		return &InsufficientSpaceError{Dir: dir, Available: avail, Required: need}
+	}
+	return nil
+}
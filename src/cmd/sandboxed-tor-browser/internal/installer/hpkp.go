@@ -18,30 +18,62 @@ package installer
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
+	"time"
 
 	"git.schwanenlied.me/yawning/hpkp.git"
 
-	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/policy"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
 )
 
-// StaticHPKPPins is the backing store containing static HPKP pins for
-// install/update related hosts.
-var StaticHPKPPins *hpkp.MemStorage
+// hpkpAsset is the pin set asset, which is part of the policy, so that a
+// signed policy pack can replace the pins before the embedded ones rot.
+const hpkpAsset = "installer/hpkp.json"
 
-func init() {
-	StaticHPKPPins = hpkp.NewMemStorage()
+type pinSet struct {
+	// Expires is the UNIX time after which the pins are considered stale.
+	Expires int64 `json:"expires"`
 
-	var parsedPins map[string][]string
-	if d, err := data.Asset("installer/hpkp.json"); err != nil {
-		panic(err)
-	} else if err = json.Unmarshal(d, &parsedPins); err != nil {
-		panic(err)
+	// Pins is the base64 encoded SHA256 SPKI pins, by host.
+	Pins map[string][]string `json:"pins"`
+}
+
+// HPKPPins returns the backing store containing the HPKP pins for
+// install/update related hosts, taken from the policy pack if one is
+// installed.  Expired pins are handled as per the configured pin policy,
+// either by ignoring them, or by refusing all connections to the pinned
+// hosts.
+func HPKPPins(cfg *config.Config) (*hpkp.MemStorage, error) {
+	d, err := policy.Asset(hpkpAsset)
+	if err != nil {
+		return nil, err
+	}
+	ps := new(pinSet)
+	if err = json.Unmarshal(d, ps); err != nil {
+		return nil, fmt.Errorf("installer: malformed HPKP pins: %v", err)
+	}
+
+	expired := time.Now().Unix() > ps.Expires
+	if expired {
+		log.Printf("installer: HPKP pins expired at %v (policy: %v).", time.Unix(ps.Expires, 0), cfg.GetPinPolicy())
 	}
 
-	for host, pins := range parsedPins {
-		StaticHPKPPins.Add(host, &hpkp.Header{
+	s := hpkp.NewMemStorage()
+	for host, pins := range ps.Pins {
+		if expired {
+			if cfg.GetPinPolicy() != config.PinPolicyFailClosed {
+				continue
+			}
+			// A pin set with no pins will never match, so every
+			// connection to the host will fail.
+			pins = nil
+		}
+		s.Add(host, &hpkp.Header{
 			Permanent:  true,
 			Sha256Pins: pins,
 		})
 	}
+	return s, nil
 }
@@ -0,0 +1,84 @@
+// local.go - Offline installation from a local bundle.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// The bundle file names are of the form
+// `tor-browser-linux64-7.0.1_en-US.tar.xz`, or for newer bundles that
+// include every locale, `tor-browser-linux-x86_64-13.0.tar.xz`.
+var localBundleRe = regexp.MustCompile(`^tor-browser-(linux64|linux-x86_64)-([0-9][0-9A-Za-z.]*)(?:_([A-Za-z-]+))?\.tar\.xz$`)
+
+var localBundleArchs = map[string]string{
+	"linux64":      "linux64",
+	"linux-x86_64": "linux64",
+}
+
+// LocalBundle is a bundle and detached signature read from the local
+// filesystem.
+type LocalBundle struct {
+	Version string
+	Bundle  []byte
+	Sig     []byte
+}
+
+// LocalBundleVersion returns the version of the bundle at bundlePath based
+// on the file name, after ensuring that it is for the configured
+// architecture and locale.
+func LocalBundleVersion(cfg *config.Config, bundlePath string) (string, error) {
+	_, fn := filepath.Split(bundlePath)
+	m := localBundleRe.FindStringSubmatch(fn)
+	if m == nil {
+		return "", fmt.Errorf("unrecognized bundle file name: '%v'", fn)
+	}
+	if arch := localBundleArchs[m[1]]; arch != cfg.Architecture {
+		return "", fmt.Errorf("bundle architecture (%v) does not match the configured architecture (%v)", m[1], cfg.Architecture)
+	}
+	if m[3] != "" && m[3] != cfg.Locale {
+		return "", fmt.Errorf("bundle locale (%v) does not match the configured locale (%v)", m[3], cfg.Locale)
+	}
+	return m[2], nil
+}
+
+// ReadLocalBundle reads and validates the bundle and signature pair from the
+// local filesystem.  No network access is required.
+func ReadLocalBundle(cfg *config.Config, bundlePath, sigPath string) (*LocalBundle, error) {
+	var err error
+
+	b := new(LocalBundle)
+	if b.Version, err = LocalBundleVersion(cfg, bundlePath); err != nil {
+		return nil, err
+	}
+	if b.Sig, err = ioutil.ReadFile(sigPath); err != nil {
+		return nil, err
+	}
+	if b.Bundle, err = ioutil.ReadFile(bundlePath); err != nil {
+		return nil, err
+	}
+	if err = ValidatePGPSignature(b.Bundle, b.Sig); err != nil {
+		return nil, fmt.Errorf("failed to validate bundle signature: %v", err)
+	}
+
+	return b, nil
+}
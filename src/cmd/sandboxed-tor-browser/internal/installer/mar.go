@@ -133,6 +133,77 @@ func VerifyTorBrowserMAR(mar []byte) error {
 	return nil
 }
 
+// MARChannel returns the MAR channel name from the MAR's
+// PRODUCT_INFORMATION additional section.
+func MARChannel(mar []byte) (string, error) {
+	const productInformationBlockID = 1
+
+	marLen := len(mar)
+	if marLen < 8+12 {
+		return "", fmt.Errorf("missing/truncated MAR SIGNATURES")
+	}
+	offsetToIndex := int(binary.BigEndian.Uint32(mar[4:8]))
+	if offsetToIndex > marLen {
+		return "", fmt.Errorf("offsetToIndex (%v) larger than MAR (%v)", offsetToIndex, marLen)
+	}
+	numSignatures := int(binary.BigEndian.Uint32(mar[16:20]))
+	if numSignatures > 8 {
+		return "", fmt.Errorf("numSignatures (%v) violates constraints", numSignatures)
+	}
+	off := 20
+
+	// Skip over the signatures, VerifyTorBrowserMAR handles them.
+	for i := 0; i < numSignatures; i++ {
+		if off+8 > offsetToIndex {
+			return "", fmt.Errorf("missing/truncated SIGNATURE_ENTRY")
+		}
+		signatureSize := int(binary.BigEndian.Uint32(mar[off+4 : off+8]))
+		if signatureSize > 2048 {
+			return "", fmt.Errorf("signatureSize (%v) violates constraints", signatureSize)
+		}
+		off += 8 + signatureSize
+	}
+
+	// ADDITIONAL_SECTIONS:
+	//   4 bytes : NumAdditionalSections - Number of additional sections
+	if off+4 > offsetToIndex {
+		return "", fmt.Errorf("missing/truncated MAR ADDITIONAL_SECTIONS")
+	}
+	numSections := int(binary.BigEndian.Uint32(mar[off : off+4]))
+	off += 4
+
+	for i := 0; i < numSections; i++ {
+		// ADDITIONAL_SECTION_ENTRY:
+		//   4 bytes : BlockSize - Size of the block including these 8 bytes
+		//   4 bytes : BlockIdentifier - Identifier of the block
+		//   N bytes : BlockData
+		if off+8 > offsetToIndex {
+			return "", fmt.Errorf("missing/truncated ADDITIONAL_SECTION_ENTRY")
+		}
+		blockSize := int(binary.BigEndian.Uint32(mar[off : off+4]))
+		blockID := binary.BigEndian.Uint32(mar[off+4 : off+8])
+		if blockSize < 8 || off+blockSize > offsetToIndex {
+			return "", fmt.Errorf("blockSize (%v) violates constraints", blockSize)
+		}
+		if blockID != productInformationBlockID {
+			off += blockSize
+			continue
+		}
+
+		// PRODUCT_INFORMATION:
+		//   MARChannelName - NUL terminated, max 64 bytes
+		//   ProductVersion - NUL terminated, max 32 bytes
+		blk := mar[off+8 : off+blockSize]
+		idx := bytes.IndexByte(blk, 0x00)
+		if idx < 0 || idx > 64 {
+			return "", fmt.Errorf("malformed MARChannelName")
+		}
+		return string(blk[:idx]), nil
+	}
+
+	return "", fmt.Errorf("MAR has no PRODUCT_INFORMATION")
+}
+
 func init() {
 	assets := []string{
 		"installer/release_primary_6.5.der", // Stable MAR signing key.
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"strings"
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
@@ -52,8 +53,12 @@ type DownloadsEntry struct {
 	Binary string
 }
 
-// DownloadsURL returns the `downloads.json` URL for the configured channel.
+// DownloadsURL returns the `downloads.json` URL for the configured channel,
+// or the configured mirror.
 func DownloadsURL(cfg *config.Config, useOnion bool) string {
+	if cfg.Mirror.DownloadsURL != "" {
+		return cfg.Mirror.DownloadsURL
+	}
 	if useOnion {
 		return urls.DownloadsOnions[cfg.Channel]
 	}
@@ -103,10 +108,13 @@ type Patch struct {
 	Type         string `xml:"type,attr"`
 }
 
-// UpdateURL returns the update check URL for the installed bundle.
-func UpdateURL(manif *config.Manifest, useOnion bool) (string, error) {
+// UpdateURL returns the update check URL for the installed bundle, from the
+// configured mirror if any.
+func UpdateURL(cfg *config.Config, manif *config.Manifest, useOnion bool) (string, error) {
 	base := urls.UpdateURLs[manif.Channel]
-	if useOnion {
+	if cfg.Mirror.UpdateURL != "" {
+		base = strings.TrimSuffix(cfg.Mirror.UpdateURL, "/")
+	} else if useOnion {
 		base = urls.UpdateOnions[manif.Channel]
 	}
 
@@ -0,0 +1,112 @@
+// mirror.go - Install/update mirror TLS overrides.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"git.schwanenlied.me/yawning/hpkp.git"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+type mirrorHost struct {
+	tlsConfig *tls.Config
+	pins      []string
+}
+
+// MirrorDialers wraps the `Dial` and `DialTLS` routines used for install and
+// update connections, so that the hosts with a configured TLS override are
+// verified as per the config instead of via the HPKP pins.  Every override in
+// use is logged, since each one weakens the verification of the connection.
+// Overrides that specify neither a CA file nor pins are rejected, as they
+// would silently fall back to the system roots.
+func MirrorDialers(cfg *config.Config, dialFn, dialTLSFn func(string, string) (net.Conn, error)) (func(string, string) (net.Conn, error), func(string, string) (net.Conn, error), error) {
+	if len(cfg.Mirror.Hosts) == 0 {
+		return dialFn, dialTLSFn, nil
+	}
+
+	hosts := make(map[string]*mirrorHost)
+	for host, mh := range cfg.Mirror.Hosts {
+		if mh.CAFile == "" && len(mh.Pins) == 0 {
+			return nil, nil, fmt.Errorf("installer: TLS override for %v has neither a CA file nor pins", host)
+		}
+		h := &mirrorHost{
+			tlsConfig: &tls.Config{ServerName: host},
+			pins:      mh.Pins,
+		}
+		if mh.CAFile != "" {
+			b, err := ioutil.ReadFile(mh.CAFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, nil, fmt.Errorf("installer: no certificates in CA file: %v", mh.CAFile)
+			}
+			h.tlsConfig.RootCAs = pool
+		}
+		hosts[host] = h
+
+		log.Printf("installer: WARNING: TLS verification for %v is overridden by the config (CA file: '%v', pins: %d).", host, mh.CAFile, len(mh.Pins))
+	}
+	lookup := func(addr string) *mirrorHost {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil
+		}
+		return hosts[host]
+	}
+
+	dialTLS := func(network, addr string) (net.Conn, error) {
+		h := lookup(addr)
+		if h == nil {
+			return dialTLSFn(network, addr)
+		}
+
+		conn, err := dialFn(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := tls.Client(conn, h.tlsConfig)
+		if err = c.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if len(h.pins) == 0 {
+			return c, nil
+		}
+
+		// As with HPKP, intermediates and the root can be pinned as well.
+		for _, peerCert := range c.ConnectionState().PeerCertificates {
+			peerPin := hpkp.Fingerprint(peerCert)
+			for _, pin := range h.pins {
+				if pin == peerPin {
+					return c, nil
+				}
+			}
+		}
+		c.Close()
+		return nil, fmt.Errorf("installer: no configured pin matches %v", h.tlsConfig.ServerName)
+	}
+	return dialFn, dialTLS, nil
+}
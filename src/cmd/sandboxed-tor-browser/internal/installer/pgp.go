@@ -19,9 +19,12 @@ package installer
 import (
 	"bytes"
 	"fmt"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"cmd/sandboxed-tor-browser/internal/data"
 )
@@ -33,10 +36,17 @@ const (
 
 var tbbKeyRing openpgp.KeyRing
 var tbbPgpKey *openpgp.Entity
+var tbbKeyRingOnce sync.Once
+var tbbKeyRingErr error
 
 // ValidatePGPSignature validates the bundle and signature pair against the TBB
 // key ring.
 func ValidatePGPSignature(bundle, signature []byte) error {
+	tbbKeyRingOnce.Do(func() { tbbKeyRingErr = loadKeyRing() })
+	if tbbKeyRingErr != nil {
+		return tbbKeyRingErr
+	}
+
 	if ent, err := openpgp.CheckArmoredDetachedSignature(tbbKeyRing, bytes.NewReader(bundle), bytes.NewReader(signature)); err != nil {
 		return err
 	} else if ent != tbbPgpKey {
@@ -45,25 +55,67 @@ func ValidatePGPSignature(bundle, signature []byte) error {
 	return nil
 }
 
-func initDISABLED() {
-	var err error
+// CheckPGPSignatureIssuer validates that the signature was issued by the TBB
+// key, without validating it against the signed data.  This is useful for
+// checking that a signature is plausible without downloading the bundle.
+func CheckPGPSignatureIssuer(signature []byte) error {
+	tbbKeyRingOnce.Do(func() { tbbKeyRingErr = loadKeyRing() })
+	if tbbKeyRingErr != nil {
+		return tbbKeyRingErr
+	}
+
+	block, err := armor.Decode(bytes.NewReader(signature))
+	if err != nil {
+		return err
+	} else if block.Type != openpgp.SignatureType {
+		return fmt.Errorf("unexpected armor type: %v", block.Type)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return err
+	}
+
+	var issuer uint64
+	switch sig := p.(type) {
+	case *packet.Signature:
+		if sig.IssuerKeyId == nil {
+			return fmt.Errorf("signature has no issuer")
+		}
+		issuer = *sig.IssuerKeyId
+	case *packet.SignatureV3:
+		issuer = sig.IssuerKeyId
+	default:
+		return fmt.Errorf("not a signature")
+	}
 
+	for _, k := range tbbKeyRing.KeysById(issuer) {
+		if k.Entity == tbbPgpKey {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature issued by unknown key: %X", issuer)
+}
+
+// loadKeyRing loads the hardcoded TBB key ring.  This is done lazily
+// rather than at init time, so that an expired key only breaks the
+// operations that actually require it.
+func loadKeyRing() error {
 	pem, err := data.Asset(tbbSigningKeyAsset)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Decode the hardcoded PGP key.
 	buf := bytes.NewReader(pem)
 	tbbKeyRing, err = openpgp.ReadArmoredKeyRing(buf)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Pull out the TBB key for easy access.
 	keys := tbbKeyRing.KeysById(tbbSigningKeyID)
 	if len(keys) != 1 {
-		panic("more than 1 key in hard coded key ring")
+		return fmt.Errorf("more than 1 key in hard coded key ring")
 	}
 	tbbPgpKey = keys[0].Entity
 
@@ -73,6 +125,7 @@ func initDISABLED() {
 		sigValid = sigValid || !subKey.Sig.KeyExpired(time.Now())
 	}
 	if !sigValid {
-		panic("tbb PGP subkeys all expired")
+		return fmt.Errorf("tbb PGP subkeys all expired")
 	}
+	return nil
 }
@@ -0,0 +1,110 @@
+// stage.go - Staged bundle installation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"fmt"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	stageSuffix  = ".new"
+	backupSuffix = ".old"
+)
+
+// StagedInstall is a bundle that has been extracted next to the install
+// directory, but has not yet replaced the existing installation.
+type StagedInstall struct {
+	destDir  string
+	stageDir string
+}
+
+// Dir returns the directory the staged bundle is extracted to.
+func (s *StagedInstall) Dir() string {
+	return s.stageDir
+}
+
+// Verify validates that the staged bundle's accepted MAR channels include
+// the specified launcher channel.
+func (s *StagedInstall) Verify(channel string) error {
+	return verifyBundleChannel(s.stageDir, channel)
+}
+
+// Commit replaces the existing installation with the staged bundle.  The
+// existing installation is only removed once the staged bundle is in place,
+// and is restored if that fails.
+func (s *StagedInstall) Commit() error {
+	backupDir := s.destDir + backupSuffix
+	os.RemoveAll(backupDir)
+
+	hasOld := utils.DirExists(s.destDir)
+	if hasOld {
+		if err := os.Rename(s.destDir, backupDir); err != nil {
+			return fmt.Errorf("failed to move aside old installation: %v", err)
+		}
+	}
+	if err := os.Rename(s.stageDir, s.destDir); err != nil {
+		if hasOld {
+			os.Rename(backupDir, s.destDir)
+		}
+		return fmt.Errorf("failed to move new installation into place: %v", err)
+	}
+	os.RemoveAll(backupDir)
+
+	return nil
+}
+
+// Abort removes the staged bundle, leaving the existing installation as is.
+func (s *StagedInstall) Abort() {
+	os.RemoveAll(s.stageDir)
+}
+
+// StageBundle extracts the supplied tar.xz archive into a temporary sibling
+// of destDir, without touching destDir.  Any writes to cancelCh will abort
+// the extraction.  On failure, the partially extracted bundle is removed.
+func StageBundle(destDir string, bundleTarXz []byte, cancelCh chan interface{}) (*StagedInstall, error) {
+	s := &StagedInstall{
+		destDir:  destDir,
+		stageDir: destDir + stageSuffix,
+	}
+	if err := ExtractBundle(s.stageDir, bundleTarXz, cancelCh); err != nil {
+		s.Abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+// RecoverInstall cleans up after an installation that was interrupted
+// (eg: by a crash or power loss), restoring the previous installation if
+// it was moved aside, but not replaced.
+func RecoverInstall(destDir string) error {
+	stageDir, backupDir := destDir+stageSuffix, destDir+backupSuffix
+
+	os.RemoveAll(stageDir)
+	if !utils.DirExists(backupDir) {
+		return nil
+	}
+	if utils.DirExists(destDir) {
+		return os.RemoveAll(backupDir)
+	}
+	if err := os.Rename(backupDir, destDir); err != nil {
+		return fmt.Errorf("failed to restore previous installation: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+// policy.go - Runtime policy pack.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package policy provides the runtime policy assets (seccomp rules, torrc
+// templates, the extension whitelist), which are versioned separately from
+// the launcher, and may be overridden by a signed policy pack, so that
+// compatibility fixes can ship without a full launcher release.
+package policy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	manifestAsset   = "policy/manifest.json"
+	keysAsset       = "policy/keys.json"
+	extensionsAsset = "policy/extensions.json"
+	controlAsset    = "policy/control.json"
+	stubAsset       = "policy/stub.json"
+
+	// PackFile is the file name of an installed policy pack.
+	PackFile = "policy-pack.json"
+
+	// SigFile is the file name of an installed policy pack's detached
+	// Ed25519 signature.
+	SigFile = PackFile + ".sig"
+)
+
+// ErrNoTrustedKeys is the error returned when a policy pack is provided,
+// but no policy signing keys are trusted.
+var ErrNoTrustedKeys = errors.New("policy: no trusted policy signing keys")
+
+type manifest struct {
+	Version int      `json:"version"`
+	URL     string   `json:"url"`
+	Onion   string   `json:"onion"`
+	Assets  []string `json:"assets"`
+}
+
+// Pack is a policy pack.
+type Pack struct {
+	// Version is the policy version, which must be greater than that of
+	// the embedded policy for the pack to be used.
+	Version int `json:"version"`
+
+	// Assets is the replacement asset contents, by asset name.  Only the
+	// embedded policy assets may be replaced.
+	Assets map[string][]byte `json:"assets"`
+
+	// Compat is the range of launcher versions that each replacement asset
+	// is valid for, by asset name.  Assets without an entry, or that are not
+	// valid for the running launcher, are not used.
+	Compat map[string]*AssetCompat `json:"compat"`
+}
+
+// AssetCompat is the range of launcher versions that a policy pack asset is
+// valid for.
+type AssetCompat struct {
+	// MinLauncher is the first launcher version the asset is valid for, or
+	// empty for all versions.
+	MinLauncher string `json:"minLauncher"`
+
+	// MaxLauncher is the first launcher version the asset is no longer valid
+	// for, or empty for all versions.
+	MaxLauncher string `json:"maxLauncher"`
+}
+
+func (c *AssetCompat) valid(vStr string) error {
+	if c.MinLauncher != "" {
+		if cmp, err := launcherVersionCompare(vStr, c.MinLauncher); err != nil {
+			return err
+		} else if cmp < 0 {
+			return fmt.Errorf("requires launcher version %v or later", c.MinLauncher)
+		}
+	}
+	if c.MaxLauncher != "" {
+		if cmp, err := launcherVersionCompare(vStr, c.MaxLauncher); err != nil {
+			return err
+		} else if cmp >= 0 {
+			return fmt.Errorf("requires a launcher version earlier than %v", c.MaxLauncher)
+		}
+	}
+	return nil
+}
+
+// filterCompat removes the assets that are not valid for the launcher
+// version vStr from the pack.
+func (p *Pack) filterCompat(vStr string) {
+	for name := range p.Assets {
+		var err error
+		if c := p.Compat[name]; c == nil {
+			err = fmt.Errorf("no launcher compatibility entry")
+		} else {
+			err = c.valid(vStr)
+		}
+		if err != nil {
+			log.Printf("policy: Ignoring policy pack asset '%v': %v", name, err)
+			delete(p.Assets, name)
+		}
+	}
+}
+
+func launcherVersionParse(vStr string) ([]int, error) {
+	var out []int
+	for _, s := range strings.Split(strings.TrimSpace(vStr), ".") {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("malformed launcher version: '%v'", vStr)
+		}
+		out = append(out, i)
+	}
+	return out, nil
+}
+
+func launcherVersionCompare(a, b string) (int, error) {
+	aVer, err := launcherVersionParse(a)
+	if err != nil {
+		return 0, err
+	}
+	bVer, err := launcherVersionParse(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for len(aVer) < len(bVer) {
+		aVer = append(aVer, 0)
+	}
+	for len(bVer) < len(aVer) {
+		bVer = append(bVer, 0)
+	}
+	for i := range aVer {
+		if aVer[i] > bVer[i] {
+			return 1, nil
+		}
+		if aVer[i] < bVer[i] {
+			return -1, nil
+		}
+	}
+	return 0, nil
+}
+
+var (
+	lock            sync.Mutex
+	embedded        manifest
+	launcherVersion string
+	policyNames     map[string]bool
+	trustedKeys     []ed25519.PublicKey
+	override        *Pack
+)
+
+// Asset returns the named asset, from the policy pack if it overrides the
+// asset, or from the embedded assets otherwise.
+func Asset(name string) ([]byte, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if override != nil {
+		if b, ok := override.Assets[name]; ok {
+			return b, nil
+		}
+	}
+	return data.Asset(name)
+}
+
+// Version returns the version of the policy in use.
+func Version() int {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if override != nil {
+		return override.Version
+	}
+	return embedded.Version
+}
+
+// URL returns the URL of the policy pack, or the empty string if none is
+// configured.
+func URL(useOnion bool) string {
+	if useOnion && embedded.Onion != "" {
+		return embedded.Onion
+	}
+	return embedded.URL
+}
+
+// Extensions returns the file names of the extensions that are permitted in
+// the Tor Browser profile.
+func Extensions() ([]string, error) {
+	b, err := Asset(extensionsAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	var exts []string
+	if err = json.Unmarshal(b, &exts); err != nil {
+		return nil, fmt.Errorf("policy: malformed extension whitelist: %v", err)
+	}
+	return exts, nil
+}
+
+// ControlRules is the control port surrogate ruleset, for the commands that
+// are not handled by the surrogate itself.
+type ControlRules struct {
+	// GetInfo is the additional GETINFO keys, or if they end in `/`, key
+	// prefixes, that are passed through to tor.
+	GetInfo []string `json:"getinfo"`
+
+	// GetConf is the GETCONF keys that are answered with a synthetic value,
+	// since the launcher owns tor's configuration.
+	GetConf map[string]string `json:"getconf"`
+
+	// SetConf is the SETCONF/RESETCONF keys that are acknowledged, but not
+	// applied.
+	SetConf []string `json:"setconf"`
+
+	// Acknowledge is the commands that are acknowledged, but not executed.
+	Acknowledge []string `json:"acknowledge"`
+
+	// Events is the SETEVENTS events that are accepted in addition to the
+	// circuit display's, but never delivered.
+	Events []string `json:"events"`
+
+	// Passthrough is the commands that are passed through to tor verbatim.
+	Passthrough []string `json:"passthrough"`
+}
+
+// Control returns the control port surrogate ruleset.
+func Control() (*ControlRules, error) {
+	b, err := Asset(controlAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(ControlRules)
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("policy: malformed control port ruleset: %v", err)
+	}
+	return r, nil
+}
+
+// Stub is a vetted build of the LD_PRELOAD stub.
+type Stub struct {
+	// Asset is the name of the stub asset.
+	Asset string `json:"asset"`
+
+	// Version is the version that the stub asset must identify as.
+	Version int `json:"version"`
+
+	// MinBundle is the first bundle version the stub is vetted for, or
+	// empty for all versions.
+	MinBundle string `json:"minBundle"`
+
+	// MaxBundle is the first bundle version the stub is no longer vetted
+	// for, or empty for all versions.
+	MaxBundle string `json:"maxBundle"`
+}
+
+// Stubs returns the vetted builds of the LD_PRELOAD stub, in order of
+// preference.
+func Stubs() ([]*Stub, error) {
+	b, err := Asset(stubAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	var stubs []*Stub
+	if err = json.Unmarshal(b, &stubs); err != nil {
+		return nil, fmt.Errorf("policy: malformed stub list: %v", err)
+	}
+	return stubs, nil
+}
+
+// Verify validates a policy pack and signature pair, and returns the
+// parsed pack, less any assets that are not valid for the running launcher
+// version.
+func Verify(b, sig []byte) (*Pack, error) {
+	if len(trustedKeys) == 0 {
+		return nil, ErrNoTrustedKeys
+	}
+
+	ok := false
+	for _, k := range trustedKeys {
+		if ed25519.Verify(k, b, sig) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("policy: invalid policy pack signature")
+	}
+
+	p := new(Pack)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("policy: malformed policy pack: %v", err)
+	}
+	if p.Version <= embedded.Version {
+		return nil, fmt.Errorf("policy: policy pack version %d is not newer than %d", p.Version, embedded.Version)
+	}
+	for name := range p.Assets {
+		if !policyNames[name] {
+			return nil, fmt.Errorf("policy: policy pack contains a non-policy asset: '%v'", name)
+		}
+	}
+	p.filterCompat(launcherVersion)
+	return p, nil
+}
+
+// Load loads the installed policy pack from dir if present.  A pack that
+// fails to validate is ignored, and the embedded policy is used.
+func Load(dir string) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, PackFile))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("policy: Failed to read policy pack: %v", err)
+		return
+	}
+	sig, err := ioutil.ReadFile(filepath.Join(dir, SigFile))
+	if err != nil {
+		log.Printf("policy: Failed to read policy pack signature: %v", err)
+		return
+	}
+
+	p, err := Verify(b, sig)
+	if err != nil {
+		log.Printf("policy: Ignoring installed policy pack: %v", err)
+		return
+	}
+
+	setOverride(p)
+}
+
+// Install validates and installs a policy pack and signature pair to dir,
+// and uses it for subsequent asset lookups.  Packs that are not newer than
+// the one in use are not installed.
+func Install(dir string, b, sig []byte) (bool, error) {
+	p, err := Verify(b, sig)
+	if err != nil {
+		return false, err
+	}
+	if p.Version <= Version() {
+		return false, nil
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, SigFile), sig, utils.FileMode); err != nil {
+		return false, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, PackFile), b, utils.FileMode); err != nil {
+		return false, err
+	}
+
+	setOverride(p)
+	return true, nil
+}
+
+func setOverride(p *Pack) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	log.Printf("policy: Using policy pack version %d, replacing %d assets.", p.Version, len(p.Assets))
+	override = p
+}
+
+func init() {
+	if b, err := data.Asset(manifestAsset); err != nil {
+		panic(err)
+	} else if err = json.Unmarshal(b, &embedded); err != nil {
+		panic(err)
+	}
+	if b, err := data.Asset("version"); err != nil {
+		panic(err)
+	} else {
+		launcherVersion = strings.TrimSpace(string(b))
+	}
+	policyNames = make(map[string]bool)
+	for _, v := range embedded.Assets {
+		policyNames[v] = true
+	}
+
+	var keys []string
+	if b, err := data.Asset(keysAsset); err != nil {
+		panic(err)
+	} else if err = json.Unmarshal(b, &keys); err != nil {
+		panic(err)
+	}
+	for _, v := range keys {
+		k, err := hex.DecodeString(v)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			panic("policy: malformed policy signing key: " + v)
+		}
+		trustedKeys = append(trustedKeys, ed25519.PublicKey(k))
+	}
+}
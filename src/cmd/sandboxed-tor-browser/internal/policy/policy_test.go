@@ -0,0 +1,91 @@
+// policy_test.go - Runtime policy pack tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package policy
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestLauncherVersionCompare(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		want int
+	}{
+		{"0.20.0", "0.20.0", 0},
+		{"0.20", "0.20.0", 0},
+		{"0.20.0", "0.20.1", -1},
+		{"0.20.1", "0.20.0", 1},
+		{"0.9.0", "0.20.0", -1},
+		{"1.0", "0.20.5", 1},
+	}
+	for _, tc := range testCases {
+		cmp, err := launcherVersionCompare(tc.a, tc.b)
+		if err != nil {
+			t.Errorf("launcherVersionCompare(%q, %q): %v", tc.a, tc.b, err)
+		} else if cmp != tc.want {
+			t.Errorf("launcherVersionCompare(%q, %q) = %d, want %d", tc.a, tc.b, cmp, tc.want)
+		}
+	}
+
+	for _, v := range []string{"", "0.20.", "0.20.0a1", "0.-1.0"} {
+		if _, err := launcherVersionCompare(v, "0.20.0"); err == nil {
+			t.Errorf("launcherVersionCompare(%q): accepted malformed version", v)
+		}
+	}
+}
+
+func TestFilterCompat(t *testing.T) {
+	p := &Pack{
+		Version: 2,
+		Assets: map[string][]byte{
+			"torrc":                  []byte("any"),
+			"torrc-bridges":          []byte("min"),
+			"torrc-alpha":            []byte("max"),
+			"policy/control.json":    []byte("range"),
+			"policy/stub.json":       []byte("too new"),
+			"policy/extensions.json": []byte("too old"),
+			"installer/hpkp.json":    []byte("missing"),
+			"launcher-amd64.seccomp": []byte("malformed"),
+		},
+		Compat: map[string]*AssetCompat{
+			"torrc":                  {},
+			"torrc-bridges":          {MinLauncher: "0.20.0"},
+			"torrc-alpha":            {MaxLauncher: "0.21.0"},
+			"policy/control.json":    {MinLauncher: "0.19.2", MaxLauncher: "0.20.1"},
+			"policy/stub.json":       {MinLauncher: "0.20.1"},
+			"policy/extensions.json": {MaxLauncher: "0.20.0"},
+			"launcher-amd64.seccomp": {MinLauncher: "0.20-rc"},
+		},
+	}
+	p.filterCompat("0.20.0")
+
+	var got []string
+	for name := range p.Assets {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := []string{"policy/control.json", "torrc", "torrc-alpha", "torrc-bridges"}
+	if len(got) != len(want) {
+		t.Fatalf("filterCompat: assets %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("filterCompat: assets %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// bits.go - QR code bitstream decoding.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package qr
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errTruncated = errors.New("qr: truncated data")
+
+const alphanumericChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// The segment modes.
+const (
+	modeTerminator       = 0x0
+	modeNumeric          = 0x1
+	modeAlphanumeric     = 0x2
+	modeStructuredAppend = 0x3
+	modeByte             = 0x4
+	modeFNC1First        = 0x5
+	modeECI              = 0x7
+	modeKanji            = 0x8
+	modeFNC1Second       = 0x9
+)
+
+type bitReader struct {
+	b   []byte
+	off int
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.b)*8 - r.off
+}
+
+func (r *bitReader) read(n int) (int, error) {
+	if n > r.remaining() {
+		return 0, errTruncated
+	}
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := (r.b[r.off>>3] >> uint(7-r.off&7)) & 1
+		v = v<<1 | int(bit)
+		r.off++
+	}
+	return v, nil
+}
+
+// charCountBits returns the size of the character count field for the mode
+// and version.
+func charCountBits(mode, version int) int {
+	idx := 0
+	switch {
+	case version >= 27:
+		idx = 2
+	case version >= 10:
+		idx = 1
+	}
+	switch mode {
+	case modeNumeric:
+		return [3]int{10, 12, 14}[idx]
+	case modeAlphanumeric:
+		return [3]int{9, 11, 13}[idx]
+	case modeByte:
+		return [3]int{8, 16, 16}[idx]
+	default: // modeKanji
+		return [3]int{8, 10, 12}[idx]
+	}
+}
+
+// decodeSegments decodes the data codewords into the contents.  ECI
+// designators are skipped, and byte mode data is returned as is, which is
+// correct for the ASCII/UTF-8 payloads that are of interest.
+func decodeSegments(data []byte, version int) ([]byte, error) {
+	r := &bitReader{b: data}
+	var out []byte
+	for r.remaining() >= 4 {
+		mode, _ := r.read(4)
+		switch mode {
+		case modeTerminator:
+			return out, nil
+		case modeNumeric, modeAlphanumeric, modeByte:
+			count, err := r.read(charCountBits(mode, version))
+			if err != nil {
+				return nil, err
+			}
+			switch mode {
+			case modeNumeric:
+				out, err = decodeNumeric(r, count, out)
+			case modeAlphanumeric:
+				out, err = decodeAlphanumeric(r, count, out)
+			default:
+				for i := 0; i < count && err == nil; i++ {
+					var v int
+					if v, err = r.read(8); err == nil {
+						out = append(out, byte(v))
+					}
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		case modeECI:
+			v, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case v&0x80 == 0:
+			case v&0xc0 == 0x80:
+				_, err = r.read(8)
+			case v&0xe0 == 0xc0:
+				_, err = r.read(16)
+			default:
+				err = fmt.Errorf("qr: invalid ECI designator")
+			}
+			if err != nil {
+				return nil, err
+			}
+		case modeStructuredAppend:
+			if _, err := r.read(16); err != nil {
+				return nil, err
+			}
+		case modeFNC1First:
+		case modeFNC1Second:
+			if _, err := r.read(8); err != nil {
+				return nil, err
+			}
+		case modeKanji:
+			return nil, fmt.Errorf("qr: kanji mode is not supported")
+		default:
+			return nil, fmt.Errorf("qr: invalid mode: %d", mode)
+		}
+	}
+	return out, nil
+}
+
+func decodeNumeric(r *bitReader, count int, out []byte) ([]byte, error) {
+	for count > 0 {
+		n, nBits := 3, 10
+		switch count {
+		case 1:
+			n, nBits = 1, 4
+		case 2:
+			n, nBits = 2, 7
+		}
+		v, err := r.read(nBits)
+		if err != nil {
+			return nil, err
+		}
+		s := fmt.Sprintf("%0*d", n, v)
+		if len(s) != n {
+			return nil, fmt.Errorf("qr: invalid numeric data")
+		}
+		out = append(out, s...)
+		count -= n
+	}
+	return out, nil
+}
+
+func decodeAlphanumeric(r *bitReader, count int, out []byte) ([]byte, error) {
+	for ; count >= 2; count -= 2 {
+		v, err := r.read(11)
+		if err != nil {
+			return nil, err
+		}
+		if v >= 45*45 {
+			return nil, fmt.Errorf("qr: invalid alphanumeric data")
+		}
+		out = append(out, alphanumericChars[v/45], alphanumericChars[v%45])
+	}
+	if count == 1 {
+		v, err := r.read(6)
+		if err != nil {
+			return nil, err
+		}
+		if v >= 45 {
+			return nil, fmt.Errorf("qr: invalid alphanumeric data")
+		}
+		out = append(out, alphanumericChars[v])
+	}
+	return out, nil
+}
@@ -0,0 +1,336 @@
+// detect.go - QR code detection and sampling.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package qr
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sort"
+)
+
+var errNotFound = errors.New("qr: no QR code found")
+
+// bitmap is a binarized image, with true being dark.
+type bitmap struct {
+	w, h int
+	pix  []bool
+}
+
+func (bm *bitmap) get(x, y int) bool {
+	if x < 0 || y < 0 || x >= bm.w || y >= bm.h {
+		return false
+	}
+	return bm.pix[y*bm.w+x]
+}
+
+func (bm *bitmap) invert() *bitmap {
+	inv := &bitmap{w: bm.w, h: bm.h, pix: make([]bool, len(bm.pix))}
+	for i, v := range bm.pix {
+		inv.pix[i] = !v
+	}
+	return inv
+}
+
+// binarize converts the image to a bitmap with a global (Otsu) threshold,
+// compositing any transparency onto white.
+func binarize(img image.Image) *bitmap {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	lum := make([]uint8, w*h)
+	var hist [256]int
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			bg := 0xffff - a
+			l := (299*(r+bg) + 587*(g+bg) + 114*(bl+bg)) / 1000
+			v := uint8(l >> 8)
+			lum[y*w+x] = v
+			hist[v]++
+		}
+	}
+
+	total := w * h
+	var sum float64
+	for i, n := range hist {
+		sum += float64(i * n)
+	}
+	var sumB, bestVar float64
+	var wB int
+	threshold := 127
+	for i, n := range hist {
+		if wB += n; wB == 0 {
+			continue
+		}
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+		sumB += float64(i * n)
+		mB := sumB / float64(wB)
+		mF := (sum - sumB) / float64(wF)
+		if v := float64(wB) * float64(wF) * (mB - mF) * (mB - mF); v > bestVar {
+			bestVar, threshold = v, i
+		}
+	}
+
+	bm := &bitmap{w: w, h: h, pix: make([]bool, w*h)}
+	for i, v := range lum {
+		bm.pix[i] = int(v) <= threshold
+	}
+	return bm
+}
+
+type point struct {
+	x, y float64
+}
+
+func (p point) sub(q point) point {
+	return point{p.x - q.x, p.y - q.y}
+}
+
+func (p point) dist(q point) float64 {
+	return math.Hypot(p.x-q.x, p.y-q.y)
+}
+
+// finder is a candidate finder pattern.
+type finder struct {
+	point
+	moduleSize float64
+	count      int
+}
+
+// isFinderRatio returns true iff the 5 run lengths are approximately in the
+// 1:1:3:1:1 ratio of a finder pattern.
+func isFinderRatio(runs [5]int) bool {
+	total := 0
+	for _, v := range runs {
+		if v == 0 {
+			return false
+		}
+		total += v
+	}
+	if total < 7 {
+		return false
+	}
+	module := float64(total) / 7
+	tol := module / 2
+	return math.Abs(module-float64(runs[0])) < tol &&
+		math.Abs(module-float64(runs[1])) < tol &&
+		math.Abs(3*module-float64(runs[2])) < 3*tol &&
+		math.Abs(module-float64(runs[3])) < tol &&
+		math.Abs(module-float64(runs[4])) < tol
+}
+
+// crossCheck measures the finder pattern runs through (cx, cy) along the
+// direction (dx, dy), and returns the center offset along the direction, and
+// the total width, if the runs are consistent with a finder pattern.
+func (bm *bitmap) crossCheck(cx, cy, dx, dy int, maxRun int) (float64, int, bool) {
+	if !bm.get(cx, cy) {
+		return 0, 0, false
+	}
+
+	var runs [5]int
+	// Walk backwards from the center through the center run, the light
+	// ring, and the outer dark ring.
+	i := 0
+	for ; bm.get(cx-i*dx, cy-i*dy); i++ {
+		runs[2]++
+	}
+	for ; inBounds(bm, cx-i*dx, cy-i*dy) && !bm.get(cx-i*dx, cy-i*dy) && runs[1] <= maxRun; i++ {
+		runs[1]++
+	}
+	for ; bm.get(cx-i*dx, cy-i*dy) && runs[0] <= maxRun; i++ {
+		runs[0]++
+	}
+	j := 1
+	for ; bm.get(cx+j*dx, cy+j*dy); j++ {
+		runs[2]++
+	}
+	for ; inBounds(bm, cx+j*dx, cy+j*dy) && !bm.get(cx+j*dx, cy+j*dy) && runs[3] <= maxRun; j++ {
+		runs[3]++
+	}
+	for ; bm.get(cx+j*dx, cy+j*dy) && runs[4] <= maxRun; j++ {
+		runs[4]++
+	}
+	if !isFinderRatio(runs) {
+		return 0, 0, false
+	}
+
+	total := runs[0] + runs[1] + runs[2] + runs[3] + runs[4]
+	// The pattern ends at offset j-1, so the center run ends at the
+	// (exclusive) offset j-runs[4]-runs[3].
+	center := float64(j-runs[4]-runs[3]) - float64(runs[2])/2
+	return center, total, true
+}
+
+func inBounds(bm *bitmap, x, y int) bool {
+	return x >= 0 && y >= 0 && x < bm.w && y < bm.h
+}
+
+// findFinders scans the bitmap for finder patterns.
+func (bm *bitmap) findFinders() []*finder {
+	var finders []*finder
+	addFinder := func(p point, moduleSize float64) {
+		for _, f := range finders {
+			if math.Abs(f.x-p.x) <= 2*f.moduleSize && math.Abs(f.y-p.y) <= 2*f.moduleSize && math.Abs(f.moduleSize-moduleSize) <= f.moduleSize {
+				n := float64(f.count)
+				f.x = (f.x*n + p.x) / (n + 1)
+				f.y = (f.y*n + p.y) / (n + 1)
+				f.moduleSize = (f.moduleSize*n + moduleSize) / (n + 1)
+				f.count++
+				return
+			}
+		}
+		finders = append(finders, &finder{point: p, moduleSize: moduleSize, count: 1})
+	}
+
+	for y := 0; y < bm.h; y++ {
+		// Run length encode the row, noting where each run starts.
+		var lens, starts []int
+		for x := 0; x < bm.w; x++ {
+			if x == 0 || bm.get(x, y) != bm.get(x-1, y) {
+				lens = append(lens, 0)
+				starts = append(starts, x)
+			}
+			lens[len(lens)-1]++
+		}
+
+		// Check every window of 5 runs that starts with a dark run.
+		first := 0
+		if !bm.get(0, y) {
+			first = 1
+		}
+		for i := first; i+5 <= len(lens); i += 2 {
+			var runs [5]int
+			copy(runs[:], lens[i:i+5])
+			if !isFinderRatio(runs) {
+				continue
+			}
+			total := runs[0] + runs[1] + runs[2] + runs[3] + runs[4]
+			cx := starts[i+2] + runs[2]/2
+			cy, vTotal, ok := bm.crossCheck(cx, y, 0, 1, runs[2])
+			if !ok {
+				continue
+			}
+			icy := y + int(math.Floor(cy))
+			cxOff, hTotal, ok := bm.crossCheck(cx, icy, 1, 0, runs[2])
+			if !ok {
+				continue
+			}
+			moduleSize := float64(total+vTotal+hTotal) / 21
+			addFinder(point{float64(cx) + cxOff, float64(y) + cy}, moduleSize)
+		}
+	}
+	return finders
+}
+
+// orderFinders picks the best triple of finder patterns, and returns them as
+// the top left, top right, and bottom left patterns.
+func orderFinders(candidates []*finder) (*finder, *finder, *finder, error) {
+	var fs []*finder
+	for _, f := range candidates {
+		if f.count >= 2 {
+			fs = append(fs, f)
+		}
+	}
+	sort.SliceStable(fs, func(i, j int) bool { return fs[i].count > fs[j].count })
+	if len(fs) > 10 {
+		fs = fs[:10]
+	}
+
+	var best [3]*finder
+	bestScore := math.Inf(1)
+	for i := 0; i < len(fs); i++ {
+		for j := i + 1; j < len(fs); j++ {
+			for k := j + 1; k < len(fs); k++ {
+				tl, tr, bl := orient(fs[i], fs[j], fs[k])
+				a, b := tr.dist(tl.point), bl.dist(tl.point)
+				if a == 0 || b == 0 {
+					continue
+				}
+				ms := (tl.moduleSize + tr.moduleSize + bl.moduleSize) / 3
+
+				// The patterns should be the same size, and form an
+				// isosceles right triangle.
+				v1, v2 := tr.sub(tl.point), bl.sub(tl.point)
+				cos := (v1.x*v2.x + v1.y*v2.y) / (a * b)
+				score := math.Abs(a-b)/math.Max(a, b) + math.Abs(cos)
+				for _, f := range []*finder{tl, tr, bl} {
+					score += math.Abs(f.moduleSize-ms) / ms
+				}
+				if score < bestScore {
+					bestScore, best = score, [3]*finder{tl, tr, bl}
+				}
+			}
+		}
+	}
+	if best[0] == nil || bestScore > 0.5 {
+		return nil, nil, nil, errNotFound
+	}
+	return best[0], best[1], best[2], nil
+}
+
+// orient orders three finder patterns into top left, top right, and bottom
+// left.  The top left pattern is opposite the longest side, and the cross
+// product determines the handedness of the remaining two.
+func orient(a, b, c *finder) (*finder, *finder, *finder) {
+	ab, bc, ac := a.dist(b.point), b.dist(c.point), a.dist(c.point)
+	var tl, p, q *finder
+	switch {
+	case bc >= ab && bc >= ac:
+		tl, p, q = a, b, c
+	case ac >= ab && ac >= bc:
+		tl, p, q = b, a, c
+	default:
+		tl, p, q = c, a, b
+	}
+	v1, v2 := p.sub(tl.point), q.sub(tl.point)
+	if v1.x*v2.y-v1.y*v2.x < 0 {
+		p, q = q, p
+	}
+	return tl, p, q
+}
+
+// sampler maps module coordinates to image coordinates via the affine
+// transform defined by the finder pattern centers.
+type sampler struct {
+	origin, u, v point
+}
+
+func newSampler(tl, tr, bl *finder, dim int) *sampler {
+	span := float64(dim - 7)
+	s := &sampler{origin: tl.point}
+	d := tr.sub(tl.point)
+	s.u = point{d.x / span, d.y / span}
+	d = bl.sub(tl.point)
+	s.v = point{d.x / span, d.y / span}
+	return s
+}
+
+func (s *sampler) sample(bm *bitmap, dim int) *grid {
+	g := newGrid(dim)
+	for y := 0; y < dim; y++ {
+		for x := 0; x < dim; x++ {
+			mx, my := float64(x)-3, float64(y)-3
+			px := s.origin.x + mx*s.u.x + my*s.v.x
+			py := s.origin.y + mx*s.u.y + my*s.v.y
+			g.set(x, y, bm.get(int(math.Floor(px)), int(math.Floor(py))))
+		}
+	}
+	return g
+}
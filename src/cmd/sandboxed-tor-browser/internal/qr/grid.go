@@ -0,0 +1,279 @@
+// grid.go - QR code module grid.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package qr
+
+import (
+	"errors"
+	"math/bits"
+)
+
+var (
+	errFormat  = errors.New("qr: failed to read the format information")
+	errVersion = errors.New("qr: failed to read the version information")
+)
+
+// maxInfoErrors is the maximum number of bit errors tolerated in the format
+// and version information.
+const maxInfoErrors = 3
+
+// grid is the sampled modules of a symbol, with true being dark.
+type grid struct {
+	dim     int
+	modules []bool
+}
+
+func newGrid(dim int) *grid {
+	return &grid{dim: dim, modules: make([]bool, dim*dim)}
+}
+
+func (g *grid) get(x, y int) bool {
+	return g.modules[y*g.dim+x]
+}
+
+func (g *grid) set(x, y int, v bool) {
+	g.modules[y*g.dim+x] = v
+}
+
+func (g *grid) bit(x, y, i int) uint32 {
+	if g.get(x, y) {
+		return 1 << uint(i)
+	}
+	return 0
+}
+
+// formatBits returns the format information codeword for the error
+// correction level and mask.
+func formatBits(ecl, mask int) uint32 {
+	data := uint32(ecl<<3 | mask)
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionBits returns the version information codeword for the version.
+func versionBits(version int) uint32 {
+	rem := uint32(version)
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	return uint32(version)<<12 | rem
+}
+
+// readFormat returns the error correction level and mask, from which ever
+// copy of the format information is the least damaged.
+func (g *grid) readFormat() (int, int, error) {
+	var a, b uint32
+	for i := 0; i <= 5; i++ {
+		a |= g.bit(8, i, i)
+	}
+	a |= g.bit(8, 7, 6) | g.bit(8, 8, 7) | g.bit(7, 8, 8)
+	for i := 9; i < 15; i++ {
+		a |= g.bit(14-i, 8, i)
+	}
+	for i := 0; i < 8; i++ {
+		b |= g.bit(g.dim-1-i, 8, i)
+	}
+	for i := 8; i < 15; i++ {
+		b |= g.bit(8, g.dim-15+i, i)
+	}
+
+	bestDist, bestEcl, bestMask := maxInfoErrors+1, 0, 0
+	for ecl := 0; ecl < 4; ecl++ {
+		for mask := 0; mask < 8; mask++ {
+			v := formatBits(ecl, mask)
+			for _, c := range []uint32{a, b} {
+				if d := bits.OnesCount32(v ^ c); d < bestDist {
+					bestDist, bestEcl, bestMask = d, ecl, mask
+				}
+			}
+		}
+	}
+	if bestDist > maxInfoErrors {
+		return 0, 0, errFormat
+	}
+	return bestEcl, bestMask, nil
+}
+
+// readVersion returns the version from which ever copy of the version
+// information is the least damaged.  Only versions >= 7 have the version
+// information.
+func (g *grid) readVersion() (int, error) {
+	var a, b uint32
+	for i := 0; i < 18; i++ {
+		x, y := g.dim-11+i%3, i/3
+		a |= g.bit(x, y, i)
+		b |= g.bit(y, x, i)
+	}
+
+	bestDist, bestVersion := maxInfoErrors+1, 0
+	for version := 7; version <= maxVersion; version++ {
+		v := versionBits(version)
+		for _, c := range []uint32{a, b} {
+			if d := bits.OnesCount32(v ^ c); d < bestDist {
+				bestDist, bestVersion = d, version
+			}
+		}
+	}
+	if bestDist > maxInfoErrors {
+		return 0, errVersion
+	}
+	return bestVersion, nil
+}
+
+// functionModules returns the grid of the function pattern modules, which
+// do not contain codewords.
+func functionModules(version int) *grid {
+	dim := dimension(version)
+	f := newGrid(dim)
+	fill := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				if x >= 0 && y >= 0 && x < dim && y < dim {
+					f.set(x, y, true)
+				}
+			}
+		}
+	}
+
+	// Timing patterns.
+	fill(6, 0, 1, dim)
+	fill(0, 6, dim, 1)
+
+	// Finder patterns and separators, along with the format information
+	// (and the dark module).
+	fill(0, 0, 9, 9)
+	fill(dim-8, 0, 8, 9)
+	fill(0, dim-8, 9, 8)
+
+	// Alignment patterns.
+	pos := alignmentPatternPositions(version)
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			fill(x-2, y-2, 5, 5)
+		}
+	}
+
+	// Version information.
+	if version >= 7 {
+		fill(dim-11, 0, 3, 6)
+		fill(0, dim-11, 6, 3)
+	}
+
+	return f
+}
+
+func maskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// readCodewords returns the unmasked raw codewords, in placement order.
+func (g *grid) readCodewords(version, mask int) []byte {
+	f := functionModules(version)
+	codewords := make([]byte, numRawDataModules(version)/8)
+	i := 0
+	for right := g.dim - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern.
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < g.dim; vert++ {
+			y := vert
+			if upward {
+				y = g.dim - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if f.get(x, y) || i >= len(codewords)*8 {
+					continue
+				}
+				if g.get(x, y) != maskBit(mask, x, y) {
+					codewords[i>>3] |= 0x80 >> uint(i&7)
+				}
+				i++
+			}
+		}
+	}
+	return codewords
+}
+
+// decodeData de-interleaves and error corrects the raw codewords, and returns
+// the data codewords.
+func decodeData(raw []byte, version, ecl int) ([]byte, error) {
+	numBlocks := numErrorCorrectionBlocks[ecl][version]
+	numEcc := eccCodewordsPerBlock[ecl][version]
+	numShort := numBlocks - len(raw)%numBlocks
+	shortLen := len(raw) / numBlocks
+
+	blocks := make([][]byte, numBlocks)
+	for i := range blocks {
+		blockLen := shortLen
+		if i >= numShort {
+			blockLen++
+		}
+		blocks[i] = make([]byte, blockLen)
+	}
+
+	// The data codewords are interleaved first, with the long blocks
+	// having one extra, followed by the error correction codewords.
+	off := 0
+	for i := 0; i < shortLen+1-numEcc; i++ {
+		for _, blk := range blocks {
+			if i < len(blk)-numEcc {
+				blk[i] = raw[off]
+				off++
+			}
+		}
+	}
+	for i := 0; i < numEcc; i++ {
+		for _, blk := range blocks {
+			blk[len(blk)-numEcc+i] = raw[off]
+			off++
+		}
+	}
+
+	var data []byte
+	for _, blk := range blocks {
+		if err := rsCorrect(blk, numEcc); err != nil {
+			return nil, err
+		}
+		data = append(data, blk[:len(blk)-numEcc]...)
+	}
+	return data, nil
+}
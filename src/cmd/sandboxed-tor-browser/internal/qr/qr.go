@@ -0,0 +1,116 @@
+// qr.go - QR code decoder.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package qr implements a minimal QR code decoder, sufficient for reading
+// bridge lines from screenshots and saved images.  Perspective distortion is
+// not corrected for, so photographs taken at an angle are unlikely to work.
+package qr
+
+import (
+	"image"
+	"math"
+)
+
+// Decode locates a single QR code in the image, in either polarity, and
+// returns the decoded contents.
+func Decode(img image.Image) ([]byte, error) {
+	bm := binarize(img)
+	b, err := decodeBitmap(bm)
+	if err == nil {
+		return b, nil
+	}
+	b, iErr := decodeBitmap(bm.invert())
+	if iErr == nil {
+		return b, nil
+	} else if err == errNotFound {
+		err = iErr
+	}
+	return nil, err
+}
+
+func decodeBitmap(bm *bitmap) ([]byte, error) {
+	tl, tr, bl, err := orderFinders(bm.findFinders())
+	if err != nil {
+		return nil, err
+	}
+
+	// Estimate the dimension from the distance between the finder pattern
+	// centers, which are 7 modules less than the dimension apart.  Symbol
+	// dimensions are always 1 (mod 4), so try the nearest candidates.
+	ms := (tl.moduleSize + tr.moduleSize + bl.moduleSize) / 3
+
+	// The module size is measured horizontally and vertically, so it is
+	// overestimated if the symbol is rotated.
+	d := tr.sub(tl.point)
+	theta := math.Mod(math.Abs(math.Atan2(d.y, d.x)), math.Pi/2)
+	if theta > math.Pi/4 {
+		theta = math.Pi/2 - theta
+	}
+	ms *= math.Cos(theta)
+	est := int(math.Floor((tr.dist(tl.point)+bl.dist(tl.point))/(2*ms)+0.5)) + 7
+	var dims []int
+	switch est & 3 {
+	case 0:
+		dims = []int{est + 1, est - 3}
+	case 1:
+		dims = []int{est, est + 4, est - 4}
+	case 2:
+		dims = []int{est - 1, est + 3}
+	default:
+		dims = []int{est - 2, est + 2}
+	}
+
+	// The error from the most likely dimension is the most informative.
+	err = errNotFound
+	for i, dim := range dims {
+		if dim < dimension(minVersion) || dim > dimension(maxVersion) {
+			continue
+		}
+		b, dErr := decodeGrid(bm, tl, tr, bl, dim)
+		if dErr == nil {
+			return b, nil
+		} else if i == 0 {
+			err = dErr
+		}
+	}
+	return nil, err
+}
+
+func decodeGrid(bm *bitmap, tl, tr, bl *finder, dim int) ([]byte, error) {
+	g := newSampler(tl, tr, bl, dim).sample(bm, dim)
+	version := (dim - 17) / 4
+	if version >= 7 {
+		// Trust the version information over the estimate.
+		v, err := g.readVersion()
+		if err != nil {
+			return nil, err
+		}
+		if v != version {
+			version, dim = v, dimension(v)
+			g = newSampler(tl, tr, bl, dim).sample(bm, dim)
+		}
+	}
+
+	ecl, mask, err := g.readFormat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeData(g.readCodewords(version, mask), version, ecl)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSegments(data, version)
+}
@@ -0,0 +1,480 @@
+// qr_test.go - QR code decoder tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package qr
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// The bridge lines as handed out by BridgeDB's QR codes.
+var testBridgeLines = []string{
+	"obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=Ab0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ/+0123 iat-mode=0",
+	"['obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=Ab0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ/+0123 iat-mode=0', 'obfs4 [2001:db8::1]:9001 76543210FEDCBA9876543210FEDCBA9876543210 cert=Zz9876543210zyxwvutsrqponmlkjihgfedcbaZYXWVUTSRQPONMLKJIHGFEDCBA+/9876 iat-mode=1']",
+	"192.0.2.2:80 0123456789ABCDEF0123456789ABCDEF01234567",
+}
+
+func TestInfoBits(t *testing.T) {
+	// Golden values from ISO/IEC 18004 Annex C and D.
+	for _, v := range []struct {
+		ecl, mask int
+		want      uint32
+	}{
+		{eclM, 0, 0x5412}, // 101010000010010
+		{eclL, 4, 0x662f}, // 110011000101111
+		{eclH, 7, 0x083b}, // 000100000111011
+		{eclQ, 2, 0x3f31}, // 011111100110001
+	} {
+		if got := formatBits(v.ecl, v.mask); got != v.want {
+			t.Errorf("formatBits(%d, %d): got %015b, want %015b", v.ecl, v.mask, got, v.want)
+		}
+	}
+	for _, v := range []struct {
+		version int
+		want    uint32
+	}{
+		{7, 0x07c94},  // 000111110010010100
+		{21, 0x15683}, // 010101011010000011
+		{40, 0x28c69}, // 101000110001101001
+	} {
+		if got := versionBits(v.version); got != v.want {
+			t.Errorf("versionBits(%d): got %018b, want %018b", v.version, got, v.want)
+		}
+	}
+}
+
+// helloWorld is the 1-M "HELLO WORLD" symbol's codewords, from the widely
+// used worked example, as an independent check of the test encoder.
+var helloWorld = struct {
+	data, ecc []byte
+}{
+	[]byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17},
+	[]byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+}
+
+func TestRSCorrect(t *testing.T) {
+	if got := rsEncode(helloWorld.data, len(helloWorld.ecc)); !bytes.Equal(got, helloWorld.ecc) {
+		t.Fatalf("rsEncode: got %v, want %v", got, helloWorld.ecc)
+	}
+	golden := append(append([]byte{}, helloWorld.data...), helloWorld.ecc...)
+	numEcc := len(helloWorld.ecc)
+
+	rng := rand.New(rand.NewSource(1))
+	for numErrs := 0; numErrs <= numEcc/2; numErrs++ {
+		for n := 0; n < 100; n++ {
+			block := append([]byte{}, golden...)
+			for _, i := range rng.Perm(len(block))[:numErrs] {
+				block[i] ^= byte(1 + rng.Intn(255))
+			}
+			if err := rsCorrect(block, numEcc); err != nil {
+				t.Fatalf("%d errors: rsCorrect: %v", numErrs, err)
+			}
+			if !bytes.Equal(block, golden) {
+				t.Fatalf("%d errors: rsCorrect: got %v, want %v", numErrs, block, golden)
+			}
+		}
+	}
+
+	// Beyond the capacity, the errors must never go unnoticed (or be
+	// "corrected" back to the original).
+	for n := 0; n < 1000; n++ {
+		block := append([]byte{}, golden...)
+		for _, i := range rng.Perm(len(block))[:numEcc/2+1+rng.Intn(numEcc/2)] {
+			block[i] ^= byte(1 + rng.Intn(255))
+		}
+		if err := rsCorrect(block, numEcc); err == nil && bytes.Equal(block, golden) {
+			t.Fatalf("rsCorrect: corrected more errors than the capacity")
+		}
+	}
+
+	// Every version and error correction level's block sizes.
+	for version := minVersion; version <= maxVersion; version++ {
+		for ecl := 0; ecl < 4; ecl++ {
+			numEcc := eccCodewordsPerBlock[ecl][version]
+			data := make([]byte, numRawDataModules(version)/8/numErrorCorrectionBlocks[ecl][version]-numEcc)
+			rng.Read(data)
+			block := append(append([]byte{}, data...), rsEncode(data, numEcc)...)
+			want := append([]byte{}, block...)
+			for _, i := range rng.Perm(len(block))[:numEcc/2] {
+				block[i] ^= byte(1 + rng.Intn(255))
+			}
+			if err := rsCorrect(block, numEcc); err != nil || !bytes.Equal(block, want) {
+				t.Fatalf("version %d, ecl %d: rsCorrect: failed to correct: %v", version, ecl, err)
+			}
+		}
+	}
+}
+
+func TestDecodeSegments(t *testing.T) {
+	b, err := decodeSegments(helloWorld.data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "HELLO WORLD" {
+		t.Errorf("decodeSegments: got %q, want %q", b, "HELLO WORLD")
+	}
+
+	// Truncated, and invalid mode segments.
+	for _, data := range [][]byte{
+		{0x40, 0xf0},       // Byte mode, 15 bytes, no data.
+		{0x10, 0x18, 0x56}, // Numeric mode, 6 digits, truncated.
+		{0x80, 0x00},       // Kanji.
+		{0xb0, 0x00},       // Invalid mode.
+	} {
+		if _, err := decodeSegments(data, 1); err == nil {
+			t.Errorf("decodeSegments(%x): no error", data)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, line := range testBridgeLines {
+		for ecl := 0; ecl < 4; ecl++ {
+			g := encode(t, []byte(line), ecl)
+			for rot := 0; rot < 4; rot++ {
+				for _, inverted := range []bool{false, true} {
+					img := render(g, 4, rot, inverted)
+					b, err := Decode(img)
+					if err != nil {
+						t.Errorf("ecl %d, rotation %d, inverted %v: Decode: %v", ecl, rot*90, inverted, err)
+					} else if string(b) != line {
+						t.Errorf("ecl %d, rotation %d, inverted %v: Decode: got %q, want %q", ecl, rot*90, inverted, b, line)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeDamaged(t *testing.T) {
+	line := []byte(testBridgeLines[1])
+	g := encode(t, line, eclH)
+	version := (g.dim - 17) / 4
+	f := functionModules(version)
+
+	// Flip data modules in a single region, as a smudge would, well under
+	// what level H can correct.
+	rng := rand.New(rand.NewSource(1))
+	damaged := newGrid(g.dim)
+	copy(damaged.modules, g.modules)
+	numFlips := 0
+	for y := g.dim / 2; y < g.dim/2+6; y++ {
+		for x := 12; x < 24; x++ {
+			if !f.get(x, y) && rng.Intn(2) == 0 {
+				damaged.set(x, y, !damaged.get(x, y))
+				numFlips++
+			}
+		}
+	}
+	if numFlips == 0 {
+		t.Fatal("no modules were damaged")
+	}
+	b, err := Decode(render(damaged, 4, 0, false))
+	if err != nil {
+		t.Fatalf("Decode: %v (%d modules flipped)", err, numFlips)
+	} else if !bytes.Equal(b, line) {
+		t.Fatalf("Decode: got %q, want %q", b, line)
+	}
+
+	// Damaging all of the data is detected, and not decoded as garbage.
+	for i := range damaged.modules {
+		if !f.modules[i] {
+			damaged.modules[i] = rng.Intn(2) == 0
+		}
+	}
+	if b, err = Decode(render(damaged, 4, 0, false)); err == nil {
+		t.Errorf("Decode: random data modules decoded: %q", b)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	blank := image.NewGray(image.Rect(0, 0, 64, 64))
+	noise := image.NewGray(image.Rect(0, 0, 200, 200))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(rng.Intn(2) * 255)
+	}
+	for _, v := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"empty", image.NewGray(image.Rect(0, 0, 0, 0))},
+		{"1x1", image.NewGray(image.Rect(0, 0, 1, 1))},
+		{"blank", blank},
+		{"noise", noise},
+	} {
+		if b, err := Decode(v.img); err == nil {
+			t.Errorf("%v: Decode: got %q", v.name, b)
+		}
+	}
+
+	// Crops, and random damage to a valid symbol must fail cleanly, and
+	// never panic.
+	g := encode(t, []byte(testBridgeLines[0]), eclM)
+	valid := render(g, 3, 0, false)
+	bounds := valid.Bounds()
+	for n := 0; n < 200; n++ {
+		x0, y0 := rng.Intn(bounds.Dx()), rng.Intn(bounds.Dy())
+		x1, y1 := x0+rng.Intn(bounds.Dx()-x0+1), y0+rng.Intn(bounds.Dy()-y0+1)
+		Decode(valid.SubImage(image.Rect(x0, y0, x1, y1)))
+
+		img := image.NewGray(bounds)
+		copy(img.Pix, valid.Pix)
+		for i := rng.Intn(len(img.Pix) / 4); i > 0; i-- {
+			img.Pix[rng.Intn(len(img.Pix))] ^= 0xff
+		}
+		Decode(img)
+	}
+}
+
+// rsEncode returns the numEcc error correction codewords for data.
+func rsEncode(data []byte, numEcc int) []byte {
+	// The generator polynomial (x - a^0)...(x - a^(numEcc-1)), highest
+	// degree coefficient first, with the leading 1 implied.
+	gen := make([]byte, numEcc)
+	gen[numEcc-1] = 1
+	root := byte(1)
+	for i := 0; i < numEcc; i++ {
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+
+	rem := make([]byte, numEcc)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[numEcc-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return rem
+}
+
+// encode returns the grid of a byte mode symbol containing data, at the
+// smallest version that fits.
+func encode(t *testing.T, data []byte, ecl int) *grid {
+	var version, numData int
+	for version = minVersion; version <= maxVersion; version++ {
+		numBlocks := numErrorCorrectionBlocks[ecl][version]
+		numData = numRawDataModules(version)/8 - numBlocks*eccCodewordsPerBlock[ecl][version]
+		if 4+charCountBits(modeByte, version)+len(data)*8 <= numData*8 {
+			break
+		}
+	}
+	if version > maxVersion {
+		t.Fatalf("encode: %d bytes is too large", len(data))
+	}
+
+	// The byte mode segment, terminator, and padding.
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>uint(i))&1 != 0)
+		}
+	}
+	appendBits(modeByte, 4)
+	appendBits(len(data), charCountBits(modeByte, version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < numData*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	codewords := make([]byte, numData)
+	for i, b := range bits {
+		if b {
+			codewords[i>>3] |= 0x80 >> uint(i&7)
+		}
+	}
+	for i, pad := len(bits)/8, byte(0xec); i < numData; i, pad = i+1, pad^0xec^0x11 {
+		codewords[i] = pad
+	}
+
+	// Split into blocks and interleave, the inverse of decodeData.
+	numBlocks := numErrorCorrectionBlocks[ecl][version]
+	numEcc := eccCodewordsPerBlock[ecl][version]
+	rawLen := numRawDataModules(version) / 8
+	numShort := numBlocks - rawLen%numBlocks
+	shortData := rawLen/numBlocks - numEcc
+	var dataBlocks, eccBlocks [][]byte
+	for i, off := 0, 0; i < numBlocks; i++ {
+		n := shortData
+		if i >= numShort {
+			n++
+		}
+		dataBlocks = append(dataBlocks, codewords[off:off+n])
+		eccBlocks = append(eccBlocks, rsEncode(codewords[off:off+n], numEcc))
+		off += n
+	}
+	var raw []byte
+	for i := 0; i <= shortData; i++ {
+		for _, blk := range dataBlocks {
+			if i < len(blk) {
+				raw = append(raw, blk[i])
+			}
+		}
+	}
+	for i := 0; i < numEcc; i++ {
+		for _, blk := range eccBlocks {
+			raw = append(raw, blk[i])
+		}
+	}
+
+	return place(version, ecl, 5, raw)
+}
+
+// place returns the symbol grid with the function patterns, and the raw
+// codewords masked and placed, the inverse of readCodewords.
+func place(version, ecl, mask int, raw []byte) *grid {
+	dim := dimension(version)
+	g := newGrid(dim)
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+
+	// pattern draws concentric squares of radius r, with the center and
+	// the outer ring dark, and the ring inside that light.
+	pattern := func(cx, cy, r int) {
+		for y := -r; y <= r; y++ {
+			for x := -r; x <= r; x++ {
+				d := abs(x)
+				if abs(y) > d {
+					d = abs(y)
+				}
+				g.set(cx+x, cy+y, d != r-1)
+			}
+		}
+	}
+
+	// Finder and alignment patterns.
+	pattern(3, 3, 3)
+	pattern(dim-4, 3, 3)
+	pattern(3, dim-4, 3)
+	pos := alignmentPatternPositions(version)
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			pattern(x, y, 2)
+		}
+	}
+
+	// Timing patterns, and the dark module.
+	for i := 8; i < dim-8; i++ {
+		g.set(i, 6, i%2 == 0)
+		g.set(6, i, i%2 == 0)
+	}
+	g.set(8, dim-8, true)
+
+	// Format and version information, the inverse of readFormat and
+	// readVersion.
+	fb := formatBits(ecl, mask)
+	on := func(v uint32, i int) bool { return (v>>uint(i))&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		g.set(8, i, on(fb, i))
+	}
+	g.set(8, 7, on(fb, 6))
+	g.set(8, 8, on(fb, 7))
+	g.set(7, 8, on(fb, 8))
+	for i := 9; i < 15; i++ {
+		g.set(14-i, 8, on(fb, i))
+	}
+	for i := 0; i < 8; i++ {
+		g.set(dim-1-i, 8, on(fb, i))
+	}
+	for i := 8; i < 15; i++ {
+		g.set(8, dim-15+i, on(fb, i))
+	}
+	if version >= 7 {
+		vb := versionBits(version)
+		for i := 0; i < 18; i++ {
+			x, y := dim-11+i%3, i/3
+			g.set(x, y, on(vb, i))
+			g.set(y, x, on(vb, i))
+		}
+	}
+
+	f := functionModules(version)
+	i := 0
+	for right := dim - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < dim; vert++ {
+			y := vert
+			if upward {
+				y = dim - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if f.get(x, y) {
+					continue
+				}
+				dark := i < len(raw)*8 && raw[i>>3]&(0x80>>uint(i&7)) != 0
+				g.set(x, y, dark != maskBit(mask, x, y))
+				i++
+			}
+		}
+	}
+	return g
+}
+
+// render draws the grid at scale pixels per module, with a quiet zone,
+// rotated by rot * 90 degrees clockwise.
+func render(g *grid, scale, rot int, inverted bool) *image.Gray {
+	const quiet = 4
+	size := (g.dim + 2*quiet) * scale
+	dark, light := color.Gray{0}, color.Gray{255}
+	if inverted {
+		dark, light = light, dark
+	}
+
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			mx, my := x/scale-quiet, y/scale-quiet
+			for i := 0; i < rot; i++ {
+				mx, my = my, g.dim-1-mx
+			}
+			if mx >= 0 && my >= 0 && mx < g.dim && my < g.dim && g.get(mx, my) {
+				img.SetGray(x, y, dark)
+			} else {
+				img.SetGray(x, y, light)
+			}
+		}
+	}
+	return img
+}
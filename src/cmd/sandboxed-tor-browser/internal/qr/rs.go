@@ -0,0 +1,164 @@
+// rs.go - QR code Reed-Solomon error correction.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package qr
+
+import "errors"
+
+var errUncorrectable = errors.New("qr: too many errors to correct")
+
+// The GF(2^8) arithmetic tables, for the QR code field polynomial
+// (x^8 + x^4 + x^3 + x^2 + 1).
+var gfExp, gfLog [512]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfPow returns alpha^e.
+func gfPow(e int) byte {
+	if e %= 255; e < 0 {
+		e += 255
+	}
+	return gfExp[e]
+}
+
+// polyEval evaluates a polynomial stored lowest degree coefficient first.
+func polyEval(p []byte, x byte) byte {
+	var y byte
+	for i := len(p) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ p[i]
+	}
+	return y
+}
+
+// rsCorrect corrects the errors in a block (data codewords followed by
+// numEcc error correction codewords, highest degree coefficient first) in
+// place, with the Berlekamp-Massey algorithm.
+func rsCorrect(block []byte, numEcc int) error {
+	n := len(block)
+
+	// Calculate the syndromes, bailing early if there are no errors.
+	synd := make([]byte, numEcc)
+	hasErrors := false
+	for i := range synd {
+		x := gfPow(i)
+		var s byte
+		for _, c := range block {
+			s = gfMul(s, x) ^ c
+		}
+		synd[i] = s
+		hasErrors = hasErrors || s != 0
+	}
+	if !hasErrors {
+		return nil
+	}
+
+	// Find the error locator polynomial.
+	sigma, prev := []byte{1}, []byte{1}
+	l, m, b := 0, 1, byte(1)
+	for i := 0; i < numEcc; i++ {
+		d := synd[i]
+		for j := 1; j <= l && j < len(sigma); j++ {
+			d ^= gfMul(sigma[j], synd[i-j])
+		}
+		if d == 0 {
+			m++
+			continue
+		}
+		coef := gfDiv(d, b)
+		next := make([]byte, maxInt(len(sigma), len(prev)+m))
+		copy(next, sigma)
+		for j, v := range prev {
+			next[j+m] ^= gfMul(coef, v)
+		}
+		if 2*l <= i {
+			prev, sigma = sigma, next
+			l, b, m = i+1-l, d, 1
+		} else {
+			sigma = next
+			m++
+		}
+	}
+	if 2*l > numEcc {
+		return errUncorrectable
+	}
+
+	// Find the error locations (Chien search).
+	var locs []int
+	for i := 0; i < n; i++ {
+		if polyEval(sigma, gfPow(-i)) == 0 {
+			locs = append(locs, i)
+		}
+	}
+	if len(locs) != l {
+		return errUncorrectable
+	}
+
+	// Calculate the error magnitudes (Forney), and correct.
+	omega := make([]byte, numEcc)
+	for i := range omega {
+		for j := 0; j <= i && j < len(sigma); j++ {
+			omega[i] ^= gfMul(sigma[j], synd[i-j])
+		}
+	}
+	sigmaDeriv := make([]byte, len(sigma))
+	for i := 1; i < len(sigma); i += 2 {
+		sigmaDeriv[i-1] = sigma[i]
+	}
+	for _, i := range locs {
+		xInv := gfPow(-i)
+		den := polyEval(sigmaDeriv, xInv)
+		if den == 0 {
+			return errUncorrectable
+		}
+		mag := gfMul(gfPow(i), gfDiv(polyEval(omega, xInv), den))
+		block[n-1-i] ^= mag
+	}
+
+	return nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -20,17 +20,24 @@ package sandbox
 
 import (
 	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/policy"
 	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
 	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
 	"cmd/sandboxed-tor-browser/internal/tor"
@@ -40,17 +47,85 @@ import (
 
 const restrictedLibDir = "/usr/lib"
 
-var distributionDependentLibSearchPath []string
+// Screenshot is a headless screenshot to be taken instead of running Tor
+// Browser normally.
+type Screenshot struct {
+	// URL is the URL to load.
+	URL string
 
-// RunTorBrowser launches sandboxed Tor Browser.
-func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (process *Process, err error) {
+	// File is the file name of the screenshot in the Downloads directory.
+	File string
+
+	// WindowSize is the optional `WIDTH[,HEIGHT]` of the window.
+	WindowSize string
+}
+
+var (
+	// ErrX11Disabled is the error returned when launching Tor Browser
+	// with X11 access disabled in the config.
+	ErrX11Disabled = errors.New("sandbox: X11 access is disabled, refusing to launch Tor Browser")
+
+	// ErrNoDisplay is the error returned when there is no X11 display to
+	// connect to.
+	ErrNoDisplay = x11.ErrNoDisplay
+
+	// ErrRemoteDisplay is the error returned when the X11 display is not
+	// local.
+	ErrRemoteDisplay = x11.ErrRemoteDisplay
+
+	// ErrNoFirefox is the error returned when the installed bundle is
+	// missing the firefox executable.
+	ErrNoFirefox = errors.New("sandbox: failed to find the firefox executable in the bundle")
+)
+
+// SessionStoreEntries are the firefox session store files and directories
+// in the profile.
+var SessionStoreEntries = []string{
+	"sessionstore.jsonlz4",
+	"sessionstore-backups",
+	"sessionCheckpoints.json",
+}
+
+// SessionRestoreFile is the file in the profile that tells the launcher to
+// have Tor Browser restore the previous session on the next launch.
+const SessionRestoreFile = "sandboxed-tor-browser-restore-session"
+
+// persistentExtensionIDs are the extensions with settings that are kept
+// across amnesiac launches, if enabled.
+var persistentExtensionIDs = []string{
+	"{73a6fe31-595d-460b-a920-fcc0f8843232}", // NoScript
+	"https-everywhere-eff@eff.org",           // HTTPS Everywhere
+}
+
+// extensionUserContextID is the private user context that Firefox keys the
+// extension IndexedDB storage to.
+const extensionUserContextID = "4294967295"
+
+// torBrowserSeccompFn installs the seccomp policy used by Tor Browser, and
+// the DNS leak probe, so that the probe tests the same policy.
+//
+// TODO: change and enable seccomp again (installTorBrowserSeccompProfile)
+var torBrowserSeccompFn func(*os.File) error
+
+// RunTorBrowser launches sandboxed Tor Browser.  If clipboard is not nil,
+// access to the host clipboard is mediated by it.
+func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor, clipboard *x11.Clipboard, shot *Screenshot) (process *Process, err error) {
 	const (
 		profileSubDir = "TorBrowser/Data/Browser/profile.default"
 		cachesSubDir  = "TorBrowser/Data/Browser/Caches"
 		stubPath      = "/home/amnesia/.tbb_stub.so"
+		mediaBpfPath  = "/home/amnesia/.tbb_media.bpf"
+		shadowPath    = "/home/amnesia/.tbb_shadow"
+		manifestPath  = "/home/amnesia/.tbb_shadow.manifest"
 		controlSocket = "control"
 		socksSocket   = "socks"
 		x11Socket     = "xorg"
+
+		dictionariesSubDir = "dictionaries"
+
+		// unixSocksMinVersion is the first bundle version that supports
+		// `TOR_SOCKS_IPC_PATH`.
+		unixSocksMinVersion = "8.0"
 	)
 
 	defer func() {
@@ -59,6 +134,11 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		}
 	}()
 
+	x11Mode := cfg.Sandbox.GetX11Mode()
+	if x11Mode == config.X11ModeDisabled {
+		return nil, ErrX11Disabled
+	}
+
 	h, err := newHugbox()
 	if err != nil {
 		return nil, err
@@ -67,25 +147,40 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	logger := newConsoleLogger("firefox")
 	h.stdout = logger
 	h.stderr = logger
-	//TODO: change and enable seccomp again
-	//h.seccompFn = installTorBrowserSeccompProfile
+	h.seccompFn = torBrowserSeccompFn
 	h.fakeDbus = true
 	h.mountProc = true
+	h.cgroup = newCgroupLimits("firefox", cfg)
+	h.applyContainerCompat(cfg)
+
+	// The caches and `/tmp` are backed by RAM, so limit them to protect
+	// low memory systems.
+	tmpfsSize := cfg.Sandbox.GetTmpfsSizeLimit()
+	if tmpfsSize > 0 && !h.supportsTmpfsSize() {
+		log.Printf("sandbox: bubblewrap %v does not support `--size`, tmpfs mounts are unlimited", h.bwrapVersion)
+	}
+	h.tmpSize = tmpfsSize
+
+	// Safe mode overrides, used for recovering from crash loops.
+	safeMode := cfg.Sandbox.SafeMode
+	enableAVCodec := cfg.Sandbox.EnableAVCodec && safeMode&config.SafeModeAVCodec == 0
+	enablePulseAudio := cfg.Sandbox.EnablePulseAudio && safeMode&config.SafeModePulseAudio == 0
+	enableAmnesiacProfile := cfg.Sandbox.EnableAmnesiacProfileDirectory && safeMode&config.SafeModeAmnesiacProfile == 0
+	if safeMode != 0 {
+		log.Printf("sandbox: Safe mode enabled: %x", safeMode)
+	}
 
 	// Gtk+ and PulseAudio.
-	hasAdwaita := h.appendGtk2Theme()
-	h.roBind("/usr/share/icons/hicolor", "/usr/share/icons/hicolor", true)
-	h.roBind("/usr/share/mime", "/usr/share/mime", false)
+	hasAdwaita := h.appendDesktopAssets(safeMode&config.SafeModeTheme == 0)
 
 	pulseAudioWorks := false
-	if cfg.Sandbox.EnablePulseAudio {
+	if enablePulseAudio {
 		if err = h.enablePulseAudio(); err != nil {
 			log.Printf("sandbox: failed to proxy PulseAudio: %v", err)
 		} else {
 			pulseAudioWorks = true
 		}
 	}
-	h.roBind("/usr/share/libthai/thbrk.tri", "/usr/share/libthai/thbrk.tri", true) // Thai language support (Optional).
 
 	browserHome := filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser", "Browser")
 	realBrowserHome := filepath.Join(cfg.BundleInstallDir, "Browser")
@@ -121,53 +216,139 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	extensionsDir := filepath.Join(profileDir, "extensions")
 
 	prefFile := "prefs.js"
-	//AVANIX added this, 60ESR needs this schemas...
-	//Enable Glib schemas to allow open, save etc...
-	//GENERAL for all
-	h.roBind("/usr/share/glib-2.0/schemas", "/usr/share/glib-2.0/schemas", false)
-	//TODO: Fine control
-	//h.roBind("/usr/share/glib-2.0/schemas/org.gtk.Settings.FileChooser.gschema.xml", "/usr/share/glib-2.0/schemas/org.gtk.Settings.FileChooser.gschema.xml", false)
-
-	//Allow this for some icons
-	h.roBind("/usr/share/icons/gnome", "/usr/share/icons/gnome", true)
 
 	// Filesystem stuff.
 	h.roBind(cfg.BundleInstallDir, filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser"), false)
 
-	if cfg.Sandbox.EnableAmnesiacProfileDirectory {
+	// Firefox picks the window icon by file name, so bind the override
+	// over every size of the bundle's default icon, and leave the scaling
+	// to the window manager.
+	if icon := cfg.Sandbox.WindowIcon; icon != "" {
+		if err := config.ValidateWindowIcon(icon); err != nil {
+			return nil, err
+		}
+		iconDir := filepath.Join("browser", "chrome", "icons", "default")
+		matches, _ := filepath.Glob(filepath.Join(realBrowserHome, iconDir, "default*.png"))
+		for _, m := range matches {
+			h.roBind(icon, filepath.Join(browserHome, iconDir, filepath.Base(m)), false)
+		}
+	}
+
+	// The stub is needed for the amnesiac profile copy, as well as the
+	// surrogates, so vet it up front.
+	stub, stubErr := vettedStub(manif)
+
+	if enableAmnesiacProfile {
+		// The user installed dictionaries are large, and there is nothing
+		// to be gained by having them be amnesiac.
 		excludes := []string{
 			filepath.Join(realProfileDir, prefFile),
 			realExtensionsDir,
+			filepath.Join(realProfileDir, dictionariesSubDir),
+		}
+
+		// The session store is left out entirely, so that sessions from
+		// a persistent launch are not restored, and the amnesiac
+		// session only ever exists in the tmpfs.
+		for _, ent := range SessionStoreEntries {
+			excludes = append(excludes, filepath.Join(realProfileDir, ent))
+		}
+
+		// Resetting the extension settings every launch trains users to
+		// lower their security, so optionally punch holes for them.
+		var persistent []string
+		if cfg.Sandbox.PersistExtensionSettings {
+			if persistent, err = persistentExtensionData(realProfileDir); err != nil {
+				return nil, err
+			}
+			excludes = append(excludes, persistent...)
+		}
+		var manifest []byte
+		shadowErr := stubErr
+		if shadowErr == nil {
+			if manifest, err = h.stagedShadowDir(profileDir, realProfileDir, shadowPath, excludes); err == errIrregularFileName {
+				shadowErr = fmt.Errorf("the profile contains a file name with a newline")
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if shadowErr == nil {
+			h.file(manifestPath, manifest)
+			h.setenv("TOR_STUB_SHADOW_MANIFEST", manifestPath)
+		} else {
+			log.Printf("sandbox: %v, copying the amnesiac profile in memory", shadowErr)
+			h.shadowDir(profileDir, realProfileDir, excludes)
+		}
+		h.roBind(filepath.Join(realProfileDir, dictionariesSubDir), filepath.Join(profileDir, dictionariesSubDir), true)
+		for _, p := range persistent {
+			rel, _ := filepath.Rel(realProfileDir, p)
+			h.bind(p, filepath.Join(profileDir, rel), false)
 		}
-		h.shadowDir(profileDir, realProfileDir, excludes)
 	} else {
 		h.bind(realProfileDir, profileDir, false)
 	}
 	h.roBind(filepath.Join(realProfileDir, prefFile), filepath.Join(profileDir, prefFile), true)
+	if restorePath := filepath.Join(realProfileDir, SessionRestoreFile); FileExists(restorePath) {
+		// Consumed by `mozilla.cfg`, for this launch only.
+		os.Remove(restorePath)
+		if !enableAmnesiacProfile {
+			h.setenv("SANDBOXED_TOR_BROWSER_RESTORE_SESSION", "1")
+		}
+	}
 	h.bind(realDesktopDir, desktopDir, false)
 	h.bind(realDownloadsDir, downloadsDir, false)
-	h.tmpfs(cachesDir)
+	if cfg.Sandbox.PersistentCache && !enableAmnesiacProfile {
+		// The launcher trims the cache before each launch, Firefox is
+		// told the same limit so that it evicts entries itself.
+		if err = os.MkdirAll(cfg.BrowserCacheDir, DirMode); err != nil {
+			return
+		}
+		log.Printf("sandbox: Using the persistent disk cache.")
+		h.bind(cfg.BrowserCacheDir, cachesDir, false)
+		h.setenv("SANDBOXED_TOR_BROWSER_DISK_CACHE", strconv.FormatInt(cfg.Sandbox.GetPersistentCacheSize()/1024, 10))
+	} else {
+		h.sizedTmpfs(cachesDir, tmpfsSize)
+	}
 	h.chdir = browserHome
 
+	// Spellcheck dictionaries.
+	bundleDictionaryDirs := []string{
+		filepath.Join(realBrowserHome, dictionariesSubDir),
+		filepath.Join(realBrowserHome, "TorBrowser", "Data", "Browser", dictionariesSubDir),
+	}
+	for _, dir := range bundleDictionaryDirs {
+		rel, _ := filepath.Rel(realBrowserHome, dir)
+		h.roBind(dir, filepath.Join(browserHome, rel), true)
+	}
+	if cfg.Sandbox.EnableHostDictionaries {
+		h.appendHostDictionaries(bundleDictionaryDirs)
+	}
+
 	// Explicitly bind mount the expected extensions in.
 	//
 	// If the Tor Browser developers ever decide to do something sensible like
 	// sign their XPI files, then the whitelist could be public key based, till
-	// then this may be somewhat fragile.
+	// then the set that shipped with the bundle is recorded in the manifest
+	// at install/update time, with the static list as a fallback.
 	h.tmpfs(extensionsDir)
-	for _, extName := range []string{
-		"{73a6fe31-595d-460b-a920-fcc0f8843232}.xpi", // NoScript
-		"torbutton@torproject.org.xpi",
-		"https-everywhere-eff@eff.org.xpi",
-		"tor-launcher@torproject.org.xpi",
-	} {
+	extNames := manif.Extensions
+	if len(extNames) == 0 {
+		if extNames, err = policy.Extensions(); err != nil {
+			return nil, err
+		}
+	}
+	for _, extName := range extNames {
+		if filepath.Base(extName) != extName || extName == ".." {
+			return nil, fmt.Errorf("sandbox: invalid extension name: '%v'", extName)
+		}
 		h.roBind(filepath.Join(realExtensionsDir, extName), filepath.Join(extensionsDir, extName), false)
 	}
 
 	// Env vars taken from start-tor-browser.
 	// h.setenv("LD_LIBRARY_PATH", filepath.Join(browserHome, "TorBrowser", "Tor"))
-	h.setenv("FONTCONFIG_PATH", filepath.Join(browserHome, "TorBrowser", "Data", "fontconfig"))
-	h.setenv("FONTCONFIG_FILE", "fonts.conf")
+	if err = h.appendFonts(realBrowserHome, browserHome, cfg.Sandbox.ConsistentFonts); err != nil {
+		return nil, err
+	}
 
 	// This used to be for `hardened` but may eventually be required for
 	// `alpha`, though according to trac, newer versions of selfrando fix the
@@ -200,18 +381,58 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	h.setenv("TOR_NO_DISPLAY_NETWORK_SETTINGS", "1")
 	h.setenv("TOR_HIDE_UPDATE_CHECK_UI", "1")
 
-	// Inject the AF_LOCAL compatibility hack stub into the filesystem, and
-	// supply the relevant args required for functionality.
+	// Supply the surrogate paths that are required for functionality.
 	ctrlPath := filepath.Join(h.runtimeDir, controlSocket)
 	socksPath := filepath.Join(h.runtimeDir, socksSocket)
 	h.setenv("TOR_STUB_CONTROL_SOCKET", ctrlPath)
 	h.setenv("TOR_STUB_SOCKS_SOCKET", socksPath)
 	h.bind(tor.CtrlSurrogatePath(), ctrlPath, false)
 	h.bind(tor.SocksSurrogatePath(), socksPath, false)
-	h.assetFile(stubPath, "tbb_stub.so")
 
-	ldPreload := stubPath
-	h.setenv("LD_PRELOAD", ldPreload)
+	// Newer bundles can use the SOCKS surrogate directly, in which case
+	// the control port surrogate needs to report the matching listener, or
+	// Torbutton will complain about the proxy settings.
+	useUnixSocks := false
+	switch cfg.Sandbox.GetSocksListener() {
+	case config.SocksListenerUnix:
+		useUnixSocks = true
+	case config.SocksListenerAuto:
+		useUnixSocks = manif.BundleVersionAtLeast(unixSocksMinVersion)
+	}
+	if useUnixSocks {
+		log.Printf("sandbox: Using the AF_LOCAL SOCKS surrogate directly")
+		h.setenv("TOR_SOCKS_IPC_PATH", socksPath)
+		tor.SetSocksListenerPath(socksPath)
+	} else {
+		tor.SetSocksListenerPath("")
+	}
+
+	// Inject the AF_LOCAL compatibility hack stub into the filesystem.  It
+	// is required, unless the bundle can use both surrogates directly.
+	if stubErr != nil {
+		if !useUnixSocks {
+			return nil, fmt.Errorf("sandbox: %v, and Tor Browser %v can not be launched without it", stubErr, manif.Version)
+		}
+		log.Printf("sandbox: %v, launching Tor Browser without it", stubErr)
+		h.setenv("TOR_CONTROL_IPC_PATH", ctrlPath)
+	} else {
+		h.file(stubPath, stub)
+		h.setenv("LD_PRELOAD", stubPath)
+	}
+
+	// The GPU and RDD processes get an additional filter, installed by the
+	// stub on startup.  This will need revisiting if GL/VA-API passthrough
+	// is ever added, since the render node ioctls would need to be allowed.
+	if cfg.Sandbox.StrictMediaProcesses && stub == nil {
+		log.Printf("sandbox: The strict media process filter requires the stub, disabling")
+	} else if cfg.Sandbox.StrictMediaProcesses {
+		bpf, err := mediaSeccompProgram()
+		if err != nil {
+			return nil, err
+		}
+		h.file(mediaBpfPath, bpf)
+		h.setenv("TOR_STUB_MEDIA_SECCOMP", mediaBpfPath)
+	}
 
 	// Hardware accelerated OpenGL will not work, and never will.
 	h.setenv("LIBGL_ALWAYS_SOFTWARE", "1")
@@ -219,9 +440,17 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	// Crashdumps regardless of being sanitized or not, not to be trusted.
 	h.setenv("MOZ_CRASHREPORTER_DISABLE", "1")
 
+	// The wrapper script is bypassed, so figure out which file is the
+	// actual firefox binary.
+	firefoxBin, err := findFirefoxBinary(realBrowserHome)
+	if err != nil {
+		return nil, err
+	}
+	realFirefoxPath := filepath.Join(realBrowserHome, firefoxBin)
+	Debugf("sandbox: firefox binary: %v", firefoxBin)
+
 	// Tor Browser currently is incompatible with PaX MPROTECT, apply the
 	// override if needed.
-	realFirefoxPath := filepath.Join(realBrowserHome, "firefox.real")
 
 	needsPaXPaths := []string{
 		realFirefoxPath,
@@ -270,7 +499,7 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		extraLibs = append(extraLibs, glExtraLibs...)
 		ldLibraryPath = ldLibraryPath + glLibPaths
 
-		if cfg.Sandbox.EnablePulseAudio && pulseAudioWorks {
+		if enablePulseAudio && pulseAudioWorks {
 			paLibs, paPath, paExtraPath, err := h.appendRestrictedPulseAudio(cache)
 			if err != nil {
 				log.Printf("sandbox: Failed to find PulseAudio libraries: %v", err)
@@ -282,7 +511,7 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		}
 
 		allowFfmpeg := false
-		if cfg.Sandbox.EnableAVCodec {
+		if enableAVCodec {
 			if codec := findBestCodec(cache); codec != "" {
 				extraLibs = append(extraLibs, codec)
 				allowFfmpeg = true
@@ -301,22 +530,82 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		extraLibs = append(extraLibs, gtkExtraLibs...)
 		ldLibraryPath = ldLibraryPath + gtkLibPaths
 
-		if err := h.appendLibraries(cache, binaries, extraLibs, ldLibraryPath, filterFn); err != nil {
+		// Resolving the libraries is slow, so the result is pinned per
+		// bundle version, and reused till something changes.
+		variant := fmt.Sprintf("ffmpeg=%v", allowFfmpeg)
+		libs, err := torBrowserLibraries(cfg, manif, cache, binaries, extraLibs, ldLibraryPath, variant, filterFn)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.bindLibraries(cache, libs); err != nil {
 			return nil, err
 		}
 	}
 	h.setenv("LD_LIBRARY_PATH", filepath.Join(browserHome, "TorBrowser", "Tor")+extraLdLibraryPath)
 
-	h.cmd = filepath.Join(browserHome, "firefox.real")
+	h.setUserEnv(cfg.Sandbox.ExtraEnv)
+
+	h.cmd = filepath.Join(browserHome, firefoxBin)
 
-	h.cmdArgs = []string{"--class", "Tor Browser", "-profile", profileDir}
+	windowClass := cfg.Sandbox.GetWindowClass()
+	if err := config.ValidateWindowClass(windowClass); err != nil {
+		return nil, err
+	}
+	h.cmdArgs = []string{"--class", windowClass}
+	if windowName := cfg.Sandbox.WindowName; windowName != "" {
+		if err := config.ValidateWindowClass(windowName); err != nil {
+			return nil, err
+		}
+		h.cmdArgs = append(h.cmdArgs, "--name", windowName)
+	}
+	h.cmdArgs = append(h.cmdArgs, "-profile", profileDir)
+	if shot != nil {
+		// Firefox exits once the screenshot is written to the Downloads
+		// bind mount.
+		if filepath.Base(shot.File) != shot.File {
+			return nil, fmt.Errorf("sandbox: invalid screenshot file name: '%v'", shot.File)
+		}
+		h.cmdArgs = append(h.cmdArgs, "--headless", "--screenshot", filepath.Join(downloadsDir, shot.File))
+		if shot.WindowSize != "" {
+			h.cmdArgs = append(h.cmdArgs, "--window-size", shot.WindowSize)
+		}
+		h.cmdArgs = append(h.cmdArgs, shot.URL)
+	}
 
 	// Do X11 last, because of the surrogate.
-	x11SurrogatePath := filepath.Join(cfg.RuntimeDir, x11Socket)
-	x, err := x11.New(cfg.Sandbox.Display, h.hostname, x11SurrogatePath)
+	x11TermHook, err := h.appendX11(cfg, clipboard, filepath.Join(cfg.RuntimeDir, x11Socket))
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := h.run()
+	if err != nil {
+		x11TermHook()
+		return nil, err
+	} else {
+		proc.AddTermHook(x11TermHook)
+	}
+
+	return proc, nil
+}
+
+// appendX11 gives the sandbox access to the host X11 server, via the
+// surrogate at surrogatePath unless disabled, and returns the hook that
+// cleans up the surrogate once the sandbox exits.
+func (h *hugbox) appendX11(cfg *config.Config, clipboard *x11.Clipboard, surrogatePath string) (func(), error) {
+	x, err := x11.New(cfg.Sandbox.Display, h.hostname, surrogatePath)
 	if err != nil {
 		return nil, err
 	} else {
+		if cfg.Sandbox.Screen != 0 {
+			x.Screen = cfg.Sandbox.Screen
+		}
+		x.NormalizeScreens = cfg.Sandbox.NormalizeX11Screens
+		x.Clipboard = clipboard
+		if x.Extensions, err = x11.ExtensionWhitelist(cfg.Sandbox.X11EnableExtensions, cfg.Sandbox.X11DisableExtensions); err != nil {
+			return nil, err
+		}
+
 		h.setenv("DISPLAY", x.Display)
 		h.dir(x11.SockDir)
 		if x.Xauthority != nil {
@@ -324,7 +613,21 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 			h.setenv("XAUTHORITY", xauthPath)
 			h.file(xauthPath, x.Xauthority)
 		}
-		if err = x.LaunchSurrogate(); err != nil {
+		if cfg.Sandbox.GetX11Mode() == config.X11ModeDirect {
+			// Everything that the surrogate does is bypassed, so let the
+			// user know what they are giving up.
+			log.Printf("sandbox: X11: WARNING: Binding the host X11 socket directly, all X11 protocol filtering is disabled.")
+			if x.NormalizeScreens || x.Screen != 0 {
+				log.Printf("sandbox: X11: WARNING: Screen selection and normalization require the surrogate.")
+			}
+			if x.Clipboard != nil {
+				log.Printf("sandbox: X11: WARNING: Clipboard brokering requires the surrogate.")
+			}
+			if len(cfg.Sandbox.X11DisableExtensions) > 0 {
+				log.Printf("sandbox: X11: WARNING: Disabling extensions requires the surrogate.")
+			}
+			x.UseHostSocket()
+		} else if err = x.LaunchSurrogate(); err != nil {
 			return nil, err
 		}
 		h.bind(x.Socket(), filepath.Join(x11.SockDir, "X0"), false)
@@ -335,16 +638,74 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 			x.Surrogate.Close()
 		}
 	}
+	return x11TermHook, nil
+}
 
-	proc, err := h.run()
+// persistentExtensionData creates the extension settings storage of the
+// persistent extensions in the real profile directory if needed, and returns
+// the paths, so that they can be bound read-write over the amnesiac profile.
+//
+// Each extension's `storage.local` lives in a directory of its own, named
+// after the per-profile extension UUID, so the databases and their journals
+// are bound as a whole.  `storage.sync` is backed by a single database that
+// is shared by every extension, and is left amnesiac.
+func persistentExtensionData(realProfileDir string) ([]string, error) {
+	uuids, err := extensionUUIDs(filepath.Join(realProfileDir, "prefs.js"))
 	if err != nil {
-		x11TermHook()
 		return nil, err
-	} else {
-		proc.AddTermHook(x11TermHook)
 	}
 
-	return proc, nil
+	var paths []string
+	for _, id := range persistentExtensionIDs {
+		dirs := []string{filepath.Join(realProfileDir, "browser-extension-data", id)}
+		if uuid, ok := uuids[id]; ok {
+			dirs = append(dirs, filepath.Join(realProfileDir, "storage", "default", "moz-extension+++"+uuid+"^userContextId="+extensionUserContextID))
+		} else {
+			Debugf("sandbox: No UUID for extension %v, storage.local is amnesiac.", id)
+		}
+		for _, p := range dirs {
+			if err := os.MkdirAll(p, DirMode); err != nil {
+				return nil, err
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// extensionUUIDs returns the per-profile extension UUIDs by extension ID,
+// from the `extensions.webextensions.uuids` pref in the `prefs.js` file.
+func extensionUUIDs(prefsPath string) (map[string]string, error) {
+	const prefPrefix = `user_pref("extensions.webextensions.uuids", `
+
+	uuids := make(map[string]string)
+	b, err := ioutil.ReadFile(prefsPath)
+	if os.IsNotExist(err) {
+		return uuids, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, prefPrefix) || !strings.HasSuffix(l, ");") {
+			continue
+		}
+		v, err := strconv.Unquote(strings.TrimSuffix(strings.TrimPrefix(l, prefPrefix), ");"))
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: malformed extension UUIDs: %v", err)
+		}
+		if err = json.Unmarshal([]byte(v), &uuids); err != nil {
+			return nil, fmt.Errorf("sandbox: malformed extension UUIDs: %v", err)
+		}
+		break
+	}
+
+	// The UUID ends up in a path, so be paranoid about it.
+	for id, uuid := range uuids {
+		if strings.ContainsAny(uuid, "/^+") || uuid == "" || uuid == "." || uuid == ".." {
+			delete(uuids, id)
+		}
+	}
+	return uuids, nil
 }
 
 func filterCodecs(fn string, allowFfmpeg bool) error {
@@ -398,6 +759,31 @@ func findBestCodec(cache *dynlib.Cache) string {
 	return ""
 }
 
+// findFirefoxBinary returns the name of the firefox executable in the
+// bundle's `Browser` directory.  Since 8.0a10, `firefox` is a shell script
+// wrapper around `firefox.real`, but older (and possibly future) bundles
+// ship the ELF binary as `firefox`, so the actual binary is looked for
+// instead of going by the bundle version.
+func findFirefoxBinary(browserHome string) (string, error) {
+	for _, n := range []string{"firefox.real", "firefox"} {
+		if isELFExecutable(filepath.Join(browserHome, n)) {
+			return n, nil
+		}
+	}
+	log.Printf("sandbox: No firefox executable in: %v", browserHome)
+	return "", ErrNoFirefox
+}
+
+func isELFExecutable(fn string) bool {
+	f, err := elf.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	return f.Type == elf.ET_EXEC || f.Type == elf.ET_DYN
+}
+
 func applyPaXAttributes(manif *config.Manifest, f string) error {
 	const paxAttr = "user.pax.flags"
 
@@ -430,7 +816,7 @@ func applyPaXAttributes(manif *config.Manifest, f string) error {
 }
 
 // RunUpdate launches sandboxed Tor Browser update.
-func RunUpdate(cfg *config.Config, mar []byte) (err error) {
+func RunUpdate(cfg *config.Config, marPath string, hzFn func(string)) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%v", r)
@@ -454,11 +840,12 @@ func RunUpdate(cfg *config.Config, mar []byte) (err error) {
 
 	browserHome := filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser", "Browser")
 	realInstallDir := cfg.BundleInstallDir
-	realUpdateDir := filepath.Join(cfg.UserDataDir, "update")
+	realUpdateDir := updateStagingDir(cfg)
 	realUpdateBin := filepath.Join(realInstallDir, "Browser", "updater")
 
 	// Do the work neccecary to make the firefox `updater` happy.
-	if err = stageUpdate(realUpdateDir, realInstallDir, mar); err != nil {
+	if err = stageUpdate(realUpdateDir, realInstallDir, marPath); err != nil {
+		os.RemoveAll(realUpdateDir)
 		return err
 	}
 
@@ -489,16 +876,21 @@ func RunUpdate(cfg *config.Config, mar []byte) (err error) {
 	if err != nil {
 		return err
 	}
-	cmd.Wait()
+	waitUpdater(cmd, filepath.Join(realUpdateDir, updateLogFile), hzFn)
 
 	// 8. After the update has completed a file named update.status will be
 	//    created in the outside directory.
-	status, err := ioutil.ReadFile(filepath.Join(realUpdateDir, "update.status"))
+	//
+	// The staging directory is only left behind if the launcher crashes
+	// while the updater is running (See `RecoverUpdate()`).
+	status, err := ioutil.ReadFile(filepath.Join(realUpdateDir, updateStatusFile))
 	if err != nil {
+		os.RemoveAll(realUpdateDir)
 		return err
 	}
 	trimmedStatus := bytes.TrimSpace(status)
 	if !bytes.Equal(trimmedStatus, []byte("succeeded")) {
+		os.RemoveAll(realUpdateDir)
 		return fmt.Errorf("failed to apply update: %v", string(trimmedStatus))
 	}
 
@@ -508,7 +900,97 @@ func RunUpdate(cfg *config.Config, mar []byte) (err error) {
 	return nil
 }
 
-func stageUpdate(updateDir, installDir string, mar []byte) error {
+const (
+	updateStatusFile = "update.status"
+	updateLogFile    = "update.log"
+)
+
+// waitUpdater waits for the `updater` to exit, periodically invoking the
+// hzFn with the progress derived from the update log, since a complete
+// update can take minutes to apply.
+func waitUpdater(cmd *Process, logPath string, hzFn func(string)) {
+	doneCh := make(chan interface{})
+	go func() {
+		cmd.Wait()
+		close(doneCh)
+	}()
+
+	t := time.NewTicker(1000 * time.Millisecond)
+	defer t.Stop()
+	lastProgress := ""
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-t.C:
+		}
+		if progress := updaterProgress(logPath); progress != "" && progress != lastProgress {
+			hzFn(progress)
+			lastProgress = progress
+		}
+	}
+}
+
+// updaterProgress returns a human readable description of the `updater`
+// progress.  Each action in the MAR manifest is logged once as `PREPARE`,
+// once as `EXECUTE`, and once as `FINISH`.  The log is buffered, so this
+// is somewhat coarse.
+func updaterProgress(logPath string) string {
+	b, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		return ""
+	}
+
+	var nPrepare, nExecute, nFinish int
+	for _, l := range bytes.Split(b, []byte{'\n'}) {
+		switch {
+		case bytes.HasPrefix(l, []byte("PREPARE ")):
+			nPrepare++
+		case bytes.HasPrefix(l, []byte("EXECUTE ")):
+			nExecute++
+		case bytes.HasPrefix(l, []byte("FINISH ")):
+			nFinish++
+		}
+	}
+
+	switch {
+	case nPrepare == 0:
+		return ""
+	case nExecute == 0:
+		return fmt.Sprintf("Preparing %d files", nPrepare)
+	case nFinish == 0 && nExecute < nPrepare:
+		return fmt.Sprintf("%d%% (%d/%d files)", nExecute*100/nPrepare, nExecute, nPrepare)
+	default:
+		return "Finishing"
+	}
+}
+
+func updateStagingDir(cfg *config.Config) string {
+	return filepath.Join(cfg.UserDataDir, "update")
+}
+
+// RecoverUpdate removes the update staging directory left behind by an
+// update that was interrupted, and returns true if the updater may have
+// modified the bundle, in which case the bundle should be considered
+// inconsistent.
+func RecoverUpdate(cfg *config.Config) (bool, error) {
+	updateDir := updateStagingDir(cfg)
+	if _, err := os.Lstat(updateDir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// The updater creates `update.status` before touching the bundle,
+	// and a successful `RunUpdate()` removes the staging directory.
+	log.Printf("sandbox: Removing stale update staging directory")
+	_, err := os.Lstat(filepath.Join(updateDir, updateStatusFile))
+	appliedUpdate := err == nil
+	return appliedUpdate, os.RemoveAll(updateDir)
+}
+
+func stageUpdate(updateDir, installDir, marPath string) error {
 	copyFile := func(src, dst string) error {
 		// stat() the source file to get the file mode.
 		fi, err := os.Lstat(src)
@@ -516,11 +998,11 @@ func stageUpdate(updateDir, installDir string, mar []byte) error {
 			return err
 		}
 
-		// Read the source file into memory.
-		b, err := ioutil.ReadFile(src)
+		s, err := os.Open(src)
 		if err != nil {
 			return err
 		}
+		defer s.Close()
 
 		// Create and write the destination file.
 		f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
@@ -528,14 +1010,20 @@ func stageUpdate(updateDir, installDir string, mar []byte) error {
 			return err
 		}
 		defer f.Close()
-		_, err = f.Write(b)
-		f.Sync()
-
-		return err
+		if _, err = io.Copy(f, s); err != nil {
+			return err
+		}
+		return f.Sync()
 	}
 
 	// 1. Create a directory outside of the application's installation
 	//    directory to be updated.
+	//
+	// Anything left over from a previous attempt is discarded, so that
+	// nothing stale (eg: `update.status`) confuses the updater.
+	if err := os.RemoveAll(updateDir); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(updateDir, DirMode); err != nil {
 		return err
 	}
@@ -551,8 +1039,12 @@ func stageUpdate(updateDir, installDir string, mar []byte) error {
 	// 3. Download the appropriate .mar file and put it into the outside
 	//    directory you created (see Where to get a mar file).
 	// 4. Rename the mar file you downloaded to update.mar.
-	if err := ioutil.WriteFile(filepath.Join(updateDir, "update.mar"), mar, FileMode); err != nil {
-		return err
+	//
+	// The downloaded MAR is linked rather than moved, so that it is still
+	// around for another attempt if this one fails.
+	dst := filepath.Join(updateDir, "update.mar")
+	if err := os.Link(marPath, dst); err != nil {
+		return copyFile(marPath, dst)
 	}
 
 	return nil
@@ -593,6 +1085,7 @@ func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *
 	//
 	// See: https://bugs.torproject.org/20773
 	h.mountProc = false
+	h.applyContainerCompat(cfg)
 
 	if err = os.MkdirAll(cfg.TorDataDir, DirMode); err != nil {
 		return
@@ -607,6 +1100,26 @@ func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *
 
 	h.dir(torDir)
 	h.roBind(realTorHome, torBinDir, false)
+
+	// A host tor (and transports) binds over the bundled binaries, so that
+	// the paths in the torrc, and the stray process detection still work.
+	binaries := []string{realTorBin}
+	ldLibraryPath := realTorHome
+	if p := cfg.Tor.CustomTorPath; p != "" {
+		var pts map[string]string
+		if binaries, pts, err = resolveCustomTor(p, filepath.Join(realTorHome, ptSubDir)); err != nil {
+			return nil, err
+		}
+		log.Printf("sandbox: Using the custom tor binary: '%v'", binaries[0])
+		h.roBind(binaries[0], filepath.Join(torBinDir, "tor"), false)
+		for name, pt := range pts {
+			log.Printf("sandbox: Using the custom pluggable transport: '%v'", pt)
+			h.roBind(pt, filepath.Join(torBinDir, ptSubDir, name), false)
+		}
+
+		// The host binaries must not pick up the bundled libraries.
+		ldLibraryPath = ""
+	}
 	for _, v := range []string{"geoip", "geoip6"} {
 		h.roBind(filepath.Join(realGeoIPDir, v), filepath.Join(torDir, "etc", v), false)
 	}
@@ -624,17 +1137,76 @@ func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *
 
 		// XXX: For now assume that PTs will always use a subset of the tor
 		// binaries libraries.
-		if err := h.appendLibraries(cache, []string{realTorBin}, nil, realTorHome, nil); err != nil {
+		if err := h.appendLibraries(cache, binaries, nil, ldLibraryPath, nil); err != nil {
 			return nil, err
 		}
 		extraLdLibraryPath = extraLdLibraryPath + ":" + restrictedLibDir
 	}
-	h.setenv("LD_LIBRARY_PATH", torBinDir+extraLdLibraryPath)
+	if ldLibraryPath != "" {
+		h.setenv("LD_LIBRARY_PATH", torBinDir+extraLdLibraryPath)
+	} else if extraLdLibraryPath != "" {
+		h.setenv("LD_LIBRARY_PATH", extraLdLibraryPath[1:])
+	}
 
 	h.cmd = filepath.Join(torBinDir, "tor")
 	h.cmdArgs = []string{"-f", torrcPath}
 
-	return h.run()
+	proc, err := h.run()
+	if err != nil {
+		return nil, err
+	}
+
+	// Past this point tor shouldn't leave a turd process lying around when
+	// the sandbox exits, but it has been seen on occasion, so check.
+	proc.AddTermHook(func() { sweepStrayTor(cfg) })
+
+	return proc, nil
+}
+
+const ptSubDir = "PluggableTransports"
+
+// resolveCustomTor resolves the custom tor binary, and returns it followed
+// by the pluggable transports that replace the bundled ones in ptDir, keyed
+// by file name.
+func resolveCustomTor(torPath, ptDir string) ([]string, map[string]string, error) {
+	torBin, err := resolveHostBinary(torPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sandbox: custom tor binary: %v", err)
+	}
+
+	binaries := []string{torBin}
+	pts := make(map[string]string)
+	ents, _ := ioutil.ReadDir(ptDir)
+	for _, ent := range ents {
+		candidate := filepath.Join(filepath.Dir(torPath), ent.Name())
+		if ent.IsDir() || !FileExists(candidate) {
+			continue
+		}
+		pt, err := resolveHostBinary(candidate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sandbox: custom pluggable transport: %v", err)
+		}
+		binaries = append(binaries, pt)
+		pts[ent.Name()] = pt
+	}
+	return binaries, pts, nil
+}
+
+// resolveHostBinary returns the absolute path of the executable regular
+// file at p, with symlinks resolved.
+func resolveHostBinary(p string) (string, error) {
+	p, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+		return "", fmt.Errorf("'%v' is not an executable file", p)
+	}
+	return filepath.Abs(p)
 }
 
 type consoleLogger struct {
@@ -659,7 +1231,7 @@ func newConsoleLogger(prefix string) *consoleLogger {
 func findDistributionDependentLibs(extraSearch []string, subDir, fn string) string {
 	var searchPaths []string
 	searchPaths = append(searchPaths, extraSearch...)
-	searchPaths = append(searchPaths, distributionDependentLibSearchPath...)
+	searchPaths = append(searchPaths, getHostDistro().LibSearchPath...)
 
 	for _, base := range searchPaths {
 		candidate := filepath.Join(base, subDir, fn)
@@ -673,7 +1245,7 @@ func findDistributionDependentLibs(extraSearch []string, subDir, fn string) stri
 func findDistributionDependentDir(extraSearch []string, subDir, fn string) string {
 	var searchPaths []string
 	searchPaths = append(searchPaths, extraSearch...)
-	searchPaths = append(searchPaths, distributionDependentLibSearchPath...)
+	searchPaths = append(searchPaths, getHostDistro().LibSearchPath...)
 
 	for _, base := range searchPaths {
 		candidate := filepath.Join(base, subDir, fn)
@@ -706,7 +1278,38 @@ func (h *hugbox) appendRestrictedOpenGL() ([]string, string) {
 	return nil, ""
 }
 
-func (h *hugbox) appendGtk2Theme() bool {
+// appendDesktopAssets binds the host theme, icon and mime data that Tor
+// Browser uses, and returns true if the Adwaita theme was found.
+func (h *hugbox) appendDesktopAssets(allowThemePassthrough bool) bool {
+	hasAdwaita := h.appendGtk2Theme(allowThemePassthrough)
+	h.roBind("/usr/share/icons/hicolor", "/usr/share/icons/hicolor", true)
+	h.roBind("/usr/share/mime", "/usr/share/mime", false)
+	h.roBind("/usr/share/libthai/thbrk.tri", "/usr/share/libthai/thbrk.tri", true) // Thai language support (Optional).
+
+	//AVANIX added this, 60ESR needs this schemas...
+	//Enable Glib schemas to allow open, save etc...
+	//GENERAL for all
+	h.roBind("/usr/share/glib-2.0/schemas", "/usr/share/glib-2.0/schemas", false)
+	//TODO: Fine control
+	//h.roBind("/usr/share/glib-2.0/schemas/org.gtk.Settings.FileChooser.gschema.xml", "/usr/share/glib-2.0/schemas/org.gtk.Settings.FileChooser.gschema.xml", false)
+
+	//Allow this for some icons
+	h.roBind("/usr/share/icons/gnome", "/usr/share/icons/gnome", true)
+
+	// Use the host's icon theme if it is something else, so that the file
+	// dialogs are not missing icons.
+	if allowThemePassthrough {
+		bound := map[string]bool{"hicolor": true, "gnome": true, "Adwaita": hasAdwaita}
+		if theme := h.appendIconTheme(bound); theme != "" {
+			settingsPath := filepath.Join(h.homeDir, ".config", "gtk-3.0", "settings.ini")
+			h.file(settingsPath, []byte("[Settings]\ngtk-icon-theme-name = "+theme+"\n"))
+		}
+	}
+
+	return hasAdwaita
+}
+
+func (h *hugbox) appendGtk2Theme(allowPassthrough bool) bool {
 	const (
 		themeDir          = "/usr/share/themes/Adwaita/gtk-2.0"
 		iconDir           = "/usr/share/themes/Adwaita"
@@ -717,12 +1320,12 @@ func (h *hugbox) appendGtk2Theme() bool {
 
 	gtkRc := fallbackGtkrcAsset
 
-	hasAdwaita := DirExists(themeDir) && DirExists(iconDir)
+	hasAdwaita := allowPassthrough && DirExists(themeDir) && DirExists(iconDir)
 	if hasAdwaita {
 		h.roBind("/usr/share/themes/Adwaita/gtk-2.0", "/usr/share/themes/Adwaita/gtk-2.0", false)
 		h.roBind("/usr/share/icons/Adwaita", "/usr/share/icons/Adwaita", false)
 		gtkRc = adwaitaGtkrcAsset
-	} else {
+	} else if allowPassthrough {
 		log.Printf("sandbox: Failed to find Adwaita gtk-2.0 theme.")
 	}
 
@@ -737,12 +1340,10 @@ func (h *hugbox) appendRestrictedGtk2(hasAdwaita bool) ([]string, string, error)
 	const (
 		libAdwaita   = "libadwaita.so"
 		libPixmap    = "libpixmap.so"
-		libPngLoader = "libpixbufloader-png.so"
 		libPrintFile = "libprintbackend-file.so"
 
 		engineSubDir = "gtk-2.0/2.10.0/engines"
 		printSubDir  = "gtk-2.0/2.10.0/printbackends"
-		gdkSubDir    = "gdk-pixbuf-2.0/2.10.0/loaders"
 	)
 
 	gtkLibs := []string{}
@@ -788,27 +1389,10 @@ func (h *hugbox) appendRestrictedGtk2(hasAdwaita bool) ([]string, string, error)
 		h.setenv("GTK_PATH", filepath.Join(restrictedLibDir, "gtk-2.0"))
 	}
 
-	// Figure out if the system gdk-pixbuf-2.0 needs loaders for common
-	// file formats.  Arch and Fedora 25 do not.  Debian does.  As far as
-	// I can tell, the only file format we actually care about is PNG.
-	normGdkDir := filepath.Join(restrictedLibDir, "gdk-pixbuf-2.0", "2.10.0")
-	pngLoaderPath := findDistributionDependentLibs(nil, gdkSubDir, libPngLoader)
-	if pngLoaderPath != "" {
-		loaderDir, _ := filepath.Split(pngLoaderPath)
-		normPngLoaderPath := filepath.Join(normGdkDir, "loaders", libPngLoader)
-		h.roBind(pngLoaderPath, normPngLoaderPath, false)
-
-		loaderCachePath := filepath.Join(normGdkDir, "loaders.cache")
-		h.assetFile(loaderCachePath, "loaders.cache")
-		h.setenv("GDK_PIXBUF_MODULE_FILE", loaderCachePath)
-
-		gtkLibs = append(gtkLibs, libPngLoader)
-		gtkLibPath = gtkLibPath + ":" + loaderDir
-	} else {
-		// gdk-pixbuf can display an annoying warning if, it thinks it should
-		// have a `loaders.cache` but doesnot.  Shut it up.
-		h.setenv("GDK_PIXBUF_MODULE_FILE", "/dev/null")
-	}
+	// The gdk-pixbuf loaders, for icons and favicons.
+	pixbufLibs, pixbufLibPath := h.appendRestrictedGdkPixbuf()
+	gtkLibs = append(gtkLibs, pixbufLibs...)
+	gtkLibPath = gtkLibPath + pixbufLibPath
 
 	// Bug #22712 - Spurious AT-SPI warnings.
 	//
@@ -822,8 +1406,29 @@ func (h *hugbox) appendRestrictedGtk2(hasAdwaita bool) ([]string, string, error)
 }
 
 func (h *hugbox) appendLibraries(cache *dynlib.Cache, binaries []string, extraLibs []string, ldLibraryPath string, filterFn dynlib.FilterFunc) error {
+	toBindMount, err := resolveLibraries(cache, binaries, extraLibs, ldLibraryPath, filterFn)
+	if err != nil {
+		return err
+	}
+	return h.bindLibraries(cache, toBindMount)
+}
+
+func resolveLibraries(cache *dynlib.Cache, binaries []string, extraLibs []string, ldLibraryPath string, filterFn dynlib.FilterFunc) (map[string][]string, error) {
 	defer runtime.GC()
 
+	// Search the distribution specific directories as well.
+	fallbackLibSearchPath := strings.Join(getHostDistro().LibSearchPath, fmt.Sprintf("%c", filepath.ListSeparator))
+	toBindMount, err := cache.ResolveLibraries(binaries, extraLibs, ldLibraryPath, fallbackLibSearchPath, filterFn)
+	if err != nil {
+		Debugf("sandbox error cache.ResolveLibraries: %v", err)
+		return nil, err
+	}
+	return toBindMount, nil
+}
+
+// bindLibraries binds the resolved libraries, a map of real library paths to
+// their aliases, into the sandbox.
+func (h *hugbox) bindLibraries(cache *dynlib.Cache, toBindMount map[string][]string) error {
 	// ld-linux(-x86-64).so needs special handling since it needs to be in
 	// a precise location on the filesystem.
 	ldSoPath, ldSoAlias, err := dynlib.FindLdSo(cache)
@@ -838,14 +1443,6 @@ func (h *hugbox) appendLibraries(cache *dynlib.Cache, binaries []string, extraLi
 		ldSoAlias = filepath.Join("/lib", ldSoAliasFn)
 	}
 
-	// Search the distribution specific directories as well.
-	fallbackLibSearchPath := strings.Join(distributionDependentLibSearchPath, fmt.Sprintf("%c", filepath.ListSeparator))
-	toBindMount, err := cache.ResolveLibraries(binaries, extraLibs, ldLibraryPath, fallbackLibSearchPath, filterFn)
-	if err != nil {
-		Debugf("sandbox error cache.ResolveLibraries: %v", err)
-		return err
-	}
-
 	// XXX: This needs one more de-dup pass to see if the sandbox expects two
 	// different versions to share an alias.
 
@@ -890,35 +1487,10 @@ func (h *hugbox) appendLibraries(cache *dynlib.Cache, binaries []string, extraLi
 	}
 
 	// Some systems are really stubborn about searching for certain things
-	// in the qualified lib directories.  In particular ld-linux.so needs to
-	// be in exactly the right place, and openSUSE seems to really want to
-	// use "/usr/lib64" for certain things.
-	switch runtime.GOARCH {
-	case "amd64":
-		h.symlink("/lib", "/lib64")
-		h.symlink(restrictedLibDir, "/usr/lib64")
-	default:
-		panic("sandbox: unsupported architecture: " + runtime.GOARCH)
-	}
+	// in the qualified lib directories.
+	h.appendCompatSymlinks(getHostDistro())
 
 	h.standardLibs = false
 
 	return nil
 }
-
-func init() {
-	searchPaths := []string{
-		"/usr/lib", // Arch Linux.
-	}
-	switch runtime.GOARCH {
-	case "amd64":
-		searchPaths = append([]string{
-			"/usr/lib64",                // Fedora 25
-			"/usr/lib/x86_64-linux-gnu", // Debian
-		}, searchPaths...)
-	default:
-		panic("sandbox: unsupported architecture: " + runtime.GOARCH)
-	}
-
-	distributionDependentLibSearchPath = searchPaths
-}
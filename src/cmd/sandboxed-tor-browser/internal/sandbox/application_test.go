@@ -0,0 +1,62 @@
+// application_test.go - Tor Browser sandbox launch routine tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdaterProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "application_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, updateLogFile)
+
+	if s := updaterProgress(logPath); s != "" {
+		t.Errorf("updaterProgress: %q with no log", s)
+	}
+
+	const (
+		prepare = "PREPARE PATCH \"browser/omni.ja\"\nPREPARE ADD \"libxul.so\"\nPREPARE REMOVEFILE \"old.so\"\nPREPARE ADD \"firefox\"\n"
+		execute = "EXECUTE PATCH \"browser/omni.ja\"\nEXECUTE ADD \"libxul.so\"\nEXECUTE REMOVEFILE \"old.so\"\nEXECUTE ADD \"firefox\"\n"
+		finish  = "FINISH PATCH \"browser/omni.ja\"\n"
+	)
+	for _, v := range []struct {
+		log, want string
+	}{
+		{"", ""},
+		{"SOURCE DIRECTORY /home/amnesia/sandboxed-tor-browser/update\n", ""},
+		{prepare, "Preparing 4 files"},
+		{prepare + "EXECUTE PATCH \"browser/omni.ja\"\n", "25% (1/4 files)"},
+		{prepare + "EXECUTE PATCH \"browser/omni.ja\"\nEXECUTE ADD \"libxul.so\"\nEXECUTE REMOVEFILE \"old.so\"\n", "75% (3/4 files)"},
+		{prepare + execute, "Finishing"},
+		{prepare + execute + finish, "Finishing"},
+		{prepare + "EXECUTE PATCH \"browser/omni.ja\"\n" + finish, "Finishing"},
+	} {
+		if err = ioutil.WriteFile(logPath, []byte(v.log), 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile: %v", err)
+		}
+		if s := updaterProgress(logPath); s != v.want {
+			t.Errorf("updaterProgress(%q) = %q, want %q", v.log, s, v.want)
+		}
+	}
+}
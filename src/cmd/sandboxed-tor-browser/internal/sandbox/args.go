@@ -0,0 +1,163 @@
+// args.go - bubblewrap argument validation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxArgLen is the maximum length of a single argument, PATH_MAX.
+	maxArgLen = 4096
+
+	// maxArgsBufferSize is the maximum size of the serialized arguments.
+	// The file contents are passed via separate fds, so this is generous.
+	maxArgsBufferSize = 1024 * 1024
+)
+
+type bwrapOperand int
+
+const (
+	operandAny     bwrapOperand = iota // Anything without a NUL.
+	operandSrcPath                     // Absolute host path.
+	operandDstPath                     // Absolute sandbox path, no `..`.
+	operandEnvKey                      // Environment variable name.
+	operandNumber                      // Non-negative integer (fd, uid, gid).
+)
+
+// bwrapOptions is every bubblewrap option that the sandbox construction
+// routines use, and the operands that each option takes.  Anything not
+// listed here is rejected, so that a value that somehow ends up being parsed
+// as an option can't go unnoticed.
+var bwrapOptions = map[string][]bwrapOperand{
+	"--unshare-user":       nil,
+	"--unshare-ipc":        nil,
+	"--unshare-pid":        nil,
+	"--unshare-net":        nil,
+	"--unshare-uts":        nil,
+	"--unshare-cgroup-try": nil,
+	"--die-with-parent":    nil,
+	"--hostname":           {operandAny},
+	"--uid":                {operandNumber},
+	"--gid":                {operandNumber},
+	"--chdir":              {operandDstPath},
+	"--setenv":             {operandEnvKey, operandAny},
+	"--dev":                {operandDstPath},
+	"--proc":               {operandDstPath},
+	"--size":               {operandNumber},
+	"--tmpfs":              {operandDstPath},
+	"--dir":                {operandDstPath},
+	"--bind":               {operandSrcPath, operandDstPath},
+	"--ro-bind":            {operandSrcPath, operandDstPath},
+	"--symlink":            {operandAny, operandDstPath},
+	"--file":               {operandNumber, operandDstPath},
+	"--seccomp":            {operandNumber},
+	"--info-fd":            {operandNumber},
+}
+
+// validateArgs ensures that the arguments passed to bubblewrap via the args
+// fd are well formed, such that each value is exactly one argument, and that
+// they will be interpreted as intended.
+func validateArgs(args []string) error {
+	sz := 0
+	for _, arg := range args {
+		if strings.IndexByte(arg, 0x00) != -1 {
+			return fmt.Errorf("sandbox: argument contains a NUL byte: '%s'", strings.Replace(arg, "\x00", "\\0", -1))
+		}
+		if len(arg) > maxArgLen {
+			return fmt.Errorf("sandbox: argument too long: %d bytes", len(arg))
+		}
+		sz += len(arg) + 1
+	}
+	if sz > maxArgsBufferSize {
+		return fmt.Errorf("sandbox: arguments too large: %d bytes", sz)
+	}
+
+	for i := 0; i < len(args); {
+		opt := args[i]
+		operands, ok := bwrapOptions[opt]
+		if !ok {
+			return fmt.Errorf("sandbox: unexpected argument: '%s'", opt)
+		}
+		i++
+
+		if len(args)-i < len(operands) {
+			return fmt.Errorf("sandbox: truncated arguments for '%s'", opt)
+		}
+		for _, kind := range operands {
+			if err := validateOperand(kind, args[i]); err != nil {
+				return fmt.Errorf("sandbox: invalid argument for '%s': %v", opt, err)
+			}
+			i++
+		}
+	}
+
+	return nil
+}
+
+func validateOperand(kind bwrapOperand, v string) error {
+	switch kind {
+	case operandAny:
+	case operandSrcPath:
+		if !strings.HasPrefix(v, "/") {
+			return fmt.Errorf("path is not absolute: '%s'", v)
+		}
+	case operandDstPath:
+		if !strings.HasPrefix(v, "/") {
+			return fmt.Errorf("path is not absolute: '%s'", v)
+		}
+		for _, elem := range strings.Split(v, "/") {
+			if elem == ".." {
+				return fmt.Errorf("path contains '..': '%s'", v)
+			}
+		}
+	case operandEnvKey:
+		if v == "" || strings.IndexByte(v, '=') != -1 {
+			return fmt.Errorf("invalid environment variable name: '%s'", v)
+		}
+	case operandNumber:
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return fmt.Errorf("invalid number: '%s'", v)
+		}
+	default:
+		panic("sandbox: unknown operand type")
+	}
+	return nil
+}
+
+// argsDestPaths returns every sandbox path that the arguments populate.  The
+// arguments are assumed to be well formed.
+func argsDestPaths(args []string) []string {
+	var dsts []string
+	for i := 0; i < len(args); {
+		opt := args[i]
+		operands := bwrapOptions[opt]
+		i++
+		for _, kind := range operands {
+			if i >= len(args) {
+				break
+			}
+			if kind == operandDstPath && opt != "--chdir" {
+				dsts = append(dsts, args[i])
+			}
+			i++
+		}
+	}
+	return dsts
+}
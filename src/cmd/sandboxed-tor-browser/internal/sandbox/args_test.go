@@ -0,0 +1,163 @@
+// args_test.go - bubblewrap argument validation tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+func TestValidateArgs(t *testing.T) {
+	for _, v := range []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "empty", args: nil},
+		{name: "no operands", args: []string{"--unshare-pid", "--die-with-parent"}},
+		{name: "bind", args: []string{"--bind", "/home/user/Downloads", "/home/amnesia/Downloads"}},
+		{name: "setenv", args: []string{"--setenv", "DISPLAY", ":0\n--bind / /"}},
+		{name: "symlink", args: []string{"--symlink", "../lib", "/lib64"}},
+		{name: "numbers", args: []string{"--uid", "1000", "--file", "4", "/etc/passwd"}},
+		{name: "size", args: []string{"--size", "536870912", "--tmpfs", "/tmp"}},
+		{name: "unknown option", args: []string{"--cap-add", "ALL"}, wantErr: true},
+		{name: "operand as option", args: []string{"/usr", "/usr"}, wantErr: true},
+		{name: "not an option", args: []string{"--bind", "/a", "/b", "extra"}, wantErr: true},
+		{name: "truncated", args: []string{"--bind", "/usr"}, wantErr: true},
+		{name: "NUL", args: []string{"--dir", "/tmp/a\x00--bind"}, wantErr: true},
+		{name: "relative src", args: []string{"--ro-bind", "usr", "/usr"}, wantErr: true},
+		{name: "relative dst", args: []string{"--ro-bind", "/usr", "usr"}, wantErr: true},
+		{name: "dst dotdot", args: []string{"--bind", "/home", "/home/amnesia/../../etc"}, wantErr: true},
+		{name: "dst trailing dotdot", args: []string{"--dir", "/tmp/.."}, wantErr: true},
+		{name: "chdir dotdot", args: []string{"--chdir", "/home/.."}, wantErr: true},
+		{name: "empty env key", args: []string{"--setenv", "", "x"}, wantErr: true},
+		{name: "env key with =", args: []string{"--setenv", "LD_PRELOAD=/x", "y"}, wantErr: true},
+		{name: "negative number", args: []string{"--uid", "-1"}, wantErr: true},
+		{name: "bad number", args: []string{"--file", "4 ", "/etc/passwd"}, wantErr: true},
+		{name: "long arg", args: []string{"--dir", "/" + strings.Repeat("a", maxArgLen)}, wantErr: true},
+	} {
+		err := validateArgs(v.args)
+		if v.wantErr && err == nil {
+			t.Errorf("%v: validateArgs(%q): no error", v.name, v.args)
+		} else if !v.wantErr && err != nil {
+			t.Errorf("%v: validateArgs(%q): %v", v.name, v.args, err)
+		}
+	}
+
+	// The total size limit, with every argument well under maxArgLen.
+	var args []string
+	for sz := 0; sz <= maxArgsBufferSize; sz += maxArgLen {
+		args = append(args, "--dir", "/"+strings.Repeat("a", maxArgLen-len("--dir")-3))
+	}
+	if err := validateArgs(args); err == nil {
+		t.Errorf("validateArgs: %d args over the size limit accepted", len(args))
+	}
+}
+
+func TestHostilePaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "args-hostile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Host paths that the config can point at are valid as long as they
+	// are absolute, and each one must still be exactly one argument.
+	for _, name := range []string{
+		"new\nline",
+		"--bind --ro-bind ",
+		" leading space",
+		"'quote\"",
+		"trailing\\",
+		"tab\there",
+	} {
+		src := filepath.Join(root, name)
+		if err := os.Mkdir(src, DirMode); err != nil {
+			t.Fatal(err)
+		}
+
+		h := new(hugbox)
+		h.bind(src, "/home/amnesia/Downloads", false)
+		h.roBind(src, "/home/amnesia/"+name, false)
+		if err := validateArgs(h.args); err != nil {
+			t.Errorf("%q: validateArgs: %v", name, err)
+			continue
+		}
+		if got := decodeArgs(t, h.args); !reflect.DeepEqual(got, h.args) {
+			t.Errorf("%q: round trip: got %q, want %q", name, got, h.args)
+		}
+	}
+
+	// Escaping a destination via the path is rejected.
+	h := new(hugbox)
+	h.bind(root, "/home/amnesia/../../etc", false)
+	if err := validateArgs(h.args); err == nil {
+		t.Errorf("validateArgs(%q): no error", h.args)
+	}
+}
+
+func TestArgsRoundTrip(t *testing.T) {
+	// Any operands that pass validation are passed to bubblewrap exactly.
+	f := func(src, dst, key, value string) bool {
+		args := []string{"--bind", "/" + src, "/" + dst, "--setenv", key, value}
+		wantOk := !strings.ContainsRune(src+dst+key+value, 0x00) &&
+			key != "" && !strings.ContainsRune(key, '=')
+		for _, elem := range strings.Split(dst, "/") {
+			wantOk = wantOk && elem != ".."
+		}
+		for _, arg := range args {
+			wantOk = wantOk && len(arg) <= maxArgLen
+		}
+
+		if err := validateArgs(args); (err == nil) != wantOk {
+			t.Logf("validateArgs(%q): %v, want ok: %v", args, err, wantOk)
+			return false
+		} else if err != nil {
+			return true
+		}
+		return reflect.DeepEqual(decodeArgs(t, args), args)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// decodeArgs encodes the args, and parses them back the way bubblewrap does.
+func decodeArgs(t *testing.T, args []string) []string {
+	b, err := encodeArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []string
+	for len(b) > 0 {
+		idx := bytes.IndexByte(b, 0x00)
+		if idx < 0 {
+			t.Fatalf("unterminated argument: %q", b)
+		}
+		ret = append(ret, string(b[:idx]))
+		b = b[idx+1:]
+	}
+	return ret
+}
@@ -0,0 +1,278 @@
+// cgroup.go - cgroup v2 resource limits and freezer support.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	cgroupRoot        = "/sys/fs/cgroup"
+	cgroup2SuperMagic = 0x63677270
+)
+
+var systemdRunPaths = []string{
+	"/usr/bin/systemd-run",
+	"/bin/systemd-run",
+}
+
+type cgroupLimits struct {
+	name      string
+	memoryMax int64 // Bytes, 0 = unlimited.
+	cpuWeight int   // 1 - 10000, 0 = default.
+}
+
+// newCgroupLimits returns the limits for a sandbox that gets a dedicated
+// cgroup, or nil if no limits are configured, and pausing is disabled, as
+// the cgroup is also what allows the sandbox to be frozen.
+func newCgroupLimits(name string, cfg *config.Config) *cgroupLimits {
+	l := &cgroupLimits{
+		name:      name,
+		memoryMax: int64(cfg.Sandbox.MemoryLimit) * 1024 * 1024,
+		cpuWeight: cfg.Sandbox.CPUWeight,
+	}
+	if l.memoryMax <= 0 && l.cpuWeight <= 0 && !cfg.Sandbox.EnablePause {
+		return nil
+	}
+	return l
+}
+
+// cgroup is a cgroup created by the launcher, that the sandbox will be
+// started in.
+type cgroup struct {
+	path string
+	fd   *os.File
+}
+
+func (cg *cgroup) close() {
+	if cg.fd != nil {
+		cg.fd.Close()
+		cg.fd = nil
+	}
+}
+
+func (cg *cgroup) remove() {
+	cg.close()
+
+	// The kernel will refuse to remove the cgroup until the last process
+	// has exited, which can take a moment after bwrap is reaped.
+	for i := 0; i < 10; i++ {
+		if err := syscall.Rmdir(cg.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("sandbox: Failed to remove cgroup: %v", cg.path)
+}
+
+// applyCgroupLimits arranges for the sandbox to be started with the cgroup
+// limits applied, either via a transient systemd scope (preferred), or a
+// cgroup created directly in the delegated cgroupfs hierarchy.
+func (h *hugbox) applyCgroupLimits(cmd *exec.Cmd) (*cgroup, error) {
+	l := h.cgroup
+	if l == nil {
+		return nil, nil
+	}
+
+	if p := findSystemdRun(); p != "" && !h.noSystemd {
+		Debugf("sandbox: cgroup: Using systemd scope.")
+
+		args := []string{p, "--user", "--scope", "--quiet", "--collect"}
+		args = append(args, "--unit", fmt.Sprintf("sandboxed-tor-browser-%d-%s", os.Getpid(), l.name))
+		if l.memoryMax > 0 {
+			args = append(args, "-p", fmt.Sprintf("MemoryMax=%d", l.memoryMax))
+		}
+		if l.cpuWeight > 0 {
+			args = append(args, "-p", fmt.Sprintf("CPUWeight=%d", l.cpuWeight))
+		}
+		args = append(args, "--")
+
+		// systemd-run needs to be able to find the user manager, the value
+		// gets overridden inside the sandbox.
+		cmd.Env = append(cmd.Env, "XDG_RUNTIME_DIR="+os.Getenv("XDG_RUNTIME_DIR"))
+		cmd.Args = append(args, cmd.Args...)
+		cmd.Path = p
+		return nil, nil
+	}
+
+	cg, err := newCgroup(l)
+	if err != nil {
+		return nil, err
+	}
+	Debugf("sandbox: cgroup: Using cgroup: %v", cg.path)
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+	return cg, nil
+}
+
+func findSystemdRun() string {
+	// The user manager must be running, and the private socket is what
+	// systemd-run will use to talk to it.
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d == "" || !FileExists(filepath.Join(d, "systemd", "private")) {
+		return ""
+	}
+	for _, v := range systemdRunPaths {
+		if FileExists(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+func newCgroup(l *cgroupLimits) (*cgroup, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &fs); err != nil {
+		return nil, err
+	} else if fs.Type != cgroup2SuperMagic {
+		return nil, fmt.Errorf("sandbox: cgroup v2 is not mounted at %v", cgroupRoot)
+	}
+
+	self, err := selfCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	// The launcher's own cgroup can't have controllers enabled for children
+	// since it contains processes, so the sandbox cgroup is a sibling.
+	parent := filepath.Dir(filepath.Join(cgroupRoot, self))
+	cg := &cgroup{path: filepath.Join(parent, fmt.Sprintf("sandboxed-tor-browser-%d-%s", os.Getpid(), l.name))}
+	if err = os.Mkdir(cg.path, 0755); err != nil {
+		return nil, fmt.Errorf("sandbox: failed to create cgroup: %v", err)
+	}
+
+	ok := false
+	defer func() {
+		if !ok {
+			cg.remove()
+		}
+	}()
+
+	var ctrls []string
+	if l.memoryMax > 0 {
+		ctrls = append(ctrls, "memory")
+	}
+	if l.cpuWeight > 0 {
+		ctrls = append(ctrls, "cpu")
+	}
+	if err = enableCgroupControllers(parent, cg.path, ctrls); err != nil {
+		return nil, err
+	}
+
+	if l.memoryMax > 0 {
+		if err = writeCgroupFile(cg.path, "memory.max", fmt.Sprintf("%d", l.memoryMax)); err != nil {
+			return nil, err
+		}
+	}
+	if l.cpuWeight > 0 {
+		if err = writeCgroupFile(cg.path, "cpu.weight", fmt.Sprintf("%d", l.cpuWeight)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cg.fd, err = os.OpenFile(cg.path, os.O_RDONLY|syscall.O_DIRECTORY, 0); err != nil {
+		return nil, err
+	}
+
+	ok = true
+	return cg, nil
+}
+
+// sandboxCgroup returns the cgroupfs path of the cgroup that the pid is in,
+// if it is distinct from the launcher's.
+func sandboxCgroup(pid int) (string, error) {
+	self, err := selfCgroup()
+	if err != nil {
+		return "", err
+	}
+	cg, err := pidCgroup(fmt.Sprintf("%d", pid))
+	if err != nil {
+		return "", err
+	}
+	if cg == self {
+		return "", fmt.Errorf("sandbox: sandbox shares the launcher's cgroup")
+	}
+	return filepath.Join(cgroupRoot, cg), nil
+}
+
+func selfCgroup() (string, error) {
+	return pidCgroup("self")
+}
+
+func pidCgroup(pid string) (string, error) {
+	f, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The unified hierarchy entry is of the form `0::/path`.
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := scanner.Text(); strings.HasPrefix(l, "0::") {
+			return l[3:], nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("sandbox: failed to determine cgroup")
+}
+
+func enableCgroupControllers(parent, path string, ctrls []string) error {
+	hasCtrl := func(ctrl string) bool {
+		b, err := ioutil.ReadFile(filepath.Join(path, "cgroup.controllers"))
+		if err != nil {
+			return false
+		}
+		for _, v := range strings.Fields(string(b)) {
+			if v == ctrl {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, ctrl := range ctrls {
+		if hasCtrl(ctrl) {
+			continue
+		}
+
+		// This is only permitted if the parent has no processes of it's
+		// own, which is the case for systemd slices.
+		if err := writeCgroupFile(parent, "cgroup.subtree_control", "+"+ctrl); err != nil || !hasCtrl(ctrl) {
+			return fmt.Errorf("sandbox: cgroup controller '%v' not available", ctrl)
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(path, f, v string) error {
+	return ioutil.WriteFile(filepath.Join(path, f), []byte(v), 0644)
+}
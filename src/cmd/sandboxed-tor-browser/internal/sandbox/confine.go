@@ -0,0 +1,97 @@
+// confine.go - Launcher self-confinement.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/twtiger/gosecco"
+	"golang.org/x/sys/unix"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	seccompSetModeFilter   = 1 // SECCOMP_SET_MODE_FILTER
+	seccompFilterFlagTsync = 1 // SECCOMP_FILTER_FLAG_TSYNC
+)
+
+// sysSeccomp is the seccomp(2) system call number, by architecture.
+var sysSeccomp = map[string]uintptr{
+	"amd64": 317,
+	"386":   354,
+}
+
+// ConfineLauncher sets `no_new_privs`, and installs the launcher's seccomp
+// blacklist onto every thread of the launcher.  Both are inherited by every
+// process the launcher spawns, so this should be called once the UI is
+// initialized, and will break anything spawned afterwards that relies on
+// setuid binaries.
+//
+// Setuid bubblewrap being one of those, nothing is done unless user
+// namespaces are usable.
+func ConfineLauncher() error {
+	if !FileExists("/proc/self/ns/user") {
+		log.Printf("sandbox: Not confining the launcher, no user namespace support.")
+		return nil
+	} else if err := probeUserNamespace(); err != nil {
+		log.Printf("sandbox: Not confining the launcher, user namespaces are unavailable: %v", err)
+		return nil
+	}
+
+	nr, ok := sysSeccomp[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("sandbox: seccomp is unsupported on %v", runtime.GOARCH)
+	}
+
+	settings := gosecco.SeccompSettings{
+		DefaultPositiveAction: "EPERM",
+		DefaultNegativeAction: "allow",
+		DefaultPolicyAction:   "allow",
+		ActionOnX32:           "kill",
+		ActionOnAuditFailure:  "kill",
+	}
+	bpf, err := compileSeccomp([]string{"launcher-" + runtime.GOARCH + ".seccomp"}, settings)
+	if err != nil {
+		return err
+	}
+
+	// `no_new_privs` is per-thread, but `SECCOMP_FILTER_FLAG_TSYNC` also
+	// applies it to every other thread, along with the filter.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0); e != 0 {
+		return fmt.Errorf("sandbox: failed to set no_new_privs: %v", e)
+	}
+	prog := &unix.SockFprog{
+		Len:    uint16(len(bpf)),
+		Filter: &bpf[0],
+	}
+	if tid, _, e := syscall.RawSyscall(nr, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(prog))); e != 0 {
+		return fmt.Errorf("sandbox: failed to install the launcher seccomp filter: %v", e)
+	} else if tid != 0 {
+		return fmt.Errorf("sandbox: failed to synchronize the launcher seccomp filter with thread %d", tid)
+	}
+
+	log.Printf("sandbox: Launcher confined (no_new_privs, %d bpf instructions).", len(bpf))
+	return nil
+}
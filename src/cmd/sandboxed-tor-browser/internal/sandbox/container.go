@@ -0,0 +1,178 @@
+// container.go - Container and VM environment detection.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// The environments that DetectContainer can identify.
+const (
+	ContainerNone   = ""
+	ContainerDocker = "docker"
+	ContainerPodman = "podman"
+	ContainerLXC    = "lxc"
+	ContainerNspawn = "systemd-nspawn"
+	ContainerQubes  = "qubes"
+)
+
+var (
+	containerOnce sync.Once
+	containerEnv  string
+)
+
+// DetectContainer returns the container runtime that the launcher is running
+// under, `ContainerQubes` if running in a Qubes VM, or `ContainerNone`.
+// Unrecognized runtimes that advertise themselves via the `container` env
+// var of pid 1 are returned as is.
+func DetectContainer() string {
+	containerOnce.Do(func() {
+		containerEnv = detectContainer()
+		if containerEnv != ContainerNone {
+			Debugf("sandbox: Running under: %v", containerEnv)
+		}
+	})
+	return containerEnv
+}
+
+// inContainer returns true iff the launcher is running in an actual
+// container, as opposed to on the host or in a Qubes VM.
+func inContainer() bool {
+	env := DetectContainer()
+	return env != ContainerNone && env != ContainerQubes
+}
+
+func detectContainer() string {
+	// Qubes VMs are actual VMs, but get detected anyway so that the
+	// diagnostics don't go looking for problems that aren't there.
+	if FileExists("/usr/share/qubes/marker-vm") {
+		return ContainerQubes
+	}
+	if FileExists("/run/.containerenv") {
+		return ContainerPodman
+	}
+	if FileExists("/.dockerenv") {
+		return ContainerDocker
+	}
+
+	// systemd (and the runtimes that follow its conventions) note the
+	// container manager here, and in pid 1's environment.
+	if b, err := ioutil.ReadFile("/run/systemd/container"); err == nil {
+		if v := strings.TrimSpace(string(b)); v != "" {
+			return normalizeContainer(v)
+		}
+	}
+	if b, err := ioutil.ReadFile("/proc/1/environ"); err == nil {
+		for _, kv := range bytes.Split(b, []byte{0}) {
+			if v := bytes.TrimPrefix(kv, []byte("container=")); len(v) != len(kv) && len(v) > 0 {
+				return normalizeContainer(string(v))
+			}
+		}
+	}
+	return ContainerNone
+}
+
+func normalizeContainer(v string) string {
+	switch v {
+	case "lxc", "lxc-libvirt":
+		return ContainerLXC
+	case "oci":
+		return ContainerPodman
+	}
+	return v
+}
+
+// containerRemedy returns a human readable suggestion for getting user
+// namespaces to work in the container, or "" if there is nothing specific
+// to suggest.
+func containerRemedy(env string) string {
+	switch env {
+	case ContainerNone:
+		return ""
+	case ContainerDocker, ContainerPodman:
+		return env + "'s default seccomp profile denies nested user namespaces, run the container with `--security-opt seccomp=unconfined`"
+	case ContainerLXC:
+		return "the container must allow nesting (eg: LXD `security.nesting=true`)"
+	case ContainerQubes:
+		return "the template VM's kernel must allow unprivileged user namespaces"
+	}
+	return "the container must allow nested user namespaces"
+}
+
+// procIsMasked returns true iff the host `/proc` has things mounted over
+// parts of it, as container runtimes do to hide `/proc/kcore` and friends.
+// The kernel refuses to mount a new procfs instance from inside a user
+// namespace, unless every existing instance is fully visible.
+func procIsMasked() bool {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint type options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "/proc/") {
+			continue
+		}
+
+		// binfmt_misc is mounted over an empty directory, which the kernel
+		// is fine with.
+		if strings.HasPrefix(fields[1], "/proc/sys/fs/binfmt_misc") {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// applyContainerCompat adjusts the sandbox to cope with running inside a
+// container, if the compatibility mode is enabled.  This weakens the sandbox:
+//
+//   - The cgroup namespace is not unshared, and the sandbox is not given
+//     it's own cgroup, since the cgroupfs is rarely delegated.  Resource
+//     limits and freezing the browser are unavailable.
+//   - If the container masks parts of `/proc`, the sandbox gets the same
+//     skeletal `/proc` as tor instead of a fresh mount.
+func (h *hugbox) applyContainerCompat(cfg *config.Config) {
+	if !cfg.Sandbox.ContainerCompat {
+		return
+	}
+
+	h.unshare.cgroup = false
+	if h.cgroup != nil && (h.cgroup.memoryMax > 0 || h.cgroup.cpuWeight > 0) {
+		log.Printf("sandbox: Container compatibility mode, cgroup limits are ignored.")
+	}
+	h.cgroup = nil
+
+	if h.mountProc && procIsMasked() {
+		log.Printf("sandbox: Container compatibility mode, `/proc` is masked and will not be mounted.")
+		h.mountProc = false
+		h.fakeProc = true
+	}
+}
@@ -0,0 +1,497 @@
+// diagnostics.go - Host environment sanity checks.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// DiagnosticResult is the result of a single host environment check.
+type DiagnosticResult struct {
+	// Name is the human readable name of the check.
+	Name string
+
+	// Passed is set if the check passed.
+	Passed bool
+
+	// Fatal is set if the check failed, and the sandbox will not work.
+	Fatal bool
+
+	// Detail is a human readable description of the result.
+	Detail string
+}
+
+func (r *DiagnosticResult) String() string {
+	status := "PASS"
+	if !r.Passed {
+		status = "WARN"
+		if r.Fatal {
+			status = "FAIL"
+		}
+	}
+	return fmt.Sprintf("[%s] %s: %s", status, r.Name, r.Detail)
+}
+
+// RunDiagnostics checks the host environment for configurations that are
+// known to prevent the sandbox from working.
+func RunDiagnostics(cfg *config.Config) []*DiagnosticResult {
+	userNS := diagUserNamespaces()
+	return []*DiagnosticResult{
+		diagContainer(cfg),
+		userNS,
+		diagBwrap(userNS.Passed),
+		diagSeccomp(),
+		diagProcMount(cfg),
+		diagX11(cfg),
+		diagProtectedSymlinks(),
+		diagAppArmor(),
+		diagSELinux(cfg),
+		diagDNSLeak(),
+		diagFonts(cfg),
+	}
+}
+
+func readSysctl(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func diagContainer(cfg *config.Config) *DiagnosticResult {
+	r := &DiagnosticResult{Name: "Container"}
+	switch env := DetectContainer(); env {
+	case ContainerNone:
+		r.Passed = true
+		r.Detail = "not running in a container"
+	case ContainerQubes:
+		r.Passed = true
+		r.Detail = "running in a Qubes VM, no adjustments are required"
+	default:
+		if cfg.Sandbox.ContainerCompat {
+			r.Detail = fmt.Sprintf("running under %v, the sandbox is degraded by the compatibility mode (no cgroup namespace or limits, and no `/proc` if masked)", env)
+		} else {
+			r.Detail = fmt.Sprintf("running under %v, if launching fails set `containerCompat` in the `sandbox` section of the config", env)
+		}
+	}
+	return r
+}
+
+func diagUserNamespaces() *DiagnosticResult {
+	r := checkUserNamespaces()
+	if remedy := containerRemedy(DetectContainer()); !r.Passed && remedy != "" {
+		r.Detail += ", " + remedy
+	}
+	return r
+}
+
+func checkUserNamespaces() *DiagnosticResult {
+	r := &DiagnosticResult{Name: "User namespaces"}
+	if !FileExists("/proc/self/ns/user") {
+		r.Detail = "not supported by the kernel"
+		return r
+	}
+
+	// Debian and derivatives have an out of tree knob to disable
+	// unprivileged user namespaces.
+	if v, err := readSysctl("/proc/sys/kernel/unprivileged_userns_clone"); err == nil && v == "0" {
+		r.Detail = "disabled (kernel.unprivileged_userns_clone = 0)"
+		return r
+	}
+	if v, err := readSysctl("/proc/sys/user/max_user_namespaces"); err == nil && v == "0" {
+		r.Detail = "disabled (user.max_user_namespaces = 0)"
+		return r
+	}
+
+	if err := probeUserNamespace(); err != nil {
+		r.Detail = fmt.Sprintf("failed to create a user namespace: %v", err)
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = "available"
+	return r
+}
+
+func diagBwrap(haveUserNS bool) *DiagnosticResult {
+	r := &DiagnosticResult{Name: "bubblewrap", Fatal: true}
+	bwrapPath := findBwrap()
+	if bwrapPath == "" {
+		r.Detail = "unable to find the bwrap binary"
+		return r
+	}
+	fi, err := os.Stat(bwrapPath)
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+
+	isSetuid := fi.Mode()&os.ModeSetuid != 0
+	switch {
+	case isSetuid:
+		r.Passed = true
+		r.Detail = fmt.Sprintf("%v is setuid", bwrapPath)
+	case haveUserNS:
+		r.Passed = true
+		r.Detail = fmt.Sprintf("%v is not setuid, and will use user namespaces", bwrapPath)
+	default:
+		r.Detail = fmt.Sprintf("%v is not setuid, and user namespaces are unavailable", bwrapPath)
+	}
+	if v, err := getBwrapVersion(bwrapPath); err != nil {
+		r.Passed = false
+		r.Detail = fmt.Sprintf("failed to query version: %v", err)
+	} else if !v.atLeast(0, 1, 3) {
+		r.Passed = false
+		r.Detail = fmt.Sprintf("version %v is older than 0.1.3", v)
+	}
+	return r
+}
+
+func diagSeccomp() *DiagnosticResult {
+	r := &DiagnosticResult{Name: "seccomp", Fatal: true}
+
+	rel, err := kernelRelease()
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	if ok, err := kernelHasTSYNC(rel); err != nil {
+		r.Detail = err.Error()
+		return r
+	} else if !ok {
+		r.Detail = fmt.Sprintf("kernel %s does not support SECCOMP_FILTER_FLAG_TSYNC", rel)
+		return r
+	}
+
+	if v, err := procStatusField("Seccomp"); err != nil {
+		r.Detail = "kernel does not support seccomp"
+		return r
+	} else if v != "0" {
+		// Not fatal, but the sandbox filters will stack on top of this.
+		r.Detail = fmt.Sprintf("the launcher is already running under seccomp (mode %v)", v)
+		r.Fatal = false
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("kernel %s supports SECCOMP_FILTER_FLAG_TSYNC", rel)
+	return r
+}
+
+// kernelRelease returns the release of the running kernel, as in `uname -r`.
+func kernelRelease() (string, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", err
+	}
+	var rel []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		rel = append(rel, byte(c))
+	}
+	return string(rel), nil
+}
+
+// kernelHasTSYNC returns true iff the kernel release supports
+// `SECCOMP_FILTER_FLAG_TSYNC` (Linux >= 3.17), which firefox requires as of
+// 7.0.7.
+func kernelHasTSYNC(rel string) (bool, error) {
+	var major, minor int
+	if _, err := fmt.Sscanf(rel, "%d.%d", &major, &minor); err != nil {
+		return false, fmt.Errorf("failed to parse kernel version '%s'", rel)
+	}
+	return major > 3 || (major == 3 && minor >= 17), nil
+}
+
+func procStatusField(name string) (string, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 && kv[0] == name {
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+	return "", fmt.Errorf("no '%v' in /proc/self/status", name)
+}
+
+func diagProcMount(cfg *config.Config) *DiagnosticResult {
+	r := &DiagnosticResult{Name: "/proc mount"}
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint type options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "/proc" || fields[2] != "proc" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			if !strings.HasPrefix(opt, "hidepid=") {
+				continue
+			}
+			if v := strings.TrimPrefix(opt, "hidepid="); v != "0" && v != "off" {
+				r.Detail = fmt.Sprintf("mounted with %v, which may break bubblewrap", opt)
+				return r
+			}
+		}
+		if procIsMasked() && probeUserNamespace() == nil {
+			// Only matters if bubblewrap will use a user namespace.
+			if cfg.Sandbox.ContainerCompat {
+				r.Detail = "partially masked, Tor Browser will run without `/proc`"
+			} else {
+				r.Detail = "partially masked, a new instance can not be mounted in the sandbox, set `containerCompat` in the config"
+				r.Fatal = true
+			}
+			return r
+		}
+		r.Passed = true
+		r.Detail = "mounted without hidepid"
+		return r
+	}
+	r.Detail = "not mounted"
+	r.Fatal = true
+	return r
+}
+
+func diagX11(cfg *config.Config) *DiagnosticResult {
+	r := &DiagnosticResult{Name: "X11", Fatal: true}
+	if cfg.Sandbox.GetX11Mode() == config.X11ModeDisabled {
+		r.Detail = "disabled via the config, Tor Browser will not launch"
+		return r
+	}
+
+	x, err := x11.New(cfg.Sandbox.Display, "", "")
+	if err != nil {
+		r.Detail = err.Error()
+		if inContainer() {
+			r.Detail += ", the container must be given a local DISPLAY (eg: `:0`)"
+		}
+		return r
+	}
+
+	sockPath := x.HostSocket()
+	fi, err := os.Lstat(sockPath)
+	if err != nil {
+		r.Detail = fmt.Sprintf("no X11 socket: %v", err)
+		if inContainer() {
+			r.Detail += fmt.Sprintf(", bind mount %v into the container", x11.SockDir)
+		}
+		return r
+	} else if fi.Mode()&os.ModeSocket == 0 {
+		r.Detail = fmt.Sprintf("%v is not an AF_LOCAL socket", sockPath)
+		return r
+	}
+
+	// The socket directory is world writable, so it should be owned by
+	// root and sticky, and the socket by root or the user.
+	sockDir := filepath.Dir(sockPath)
+	if dfi, err := os.Lstat(sockDir); err != nil {
+		r.Detail = err.Error()
+		return r
+	} else if st, ok := dfi.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 || dfi.Mode()&os.ModeSticky == 0 {
+		r.Detail = fmt.Sprintf("%v is not owned by root, or not sticky", sockDir)
+		r.Fatal = false
+		return r
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || (st.Uid != 0 && int(st.Uid) != os.Getuid()) {
+		r.Detail = fmt.Sprintf("%v is owned by another user", sockPath)
+		r.Fatal = false
+		return r
+	}
+
+	if cfg.Sandbox.GetX11Mode() == config.X11ModeDirect {
+		r.Detail = fmt.Sprintf("%v is usable, but is bound directly without the surrogate", sockPath)
+		r.Fatal = false
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("%v is usable", sockPath)
+	return r
+}
+
+func diagProtectedSymlinks() *DiagnosticResult {
+	r := &DiagnosticResult{Name: "Protected symlinks"}
+	v, err := readSysctl("/proc/sys/fs/protected_symlinks")
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	if v != "1" {
+		r.Detail = fmt.Sprintf("fs.protected_symlinks = %v, should be 1", v)
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = "enabled"
+	return r
+}
+
+func diagAppArmor() *DiagnosticResult {
+	const apparmorDir = "/etc/apparmor.d"
+
+	r := &DiagnosticResult{Name: "AppArmor"}
+	v, err := readSysctl("/proc/sys/kernel/apparmor_restrict_unprivileged_userns")
+	if err != nil || v != "1" {
+		r.Passed = true
+		r.Detail = "unprivileged user namespaces are not restricted"
+		return r
+	}
+
+	// Newer Ubuntu restricts unprivileged user namespaces to binaries with
+	// an AppArmor profile that allows them.
+	r.Fatal = true
+	bwrapPath := findBwrap()
+	if bwrapPath == "" {
+		r.Detail = "unprivileged user namespaces are restricted, and bwrap is missing"
+		return r
+	} else if fi, err := os.Stat(bwrapPath); err == nil && fi.Mode()&os.ModeSetuid != 0 {
+		r.Passed = true
+		r.Detail = "unprivileged user namespaces are restricted, but bwrap is setuid"
+		return r
+	}
+	ents, err := ioutil.ReadDir(apparmorDir)
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	for _, ent := range ents {
+		if ent.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(apparmorDir, ent.Name()))
+		if err != nil {
+			continue
+		}
+		if strings.Contains(string(b), bwrapPath) && strings.Contains(string(b), "userns") {
+			r.Passed = true
+			r.Detail = fmt.Sprintf("bwrap is allowed user namespaces by %v", filepath.Join(apparmorDir, ent.Name()))
+			return r
+		}
+	}
+	r.Detail = "unprivileged user namespaces are restricted, and there is no AppArmor profile allowing bwrap to use them"
+	return r
+}
+
+func diagSELinux(cfg *config.Config) *DiagnosticResult {
+	r := &DiagnosticResult{Name: "SELinux"}
+	mode := SELinuxMode()
+	if mode == "" {
+		r.Passed = true
+		r.Detail = "disabled"
+		return r
+	}
+
+	var problems []string
+
+	// Tor Browser runs in the launcher's domain, and reaches the host X11
+	// and PulseAudio sockets via bind mounts, so a confined launcher can
+	// have the connections denied.
+	if b, err := ioutil.ReadFile("/proc/self/attr/current"); err == nil {
+		label := strings.TrimRight(strings.TrimSpace(string(b)), "\x00")
+		if domain := selinuxType(label); domain != "" && domain != "unconfined_t" {
+			var socks []string
+			if cfg.Sandbox.GetX11Mode() != config.X11ModeDisabled {
+				if x, err := x11.New(cfg.Sandbox.Display, "", ""); err == nil {
+					socks = append(socks, x.HostSocket())
+				}
+			}
+			if cfg.Sandbox.EnablePulseAudio {
+				if sockPath, err := pulseSocketPath(); err == nil {
+					socks = append(socks, sockPath)
+				}
+			}
+			for i, sockPath := range socks {
+				if l, err := selinuxLabel(sockPath); err == nil {
+					socks[i] = fmt.Sprintf("%v (%v)", sockPath, selinuxType(l))
+				}
+			}
+			p := fmt.Sprintf("the launcher is confined as %v", domain)
+			if len(socks) > 0 {
+				p += fmt.Sprintf(", connecting to %v may be denied", strings.Join(socks, " and "))
+			}
+			p += ", check `ausearch -m avc -ts recent` for denials"
+			problems = append(problems, p)
+		}
+	}
+
+	// Files created from inside the sandbox inherit the label of the
+	// directory, instead of what the policy specifies for the path.
+	if restorecon := findRestorecon(); restorecon == "" {
+		problems = append(problems, "restorecon is missing, so files in the Desktop and Downloads directories can not be relabeled")
+	} else {
+		dirs := []string{cfg.HostDesktopDir(), cfg.HostDownloadsDir()}
+		if dirs[0] == dirs[1] {
+			dirs = dirs[1:]
+		}
+		for _, dir := range dirs {
+			if !DirExists(dir) {
+				continue
+			}
+			paths, err := mislabeledFiles(restorecon, dir)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("failed to check the labels in %v: %v", dir, err))
+			} else if len(paths) > 0 {
+				problems = append(problems, fmt.Sprintf("%d file(s) in %v have non-default labels, run `restorecon -R %v`, and set `relabelSharedDirs` in the `sandbox` section of the config", len(paths), dir, dir))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		r.Detail = mode + ", " + strings.Join(problems, "; ")
+		return r
+	}
+	r.Passed = true
+	r.Detail = mode + ", no labeling problems found"
+	return r
+}
+
+// FormatDiagnostics returns a human readable report of the diagnostic
+// results, and true if any of the checks failed fatally.
+func FormatDiagnostics(results []*DiagnosticResult) (string, bool) {
+	fatal := false
+	lines := make([]string, 0, len(results))
+	for _, r := range results {
+		lines = append(lines, r.String())
+		fatal = fatal || (!r.Passed && r.Fatal)
+	}
+	return strings.Join(lines, "\n"), fatal
+}
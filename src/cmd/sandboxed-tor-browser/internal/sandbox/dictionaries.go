@@ -0,0 +1,82 @@
+// dictionaries.go - Spellcheck dictionaries.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// hostDictionariesDir is where the distributions install hunspell
+// dictionaries, and also one of the directories that firefox searches.
+const hostDictionariesDir = "/usr/share/hunspell"
+
+// listDictionaries returns the locales of the hunspell dictionaries (`.dic`
+// and `.aff` pairs) in dir.
+func listDictionaries(dir string) []string {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var locales []string
+	for _, ent := range ents {
+		name := ent.Name()
+		if !strings.HasSuffix(name, ".dic") {
+			continue
+		}
+		locale := strings.TrimSuffix(name, ".dic")
+		if FileExists(filepath.Join(dir, locale+".aff")) {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// appendHostDictionaries binds the host hunspell dictionaries for locales
+// that aren't in the bundle into the sandbox, read-only.
+func (h *hugbox) appendHostDictionaries(bundleDirs []string) {
+	bundleLocales := make(map[string]bool)
+	for _, dir := range bundleDirs {
+		for _, v := range listDictionaries(dir) {
+			bundleLocales[strings.ToLower(strings.Replace(v, "_", "-", -1))] = true
+		}
+	}
+
+	var bound []string
+	for _, v := range listDictionaries(hostDictionariesDir) {
+		if bundleLocales[strings.ToLower(strings.Replace(v, "_", "-", -1))] {
+			continue
+		}
+		for _, ext := range []string{".dic", ".aff"} {
+			p := filepath.Join(hostDictionariesDir, v+ext)
+			h.roBind(p, p, false)
+		}
+		bound = append(bound, v)
+	}
+	if len(bound) > 0 {
+		log.Printf("sandbox: Host dictionaries: %v", strings.Join(bound, " "))
+	} else {
+		Debugf("sandbox: No additional host dictionaries")
+	}
+}
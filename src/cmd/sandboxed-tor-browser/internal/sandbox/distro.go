@@ -0,0 +1,272 @@
+// distro.go - Host distribution library layout probe.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const maxLdSoConfDepth = 8
+
+// hostDistro is the host distribution's library layout, as far as the
+// sandbox cares.
+type hostDistro struct {
+	// ID is the `os-release` `ID` followed by the `ID_LIKE` entries, most
+	// specific first.
+	ID []string
+
+	// LibSearchPath is the list of existing library directories, in search
+	// order, for the libraries that are not in `ld.so.cache`, and for the
+	// various modules that live in subdirectories of the library directories
+	// (DRI drivers, Gtk+ engines, PulseAudio, etc).
+	LibSearchPath []string
+}
+
+// distroLibDirs are the library directories of distribution families, keyed
+// by `os-release` `ID`, most specific first.
+var distroLibDirs = map[string][]string{
+	"debian":   {"/usr/lib/x86_64-linux-gnu", "/lib/x86_64-linux-gnu"},
+	"ubuntu":   {"/usr/lib/x86_64-linux-gnu", "/lib/x86_64-linux-gnu"},
+	"fedora":   {"/usr/lib64", "/lib64"},
+	"rhel":     {"/usr/lib64", "/lib64"},
+	"centos":   {"/usr/lib64", "/lib64"},
+	"mageia":   {"/usr/lib64", "/lib64"},
+	"suse":     {"/usr/lib64", "/lib64"},
+	"opensuse": {"/usr/lib64", "/lib64"},
+	"arch":     {"/usr/lib"},
+	"nixos":    {"/run/opengl-driver/lib", "/run/current-system/sw/lib"},
+}
+
+// genericLibDirs are searched last, regardless of distribution.
+var genericLibDirs = []string{
+	"/usr/lib64",                // Fedora 25
+	"/usr/lib/x86_64-linux-gnu", // Debian
+	"/usr/lib",                  // Arch Linux.
+}
+
+var (
+	hostDistroOnce sync.Once
+	hostDistroInfo *hostDistro
+)
+
+// getHostDistro returns the host distribution, probing it the first time
+// it is called.
+func getHostDistro() *hostDistro {
+	hostDistroOnce.Do(func() {
+		hostDistroInfo = probeDistro("/")
+		Debugf("sandbox: Host distribution: %v, library search path: %v", hostDistroInfo.ID, hostDistroInfo.LibSearchPath)
+	})
+	return hostDistroInfo
+}
+
+// probeDistro builds the library layout of the distribution installed at
+// root, from `os-release`, `ld.so.conf` and the `nix-ld` environment.
+//
+// Note: NixOS has no `ld.so.cache`, so this only helps with locating the
+// modules, not the libraries that the `dynlib` cache resolves.
+func probeDistro(root string) *hostDistro {
+	d := new(hostDistro)
+	if runtime.GOARCH != "amd64" {
+		panic("sandbox: unsupported architecture: " + runtime.GOARCH)
+	}
+
+	osRelease := readOsRelease(filepath.Join(root, "etc", "os-release"))
+	if osRelease == nil {
+		osRelease = readOsRelease(filepath.Join(root, "usr", "lib", "os-release"))
+	}
+	if id := osRelease["ID"]; id != "" {
+		d.ID = append(d.ID, id)
+	}
+	d.ID = append(d.ID, strings.Fields(osRelease["ID_LIKE"])...)
+
+	var dirs []string
+	for _, id := range d.ID {
+		dirs = append(dirs, distroLibDirs[id]...)
+		if id == "nixos" {
+			dirs = append(dirs, nixLdDirs()...)
+		}
+	}
+	dirs = append(dirs, readLdSoConf(root, filepath.Join(root, "etc", "ld.so.conf"), 0)...)
+	dirs = append(dirs, genericLibDirs...)
+
+	seen := make(map[string]bool)
+	for _, v := range dirs {
+		v = filepath.Clean(v)
+		if seen[v] || !DirExists(filepath.Join(root, v)) {
+			continue
+		}
+		seen[v] = true
+		d.LibSearchPath = append(d.LibSearchPath, v)
+	}
+	return d
+}
+
+// readOsRelease parses an `os-release` file, returning nil on failure.
+func readOsRelease(path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		if uv, err := strconv.Unquote(v); err == nil {
+			v = uv
+		} else {
+			v = strings.Trim(v, "'")
+		}
+		m[kv[0]] = v
+	}
+	return m
+}
+
+// readLdSoConf returns the library directories in an `ld.so.conf` file, and
+// the files it includes.  Relative include globs are relative to `/etc`.
+func readLdSoConf(root, path string, depth int) []string {
+	if depth > maxLdSoConfDepth {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := scanner.Text()
+		if idx := strings.IndexByte(l, '#'); idx >= 0 {
+			l = l[:idx]
+		}
+		fields := strings.FieldsFunc(l, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ',' || r == ':'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join("/etc", pattern)
+				}
+				matches, _ := filepath.Glob(filepath.Join(root, pattern))
+				for _, m := range matches {
+					dirs = append(dirs, readLdSoConf(root, m, depth+1)...)
+				}
+			}
+		case "hwcap":
+		default:
+			for _, v := range fields {
+				if filepath.IsAbs(v) {
+					dirs = append(dirs, v)
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// nixLdDirs returns the library directories that `nix-ld` is configured to
+// provide to foreign binaries.
+func nixLdDirs() []string {
+	var dirs []string
+	if p := os.Getenv("NIX_LD_LIBRARY_PATH"); p != "" {
+		dirs = append(dirs, filepath.SplitList(p)...)
+	}
+	if ldSo := os.Getenv("NIX_LD"); filepath.IsAbs(ldSo) {
+		dirs = append(dirs, filepath.Dir(ldSo))
+	}
+	return dirs
+}
+
+// isLike returns true iff the distribution is, or is derived from id.
+func (d *hostDistro) isLike(id string) bool {
+	for _, v := range d.ID {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// compatSymlinks returns the symlinks (target, link) that paper over the
+// hardcoded library directories, when the restricted library set is used.
+// ld-linux.so needs to be in exactly the right place, and openSUSE (and
+// Fedora) libraries really want to use "/usr/lib64" for certain things.
+func (d *hostDistro) compatSymlinks() [][2]string {
+	links := [][2]string{
+		{"/lib", "/lib64"},
+		{restrictedLibDir, "/usr/lib64"},
+	}
+
+	// Debian derived distributions hardcode the multiarch directory in the
+	// module search paths (DRI drivers, PulseAudio, etc), while the sandbox
+	// normalizes the modules to be under the restricted library directory.
+	if d.isLike("debian") {
+		links = append(links, [2]string{restrictedLibDir, "/usr/lib/x86_64-linux-gnu"})
+	}
+	return links
+}
+
+// appendCompatSymlinks appends the distribution's compatibility symlinks.
+// bwrap fails to create a symlink over a directory that already exists, so
+// links that would replace a directory something is already mounted under
+// (eg: a viewer's plugin directory) are skipped, and said directory is used
+// as is.
+func (h *hugbox) appendCompatSymlinks(d *hostDistro) {
+	for _, l := range d.compatSymlinks() {
+		if h.hasDestUnder(l[1]) {
+			Debugf("sandbox: Skipping compat symlink %v, already populated.", l[1])
+			continue
+		}
+		h.symlink(l[0], l[1])
+	}
+}
+
+// standardLibDirs returns the host library directories that are bound into
+// the sandbox as is, when the restricted library set is not used.  NixOS
+// for one, has no `/lib64` unless `stub-ld` is enabled.
+func standardLibDirs() []string {
+	var dirs []string
+	for _, v := range []string{"/usr/lib", "/lib", "/lib64", "/usr/lib64"} {
+		if FileExists(v) {
+			dirs = append(dirs, v)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,184 @@
+// distro_test.go - Host distribution probe tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+func TestProbeDistro(t *testing.T) {
+	// NixOS appends the nix-ld directories from the environment.
+	for _, k := range []string{"NIX_LD_LIBRARY_PATH", "NIX_LD"} {
+		if v, ok := os.LookupEnv(k); ok {
+			os.Unsetenv(k)
+			defer os.Setenv(k, v)
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		files map[string]string
+		dirs  []string
+
+		wantID      []string
+		wantLibPath []string
+	}{
+		{
+			name: "debian",
+			files: map[string]string{
+				"etc/os-release":                           "PRETTY_NAME=\"Debian GNU/Linux 9 (stretch)\"\nID=debian\n",
+				"etc/ld.so.conf":                           "include /etc/ld.so.conf.d/*.conf\n",
+				"etc/ld.so.conf.d/x86_64-linux-gnu.conf":   "# Multiarch support\n/lib/x86_64-linux-gnu\n/usr/lib/x86_64-linux-gnu\n",
+				"etc/ld.so.conf.d/libc.conf":               "/usr/local/lib\n",
+				"etc/ld.so.conf.d/fakeroot-x86_64.conf.bk": "/usr/lib/x86_64-linux-gnu/libfakeroot\n",
+			},
+			dirs:        []string{"lib/x86_64-linux-gnu", "usr/lib/x86_64-linux-gnu/libfakeroot", "usr/local/lib", "usr/lib"},
+			wantID:      []string{"debian"},
+			wantLibPath: []string{"/usr/lib/x86_64-linux-gnu", "/lib/x86_64-linux-gnu", "/usr/local/lib", "/usr/lib"},
+		},
+		{
+			name: "ubuntu",
+			files: map[string]string{
+				"usr/lib/os-release": "ID=ubuntu\nID_LIKE=debian\n",
+			},
+			dirs:        []string{"usr/lib/x86_64-linux-gnu", "usr/lib"},
+			wantID:      []string{"ubuntu", "debian"},
+			wantLibPath: []string{"/usr/lib/x86_64-linux-gnu", "/usr/lib"},
+		},
+		{
+			name: "fedora",
+			files: map[string]string{
+				"etc/os-release":               "NAME=Fedora\nID=fedora\nVERSION_ID=25\n",
+				"etc/ld.so.conf":               "include ld.so.conf.d/*.conf\n",
+				"etc/ld.so.conf.d/mysql.conf":  "/usr/lib64/mysql\n",
+				"etc/ld.so.conf.d/broken.conf": "include broken.conf.d/*.conf\n",
+			},
+			dirs:        []string{"usr/lib64/mysql", "lib64", "usr/lib"},
+			wantID:      []string{"fedora"},
+			wantLibPath: []string{"/usr/lib64", "/lib64", "/usr/lib64/mysql", "/usr/lib"},
+		},
+		{
+			name: "opensuse",
+			files: map[string]string{
+				"etc/os-release": "NAME=\"openSUSE Leap\"\nID=opensuse\nID_LIKE=\"suse\"\n",
+				"etc/ld.so.conf": "/usr/local/lib64\n/usr/local/lib\ninclude /etc/ld.so.conf.d/*.conf\n/lib64\n/lib\n/usr/lib64\n/usr/lib\n/usr/X11R6/lib64/Xaw3d\n",
+			},
+			dirs:        []string{"usr/lib64", "lib64", "usr/local/lib64", "usr/lib"},
+			wantID:      []string{"opensuse", "suse"},
+			wantLibPath: []string{"/usr/lib64", "/lib64", "/usr/local/lib64", "/usr/lib"},
+		},
+		{
+			name: "arch",
+			files: map[string]string{
+				"etc/os-release": "NAME=\"Arch Linux\"\nID=arch\n",
+				"etc/ld.so.conf": "include ld.so.conf.d/*.conf\n",
+			},
+			dirs:        []string{"usr/lib"},
+			wantID:      []string{"arch"},
+			wantLibPath: []string{"/usr/lib"},
+		},
+		{
+			name: "nixos",
+			files: map[string]string{
+				"etc/os-release": "NAME=NixOS\nID=nixos\n",
+			},
+			dirs:        []string{"run/opengl-driver/lib", "run/current-system/sw/lib"},
+			wantID:      []string{"nixos"},
+			wantLibPath: []string{"/run/opengl-driver/lib", "/run/current-system/sw/lib"},
+		},
+		{
+			name:        "unknown",
+			dirs:        []string{"usr/lib64", "usr/lib"},
+			wantLibPath: []string{"/usr/lib64", "/usr/lib"},
+		},
+	}
+
+	for _, tc := range testCases {
+		root, err := ioutil.TempDir("", "distro-"+tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		for f, contents := range tc.files {
+			p := filepath.Join(root, f)
+			if err := os.MkdirAll(filepath.Dir(p), DirMode); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(contents), FileMode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, d := range tc.dirs {
+			if err := os.MkdirAll(filepath.Join(root, d), DirMode); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		d := probeDistro(root)
+		if !reflect.DeepEqual(d.ID, tc.wantID) {
+			t.Errorf("%v: ID: got %q, want %q", tc.name, d.ID, tc.wantID)
+		}
+		if !reflect.DeepEqual(d.LibSearchPath, tc.wantLibPath) {
+			t.Errorf("%v: LibSearchPath: got %q, want %q", tc.name, d.LibSearchPath, tc.wantLibPath)
+		}
+	}
+}
+
+func TestAppendCompatSymlinks(t *testing.T) {
+	debian := &hostDistro{ID: []string{"debian"}}
+	const multiarch = "/usr/lib/x86_64-linux-gnu"
+
+	// Nothing under the multiarch directory, so it is symlinked.
+	h := new(hugbox)
+	h.appendCompatSymlinks(debian)
+	if want := []string{"--symlink", restrictedLibDir, multiarch}; !hasArgs(h.args, want) {
+		t.Errorf("missing %q in %q", want, h.args)
+	}
+
+	// A plugin directory bound under the multiarch directory, so the symlink
+	// would fail with EEXIST.
+	h = new(hugbox)
+	h.roBind("/", multiarch+"/evince", false)
+	h.appendCompatSymlinks(debian)
+	if !hasArgs(h.args, []string{"--symlink", "/lib", "/lib64"}) {
+		t.Errorf("missing /lib64 symlink in %q", h.args)
+	}
+	for i, v := range h.args {
+		if v == multiarch && h.args[i-2] == "--symlink" {
+			t.Errorf("unexpected %v symlink in %q", multiarch, h.args)
+		}
+	}
+	if err := validateArgs(h.args); err != nil {
+		t.Error(err)
+	}
+}
+
+func hasArgs(args, want []string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		if reflect.DeepEqual(args[i:i+len(want)], want) {
+			return true
+		}
+	}
+	return false
+}
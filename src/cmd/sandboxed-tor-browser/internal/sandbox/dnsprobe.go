@@ -0,0 +1,324 @@
+// dnsprobe.go - DNS leak self-test.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// DNSProbeArg is the argument that the launcher is re-executed with inside
+// the DNS leak probe sandbox.
+const DNSProbeArg = "--dns-probe-sandbox"
+
+const (
+	dnsProbeTimeout     = 3 * time.Second
+	probeSandboxTimeout = 30 * time.Second
+)
+
+// dnsProbeResolvers are the well known public DNS and DoH resolvers that are
+// probed in addition to the host's configured nameservers.
+var dnsProbeResolvers = []string{
+	"1.1.1.1",
+	"8.8.8.8",
+	"9.9.9.9",
+	"2606:4700:4700::1111",
+}
+
+// dnsProbeResult is the result of a single direct resolution attempt from
+// inside the probe sandbox.
+type dnsProbeResult struct {
+	Target  string `json:"target"`
+	Leaked  bool   `json:"leaked"`
+	Blocker string `json:"blocker,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+func (r *dnsProbeResult) String() string {
+	if r.Leaked {
+		return fmt.Sprintf("%v: LEAKED (%v)", r.Target, r.Detail)
+	}
+	return fmt.Sprintf("%v: blocked by %v (%v)", r.Target, r.Blocker, r.Detail)
+}
+
+// RunDNSProbe is the entry point of the launcher when re-executed with
+// `DNSProbeArg` inside the probe sandbox.  It attempts to resolve via each
+// of the nameservers in args and the well known resolvers, over UDP, TCP and
+// DoH, writes the results to stdout as JSON, and returns the exit status.
+func RunDNSProbe(args []string) int {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, ns := range append(append([]string{}, args...), dnsProbeResolvers...) {
+		if seen[ns] || net.ParseIP(ns) == nil {
+			continue
+		}
+		seen[ns] = true
+		targets = append(targets, "udp "+net.JoinHostPort(ns, "53"), "tcp "+net.JoinHostPort(ns, "53"))
+	}
+	for _, ns := range dnsProbeResolvers {
+		targets = append(targets, "tcp "+net.JoinHostPort(ns, "443"))
+	}
+
+	results := make([]*dnsProbeResult, len(targets))
+	var wg sync.WaitGroup
+	for i, v := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			results[i] = dnsProbeTarget(target)
+		}(i, v)
+	}
+	wg.Wait()
+
+	if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+		return 1
+	}
+	return 0
+}
+
+func dnsProbeTarget(target string) *dnsProbeResult {
+	r := &dnsProbeResult{Target: target}
+	sp := strings.SplitN(target, " ", 2)
+	network, addr := sp[0], sp[1]
+
+	conn, err := net.DialTimeout(network, addr, dnsProbeTimeout)
+	if err != nil {
+		r.Blocker, r.Detail = dnsProbeBlocker(err), err.Error()
+		return r
+	}
+	defer conn.Close()
+	if network == "tcp" {
+		// Being able to establish a TCP connection at all is a leak,
+		// regardless of if it's DNS over TCP or DoH.
+		r.Leaked, r.Detail = true, "connected"
+		return r
+	}
+
+	// UDP is connectionless, so an actual query needs to be answered.
+	conn.SetDeadline(time.Now().Add(dnsProbeTimeout))
+	query := dnsProbeQuery("torproject.org")
+	if _, err = conn.Write(query); err != nil {
+		r.Blocker, r.Detail = dnsProbeBlocker(err), err.Error()
+		return r
+	}
+	var resp [512]byte
+	n, err := conn.Read(resp[:])
+	if err != nil {
+		r.Blocker, r.Detail = dnsProbeBlocker(err), err.Error()
+		return r
+	}
+	if n >= 12 && bytes.Equal(resp[:2], query[:2]) {
+		r.Leaked, r.Detail = true, "answered"
+	} else {
+		r.Blocker, r.Detail = "network", "invalid response"
+	}
+	return r
+}
+
+func dnsProbeBlocker(err error) string {
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		case syscall.Errno:
+			if e == syscall.ENOSYS || e == syscall.EPERM || e == syscall.EACCES {
+				return "seccomp"
+			}
+		}
+		return "network namespace"
+	}
+}
+
+func dnsProbeQuery(name string) []byte {
+	// ID, RD, QDCOUNT = 1
+	b := []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(b[0:], uint16(time.Now().UnixNano()))
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0x00, 0x00, 0x01, 0x00, 0x01) // QTYPE = A, QCLASS = IN
+}
+
+// hostNameservers returns the nameservers from the host `/etc/resolv.conf`.
+func hostNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var ret []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			ret = append(ret, fields[1])
+		}
+	}
+	return ret
+}
+
+// runDNSProbe re-executes the launcher inside a sandbox with the same network
+// and seccomp policy as Tor Browser, and returns the results of the direct
+// resolution attempts made from inside it.
+func runDNSProbe() (results []*dnsProbeResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	h, err := newHugbox()
+	if err != nil {
+		return nil, err
+	}
+	h.stderr = newConsoleLogger("dns-probe")
+	h.seccompFn = torBrowserSeccompFn
+	if err = h.appendSelf("dns-probe", append([]string{DNSProbeArg}, hostNameservers()...)); err != nil {
+		return nil, err
+	}
+
+	if err = h.runProbe(&results); err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		Debugf("sandbox: DNS probe: %v", r)
+	}
+	return results, nil
+}
+
+// appendSelf sets the launcher, and the libraries it needs, as the command to
+// run in the sandbox, for the probes that re-execute the launcher.
+func (h *hugbox) appendSelf(name string, args []string) error {
+	return h.appendSelfWithLibraries(name, args, nil, "")
+}
+
+// appendSelfWithLibraries is appendSelf, that also resolves the dependencies
+// of the libraries that the launcher will dlopen(), searching ldLibraryPath
+// first.  The caller is responsible for making ldLibraryPath available in
+// the sandbox, and setting `LD_LIBRARY_PATH` accordingly.
+func (h *hugbox) appendSelfWithLibraries(name string, args []string, libs []string, ldLibraryPath string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	probePath := filepath.Join(h.homeDir, name)
+	h.roBind(self, probePath, false)
+	if dynlib.IsSupported() {
+		cache, err := dynlib.LoadCache()
+		if err != nil {
+			return err
+		}
+		if err := h.appendLibraries(cache, append([]string{self}, libs...), nil, ldLibraryPath, nil); err != nil {
+			return err
+		}
+		h.setenv("LD_LIBRARY_PATH", restrictedLibDir)
+	}
+	h.cmd = probePath
+	h.cmdArgs = args
+	return nil
+}
+
+// runProbe runs the probe sandbox, and decodes the JSON that it writes to
+// stdout into v.
+func (h *hugbox) runProbe(v interface{}) error {
+	// The output is read via a pipe, since `Process.Wait()` does not wait
+	// for exec to finish copying to a non-file `io.Writer`.
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	h.stdout = wr
+
+	process, err := h.run()
+	wr.Close()
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(probeSandboxTimeout, process.Kill)
+	out, _ := ioutil.ReadAll(rd)
+	process.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("timeout waiting for the probe")
+	}
+
+	if err = json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("failed to parse probe results: %v", err)
+	}
+	return nil
+}
+
+func diagDNSLeak() *DiagnosticResult {
+	r := &DiagnosticResult{Name: "DNS leaks"}
+	if findBwrap() == "" {
+		r.Detail = "skipped, bwrap is missing"
+		return r
+	}
+
+	results, err := runDNSProbe()
+	if err != nil {
+		r.Detail = fmt.Sprintf("failed to run the probe sandbox: %v", err)
+		return r
+	}
+	var leaks []string
+	blockers := make(map[string]bool)
+	for _, v := range results {
+		if v.Leaked {
+			leaks = append(leaks, v.Target)
+		} else {
+			blockers[v.Blocker] = true
+		}
+	}
+	if len(leaks) > 0 {
+		log.Printf("sandbox: DNS probe: direct resolution possible via: %v", strings.Join(leaks, ", "))
+		r.Detail = fmt.Sprintf("direct connections from the sandbox succeeded: %v", strings.Join(leaks, ", "))
+		r.Fatal = true
+		return r
+	}
+
+	var by []string
+	for _, v := range []string{"network namespace", "seccomp"} {
+		if blockers[v] {
+			by = append(by, v)
+		}
+	}
+	r.Passed = true
+	r.Detail = fmt.Sprintf("all %d direct DNS and DoH attempts were blocked (%v)", len(results), strings.Join(by, ", "))
+	return r
+}
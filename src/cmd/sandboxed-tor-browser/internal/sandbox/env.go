@@ -0,0 +1,170 @@
+// env.go - Sandbox environment variable policy.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// The sandboxed processes are started with an empty environment, and only
+// the variables set via `hugbox.setenv()` are passed in.  Every variable the
+// launcher sets must be listed in `sandboxEnvAllowlist`, so that new
+// variables get reviewed, instead of leaking in from wherever.
+//
+// Users may inject additional variables via the config (eg: `MOZ_X11_EGL`),
+// but nothing overriding the launcher's variables, or that is in
+// `sandboxEnvDenylist` is allowed through.
+
+// sandboxEnvAllowlist is the set of variables that the launcher sets, and
+// why.
+var sandboxEnvAllowlist = map[string]string{
+	// Common.
+	"HOME":            "the sandbox home directory",
+	"XDG_RUNTIME_DIR": "the sandbox runtime directory",
+	"LD_LIBRARY_PATH": "the restricted library search path",
+	"LD_PRELOAD":      "the AF_LOCAL compatibility stub",
+
+	// X11.
+	"DISPLAY":    "the display (or surrogate) in the sandbox",
+	"XAUTHORITY": "the sanitized Xauthority file",
+
+	// Tor Browser using the surrogates.
+	"TOR_SOCKS_PORT":                  "the SOCKS surrogate",
+	"TOR_CONTROL_PORT":                "the control port surrogate",
+	"TOR_SKIP_LAUNCH":                 "the launcher manages tor",
+	"TOR_NO_DISPLAY_NETWORK_SETTINGS": "the launcher manages tor",
+	"TOR_HIDE_UPDATE_CHECK_UI":        "the launcher handles updates",
+	"TOR_STUB_CONTROL_SOCKET":         "the control port surrogate socket",
+	"TOR_STUB_MEDIA_SECCOMP":          "the GPU/RDD process seccomp filter",
+	"TOR_STUB_SHADOW_MANIFEST":        "the amnesiac profile copy manifest",
+	"TOR_STUB_SOCKS_SOCKET":           "the SOCKS surrogate socket",
+	"TOR_SOCKS_IPC_PATH":              "the SOCKS surrogate socket, used directly",
+	"TOR_CONTROL_IPC_PATH":            "the control port surrogate socket, used directly",
+
+	// Firefox.
+	"FONTCONFIG_PATH":           "the bundled or consistent fonts fontconfig configuration",
+	"FONTCONFIG_FILE":           "the bundled or consistent fonts fontconfig configuration",
+	"LIBGL_ALWAYS_SOFTWARE":     "hardware OpenGL does not work",
+	"LIBGL_DRIVERS_PATH":        "the restricted DRI drivers",
+	"MOZ_CRASHREPORTER_DISABLE": "crash dumps are not to be trusted",
+
+	// mozilla.cfg.
+	"SANDBOXED_TOR_BROWSER_DISK_CACHE":      "the persistent disk cache size in KiB",
+	"SANDBOXED_TOR_BROWSER_RESTORE_SESSION": "the crashed session should be restored",
+
+	// Gtk+.
+	"GTK2_RC_FILES":          "the Gtk+ 2.0 theme",
+	"GTK_PATH":               "the restricted Gtk+ 2.0 modules",
+	"GDK_PIXBUF_MODULE_FILE": "the restricted gdk-pixbuf loaders",
+	"NO_AT_BRIDGE":           "accessibility needs D-Bus",
+
+	// PulseAudio.
+	"PULSE_SERVER":       "the PulseAudio socket",
+	"PULSE_CLIENTCONFIG": "the PulseAudio client configuration",
+	"PULSE_COOKIE":       "the PulseAudio cookie",
+}
+
+// sandboxEnvDenylist is the set of variables (or prefixes ending in `_`)
+// that are never passed into the sandbox, even if requested by the user,
+// either because they fingerprint the host, or they alter what actually
+// gets loaded and run.
+var sandboxEnvDenylist = []string{
+	// Fingerprinting.
+	"TZ",
+	"LANG",
+	"LANGUAGE",
+	"LC_",
+	"USER",
+	"LOGNAME",
+	"HOSTNAME",
+	"SHELL",
+	"PWD",
+	"DESKTOP_SESSION",
+	"SESSION_MANAGER",
+	"XDG_",
+	"SSH_",
+	"DBUS_",
+	"GNOME_",
+	"KDE_",
+
+	// Code loading, and sandbox escape.
+	"LD_",
+	"GTK_",
+	"GDK_",
+	"GIO_",
+	"GST_",
+	"TOR_",
+	"MOZ_CRASHREPORTER",
+	"PULSE_",
+	"WAYLAND_",
+}
+
+func isDeniedEnv(k string) bool {
+	for _, v := range sandboxEnvDenylist {
+		if k == v || (strings.HasSuffix(v, "_") && strings.HasPrefix(k, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidEnvKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i, c := range k {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setUserEnv sets the user requested extra environment variables, skipping
+// anything that is denied, or that the launcher sets itself.
+func (h *hugbox) setUserEnv(env map[string]string) {
+	for k, v := range env {
+		switch {
+		case !isValidEnvKey(k):
+			log.Printf("sandbox: Ignoring invalid environment variable: '%v'", k)
+		case isDeniedEnv(k) || sandboxEnvAllowlist[k] != "":
+			log.Printf("sandbox: Ignoring disallowed environment variable: %v", k)
+		default:
+			log.Printf("sandbox: Setting user environment variable: %v", k)
+			h.env[k] = v
+		}
+	}
+}
+
+func (h *hugbox) envArgs() []string {
+	keys := make([]string, 0, len(h.env))
+	for k := range h.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, 3*len(keys))
+	for _, k := range keys {
+		args = append(args, "--setenv", k, h.env[k])
+	}
+	return args
+}
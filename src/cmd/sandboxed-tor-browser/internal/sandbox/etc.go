@@ -0,0 +1,93 @@
+// etc.go - Sandbox `/etc` policy.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// etcAllowedBinds are the host `/etc` paths that may be bound into a
+// sandbox.  Everything else under `/etc` is synthetic, so that nothing
+// about the host configuration (resolvers, hosts, distribution, etc) is
+// visible, either directly or via a library that reads it.
+var etcAllowedBinds = map[string]bool{
+	"/etc/fonts": true, // The document viewer uses the host fontconfig.
+}
+
+// appendEtc adds the synthetic `/etc` files.  `/etc/passwd` and
+// `/etc/group` depend on the sandbox uid/gid and are added by `run()`.
+//
+// Note: `/etc/os-release` is usually a symlink to `/usr/lib/os-release`,
+// which is only hidden when the restricted library set is used, since
+// otherwise the host `/usr/lib` is bound as is.
+func (h *hugbox) appendEtc() {
+	hostname := h.hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	h.file("/etc/hostname", []byte(hostname+"\n"))
+	h.file("/etc/hosts", []byte(fmt.Sprintf("127.0.0.1\tlocalhost\n::1\tlocalhost\n127.0.1.1\t%s\n", hostname)))
+	if h.resolvConf != nil {
+		h.file("/etc/nsswitch.conf", []byte("passwd: files\ngroup: files\nhosts: files dns\n"))
+		h.file("/etc/resolv.conf", h.resolvConf)
+	} else {
+		h.file("/etc/nsswitch.conf", []byte("passwd: files\ngroup: files\nhosts: files\n"))
+
+		// The network namespace is unshared, and nothing should ever
+		// attempt to resolve names directly.
+		h.file("/etc/resolv.conf", []byte("# All name resolution is done via tor.\n"))
+	}
+
+	osRelease := []byte("NAME=\"Linux\"\nID=linux\nPRETTY_NAME=\"Linux\"\n")
+	h.file("/etc/os-release", osRelease)
+	if !h.standardLibs {
+		h.file("/usr/lib/os-release", osRelease)
+	}
+}
+
+// validateEtc ensures that the bubblewrap arguments, which must have already
+// been checked by `validateArgs()`, do not make any host `/etc` file that is
+// not explicitly allowed reachable from inside the sandbox.
+func validateEtc(args []string) error {
+	for i := 0; i < len(args); {
+		opt := args[i]
+		operands := bwrapOptions[opt]
+		i++
+
+		if opt == "--bind" || opt == "--ro-bind" {
+			src, dst := filepath.Clean(args[i]), filepath.Clean(args[i+1])
+			switch {
+			case etcAllowedBinds[src] && src == dst:
+			case isSubPath(src, "/etc") || isSubPath("/etc", src):
+				return fmt.Errorf("sandbox: host `/etc` bound into the sandbox: '%s' -> '%s'", src, dst)
+			case isSubPath(dst, "/etc"):
+				return fmt.Errorf("sandbox: bind over the synthetic `/etc`: '%s' -> '%s'", src, dst)
+			}
+		}
+		i += len(operands)
+	}
+	return nil
+}
+
+// isSubPath returns true if p is dir, or is under dir.  Both must be clean
+// absolute paths.
+func isSubPath(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,101 @@
+// fetch.go - Install/update fetch helper sandbox.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// FetchHelperArg is the argument that the launcher is re-executed with inside
+// the fetch helper sandbox.
+const FetchHelperArg = "--fetch-helper-sandbox"
+
+const (
+	fetchHelperRequest = "/home/amnesia/fetch.json"
+	fetchHelperOutDir  = "/home/amnesia/fetch"
+	fetchHelperSocks   = "/home/amnesia/socks"
+)
+
+// FetchHelper is the configuration of a fetch helper sandbox, which does a
+// single install/update related HTTP(S) request, so that the launcher never
+// has to parse anything that came off the network, other than what it was
+// after in the first place.
+type FetchHelper struct {
+	// Request is the request, passed to the helper as is.
+	Request []byte
+
+	// OutDir is the host directory that the helper writes to.
+	OutDir string
+
+	// SocksPath is the host path of the tor SOCKS socket, if any.
+	SocksPath string
+
+	// Direct is if the helper connects via the host network, and resolves
+	// names itself, instead of (only) via the SOCKS socket.
+	Direct bool
+
+	// Stdout receives the helper's status updates.
+	Stdout *os.File
+}
+
+// RunFetchHelper launches a fetch helper sandbox.  The helper is executed
+// with `FetchHelperArg`, followed by the in-sandbox paths of the request,
+// the output directory, and the SOCKS socket ("" if none).
+func RunFetchHelper(cfg *config.Config, fh *FetchHelper) (process *Process, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	h, err := newHugbox()
+	if err != nil {
+		return nil, err
+	}
+	h.stdout = fh.Stdout
+	h.stderr = newConsoleLogger("fetch")
+	// The helper always gets the Tor Browser profile, even while Tor Browser
+	// itself runs without one, since it handles untrusted network data.
+	h.seccompFn = func(fd *os.File) error { return installFetchSeccompProfile(fd, fh.Direct) }
+	h.mountProc = false
+	h.applyContainerCompat(cfg)
+
+	socksPath := ""
+	if fh.SocksPath != "" {
+		h.bind(fh.SocksPath, fetchHelperSocks, false)
+		socksPath = fetchHelperSocks
+	}
+	if fh.Direct {
+		if h.resolvConf, err = ioutil.ReadFile("/etc/resolv.conf"); err != nil {
+			return nil, err
+		}
+		h.unshare.net = false
+	}
+	h.bind(fh.OutDir, fetchHelperOutDir, false)
+	h.file(fetchHelperRequest, fh.Request)
+
+	if err = h.appendSelf("fetch-helper", []string{FetchHelperArg, fetchHelperRequest, fetchHelperOutDir, socksPath}); err != nil {
+		return nil, err
+	}
+
+	return h.run()
+}
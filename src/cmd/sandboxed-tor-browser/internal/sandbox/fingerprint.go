@@ -0,0 +1,60 @@
+// fingerprint.go - Host environment fingerprint.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"os"
+	"runtime"
+)
+
+// Fingerprint is a summary of the host environment features that the
+// sandbox depends on, for the benefit of bug reports.
+type Fingerprint struct {
+	Arch   string `json:"arch"`
+	Kernel string `json:"kernel"`
+
+	BwrapPath    string `json:"bwrapPath,omitempty"`
+	BwrapVersion string `json:"bwrapVersion,omitempty"`
+	BwrapSetuid  bool   `json:"bwrapSetuid"`
+
+	UserNamespaces bool `json:"userNamespaces"`
+	SeccompTSYNC   bool `json:"seccompTsync"`
+	Grsec          bool `json:"grsec"`
+}
+
+// GetFingerprint returns the host environment fingerprint.  Failures to
+// query individual features are reflected as the feature being absent.
+func GetFingerprint() *Fingerprint {
+	fp := &Fingerprint{
+		Arch:           runtime.GOARCH,
+		UserNamespaces: diagUserNamespaces().Passed,
+		Grsec:          IsGrsecKernel(),
+	}
+	if rel, err := kernelRelease(); err == nil {
+		fp.Kernel = rel
+		fp.SeccompTSYNC, _ = kernelHasTSYNC(rel)
+	}
+	if fp.BwrapPath = findBwrap(); fp.BwrapPath != "" {
+		if fi, err := os.Stat(fp.BwrapPath); err == nil {
+			fp.BwrapSetuid = fi.Mode()&os.ModeSetuid != 0
+		}
+		if v, err := getBwrapVersion(fp.BwrapPath); err == nil {
+			fp.BwrapVersion = v.String()
+		}
+	}
+	return fp
+}
@@ -0,0 +1,312 @@
+// fonts.go - Font configuration and font visibility self-test.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// FontProbeArg is the argument that the launcher is re-executed with inside
+// the font probe sandbox.
+const FontProbeArg = "--font-probe-sandbox"
+
+// consistentFontsConf is the fontconfig configuration used when consistent
+// fonts are enabled.  Nothing is included from the host, so the only fonts
+// are the bundled ones, and the rendering settings are fixed.
+const consistentFontsConf = `<?xml version="1.0"?>
+<!DOCTYPE fontconfig SYSTEM "fonts.dtd">
+<fontconfig>
+  <dir>%s</dir>
+  <cachedir>%s</cachedir>
+  <config>
+    <rescan><int>0</int></rescan>
+  </config>
+  <match target="font">
+    <edit name="antialias" mode="assign"><bool>true</bool></edit>
+    <edit name="hinting" mode="assign"><bool>true</bool></edit>
+    <edit name="hintstyle" mode="assign"><const>hintslight</const></edit>
+    <edit name="rgba" mode="assign"><const>none</const></edit>
+    <edit name="lcdfilter" mode="assign"><const>lcddefault</const></edit>
+  </match>
+</fontconfig>
+`
+
+var fontFileExts = map[string]bool{
+	".bdf":   true,
+	".otf":   true,
+	".pcf":   true,
+	".pfa":   true,
+	".pfb":   true,
+	".ttc":   true,
+	".ttf":   true,
+	".woff":  true,
+	".woff2": true,
+}
+
+// bundleFontconfigDirs are the locations of the bundled fontconfig
+// configuration relative to the bundle's `Browser` directory, newest layout
+// first.
+var bundleFontconfigDirs = []string{
+	"fontconfig",
+	filepath.Join("TorBrowser", "Data", "fontconfig"),
+}
+
+// bundleFontsDirs are the locations of the bundled fonts relative to the
+// bundle's `Browser` directory, newest layout first.
+var bundleFontsDirs = []string{
+	"fonts",
+	filepath.Join("TorBrowser", "Data", "fonts"),
+}
+
+const bundleFontconfigFile = "fonts.conf"
+
+// bundleFontLayout is where a bundle keeps its fonts, and fontconfig
+// configuration, relative to the `Browser` directory.
+type bundleFontLayout struct {
+	// ConfigDir is the directory containing `fonts.conf`, or "" if the
+	// bundle has no fontconfig configuration.
+	ConfigDir string
+
+	// FontsDir is the directory containing the bundled fonts, or "" if
+	// the bundle has no fonts directory.
+	FontsDir string
+}
+
+// detectBundleFontLayout examines the bundle `Browser` directory at
+// realBrowserHome, and returns where the fonts and configuration are.
+func detectBundleFontLayout(realBrowserHome string) *bundleFontLayout {
+	l := new(bundleFontLayout)
+	for _, d := range bundleFontconfigDirs {
+		if FileExists(filepath.Join(realBrowserHome, d, bundleFontconfigFile)) {
+			l.ConfigDir = d
+			break
+		}
+	}
+	for _, d := range bundleFontsDirs {
+		if DirExists(filepath.Join(realBrowserHome, d)) {
+			l.FontsDir = d
+			break
+		}
+	}
+	return l
+}
+
+// appendFonts configures fontconfig for Tor Browser.  By default the bundled
+// configuration is used, otherwise a generated configuration that only has
+// the bundled fonts, and a cache that is empty at the start of each session.
+// The generated configuration is also used if the bundle does not have a
+// configuration where one is expected.
+func (h *hugbox) appendFonts(realBrowserHome, browserHome string, consistent bool) error {
+	layout := detectBundleFontLayout(realBrowserHome)
+	Debugf("sandbox: Bundle font layout: %+v", layout)
+
+	if !consistent {
+		if layout.ConfigDir != "" {
+			h.setenv("FONTCONFIG_PATH", filepath.Join(browserHome, layout.ConfigDir))
+			h.setenv("FONTCONFIG_FILE", bundleFontconfigFile)
+			return nil
+		}
+		log.Printf("sandbox: Failed to find the bundled fontconfig configuration, using only the bundled fonts")
+	}
+	if layout.FontsDir == "" {
+		return fmt.Errorf("sandbox: failed to find the bundled fonts in: %v", realBrowserHome)
+	}
+
+	confPath := filepath.Join(h.homeDir, ".tbb_fonts.conf")
+	cacheDir := filepath.Join(h.homeDir, ".cache", "fontconfig")
+	h.tmpfs(cacheDir)
+	h.file(confPath, []byte(fmt.Sprintf(consistentFontsConf, filepath.Join(browserHome, layout.FontsDir), cacheDir)))
+	h.setenv("FONTCONFIG_PATH", h.homeDir)
+	h.setenv("FONTCONFIG_FILE", confPath)
+	return nil
+}
+
+// fontProbeResult is the set of fonts visible from inside the probe sandbox.
+type fontProbeResult struct {
+	// Fonts is every font file visible anywhere in the sandbox.
+	Fonts []string `json:"fonts"`
+
+	// Dirs is the directories that fontconfig is configured to scan.
+	Dirs []string `json:"dirs"`
+}
+
+// RunFontProbe is the entry point of the launcher when re-executed with
+// `FontProbeArg` inside the probe sandbox.  It enumerates the font files
+// visible in the sandbox, and the directories that fontconfig is configured
+// to scan, writes the result to stdout as JSON, and returns the exit status.
+func RunFontProbe(args []string) int {
+	r := new(fontProbeResult)
+	filepath.Walk("/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			switch path {
+			case "/dev", "/proc", "/sys":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fontFileExts[filepath.Ext(strings.TrimSuffix(path, ".gz"))] {
+			r.Fonts = append(r.Fonts, path)
+		}
+		return nil
+	})
+	r.Dirs = fontconfigDirs()
+
+	if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// fontconfigDirs returns the font directories from the fontconfig
+// configuration specified by the environment.  Includes are not followed,
+// since neither the bundled nor the generated configuration uses them.
+func fontconfigDirs() []string {
+	confPath := os.Getenv("FONTCONFIG_FILE")
+	if !filepath.IsAbs(confPath) {
+		confPath = filepath.Join(os.Getenv("FONTCONFIG_PATH"), confPath)
+	}
+	b, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return nil
+	}
+
+	var conf struct {
+		Dirs []struct {
+			Prefix string `xml:"prefix,attr"`
+			Path   string `xml:",chardata"`
+		} `xml:"dir"`
+	}
+	if err = xml.Unmarshal(b, &conf); err != nil {
+		return nil
+	}
+	cwd, _ := os.Getwd()
+	var dirs []string
+	for _, d := range conf.Dirs {
+		dir := strings.TrimSpace(d.Path)
+		switch {
+		case strings.HasPrefix(dir, "~/"):
+			dir = filepath.Join(os.Getenv("HOME"), dir[2:])
+		case d.Prefix == "xdg":
+			dir = filepath.Join(os.Getenv("HOME"), ".local", "share", dir)
+		case !filepath.IsAbs(dir):
+			dir = filepath.Join(cwd, dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs
+}
+
+// runFontProbe re-executes the launcher inside a sandbox with the same font
+// configuration and host theme data as Tor Browser, and returns the fonts
+// visible inside it, along with where the bundle is in the sandbox.
+func runFontProbe(cfg *config.Config) (result *fontProbeResult, bundleDir string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	h, err := newHugbox()
+	if err != nil {
+		return nil, "", err
+	}
+	h.stderr = newConsoleLogger("font-probe")
+
+	bundleDir = filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser")
+	browserHome := filepath.Join(bundleDir, "Browser")
+	h.appendDesktopAssets(true)
+	h.roBind(cfg.BundleInstallDir, bundleDir, false)
+	if err = h.appendFonts(filepath.Join(cfg.BundleInstallDir, "Browser"), browserHome, cfg.Sandbox.ConsistentFonts); err != nil {
+		return nil, "", err
+	}
+	h.chdir = browserHome
+	if err = h.appendSelf("font-probe", []string{FontProbeArg}); err != nil {
+		return nil, "", err
+	}
+
+	result = new(fontProbeResult)
+	if err = h.runProbe(result); err != nil {
+		return nil, "", err
+	}
+	return result, bundleDir, nil
+}
+
+func diagFonts(cfg *config.Config) *DiagnosticResult {
+	r := &DiagnosticResult{Name: "Fonts"}
+	if findBwrap() == "" {
+		r.Detail = "skipped, bwrap is missing"
+		return r
+	} else if !DirExists(filepath.Join(cfg.BundleInstallDir, "Browser")) {
+		r.Detail = "skipped, Tor Browser is not installed"
+		return r
+	}
+
+	result, bundleDir, err := runFontProbe(cfg)
+	if err != nil {
+		r.Detail = fmt.Sprintf("failed to run the probe sandbox: %v", err)
+		return r
+	}
+
+	// Everything outside of the bundle is a host font, and the ones that
+	// are under a directory that fontconfig scans are usable by Tor
+	// Browser.
+	var hostFonts, usable []string
+	for _, f := range result.Fonts {
+		if strings.HasPrefix(f, bundleDir+"/") {
+			continue
+		}
+		hostFonts = append(hostFonts, f)
+		for _, d := range result.Dirs {
+			if strings.HasPrefix(f, d+"/") {
+				usable = append(usable, f)
+				break
+			}
+		}
+	}
+	for _, f := range hostFonts {
+		Debugf("sandbox: Font probe: host font visible: %v", f)
+	}
+	bundleFonts := len(result.Fonts) - len(hostFonts)
+
+	switch {
+	case len(usable) > 0:
+		r.Detail = fmt.Sprintf("%d host fonts are usable by Tor Browser (eg: %v)", len(usable), usable[0])
+		if !cfg.Sandbox.ConsistentFonts {
+			r.Detail += ", enabling consistent fonts will hide them"
+		}
+	case len(hostFonts) > 0:
+		r.Passed = true
+		r.Detail = fmt.Sprintf("%d bundled fonts are usable, %d host fonts are visible but not used", bundleFonts, len(hostFonts))
+	default:
+		r.Passed = true
+		r.Detail = fmt.Sprintf("only the %d bundled fonts are visible", bundleFonts)
+	}
+	return r
+}
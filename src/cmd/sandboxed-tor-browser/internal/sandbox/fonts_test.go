@@ -0,0 +1,144 @@
+// fonts_test.go - Bundle font layout tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+func TestBundleFontLayout(t *testing.T) {
+	const browserHome = "/home/amnesia/sandboxed-tor-browser/tor-browser/Browser"
+
+	testCases := []struct {
+		name  string
+		files []string
+		dirs  []string
+
+		wantLayout bundleFontLayout
+		wantConfig string // FONTCONFIG_PATH with the bundled configuration.
+		wantErr    bool   // Generated configuration fails.
+	}{
+		{
+			name:       "old",
+			files:      []string{"TorBrowser/Data/fontconfig/fonts.conf"},
+			dirs:       []string{"fonts"},
+			wantLayout: bundleFontLayout{ConfigDir: "TorBrowser/Data/fontconfig", FontsDir: "fonts"},
+			wantConfig: browserHome + "/TorBrowser/Data/fontconfig",
+		},
+		{
+			name:       "new",
+			files:      []string{"fontconfig/fonts.conf", "TorBrowser/Data/fontconfig/fonts.conf"},
+			dirs:       []string{"fonts"},
+			wantLayout: bundleFontLayout{ConfigDir: "fontconfig", FontsDir: "fonts"},
+			wantConfig: browserHome + "/fontconfig",
+		},
+		{
+			name:       "data-fonts",
+			files:      []string{"TorBrowser/Data/fontconfig/fonts.conf"},
+			dirs:       []string{"TorBrowser/Data/fonts"},
+			wantLayout: bundleFontLayout{ConfigDir: "TorBrowser/Data/fontconfig", FontsDir: "TorBrowser/Data/fonts"},
+			wantConfig: browserHome + "/TorBrowser/Data/fontconfig",
+		},
+		{
+			name:       "no-config",
+			dirs:       []string{"fonts"},
+			wantLayout: bundleFontLayout{FontsDir: "fonts"},
+		},
+		{
+			name:       "no-fonts",
+			files:      []string{"fontconfig/fonts.conf"},
+			wantLayout: bundleFontLayout{ConfigDir: "fontconfig"},
+			wantConfig: browserHome + "/fontconfig",
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		root, err := ioutil.TempDir("", "fonts-"+tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		for _, f := range tc.files {
+			p := filepath.Join(root, f)
+			if err := os.MkdirAll(filepath.Dir(p), DirMode); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte("<fontconfig/>\n"), FileMode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, d := range tc.dirs {
+			if err := os.MkdirAll(filepath.Join(root, d), DirMode); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if l := detectBundleFontLayout(root); *l != tc.wantLayout {
+			t.Errorf("%v: layout: got %+v, want %+v", tc.name, *l, tc.wantLayout)
+		}
+
+		// The bundled configuration.
+		h := &hugbox{env: make(map[string]string), homeDir: "/home/amnesia"}
+		err = h.appendFonts(root, browserHome, false)
+		switch {
+		case tc.wantConfig != "":
+			if err != nil {
+				t.Errorf("%v: bundled: %v", tc.name, err)
+			} else if h.env["FONTCONFIG_PATH"] != tc.wantConfig || h.env["FONTCONFIG_FILE"] != bundleFontconfigFile {
+				t.Errorf("%v: bundled: got %q, want %v/%v", tc.name, h.env, tc.wantConfig, bundleFontconfigFile)
+			}
+		case tc.wantErr:
+			if err == nil {
+				t.Errorf("%v: bundled: no error without the fonts", tc.name)
+			}
+		case err != nil:
+			// Falls back to the generated configuration.
+			t.Errorf("%v: bundled: %v", tc.name, err)
+		}
+
+		// The generated configuration.
+		h = &hugbox{env: make(map[string]string), homeDir: "/home/amnesia"}
+		err = h.appendFonts(root, browserHome, true)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: generated: no error without the fonts", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: generated: %v", tc.name, err)
+			continue
+		}
+		if len(h.fileData) != 1 {
+			t.Fatalf("%v: generated: got %d files, want 1", tc.name, len(h.fileData))
+		}
+		wantDir := "<dir>" + filepath.Join(browserHome, tc.wantLayout.FontsDir) + "</dir>"
+		if !strings.Contains(string(h.fileData[0]), wantDir) {
+			t.Errorf("%v: generated: missing %v in %s", tc.name, wantDir, h.fileData[0])
+		}
+		if h.env["FONTCONFIG_FILE"] != h.fileDests[0] {
+			t.Errorf("%v: generated: FONTCONFIG_FILE %q, want %q", tc.name, h.env["FONTCONFIG_FILE"], h.fileDests[0])
+		}
+	}
+}
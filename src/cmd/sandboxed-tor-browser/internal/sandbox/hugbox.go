@@ -19,17 +19,21 @@ package sandbox
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
@@ -72,6 +76,10 @@ func (u *unshareOpts) toArgs() []string {
 	return args
 }
 
+// sandboxUID is the uid/gid used inside the sandbox when a new user
+// namespace is created, regardless of the host uid.
+const sandboxUID = 1000
+
 type hugbox struct {
 	cmd     string
 	cmdArgs []string
@@ -87,22 +95,36 @@ type hugbox struct {
 	stderr    io.Writer
 	seccompFn func(*os.File) error
 	pdeathSig syscall.Signal
+	cgroup    *cgroupLimits
+	noSystemd bool   // Don't use a systemd scope for the cgroup.
+	tmpSize   uint64 // `/tmp` size limit in bytes, 0 is unlimited.
 
 	fakeDbus     bool
 	standardLibs bool
 
+	// resolvConf is the `/etc/resolv.conf` contents, for the rare sandbox
+	// that must resolve names directly.  If nil, name resolution is
+	// disabled.
+	resolvConf []byte
+
 	// Internal options, not to be *modified* except via helpers, unless you
 	// know what you are doing.
 	bwrapPath    string
 	bwrapVersion *bwrapVersion
 	args         []string
+	env          map[string]string
 	fileData     [][]byte
+	fileDests    []string
 
+	uid, gid   int    // Set at creation time.
 	runtimeDir string // Set at creation time.
 }
 
 func (h *hugbox) setenv(k, v string) {
-	h.args = append(h.args, "--setenv", k, v)
+	if sandboxEnvAllowlist[k] == "" {
+		panic(fmt.Errorf("sandbox: BUG: environment variable not in the allowlist: %v", k))
+	}
+	h.env[k] = v
 }
 
 func (h *hugbox) dir(dest string) {
@@ -133,9 +155,23 @@ func (h *hugbox) roBind(src, dest string, optional bool) {
 	h.args = append(h.args, "--ro-bind", src, dest)
 }
 
+// hasDestUnder returns true iff dir, or anything under it, is already
+// populated in the sandbox.
+func (h *hugbox) hasDestUnder(dir string) bool {
+	dir = filepath.Clean(dir)
+	for _, dst := range argsDestPaths(h.args) {
+		dst = filepath.Clean(dst)
+		if dst == dir || strings.HasPrefix(dst, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *hugbox) file(dest string, data []byte) {
 	h.args = append(h.args, "--file", fmt.Sprintf("%d", 4+len(h.fileData)), dest)
 	h.fileData = append(h.fileData, data)
+	h.fileDests = append(h.fileDests, dest)
 }
 
 func (h *hugbox) setupDbus() {
@@ -163,17 +199,125 @@ func (h *hugbox) tmpfs(dest string) {
 	h.args = append(h.args, "--tmpfs", dest)
 }
 
+// sizedTmpfs mounts a tmpfs limited to size bytes, if bubblewrap supports
+// limiting the size.
+func (h *hugbox) sizedTmpfs(dest string, size uint64) {
+	h.args = append(h.args, h.tmpfsArgs(dest, size)...)
+}
+
+func (h *hugbox) tmpfsArgs(dest string, size uint64) []string {
+	if size > 0 && h.supportsTmpfsSize() {
+		return []string{"--size", strconv.FormatUint(size, 10), "--tmpfs", dest}
+	}
+	return []string{"--tmpfs", dest}
+}
+
+func (h *hugbox) supportsTmpfsSize() bool {
+	return h.bwrapVersion.atLeast(0, 7, 0)
+}
+
+// shadowDir populates a tmpfs at dest with a copy of src, by reading every
+// file into memory, and passing it to bwrap.  It is the fallback for when
+// the stub is unavailable, see stagedShadowDir.
 func (h *hugbox) shadowDir(dest, src string, exclude []string) {
 	Debugf("sandbox: shadowDir: %s -> %s", src, dest)
 
+	h.tmpfs(dest)
+	err := walkShadow(src, exclude, func(relPath string, info os.FileInfo) error {
+		destPath := filepath.Join(dest, relPath)
+		if info.IsDir() {
+			h.dir(destPath)
+			return nil
+		}
+
+		if info.Mode()&0111 != 0 {
+			// Alas shadowDir has limits, because bwrap doesn't give a easy way
+			// to set this up.
+			Debugf("sandbox: shadowDir: '%s' ignoring executable perm bits: %s", relPath, info.Mode())
+		}
+
+		// XXX: This guzzles memory, and it'll be easier just to open
+		// the source file, but cleanup on errors would be a huge
+		// nightmare, because Go is too cool for destructors.
+		b, err := ioutil.ReadFile(filepath.Join(src, relPath))
+		if err != nil {
+			return err
+		}
+		h.file(destPath, b)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// stagedShadowDir populates a tmpfs at dest with a copy of src, like
+// shadowDir, except that the copy is done inside the sandbox by the stub,
+// from a read-only bind of src at staging.  Only the metadata is walked
+// here, so the memory use doesn't scale with the size of src, and the
+// permission bits are preserved.  The returned manifest must be passed to
+// the stub via `TOR_STUB_SHADOW_MANIFEST`.  If src contains a file name that
+// can not be represented in the manifest, errIrregularFileName is returned
+// without modifying the sandbox, and shadowDir should be used instead.
+func (h *hugbox) stagedShadowDir(dest, src, staging string, exclude []string) ([]byte, error) {
+	Debugf("sandbox: stagedShadowDir: %s -> %s (via %s)", src, dest, staging)
+
+	// The manifest is the source and destination, followed by a
+	// `<type> <mode> <path>` line per entry, parents first.
+	var b []byte
+	b = append(b, staging+"\n"+dest+"\n"...)
+	err := walkShadow(src, exclude, func(relPath string, info os.FileInfo) error {
+		if strings.ContainsRune(relPath, '\n') {
+			Debugf("sandbox: stagedShadowDir: %q irregular file name", relPath)
+			return errIrregularFileName
+		}
+		t := "f"
+		if info.IsDir() {
+			t = "d"
+		}
+		b = append(b, fmt.Sprintf("%s %04o %s\n", t, info.Mode().Perm(), relPath)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.tmpfs(dest)
+	h.roBind(src, staging, false)
+
+	// The staging bind remains visible for the lifetime of the sandbox,
+	// so hide everything that is excluded from the copy.
+	for _, p := range exclude {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if fi.IsDir() {
+			h.tmpfs(filepath.Join(staging, rel))
+		} else {
+			h.roBind("/dev/null", filepath.Join(staging, rel), false)
+		}
+	}
+	return b, nil
+}
+
+// walkShadow walks src, calling fn with the path relative to src for each
+// directory and regular file that is not excluded.
+func walkShadow(src string, exclude []string, fn func(string, os.FileInfo) error) error {
 	excludeMap := make(map[string]bool)
 	for _, s := range exclude {
 		excludeMap[s] = true
 	}
 
-	shadowWalk := func(path string, info os.FileInfo, err error) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if path == src {
-			h.tmpfs(dest)
 			return nil
 		}
 
@@ -188,47 +332,37 @@ func (h *hugbox) shadowDir(dest, src string, exclude []string) {
 
 		// Dealing with this is annoying, and it doesn't happen under
 		// normal usage.
-		const (
-			modeIrregular  = os.ModeSymlink | os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
-			modeExecutable = 0111
-		)
-		mode := info.Mode()
-		if mode&modeIrregular != 0 {
+		const modeIrregular = os.ModeSymlink | os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
+		if mode := info.Mode(); mode&modeIrregular != 0 {
 			Debugf("sandbox: shadowDir: '%s' irregular perm bits: %s", path, mode)
 			return fmt.Errorf("sandbox: shadowDir: '%s' irregular perm bits: %s", path, mode)
-		} else if mode&modeExecutable != 0 && !isDir {
-			// Alas shadowDir has limits, because bwrap doesn't give a easy way
-			// to set this up.
-			Debugf("sandbox: shadowDir: '%s' ignoring executable perm bits: %s", path, mode)
 		}
 
-		relPath := filepath.Clean(strings.TrimPrefix(path, src))
-		destPath := filepath.Join(dest, relPath)
-		if isDir {
-			h.dir(destPath)
-		} else {
-			// XXX: This guzzles memory, and it'll be easier just to open
-			// the source file, but cleanup on errors would be a huge
-			// nightmare, because Go is too cool for destructors.
-			b, err := ioutil.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			h.file(destPath, b)
-		}
-
-		// Debugf("shadow: '%s' -> '%s'", relPath, destPath)
-
-		return nil
-	}
-
-	// Create the directory, and then walk.
-	if err := filepath.Walk(src, shadowWalk); err != nil {
-		panic(err)
-	}
+		return fn(filepath.Clean(strings.TrimPrefix(path, src+"/")), info)
+	})
 }
 
 func (h *hugbox) run() (*Process, error) {
+	// runOnce appends the generated files (`/etc/passwd` and the like) to
+	// the args, so a retry must start from the original state.
+	args := append([]string{}, h.args...)
+	fileData := append([][]byte{}, h.fileData...)
+	fileDests := append([]string{}, h.fileDests...)
+
+	process, err := h.runOnce()
+	if err == errSystemdRunFailed {
+		// systemd-run can fail for all sorts of reasons (eg: the user
+		// manager refusing the properties), so retry without it, since the
+		// cgroup is not essential.
+		log.Printf("sandbox: Failed to start via systemd-run, retrying without a systemd scope.")
+		h.args, h.fileData, h.fileDests = args, fileData, fileDests
+		h.noSystemd = true
+		process, err = h.runOnce()
+	}
+	return process, err
+}
+
+func (h *hugbox) runOnce() (*Process, error) {
 	// Create the command struct for the sandbox.
 	cmd := &exec.Cmd{
 		Path:   h.bwrapPath,
@@ -244,7 +378,17 @@ func (h *hugbox) run() (*Process, error) {
 	}
 	cmd.Args = append(cmd.Args, h.cmdArgs...)
 
+	// Apply the resource limits if any.
+	cg, err := h.applyCgroupLimits(cmd)
+	if err != nil {
+		log.Printf("sandbox: Failed to apply cgroup limits: %v", err)
+	}
+
 	defer func() {
+		if cg != nil {
+			cg.close()
+		}
+
 		// Force close the unwritten pipe fd(s), on the off-chance that
 		// something failed before they could be written.
 		for _, f := range cmd.ExtraFiles {
@@ -253,12 +397,12 @@ func (h *hugbox) run() (*Process, error) {
 	}()
 
 	// Prep the args pipe.
-	var argsWrFd *os.File
+	var argsRdFd, argsWrFd *os.File
 	if r, w, err := os.Pipe(); err != nil {
 		return nil, err
 	} else {
 		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
-		argsWrFd = w
+		argsRdFd, argsWrFd = r, w
 	}
 
 	// Build up the args to be passed via fd.  This specifies args directly
@@ -268,25 +412,18 @@ func (h *hugbox) run() (*Process, error) {
 	fdArgs := []string{
 		// Standard things required by most applications.
 		"--dev", "/dev",
-		"--tmpfs", "/tmp",
-
-		"--setenv", "XDG_RUNTIME_DIR", h.runtimeDir,
+	}
+	fdArgs = append(fdArgs, h.tmpfsArgs("/tmp", h.tmpSize)...)
+	fdArgs = append(fdArgs, []string{
 		"--dir", h.runtimeDir,
-
-		"--setenv", "HOME", h.homeDir,
 		"--dir", h.homeDir,
-	}
+	}...)
+	h.setenv("XDG_RUNTIME_DIR", h.runtimeDir)
+	h.setenv("HOME", h.homeDir)
+	fdArgs = append(fdArgs, h.envArgs()...)
 	if h.standardLibs {
-		fdArgs = append(fdArgs, []string{
-			"--ro-bind", "/usr/lib", "/usr/lib",
-			"--ro-bind", "/lib", "/lib",
-		}...)
-		if runtime.GOARCH == "amd64" { // 64 bit Linux-ism.
-			fdArgs = append(fdArgs, "--ro-bind", "/lib64", "/lib64")
-			if FileExists("/usr/lib64") {
-				// openSUSE keeps 64 bit libraries here.
-				fdArgs = append(fdArgs, "--ro-bind", "/usr/lib64", "/usr/lib64")
-			}
+		for _, d := range standardLibDirs() {
+			fdArgs = append(fdArgs, "--ro-bind", d, d)
 		}
 	}
 	fdArgs = append(fdArgs, h.unshare.toArgs()...) // unshare(2) options.
@@ -311,18 +448,17 @@ func (h *hugbox) run() (*Process, error) {
 		fdArgs = append(fdArgs, "--chdir", h.chdir)
 	}
 
-	uid, gid := os.Getuid(), os.Getgid()
 	if h.unshare.user {
-		uid, gid = 1000, 1000
 		fdArgs = append(fdArgs, []string{
-			"--uid", "1000",
-			"--gid", "1000",
+			"--uid", strconv.Itoa(h.uid),
+			"--gid", strconv.Itoa(h.gid),
 		}...)
 	}
-	passwdBody := fmt.Sprintf("amnesia:x:%d:%d:Debian Live User,,,:/home/amnesia:/bin/bash\n", uid, gid)
-	groupBody := fmt.Sprintf("amnesia:x:%d:\n", gid)
+	passwdBody := fmt.Sprintf("amnesia:x:%d:%d:Debian Live User,,,:/home/amnesia:/bin/bash\n", h.uid, h.gid)
+	groupBody := fmt.Sprintf("amnesia:x:%d:\n", h.gid)
 	h.file("/etc/passwd", []byte(passwdBody))
 	h.file("/etc/group", []byte(groupBody))
+	h.appendEtc()
 
 	dieWithParent := h.bwrapVersion.atLeast(0, 1, 8)
 	if dieWithParent {
@@ -373,18 +509,32 @@ func (h *hugbox) run() (*Process, error) {
 	// Convert the arg vector to a format fit for bubblewrap, and schedule the
 	// write.
 	fdArgs = append(fdArgs, h.args...) // Finalize args.
-	var argsBuf []byte
-	for _, arg := range fdArgs {
-		argsBuf = append(argsBuf, []byte(arg)...)
-		argsBuf = append(argsBuf, 0x00)
+	if err := validateArgs(fdArgs); err != nil {
+		return nil, err
+	}
+	if err := validateEtc(fdArgs); err != nil {
+		return nil, err
+	}
+	argsBuf, err := encodeArgs(fdArgs)
+	if err != nil {
+		return nil, err
 	}
 	pendingWrites := [][]byte{argsBuf}
 	pendingWrites = append(pendingWrites, h.fileData...)
+	pendingNames := []string{"args"}
+	for _, dest := range h.fileDests {
+		pendingNames = append(pendingNames, fmt.Sprintf("file data (`%s`)", dest))
+	}
 
 	Debugf("sandbox: fdArgs: %v", fdArgs)
 
 	// Fork/exec.
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		if cg != nil {
+			cg.remove()
+		}
+		return nil, err
+	}
 
 	// Do the rest of the setup in a go routine, and monitor completion and
 	// a watchdog timer.
@@ -393,12 +543,20 @@ func (h *hugbox) run() (*Process, error) {
 	defer hz.Stop()
 
 	process := NewProcess(cmd)
+	if cg != nil {
+		process.AddTermHook(cg.remove)
+	}
+
+	// The setup stage, so that a stall can be attributed to the payload
+	// bubblewrap is not consuming.
+	var stage atomic.Value
+	stage.Store("starting")
 
 	go func() {
 		// Flush the pending writes.
 		for i, wrFd := range pendingWriteFds {
-			d := pendingWrites[i]
-			if err := writeBuffer(wrFd, d); err != nil {
+			stage.Store("writing " + pendingNames[i])
+			if err := writeBuffer(wrFd, pendingNames[i], pendingWrites[i]); err != nil {
 				doneCh <- err
 				return
 			}
@@ -413,8 +571,10 @@ func (h *hugbox) run() (*Process, error) {
 			} else if seccompWrFd == nil {
 				panic("sandbox: missing fd when writing seccomp rules")
 			}
+			stage.Store("writing seccomp rules")
+			seccompWrFd.SetWriteDeadline(time.Now().Add(pipeWriteTimeout))
 			if err := h.seccompFn(seccompWrFd); err != nil {
-				doneCh <- err
+				doneCh <- &PipeWriteError{Payload: "seccomp rules", Err: err}
 				return
 			}
 			cmd.ExtraFiles = cmd.ExtraFiles[1:]
@@ -423,6 +583,7 @@ func (h *hugbox) run() (*Process, error) {
 		}
 
 		// Read back the init child pid.
+		stage.Store("reading the init pid")
 		decoder := json.NewDecoder(infoRdFd)
 		info := &bwrapInfo{}
 		if err := decoder.Decode(info); err != nil {
@@ -437,35 +598,132 @@ func (h *hugbox) run() (*Process, error) {
 		// namespace.  If people aren't using unshare.pid, bad things happen.
 		process.SetInitPid(info.Pid)
 
+		// Record the sandbox's cgroup so that it can be frozen.  This is
+		// done now rather than when the cgroup is created, since a transient
+		// systemd scope is only known after the fact.
+		if h.cgroup != nil {
+			if p, err := sandboxCgroup(info.Pid); err != nil {
+				log.Printf("sandbox: Failed to determine sandbox cgroup: %v", err)
+			} else {
+				Debugf("sandbox: cgroup is: %v", p)
+				process.SetCgroup(p)
+			}
+		}
+
 		doneCh <- nil
 	}()
 
-	err := fmt.Errorf("sandbox: timeout waiting for bubblewrap to start")
+	var startErr error
 timeoutLoop:
 	for nTicks := 0; nTicks < 10; { // 10 second timeout, probably excessive.
 		select {
-		case err = <-doneCh:
-			if err == nil {
+		case startErr = <-doneCh:
+			if startErr == nil {
 				return process, nil
 			}
 			break timeoutLoop
 		case <-hz.C:
 			if !process.Running() {
-				err = fmt.Errorf("sandbox: bubblewrap exited unexpectedly")
+				// If the args were never read, bubblewrap was never
+				// executed, and the systemd-run wrapper is at fault.
+				if cmd.Path != h.bwrapPath && pipeUnread(argsRdFd) > 0 {
+					log.Printf("sandbox: systemd-run exited unexpectedly")
+					startErr = errSystemdRunFailed
+					break timeoutLoop
+				}
+				log.Printf("sandbox: bubblewrap exited unexpectedly, while %v", stage.Load())
+				startErr = ErrBwrapFailed
 				break timeoutLoop
 			}
 			nTicks++
 		}
 	}
+	if startErr == nil {
+		log.Printf("sandbox: timeout waiting for bubblewrap to start, stalled %v", stage.Load())
+		startErr = ErrBwrapTimeout
+	}
 
 	process.Kill()
-	return nil, err
+	return nil, startErr
+}
+
+// PipeWriteError is the error returned when writing a payload to bubblewrap
+// over a pipe fails or stalls.
+type PipeWriteError struct {
+	// Payload is the description of what was being written.
+	Payload string
+
+	// Written and Total are the number of bytes written and the payload
+	// size, or 0 if unknown.
+	Written, Total int
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *PipeWriteError) Error() string {
+	if e.Total == 0 {
+		return fmt.Sprintf("sandbox: failed to write %s to bubblewrap: %v", e.Payload, e.Err)
+	}
+	return fmt.Sprintf("sandbox: failed to write %s to bubblewrap (%d of %d bytes): %v", e.Payload, e.Written, e.Total, e.Err)
+}
+
+// encodeArgs encodes the args for `--args`, as NUL terminated strings.
+// bubblewrap reads until EOF, so an arg with an embedded NUL would silently
+// become two, and is rejected.  Every arg, including the last, gets a
+// terminator, so the final one is never truncated.
+func encodeArgs(args []string) ([]byte, error) {
+	var b []byte
+	for i, arg := range args {
+		if strings.IndexByte(arg, 0x00) >= 0 {
+			return nil, fmt.Errorf("sandbox: arg %d contains a NUL byte: %q", i, arg)
+		}
+		b = append(b, []byte(arg)...)
+		b = append(b, 0x00)
+	}
+	return b, nil
 }
 
 type bwrapInfo struct {
 	Pid int `json:"child-pid"`
 }
 
+var (
+	// ErrBwrapMissing is the error returned when bubblewrap is not
+	// installed.
+	ErrBwrapMissing = errors.New("sandbox: unable to find bubblewrap binary")
+
+	// ErrBwrapTooOld is the error returned when the installed bubblewrap
+	// is too old to be used safely.
+	ErrBwrapTooOld = errors.New("sandbox: bubblewrap appears to be older than 0.1.3, you MUST upgrade.")
+
+	// ErrBwrapFailed is the error returned when bubblewrap fails to set up
+	// the sandbox, usually due to the host not allowing namespaces.
+	ErrBwrapFailed = errors.New("sandbox: bubblewrap exited unexpectedly")
+
+	// ErrBwrapTimeout is the error returned when bubblewrap fails to set up
+	// the sandbox in a timely manner.
+	ErrBwrapTimeout = errors.New("sandbox: timeout waiting for bubblewrap to start")
+
+	errSystemdRunFailed = errors.New("sandbox: systemd-run exited unexpectedly")
+
+	errIrregularFileName = errors.New("sandbox: irregular file name")
+)
+
+// bwrapPaths is the list of sensible locations for the bwrap binary.
+var bwrapPaths = []string{
+	"/usr/bin/bwrap",
+}
+
+func findBwrap() string {
+	for _, v := range bwrapPaths {
+		if FileExists(v) {
+			return v
+		}
+	}
+	return ""
+}
+
 func newHugbox() (*hugbox, error) {
 	h := &hugbox{
 		unshare: unshareOpts{
@@ -478,34 +736,39 @@ func newHugbox() (*hugbox, error) {
 		},
 		hostname:     "amnesia",
 		mountProc:    true,
-		runtimeDir:   filepath.Join("/run", "user", fmt.Sprintf("%d", os.Getuid())),
+		uid:          os.Getuid(),
+		gid:          os.Getgid(),
 		homeDir:      "/home/amnesia",
 		pdeathSig:    syscall.SIGTERM,
 		standardLibs: true,
+		env:          make(map[string]string),
+	}
+
+	// Look for the bwrap binary in sensible locations.
+	if h.bwrapPath = findBwrap(); h.bwrapPath == "" {
+		return nil, ErrBwrapMissing
 	}
 
 	// This option is considered dangerous and leads to things like
 	// CVE-2016-8655.  But if the user is running with this enabled,
 	// then might as well take advantage of it.
 	if FileExists("/proc/self/ns/user") {
-		Debugf("sandbox: User namespace support detected.")
-		h.unshare.user = true
-		h.runtimeDir = "/run/user/1000"
-	}
-
-	// Look for the bwrap binary in sensible locations.
-	bwrapPaths := []string{
-		"/usr/bin/bwrap",
-	}
-	for _, v := range bwrapPaths {
-		if FileExists(v) {
-			h.bwrapPath = v
-			break
+		if err := probeUserNamespace(); err == nil {
+			Debugf("sandbox: User namespace support detected.")
+			h.unshare.user = true
+			h.uid, h.gid = sandboxUID, sandboxUID
+		} else if fi, err2 := os.Stat(h.bwrapPath); err2 == nil && fi.Mode()&os.ModeSetuid != 0 {
+			log.Printf("sandbox: User namespaces are unavailable (%v), using setuid bubblewrap.", err)
+		} else if remedy := containerRemedy(DetectContainer()); remedy != "" {
+			log.Printf("sandbox: User namespaces are unavailable (%v), and bubblewrap is not setuid, launching will likely fail, %v.", err, remedy)
+		} else {
+			log.Printf("sandbox: User namespaces are unavailable (%v), and bubblewrap is not setuid, launching will likely fail.", err)
 		}
 	}
-	if h.bwrapPath == "" {
-		return nil, fmt.Errorf("sandbox: unable to find bubblewrap binary")
-	}
+
+	// The sandbox's runtime directory is entirely synthetic, and must match
+	// the uid inside the sandbox, not the host's `XDG_RUNTIME_DIR`.
+	h.runtimeDir = filepath.Join("/run", "user", strconv.Itoa(h.uid))
 
 	// Query and cache the bubblewrap version.
 	var err error
@@ -519,13 +782,52 @@ func newHugbox() (*hugbox, error) {
 		// bubblewrap to be ptrace-able when I contributed support for setting
 		// the hostname.
 		if !h.bwrapVersion.atLeast(0, 1, 3) {
-			return nil, fmt.Errorf("sandbox: bubblewrap appears to be older than 0.1.3, you MUST upgrade.")
+			return nil, ErrBwrapTooOld
 		}
 	}
 
 	return h, nil
 }
 
+var (
+	userNSProbeOnce sync.Once
+	userNSProbeErr  error
+)
+
+// probeUserNamespace checks if unprivileged user namespaces can actually be
+// created, since the kernel supporting them does not mean that they are
+// enabled (eg: `kernel.unprivileged_userns_clone = 0`,
+// `user.max_user_namespaces = 0`, or an LSM denying them).
+func probeUserNamespace() error {
+	userNSProbeOnce.Do(func() {
+		var truePath string
+		for _, v := range []string{"/bin/true", "/usr/bin/true"} {
+			if FileExists(v) {
+				truePath = v
+				break
+			}
+		}
+		if truePath == "" {
+			// No way to probe, so assume that they work.
+			return
+		}
+
+		cmd := &exec.Cmd{
+			Path: truePath,
+			Args: []string{truePath},
+			Env:  []string{},
+			SysProcAttr: &syscall.SysProcAttr{
+				Cloneflags: syscall.CLONE_NEWUSER,
+				Pdeathsig:  syscall.SIGKILL,
+			},
+		}
+		if err := cmd.Run(); err != nil {
+			userNSProbeErr = err
+		}
+	})
+	return userNSProbeErr
+}
+
 type bwrapVersion struct {
 	maj, min, pl int
 }
@@ -547,7 +849,36 @@ func (v *bwrapVersion) String() string {
 	return fmt.Sprintf("%d.%d.%d", v.maj, v.min, v.pl)
 }
 
+var bwrapVersionCache struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	v       *bwrapVersion
+}
+
+// getBwrapVersion returns the version of the bubblewrap binary, querying it
+// only if the binary has changed since the last call.
 func getBwrapVersion(f string) (*bwrapVersion, error) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &bwrapVersionCache
+	c.Lock()
+	defer c.Unlock()
+	if c.v != nil && c.path == f && c.modTime.Equal(fi.ModTime()) {
+		return c.v, nil
+	}
+	v, err := queryBwrapVersion(f)
+	if err != nil {
+		return nil, err
+	}
+	c.path, c.modTime, c.v = f, fi.ModTime(), v
+	return v, nil
+}
+
+func queryBwrapVersion(f string) (*bwrapVersion, error) {
 	cmd := &exec.Cmd{
 		Path: f,
 		Args: []string{f, "--version"},
@@ -582,10 +913,39 @@ func getBwrapVersion(f string) (*bwrapVersion, error) {
 	return &bwrapVersion{maj: iVers[0], min: iVers[1], pl: iVers[2]}, nil
 }
 
-func writeBuffer(w io.WriteCloser, contents []byte) error {
+// pipeWriteTimeout is the per-fd deadline for writing a payload to
+// bubblewrap.
+const pipeWriteTimeout = 5 * time.Second
+
+// writeBuffer writes the payload to a pipe to bubblewrap, and closes it.
+// Short writes, and writes that stall past the deadline are reported as a
+// PipeWriteError.
+func writeBuffer(w *os.File, name string, contents []byte) error {
 	defer w.Close()
-	_, err := w.Write(contents)
-	return err
+
+	// If deadlines are unsupported, the watchdog in run() still applies.
+	w.SetWriteDeadline(time.Now().Add(pipeWriteTimeout))
+	n, err := w.Write(contents)
+	if err == nil && n != len(contents) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		if os.IsTimeout(err) {
+			err = fmt.Errorf("bubblewrap stopped reading after %v", pipeWriteTimeout)
+		}
+		return &PipeWriteError{Payload: name, Written: n, Total: len(contents), Err: err}
+	}
+	return nil
+}
+
+// pipeUnread returns the number of bytes in the pipe that are yet to be read,
+// or 0 on failure.
+func pipeUnread(f *os.File) int {
+	var n int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCINQ, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		return 0
+	}
+	return int(n)
 }
 
 // IsGrsecKernel returns true if the system appears to be running a grsec
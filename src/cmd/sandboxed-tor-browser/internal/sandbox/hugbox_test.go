@@ -0,0 +1,123 @@
+// hugbox_test.go - Hugbox tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTmpfsArgsValidate(t *testing.T) {
+	for _, v := range []*bwrapVersion{{0, 1, 8}, {0, 7, 0}, {0, 8, 0}} {
+		h := &hugbox{bwrapVersion: v}
+		for _, size := range []uint64{0, 512 * 1024 * 1024} {
+			args := h.tmpfsArgs("/tmp", size)
+			if err := validateArgs(args); err != nil {
+				t.Errorf("bwrap %v, size %d: validateArgs(%q): %v", v, size, args, err)
+			}
+			if wantSize := size > 0 && v.atLeast(0, 7, 0); wantSize != (args[0] == "--size") {
+				t.Errorf("bwrap %v, size %d: unexpected args: %q", v, size, args)
+			}
+		}
+	}
+}
+
+func TestEncodeArgs(t *testing.T) {
+	b, err := encodeArgs([]string{"--ro-bind", "/usr", "/usr", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("--ro-bind\x00/usr\x00/usr\x00\x00"); !bytes.Equal(b, want) {
+		t.Errorf("encodeArgs: got %q, want %q", b, want)
+	}
+
+	if _, err = encodeArgs([]string{"--setenv", "FOO", "bar\x00--bind"}); err == nil {
+		t.Errorf("encodeArgs: arg with an embedded NUL was accepted")
+	}
+}
+
+func TestPipeUnread(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	if n := pipeUnread(r); n != 0 {
+		t.Errorf("pipeUnread: empty pipe has %d bytes", n)
+	}
+	if _, err = w.Write([]byte("--dev\x00/dev\x00")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := pipeUnread(r); n != 11 {
+		t.Errorf("pipeUnread: %d bytes, want 11", n)
+	}
+	var b [5]byte
+	if _, err = r.Read(b[:]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n := pipeUnread(r); n != 6 {
+		t.Errorf("pipeUnread: %d bytes after a read, want 6", n)
+	}
+}
+
+func TestStagedShadowDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "hugbox_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(src)
+
+	if err = os.Mkdir(filepath.Join(src, "dir"), 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	for _, f := range []string{"dir/file", "excluded"} {
+		if err = ioutil.WriteFile(filepath.Join(src, f), []byte(f), 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile: %v", err)
+		}
+	}
+	exclude := []string{filepath.Join(src, "excluded")}
+
+	h := new(hugbox)
+	manifest, err := h.stagedShadowDir("/dest", src, "/staging", exclude)
+	if err != nil {
+		t.Fatalf("stagedShadowDir: %v", err)
+	}
+	if want := "/staging\n/dest\nd 0700 dir\nf 0600 dir/file\n"; string(manifest) != want {
+		t.Errorf("stagedShadowDir: manifest %q, want %q", manifest, want)
+	}
+	if len(h.args) == 0 {
+		t.Errorf("stagedShadowDir: no args")
+	}
+
+	// A file name with a newline can not be in the manifest, and must leave
+	// the sandbox as is, so that shadowDir can be used instead.
+	if err = ioutil.WriteFile(filepath.Join(src, "dir", "new\nline"), nil, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile: %v", err)
+	}
+	h = new(hugbox)
+	if _, err = h.stagedShadowDir("/dest", src, "/staging", exclude); err != errIrregularFileName {
+		t.Errorf("stagedShadowDir: irregular file name: %v", err)
+	}
+	if len(h.args) != 0 {
+		t.Errorf("stagedShadowDir: irregular file name: unexpected args: %q", h.args)
+	}
+}
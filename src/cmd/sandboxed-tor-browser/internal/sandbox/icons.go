@@ -0,0 +1,176 @@
+// icons.go - Host icon theme passthrough.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	xdg "github.com/cep21/xdgbasedir"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	// maxIconThemes bounds the length of the `Inherits` chain that is
+	// followed, in case of a cycle or a pathological theme.
+	maxIconThemes = 8
+
+	kdeDefaultIconTheme = "breeze"
+)
+
+// detectIconTheme returns the name of the host's active icon theme, or "" if
+// it can not be determined.
+func detectIconTheme() string {
+	isKDE := strings.Contains(strings.ToUpper(os.Getenv("XDG_CURRENT_DESKTOP")), "KDE")
+	if isKDE {
+		if theme := kdeIconTheme(); theme != "" {
+			return theme
+		}
+	}
+	if theme := gsettingsIconTheme(); theme != "" {
+		return theme
+	}
+	if isKDE {
+		return kdeDefaultIconTheme
+	}
+	return ""
+}
+
+func gsettingsIconTheme() string {
+	gsettings, err := exec.LookPath("gsettings")
+	if err != nil {
+		return ""
+	}
+	out, err := exec.Command(gsettings, "get", "org.gnome.desktop.interface", "icon-theme").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(string(out)), "'")
+}
+
+func kdeIconTheme() string {
+	configHome, err := xdg.ConfigHomeDirectory()
+	if err != nil {
+		return ""
+	}
+	return readIniKey(filepath.Join(configHome, "kdeglobals"), "Icons", "Theme")
+}
+
+// readIniKey returns the value of key in section of the desktop entry style
+// ini file at path, or "" if it is not set.
+func readIniKey(path, section, key string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(l, "[") {
+			inSection = l == "["+section+"]"
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if kv := strings.SplitN(l, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+func isValidIconTheme(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\x00")
+}
+
+// iconThemeSearchDirs returns the host directories that icon themes are
+// looked up in, along with where each is mounted in the sandbox.
+func (h *hugbox) iconThemeSearchDirs() [][2]string {
+	var dirs [][2]string
+	if dataHome, err := xdg.DataHomeDirectory(); err == nil {
+		dirs = append(dirs, [2]string{filepath.Join(dataHome, "icons"), filepath.Join(h.homeDir, ".local", "share", "icons")})
+	}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	for _, d := range strings.Split(dataDirs, ":") {
+		if filepath.IsAbs(d) {
+			dirs = append(dirs, [2]string{filepath.Join(d, "icons"), "/usr/share/icons"})
+		}
+	}
+	return dirs
+}
+
+// appendIconTheme binds the host's active icon theme, and the themes it
+// inherits from, into the sandbox read-only, skipping the themes in bound
+// that are already there.  It returns the name of the theme if it was found,
+// or "" if the sandbox is left with the default themes.
+func (h *hugbox) appendIconTheme(bound map[string]bool) string {
+	active := detectIconTheme()
+	if !isValidIconTheme(active) {
+		return ""
+	}
+
+	searchDirs := h.iconThemeSearchDirs()
+	found := false
+	queue := []string{active}
+	seen := make(map[string]bool)
+	for len(queue) > 0 && len(seen) < maxIconThemes {
+		theme := queue[0]
+		queue = queue[1:]
+		if seen[theme] {
+			continue
+		}
+		seen[theme] = true
+
+		// The first directory with an `index.theme` is the theme, as far
+		// as Gtk+ is concerned.
+		for _, d := range searchDirs {
+			src := filepath.Join(d[0], theme)
+			indexPath := filepath.Join(src, "index.theme")
+			if !FileExists(indexPath) {
+				continue
+			}
+			if !bound[theme] {
+				h.roBind(src, filepath.Join(d[1], theme), false)
+			}
+			found = found || theme == active
+			for _, v := range strings.Split(readIniKey(indexPath, "Icon Theme", "Inherits"), ",") {
+				if v = strings.TrimSpace(v); isValidIconTheme(v) {
+					queue = append(queue, v)
+				}
+			}
+			break
+		}
+	}
+	if !found {
+		log.Printf("sandbox: Failed to find the host icon theme: %v", active)
+		return ""
+	}
+	Debugf("sandbox: Host icon theme: %v", active)
+	return active
+}
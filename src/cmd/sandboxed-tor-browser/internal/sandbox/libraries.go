@@ -0,0 +1,177 @@
+// libraries.go - Pinned Tor Browser library sets.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	libraryManifestFile = "libraries.json"
+	pendingExt          = ".pending"
+
+	ldSoCachePath = "/etc/ld.so.cache"
+)
+
+// libraryManifest is the set of libraries that Tor Browser was last launched
+// with successfully, which is reused until the bundle or the host libraries
+// change.
+type libraryManifest struct {
+	// BundleVersion is the bundle version the libraries were resolved for.
+	BundleVersion string `json:"bundleVersion"`
+
+	// Key is the digest of everything else that the resolution depends on.
+	Key string `json:"key"`
+
+	// Libraries is the map of real library paths to their aliases.
+	Libraries map[string][]string `json:"libraries"`
+
+	// Stamps is the state of each library, and of the `ld.so` cache, when
+	// the libraries were resolved.
+	Stamps map[string]*fileStamp `json:"stamps"`
+}
+
+type fileStamp struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Inode   uint64 `json:"inode"`
+}
+
+func newFileStamp(fn string) (*fileStamp, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStamp{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		s.Inode = st.Ino
+	}
+	return s, nil
+}
+
+// staleReason returns why the manifest can not be used, or the empty string
+// if it can.
+func (m *libraryManifest) staleReason(bundleVersion, key string) string {
+	if m.BundleVersion != bundleVersion {
+		return fmt.Sprintf("bundle version changed to %v", bundleVersion)
+	} else if m.Key != key {
+		return "the library requirements changed"
+	}
+	for fn, s := range m.Stamps {
+		cur, err := newFileStamp(fn)
+		if err != nil {
+			return fmt.Sprintf("%v is missing", fn)
+		} else if *cur != *s {
+			return fmt.Sprintf("%v changed", fn)
+		}
+	}
+	return ""
+}
+
+func libraryResolutionKey(binaries, extraLibs []string, ldLibraryPath, variant string) string {
+	h := sha256.New()
+	for _, v := range [][]string{binaries, extraLibs, {ldLibraryPath, variant}} {
+		h.Write([]byte(strings.Join(v, "\x00")))
+		h.Write([]byte{0xff})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// torBrowserLibraries returns the libraries to bind into the Tor Browser
+// sandbox, from the library manifest if it is still valid.  Otherwise the
+// libraries are resolved, and the result is staged, to be pinned by
+// `PinLibraries` once Tor Browser starts successfully.  Everything that
+// influences the resolution other than the bundle version and the host
+// libraries must be included in variant.
+func torBrowserLibraries(cfg *config.Config, manif *config.Manifest, cache *dynlib.Cache, binaries, extraLibs []string, ldLibraryPath, variant string, filterFn dynlib.FilterFunc) (map[string][]string, error) {
+	manifPath := filepath.Join(cfg.UserDataDir, libraryManifestFile)
+	key := libraryResolutionKey(binaries, extraLibs, ldLibraryPath, variant)
+
+	if cfg.Sandbox.Relink {
+		log.Printf("sandbox: Re-resolving libraries, as requested.")
+		cfg.Sandbox.Relink = false
+	} else if b, err := ioutil.ReadFile(manifPath); err == nil {
+		m := new(libraryManifest)
+		if err = json.Unmarshal(b, m); err != nil {
+			log.Printf("sandbox: Ignoring malformed library manifest: %v", err)
+		} else if reason := m.staleReason(manif.Version, key); reason != "" {
+			log.Printf("sandbox: Re-resolving libraries, %v.", reason)
+		} else {
+			// Anything staged by an earlier failed launch is obsolete.
+			Debugf("sandbox: Using the pinned libraries.")
+			os.Remove(manifPath + pendingExt)
+			return m.Libraries, nil
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("sandbox: Failed to read library manifest: %v", err)
+	}
+
+	libs, err := resolveLibraries(cache, binaries, extraLibs, ldLibraryPath, filterFn)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &libraryManifest{
+		BundleVersion: manif.Version,
+		Key:           key,
+		Libraries:     libs,
+		Stamps:        make(map[string]*fileStamp),
+	}
+	for _, fn := range append([]string{ldSoCachePath}, mapKeys(libs)...) {
+		if m.Stamps[fn], err = newFileStamp(fn); err != nil {
+			return nil, err
+		}
+	}
+	if b, err := json.Marshal(m); err != nil {
+		return nil, err
+	} else if err = ioutil.WriteFile(manifPath+pendingExt, b, FileMode); err != nil {
+		log.Printf("sandbox: Failed to stage library manifest: %v", err)
+	}
+	return libs, nil
+}
+
+// PinLibraries pins the libraries staged by the last Tor Browser launch, if
+// any, to be reused by subsequent launches.  This should only be called
+// once Tor Browser has started successfully.
+func PinLibraries(cfg *config.Config) error {
+	manifPath := filepath.Join(cfg.UserDataDir, libraryManifestFile)
+	if err := os.Rename(manifPath+pendingExt, manifPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func mapKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,116 @@
+// pixbuf.go - gdk-pixbuf loader related sandbox routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// pixbufLoader is a gdk-pixbuf loader module, and the `loaders.cache` entry
+// that `gdk-pixbuf-query-loaders` would generate for it.
+type pixbufLoader struct {
+	lib   string
+	entry string
+}
+
+// pixbufLoaders are the loaders that are made available to Tor Browser, if
+// present on the host.  The entries are synthesized rather than queried,
+// since running `gdk-pixbuf-query-loaders` means executing each loader, and
+// the format has been stable since gdk-pixbuf 2.10.0.
+var pixbufLoaders = []pixbufLoader{
+	{
+		lib: "libpixbufloader-png.so",
+		entry: `"png" 5 "gdk-pixbuf" "The PNG image format" "LGPL"
+"image/png" ""
+"png" ""
+"\211PNG\r\n\032\n" "" 100
+`,
+	},
+	{
+		lib: "libpixbufloader-jpeg.so",
+		entry: `"jpeg" 5 "gdk-pixbuf" "The JPEG image format" "LGPL"
+"image/jpeg" ""
+"jpeg" "jpe" "jpg" ""
+"\377\330" "  " 100
+`,
+	},
+	{
+		// librsvg.
+		lib: "libpixbufloader-svg.so",
+		entry: `"svg" 6 "gdk-pixbuf" "Scalable Vector Graphics" "LGPL"
+"image/svg+xml" "image/svg" "image/svg-xml" "image/vnd.adobe.svg+xml" "text/xml-svg" "image/svg+xml-compressed" ""
+"svg" "svgz" "svg.gz" ""
+" <svg" "*    " 100
+" <!DOCTYPE svg" "*             " 100
+`,
+	},
+}
+
+// appendRestrictedGdkPixbuf binds the available gdk-pixbuf loaders into the
+// sandbox, along with a `loaders.cache` that lists exactly those loaders at
+// their sandbox paths, and returns the loader libraries and their host
+// directories.
+func (h *hugbox) appendRestrictedGdkPixbuf() ([]string, string) {
+	const gdkSubDir = "gdk-pixbuf-2.0/2.10.0/loaders"
+
+	normGdkDir := filepath.Join(restrictedLibDir, "gdk-pixbuf-2.0", "2.10.0")
+	normLoaderDir := filepath.Join(normGdkDir, "loaders")
+
+	var libs, dirs []string
+	var cache bytes.Buffer
+	cache.WriteString("# GdkPixbuf Image Loader Modules file\n")
+	cache.WriteString("# Automatically generated file, do not edit\n")
+	cache.WriteString("# Created by sandboxed-tor-browser\n")
+	cache.WriteString("#\n")
+	fmt.Fprintf(&cache, "# LoaderDir = %v\n", normLoaderDir)
+	cache.WriteString("#\n")
+
+	// Figure out if the system gdk-pixbuf-2.0 needs loaders for common
+	// file formats.  Arch and Fedora 25 do not (for PNG, and JPEG), since
+	// they are built in.  Debian does.
+	for _, l := range pixbufLoaders {
+		loaderPath := findDistributionDependentLibs(nil, gdkSubDir, l.lib)
+		if loaderPath == "" {
+			continue
+		}
+		normLoaderPath := filepath.Join(normLoaderDir, l.lib)
+		h.roBind(loaderPath, normLoaderPath, false)
+		fmt.Fprintf(&cache, "%q\n%s\n", normLoaderPath, l.entry)
+
+		loaderDir, _ := filepath.Split(loaderPath)
+		libs = append(libs, l.lib)
+		dirs = append(dirs, loaderDir)
+	}
+
+	if len(libs) == 0 {
+		// gdk-pixbuf can display an annoying warning if, it thinks it should
+		// have a `loaders.cache` but doesnot.  Shut it up.
+		h.setenv("GDK_PIXBUF_MODULE_FILE", "/dev/null")
+		return nil, ""
+	}
+	log.Printf("sandbox: gdk-pixbuf loaders: %v", strings.Join(libs, ", "))
+
+	loaderCachePath := filepath.Join(normGdkDir, "loaders.cache")
+	h.file(loaderCachePath, cache.Bytes())
+	h.setenv("GDK_PIXBUF_MODULE_FILE", loaderCachePath)
+
+	return libs, ":" + strings.Join(dirs, ":")
+}
@@ -19,59 +19,187 @@
 package process
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
-// Process is a running bwrap instance.
+// ErrNoCgroup is the error returned when attempting to freeze a bwrap
+// instance that does not have a dedicated cgroup.
+var ErrNoCgroup = errors.New("process: no dedicated cgroup")
+
+// Process is a running bwrap instance.  It is safe to call Kill, Terminate
+// and Wait concurrently, the bwrap instance is reaped exactly once, and the
+// term hooks are called exactly once.
 type Process struct {
+	sync.Mutex
+
 	init      *os.Process
 	cmd       *exec.Cmd
+	cgroup    string
 	termHooks []func()
+	exited    bool
+	state     *os.ProcessState
+	reapOnce  sync.Once
 }
 
-func (p *Process) onExit() {
-	if p.termHooks != nil {
-		for _, fn := range p.termHooks {
-			fn()
+// reap waits for the bwrap instance to exit, and calls the term hooks.
+// Concurrent callers block until the first caller is done.
+func (p *Process) reap() {
+	p.reapOnce.Do(func() {
+		p.Lock()
+		cmd := p.cmd
+		p.Unlock()
+
+		// Can't wait on the init process since it's a grandchild.
+		var state *os.ProcessState
+		if cmd != nil {
+			state, _ = cmd.Process.Wait()
 		}
+
+		p.Lock()
+		p.exited = true
+		p.state = state
+		p.cmd = nil
+		p.init = nil // bwrap only exits after init does.
+		hooks := p.termHooks
 		p.termHooks = nil
-	}
+		p.Unlock()
+
+		for _, fn := range hooks {
+			fn()
+		}
+	})
 }
 
-// AddTermHook adds the hook function fn to be called on process exit.
+// AddTermHook adds the hook function fn to be called on process exit.  If
+// the process has already exited, fn is called immediately.
 func (p *Process) AddTermHook(fn func()) {
-	p.termHooks = append(p.termHooks, fn)
+	p.Lock()
+	if !p.exited {
+		p.termHooks = append(p.termHooks, fn)
+		fn = nil
+	}
+	p.Unlock()
+
+	if fn != nil {
+		fn()
+	}
 }
 
 // Kill terminates the bwrap instance and all of it's children.
 func (p *Process) Kill() {
-	if p.init != nil {
-		p.init.Kill()
-		p.init = nil
+	p.Lock()
+	if !p.exited {
+		if p.init != nil {
+			p.init.Kill()
+		}
+		if p.cmd != nil {
+			p.cmd.Process.Kill()
+		}
 	}
-	if p.cmd != nil {
-		p.cmd.Process.Kill()
-		p.cmd.Process.Wait()
-		p.cmd = nil
+	p.Unlock()
+	p.reap()
+}
+
+// Terminate asks the bwrap instance to exit by sending SIGTERM to the
+// children of the sandbox init, and kills it, if it is still running after
+// the grace period.
+func (p *Process) Terminate(grace time.Duration) {
+	const pollInterval = 100 * time.Millisecond
+
+	initPid := 0
+	p.Lock()
+	if !p.exited && p.init != nil {
+		initPid = p.init.Pid
 	}
-	p.onExit()
+	p.Unlock()
+
+	// A frozen sandbox can not handle SIGTERM, so resume it first.
+	if p.Frozen() {
+		p.Thaw()
+	}
+
+	if initPid != 0 && grace > 0 {
+		// The init process itself ignores SIGTERM.
+		for _, pid := range childPids(initPid) {
+			syscall.Kill(pid, syscall.SIGTERM)
+		}
+		for deadline := time.Now().Add(grace); time.Now().Before(deadline); {
+			if syscall.Kill(initPid, 0) == syscall.ESRCH || p.hasExited() {
+				break
+			}
+			time.Sleep(pollInterval)
+		}
+	}
+	p.Kill()
+}
+
+func (p *Process) hasExited() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.exited
+}
+
+// childPids returns the pids of the child processes of pid.
+func childPids(pid int) []int {
+	fis, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var pids []int
+	for _, fi := range fis {
+		child, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join("/proc", fi.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		// The command name may contain spaces and parentheses, so skip
+		// past the last `)`.
+		s := string(b)
+		fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+		if len(fields) > 1 && fields[1] == strconv.Itoa(pid) {
+			pids = append(pids, child)
+		}
+	}
+	return pids
 }
 
 // Wait waits for the bwrap instance to complete.
 func (p *Process) Wait() error {
-	// Can't wait on the init process since it's a grandchild.
-	if p.cmd != nil {
-		p.cmd.Process.Wait()
-		p.cmd = nil
-		p.onExit()
-	}
+	p.reap()
 	return nil
 }
 
+// Failed returns true if the bwrap instance has exited unsuccessfully.  bwrap
+// exits with the exit status of the sandboxed process, or 128 plus the signal
+// number if it was killed by a signal.
+func (p *Process) Failed() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.state != nil && !p.state.Success()
+}
+
 // Running returns true if the bwrap instance is running.
 func (p *Process) Running() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.exited || p.cmd == nil {
+		return false
+	}
 	wpid, err := syscall.Wait4(p.cmd.Process.Pid, nil, syscall.WNOHANG, nil)
 	if err != nil {
 		return false
@@ -82,6 +210,7 @@ func (p *Process) Running() bool {
 // SetInitPid sets the pid of the bwrap init fork.  This should not be called
 // except from the sandbox creation routine.
 func (p *Process) SetInitPid(pid int) {
+	p.Lock()
 	if p.init != nil {
 		panic("process: SetInitPid called when already set")
 	}
@@ -91,6 +220,69 @@ func (p *Process) SetInitPid(pid int) {
 		panic("process: SetInitPid on invalid process:" + err.Error())
 	}
 	p.init = proc
+	p.Unlock()
+
+	p.register(pid)
+}
+
+// SetCgroup sets the path to the bwrap instance's dedicated cgroup.  This
+// should not be called except from the sandbox creation routine.
+func (p *Process) SetCgroup(path string) {
+	p.Lock()
+	defer p.Unlock()
+	p.cgroup = path
+}
+
+// Freeze suspends every process in the bwrap instance via the cgroup
+// freezer.
+func (p *Process) Freeze() error {
+	return p.setFrozen(true)
+}
+
+// Thaw resumes a frozen bwrap instance.
+func (p *Process) Thaw() error {
+	return p.setFrozen(false)
+}
+
+// Frozen returns true if the bwrap instance is frozen.
+func (p *Process) Frozen() bool {
+	if p.cgroup == "" {
+		return false
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(p.cgroup, "cgroup.events"))
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "frozen 1" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Process) setFrozen(b bool) error {
+	if p.cgroup == "" {
+		return ErrNoCgroup
+	}
+
+	v := []byte("0")
+	if b {
+		v = []byte("1")
+	}
+	if err := ioutil.WriteFile(filepath.Join(p.cgroup, "cgroup.freeze"), v, 0644); err != nil {
+		return err
+	}
+
+	// The state change is asynchronous, wait a bit for it to complete.
+	for i := 0; i < 20; i++ {
+		if p.Frozen() == b {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("process: timeout waiting for cgroup freezer")
 }
 
 // NewProcess creates a new Process instance from a Cmd.
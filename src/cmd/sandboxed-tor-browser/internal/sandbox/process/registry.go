@@ -0,0 +1,107 @@
+// registry.go - Running bwrap instance registry.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package process
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// registryDir is the directory where the pid of each bwrap init process is
+// recorded, so that every sandbox can be torn down from another process,
+// even if the launcher is wedged.
+var registryDir string
+
+// SetRegistryDir sets the registry directory, creating it if required.
+func SetRegistryDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return err
+	}
+	registryDir = dir
+	return nil
+}
+
+func (p *Process) register(pid int) {
+	if registryDir == "" {
+		return
+	}
+
+	f := filepath.Join(registryDir, strconv.Itoa(pid))
+	if err := ioutil.WriteFile(f, nil, 0600); err == nil {
+		p.AddTermHook(func() { os.Remove(f) })
+	}
+}
+
+// RegisteredInitPids returns the pids of the bwrap init processes recorded
+// in the registry dir that are still running.  Stale entries are removed.
+func RegisteredInitPids(dir string) ([]int, error) {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var pids []int
+	for _, ent := range ents {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil || pid <= 1 {
+			continue
+		}
+
+		// Guard against the pid having been reused, by checking that it
+		// still is a bwrap owned by this user.
+		if isBwrap(pid) {
+			pids = append(pids, pid)
+		} else {
+			os.Remove(filepath.Join(dir, ent.Name()))
+		}
+	}
+	return pids, nil
+}
+
+// KillInitPid sends a SIGKILL to a bwrap init process, which terminates
+// every process in the sandbox's PID namespace.
+func KillInitPid(pid int) error {
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+func isBwrap(pid int) bool {
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+	b, err := ioutil.ReadFile(filepath.Join(procDir, "comm"))
+	if err != nil || strings.TrimSpace(string(b)) != "bwrap" {
+		return false
+	}
+
+	// The real uid is checked instead of the owner of the proc directory,
+	// since a setuid bwrap is not dumpable.
+	b, err = ioutil.ReadFile(filepath.Join(procDir, "status"))
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) > 1 && f[0] == "Uid:" {
+			return f[1] == strconv.Itoa(os.Getuid())
+		}
+	}
+	return false
+}
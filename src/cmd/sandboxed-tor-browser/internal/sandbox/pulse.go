@@ -29,13 +29,14 @@ import (
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
-func (h *hugbox) enablePulseAudio() error {
-	const (
-		pulseServer = "PULSE_SERVER"
-		pulseCookie = "PULSE_COOKIE"
-		unixPrefix  = "unix:"
-	)
+const (
+	pulseServer = "PULSE_SERVER"
+	pulseCookie = "PULSE_COOKIE"
+	unixPrefix  = "unix:"
+)
 
+// pulseSocketPath returns the path to the host PulseAudio socket.
+func pulseSocketPath() (string, error) {
 	// TODO: PulseAudio can optionally store information regarding the location
 	// of the socket and the cookie contents as X11 root window properties.
 
@@ -45,26 +46,34 @@ func (h *hugbox) enablePulseAudio() error {
 	if sockPath == "" {
 		hostRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
 		if hostRuntimeDir == "" {
-			// Should never happen, the app requires/uses XDG_RUNTIME_DIR.
-			return fmt.Errorf("hugbox: BUG: Couldn't determine XDG_RUNTIME_DIR")
+			// The launcher can run with a fallback runtime directory, but
+			// PulseAudio won't have a socket there.
+			return "", fmt.Errorf("sandbox: no PulseAudio socket, `XDG_RUNTIME_DIR` not set")
 		}
 		sockPath = filepath.Join(hostRuntimeDir, "pulse", "native")
 	} else if strings.HasPrefix(sockPath, unixPrefix) {
 		sockPath = strings.TrimPrefix(sockPath, unixPrefix)
 	} else {
-		return fmt.Errorf("sandbox: non-local PulseAudio not supported")
+		return "", fmt.Errorf("sandbox: non-local PulseAudio not supported")
 	}
 
 	if fi, err := os.Stat(sockPath); err != nil {
 		// No PulseAudio socket.
-		return fmt.Errorf("sandbox: no PulseAudio socket")
+		return "", fmt.Errorf("sandbox: no PulseAudio socket")
 	} else if fi.Mode()&os.ModeSocket == 0 {
 		// Not an AF_LOCAL socket.
-		return fmt.Errorf("sandbox: PulseAudio socket isn't an AF_LOCAL socket")
+		return "", fmt.Errorf("sandbox: PulseAudio socket isn't an AF_LOCAL socket")
+	}
+	return sockPath, nil
+}
+
+func (h *hugbox) enablePulseAudio() error {
+	sockPath, err := pulseSocketPath()
+	if err != nil {
+		return err
 	}
 
 	// Read in the cookie, if any.
-	var err error
 	var cookie []byte
 	cookiePath := os.Getenv(pulseCookie)
 	if cookiePath == "" {
@@ -17,15 +17,18 @@
 package sandbox
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 
 	"github.com/twtiger/gosecco"
 	"github.com/twtiger/gosecco/parser"
+	"golang.org/x/sys/unix"
 
-	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/policy"
 )
 
 func installTorSeccompProfile(fd *os.File, useBridges bool) error {
@@ -47,6 +50,62 @@ func installTorBrowserSeccompProfile(fd *os.File) error {
 	return installSeccomp(fd, []string{assetFile})
 }
 
+// installFetchSeccompProfile installs the Tor Browser profile onto the fetch
+// helper, like with the probes that re-execute the launcher.  If the helper
+// connects directly, IPv4/IPv6 sockets are also allowed.
+func installFetchSeccompProfile(fd *os.File, direct bool) error {
+	if !direct {
+		return installTorBrowserSeccompProfile(fd)
+	}
+	defer fd.Close()
+
+	const (
+		unixSocketRule = "socket: arg0 == AF_UNIX\n"
+		inetSocketRule = "socket: arg0 == AF_UNIX || arg0 == AF_INET || arg0 == AF_INET6\n"
+	)
+	assetFile := "torbrowser-" + runtime.GOARCH + ".seccomp"
+	rules, err := policy.Asset(assetFile)
+	if err != nil {
+		return err
+	}
+	if bytes.Count(rules, []byte(unixSocketRule)) != 1 {
+		return fmt.Errorf("sandbox: %v has an unexpected socket rule", assetFile)
+	}
+	rules = bytes.Replace(rules, []byte(unixSocketRule), []byte(inetSocketRule), 1)
+
+	settings := gosecco.SeccompSettings{
+		DefaultPositiveAction: "allow",
+		DefaultNegativeAction: "ENOSYS",
+		DefaultPolicyAction:   "ENOSYS",
+		ActionOnX32:           "kill",
+		ActionOnAuditFailure:  "kill",
+	}
+	bpf, err := compileSeccompSources([]parser.Source{&parser.StringSource{Name: assetFile, Content: string(rules)}}, settings)
+	if err != nil {
+		return err
+	}
+	return writeBpf(fd, bpf)
+}
+
+// mediaSeccompProgram returns the compiled filter that `tbb_stub.so` stacks
+// onto the GPU and RDD processes.  Unlike the other profiles, it is a
+// blacklist.
+func mediaSeccompProgram() ([]byte, error) {
+	settings := gosecco.SeccompSettings{
+		DefaultPositiveAction: "EACCES",
+		DefaultNegativeAction: "allow",
+		DefaultPolicyAction:   "allow",
+		ActionOnX32:           "kill",
+		ActionOnAuditFailure:  "kill",
+	}
+
+	var b bytes.Buffer
+	if err := writeSeccomp(&b, []string{"torbrowser-media-" + runtime.GOARCH + ".seccomp"}, settings); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
 func installSeccomp(fd *os.File, ruleAssets []string) error {
 	defer fd.Close()
 
@@ -57,17 +116,39 @@ func installSeccomp(fd *os.File, ruleAssets []string) error {
 		ActionOnX32:           "kill",
 		ActionOnAuditFailure:  "kill",
 	}
+	return writeSeccomp(fd, ruleAssets, settings)
+}
+
+func writeSeccomp(w io.Writer, ruleAssets []string, settings gosecco.SeccompSettings) error {
+	bpf, err := compileSeccomp(ruleAssets, settings)
+	if err != nil {
+		return err
+	}
+	return writeBpf(w, bpf)
+}
+
+func writeBpf(w io.Writer, bpf []unix.SockFilter) error {
+	// Install the bpf bytecode.
+	for _, rule := range bpf {
+		if err := binary.Write(w, binary.LittleEndian, rule); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+func compileSeccomp(ruleAssets []string, settings gosecco.SeccompSettings) ([]unix.SockFilter, error) {
 	if len(ruleAssets) == 0 {
-		return fmt.Errorf("installSeccomp() called with no rules")
+		return nil, fmt.Errorf("installSeccomp() called with no rules")
 	}
 
 	// Combine the rules into a single source.
 	var sources []parser.Source
 	for _, asset := range ruleAssets {
-		rules, err := data.Asset(asset)
+		rules, err := policy.Asset(asset)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		source := &parser.StringSource{
 			Name:    asset,
@@ -75,23 +156,18 @@ func installSeccomp(fd *os.File, ruleAssets []string) error {
 		}
 		sources = append(sources, source)
 	}
+	return compileSeccompSources(sources, settings)
+}
 
+func compileSeccompSources(sources []parser.Source, settings gosecco.SeccompSettings) ([]unix.SockFilter, error) {
 	// Compile the combined source into bpf bytecode.
 	combined := parser.CombineSources(sources...)
 	bpf, err := gosecco.PrepareSource(combined, settings)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Install the bpf bytecode.
 	if size, limit := len(bpf), 0xffff; size > limit {
-		return fmt.Errorf("filter program too big: %d bpf instructions (limit = %d)", size, limit)
+		return nil, fmt.Errorf("filter program too big: %d bpf instructions (limit = %d)", size, limit)
 	}
-	for _, rule := range bpf {
-		if err := binary.Write(fd, binary.LittleEndian, rule); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return bpf, nil
 }
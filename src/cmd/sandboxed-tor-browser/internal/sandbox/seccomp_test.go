@@ -0,0 +1,50 @@
+// seccomp_test.go - Sandbox seccomp tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFetchSeccompProfile(t *testing.T) {
+	compile := func(direct bool) []byte {
+		f, err := ioutil.TempFile("", "seccomp_test")
+		if err != nil {
+			t.Fatalf("ioutil.TempFile: %v", err)
+		}
+		defer os.Remove(f.Name())
+
+		if err = installFetchSeccompProfile(f, direct); err != nil {
+			t.Fatalf("installFetchSeccompProfile(%v): %v", direct, err)
+		}
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("ioutil.ReadFile: %v", err)
+		}
+		if len(b) == 0 || len(b)%8 != 0 {
+			t.Fatalf("installFetchSeccompProfile(%v): malformed program (%d bytes)", direct, len(b))
+		}
+		return b
+	}
+
+	if bytes.Equal(compile(false), compile(true)) {
+		t.Errorf("installFetchSeccompProfile: direct profile does not allow inet sockets")
+	}
+}
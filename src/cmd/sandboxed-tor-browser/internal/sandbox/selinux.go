@@ -0,0 +1,126 @@
+// selinux.go - SELinux related routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	selinuxEnforce = "/sys/fs/selinux/enforce"
+	selinuxXattr   = "security.selinux"
+)
+
+// restoreconPaths is the list of sensible locations for the restorecon
+// binary, which is frequently not in the user's `PATH`.
+var restoreconPaths = []string{
+	"/usr/sbin/restorecon",
+	"/sbin/restorecon",
+}
+
+// SELinuxMode returns the host SELinux mode ("enforcing" or "permissive"),
+// or "" if SELinux is disabled.
+func SELinuxMode() string {
+	v, err := readSysctl(selinuxEnforce)
+	if err != nil {
+		return ""
+	}
+	if v == "1" {
+		return "enforcing"
+	}
+	return "permissive"
+}
+
+func findRestorecon() string {
+	if p, err := exec.LookPath("restorecon"); err == nil {
+		return p
+	}
+	for _, v := range restoreconPaths {
+		if FileExists(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// selinuxLabel returns the SELinux label of the file at path.
+func selinuxLabel(path string) (string, error) {
+	var buf [256]byte
+	n, err := unix.Getxattr(path, selinuxXattr, buf[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(buf[:n]), "\x00"), nil
+}
+
+// selinuxType returns the type field of a SELinux label.
+func selinuxType(label string) string {
+	if f := strings.Split(label, ":"); len(f) >= 3 {
+		return f[2]
+	}
+	return ""
+}
+
+// RelabelFile resets the SELinux label of the file at path to the host policy
+// default via `restorecon`.  This is run on the host, since the files Tor
+// Browser creates in the bind mounted directories inherit labels that other
+// confined applications may not be allowed to read.  It is a no-op if SELinux
+// is disabled.
+func RelabelFile(path string) error {
+	if SELinuxMode() == "" {
+		return nil
+	}
+	restorecon := findRestorecon()
+	if restorecon == "" {
+		return fmt.Errorf("sandbox: SELinux is enabled, but restorecon is missing")
+	}
+
+	// The path is always absolute, so it can't be mistaken for an option.
+	if out, err := exec.Command(restorecon, path).CombinedOutput(); err != nil {
+		return fmt.Errorf("sandbox: restorecon failed: %v (%s)", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// mislabeledFiles returns the paths under dir that `restorecon` would
+// relabel, without changing anything.
+func mislabeledFiles(restorecon, dir string) ([]string, error) {
+	out, err := exec.Command(restorecon, "-n", "-v", "-R", dir).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v (%s)", err, bytes.TrimSpace(out))
+	}
+
+	// Output is `Would relabel <path> from <label> to <label>`.
+	var paths []string
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(l)
+		for i, v := range f {
+			if v == "relabel" && i+1 < len(f) {
+				paths = append(paths, f[i+1])
+				break
+			}
+		}
+	}
+	return paths, nil
+}
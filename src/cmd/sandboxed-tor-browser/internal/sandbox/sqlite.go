@@ -0,0 +1,97 @@
+// sqlite.go - SQLite helper sandbox.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// SQLiteHelperArg is the argument that the launcher is re-executed with
+// inside the SQLite helper sandbox.
+const SQLiteHelperArg = "--sqlite-helper-sandbox"
+
+const (
+	sqliteHelperRequest = "/home/amnesia/sqlite.json"
+	sqliteHelperDir     = "/home/amnesia/db"
+)
+
+// bundleSQLiteLibs are the libraries in the bundle's `Browser` directory that
+// SQLite can be in.  Newer bundles have SQLite built into NSS.
+var bundleSQLiteLibs = []string{
+	"libmozsqlite3.so",
+	"libnss3.so",
+}
+
+// ErrNoBundleSQLite is the error returned when the installed bundle has no
+// usable SQLite library.
+var ErrNoBundleSQLite = errors.New("sandbox: failed to find the bundled SQLite")
+
+// RunSQLiteHelper re-executes the launcher inside a sandbox with the bundled
+// SQLite library, and read-write access to the databases in the host
+// directory dir, passes it the request, and decodes the JSON response into
+// resp.  The helper is executed with `SQLiteHelperArg`, followed by the
+// in-sandbox paths of the library, the request, and the directory.
+func RunSQLiteHelper(cfg *config.Config, dir string, req []byte, resp interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	realBrowserHome := filepath.Join(cfg.BundleInstallDir, "Browser")
+	libName := ""
+	for _, v := range bundleSQLiteLibs {
+		if FileExists(filepath.Join(realBrowserHome, v)) {
+			libName = v
+			break
+		}
+	}
+	if libName == "" {
+		return ErrNoBundleSQLite
+	}
+
+	h, err := newHugbox()
+	if err != nil {
+		return err
+	}
+	h.stderr = newConsoleLogger("sqlite-helper")
+	h.seccompFn = torBrowserSeccompFn
+	h.mountProc = false
+
+	browserHome := filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser", "Browser")
+	h.roBind(realBrowserHome, browserHome, false)
+	h.bind(dir, sqliteHelperDir, false)
+	h.file(sqliteHelperRequest, req)
+
+	args := []string{SQLiteHelperArg, filepath.Join(browserHome, libName), sqliteHelperRequest, sqliteHelperDir}
+	if err = h.appendSelfWithLibraries("sqlite-helper", args, []string{filepath.Join(realBrowserHome, libName)}, realBrowserHome); err != nil {
+		return err
+	}
+	if dynlib.IsSupported() {
+		h.setenv("LD_LIBRARY_PATH", browserHome+":"+restrictedLibDir)
+	} else {
+		h.setenv("LD_LIBRARY_PATH", browserHome)
+	}
+
+	return h.runProbe(resp)
+}
@@ -0,0 +1,182 @@
+// strays.go - Stray sandboxed tor process detection.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// The paths of the tor binary, torrc and data directory inside the tor
+// sandbox, as set up by `RunTor()`.
+const (
+	torSandboxBin     = "/home/amnesia/tor/bin/tor"
+	torSandboxTorrc   = "/home/amnesia/tor/etc/torrc"
+	torSandboxDataDir = "/home/amnesia/tor/data"
+)
+
+// strayTorSettleTime is how long the processes in a torn down sandbox are
+// given to finish exiting, before being considered stray.
+const strayTorSettleTime = 1 * time.Second
+
+// strayTor is a sandboxed tor process that is still running after the
+// sandbox was shut down.
+type strayTor struct {
+	pid, ppid int
+	cmdline   string
+
+	// confirmed is true if the process is known to be using this instance's
+	// tor data directory, and is not just a tor sandboxed by something
+	// that looks similar.  Processes known to be using another directory
+	// are not strays at all.
+	confirmed bool
+}
+
+// sweepStrayTor looks for sandboxed tor processes that outlived their
+// sandbox, logs each one, and kills them if enabled in the config.  It is
+// meant to be called after the tor sandbox exits.
+func sweepStrayTor(cfg *config.Config) {
+	if len(findStrayTor(cfg)) == 0 {
+		return
+	}
+
+	// The kernel tears down the PID namespace asynchronously, so only
+	// report what remains after a moment.
+	time.Sleep(strayTorSettleTime)
+	for _, s := range findStrayTor(cfg) {
+		parent := "sandbox init"
+		if !isBwrapPid(s.ppid) {
+			parent = "not a sandbox"
+		} else if ppidOf(s.ppid) == 1 {
+			parent = "orphaned sandbox init"
+		}
+		log.Printf("tor: INCIDENT: Stray tor process after shutdown: pid %d, ppid %d (%s), confirmed: %v, cmdline: %s", s.pid, s.ppid, parent, s.confirmed, s.cmdline)
+
+		if !cfg.Tor.KillStrayTor {
+			continue
+		}
+		if !s.confirmed {
+			log.Printf("tor: Not killing unconfirmed stray tor process: %d", s.pid)
+			continue
+		}
+
+		// Killing the sandbox init takes out the pluggable transports too.
+		var err error
+		if isBwrapPid(s.ppid) {
+			err = process.KillInitPid(s.ppid)
+		} else {
+			err = syscall.Kill(s.pid, syscall.SIGKILL)
+		}
+		if err != nil {
+			log.Printf("tor: Failed to kill stray tor process %d: %v", s.pid, err)
+		} else {
+			log.Printf("tor: Killed stray tor process: %d", s.pid)
+		}
+	}
+}
+
+// findStrayTor returns the running processes owned by the user that have
+// the command line of the sandboxed tor, and that are not using a different
+// tor data directory, as the other tor instances that the launcher runs
+// (eg: the bridge test) do.
+func findStrayTor(cfg *config.Config) []*strayTor {
+	fis, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	dataFi, _ := os.Stat(cfg.TorDataDir)
+	uid := strconv.Itoa(os.Getuid())
+
+	var ret []*strayTor
+	for _, fi := range fis {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		procDir := filepath.Join("/proc", fi.Name())
+
+		b, err := ioutil.ReadFile(filepath.Join(procDir, "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(b, "\x00")), "\x00")
+		if len(args) < 3 || args[0] != torSandboxBin || args[1] != "-f" || args[2] != torSandboxTorrc {
+			continue
+		}
+		if pidStatusField(pid, "Uid:") != uid {
+			continue
+		}
+
+		// Skip the tor processes that use the sockets of another instance.
+		if torrc, err := ioutil.ReadFile(filepath.Join(procDir, "root", torSandboxTorrc)); err == nil && !tor.IsInstanceTorrc(cfg, torrc) {
+			continue
+		}
+
+		s := &strayTor{
+			pid:     pid,
+			ppid:    ppidOf(pid),
+			cmdline: strings.Join(args, " "),
+		}
+		if dataFi != nil {
+			if fi, err := os.Stat(filepath.Join(procDir, "root", torSandboxDataDir)); err == nil {
+				if !os.SameFile(fi, dataFi) {
+					continue
+				}
+				s.confirmed = true
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// pidStatusField returns the first value of the field from
+// `/proc/<pid>/status`.
+func pidStatusField(pid int, field string) string {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return ""
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) > 1 && f[0] == field {
+			return f[1]
+		}
+	}
+	return ""
+}
+
+func ppidOf(pid int) int {
+	ppid, _ := strconv.Atoi(pidStatusField(pid, "PPid:"))
+	return ppid
+}
+
+func isBwrapPid(pid int) bool {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	return err == nil && strings.TrimSpace(string(b)) == "bwrap" && pidStatusField(pid, "Uid:") == strconv.Itoa(os.Getuid())
+}
@@ -0,0 +1,103 @@
+// stub.go - LD_PRELOAD stub selection and validation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"strconv"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/policy"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const stubVersionSection = ".tbb_stub_version"
+
+// vettedStub returns the stub vetted for the installed bundle, after ensuring
+// that it will load against the host libc, since an incompatible stub fails
+// with a cryptic dynamic linker error inside the sandbox.
+func vettedStub(manif *config.Manifest) ([]byte, error) {
+	stubs, err := policy.Stubs()
+	if err != nil {
+		return nil, err
+	}
+
+	var stub *policy.Stub
+	for _, v := range stubs {
+		if v.MinBundle != "" && !manif.BundleVersionAtLeast(v.MinBundle) {
+			continue
+		}
+		if v.MaxBundle != "" && manif.BundleVersionAtLeast(v.MaxBundle) {
+			continue
+		}
+		stub = v
+		break
+	}
+	if stub == nil {
+		return nil, fmt.Errorf("no stub is vetted for bundle version %v", manif.Version)
+	}
+
+	b, err := data.Asset(stub.Asset)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateStub(b, stub); err != nil {
+		return nil, fmt.Errorf("stub `%v` is unusable: %v", stub.Asset, err)
+	}
+	return b, nil
+}
+
+func validateStub(b []byte, stub *policy.Stub) error {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = dynlib.ValidateClass(f); err != nil {
+		return err
+	}
+
+	// Guard against the asset being from a different build than the one
+	// that was vetted.
+	sec := f.Section(stubVersionSection)
+	if sec == nil {
+		return fmt.Errorf("no version information")
+	}
+	secData, err := sec.Data()
+	if err != nil {
+		return err
+	}
+	v, err := strconv.Atoi(string(bytes.TrimRight(secData, "\x00")))
+	if err != nil {
+		return fmt.Errorf("malformed version information")
+	} else if v != stub.Version {
+		return fmt.Errorf("version %d, expected %d", v, stub.Version)
+	}
+
+	if !dynlib.IsSupported() {
+		return nil
+	}
+	cache, err := dynlib.LoadCache()
+	if err != nil {
+		return err
+	}
+	return dynlib.ValidateSymbolVersions(f, cache)
+}
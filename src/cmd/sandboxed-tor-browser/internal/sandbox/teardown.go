@@ -0,0 +1,169 @@
+// teardown.go - Emergency sandbox teardown.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const registrySubDir = "sandboxes"
+
+// InitRegistry enables recording the init pid of every sandbox that is
+// launched, for the benefit of `Teardown`.
+func InitRegistry(cfg *config.Config) error {
+	return process.SetRegistryDir(filepath.Join(cfg.RuntimeDir, registrySubDir))
+}
+
+// Teardown immediately SIGKILLs every registered sandbox (Tor Browser, tor,
+// and the updater), and returns the number of sandboxes killed.  If shred is
+// set, the contents of each sandbox's tmpfs mounts (eg: the amnesiac
+// profile) are overwritten first, since the kernel does not scrub the pages
+// when they are freed.
+func Teardown(cfg *config.Config, shred bool) (int, error) {
+	pids, err := process.RegisteredInitPids(filepath.Join(cfg.RuntimeDir, registrySubDir))
+	if err != nil {
+		return 0, err
+	}
+
+	var firstErr error
+	n := 0
+	for _, pid := range pids {
+		if shred {
+			// Stop the init process first, so that nothing new gets
+			// reaped or spawned while the shredding happens.  The other
+			// processes will be killed in a moment regardless.
+			syscall.Kill(pid, syscall.SIGSTOP)
+			if err := shredTmpfs(pid); err != nil {
+				log.Printf("sandbox: Failed to shred sandbox %v: %v", pid, err)
+			}
+		}
+		if err := process.KillInitPid(pid); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("sandbox: failed to kill %v: %v", pid, err)
+			}
+			continue
+		}
+		n++
+	}
+	return n, firstErr
+}
+
+// shredTmpfs overwrites every regular file on the tmpfs mounts of the
+// sandbox with the init process pid, via `/proc/<pid>/root`.  Only files
+// that actually reside on one of the tmpfs mounts are touched, so host
+// files that are bind mounted into the sandbox are left alone.
+func shredTmpfs(pid int) error {
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+	f, err := os.Open(filepath.Join(procDir, "mountinfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mountPoints []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		for i, v := range fields {
+			if v == "-" && i > 4 && i+1 < len(fields) && fields[i+1] == "tmpfs" {
+				mountPoints = append(mountPoints, unescapeMountPath(fields[4]))
+				break
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	rootDir := filepath.Join(procDir, "root")
+	for _, mp := range mountPoints {
+		shredTree(filepath.Join(rootDir, mp))
+	}
+	return nil
+}
+
+func shredTree(dir string) {
+	fi, err := os.Lstat(dir)
+	if err != nil || !fi.IsDir() {
+		return
+	}
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+
+	var zeros [32 * 1024]byte
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.Sys().(*syscall.Stat_t).Dev != dev {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return nil
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		for remaining := fi.Size(); remaining > 0; {
+			n := int64(len(zeros))
+			if n > remaining {
+				n = remaining
+			}
+			if _, err = f.Write(zeros[:n]); err != nil {
+				break
+			}
+			remaining -= n
+		}
+		f.Truncate(0)
+		return nil
+	})
+}
+
+func unescapeMountPath(s string) string {
+	// The kernel octal escapes space, tab, newline and backslash.
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(v))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,155 @@
+// viewer.go - Sandboxed document viewer.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+var viewerCount uint32
+
+// RunViewer launches the configured document viewer on path, a completed
+// download, in a sandbox with no network access, and only a read-only view
+// of the Downloads directory.
+func RunViewer(cfg *config.Config, path string) (process *Process, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if len(cfg.Sandbox.ViewerCommand) == 0 {
+		return nil, fmt.Errorf("sandbox: no document viewer is configured")
+	}
+	if cfg.Sandbox.GetX11Mode() == config.X11ModeDisabled {
+		return nil, fmt.Errorf("sandbox: X11 access is disabled, refusing to launch the document viewer")
+	}
+
+	// Only ever expose the single directory, and only files in it.
+	realDownloadsDir := cfg.HostDownloadsDir()
+	rel, err := filepath.Rel(realDownloadsDir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("sandbox: '%v' is not in the Downloads directory", path)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("sandbox: '%v' is not a regular file", path)
+	}
+
+	realViewerBin, err := exec.LookPath(cfg.Sandbox.ViewerCommand[0])
+	if err != nil {
+		return nil, err
+	}
+	if realViewerBin, err = filepath.EvalSymlinks(realViewerBin); err != nil {
+		return nil, err
+	}
+	if realViewerBin, err = filepath.Abs(realViewerBin); err != nil {
+		return nil, err
+	}
+
+	h, err := newHugbox()
+	if err != nil {
+		return nil, err
+	}
+	logger := newConsoleLogger("viewer")
+	h.stdout = logger
+	h.stderr = logger
+	h.seccompFn = installTorBrowserSeccompProfile
+	h.fakeDbus = true
+	h.applyContainerCompat(cfg)
+
+	// The network namespace is unshared by default, and nothing that could
+	// be used to reach tor or the host is bound in.
+	downloadsDir := filepath.Join(h.homeDir, "Downloads")
+	h.roBind(realDownloadsDir, downloadsDir, false)
+	h.chdir = downloadsDir
+
+	h.appendDesktopAssets(true)
+	h.roBind("/usr/share/icons/Adwaita", "/usr/share/icons/Adwaita", true)
+	h.roBind("/etc/fonts", "/etc/fonts", true)
+	h.roBind("/usr/share/fonts", "/usr/share/fonts", true)
+	h.roBind(realViewerBin, realViewerBin, false)
+
+	if dynlib.IsSupported() {
+		cache, err := dynlib.LoadCache()
+		if err != nil {
+			return nil, err
+		}
+
+		binaries := []string{realViewerBin}
+		extraLibs := []string{
+			"libxcb.so.1",
+			"libXau.so.6",
+			"libXdmcp.so.6",
+		}
+		ldLibraryPath := ""
+
+		// Viewers like evince dlopen() their format backends from a
+		// directory named after the binary, so bind that in as is, and
+		// resolve the backends as well.
+		if pluginDir := findDistributionDependentDir(nil, "", filepath.Base(realViewerBin)); pluginDir != "" {
+			h.roBind(pluginDir, pluginDir, false)
+			filepath.Walk(pluginDir, func(p string, fi os.FileInfo, err error) error {
+				if err == nil && fi.Mode().IsRegular() && strings.HasSuffix(p, ".so") {
+					binaries = append(binaries, p)
+				}
+				return nil
+			})
+		}
+
+		pixbufLibs, pixbufLibPath := h.appendRestrictedGdkPixbuf()
+		extraLibs = append(extraLibs, pixbufLibs...)
+		ldLibraryPath = ldLibraryPath + pixbufLibPath
+
+		if err := h.appendLibraries(cache, binaries, extraLibs, ldLibraryPath, nil); err != nil {
+			return nil, err
+		}
+		h.setenv("LD_LIBRARY_PATH", restrictedLibDir)
+	}
+
+	h.cmd = realViewerBin
+	h.cmdArgs = append(append([]string{}, cfg.Sandbox.ViewerCommand[1:]...), filepath.Join(downloadsDir, rel))
+
+	// Each viewer gets its own surrogate, since more than one document can
+	// be open at once.
+	n := atomic.AddUint32(&viewerCount, 1)
+	x11TermHook, err := h.appendX11(cfg, nil, filepath.Join(cfg.RuntimeDir, fmt.Sprintf("xorg-viewer-%d", n)))
+	if err != nil {
+		return nil, err
+	}
+
+	Debugf("sandbox: viewer: %v %v", h.cmd, h.cmdArgs)
+	proc, err := h.run()
+	if err != nil {
+		x11TermHook()
+		return nil, err
+	}
+	proc.AddTermHook(x11TermHook)
+
+	return proc, nil
+}
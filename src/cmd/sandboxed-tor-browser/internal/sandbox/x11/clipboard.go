@@ -0,0 +1,136 @@
+// clipboard.go - X11 surrogate clipboard broker.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package x11
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	opSetSelectionOwner = 22
+	opConvertSelection  = 24
+	opSendEvent         = 25
+
+	evSelectionRequest = 30
+
+	atomPrimary   = 1
+	atomSecondary = 2
+
+	// ClipboardWindow is how long the clipboard is accessible for, after
+	// the user allows a transfer.
+	ClipboardWindow = 5 * time.Second
+)
+
+// clipboardAtom is the host X server's `CLIPBOARD` atom.
+var clipboardAtom uint32
+
+// Clipboard brokers the sandboxed application's access to the host
+// clipboard.  By default all access is denied, and the user must explicitly
+// allow each transfer, which is then possible for `ClipboardWindow`.
+//
+// Only the `CLIPBOARD` selection is ever shared, `PRIMARY` and `SECONDARY`
+// are always denied, since they are set by merely selecting text.
+type Clipboard struct {
+	sync.Mutex
+
+	pasteDeadline time.Time
+	copyDeadline  time.Time
+}
+
+// AllowPaste allows the sandboxed application to read the host clipboard.
+func (cb *Clipboard) AllowPaste() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	log.Printf("sandbox: X11: Allowing clipboard paste into the sandbox")
+	cb.pasteDeadline = time.Now().Add(ClipboardWindow)
+}
+
+// AllowCopy allows the sandboxed application to take ownership of the host
+// clipboard, once.
+func (cb *Clipboard) AllowCopy() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	log.Printf("sandbox: X11: Allowing clipboard copy from the sandbox")
+	cb.copyDeadline = time.Now().Add(ClipboardWindow)
+}
+
+// filterRequest returns true iff the request is permitted.
+func (cb *Clipboard) filterRequest(opCode byte, body []byte, byteOrder binary.ByteOrder) bool {
+	switch opCode {
+	case opSetSelectionOwner:
+		// uint32_t owner
+		// uint32_t selection
+		// uint32_t time
+		if len(body) < 8 {
+			return false
+		}
+		return cb.allowSelection(byteOrder.Uint32(body[4:]), &cb.copyDeadline, true)
+	case opConvertSelection:
+		// uint32_t requestor
+		// uint32_t selection
+		// uint32_t target
+		// uint32_t property
+		// uint32_t time
+		if len(body) < 8 {
+			return false
+		}
+
+		// Each paste takes multiple requests (`TARGETS`, followed by the
+		// actual data), so this isn't one-shot.
+		return cb.allowSelection(byteOrder.Uint32(body[4:]), &cb.pasteDeadline, false)
+	case opSendEvent:
+		// uint32_t destination
+		// uint32_t event_mask
+		// uint8_t  event[32]
+		//
+		// Only the X server has any business generating SelectionRequest
+		// events, forging them would allow reading the clipboard directly.
+		if len(body) < 9 {
+			return false
+		}
+		return body[8]&0x7f != evSelectionRequest
+	}
+	return true
+}
+
+func (cb *Clipboard) allowSelection(selection uint32, deadline *time.Time, oneShot bool) bool {
+	switch selection {
+	case atomPrimary, atomSecondary:
+		return false
+	case clipboardAtom:
+	default:
+		// XdndSelection, and other selections that are used as part of
+		// various protocols.
+		return true
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	if time.Now().After(*deadline) {
+		return false
+	}
+	if oneShot {
+		*deadline = time.Time{}
+	}
+	return true
+}
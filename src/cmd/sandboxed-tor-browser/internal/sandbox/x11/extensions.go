@@ -0,0 +1,101 @@
+// extensions.go - X11 surrogate extension whitelist.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package x11
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+)
+
+// extensionPolicy is the X11 extension policy, loaded from the
+// `x11/extensions.json` asset.
+//
+//   - allowed - Enabled by default.
+//   - optional - Apparently unused, but not obviously horrific.
+//   - unsafe - Never allowed (Direct rendering, input injection/snooping).
+//   - broken - Never allowed, because they can't work across the sandbox
+//     boundary (eg: `MIT-SHM`).
+var extensionPolicy struct {
+	Allowed  []string `json:"allowed"`
+	Optional []string `json:"optional"`
+	Unsafe   []string `json:"unsafe"`
+	Broken   []string `json:"broken"`
+}
+
+func stringInSlice(s string, l []string) bool {
+	for _, v := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateExtension returns an error if the X11 extension may never be
+// enabled.
+func ValidateExtension(ext string) error {
+	switch {
+	case ext == "":
+		return fmt.Errorf("sandbox: X11: empty extension name")
+	case stringInSlice(ext, extensionPolicy.Unsafe):
+		return fmt.Errorf("sandbox: X11: extension '%s' is unsafe", ext)
+	case stringInSlice(ext, extensionPolicy.Broken):
+		return fmt.Errorf("sandbox: X11: extension '%s' does not work in the sandbox", ext)
+	}
+	return nil
+}
+
+// ExtensionWhitelist returns the X11 extensions that the surrogate allows,
+// with the default whitelist adjusted by the specified additions and
+// removals.
+func ExtensionWhitelist(enable, disable []string) ([]string, error) {
+	var l []string
+	for _, v := range extensionPolicy.Allowed {
+		if !stringInSlice(v, disable) {
+			l = append(l, v)
+		}
+	}
+	for _, v := range enable {
+		if err := ValidateExtension(v); err != nil {
+			return nil, err
+		}
+		if stringInSlice(v, l) || stringInSlice(v, disable) {
+			continue
+		}
+		if !stringInSlice(v, extensionPolicy.Optional) {
+			log.Printf("sandbox: X11: WARNING: Enabling unknown extension '%s'", v)
+		}
+		l = append(l, v)
+	}
+	return l, nil
+}
+
+func init() {
+	if d, err := data.Asset("x11/extensions.json"); err != nil {
+		panic(err)
+	} else if err = json.Unmarshal(d, &extensionPolicy); err != nil {
+		panic(err)
+	}
+	for _, v := range extensionPolicy.Allowed {
+		if err := ValidateExtension(v); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+// multihead.go - X11 monitor layout normalization.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package x11
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	opGetInputFocus = 43
+
+	extRandr    = "RANDR"
+	extXinerama = "XINERAMA"
+
+	// The RANDR requests that are answered with the synthetic layout.
+	rrGetScreenInfo             = 5
+	rrGetScreenSizeRange        = 6
+	rrGetScreenResources        = 8
+	rrGetOutputInfo             = 9
+	rrListOutputProperties      = 10
+	rrQueryOutputProperty       = 11
+	rrGetOutputProperty         = 15
+	rrGetCrtcInfo               = 20
+	rrGetCrtcGammaSize          = 22
+	rrGetCrtcGamma              = 23
+	rrGetScreenResourcesCurrent = 25
+	rrGetPanning                = 28
+	rrGetOutputPrimary          = 31
+	rrGetProviders              = 32
+	rrGetMonitors               = 42
+
+	// The RANDR requests that are forwarded as is.
+	rrQueryVersion = 0
+	rrSelectInput  = 4
+
+	rrScreenChangeNotify = 0 // Relative to the first event.
+	rrNotify             = 1
+
+	xineramaQueryVersion   = 0
+	xineramaGetState       = 1
+	xineramaGetScreenCount = 2
+	xineramaGetScreenSize  = 3
+	xineramaIsActive       = 4
+	xineramaQueryScreens   = 5
+
+	// The resource IDs of the synthetic CRTC, output and mode.  The client
+	// only ever gets to use them in requests that are answered by the
+	// surrogate, and the X server rejects them anywhere else.
+	fakeCrtc   = 0x3f
+	fakeOutput = 0x40
+	fakeMode   = 0x41
+
+	fakeRefreshRate = 60
+	fakeOutputName  = "default"
+)
+
+// randrFirstEvent is the host X server's first RANDR event code, or -1.
+var randrFirstEvent = -1
+
+// screenGeometry is the exposed screen's root window geometry.
+type screenGeometry struct {
+	root              uint32
+	width, height     uint16
+	widthMM, heightMM uint16
+}
+
+// filterMultiheadRequest returns the synthetic reply for a RANDR or XINERAMA
+// request that reveals the monitor layout, and if the request should be
+// rejected instead.  A nil reply, and false means the request does not leak
+// anything, and should be forwarded.  body is the request body, sans the
+// 4 byte header.
+func (c *surrogateInstance) filterMultiheadRequest(ext string, minor byte, body []byte) ([]byte, bool) {
+	c.Lock()
+	g := c.geometry
+	c.Unlock()
+
+	switch ext {
+	case extRandr:
+		switch minor {
+		case rrQueryVersion, rrSelectInput:
+			return nil, false
+		}
+		if rep := g.randrReply(minor, c.byteOrder); rep != nil {
+			return rep, false
+		}
+	case extXinerama:
+		if minor == xineramaQueryVersion {
+			return nil, false
+		}
+		if rep := g.xineramaReply(minor, body, c.byteOrder); rep != nil {
+			return rep, false
+		}
+	default:
+		return nil, false
+	}
+
+	// Everything else either changes the configuration, or is not used by
+	// Firefox.
+	return nil, true
+}
+
+// filterMultiheadEvent returns true iff the event should be forwarded, and
+// tracks the root window size.
+func (c *surrogateInstance) filterMultiheadEvent(ev []byte) bool {
+	if randrFirstEvent < 0 {
+		return true
+	}
+	switch int(ev[0]&0x7f) - randrFirstEvent {
+	case rrScreenChangeNotify:
+		// uint8_t  type
+		// uint8_t  rotation
+		// uint16_t sequence
+		// uint32_t timestamp
+		// uint32_t config_timestamp
+		// uint32_t root
+		// uint32_t request_window
+		// uint16_t sizeID
+		// uint16_t subpixel_order
+		// uint16_t width
+		// uint16_t height
+		// uint16_t mwidth
+		// uint16_t mheight
+		//
+		// This is the same information as the ConfigureNotify on the
+		// root window.
+		c.Lock()
+		defer c.Unlock()
+		if c.byteOrder.Uint32(ev[12:]) == c.geometry.root {
+			c.geometry.width = c.byteOrder.Uint16(ev[24:])
+			c.geometry.height = c.byteOrder.Uint16(ev[26:])
+			c.geometry.widthMM = c.byteOrder.Uint16(ev[28:])
+			c.geometry.heightMM = c.byteOrder.Uint16(ev[30:])
+		}
+		return true
+	case rrNotify:
+		// CRTC, output, and provider changes, all of which describe the
+		// real layout.
+		return false
+	}
+	return true
+}
+
+// newReply returns a reply with length bytes of additional data, with
+// everything but the sequence number filled in.
+func newReply(length int, byteOrder binary.ByteOrder) []byte {
+	length += pad(length)
+	rep := make([]byte, 32+length)
+	rep[0] = repReply
+	byteOrder.PutUint32(rep[4:], uint32(length/4))
+	return rep
+}
+
+func (g *screenGeometry) randrModeName() string {
+	return fmt.Sprintf("%dx%d", g.width, g.height)
+}
+
+func (g *screenGeometry) randrReply(minor byte, bo binary.ByteOrder) []byte {
+	var rep []byte
+	switch minor {
+	case rrGetScreenInfo:
+		// uint8_t  rotations
+		// uint32_t root
+		// uint32_t timestamp
+		// uint32_t config_timestamp
+		// uint16_t nSizes
+		// uint16_t sizeID
+		// uint16_t rotation
+		// uint16_t rate
+		// uint16_t nInfo
+		// uint8_t  pad[2]
+		// SCREENSIZE sizes[nSizes] (8 bytes each)
+		// REFRESHRATES rates[nSizes] (uint16_t nRates, uint16_t rates[])
+		rep = newReply(8+4, bo)
+		rep[1] = 1 // Rotate_0
+		bo.PutUint32(rep[8:], g.root)
+		bo.PutUint16(rep[20:], 1)
+		bo.PutUint16(rep[24:], 1)
+		bo.PutUint16(rep[26:], fakeRefreshRate)
+		bo.PutUint16(rep[28:], 2)
+		bo.PutUint16(rep[32:], g.width)
+		bo.PutUint16(rep[34:], g.height)
+		bo.PutUint16(rep[36:], g.widthMM)
+		bo.PutUint16(rep[38:], g.heightMM)
+		bo.PutUint16(rep[40:], 1)
+		bo.PutUint16(rep[42:], fakeRefreshRate)
+	case rrGetScreenSizeRange:
+		// uint16_t min_width
+		// uint16_t min_height
+		// uint16_t max_width
+		// uint16_t max_height
+		rep = newReply(0, bo)
+		bo.PutUint16(rep[8:], g.width)
+		bo.PutUint16(rep[10:], g.height)
+		bo.PutUint16(rep[12:], g.width)
+		bo.PutUint16(rep[14:], g.height)
+	case rrGetScreenResources, rrGetScreenResourcesCurrent:
+		// uint32_t timestamp
+		// uint32_t config_timestamp
+		// uint16_t num_crtcs
+		// uint16_t num_outputs
+		// uint16_t num_modes
+		// uint16_t names_len
+		// uint8_t  pad[8]
+		// CRTC     crtcs[num_crtcs]
+		// OUTPUT   outputs[num_outputs]
+		// MODEINFO modes[num_modes] (32 bytes each)
+		// uint8_t  names[names_len]
+		name := g.randrModeName()
+		rep = newReply(4+4+32+len(name), bo)
+		bo.PutUint16(rep[16:], 1)
+		bo.PutUint16(rep[18:], 1)
+		bo.PutUint16(rep[20:], 1)
+		bo.PutUint16(rep[22:], uint16(len(name)))
+		bo.PutUint32(rep[32:], fakeCrtc)
+		bo.PutUint32(rep[36:], fakeOutput)
+		g.putModeInfo(rep[40:], uint16(len(name)), bo)
+		copy(rep[72:], name)
+	case rrGetOutputInfo:
+		// uint8_t  status
+		// uint32_t timestamp
+		// CRTC     crtc
+		// uint32_t mm_width
+		// uint32_t mm_height
+		// uint8_t  connection
+		// uint8_t  subpixel_order
+		// uint16_t num_crtcs
+		// uint16_t num_modes
+		// uint16_t num_preferred
+		// uint16_t num_clones
+		// uint16_t name_len
+		// CRTC     crtcs[num_crtcs]
+		// MODE     modes[num_modes]
+		// OUTPUT   clones[num_clones]
+		// uint8_t  name[name_len]
+		rep = newReply(4+4+4+len(fakeOutputName), bo)
+		bo.PutUint32(rep[12:], fakeCrtc)
+		bo.PutUint32(rep[16:], uint32(g.widthMM))
+		bo.PutUint32(rep[20:], uint32(g.heightMM))
+		bo.PutUint16(rep[26:], 1)
+		bo.PutUint16(rep[28:], 1)
+		bo.PutUint16(rep[30:], 1)
+		bo.PutUint16(rep[34:], uint16(len(fakeOutputName)))
+		bo.PutUint32(rep[36:], fakeCrtc)
+		bo.PutUint32(rep[40:], fakeMode)
+		copy(rep[44:], fakeOutputName)
+	case rrGetCrtcInfo:
+		// uint8_t  status
+		// uint32_t timestamp
+		// int16_t  x
+		// int16_t  y
+		// uint16_t width
+		// uint16_t height
+		// MODE     mode
+		// uint16_t rotation
+		// uint16_t rotations
+		// uint16_t num_outputs
+		// uint16_t num_possible_outputs
+		// OUTPUT   outputs[num_outputs]
+		// OUTPUT   possible[num_possible_outputs]
+		rep = newReply(4+4, bo)
+		bo.PutUint16(rep[16:], g.width)
+		bo.PutUint16(rep[18:], g.height)
+		bo.PutUint32(rep[20:], fakeMode)
+		bo.PutUint16(rep[24:], 1)
+		bo.PutUint16(rep[26:], 1)
+		bo.PutUint16(rep[28:], 1)
+		bo.PutUint16(rep[30:], 1)
+		bo.PutUint32(rep[32:], fakeOutput)
+		bo.PutUint32(rep[36:], fakeOutput)
+	case rrGetOutputPrimary:
+		// OUTPUT output
+		rep = newReply(0, bo)
+		bo.PutUint32(rep[8:], fakeOutput)
+	case rrGetMonitors:
+		// uint32_t timestamp
+		// uint32_t nMonitors
+		// uint32_t nOutputs
+		// uint8_t  pad[12]
+		// MONITORINFO monitors[nMonitors]
+		//
+		// MONITORINFO:
+		//  ATOM     name
+		//  uint8_t  primary
+		//  uint8_t  automatic
+		//  uint16_t nOutput
+		//  int16_t  x
+		//  int16_t  y
+		//  uint16_t width
+		//  uint16_t height
+		//  uint32_t width_in_millimeters
+		//  uint32_t height_in_millimeters
+		//  OUTPUT   outputs[nOutput]
+		rep = newReply(24+4, bo)
+		bo.PutUint32(rep[12:], 1)
+		bo.PutUint32(rep[16:], 1)
+		rep[36], rep[37] = 1, 1
+		bo.PutUint16(rep[38:], 1)
+		bo.PutUint16(rep[44:], g.width)
+		bo.PutUint16(rep[46:], g.height)
+		bo.PutUint32(rep[48:], uint32(g.widthMM))
+		bo.PutUint32(rep[52:], uint32(g.heightMM))
+		bo.PutUint32(rep[56:], fakeOutput)
+	case rrListOutputProperties, rrGetCrtcGammaSize, rrGetCrtcGamma, rrGetProviders:
+		// No properties (eg: the EDID), gamma ramp, or providers.
+		rep = newReply(0, bo)
+	case rrQueryOutputProperty, rrGetOutputProperty:
+		// As if the property does not exist.
+		rep = newReply(0, bo)
+	case rrGetPanning:
+		// Panning is disabled, all of the (36 byte) fields are 0.
+		rep = newReply(4, bo)
+	}
+	return rep
+}
+
+func (g *screenGeometry) putModeInfo(b []byte, nameLen uint16, bo binary.ByteOrder) {
+	// uint32_t id
+	// uint16_t width
+	// uint16_t height
+	// uint32_t dot_clock
+	// uint16_t hsync_start
+	// uint16_t hsync_end
+	// uint16_t htotal
+	// uint16_t hskew
+	// uint16_t vsync_start
+	// uint16_t vsync_end
+	// uint16_t vtotal
+	// uint16_t name_len
+	// uint32_t mode_flags
+	//
+	// The timings are the bare minimum for the refresh rate to work out.
+	bo.PutUint32(b[0:], fakeMode)
+	bo.PutUint16(b[4:], g.width)
+	bo.PutUint16(b[6:], g.height)
+	bo.PutUint32(b[8:], uint32(g.width)*uint32(g.height)*fakeRefreshRate)
+	bo.PutUint16(b[12:], g.width)
+	bo.PutUint16(b[14:], g.width)
+	bo.PutUint16(b[16:], g.width)
+	bo.PutUint16(b[20:], g.height)
+	bo.PutUint16(b[22:], g.height)
+	bo.PutUint16(b[24:], g.height)
+	bo.PutUint16(b[26:], nameLen)
+}
+
+func (g *screenGeometry) xineramaReply(minor byte, body []byte, bo binary.ByteOrder) []byte {
+	var window uint32
+	if len(body) >= 4 {
+		window = bo.Uint32(body)
+	}
+
+	var rep []byte
+	switch minor {
+	case xineramaGetState:
+		// uint8_t state
+		// WINDOW  window
+		rep = newReply(0, bo)
+		rep[1] = 1
+		bo.PutUint32(rep[8:], window)
+	case xineramaGetScreenCount:
+		// uint8_t screen_count
+		// WINDOW  window
+		rep = newReply(0, bo)
+		rep[1] = 1
+		bo.PutUint32(rep[8:], window)
+	case xineramaGetScreenSize:
+		// uint32_t width
+		// uint32_t height
+		// WINDOW   window
+		// uint32_t screen
+		rep = newReply(0, bo)
+		bo.PutUint32(rep[8:], uint32(g.width))
+		bo.PutUint32(rep[12:], uint32(g.height))
+		bo.PutUint32(rep[16:], window)
+		if len(body) >= 8 {
+			copy(rep[20:24], body[4:8])
+		}
+	case xineramaIsActive:
+		// uint32_t state
+		rep = newReply(0, bo)
+		bo.PutUint32(rep[8:], 1)
+	case xineramaQueryScreens:
+		// uint32_t number
+		// uint8_t  pad[20]
+		// ScreenInfo screen_info[number] (int16_t x_org, y_org,
+		//                                 uint16_t width, height)
+		rep = newReply(8, bo)
+		bo.PutUint32(rep[8:], 1)
+		bo.PutUint16(rep[36:], g.width)
+		bo.PutUint16(rep[38:], g.height)
+	}
+	return rep
+}
@@ -0,0 +1,213 @@
+// multihead_test.go - X11 monitor layout normalization tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package x11
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func newTestInstance() *surrogateInstance {
+	c := newSurrogateInstance(nil, nil, 0)
+	c.byteOrder = binary.LittleEndian
+	c.normalize = true
+	c.geometry = screenGeometry{
+		root:     0x123,
+		width:    1366,
+		height:   768,
+		widthMM:  361,
+		heightMM: 203,
+	}
+	return c
+}
+
+func TestMultiheadRequests(t *testing.T) {
+	c := newTestInstance()
+	bo := c.byteOrder
+	window := []byte{0x23, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+
+	for _, v := range []struct {
+		ext     string
+		minor   byte
+		forward bool
+		reject  bool
+	}{
+		{extRandr, rrQueryVersion, true, false},
+		{extRandr, rrSelectInput, true, false},
+		{extRandr, rrGetScreenInfo, false, false},
+		{extRandr, rrGetScreenSizeRange, false, false},
+		{extRandr, rrGetScreenResources, false, false},
+		{extRandr, rrGetScreenResourcesCurrent, false, false},
+		{extRandr, rrGetOutputInfo, false, false},
+		{extRandr, rrListOutputProperties, false, false},
+		{extRandr, rrQueryOutputProperty, false, false},
+		{extRandr, rrGetOutputProperty, false, false},
+		{extRandr, rrGetCrtcInfo, false, false},
+		{extRandr, rrGetCrtcGammaSize, false, false},
+		{extRandr, rrGetCrtcGamma, false, false},
+		{extRandr, rrGetPanning, false, false},
+		{extRandr, rrGetOutputPrimary, false, false},
+		{extRandr, rrGetProviders, false, false},
+		{extRandr, rrGetMonitors, false, false},
+		{extRandr, 7, false, true},  // SetScreenSize
+		{extRandr, 21, false, true}, // SetCrtcConfig
+		{extRandr, 33, false, true}, // GetProviderInfo
+		{extXinerama, xineramaQueryVersion, true, false},
+		{extXinerama, xineramaGetState, false, false},
+		{extXinerama, xineramaGetScreenCount, false, false},
+		{extXinerama, xineramaGetScreenSize, false, false},
+		{extXinerama, xineramaIsActive, false, false},
+		{extXinerama, xineramaQueryScreens, false, false},
+		{extXinerama, 6, false, true},
+		{"RENDER", 0, true, false},
+	} {
+		rep, reject := c.filterMultiheadRequest(v.ext, v.minor, window)
+		switch {
+		case v.forward && (rep != nil || reject):
+			t.Errorf("%v %d: not forwarded", v.ext, v.minor)
+		case v.reject && !reject:
+			t.Errorf("%v %d: not rejected", v.ext, v.minor)
+		case !v.forward && !v.reject && rep == nil:
+			t.Errorf("%v %d: no reply", v.ext, v.minor)
+		case rep != nil:
+			if rep[0] != repReply || len(rep) < 32 || len(rep)%4 != 0 {
+				t.Errorf("%v %d: malformed reply: %x", v.ext, v.minor, rep)
+			} else if n := 32 + 4*int(bo.Uint32(rep[4:])); n != len(rep) {
+				t.Errorf("%v %d: reply length %d, actual %d", v.ext, v.minor, n, len(rep))
+			}
+		}
+	}
+
+	// Spot check the geometry of the important replies.
+	rep, _ := c.filterMultiheadRequest(extRandr, rrGetMonitors, window)
+	if n := bo.Uint32(rep[12:]); n != 1 {
+		t.Errorf("GetMonitors: %d monitors", n)
+	}
+	if x, y, w, h := bo.Uint16(rep[40:]), bo.Uint16(rep[42:]), bo.Uint16(rep[44:]), bo.Uint16(rep[46:]); x != 0 || y != 0 || w != 1366 || h != 768 {
+		t.Errorf("GetMonitors: geometry %dx%d+%d+%d", w, h, x, y)
+	}
+	rep, _ = c.filterMultiheadRequest(extRandr, rrGetScreenResourcesCurrent, window)
+	if bo.Uint32(rep[32:]) != fakeCrtc || bo.Uint32(rep[36:]) != fakeOutput || bo.Uint32(rep[40:]) != fakeMode {
+		t.Errorf("GetScreenResourcesCurrent: unexpected resources: %x", rep[32:44])
+	}
+	if name := string(rep[72 : 72+bo.Uint16(rep[22:])]); name != "1366x768" {
+		t.Errorf("GetScreenResourcesCurrent: mode name %q", name)
+	}
+	rep, _ = c.filterMultiheadRequest(extRandr, rrGetCrtcInfo, window)
+	if w, h := bo.Uint16(rep[16:]), bo.Uint16(rep[18:]); w != 1366 || h != 768 {
+		t.Errorf("GetCrtcInfo: geometry %dx%d", w, h)
+	}
+	rep, _ = c.filterMultiheadRequest(extXinerama, xineramaQueryScreens, window)
+	if n, w, h := bo.Uint32(rep[8:]), bo.Uint16(rep[36:]), bo.Uint16(rep[38:]); n != 1 || w != 1366 || h != 768 {
+		t.Errorf("QueryScreens: %d screens, %dx%d", n, w, h)
+	}
+	rep, _ = c.filterMultiheadRequest(extXinerama, xineramaGetScreenSize, window)
+	if bo.Uint32(rep[16:]) != 0x123 || bo.Uint32(rep[20:]) != 1 {
+		t.Errorf("GetScreenSize: window/screen not echoed: %x", rep[16:24])
+	}
+}
+
+func TestMultiheadEvents(t *testing.T) {
+	defer func(v int) { randrFirstEvent = v }(randrFirstEvent)
+	randrFirstEvent = 89
+
+	c := newTestInstance()
+	bo := c.byteOrder
+
+	ev := make([]byte, 32)
+	ev[0] = byte(randrFirstEvent + rrNotify)
+	if c.filterMultiheadEvent(ev) {
+		t.Errorf("RRNotify forwarded")
+	}
+	ev[0] |= 0x80 // SendEvent
+	if c.filterMultiheadEvent(ev) {
+		t.Errorf("RRNotify (SendEvent) forwarded")
+	}
+
+	ev[0] = byte(randrFirstEvent + rrScreenChangeNotify)
+	bo.PutUint32(ev[12:], c.geometry.root)
+	bo.PutUint16(ev[24:], 1920)
+	bo.PutUint16(ev[26:], 1080)
+	if !c.filterMultiheadEvent(ev) {
+		t.Errorf("RRScreenChangeNotify dropped")
+	}
+	if c.geometry.width != 1920 || c.geometry.height != 1080 {
+		t.Errorf("RRScreenChangeNotify: geometry not updated: %+v", c.geometry)
+	}
+
+	ev[0] = 22 // ConfigureNotify
+	if !c.filterMultiheadEvent(ev) {
+		t.Errorf("core event dropped")
+	}
+}
+
+func TestMultiheadProxy(t *testing.T) {
+	defer func(fwd map[byte]string) { extensionOpFwdMap = fwd }(extensionOpFwdMap)
+	const randrOp = 140
+	extensionOpFwdMap = map[byte]string{randrOp: extRandr}
+
+	ffConn, ffPeer := net.Pipe()
+	xConn, xPeer := net.Pipe()
+	defer ffPeer.Close()
+	defer xPeer.Close()
+	c := newTestInstance()
+	c.ffConn, c.xConn = ffConn, xConn
+	bo := c.byteOrder
+
+	// RRGetMonitors(window, get_active) is replaced with GetInputFocus.
+	go func() {
+		req := []byte{randrOp, rrGetMonitors, 3, 0, 0x23, 0x01, 0, 0, 1, 0, 0, 0}
+		ffPeer.Write(req)
+	}()
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.consumeClientRequest() }()
+	var req [4]byte
+	if _, err := io.ReadFull(xPeer, req[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if req[0] != opGetInputFocus || bo.Uint16(req[2:]) != 1 {
+		t.Fatalf("unexpected substituted request: %x", req)
+	}
+
+	// The GetInputFocus reply is replaced with the synthetic reply.
+	go func() {
+		rep := make([]byte, 32)
+		rep[0] = repReply
+		bo.PutUint16(rep[2:], 1)
+		xPeer.Write(rep)
+	}()
+	go func() { errCh <- c.consumeServerReply() }()
+	rep := make([]byte, 32)
+	if _, err := io.ReadFull(ffPeer, rep); err != nil {
+		t.Fatal(err)
+	}
+	rep = append(rep, make([]byte, 4*bo.Uint32(rep[4:]))...)
+	if _, err := io.ReadFull(ffPeer, rep[32:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if bo.Uint16(rep[2:]) != 1 || bo.Uint32(rep[12:]) != 1 || bo.Uint16(rep[44:]) != 1366 {
+		t.Errorf("unexpected reply: %x", rep)
+	}
+}
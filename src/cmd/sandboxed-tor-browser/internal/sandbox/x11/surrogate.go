@@ -24,7 +24,7 @@ package x11
 // #include <string.h>
 //
 // static int
-// query_extension_opcode(xcb_connection_t *conn, const char *name) {
+// query_extension_opcode(xcb_connection_t *conn, const char *name, int *first_event) {
 //     xcb_generic_error_t *error = NULL;
 //     xcb_query_extension_cookie_t cookie;
 //     xcb_query_extension_reply_t *reply;
@@ -36,6 +36,25 @@ package x11
 //         return -1;
 //
 //     ret = reply->major_opcode;
+//     *first_event = reply->first_event;
+//     free(reply);
+//
+//     return ret;
+// }
+//
+// static uint32_t
+// intern_atom(xcb_connection_t *conn, const char *name) {
+//     xcb_generic_error_t *error = NULL;
+//     xcb_intern_atom_cookie_t cookie;
+//     xcb_intern_atom_reply_t *reply;
+//     uint32_t ret;
+//
+//     cookie = xcb_intern_atom(conn, 1, strlen(name), name);
+//     reply = xcb_intern_atom_reply(conn, cookie, &error);
+//     if (error)
+//         return 0;
+//
+//     ret = reply->atom;
 //     free(reply);
 //
 //     return ret;
@@ -51,6 +70,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -74,79 +94,90 @@ const (
 )
 
 var (
-	extensionWhitelist = []string{
-		"BIG-REQUESTS",
-		"Composite",
-		"DAMAGE",
-		"GLX",
-		"Generic Event Extension",
-		"RANDR",
-		"RENDER", // Remove this?
-		"SHAPE",
-		"SYNC",
-		"XFIXES",
-		"XINERAMA",
-		"XInputExtension",
-		"XKEYBOARD",
-
-		// Apparently unused, but not obviously horrific:
-		//   DOUBLE-BUFFER
-		//   DPMS
-		//   MIT-SCREEN-SAVER
-		//   Present
-		//   SGI-GLX
-		//   X-Resource
-		//   XC-MISC
-		//   XFree86-DGA
-		//   XFree86-VidModeExtension
-		//   XVideo
-
-		// Unsafe:
-		//   DRI2
-		//   DRI3
-		//   RECORD
-		//   SECURITY
-		//   XTEST
-
-		// Won't work:
-		//   MIT-SHM
-	}
-
 	extensionOpFwdMap map[byte]string
 	extensionOpRevMap map[string]byte
+
+	// lastInput is the UNIX time in nanoseconds of the last user input
+	// event relayed by any surrogate, 0 if a surrogate was never launched.
+	lastInput int64
 )
 
-func queryAllowedExtensionOpcodes(display string) error {
+// LastInput returns the time of the last keyboard or pointer event relayed to
+// a sandboxed client, or the zero time if no surrogate has been launched (as
+// in, activity is not being monitored at all).
+func LastInput() time.Time {
+	if t := atomic.LoadInt64(&lastInput); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (c *surrogateInstance) noteInput(hdr []byte) {
+	// Core input events are KeyPress (2) through MotionNotify (6).  XInput2
+	// delivers them as a GenericEvent, with the event type at offset 8,
+	// where KeyPress (2) through Motion (6) and RawKeyPress (13) through
+	// TouchEnd (22) are input.  Events with the high bit set were sent via
+	// SendEvent by another client, and are ignored.
+	isInput := false
+	switch hdr[0] {
+	case 2, 3, 4, 5, 6:
+		isInput = true
+	case opGenericEvent:
+		if op, ok := extensionOpRevMap["XInputExtension"]; ok && hdr[1] == op {
+			xiType := c.byteOrder.Uint16(hdr[8:])
+			isInput = (xiType >= 2 && xiType <= 6) || (xiType >= 13 && xiType <= 22)
+		}
+	}
+	if isInput {
+		atomic.StoreInt64(&lastInput, time.Now().UnixNano())
+	}
+}
+
+func queryAllowedExtensionOpcodes(display string, extensions []string) error {
 	cDisplay := C.CString(display)
 	defer C.free(unsafe.Pointer(cDisplay))
 
 	conn := C.xcb_connect(cDisplay, nil)
 	if ret := C.xcb_connection_has_error(conn); ret != 0 {
-		return fmt.Errorf("failed to query X11 extensions: ", ret)
+		return fmt.Errorf("failed to query X11 extensions: %v", ret)
 	}
 	defer C.xcb_disconnect(conn)
 
 	extensionOpFwdMap = make(map[byte]string)
 	extensionOpRevMap = make(map[string]byte)
+	randrFirstEvent = -1
 
-	for _, v := range extensionWhitelist {
+	for _, v := range extensions {
 		name := C.CString(v)
-		if op := C.query_extension_opcode(conn, name); op > 0 {
+		var firstEvent C.int
+		if op := C.query_extension_opcode(conn, name, &firstEvent); op > 0 {
 			Debugf("sandbox: X11: Extension '%s' -> %d", v, op)
 			extensionOpFwdMap[byte(op)] = v
 			extensionOpRevMap[v] = byte(op)
+			if v == extRandr {
+				randrFirstEvent = int(firstEvent)
+			}
 		} else {
 			Debugf("sandbox: X11: Extension '%s' -> Not Supported", v)
 		}
 		C.free(unsafe.Pointer(name))
 	}
 
+	// The clipboard broker needs to know which atom is `CLIPBOARD`.
+	name := C.CString("CLIPBOARD")
+	defer C.free(unsafe.Pointer(name))
+	clipboardAtom = uint32(C.intern_atom(conn, name))
+	Debugf("sandbox: X11: Atom 'CLIPBOARD' -> %d", clipboardAtom)
+
 	return nil
 }
 
 type Surrogate struct {
 	sNet, sAddr string
 	pSock       string
+	screen      int
+	normalize   bool
+	clipboard   *Clipboard
 	l           net.Listener
 }
 
@@ -179,6 +210,9 @@ func (p *Surrogate) acceptLoop() {
 			defer xConn.Close()
 
 			c := newSurrogateInstance(conn, xConn, connID)
+			c.screen = p.screen
+			c.normalize = p.normalize
+			c.clipboard = p.clipboard
 			c.proxyConns()
 		}(id)
 		id++
@@ -189,7 +223,11 @@ type surrogateInstance struct {
 	sync.WaitGroup
 	sync.Mutex
 
-	connID int
+	connID    int
+	screen    int
+	normalize bool
+	clipboard *Clipboard
+	geometry  screenGeometry
 
 	ffConn    net.Conn
 	xConn     net.Conn
@@ -351,12 +389,29 @@ func (c *surrogateInstance) consumeClientRequest() error {
 		// The right thing to do when this is required is to rewrite the
 		// response to only show the whitelisted and supported extensions.
 
+	case opSetSelectionOwner, opConvertSelection, opSendEvent:
+		if c.clipboard == nil {
+			break
+		}
+
+		reqBody = make([]byte, reqLen)
+		if _, err := io.ReadFull(c.ffConn, reqBody); err != nil {
+			return err
+		}
+		if !c.clipboard.filterRequest(opCode, reqBody, c.byteOrder) {
+			// None of these requests have replies, and failure is
+			// indistinguishable from another client owning the selection,
+			// or the owner not responding.
+			Debugf("sandbox: X11(%d): Req(#%05d): Dropping clipboard request: %d", c.connID, c.reqSeq, opCode)
+			rejectReq = true
+		}
+
 	default:
 		// Debugf("sandbox: X11(%d): Req(#%05d): %03d %03d: %d bytes", c.connID, c.reqSeq, opCode, hdr[1], reqLen)
 
 		if opCode >= opExtensionBase {
 			// Check to see if the extension is allowed.
-			_, extAllowed := extensionOpFwdMap[opCode]
+			ext, extAllowed := extensionOpFwdMap[opCode]
 			if !extAllowed {
 				log.Printf("sandbox: X11: WARNING: Rejecting prohibited request: %d", opCode)
 
@@ -364,6 +419,34 @@ func (c *surrogateInstance) consumeClientRequest() error {
 					return err
 				}
 				rejectReq = true
+				break
+			}
+			if !c.normalize || (ext != extRandr && ext != extXinerama) {
+				break
+			}
+
+			reqBody = make([]byte, reqLen)
+			if _, err := io.ReadFull(c.ffConn, reqBody); err != nil {
+				return err
+			}
+			rep, reject := c.filterMultiheadRequest(ext, hdr[1], reqBody)
+			switch {
+			case reject:
+				Debugf("sandbox: X11(%d): Req(#%05d): Rejecting %s request: %d", c.connID, c.reqSeq, ext, hdr[1])
+				if err := c.injectRequestError(opCode); err != nil {
+					return err
+				}
+				rejectReq = true
+			case rep != nil:
+				// Send a request that is guaranteed to get a reply in the
+				// place of the request, and replace the reply with the
+				// synthetic one.
+				c.scheduleReplyRewrite(rep, fmt.Sprintf("%s request %d", ext, hdr[1]))
+				if err := c.injectGetInputFocusRequest(); err != nil {
+					return err
+				}
+				c.reqSeq++
+				return nil
 			}
 		}
 	}
@@ -394,7 +477,7 @@ func (c *surrogateInstance) consumeClientRequest() error {
 		}
 
 		// ... and discard the unread body.
-		if reqLen > 0 {
+		if reqBody == nil && reqLen > 0 {
 			if err := discardFull(c.ffConn, int64(reqLen)); err != nil {
 				return err
 			}
@@ -435,6 +518,31 @@ func (c *surrogateInstance) injectNoOperationRequest() error {
 	return writeFull(c.xConn, req[:])
 }
 
+func (c *surrogateInstance) injectGetInputFocusRequest() error {
+	// uint8_t opcode (43)
+	// uint8_t unused
+	// uint16_t request_length (1)
+
+	req := [4]byte{opGetInputFocus, 0x00, 0x00, 0x00}
+	c.byteOrder.PutUint16(req[2:], 1)
+
+	return writeFull(c.xConn, req[:])
+}
+
+// scheduleReplyRewrite replaces the reply to the current request with body,
+// which must have everything but the sequence number filled in.
+func (c *surrogateInstance) scheduleReplyRewrite(body []byte, descr string) {
+	rep := new(replyRewrite)
+	rep.seq = c.reqSeq
+	rep.body = body
+	rep.descr = descr
+	c.byteOrder.PutUint16(rep.body[2:], c.reqSeq)
+
+	c.Lock()
+	defer c.Unlock()
+	c.replyRewriteQueue = append(c.replyRewriteQueue, rep)
+}
+
 func (c *surrogateInstance) scheduleQueryExtensionReplyRewrite(descr string) {
 	rep := new(replyRewrite)
 	rep.seq = c.reqSeq
@@ -478,6 +586,24 @@ func (c *surrogateInstance) consumeServerConnectionSetup() error {
 	}
 	adLen := int(c.byteOrder.Uint16(hdr[6:])) * 4
 
+	if hdr[0] == 1 {
+		// On success, the screen list gets rewritten so that only the
+		// selected screen is visible to the client, as screen 0.
+		ad := make([]byte, adLen)
+		if _, err := io.ReadFull(c.xConn, ad); err != nil {
+			return err
+		}
+		ad, err := c.rewriteScreens(ad)
+		if err != nil {
+			return err
+		}
+		c.byteOrder.PutUint16(hdr[6:], uint16(len(ad)/4))
+		if err := writeFull(c.ffConn, hdr[:]); err != nil {
+			return err
+		}
+		return writeFull(c.ffConn, ad)
+	}
+
 	if err := writeFull(c.ffConn, hdr[:]); err != nil {
 		return err
 	}
@@ -499,6 +625,111 @@ func (c *surrogateInstance) consumeServerConnectionSetup() error {
 	}
 }
 
+func (c *surrogateInstance) rewriteScreens(ad []byte) ([]byte, error) {
+	// The successful connection setup additional data is laid out as
+	// follows:
+	//
+	// uint32_t release_number
+	// uint32_t resource_id_base
+	// uint32_t resource_id_mask
+	// uint32_t motion_buffer_size
+	// uint16_t vendor_len
+	// uint16_t maximum_request_length
+	// uint8_t  roots_len
+	// uint8_t  pixmap_formats_len
+	// uint8_t  misc[6]
+	// uint8_t  unused[4]
+	// uint8_t  vendor[vendor_len]
+	// uint8_t  vendorPad[pad(vendor_len)]
+	// FORMAT   pixmap_formats[pixmap_formats_len] (8 bytes each)
+	// SCREEN   roots[roots_len]
+	const (
+		fixedLen       = 32
+		formatLen      = 8
+		screenFixedLen = 40
+		depthFixedLen  = 8
+		visualLen      = 24
+	)
+
+	if len(ad) < fixedLen {
+		return nil, fmt.Errorf("truncated X11 connection setup")
+	}
+	vendorLen := int(c.byteOrder.Uint16(ad[16:]))
+	nScreens := int(ad[20])
+	nFormats := int(ad[21])
+	off := fixedLen + vendorLen + pad(vendorLen) + nFormats*formatLen
+	screensOff := off
+
+	if c.screen >= nScreens {
+		return nil, fmt.Errorf("X11 screen %d does not exist (%d screens)", c.screen, nScreens)
+	}
+
+	var selected []byte
+	for i := 0; i < nScreens; i++ {
+		// SCREEN:
+		//  uint8_t fixed[39] ...
+		//  uint8_t allowed_depths_len
+		//  DEPTH   allowed_depths[allowed_depths_len]
+		//
+		// DEPTH:
+		//  uint8_t  depth
+		//  uint8_t  unused
+		//  uint16_t visuals_len
+		//  uint8_t  unused[4]
+		//  VISUALTYPE visuals[visuals_len] (24 bytes each)
+		start := off
+		if off+screenFixedLen > len(ad) {
+			return nil, fmt.Errorf("truncated X11 SCREEN")
+		}
+		nDepths := int(ad[off+39])
+		off += screenFixedLen
+		for j := 0; j < nDepths; j++ {
+			if off+depthFixedLen > len(ad) {
+				return nil, fmt.Errorf("truncated X11 DEPTH")
+			}
+			nVisuals := int(c.byteOrder.Uint16(ad[off+2:]))
+			off += depthFixedLen + nVisuals*visualLen
+		}
+		if off > len(ad) {
+			return nil, fmt.Errorf("truncated X11 VISUALTYPE")
+		}
+		if i == c.screen {
+			selected = ad[start:off]
+		}
+	}
+
+	// SCREEN:
+	//  WINDOW   root
+	//  uint32_t default_colormap
+	//  uint32_t white_pixel
+	//  uint32_t black_pixel
+	//  uint32_t current_input_masks
+	//  uint16_t width_in_pixels
+	//  uint16_t height_in_pixels
+	//  uint16_t width_in_millimeters
+	//  uint16_t height_in_millimeters
+	//  ...
+	c.Lock()
+	c.geometry = screenGeometry{
+		root:     c.byteOrder.Uint32(selected[0:]),
+		width:    c.byteOrder.Uint16(selected[20:]),
+		height:   c.byteOrder.Uint16(selected[22:]),
+		widthMM:  c.byteOrder.Uint16(selected[24:]),
+		heightMM: c.byteOrder.Uint16(selected[26:]),
+	}
+	c.Unlock()
+
+	if nScreens > 1 {
+		Debugf("sandbox: X11(%d): Exposing screen %d of %d", c.connID, c.screen, nScreens)
+	}
+
+	ret := make([]byte, 0, screensOff+len(selected))
+	ret = append(ret, ad[:screensOff]...)
+	ret = append(ret, selected...)
+	ret[20] = 1
+	return ret, nil
+}
+
 func (c *surrogateInstance) consumeServerReply() error {
 	// Everything follows this sort of structure.
 	//
@@ -521,6 +752,11 @@ func (c *surrogateInstance) consumeServerReply() error {
 		repLen = int(c.byteOrder.Uint32(hdr[4:])) * 4
 	}
 
+	c.noteInput(hdr[:])
+	if c.normalize && hdr[0] != repError && hdr[0] != repReply && hdr[0] != opGenericEvent && !c.filterMultiheadEvent(hdr[:]) {
+		return nil
+	}
+
 	seq := c.byteOrder.Uint16(hdr[2:])
 	// Debugf("sandbox: X11(%d): Rep(#%05d): %d: %d bytes", c.connID, seq, hdr[0], 32+repLen)
 
@@ -653,11 +889,14 @@ func (c *surrogateInstance) proxyConns() {
 	// Maybe display errors off errChan, whatever, who cares.
 }
 
-func launchSurrogate(xSock, pSock, display string) (*Surrogate, error) {
+func launchSurrogate(xSock, pSock, display string, screen int, extensions []string, normalize bool, clipboard *Clipboard) (*Surrogate, error) {
 	p := new(Surrogate)
 	p.sNet = "unix"
 	p.sAddr = xSock
 	p.pSock = pSock
+	p.screen = screen
+	p.normalize = normalize
+	p.clipboard = clipboard
 
 	// (Re)-Initialize the extension whitelist.
 	//
@@ -668,7 +907,7 @@ func launchSurrogate(xSock, pSock, display string) (*Surrogate, error) {
 	// The alternative would be to incrementally build this list up by
 	// sniffing QueryExtension requests and it's replies, but it's a lot
 	// of work, and I suspect would be somewhat fragile.
-	err := queryAllowedExtensionOpcodes(display)
+	err := queryAllowedExtensionOpcodes(display, extensions)
 	if err != nil {
 		return nil, err
 	}
@@ -679,6 +918,9 @@ func launchSurrogate(xSock, pSock, display string) (*Surrogate, error) {
 		return nil, err
 	}
 
+	// Launching counts as activity, so that LastInput() is non-zero.
+	atomic.StoreInt64(&lastInput, time.Now().UnixNano())
+
 	go p.acceptLoop()
 
 	return p, nil
@@ -20,11 +20,13 @@ package x11
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	. "cmd/sandboxed-tor-browser/internal/utils"
@@ -32,6 +34,16 @@ import (
 
 const SockDir = "/tmp/.X11-unix"
 
+var (
+	// ErrNoDisplay is the error returned when there is no X11 display to
+	// connect to.
+	ErrNoDisplay = errors.New("sandbox: no DISPLAY env var set")
+
+	// ErrRemoteDisplay is the error returned when the X11 display is not
+	// local.
+	ErrRemoteDisplay = errors.New("sandbox: non-local X11 displays not supported")
+)
+
 func craftAuthority(hugboxHostname, realDisplay string) ([]byte, error) {
 	const familyAFLocal = 256
 
@@ -167,6 +179,22 @@ type SandboxedX11 struct {
 	Display    string
 	Xauthority []byte
 
+	// Screen is the host X11 screen exposed to the sandbox as screen 0.
+	Screen int
+
+	// Extensions is the X11 extension whitelist, if the default is to be
+	// overridden.  See `ExtensionWhitelist()`.
+	Extensions []string
+
+	// NormalizeScreens rewrites the RANDR and XINERAMA replies, and drops
+	// the events that reveal the monitor layout, so that the host looks
+	// like it has a single monitor the size of the root window.
+	NormalizeScreens bool
+
+	// Clipboard is the clipboard broker, if host clipboard access is to be
+	// mediated by the surrogate.
+	Clipboard *Clipboard
+
 	Surrogate *Surrogate
 	launched  bool
 }
@@ -181,12 +209,29 @@ func (x *SandboxedX11) Socket() string {
 	return x.hSock
 }
 
+// HostSocket returns the path to the host X11 server's AF_LOCAL socket.
+func (x *SandboxedX11) HostSocket() string {
+	return x.hSock
+}
+
+// UseHostSocket forgoes the surrogate, so that the host X11 socket is used
+// directly.
+func (x *SandboxedX11) UseHostSocket() {
+	Debugf("sandbox: X11: Using the host socket directly")
+	x.launched = true
+}
+
 func (x *SandboxedX11) LaunchSurrogate() error {
 	// Launch the surrogate unless disabled.
 	Debugf("sandbox: X11: Launching surrogate")
 
+	extensions := x.Extensions
+	if extensions == nil {
+		extensions = extensionPolicy.Allowed
+	}
+
 	var err error
-	if x.Surrogate, err = launchSurrogate(x.hSock, x.pSock, x.hDisplay); err != nil {
+	if x.Surrogate, err = launchSurrogate(x.hSock, x.pSock, x.hDisplay, x.Screen, extensions, x.NormalizeScreens, x.Clipboard); err != nil {
 		return err
 	}
 	x.launched = true
@@ -202,28 +247,33 @@ func New(display, hostname, pSock string) (*SandboxedX11, error) {
 		}
 	}
 	if display == "" {
-		return nil, fmt.Errorf("sandbox: no DISPLAY env var set")
+		return nil, ErrNoDisplay
 	}
 	if !strings.HasPrefix(display, ":") {
-		return nil, fmt.Errorf("sandbox: non-local X11 displays not supported")
+		return nil, ErrRemoteDisplay
 	}
 
-	// Certain multimonitor setups use the form ":0.0" or similar.
-	var d []byte
-	for _, c := range []byte(strings.TrimLeft(display, ":")) {
-		if c < 0x30 || c > 0x39 {
-			break
-		}
-		d = append(d, c)
+	// Certain multimonitor setups use the form ":0.1" or similar, where
+	// the number after the "." is the screen.
+	displayNum, screenNum := strings.TrimLeft(display, ":"), ""
+	if idx := strings.IndexByte(displayNum, '.'); idx != -1 {
+		displayNum, screenNum = displayNum[:idx], displayNum[idx+1:]
 	}
-	displayNum := string(d)
-	if len(displayNum) == 0 {
+	if displayNum == "" || !isDecimal(displayNum) {
 		return nil, fmt.Errorf("sandbox: failed to determine X11 display")
 	}
+	screen := 0
+	if screenNum != "" {
+		if !isDecimal(screenNum) {
+			return nil, fmt.Errorf("sandbox: failed to determine X11 screen")
+		}
+		screen, _ = strconv.Atoi(screenNum)
+	}
 
 	// Store the various sandboxed X11 parameters.
 	x := new(SandboxedX11)
 	x.Display = ":0"
+	x.Screen = screen
 	x.hDisplay = display
 	x.hSock = filepath.Join(SockDir, "X"+displayNum)
 	x.pSock = pSock
@@ -236,3 +286,12 @@ func New(display, hostname, pSock string) (*SandboxedX11, error) {
 
 	return x, nil
 }
+
+func isDecimal(s string) bool {
+	for _, c := range []byte(s) {
+		if c < 0x30 || c > 0x39 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,252 @@
+// sqlite3.go - Runtime loaded SQLite bindings.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sqlite3 is a minimal interface to SQLite, for the few things the
+// launcher needs to do to Tor Browser's databases.
+//
+// Note: Instead of linking SQLite, the library from the Tor Browser bundle is
+// loaded at runtime via dlopen(), so that the databases are only ever
+// touched by the SQLite that Tor Browser itself uses.  This is only done
+// from inside a sandbox.
+package sqlite3
+
+// #cgo LDFLAGS: -ldl
+//
+// #include <dlfcn.h>
+// #include <stdint.h>
+// #include <stdlib.h>
+//
+// typedef struct sqlite3 sqlite3;
+// typedef struct sqlite3_stmt sqlite3_stmt;
+//
+// static int (*open_v2_fn)(const char *, sqlite3 **, int, const char *) = NULL;
+// static int (*close_fn)(sqlite3 *) = NULL;
+// static const char *(*errmsg_fn)(sqlite3 *) = NULL;
+// static int (*prepare_v2_fn)(sqlite3 *, const char *, int, sqlite3_stmt **, const char **) = NULL;
+// static int (*bind_text_fn)(sqlite3_stmt *, int, const char *, int, void (*)(void *)) = NULL;
+// static int (*bind_int64_fn)(sqlite3_stmt *, int, int64_t) = NULL;
+// static int (*step_fn)(sqlite3_stmt *) = NULL;
+// static int (*column_count_fn)(sqlite3_stmt *) = NULL;
+// static int (*column_type_fn)(sqlite3_stmt *, int) = NULL;
+// static const unsigned char *(*column_text_fn)(sqlite3_stmt *, int) = NULL;
+// static int (*column_bytes_fn)(sqlite3_stmt *, int) = NULL;
+// static int (*finalize_fn)(sqlite3_stmt *) = NULL;
+// static int (*changes_fn)(sqlite3 *) = NULL;
+//
+// static const char *
+// load_sqlite3(const char *path) {
+//   void *handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+//   if (handle == NULL) {
+//     return dlerror();
+//   }
+//
+// #define LOAD(fn) if ((fn##_fn = dlsym(handle, "sqlite3_" #fn)) == NULL) { dlclose(handle); return "failed to find 'sqlite3_" #fn "()'"; }
+//   LOAD(open_v2)
+//   LOAD(close)
+//   LOAD(errmsg)
+//   LOAD(prepare_v2)
+//   LOAD(bind_text)
+//   LOAD(bind_int64)
+//   LOAD(step)
+//   LOAD(column_count)
+//   LOAD(column_type)
+//   LOAD(column_text)
+//   LOAD(column_bytes)
+//   LOAD(finalize)
+//   LOAD(changes)
+// #undef LOAD
+//
+//   return NULL;
+// }
+//
+// static int sqlite3_open_v2(const char *path, sqlite3 **db, int flags) { return open_v2_fn(path, db, flags, NULL); }
+// static int sqlite3_close(sqlite3 *db) { return close_fn(db); }
+// static const char *sqlite3_errmsg(sqlite3 *db) { return errmsg_fn(db); }
+// static int sqlite3_prepare_v2(sqlite3 *db, const char *sql, sqlite3_stmt **stmt) { return prepare_v2_fn(db, sql, -1, stmt, NULL); }
+// static int sqlite3_bind_text(sqlite3_stmt *stmt, int i, const char *s, int n) { return bind_text_fn(stmt, i, s, n, (void (*)(void *))-1); }
+// static int sqlite3_bind_int64(sqlite3_stmt *stmt, int i, int64_t v) { return bind_int64_fn(stmt, i, v); }
+// static int sqlite3_step(sqlite3_stmt *stmt) { return step_fn(stmt); }
+// static int sqlite3_column_count(sqlite3_stmt *stmt) { return column_count_fn(stmt); }
+// static int sqlite3_column_type(sqlite3_stmt *stmt, int i) { return column_type_fn(stmt, i); }
+// static const unsigned char *sqlite3_column_text(sqlite3_stmt *stmt, int i) { return column_text_fn(stmt, i); }
+// static int sqlite3_column_bytes(sqlite3_stmt *stmt, int i) { return column_bytes_fn(stmt, i); }
+// static int sqlite3_finalize(sqlite3_stmt *stmt) { return finalize_fn(stmt); }
+// static int sqlite3_changes(sqlite3 *db) { return changes_fn(db); }
+//
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+const (
+	sqliteOk   = 0
+	sqliteRow  = 100
+	sqliteDone = 101
+
+	sqliteNull = 5
+
+	openReadOnly  = 0x00000001
+	openReadWrite = 0x00000002
+)
+
+var (
+	// ErrNotLoaded is the error returned when the library has not been
+	// loaded.
+	ErrNotLoaded = errors.New("sqlite3: library not loaded")
+
+	loadLock sync.Mutex
+	loaded   bool
+)
+
+// Load loads the SQLite library at path.  Only one library can be loaded
+// per process.
+func Load(path string) error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+
+	if loaded {
+		return nil
+	}
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	if errStr := C.load_sqlite3(cPath); errStr != nil {
+		return fmt.Errorf("sqlite3: failed to load '%v': %v", path, C.GoString(errStr))
+	}
+	loaded = true
+	return nil
+}
+
+// DB is an open database.
+type DB struct {
+	db *C.sqlite3
+}
+
+// Open opens the existing database at path.
+func Open(path string, readOnly bool) (*DB, error) {
+	loadLock.Lock()
+	ok := loaded
+	loadLock.Unlock()
+	if !ok {
+		return nil, ErrNotLoaded
+	}
+
+	flags := C.int(openReadWrite)
+	if readOnly {
+		flags = openReadOnly
+	}
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	db := new(DB)
+	if rc := C.sqlite3_open_v2(cPath, &db.db, flags); rc != sqliteOk {
+		err := db.err(rc)
+		if db.db != nil {
+			C.sqlite3_close(db.db)
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	if rc := C.sqlite3_close(db.db); rc != sqliteOk {
+		return db.err(rc)
+	}
+	return nil
+}
+
+// Query executes the statement with the args (string or int64) bound to the
+// parameters, and returns the rows as text, with NULL returned as nil.
+func (db *DB) Query(sql string, args ...interface{}) ([][]*string, error) {
+	var rows [][]*string
+	err := db.run(sql, args, func(stmt *C.sqlite3_stmt) {
+		n := int(C.sqlite3_column_count(stmt))
+		row := make([]*string, n)
+		for i := 0; i < n; i++ {
+			if C.sqlite3_column_type(stmt, C.int(i)) == sqliteNull {
+				continue
+			}
+			p := C.sqlite3_column_text(stmt, C.int(i))
+			sz := C.sqlite3_column_bytes(stmt, C.int(i))
+			s := C.GoStringN((*C.char)(unsafe.Pointer(p)), sz)
+			row[i] = &s
+		}
+		rows = append(rows, row)
+	})
+	return rows, err
+}
+
+// Exec executes the statement with the args (string or int64) bound to the
+// parameters, and returns the number of rows changed.
+func (db *DB) Exec(sql string, args ...interface{}) (int, error) {
+	if err := db.run(sql, args, nil); err != nil {
+		return 0, err
+	}
+	return int(C.sqlite3_changes(db.db)), nil
+}
+
+func (db *DB) run(sql string, args []interface{}, onRow func(*C.sqlite3_stmt)) error {
+	cSQL := C.CString(sql)
+	defer C.free(unsafe.Pointer(cSQL))
+
+	var stmt *C.sqlite3_stmt
+	if rc := C.sqlite3_prepare_v2(db.db, cSQL, &stmt); rc != sqliteOk {
+		return db.err(rc)
+	}
+	defer C.sqlite3_finalize(stmt)
+
+	for i, arg := range args {
+		var rc C.int
+		switch v := arg.(type) {
+		case string:
+			cStr := C.CString(v)
+			rc = C.sqlite3_bind_text(stmt, C.int(i+1), cStr, C.int(len(v)))
+			C.free(unsafe.Pointer(cStr))
+		case int64:
+			rc = C.sqlite3_bind_int64(stmt, C.int(i+1), C.int64_t(v))
+		default:
+			return fmt.Errorf("sqlite3: unsupported parameter type: %T", arg)
+		}
+		if rc != sqliteOk {
+			return db.err(rc)
+		}
+	}
+
+	for {
+		switch rc := C.sqlite3_step(stmt); rc {
+		case sqliteRow:
+			if onRow != nil {
+				onRow(stmt)
+			}
+		case sqliteDone:
+			return nil
+		default:
+			return db.err(rc)
+		}
+	}
+}
+
+func (db *DB) err(rc C.int) error {
+	if db.db == nil {
+		return fmt.Errorf("sqlite3: error %d", int(rc))
+	}
+	return fmt.Errorf("sqlite3: %v (%d)", C.GoString(C.sqlite3_errmsg(db.db)), int(rc))
+}
@@ -0,0 +1,170 @@
+// auth.go - Tor control port authentication.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"git.schwanenlied.me/yawning/bulb.git"
+)
+
+const (
+	authMethodNull       = "NULL"
+	authMethodPassword   = "HASHEDPASSWORD"
+	authMethodCookie     = "COOKIE"
+	authMethodSafeCookie = "SAFECOOKIE"
+
+	authCookieLength = 32
+	authNonceLength  = 32
+
+	authServerHashKey = "Tor safe cookie authentication server-to-controller hash"
+	authClientHashKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// defaultCookieFiles are the cookie locations used by the distribution tor
+// packages, tried if the cookie file tor reports isn't readable.
+var defaultCookieFiles = []string{
+	"/run/tor/control.authcookie",           // Debian and derivatives.
+	"/var/run/tor/control.authcookie",       // Older Debian.
+	"/var/lib/tor/control_auth_cookie",      // Fedora, Arch (DataDirectory).
+	"/var/lib/tor/data/control_auth_cookie", // openSUSE.
+}
+
+// authenticate authenticates a control port connection, with the password
+// if one is provided, or via the auth cookie.  If cookieFile is empty, the
+// cookie location reported by tor is used.
+func authenticate(conn *bulb.Conn, password, cookieFile string) error {
+	pi, err := conn.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pi.AuthMethods[authMethodNull]:
+		_, err = conn.Request(cmdAuthenticate)
+		return err
+	case password != "" && pi.AuthMethods[authMethodPassword]:
+		// Despite the name HASHEDPASSWORD, the raw password is sent.
+		_, err = conn.Request("%s %s", cmdAuthenticate, hex.EncodeToString([]byte(password)))
+		return err
+	case pi.AuthMethods[authMethodSafeCookie], pi.AuthMethods[authMethodCookie]:
+		cookie, err := readAuthCookie(cookieFile, pi.CookieFile)
+		if err != nil {
+			return err
+		}
+		if pi.AuthMethods[authMethodSafeCookie] {
+			return safeCookieAuthenticate(conn, cookie)
+		}
+		_, err = conn.Request("%s %s", cmdAuthenticate, hex.EncodeToString(cookie))
+		return err
+	case pi.AuthMethods[authMethodPassword]:
+		return fmt.Errorf("tor: control port requires a password")
+	}
+	return fmt.Errorf("tor: no supported control port authentication methods")
+}
+
+func readAuthCookie(cookieFile, torCookieFile string) ([]byte, error) {
+	var candidates []string
+	if cookieFile != "" {
+		// An explicitly configured cookie file is the only one tried.
+		candidates = []string{cookieFile}
+	} else {
+		if torCookieFile != "" {
+			candidates = append(candidates, torCookieFile)
+		}
+		candidates = append(candidates, defaultCookieFiles...)
+	}
+
+	var firstErr error
+	for _, f := range candidates {
+		cookie, err := ioutil.ReadFile(f)
+		if err == nil {
+			if len(cookie) != authCookieLength {
+				return nil, fmt.Errorf("tor: invalid auth cookie length: %v", f)
+			}
+			return cookie, nil
+		}
+		if firstErr == nil {
+			if os.IsPermission(err) {
+				err = fmt.Errorf("%v (the user may need to be in the tor daemon's group)", err)
+			}
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return nil, fmt.Errorf("tor: no auth cookie file")
+	}
+	return nil, fmt.Errorf("tor: failed to read the auth cookie: %v", firstErr)
+}
+
+func safeCookieAuthenticate(conn *bulb.Conn, cookie []byte) error {
+	var clientNonce [authNonceLength]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return fmt.Errorf("tor: failed to generate client nonce: %v", err)
+	}
+
+	resp, err := conn.Request("AUTHCHALLENGE %s %s", authMethodSafeCookie, hex.EncodeToString(clientNonce[:]))
+	if err != nil {
+		return err
+	}
+
+	// 250 AUTHCHALLENGE SERVERHASH=<hex> SERVERNONCE=<hex>
+	var serverHash, serverNonce []byte
+	for _, v := range strings.Fields(resp.Reply) {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "SERVERHASH":
+			serverHash, err = hex.DecodeString(kv[1])
+		case "SERVERNONCE":
+			serverNonce, err = hex.DecodeString(kv[1])
+		}
+		if err != nil {
+			return fmt.Errorf("tor: malformed AUTHCHALLENGE response: %v", err)
+		}
+	}
+	if len(serverHash) != sha256.Size || len(serverNonce) != authNonceLength {
+		return fmt.Errorf("tor: malformed AUTHCHALLENGE response")
+	}
+
+	safeCookieHash := func(key string) []byte {
+		m := hmac.New(sha256.New, []byte(key))
+		m.Write(cookie)
+		m.Write(clientNonce[:])
+		m.Write(serverNonce)
+		return m.Sum(nil)
+	}
+
+	// Validate the server hash, to ensure that the other end actually
+	// knows the cookie.
+	if !hmac.Equal(serverHash, safeCookieHash(authServerHashKey)) {
+		return fmt.Errorf("tor: AUTHCHALLENGE server hash mismatch")
+	}
+
+	clientHash := safeCookieHash(authClientHashKey)
+	_, err = conn.Request("%s %s", cmdAuthenticate, hex.EncodeToString(clientHash))
+	return err
+}
@@ -0,0 +1,226 @@
+// bootstrap.go - Tor bootstrap status parsing and diagnostics.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/torctl"
+)
+
+// BootstrapStatus is a parsed `STATUS_CLIENT` `BOOTSTRAP` event.
+type BootstrapStatus struct {
+	Severity string `json:"severity"` // `NOTICE` or `WARN`.
+	Progress int    `json:"progress"`
+	Tag      string `json:"tag"`
+	Summary  string `json:"summary"`
+
+	// The following are only set for `WARN` events.
+	Warning        string `json:"warning,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	Count          int    `json:"count,omitempty"`
+	Recommendation string `json:"recommendation,omitempty"`
+	HostAddr       string `json:"hostAddr,omitempty"`
+}
+
+// IsProblem returns true if the status is a bootstrap problem report.
+func (st *BootstrapStatus) IsProblem() bool {
+	return st.Severity == "WARN"
+}
+
+// parseBootstrapStatus parses the body of a `STATUS_CLIENT` event (sans
+// the event name), returning nil if it is not a bootstrap event.
+func parseBootstrapStatus(s string) *BootstrapStatus {
+	const bootstrapEv = "BOOTSTRAP"
+
+	split := torctl.Split(s)
+	if len(split) < 2 || split[1] != bootstrapEv {
+		return nil
+	}
+
+	st := &BootstrapStatus{Severity: split[0]}
+	for key, val := range torctl.Keywords(split[2:]) {
+		switch key {
+		case "PROGRESS":
+			st.Progress, _ = strconv.Atoi(val)
+		case "TAG":
+			st.Tag = val
+		case "SUMMARY":
+			st.Summary = val
+		case "WARNING":
+			st.Warning = val
+		case "REASON":
+			st.Reason = val
+		case "COUNT":
+			st.Count, _ = strconv.Atoi(val)
+		case "RECOMMENDATION":
+			st.Recommendation = val
+		case "HOSTADDR":
+			st.HostAddr = val
+		}
+	}
+	return st
+}
+
+// Bootstrap phases that are part of establishing the initial connection to
+// the Tor network.  A stall here usually means that tor is blocked.
+func isConnTag(tag string) bool {
+	switch tag {
+	case "starting", "conn", "conn_done", "handshake", "handshake_done",
+		"conn_dir", "handshake_dir", "conn_or", "handshake_or", "onehop_create":
+		return true
+	}
+	return false
+}
+
+func isPTTag(tag string) bool {
+	return tag == "conn_pt" || tag == "conn_done_pt"
+}
+
+func isProxyTag(tag string) bool {
+	return tag == "conn_proxy" || tag == "conn_done_proxy"
+}
+
+// Bootstrap phases where an incorrect system clock will cause the consensus
+// and certificates to be rejected.
+func isDirInfoTag(tag string) bool {
+	switch tag {
+	case "requesting_status", "loading_status", "loading_keys",
+		"requesting_descriptors", "loading_descriptors", "enough_dirinfo":
+		return true
+	}
+	return false
+}
+
+const (
+	consensusTimeLayout = "2006-01-02 15:04:05"
+
+	// consensusSkewTolerance is how far before the consensus validity
+	// interval the local clock can be.
+	consensusSkewTolerance = 1 * time.Hour
+
+	// consensusLiveInterval is how long after the consensus validity
+	// interval tor will still consider it reasonably live.
+	consensusLiveInterval = 24 * time.Hour
+)
+
+// consensusClockSkew compares the local time against the consensus
+// `valid-after` and `valid-until` times, and returns a description of the
+// clock skew if it is beyond tolerance.
+//
+// A consensus that appears to be from the past may just be a stale cached
+// copy, so that is only reported when tor is stalled loading directory
+// information, which implies that the network is otherwise reachable.
+func consensusClockSkew(validAfter, validUntil string, now time.Time, tag string) string {
+	after, err := time.ParseInLocation(consensusTimeLayout, validAfter, time.UTC)
+	if err != nil {
+		return ""
+	}
+	until, err := time.ParseInLocation(consensusTimeLayout, validUntil, time.UTC)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case now.Before(after.Add(-consensusSkewTolerance)):
+		return fmt.Sprintf("behind by at least %v according to the consensus", after.Sub(now).Round(time.Minute))
+	case isDirInfoTag(tag) && now.After(until.Add(consensusLiveInterval)):
+		return fmt.Sprintf("ahead by at least %v according to the consensus", now.Sub(until).Round(time.Minute))
+	}
+	return ""
+}
+
+// BootstrapError is the error returned when tor fails to bootstrap.
+type BootstrapError struct {
+	// Status is the last bootstrap status received, if any.
+	Status *BootstrapStatus
+
+	// Problem is the last bootstrap problem report received, if any.
+	Problem *BootstrapStatus
+
+	// ClockSkew is set if tor reported that the system clock is wrong.
+	ClockSkew string
+
+	// Advice is a human readable suggestion for fixing the problem.
+	Advice string
+
+	// NeedsBridges is set if bridges are not in use and are likely to
+	// help.
+	NeedsBridges bool
+}
+
+func (e *BootstrapError) Error() string {
+	s := "tor: timeout connecting to the tor network"
+	if e.Status != nil {
+		s = fmt.Sprintf("%s (stalled at %d%%: %s)", s, e.Status.Progress, e.Status.Summary)
+	}
+	if e.Problem != nil && e.Problem.Warning != "" {
+		s = fmt.Sprintf("%s, last warning: %s", s, e.Problem.Warning)
+	}
+	if e.Advice != "" {
+		s = s + "\n\n" + e.Advice
+	}
+	return s
+}
+
+// bootstrapAdvice returns human readable advice for a bootstrap problem,
+// and if enabling bridges is likely to help.
+func bootstrapAdvice(status, problem *BootstrapStatus, clockSkew string, usingBridges, usingProxy bool) (string, bool) {
+	if clockSkew != "" {
+		return fmt.Sprintf("The system clock appears to be wrong (%s), correct the time and timezone and try again.", clockSkew), false
+	}
+
+	var tag, reason string
+	if problem != nil {
+		tag, reason = problem.Tag, problem.Reason
+	} else if status != nil {
+		tag = status.Tag
+	}
+
+	switch reason {
+	case "NOROUTE":
+		return "There is no route to the Tor network, check that the network connection is working.", false
+	case "RESOURCELIMIT":
+		return "The system has run out of resources (eg: file descriptors or memory).", false
+	case "PT_MISSING":
+		return "The pluggable transport for the configured bridges is not available, try a different bridge type.", false
+	case "IDENTITY":
+		if usingBridges {
+			return "A bridge's identity did not match, check the bridge lines for typos.", false
+		}
+	}
+
+	switch {
+	case isProxyTag(tag):
+		return "The connection to the proxy failed, check the proxy settings.", false
+	case isPTTag(tag):
+		return "The pluggable transport failed to connect, the bridges may be offline or blocked.  Try a different bridge type.", false
+	case isConnTag(tag):
+		if usingBridges {
+			return "The bridges could not be reached, they may be offline or blocked.  Try a different bridge type or custom bridges.", false
+		}
+		if usingProxy {
+			return "The Tor network could not be reached via the proxy, check the proxy settings, or try bridges.", true
+		}
+		return "The Tor network could not be reached, and may be blocked by the network.  Try using bridges.", true
+	case isDirInfoTag(tag):
+		return "The Tor network directory information could not be loaded.  If the system clock is wrong, correct the time and timezone and try again.", false
+	}
+	return "", false
+}
@@ -0,0 +1,326 @@
+// bridgeprobe.go - Internal bridge reachability probing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	bridgeProbeTimeout     = 10 * time.Second
+	bridgeProbeConcurrency = 8
+)
+
+// bridgeAddr returns the `address:port` of a `Bridge` line, or "" if it
+// can not be probed (eg: meek and snowflake use a placeholder address).
+func bridgeAddr(line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, "Bridge "))
+	if len(fields) == 0 {
+		return ""
+	}
+	addr := fields[0]
+	if !strings.Contains(addr, ":") && len(fields) > 1 {
+		// The first field is the transport.
+		addr = fields[1]
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() || port == "0" {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil && (ip4[0] == 0 || (ip4[0] == 192 && ip4[1] == 0 && ip4[2] == 2)) {
+		return ""
+	}
+	return addr
+}
+
+// ProbeBridges tests the TCP reachability and latency of the internal
+// bridges of the configured type (via the configured proxy if any), and
+// records the results in the config, so that `CfgToSandboxTorrc` can prefer
+// the responsive bridges.  This does nothing unless probing is enabled, and
+// internal bridges are in use.
+func ProbeBridges(ctx context.Context, cfg *config.Config, bridges map[string][]string) error {
+	if !cfg.Tor.ProbeBridges || !cfg.Tor.UseBridges || cfg.Tor.UseCustomBridges {
+		return nil
+	}
+
+	dialFn, err := bridgeProbeDialer(cfg)
+	if err != nil {
+		return err
+	}
+
+	var addrs []string
+	for _, line := range bridges[cfg.Tor.InternalBridgeType] {
+		if addr := bridgeAddr(line); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	cfg.Tor.PruneBridgeStats(addrs)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	log.Printf("tor: Probing %d %v bridges.", len(addrs), cfg.Tor.InternalBridgeType)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, bridgeProbeConcurrency)
+	nOk := 0
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+
+			start := time.Now()
+			conn, err := dialFn(ctx, addr)
+			rtt := time.Since(start)
+			if ctx.Err() != nil {
+				// Canceled, the result says nothing about the bridge.
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			if err == nil {
+				conn.Close()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				Debugf("tor: Bridge probe failed: %v: %v", addr, err)
+			} else {
+				Debugf("tor: Bridge probe succeeded: %v: %v", addr, rtt)
+				nOk++
+			}
+			cfg.Tor.RecordBridgeProbe(addr, err == nil, rtt)
+		}(addr)
+	}
+	wg.Wait()
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("tor: %d/%d bridges are reachable.", nOk, len(addrs))
+	return nil
+}
+
+type bridgeDialFunc func(context.Context, string) (net.Conn, error)
+
+func bridgeProbeDialer(cfg *config.Config) (bridgeDialFunc, error) {
+	withTimeout := func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, bridgeProbeTimeout)
+	}
+
+	if !cfg.Tor.UseProxy {
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			ctx, cancelFn := withTimeout(ctx)
+			defer cancelFn()
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		}, nil
+	}
+
+	proxyAddr := net.JoinHostPort(cfg.Tor.ProxyAddress, cfg.Tor.ProxyPort)
+	var handshakeFn func(net.Conn, string) error
+	switch cfg.Tor.ProxyType {
+	case "SOCKS 4":
+		handshakeFn = socks4Connect
+	case "SOCKS 5":
+		var auth *proxy.Auth
+		if cfg.Tor.ProxyUsername != "" && cfg.Tor.ProxyPassword != "" {
+			auth = &proxy.Auth{User: cfg.Tor.ProxyUsername, Password: cfg.Tor.ProxyPassword}
+		}
+		handshakeFn = func(conn net.Conn, addr string) error {
+			d, err := proxy.SOCKS5("tcp", proxyAddr, auth, &connDialer{conn})
+			if err != nil {
+				return err
+			}
+			_, err = d.Dial("tcp", addr)
+			return err
+		}
+	case "HTTP(S)":
+		handshakeFn = func(conn net.Conn, addr string) error {
+			return httpConnect(conn, addr, cfg.Tor.ProxyUsername, cfg.Tor.ProxyPassword)
+		}
+	default:
+		return nil, fmt.Errorf("tor: Unsupported proxy type: %v", cfg.Tor.ProxyType)
+	}
+
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		ctx, cancelFn := withTimeout(ctx)
+		defer cancelFn()
+
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if err = handshakeFn(conn, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, nil
+}
+
+// connDialer is a `proxy.Dialer` that returns an already established
+// connection, so that the SOCKS 5 handshake can be done with a deadline.
+type connDialer struct {
+	conn net.Conn
+}
+
+func (d *connDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func socks4Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return fmt.Errorf("SOCKS 4 does not support the address: %v", addr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	// VN, CD (CONNECT), DSTPORT, DSTIP, USERID (empty)
+	req := []byte{0x04, 0x01, 0x00, 0x00}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	req = append(append(req, ip...), 0x00)
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [8]byte
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0x5a {
+		return fmt.Errorf("SOCKS 4 request rejected: 0x%02x", resp[1])
+	}
+	return nil
+}
+
+func httpConnect(conn net.Conn, addr, user, passwd string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user != "" && passwd != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+passwd)) + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP CONNECT failed: %v", resp.Status)
+	}
+	return nil
+}
+
+// orderBridges returns the bridge lines ordered by the recorded probe
+// history, with the bridges that are currently unreachable dropped unless
+// none are reachable.  The relative ordering of otherwise equal bridges is
+// preserved, so that the seeded load balancing still applies.
+func orderBridges(lines []string, stats map[string]*config.BridgeStat) []string {
+	type entry struct {
+		line string
+		stat *config.BridgeStat
+	}
+
+	entries := make([]entry, 0, len(lines))
+	haveReachable := false
+	for _, line := range lines {
+		st := stats[bridgeAddr(line)]
+		if st != nil && st.LastProbe != 0 && st.Failures == 0 {
+			haveReachable = true
+		}
+		entries = append(entries, entry{line, st})
+	}
+
+	// Bridges that are reachable come first, sorted by latency, then the
+	// ones that weren't probed, then the rest by consecutive failures.
+	rank := func(st *config.BridgeStat) (int, int64) {
+		switch {
+		case st == nil || st.LastProbe == 0:
+			return 1, 0
+		case st.Failures == 0:
+			return 0, st.RTT
+		default:
+			return 2, int64(st.Failures)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ri, vi := rank(entries[i].stat)
+		rj, vj := rank(entries[j].stat)
+		if ri != rj {
+			return ri < rj
+		}
+		return vi < vj
+	})
+
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if haveReachable {
+			if r, _ := rank(e.stat); r == 2 {
+				continue
+			}
+		}
+		ret = append(ret, e.line)
+	}
+	return ret
+}
@@ -0,0 +1,195 @@
+// bridgetest.go - Bridge reachability testing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/torctl"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const bridgeTestTimeout = 60 * time.Second
+
+// BridgeTestResult is the outcome of testing a single bridge line.
+type BridgeTestResult struct {
+	// Line is the bridge line that was tested.
+	Line string
+
+	// Reachable is true if tor established a connection to the bridge.
+	Reachable bool
+
+	// Reason is the reason the bridge is considered unreachable.
+	Reason string
+
+	fingerprint string
+	addr        string
+	done        bool
+}
+
+func (r *BridgeTestResult) matches(target string) bool {
+	// ORCONN targets are either `$FINGERPRINT[~|=Nickname]` or
+	// `address:port`.
+	if strings.HasPrefix(target, "$") {
+		if i := strings.IndexAny(target, "~="); i > 0 {
+			target = target[:i]
+		}
+		return r.fingerprint != "" && strings.EqualFold(target[1:], r.fingerprint)
+	}
+	return r.addr != "" && target == r.addr
+}
+
+// bridgeFingerprint returns the fingerprint of a `Bridge` line, or "" if
+// there is none.
+func bridgeFingerprint(line string) string {
+	for _, f := range strings.Fields(strings.TrimPrefix(line, "Bridge ")) {
+		if len(f) != 40 {
+			continue
+		}
+		if strings.Trim(strings.ToUpper(f), "0123456789ABCDEF") == "" {
+			return f
+		}
+	}
+	return ""
+}
+
+// TestBridges has a freshly launched sandboxed tor instance, configured
+// with the bridge lines, connect to the network, and reports which of the
+// bridges it managed to connect to.  The instance is only good for the
+// test, and should be shutdown by the caller afterwards.
+func (t *Tor) TestBridges(cfg *config.Config, lines []string, async *Async) ([]*BridgeTestResult, error) {
+	if t.isSystem || t.isBootstrapped {
+		return nil, fmt.Errorf("tor: bridges can only be tested with a new sandboxed tor")
+	}
+
+	results := make([]*BridgeTestResult, 0, len(lines))
+	nPending := 0
+	for _, line := range lines {
+		r := &BridgeTestResult{
+			Line:        line,
+			fingerprint: bridgeFingerprint(line),
+			addr:        bridgeAddr(line),
+		}
+		if r.fingerprint == "" && r.addr == "" {
+			r.Reason = "Bridge has no address or fingerprint to test"
+			r.done = true
+		} else {
+			nPending++
+		}
+		results = append(results, r)
+	}
+	if nPending == 0 {
+		return results, nil
+	}
+
+	async.UpdateProgress("Connecting to the Tor Control Port.")
+	if err := t.connectSandboxedCtrl(cfg, async); err != nil {
+		return nil, err
+	}
+	ctrl := t.ctrl
+	ctx := context.Background()
+
+	go t.eventReader(ctrl)
+
+	if _, err := ctrl.Request(ctx, "TAKEOWNERSHIP"); err != nil {
+		return nil, err
+	}
+	if _, err := ctrl.Request(ctx, "SETEVENTS ORCONN"); err != nil {
+		return nil, err
+	}
+
+	log.Printf("tor: Testing %d bridges.", nPending)
+	async.UpdateProgress("Testing bridges.")
+	if _, err := ctrl.Request(ctx, "RESETCONF DisableNetwork"); err != nil {
+		return nil, err
+	}
+
+	hz := time.NewTicker(1 * time.Second)
+	defer hz.Stop()
+	timeout := time.After(bridgeTestTimeout)
+
+	nTotal := nPending
+	for nPending > 0 {
+		select {
+		case ev := <-t.ctrlEvents:
+			const evORConnPrefix = "ORCONN "
+			if ev == nil {
+				return nil, fmt.Errorf("tor: lost the control port connection")
+			}
+			if !strings.HasPrefix(ev.Reply, evORConnPrefix) {
+				continue
+			}
+			split := torctl.Split(strings.TrimPrefix(ev.Reply, evORConnPrefix))
+			if len(split) < 2 {
+				continue
+			}
+			target, status := split[0], split[1]
+			for _, r := range results {
+				if !r.matches(target) || r.Reachable {
+					continue
+				}
+				switch status {
+				case "CONNECTED":
+					r.Reachable, r.Reason = true, ""
+				case "FAILED":
+					r.Reason = torctl.Keywords(split[2:])["REASON"]
+					if r.Reason == "" {
+						r.Reason = "Connection failed"
+					}
+				default:
+					continue
+				}
+				if !r.done {
+					r.done = true
+					nPending--
+				}
+				Debugf("tor: Bridge test: %v: %v %v", target, status, r.Reason)
+			}
+			async.UpdateProgress(fmt.Sprintf("Testing bridges (%d/%d done).", nTotal-nPending, nTotal))
+		case <-async.Cancel:
+			return nil, ErrCanceled
+		case <-hz.C:
+			if !t.process.Running() {
+				return nil, ErrTorCrashed
+			}
+		case <-timeout:
+			for _, r := range results {
+				if !r.done {
+					r.Reason = "Timed out"
+					r.done = true
+				}
+			}
+			nPending = 0
+		}
+	}
+
+	nOk := 0
+	for _, r := range results {
+		if r.Reachable {
+			nOk++
+		}
+	}
+	log.Printf("tor: %d/%d bridges are reachable.", nOk, len(results))
+
+	return results, nil
+}
@@ -18,34 +18,49 @@ package tor
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"sync"
+
+	"cmd/sandboxed-tor-browser/internal/torctl"
 )
 
+// ErrCircuitDisplayUnavailable is the error returned when the circuit monitor
+// has lost the control port connection.
+var ErrCircuitDisplayUnavailable = errors.New("tor: the circuit display is unavailable")
+
 type circuitMonitor struct {
 	sync.Mutex
 
-	p       *ctrlProxy
-	circs   []string
-	circIds map[int]bool
-	conns   *list.List
+	p         *ctrlProxy
+	circs     []string
+	circIds   map[int]bool
+	conns     *list.List
+	available bool
 }
 
 func (m *circuitMonitor) updateCircuitStatus(id int) (bool, error) {
 	const (
-		lineOk        = "250 OK"
-		socksPassword = "SOCKS_PASSWORD=\""
+		argCircuitStatus = "circuit-status"
+		socksPassword    = "SOCKS_PASSWORD=\""
 	)
 
-	resp, err := m.p.tor.getinfo("circuit-status")
-	if resp == nil && err != nil {
+	ctrl, err := m.p.tor.getCtrl()
+	if err != nil {
+		return false, err
+	}
+	info, err := ctrl.GetInfo(context.Background(), argCircuitStatus)
+	if err != nil {
 		return false, err
 	}
 
-	if len(resp.RawLines) <= 2 {
-		// No circuits, or error...
+	lines := strings.Split(info[argCircuitStatus], "\n")
+	if info[argCircuitStatus] == "" {
+		// No circuits.
 		return false, nil
 	}
 
@@ -55,18 +70,12 @@ func (m *circuitMonitor) updateCircuitStatus(id int) (bool, error) {
 	defer m.Unlock()
 
 	m.circIds = make(map[int]bool)
-	m.circs = make([]string, 0, len(resp.RawLines)-2)
+	m.circs = make([]string, 0, len(lines))
 
 	// Parse each circuit line...
 	foundId := false
-	for _, v := range resp.RawLines {
-		switch v {
-		case ".", lineOk, responseCircuitStatus:
-			continue
-		default:
-		}
-
-		splitCirc := splitQuoted(v)
+	for _, v := range lines {
+		splitCirc := torctl.Split(v)
 		if len(splitCirc) < 1 {
 			continue
 		}
@@ -108,7 +117,47 @@ func (m *circuitMonitor) getCircuitStatus() []string {
 	return m.circs
 }
 
+func (m *circuitMonitor) isAvailable() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.available
+}
+
+func (m *circuitMonitor) setAvailable(b bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.available = b
+	if !b {
+		m.circs = nil
+		m.circIds = nil
+	}
+}
+
+// onCtrlState is the control port connection state hook, which resubscribes
+// to the stream events once the connection is re-established.
+func (m *circuitMonitor) onCtrlState(connected bool) {
+	if !connected {
+		log.Printf("tor: Circuit display unavailable until tor is reachable.")
+		m.setAvailable(false)
+		return
+	}
+
+	if _, err := m.p.tor.request(context.Background(), "SETEVENTS %s", eventStream); err != nil {
+		log.Printf("tor: Failed to re-register for circuit/stream events: %v", err)
+		return
+	}
+	log.Printf("tor: Circuit display restored.")
+	m.setAvailable(true)
+}
+
 func (m *circuitMonitor) handleEvents() {
+	defer func() {
+		if m.isAvailable() {
+			log.Printf("tor: Circuit display unavailable, the control port connection is gone.")
+		}
+		m.setAvailable(false)
+	}()
+
 	for {
 		ev, ok := <-m.p.tor.ctrlEvents
 		if !ok {
@@ -118,7 +167,7 @@ func (m *circuitMonitor) handleEvents() {
 		if len(ev.RawLines) > 1 {
 			continue
 		}
-		splitEv := splitQuoted(ev.Reply)
+		splitEv := torctl.Split(ev.Reply)
 		if splitEv[0] != eventStream {
 			continue
 		}
@@ -188,10 +237,141 @@ func initCircuitMonitor(p *ctrlProxy) (*circuitMonitor, error) {
 	m.p = p
 	m.conns = list.New()
 
-	if _, err := m.p.tor.ctrl.Request("SETEVENTS %s", eventStream); err != nil {
+	if _, err := m.p.tor.request(context.Background(), "SETEVENTS %s", eventStream); err != nil {
 		return nil, fmt.Errorf("circuitMon: failed to register for circuit/stream events: %v", err)
 	}
+	m.available = true
+	m.p.tor.setCtrlStateHook(m.onCtrlState)
 	go m.handleEvents()
 
 	return m, nil
 }
+
+// CircuitRelay is a relay that is part of a circuit.
+type CircuitRelay struct {
+	Fingerprint string
+	Nickname    string
+	Address     string
+	Country     string
+	Bandwidth   int // In kilobytes/sec, as listed in the consensus.
+}
+
+func (r *CircuitRelay) String() string {
+	s := r.Nickname
+	if r.Address != "" {
+		s += " (" + r.Address + ")"
+	}
+	if r.Country != "" {
+		s += " [" + strings.ToUpper(r.Country) + "]"
+	}
+	if r.Bandwidth > 0 {
+		s += fmt.Sprintf(" %d KB/s", r.Bandwidth)
+	}
+	return s
+}
+
+// Circuit is a Tor Browser circuit.
+type Circuit struct {
+	ID     int
+	Status string
+	Domain string
+	Relays []*CircuitRelay
+}
+
+// Circuits returns the Tor Browser circuits, with the details of each relay.
+// This requires the circuit display to be enabled.
+func (t *Tor) Circuits(ctx context.Context) ([]*Circuit, error) {
+	const (
+		socksUsername = "SOCKS_USERNAME"
+		tagDomain     = "--unknown--" // Torbutton's catch-all domain.
+	)
+
+	t.Lock()
+	p := t.ctrlSurrogate
+	t.Unlock()
+	if p == nil || !p.circuitMonitorEnabled {
+		return nil, fmt.Errorf("tor: the circuit display is not enabled")
+	}
+	if !p.circuitMonitor.isAvailable() {
+		return nil, ErrCircuitDisplayUnavailable
+	}
+	if _, err := p.circuitMonitor.updateCircuitStatus(-1); err != nil {
+		return nil, err
+	}
+
+	relays := make(map[string]*CircuitRelay)
+	var circs []*Circuit
+	for _, v := range p.circuitMonitor.getCircuitStatus() {
+		splitCirc := torctl.Split(v)
+		if len(splitCirc) < 3 {
+			continue
+		}
+		id, err := strconv.Atoi(splitCirc[0])
+		if err != nil {
+			continue
+		}
+		circ := &Circuit{ID: id, Status: splitCirc[1]}
+		for _, vv := range splitCirc[2:] {
+			if k, d, ok := torctl.Keyword(vv); ok && k == socksUsername && d != tagDomain {
+				circ.Domain = d
+			}
+		}
+
+		// $fingerprint~nickname,...
+		for _, hop := range strings.Split(splitCirc[2], ",") {
+			fp := strings.TrimPrefix(strings.SplitN(hop, "~", 2)[0], "$")
+			if fp == "" || strings.Contains(fp, "=") {
+				break
+			}
+			r, ok := relays[fp]
+			if !ok {
+				r = t.queryRelay(ctx, fp)
+				if idx := strings.IndexByte(hop, '~'); r.Nickname == "" && idx != -1 {
+					r.Nickname = hop[idx+1:]
+				}
+				relays[fp] = r
+			}
+			circ.Relays = append(circ.Relays, r)
+		}
+		circs = append(circs, circ)
+	}
+	return circs, nil
+}
+
+func (t *Tor) queryRelay(ctx context.Context, fp string) *CircuitRelay {
+	r := &CircuitRelay{Fingerprint: fp, Nickname: fp}
+
+	ctrl, err := t.getCtrl()
+	if err != nil {
+		return r
+	}
+
+	// Failures here are not fatal, since bridges are not in the consensus.
+	argNsId := "ns/id/" + fp
+	info, err := ctrl.GetInfo(ctx, argNsId)
+	if err != nil {
+		return r
+	}
+	for _, l := range strings.Split(info[argNsId], "\n") {
+		// r nickname identity digest publication-date publication-time IP ORPort DirPort
+		// w Bandwidth=N
+		f := strings.Fields(l)
+		switch {
+		case len(f) >= 9 && f[0] == "r":
+			r.Nickname = f[1]
+			r.Address = f[6]
+		case len(f) >= 2 && f[0] == "w" && strings.HasPrefix(f[1], "Bandwidth="):
+			r.Bandwidth, _ = strconv.Atoi(strings.TrimPrefix(f[1], "Bandwidth="))
+		}
+	}
+
+	if r.Address != "" {
+		argIpToCountry := "ip-to-country/" + r.Address
+		if info, err = ctrl.GetInfo(ctx, argIpToCountry); err == nil {
+			if cc := info[argIpToCountry]; cc != "??" {
+				r.Country = cc
+			}
+		}
+	}
+	return r
+}
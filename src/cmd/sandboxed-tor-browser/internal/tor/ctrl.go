@@ -0,0 +1,233 @@
+// ctrl.go - Multiplexing tor control port client.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"git.schwanenlied.me/yawning/bulb.git"
+
+	"cmd/sandboxed-tor-browser/internal/torctl"
+)
+
+const maxCtrlEventBacklog = 16
+
+var errCtrlClosed = errors.New("tor: control port connection closed")
+
+// ctrlConn is a control port connection that supports concurrent requests.
+//
+// The control port protocol has no request identifiers, and tor services
+// commands strictly in order, so requests are pipelined, and each response
+// is dispatched to the oldest outstanding request.  Unlike bulb's
+// `Request()`, callers only serialize on writing the command, and not on
+// waiting for the response.
+type ctrlConn struct {
+	conn *bulb.Conn
+
+	// wrLock serializes writes, so that the pending queue is in the same
+	// order as the commands on the wire.
+	wrLock sync.Mutex
+
+	sync.Mutex
+	pending []chan *bulb.Response
+	err     error
+
+	events    chan *bulb.Response
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	closeWg   sync.WaitGroup
+}
+
+func (c *ctrlConn) getErr() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+func (c *ctrlConn) fail(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.pending = nil
+}
+
+func (c *ctrlConn) reader() {
+	defer c.closeWg.Done()
+	defer close(c.events)
+
+	for {
+		resp, err := c.conn.ReadResponse()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if resp.IsAsync() {
+			select {
+			case c.events <- resp:
+			case <-c.closeCh:
+				return
+			}
+			continue
+		}
+
+		c.Lock()
+		if len(c.pending) == 0 {
+			c.Unlock()
+			c.fail(fmt.Errorf("tor: unsolicited control port response: '%v'", resp.Reply))
+			c.conn.Close()
+			return
+		}
+		ch := c.pending[0]
+		c.pending = c.pending[1:]
+		c.Unlock()
+
+		// Buffered, so this never blocks even if the caller gave up.
+		ch <- resp
+	}
+}
+
+// Request issues a control port command, and waits for the response or
+// for ctx to be done.  Canceling a request does not cancel the command,
+// the response is discarded when it arrives.
+func (c *ctrlConn) Request(ctx context.Context, format string, args ...interface{}) (*bulb.Response, error) {
+	cmd := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(cmd, "\r\n") {
+		return nil, fmt.Errorf("tor: control port command contains a newline")
+	}
+
+	ch := make(chan *bulb.Response, 1)
+
+	c.wrLock.Lock()
+	c.Lock()
+	if err := c.err; err != nil {
+		c.Unlock()
+		c.wrLock.Unlock()
+		return nil, err
+	}
+	c.pending = append(c.pending, ch)
+	c.Unlock()
+	_, err := c.conn.Write([]byte(cmd + "\r\n"))
+	c.wrLock.Unlock()
+	if err != nil {
+		c.fail(err)
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.getErr()
+		}
+		if resp.IsOk() {
+			return resp, nil
+		}
+		return resp, resp.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetInfo issues a GETINFO command, and returns the values keyed by name.
+// Multi-line values are returned with the lines separated by "\n".
+func (c *ctrlConn) GetInfo(ctx context.Context, keys ...string) (map[string]string, error) {
+	resp, err := c.Request(ctx, "GETINFO %s", strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	return torctl.ParseGetInfo(resp.RawLines)
+}
+
+// GetConf issues a GETCONF command, and returns the values keyed by name.
+// Options that are set to their default values will have no values.
+func (c *ctrlConn) GetConf(ctx context.Context, keys ...string) (map[string][]string, error) {
+	resp, err := c.Request(ctx, "GETCONF %s", strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	return torctl.ParseGetConf(resp.RawLines)
+}
+
+// NextEvent returns the next asynchronous event.
+func (c *ctrlConn) NextEvent() (*bulb.Response, error) {
+	resp, ok := <-c.events
+	if !ok {
+		if err := c.getErr(); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, errCtrlClosed
+	}
+	return resp, nil
+}
+
+// Close closes the control port connection, failing all outstanding
+// requests.
+func (c *ctrlConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closeCh) })
+	err := c.conn.Close()
+	c.closeWg.Wait()
+	c.fail(errCtrlClosed)
+	return err
+}
+
+// dialCtrl connects and authenticates to a tor control port, and returns the
+// connection and the tor version.
+func dialCtrl(network, addr, password, cookieFile string) (*ctrlConn, string, error) {
+	conn, err := bulb.Dial(network, addr)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = authenticate(conn, password, cookieFile); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	// Query the version while bulb still owns the connection.  Tor Browser
+	// doesn't use PROTOCOLINFO, but the control port surrogate should do
+	// the right thing when it does.
+	pi, err := conn.ProtocolInfo()
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	return newCtrlConn(conn), pi.TorVersion, nil
+}
+
+// newCtrlConn wraps an authenticated bulb connection.  bulb must not be
+// used to issue requests past this point.
+func newCtrlConn(conn *bulb.Conn) *ctrlConn {
+	c := &ctrlConn{
+		conn:    conn,
+		events:  make(chan *bulb.Response, maxCtrlEventBacklog),
+		closeCh: make(chan struct{}),
+	}
+	c.closeWg.Add(1)
+	go c.reader()
+	return c
+}
@@ -0,0 +1,196 @@
+// features.go - Optional tor feature detection and configuration.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/torctl"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	confluxEnabledOpt    = "ConfluxEnabled"
+	confluxLinkedPurpose = "PURPOSE=CONFLUX_LINKED"
+	argConfigNames       = "config/names"
+	argCircuitStatus     = "circuit-status"
+)
+
+// Congestion control was added in tor 0.4.7.x.  There is no client side
+// configuration, it is enabled as directed by the consensus.
+var congestionControlVersion = []int{0, 4, 7}
+
+// A custom tor binary must be at least as new as the oldest tor that the
+// launcher's torrc and control port usage were tested against.
+var customTorMinVersion = []int{0, 4, 8}
+
+const customTorMinVersionStr = "0.4.8"
+
+// Features is the status of the optional tor features that the launcher
+// knows about.
+type Features struct {
+	// Version is the tor version reported via PROTOCOLINFO.
+	Version string `json:"version"`
+
+	// ConfluxSupported is if tor supports conflux.
+	ConfluxSupported bool `json:"confluxSupported"`
+
+	// ConfluxEnabled is the value of the `ConfluxEnabled` option.
+	ConfluxEnabled string `json:"confluxEnabled,omitempty"`
+
+	// ConfluxLinked is the number of linked conflux circuits.
+	ConfluxLinked int `json:"confluxLinked"`
+
+	// CongestionControlSupported is if tor supports congestion control.
+	CongestionControlSupported bool `json:"congestionControlSupported"`
+}
+
+// String returns a human readable summary of the feature status.
+func (f *Features) String() string {
+	conflux := "unsupported"
+	if f.ConfluxSupported {
+		switch {
+		case f.ConfluxLinked > 0:
+			conflux = fmt.Sprintf("active (%d linked circuits)", f.ConfluxLinked)
+		case f.ConfluxEnabled == "0":
+			conflux = "disabled"
+		default:
+			conflux = "inactive"
+		}
+	}
+	cc := "unsupported"
+	if f.CongestionControlSupported {
+		cc = "supported"
+	}
+	return fmt.Sprintf("Tor %v, Conflux: %v, Congestion Control: %v", f.Version, conflux, cc)
+}
+
+// Features queries the status of the optional tor features.
+func (t *Tor) Features(ctx context.Context) (*Features, error) {
+	ctrl, err := t.getCtrl()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	f := &Features{Version: t.torVersion}
+	t.Unlock()
+
+	f.CongestionControlSupported = versionAtLeast(f.Version, congestionControlVersion)
+	if f.ConfluxSupported, err = hasConfOption(ctx, ctrl, confluxEnabledOpt); err != nil {
+		return nil, err
+	}
+	if !f.ConfluxSupported {
+		return f, nil
+	}
+
+	conf, err := ctrl.GetConf(ctx, confluxEnabledOpt)
+	if err != nil {
+		return nil, err
+	}
+	if v := conf[confluxEnabledOpt]; len(v) > 0 {
+		f.ConfluxEnabled = v[0]
+	}
+
+	info, err := ctrl.GetInfo(ctx, argCircuitStatus)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(info[argCircuitStatus], "\n") {
+		for _, v := range torctl.Split(l) {
+			if v == confluxLinkedPurpose {
+				f.ConfluxLinked++
+				break
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// applyFeatureConfig configures the optional tor features, prior to the
+// network being enabled.  Options that the tor instance does not support are
+// skipped, so that older tor binaries continue to work.
+func applyFeatureConfig(ctx context.Context, ctrl *ctrlConn, cfg *config.Config) error {
+	var v string
+	switch cfg.Tor.ConfluxMode {
+	case config.ConfluxEnabled:
+		v = "1"
+	case config.ConfluxDisabled:
+		v = "0"
+	default:
+		return nil
+	}
+
+	if ok, err := hasConfOption(ctx, ctrl, confluxEnabledOpt); err != nil {
+		return err
+	} else if !ok {
+		log.Printf("tor: Conflux is not supported, ignoring the configured mode.")
+		return nil
+	}
+
+	_, err := ctrl.Request(ctx, "SETCONF %s=%s", confluxEnabledOpt, v)
+	return err
+}
+
+func hasConfOption(ctx context.Context, ctrl *ctrlConn, opt string) (bool, error) {
+	info, err := ctrl.GetInfo(ctx, argConfigNames)
+	if err != nil {
+		return false, err
+	}
+
+	// Each line is of the form `OptionName Type [Documentation]`.
+	for _, l := range strings.Split(info[argConfigNames], "\n") {
+		if f := strings.Fields(l); len(f) > 0 && f[0] == opt {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// versionAtLeast returns true if the tor version string (eg:
+// `0.4.8.9 (git-...)`) is greater than or equal to the minimum version.
+func versionAtLeast(version string, min []int) bool {
+	f := strings.Fields(version)
+	if len(f) == 0 {
+		return false
+	}
+
+	// Strip off the status tag (eg: `-alpha`, `-dev`).
+	v := f[0]
+	if idx := strings.IndexByte(v, '-'); idx != -1 {
+		v = v[:idx]
+	}
+	split := strings.Split(v, ".")
+	for i, m := range min {
+		if i >= len(split) {
+			return false
+		}
+		n, err := strconv.Atoi(split[i])
+		if err != nil {
+			return false
+		}
+		if n != m {
+			return n > m
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+// isolation.go - SOCKS isolation credentials.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// isolationTag returns the random part of a SOCKS isolation credential.
+// With `IsolationSchemeProfile` the stored credential is reused, unless
+// regenerate is set, in which case a new one is generated and stored.
+func isolationTag(cfg *config.Config, regenerate bool) (string, error) {
+	isProfile := cfg.Tor.GetIsolationScheme() == config.IsolationSchemeProfile
+	if isProfile && !regenerate && cfg.Tor.IsolationTag != "" {
+		return cfg.Tor.IsolationTag, nil
+	}
+
+	var b [config.IsolationTagSize]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	tag := hex.EncodeToString(b[:])
+	if isProfile {
+		cfg.Tor.SetIsolationTag(tag)
+		if err := cfg.Sync(); err != nil {
+			return "", err
+		}
+	}
+	return tag, nil
+}
+
+// isolationCredential formats a SOCKS isolation credential.  Nothing that
+// identifies the launcher is included, unless the user asked for it via
+// `IsolationSchemePrefix`.
+func isolationCredential(cfg *config.Config, tag string) string {
+	if cfg.Tor.GetIsolationScheme() == config.IsolationSchemePrefix && cfg.Tor.IsolationPrefix != "" {
+		return cfg.Tor.IsolationPrefix + ":" + tag
+	}
+	return tag
+}
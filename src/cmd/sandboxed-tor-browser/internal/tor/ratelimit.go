@@ -0,0 +1,155 @@
+// ratelimit.go - Surrogate bandwidth limiting.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// rateLimitChunkSize is the largest write that is passed through a rate
+// limited connection at once, so that the traffic is reasonably smooth.
+const rateLimitChunkSize = 4096
+
+// tokenBucket is a token bucket rate limiter, that holds at most one second
+// worth of tokens.
+type tokenBucket struct {
+	sync.Mutex
+
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate != rate {
+		b.rate = rate
+		b.last = time.Time{}
+	}
+}
+
+// reserve takes n tokens from the bucket, and returns how long the caller
+// must wait before using them.  The bucket is allowed to go into debt, so
+// that concurrent callers are serviced in order.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	elapsed := now.Sub(b.last)
+	if b.last.IsZero() || elapsed >= time.Second {
+		b.tokens = b.rate
+	} else if elapsed > 0 {
+		b.tokens += int64(elapsed) * b.rate / int64(time.Second)
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+
+	b.tokens -= int64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * int64(time.Second) / b.rate)
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > rateLimitChunkSize {
+			n = rateLimitChunkSize
+		}
+
+		var delay time.Duration
+		now := time.Now()
+		for _, b := range w.buckets {
+			if d := b.reserve(n, now); d > delay {
+				delay = d
+			}
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		nn, err := w.w.Write(p[:n])
+		written += nn
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimiter is the bandwidth limit shared by the SOCKS surrogate and
+// passthrough.  The limits are re-read from the config each time a connection
+// is established, so changes apply to new connections without restarting
+// tor.
+type rateLimiter struct {
+	cfg *config.Config
+
+	up, down tokenBucket
+}
+
+// writers returns writers for each of the connections, that enforce the
+// configured limits.  Unlimited connections are returned as is.
+func (l *rateLimiter) writers(upConn, downConn net.Conn) (io.Writer, io.Writer) {
+	if l == nil {
+		return upConn, downConn
+	}
+
+	rate, connRate := l.cfg.Tor.GetBandwidthLimit(), l.cfg.Tor.GetConnBandwidthLimit()
+	l.up.setRate(rate)
+	l.down.setRate(rate)
+
+	return limitWriter(upConn, &l.up, rate, connRate), limitWriter(downConn, &l.down, rate, connRate)
+}
+
+func limitWriter(w io.Writer, global *tokenBucket, rate, connRate int64) io.Writer {
+	var buckets []*tokenBucket
+	if rate > 0 {
+		buckets = append(buckets, global)
+	}
+	if connRate > 0 {
+		buckets = append(buckets, &tokenBucket{rate: connRate})
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+	return &limitedWriter{w: w, buckets: buckets}
+}
+
+func newRateLimiter(cfg *config.Config) *rateLimiter {
+	return &rateLimiter{cfg: cfg}
+}
@@ -0,0 +1,145 @@
+// selftest.go - SOCKS surrogate self test.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"cmd/sandboxed-tor-browser/internal/socks5"
+)
+
+const (
+	// selfTestHost is the hostname that the SOCKS surrogate answers itself,
+	// instead of passing the request to tor.  `.invalid` is reserved
+	// (RFC 2606), so it will never collide with a real destination.
+	selfTestHost    = "check.sandboxed-tor-browser.invalid"
+	selfTestBody    = `{"IsTor":true}`
+	selfTestTimeout = 10 * time.Second
+)
+
+func isSelfTestHost(req *socks5.Request) bool {
+	host, _ := req.Addr.HostPort()
+	return strings.ToLower(host) == selfTestHost
+}
+
+// isSelfTestRequest returns true iff the request is for the self test
+// hostname, and uses the launcher's credential, so that the surrogate only
+// answers the launcher itself, and not content within Tor Browser.
+func isSelfTestRequest(req *socks5.Request, auth *proxy.Auth) bool {
+	if auth == nil || !isSelfTestHost(req) {
+		return false
+	}
+	uname, passwd := req.Auth.Uname, req.Auth.Passwd
+	return subtle.ConstantTimeCompare(uname, []byte(auth.User)) == 1 && subtle.ConstantTimeCompare(passwd, []byte(auth.Password)) == 1
+}
+
+// serveSelfTest answers a self test request with a minimal
+// check.torproject.org API equivalent response.
+func serveSelfTest(conn net.Conn, req *socks5.Request) {
+	if err := req.Reply(socks5.ReplySucceeded); err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(selfTestTimeout))
+	httpReq, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	httpReq.Body.Close()
+
+	resp := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(selfTestBody), selfTestBody)
+	conn.Write([]byte(resp))
+}
+
+// SelfTest connects to the SOCKS surrogate the same way that Tor Browser
+// does, and requests the self test hostname, to verify the browser's path
+// to tor end to end.  The surrogate answers the request itself, so this
+// additionally checks that tor has a circuit established.
+func (t *Tor) SelfTest() error {
+	t.Lock()
+	var sPath string
+	if t.socksSurrogate != nil {
+		sPath = t.socksSurrogate.sPath
+	}
+	auth := t.dialerAuth
+	t.Unlock()
+	if sPath == "" {
+		return ErrTorNotRunning
+	}
+
+	// The surrogate only answers the self test when the launcher's own
+	// credential is used.
+	if auth == nil {
+		return ErrTorNotRunning
+	}
+	dialer, err := proxy.SOCKS5("unix", sPath, auth, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(selfTestHost, "80"))
+	if err != nil {
+		return fmt.Errorf("failed to connect via the SOCKS surrogate: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	httpReq, err := http.NewRequest("GET", "http://"+selfTestHost+"/api/ip", nil)
+	if err != nil {
+		return err
+	}
+	if err = httpReq.Write(conn); err != nil {
+		return fmt.Errorf("failed to send the self test request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to read the self test response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the self test response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != selfTestBody {
+		return fmt.Errorf("unexpected self test response: %v", resp.Status)
+	}
+
+	// The surrogate works, so check that tor is actually usable.
+	ctrl, err := t.getCtrl()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	info, err := ctrl.GetInfo(ctx, "status/circuit-established")
+	if err != nil {
+		return err
+	}
+	if info["status/circuit-established"] != "1" {
+		return fmt.Errorf("tor does not have a circuit established")
+	}
+	return nil
+}
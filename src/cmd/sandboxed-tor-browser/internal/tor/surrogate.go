@@ -20,8 +20,7 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -33,7 +32,11 @@ import (
 	"strings"
 	"sync"
 
+	"golang.org/x/net/proxy"
+
+	"cmd/sandboxed-tor-browser/internal/policy"
 	"cmd/sandboxed-tor-browser/internal/socks5"
+	"cmd/sandboxed-tor-browser/internal/torctl"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
 )
 
@@ -46,6 +49,8 @@ const (
 	cmdQuit          = "QUIT"
 	cmdGetinfo       = "GETINFO"
 	cmdGetconf       = "GETCONF"
+	cmdSetconf       = "SETCONF"
+	cmdResetconf     = "RESETCONF"
 	cmdSignal        = "SIGNAL"
 	cmdSetEvents     = "SETEVENTS"
 
@@ -57,6 +62,7 @@ const (
 	errAuthenticationRequired = "514 Authentication required" + crLf
 	errUnrecognizedCommand    = "510 Unrecognized command" + crLf
 	errUnspecifiedTor         = "550 Unspecified Tor error" + crLf
+	errCircuitDisplay         = "551 Circuit display unavailable" + crLf
 
 	// These responses are entirely synthetic so they don't matter.
 	socksAddr = "127.0.0.1:9150"
@@ -64,23 +70,24 @@ const (
 	aboutAddonsUnsafeHost = "discovery.addons.mozilla.org"
 )
 
-func copyLoop(upConn, downConn net.Conn) {
+func copyLoop(upConn, downConn net.Conn, limiter *rateLimiter) {
 	errChan := make(chan error, 2)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	cpFn := func(a, b net.Conn) {
+	cpFn := func(a, b net.Conn, w io.Writer) {
 		defer wg.Done()
 		defer a.Close()
 		defer b.Close()
 
-		_, err := io.Copy(a, b)
+		_, err := io.Copy(w, b)
 		errChan <- err
 	}
 
-	go cpFn(upConn, downConn)
-	go cpFn(downConn, upConn)
+	upW, downW := limiter.writers(upConn, downConn)
+	go cpFn(upConn, downConn, upW)
+	go cpFn(downConn, upConn, downW)
 
 	wg.Wait()
 }
@@ -88,6 +95,7 @@ func copyLoop(upConn, downConn net.Conn) {
 type passthroughProxy struct {
 	sNet, sAddr string
 	l           net.Listener
+	limiter     *rateLimiter
 }
 
 func (p *passthroughProxy) close() {
@@ -114,14 +122,19 @@ func (p *passthroughProxy) acceptLoop() {
 			}
 			defer downConn.Close()
 
-			copyLoop(conn, downConn)
+			copyLoop(conn, downConn, p.limiter)
 		}()
 	}
 }
 
-func launchPassthroughProxy(hostNet, hostAddr, destNet, destAddr string) (*passthroughProxy, error) {
+func launchPassthroughProxy(hostNet, hostAddr, destNet, destAddr string, limiter *rateLimiter) (*passthroughProxy, error) {
 	p := new(passthroughProxy)
 	p.sNet, p.sAddr = destNet, destAddr
+	p.limiter = limiter
+
+	if hostNet == "unix" && !strings.HasPrefix(hostAddr, "@") {
+		os.Remove(hostAddr)
+	}
 
 	var err error
 	p.l, err = net.Listen(hostNet, hostAddr)
@@ -137,7 +150,14 @@ type socksProxy struct {
 	sync.RWMutex
 	sPath       string
 	sNet, sAddr string
+	cfg         *config.Config
 	tag         string
+	persistent  bool
+	limiter     *rateLimiter
+
+	// selfTestAuth is the launcher's credential, required for the self
+	// test request to be answered.
+	selfTestAuth *proxy.Auth
 
 	l net.Listener
 }
@@ -150,11 +170,38 @@ func (p *socksProxy) newTag() error {
 	p.Lock()
 	defer p.Unlock()
 
-	var b [16]byte
-	if _, err := rand.Read(b[:]); err != nil {
+	// Persistent containers keep their credential across New Identity,
+	// since NEWNYM already stops tor from reusing the old circuits.
+	if p.persistent {
+		return nil
+	}
+
+	tag, err := isolationTag(p.cfg, true)
+	if err != nil {
+		return err
+	}
+	p.tag = isolationCredential(p.cfg, tag)
+
+	return nil
+}
+
+// setContainer switches to the isolation credential of the container, or to
+// the default credential if the container is nil or not persistent.
+func (p *socksProxy) setContainer(c *config.Container) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.persistent = c != nil && c.Persistent
+	if p.persistent {
+		p.tag = isolationCredential(p.cfg, c.Tag)
+		return nil
+	}
+
+	tag, err := isolationTag(p.cfg, false)
+	if err != nil {
 		return err
 	}
-	p.tag = "sandboxed-tor-browser:" + hex.EncodeToString(b[:])
+	p.tag = isolationCredential(p.cfg, tag)
 
 	return nil
 }
@@ -190,6 +237,16 @@ func (p *socksProxy) handleConn(conn net.Conn) {
 		return
 	}
 
+	// The launcher's self test is answered locally, and anything else
+	// for the self test hostname is refused, as it will never resolve.
+	if isSelfTestRequest(req, p.selfTestAuth) {
+		serveSelfTest(conn, req)
+		return
+	} else if isSelfTestHost(req) {
+		req.Reply(socks5.ReplyHostUnreachable)
+		return
+	}
+
 	// Append our isolation tag.
 	if err := p.rewriteTag(conn, req); err != nil {
 		req.Reply(socks5.ReplyGeneralFailure)
@@ -209,7 +266,7 @@ func (p *socksProxy) handleConn(conn net.Conn) {
 		return
 	}
 
-	copyLoop(upConn, conn)
+	copyLoop(upConn, conn, p.limiter)
 }
 
 func (p *socksProxy) rewriteTag(conn net.Conn, req *socks5.Request) error {
@@ -229,9 +286,14 @@ func (p *socksProxy) rewriteTag(conn net.Conn, req *socks5.Request) error {
 	return nil
 }
 
-func launchSocksProxy(cfg *config.Config, tor *Tor) (*socksProxy, error) {
+func launchSocksProxy(cfg *config.Config, tor *Tor, limiter *rateLimiter) (*socksProxy, error) {
 	p := new(socksProxy)
-	if err := p.newTag(); err != nil {
+	p.cfg = cfg
+	p.limiter = limiter
+	tor.Lock()
+	p.selfTestAuth = tor.dialerAuth
+	tor.Unlock()
+	if err := tor.setContainer(cfg, p); err != nil {
 		return nil, err
 	}
 
@@ -241,7 +303,7 @@ func launchSocksProxy(cfg *config.Config, tor *Tor) (*socksProxy, error) {
 		return nil, err
 	}
 
-	p.sPath = filepath.Join(cfg.RuntimeDir, "socks")
+	p.sPath = filepath.Join(cfg.RuntimeDir, cfg.TorSocketName(socksSocket))
 	os.Remove(p.sPath)
 	p.l, err = net.Listen("unix", p.sPath)
 	if err != nil {
@@ -276,9 +338,12 @@ func (c *ctrlProxyConn) appConnReadLine() (cmd string, splitCmd []string, rawLin
 		return
 	}
 
+	// Quoted arguments (eg: `SETCONF Key="a b"`) are a single field.
 	trimmedLine := bytes.TrimSpace(rawLine)
-	splitCmd = strings.Split(string(trimmedLine), " ")
-	cmd = strings.ToUpper(strings.TrimSpace(splitCmd[0]))
+	if splitCmd = torctl.Split(string(trimmedLine)); len(splitCmd) == 0 {
+		splitCmd = []string{""}
+	}
+	cmd = strings.ToUpper(splitCmd[0])
 	return
 }
 
@@ -339,8 +404,20 @@ func (c *ctrlProxyConn) proxyAndFilerApp() {
 			err = c.onCmdSetEvents(splitCmd, raw)
 		case cmdGetconf:
 			err = c.onCmdGetconf(splitCmd, raw)
+		case cmdSetconf, cmdResetconf:
+			err = c.onCmdSetconf(splitCmd, raw)
 		default:
-			err = c.sendErrUnrecognizedCommand()
+			// The rest are only handled if the ruleset allows it, as
+			// needed by the built-in bootstrap (`about:torconnect`) of
+			// newer Tor Browser releases.
+			switch {
+			case containsFold(c.p.rules.Acknowledge, cmd):
+				_, err = c.appConnWrite([]byte(responseOk))
+			case containsFold(c.p.rules.Passthrough, cmd):
+				err = c.onCmdPassthrough(raw)
+			default:
+				err = c.sendErrUnrecognizedCommand()
+			}
 		}
 		if err != nil {
 			break
@@ -392,42 +469,85 @@ func (c *ctrlProxyConn) onCmdProtocolInfo(splitCmd []string) error {
 	return err
 }
 
+// getinfoRule is how the control port surrogate handles a GETINFO key.
+type getinfoRule struct {
+	// key is the key, or if it ends in `/`, the key prefix.
+	key string
+
+	// synthetic returns the value of a synthetic key.  If nil, the query is
+	// passed through to tor.
+	synthetic func(c *ctrlProxyConn) string
+
+	// needsCircuitDisplay is set if the key is only handled when the
+	// circuit display is enabled.
+	needsCircuitDisplay bool
+}
+
+// getinfoRules is the set of GETINFO keys that the surrogate handles, all
+// others are rejected.  Only read-only keys that do not leak anything about
+// the host or tor's configuration belong here.
+var getinfoRules = []*getinfoRule{
+	// Tor Browser.
+	{key: "net/listeners/socks", synthetic: func(c *ctrlProxyConn) string { return c.p.tor.socksListener() }},
+	{key: "version", synthetic: func(c *ctrlProxyConn) string { return c.p.torVersion }},
+
+	// Torbutton at startup.  The config file paths are sanitized, since the
+	// launcher manages the config.
+	{key: "config/names"},
+	{key: "config/defaults"},
+	{key: "config-file", synthetic: func(c *ctrlProxyConn) string { return "" }},
+	{key: "config-defaults-file", synthetic: func(c *ctrlProxyConn) string { return "" }},
+
+	// The circuit display.
+	//
+	// ns/id and ip-to-country *could* filter the relevant results to those
+	// that are actually part of circuits that the user has, but that seems
+	// overly paranoid, and ironically leaks more information.
+	{key: "circuit-status", needsCircuitDisplay: true},
+	{key: "ns/id/", needsCircuitDisplay: true},
+	{key: "ip-to-country/", needsCircuitDisplay: true},
+}
+
+func (p *ctrlProxy) findGetinfoRule(key string) *getinfoRule {
+	for _, r := range p.getinfoRules {
+		if r.key == key || (strings.HasSuffix(r.key, "/") && strings.HasPrefix(key, r.key) && len(key) > len(r.key)) {
+			return r
+		}
+	}
+	return nil
+}
+
 func (c *ctrlProxyConn) onCmdGetinfo(splitCmd []string, raw []byte) error {
-	const (
-		argGetinfoSocks          = "net/listeners/socks"
-		argGetinfoCircuitStatus  = "circuit-status"
-		prefixGetinfoNsId        = "ns/id/"
-		prefixGetinfoIpToCountry = "ip-to-country/"
-	)
 	if len(splitCmd) != 2 {
 		return c.sendErrUnexpectedArgCount(cmdGetinfo, 2, len(splitCmd))
 	}
 
-	if c.p.circuitMonitorEnabled && (strings.HasPrefix(splitCmd[1], prefixGetinfoNsId) || strings.HasPrefix(splitCmd[1], prefixGetinfoIpToCountry)) {
-		// This *could* filter the relevant results to those that are actually
-		// part of circuits that the user has, but that seems overly paranoid,
-		// and ironically leaks more information.
-		if resp, _ := c.p.tor.getinfo(splitCmd[1]); resp != nil {
-			respStr := strings.Join(resp.RawLines, crLf) + crLf
-			_, err := c.appConnWrite([]byte(respStr))
-			return err
-		}
-		return c.sendErrUnspecifiedTor()
+	key := splitCmd[1]
+	r := c.p.findGetinfoRule(key)
+	if r == nil || (r.needsCircuitDisplay && !c.p.circuitMonitorEnabled) {
+		respStr := "552 Unrecognized key \"" + key + "\"" + crLf
+		_, err := c.appConnWrite([]byte(respStr))
+		return err
 	}
 
-	// Handle the synthetic responses.
-	respStr := "552 Unrecognized key \"" + splitCmd[1] + "\"" + crLf
-	switch splitCmd[1] {
-	case argGetinfoSocks:
-		respStr = "250-" + argGetinfoSocks + "=\"" + socksAddr + "\"" + crLf + responseOk
-	case argGetinfoCircuitStatus:
-		if !c.p.circuitMonitorEnabled {
-			break
-		}
+	var respStr string
+	switch {
+	case key == argCircuitStatus && !c.p.circuitMonitor.isAvailable():
+		respStr = errCircuitDisplay
+	case key == argCircuitStatus:
+		// Synthetic, filtered to the circuits that Tor Browser created.
 		respVec := []string{responseCircuitStatus}
 		respVec = append(respVec, c.p.circuitMonitor.getCircuitStatus()...)
 		respVec = append(respVec, ".", responseOk)
 		respStr = strings.Join(respVec, crLf)
+	case r.synthetic != nil:
+		respStr = "250-" + key + "=" + r.synthetic(c) + crLf + responseOk
+	default:
+		resp, _ := c.p.tor.getinfo(context.Background(), key)
+		if resp == nil {
+			return c.sendErrUnspecifiedTor()
+		}
+		respStr = strings.Join(resp.RawLines, crLf) + crLf
 	}
 	_, err := c.appConnWrite([]byte(respStr))
 	return err
@@ -440,19 +560,65 @@ func (c *ctrlProxyConn) onCmdGetconf(splitCmd []string, raw []byte) error {
 	}
 
 	if strings.ToUpper(splitCmd[1]) == argBridge && c.p.circuitMonitorEnabled {
-		if resp, _ := c.p.tor.getconf(splitCmd[1]); resp != nil {
+		if resp, _ := c.p.tor.getconf(context.Background(), splitCmd[1]); resp != nil {
 			respStr := strings.Join(resp.RawLines, crLf) + crLf
 			_, err := c.appConnWrite([]byte(respStr))
 			return err
 		}
 		return c.sendErrUnspecifiedTor()
 	}
+	for k, v := range c.p.rules.GetConf {
+		if strings.EqualFold(k, splitCmd[1]) {
+			// Unset options are returned without a value.
+			respStr := "250 " + k
+			if v != "" {
+				respStr += "=" + v
+			}
+			_, err := c.appConnWrite([]byte(respStr + crLf))
+			return err
+		}
+	}
 
 	respStr := "552 Unrecognized configuration key \"" + splitCmd[1] + "\"" + crLf
 	_, err := c.appConnWrite([]byte(respStr))
 	return err
 }
 
+func (c *ctrlProxyConn) onCmdSetconf(splitCmd []string, raw []byte) error {
+	// The launcher owns tor's configuration, so the permitted keys are
+	// only acknowledged.  Tor Browser just wants the network enabled, and
+	// tor is already bootstrapped by the time it starts.
+	if len(splitCmd) < 2 {
+		return c.sendErrUnexpectedArgCount(splitCmd[0], 2, len(splitCmd))
+	}
+	for _, v := range splitCmd[1:] {
+		key := strings.SplitN(v, "=", 2)[0]
+		if !containsFold(c.p.rules.SetConf, key) {
+			respStr := "552 Unrecognized option: Unknown option '" + key + "'" + crLf
+			_, err := c.appConnWrite([]byte(respStr))
+			return err
+		}
+	}
+	_, err := c.appConnWrite([]byte(responseOk))
+	return err
+}
+
+func (c *ctrlProxyConn) onCmdPassthrough(raw []byte) error {
+	// Only single line commands are passed through, so a stray CR can't be
+	// used to smuggle a second command to tor.
+	line := bytes.TrimSpace(raw)
+	if bytes.ContainsAny(line, "\r\n") {
+		return c.sendErrUnrecognizedCommand()
+	}
+	resp, _ := c.p.tor.request(context.Background(), "%s", line)
+	if resp == nil {
+		return c.sendErrUnspecifiedTor()
+	}
+	respStr := strings.Join(resp.RawLines, crLf) + crLf
+	_, err := c.appConnWrite([]byte(respStr))
+	return err
+}
+
 func (c *ctrlProxyConn) onCmdSignal(splitCmd []string, raw []byte) error {
 	const argSignalNewnym = "NEWNYM"
 	if len(splitCmd) != 2 {
@@ -474,27 +640,43 @@ func (c *ctrlProxyConn) onCmdSignal(splitCmd []string, raw []byte) error {
 }
 
 func (c *ctrlProxyConn) onCmdSetEvents(splitCmd []string, raw []byte) error {
-	if !c.p.circuitMonitorEnabled {
-		return c.sendErrUnrecognizedCommand()
+	// The circuit display uses "SETEVENTS STREAM", which is the only event
+	// that is actually delivered.  The bootstrap status events that newer
+	// Tor Browser releases subscribe to are accepted if the ruleset allows
+	// it, since tor has finished bootstrapping before the browser starts.
+	wantStream := false
+	for _, v := range splitCmd[1:] {
+		switch {
+		case strings.ToUpper(v) == eventStream && c.p.circuitMonitorEnabled:
+			wantStream = true
+		case containsFold(c.p.rules.Events, v):
+		default:
+			respStr := "552 Unrecognized event \"" + v + "\"" + crLf
+			_, err := c.appConnWrite([]byte(respStr))
+			return err
+		}
 	}
 
-	if len(splitCmd) == 1 {
-		c.p.circuitMonitor.deregister(c)
-		_, err := c.appConnWrite([]byte(responseOk))
-		return err
-	} else if len(splitCmd) != 2 {
-		// Tor Browser only uses "SETEVENTS STREAM" AFAIK.
-		return c.sendErrUnexpectedArgCount(cmdSignal, 2, len(splitCmd))
-	} else if strings.ToUpper(splitCmd[1]) != eventStream {
-		respStr := "552 Unrecognized event \"" + splitCmd[1] + "\"" + crLf
-		_, err := c.appConnWrite([]byte(respStr))
-		return err
+	if c.p.circuitMonitorEnabled {
+		if wantStream {
+			c.p.circuitMonitor.register(c)
+		} else {
+			c.p.circuitMonitor.deregister(c)
+		}
 	}
-	c.p.circuitMonitor.register(c)
 	_, err := c.appConnWrite([]byte(responseOk))
 	return err
 }
 
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *ctrlProxyConn) handle() {
 	defer c.appConn.Close()
 
@@ -516,6 +698,9 @@ type ctrlProxy struct {
 	circuitMonitorEnabled bool
 	circuitMonitor        *circuitMonitor
 
+	rules        *policy.ControlRules
+	getinfoRules []*getinfoRule
+
 	l net.Listener
 }
 
@@ -553,17 +738,20 @@ func launchCtrlProxy(cfg *config.Config, tor *Tor) (*ctrlProxy, error) {
 	p.socks = tor.socksSurrogate
 	p.tor = tor
 
-	// Save the real tor version.  Tor Browser doesn't use PROTOCOLINFO,
-	// but we should do the right thing when it does, and this query is
-	// serviced entirely from bulb's internal cache.
-	if pi, err := p.tor.ctrl.ProtocolInfo(); err != nil {
+	// Save the real tor version, queried when the control port connection
+	// was established.
+	p.torVersion = tor.torVersion
+
+	var err error
+	if p.rules, err = policy.Control(); err != nil {
 		return nil, err
-	} else {
-		p.torVersion = pi.TorVersion
+	}
+	p.getinfoRules = append(p.getinfoRules, getinfoRules...)
+	for _, k := range p.rules.GetInfo {
+		p.getinfoRules = append(p.getinfoRules, &getinfoRule{key: k})
 	}
 
-	var err error
-	p.cPath = filepath.Join(cfg.RuntimeDir, "control")
+	p.cPath = filepath.Join(cfg.RuntimeDir, cfg.TorSocketName(ctrlSocket))
 	os.Remove(p.cPath)
 	p.l, err = net.Listen("unix", p.cPath)
 	if err != nil {
@@ -19,6 +19,7 @@ package tor
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -26,27 +27,43 @@ import (
 	"io/ioutil"
 	"log"
 	mrand "math/rand"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"unicode"
 
 	"git.schwanenlied.me/yawning/bulb.git"
 	"golang.org/x/crypto/openpgp/s2k"
 	"golang.org/x/net/proxy"
 
-	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/policy"
 	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/torctl"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
-// ErrTorNotRunning is the error returned when the tor is not running.
-var ErrTorNotRunning = errors.New("tor not running")
+var (
+	// ErrTorNotRunning is the error returned when the tor is not running.
+	ErrTorNotRunning = errors.New("tor not running")
+
+	// ErrTorCrashed is the error returned when the tor process exits
+	// while being waited on.
+	ErrTorCrashed = errors.New("tor process appears to have crashed.")
+
+	// ErrCtrlPortTimeout is the error returned when tor fails to open the
+	// control port in a timely manner.
+	ErrCtrlPortTimeout = errors.New("tor: timeout waiting for the control port")
+
+	// ErrCustomTorTooOld is the error returned when the configured custom
+	// tor binary is older than the minimum supported version.
+	ErrCustomTorTooOld = errors.New("tor: custom tor version is older than the minimum supported (" + customTorMinVersionStr + ")")
+)
 
 // Tor is a tor instance.
 type Tor struct {
@@ -56,46 +73,105 @@ type Tor struct {
 	isBootstrapped bool
 
 	process    *process.Process
-	ctrl       *bulb.Conn
+	ctrl       *ctrlConn
 	ctrlEvents chan *bulb.Response
+	torVersion string
+
+	bootstrapHook func(*BootstrapStatus)
 
 	socksNet  string
 	socksAddr string
+	ctrlNet   string
 	ctrlAddr  string
 
+	// The system tor control port credentials, for reconnecting.
+	ctrlPassword   string
+	ctrlCookieFile string
+
+	// ctrlStateHook is called when the control port connection is lost,
+	// and when it is re-established.
+	ctrlStateHook func(connected bool)
+
+	isShutdown bool
+	shutdownCh chan struct{}
+
+	// socksListenerPath is the path of the SOCKS surrogate inside the
+	// sandbox, if Tor Browser uses it directly instead of via TCP.
+	socksListenerPath string
+
 	ctrlSurrogate    *ctrlProxy
 	socksSurrogate   *socksProxy
 	socksPassthrough *passthroughProxy
 
+	// dialerAuth is the isolation credential used by Dialer.
+	dialerAuth *proxy.Auth
+
 	unlinkOnExit []string
 }
 
+// SetSocksListenerPath sets the in-sandbox path of the SOCKS surrogate to be
+// reported via the control port surrogate's `net/listeners/socks`.  If path
+// is empty, the fake TCP listener is reported instead.
+func (t *Tor) SetSocksListenerPath(path string) {
+	t.Lock()
+	defer t.Unlock()
+	t.socksListenerPath = path
+}
+
+func (t *Tor) socksListener() string {
+	t.Lock()
+	defer t.Unlock()
+	if t.socksListenerPath != "" {
+		// Tor escapes the entire listener, not just the path.
+		return strconv.Quote("unix:" + t.socksListenerPath)
+	}
+	return strconv.Quote(socksAddr)
+}
+
 // IsSystem returns if the tor instance is a OS service not being actively
 // managed by the app.
 func (t *Tor) IsSystem() bool {
 	return t.isSystem
 }
 
+// IsRunning returns if the sandboxed tor instance is bootstrapped, and the
+// process is still alive.
+func (t *Tor) IsRunning() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.isSystem || t.process == nil || t.ctrl == nil {
+		return false
+	}
+	return t.isBootstrapped && t.process.Running()
+}
+
 // Dialer returns a proxy.Dialer configured to use the Socks port with the
-// generic `sandboxed-tor-browser:isolation:pid` isolation settings.
+// launcher's own isolation credential.
 func (t *Tor) Dialer() (proxy.Dialer, error) {
-	net, addr, err := t.SocksPort()
+	net, addr, auth, err := t.DialerParams()
 	if err != nil {
 		return nil, err
 	}
 
+	return proxy.SOCKS5(net, addr, auth, proxy.Direct)
+}
+
+// DialerParams returns the SocksPort and isolation credential used by
+// Dialer, for dialing from another process.
+func (t *Tor) DialerParams() (net, addr string, auth *proxy.Auth, err error) {
+	if net, addr, err = t.SocksPort(); err != nil {
+		return "", "", nil, err
+	}
+
 	t.Lock()
 	defer t.Unlock()
 
-	if t.ctrl == nil {
-		return nil, ErrTorNotRunning
-	}
-	auth := &proxy.Auth{
-		User:     "sandboxed-tor-bowser",
-		Password: "isolation:" + strconv.Itoa(os.Getpid()),
+	if t.ctrl == nil || t.dialerAuth == nil {
+		return "", "", nil, ErrTorNotRunning
 	}
 
-	return proxy.SOCKS5(net, addr, auth, proxy.Direct)
+	return net, addr, t.dialerAuth, nil
 }
 
 // SocksPort returns the SocksPort associated with the tor instance.
@@ -107,40 +183,69 @@ func (t *Tor) SocksPort() (net, addr string, err error) {
 		return "", "", ErrTorNotRunning
 	}
 	if t.socksNet == "" && t.socksAddr == "" {
-		t.socksNet, t.socksAddr, err = t.ctrl.SocksPort()
+		t.socksNet, t.socksAddr, err = querySocksPort(t.ctrl)
 	}
 	return t.socksNet, t.socksAddr, err
 }
 
-func (t *Tor) newnym() error {
-	t.Lock()
-	defer t.Unlock()
+func querySocksPort(ctrl *ctrlConn) (net, addr string, err error) {
+	const (
+		socksListeners = "net/listeners/socks"
+		unixPrefix     = "unix:"
+	)
 
-	if t.ctrl == nil {
-		return ErrTorNotRunning
+	info, err := ctrl.GetInfo(context.Background(), socksListeners)
+	if err != nil {
+		return "", "", err
 	}
-	_, err := t.ctrl.Request("SIGNAL NEWNYM")
-	return err
-}
 
-func (t *Tor) getinfo(arg string) (*bulb.Response, error) {
-	t.Lock()
-	defer t.Unlock()
+	// The first listener is used, and all entries are QuotedStrings.
+	listeners := torctl.Split(info[socksListeners])
+	if len(listeners) < 1 {
+		return "", "", fmt.Errorf("tor: no SOCKS listeners configured")
+	}
+	laddr, err := torctl.Unquote(listeners[0])
+	if err != nil {
+		return "", "", fmt.Errorf("tor: failed to parse SOCKS listener: %v", err)
+	}
 
-	if t.ctrl == nil {
-		return nil, ErrTorNotRunning
+	if strings.HasPrefix(laddr, unixPrefix) {
+		return "unix", strings.TrimPrefix(laddr, unixPrefix), nil
 	}
-	return t.ctrl.Request("GETINFO %s", arg)
+	return "tcp", laddr, nil
 }
 
-func (t *Tor) getconf(arg string) (*bulb.Response, error) {
+// getCtrl returns the control port connection.  The Tor lock is not held
+// while requests are in flight, so concurrent callers don't block each other.
+func (t *Tor) getCtrl() (*ctrlConn, error) {
 	t.Lock()
 	defer t.Unlock()
 
 	if t.ctrl == nil {
 		return nil, ErrTorNotRunning
 	}
-	return t.ctrl.Request("GETCONF %s", arg)
+	return t.ctrl, nil
+}
+
+func (t *Tor) request(ctx context.Context, format string, args ...interface{}) (*bulb.Response, error) {
+	ctrl, err := t.getCtrl()
+	if err != nil {
+		return nil, err
+	}
+	return ctrl.Request(ctx, format, args...)
+}
+
+func (t *Tor) newnym() error {
+	_, err := t.request(context.Background(), "SIGNAL NEWNYM")
+	return err
+}
+
+func (t *Tor) getinfo(ctx context.Context, arg string) (*bulb.Response, error) {
+	return t.request(ctx, "GETINFO %s", arg)
+}
+
+func (t *Tor) getconf(ctx context.Context, arg string) (*bulb.Response, error) {
+	return t.request(ctx, "GETCONF %s", arg)
 }
 
 // Shutdown attempts to gracefully clean up the Tor instance.  If it is a
@@ -150,11 +255,18 @@ func (t *Tor) Shutdown() {
 	t.Lock()
 	defer t.Unlock()
 
+	if !t.isShutdown {
+		t.isShutdown = true
+		close(t.shutdownCh)
+	}
+
 	sentHalt := false
 	if t.ctrl != nil {
 		// Try to gracefully terminate the daemon via the control port.
 		if !t.isSystem {
-			t.ctrl.Request("SIGNAL HALT")
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.ctrl.Request(ctx, "SIGNAL HALT")
+			cancel()
 			sentHalt = true
 		}
 		t.ctrl.Close()
@@ -208,6 +320,12 @@ func (t *Tor) Shutdown() {
 	}
 }
 
+func (t *Tor) setCtrlStateHook(fn func(connected bool)) {
+	t.Lock()
+	defer t.Unlock()
+	t.ctrlStateHook = fn
+}
+
 // SocksSurrogatePath returns the socks port surrogate AF_UNIX path.
 func (t *Tor) SocksSurrogatePath() string {
 	return t.socksSurrogate.sPath
@@ -218,9 +336,47 @@ func (t *Tor) CtrlSurrogatePath() string {
 	return t.ctrlSurrogate.cPath
 }
 
+// SetContainer switches the SOCKS isolation credential used by Tor Browser to
+// that of the configured container, generating the credential of persistent
+// containers that lack one.
+func (t *Tor) SetContainer(cfg *config.Config) error {
+	return t.setContainer(cfg, t.socksSurrogate)
+}
+
+func (t *Tor) setContainer(cfg *config.Config, p *socksProxy) error {
+	c := cfg.Tor.GetContainer()
+	if c != nil && c.Persistent && c.Tag == "" {
+		var b [config.ContainerTagSize]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		cfg.Tor.SetContainerTag(c.Name, hex.EncodeToString(b[:]))
+		if err := cfg.Sync(); err != nil {
+			return err
+		}
+	}
+	if c != nil {
+		log.Printf("tor: Using the '%v' isolation container.", c.Name)
+	}
+	return p.setContainer(c)
+}
+
 func (t *Tor) launchSurrogates(cfg *config.Config) error {
-	var err error
-	if t.socksSurrogate, err = launchSocksProxy(cfg, t); err != nil {
+	// The launcher's own traffic gets a credential distinct from anything
+	// Tor Browser will use, since Tor Browser always sets the username to
+	// the first party domain.
+	tag, err := isolationTag(cfg, false)
+	if err != nil {
+		return err
+	}
+	cred := isolationCredential(cfg, tag)
+	t.Lock()
+	t.dialerAuth = &proxy.Auth{User: cred, Password: cred}
+	t.Unlock()
+
+	// The SOCKS surrogate and passthrough share the total bandwidth limit.
+	limiter := newRateLimiter(cfg)
+	if t.socksSurrogate, err = launchSocksProxy(cfg, t, limiter); err != nil {
 		return err
 	}
 
@@ -230,56 +386,135 @@ func (t *Tor) launchSurrogates(cfg *config.Config) error {
 	}
 
 	if !t.IsSystem() {
-		const passthroughAddr = "127.0.0.1:9150"
-
-		tNet, tAddr, _ := t.SocksPort()
-		t.socksPassthrough, err = launchPassthroughProxy("tcp", passthroughAddr, tNet, tAddr)
-		if err != nil {
-			log.Printf("tor: Failed to open SOCKS passthrough listener: %v", err)
-		} else {
-			log.Printf("tor: Opened SOCKS passthrough listener: %v", passthroughAddr)
+		if hNet, hAddr := socksPassthroughAddr(cfg); hNet != "" {
+			tNet, tAddr, _ := t.SocksPort()
+			t.socksPassthrough, err = launchPassthroughProxy(hNet, hAddr, tNet, tAddr, limiter)
+			if err != nil {
+				log.Printf("tor: Failed to open SOCKS passthrough listener: %v", err)
+			} else {
+				log.Printf("tor: Opened SOCKS passthrough listener: %v:%v", hNet, hAddr)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (t *Tor) eventReader() {
-	ctrl := t.ctrl
+// socksPassthroughAddr returns the network and address that the SOCKS
+// passthrough should listen on, or "" if it is disabled.
+func socksPassthroughAddr(cfg *config.Config) (string, string) {
+	switch cfg.Tor.GetSocksPassthrough() {
+	case config.SocksPassthroughTCP:
+		return "tcp", cfg.Tor.GetSocksPassthroughAddr()
+	case config.SocksPassthroughUnix:
+		return "unix", filepath.Join(cfg.RuntimeDir, cfg.TorSocketName("socks-passthrough"))
+	case config.SocksPassthroughAbstract:
+		// The abstract namespace is shared by every user, so the name
+		// includes the uid.
+		return "unix", fmt.Sprintf("@sandboxed-tor-browser-%d/%s", os.Getuid(), cfg.TorSocketName(socksSocket))
+	default:
+		return "", ""
+	}
+}
+
+func (t *Tor) eventReader(ctrl *ctrlConn) {
 	for {
 		resp, err := ctrl.NextEvent()
 		if err != nil {
-			break
+			if ctrl = t.reconnectCtrl(ctrl, err); ctrl == nil {
+				break
+			}
+			continue
 		}
 		t.ctrlEvents <- resp
 	}
 	close(t.ctrlEvents)
 }
 
+// reconnectCtrl handles the loss of the control port connection after
+// bootstrap, and returns the new connection, or nil if there will not be
+// one.
+//
+// Only the system tor is reconnected to.  The sandboxed tor is told to
+// TAKEOWNERSHIP, so it terminates along with the connection, and the next
+// launch will start a new one.
+func (t *Tor) reconnectCtrl(old *ctrlConn, reason error) *ctrlConn {
+	const (
+		minReconnectDelay = 1 * time.Second
+		maxReconnectDelay = 30 * time.Second
+	)
+
+	t.Lock()
+	if t.ctrl != old || !t.isBootstrapped || t.isShutdown {
+		// Shutdown, or still bootstrapping, which handles errors itself.
+		t.Unlock()
+		return nil
+	}
+	t.ctrl = nil
+	hook := t.ctrlStateHook
+	t.Unlock()
+	old.Close()
+
+	log.Printf("tor: Lost the control port connection: %v", reason)
+	if hook != nil {
+		hook(false)
+	}
+	if !t.isSystem {
+		return nil
+	}
+
+	for delay := minReconnectDelay; ; delay *= 2 {
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		select {
+		case <-t.shutdownCh:
+			return nil
+		case <-time.After(delay):
+		}
+
+		ctrl, torVersion, err := dialCtrl(t.ctrlNet, t.ctrlAddr, t.ctrlPassword, t.ctrlCookieFile)
+		if err != nil {
+			Debugf("tor: Failed to reconnect to the control port: %v", err)
+			continue
+		}
+
+		t.Lock()
+		if t.isShutdown {
+			t.Unlock()
+			ctrl.Close()
+			return nil
+		}
+		t.ctrl, t.torVersion = ctrl, torVersion
+		t.Unlock()
+
+		log.Printf("tor: Reconnected to the control port.")
+		if hook != nil {
+			hook(true)
+		}
+		return ctrl
+	}
+}
+
 // NewSystemTor creates a Tor struct around a system tor instance.
 func NewSystemTor(cfg *config.Config) (*Tor, error) {
 	t := new(Tor)
 	t.isSystem = true
 	t.ctrlEvents = make(chan *bulb.Response, 16)
+	t.shutdownCh = make(chan struct{})
 	t.isBootstrapped = true
 
-	net := cfg.SystemTorControlNet
-	addr := cfg.SystemTorControlAddr
+	t.ctrlNet = cfg.SystemTorControlNet
+	t.ctrlAddr = cfg.SystemTorControlAddr
+	t.ctrlPassword = cfg.SystemTorControlPassword
+	t.ctrlCookieFile = cfg.SystemTorControlCookieFile
 
-	// Dial the control port.
+	// Dial and authenticate with the control port.
 	var err error
-	if t.ctrl, err = bulb.Dial(net, addr); err != nil {
-		return nil, err
-	}
-
-	// Authenticate with the control port.
-	if err = t.ctrl.Authenticate(""); err != nil {
-		t.ctrl.Close()
+	if t.ctrl, t.torVersion, err = dialCtrl(t.ctrlNet, t.ctrlAddr, t.ctrlPassword, t.ctrlCookieFile); err != nil {
 		return nil, err
 	}
-
-	t.ctrl.StartAsyncReader()
-	go t.eventReader()
+	go t.eventReader(t.ctrl)
 
 	// Launch the surrogates.
 	if err = t.launchSurrogates(cfg); err != nil {
@@ -296,14 +531,22 @@ func NewSandboxedTor(cfg *config.Config, process *process.Process) *Tor {
 	t.isSystem = false
 	t.process = process
 	t.socksNet = "unix"
-	t.socksAddr = filepath.Join(cfg.TorDataDir, "socks")
-	t.ctrlAddr = filepath.Join(cfg.TorDataDir, "control")
+	t.socksAddr = filepath.Join(cfg.TorDataDir, cfg.TorSocketName(socksSocket))
+	t.ctrlNet = "unix"
+	t.ctrlAddr = filepath.Join(cfg.TorDataDir, cfg.TorSocketName(ctrlSocket))
 	t.ctrlEvents = make(chan *bulb.Response, 16)
+	t.shutdownCh = make(chan struct{})
 	t.unlinkOnExit = []string{t.socksAddr, t.ctrlAddr}
 
 	return t
 }
 
+// SetBootstrapHook sets the function called with each bootstrap status
+// update, including problem reports, during DoBootstrap.
+func (t *Tor) SetBootstrapHook(fn func(*BootstrapStatus)) {
+	t.bootstrapHook = fn
+}
+
 // DoBootstrap will bootstrap a tor instance, if it is one that is lauched
 // by us.
 func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
@@ -311,93 +554,80 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 		return nil
 	}
 
-	hz := time.NewTicker(1 * time.Second)
-	defer hz.Stop()
-
-	// Wait for the control port to be ready.
-	var ctrlPortAddr []byte
-	for nTicks := 0; nTicks < 10; { // 10 sec timeout (control port).
-		if ctrlPortAddr, err = ioutil.ReadFile(filepath.Join(cfg.TorDataDir, "control_port")); err == nil {
-			break
-		}
-
-		if os.IsNotExist(err) {
-			select {
-			case <-hz.C:
-				nTicks++
-				continue
-			case <-async.Cancel:
-				return ErrCanceled
-			}
-		}
-		return err
-	}
-	if ctrlPortAddr == nil {
-		return fmt.Errorf("tor: timeout waiting for the control port")
-	}
-
-	Debugf("tor: control port is: %v", string(ctrlPortAddr))
-
-	// Dial the control port.
+	// Connect to the control port.
 	async.UpdateProgress("Connecting to the Tor Control Port.")
-	if t.ctrl, err = bulb.Dial("unix", t.ctrlAddr); err != nil {
+	if err = t.connectSandboxedCtrl(cfg, async); err != nil {
 		return err
 	}
 	ctrl := t.ctrl // Shadow, so that we fail gracefully on close.
+	ctx := context.Background()
 
-	// Authenticate with the control port.
-	if err = ctrl.Authenticate(cfg.Tor.CtrlPassword); err != nil {
-		return err
-	}
+	// Start the event reader.
+	go t.eventReader(ctrl)
 
 	// Take ownership of the tor process such that it will self terminate
 	// when the control port connection gets closed.  Past this point, tor
 	// shouldn't leave a turd process lying around, though I've seen it on
 	// occaision. :(
 	log.Printf("tor: Taking ownership of the tor process")
-	if _, err = ctrl.Request("TAKEOWNERSHIP"); err != nil {
+	if _, err = ctrl.Request(ctx, "TAKEOWNERSHIP"); err != nil {
 		return err
 	}
 
-	// Start the event async reader.
-	ctrl.StartAsyncReader()
-	go t.eventReader()
+	// Register the `STATUS_CLIENT` and `STATUS_GENERAL` (for clock skew)
+	// event handlers.
+	if _, err = ctrl.Request(ctx, "SETEVENTS STATUS_CLIENT STATUS_GENERAL"); err != nil {
+		return err
+	}
 
-	// Register the `STATUS_CLIENT` event handler.
-	if _, err = ctrl.Request("SETEVENTS STATUS_CLIENT"); err != nil {
+	// Configure the optional features, while the network is still disabled.
+	if err = applyFeatureConfig(ctx, ctrl, cfg); err != nil {
 		return err
 	}
 
 	// Start the bootstrap.
 	async.UpdateProgress("Connecting to the Tor network.")
-	if _, err = ctrl.Request("RESETCONF DisableNetwork"); err != nil {
+	if _, err = ctrl.Request(ctx, "RESETCONF DisableNetwork"); err != nil {
 		return err
 	}
 
+	hz := time.NewTicker(1 * time.Second)
+	defer hz.Stop()
+
 	// Wait for bootstrap to finish.
 	bootstrapFinished := false
 	pct := 0
+	var status, problem *BootstrapStatus
+	var clockSkew string
 	for nTicks := 0; nTicks < 300 && !bootstrapFinished; { // 300 sec timeout (bootstrap).
-		newPct := 0
+		var st *BootstrapStatus
 		select {
 		case ev := <-t.ctrlEvents:
-			const evPrefix = "STATUS_CLIENT "
+			const (
+				evClientPrefix  = "STATUS_CLIENT "
+				evGeneralPrefix = "STATUS_GENERAL "
+			)
 			if ev == nil {
 				return ErrCanceled
 			}
-			if !strings.HasPrefix(ev.Reply, evPrefix) {
+			if strings.HasPrefix(ev.Reply, evGeneralPrefix) {
+				if skew := parseClockSkew(strings.TrimPrefix(ev.Reply, evGeneralPrefix)); skew != "" {
+					log.Printf("tor: Clock skew detected: %v", skew)
+					clockSkew = skew
+				}
+				continue
+			}
+			if !strings.HasPrefix(ev.Reply, evClientPrefix) {
 				continue
 			}
-			bootstrapFinished, newPct = handleBootstrapEvent(async, strings.TrimPrefix(ev.Reply, evPrefix))
+			st = handleBootstrapEvent(async, strings.TrimPrefix(ev.Reply, evClientPrefix))
 		case <-async.Cancel:
 			return ErrCanceled
 		case <-hz.C:
-			const statusPrefix = "status/bootstrap-phase="
-
 			// As a fallback, periodicall poll to see if the process has
 			// crashed.
 			if !t.process.Running() {
-				return fmt.Errorf("tor process appears to have crashed.")
+				return ErrTorCrashed
 			}
 
 			// Fallback in case something goes wrong, poll the bootstrap status
@@ -407,24 +637,58 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 				continue
 			}
 
-			resp, err := t.getinfo("status/bootstrap-phase")
+			info, err := ctrl.GetInfo(ctx, "status/bootstrap-phase")
 			if err != nil {
 				return err
 			}
-			bootstrapFinished, newPct = handleBootstrapEvent(async, strings.TrimPrefix(resp.Data[0], statusPrefix))
+			st = handleBootstrapEvent(async, info["status/bootstrap-phase"])
+
+			// tor only reports clock skew in certain situations, so while
+			// there are problems, check against the consensus as well.
+			if problem != nil && clockSkew == "" {
+				clockSkew = queryConsensusClockSkew(ctx, ctrl, problem.Tag)
+			}
+		}
+		if st == nil {
+			continue
+		}
+		if t.bootstrapHook != nil {
+			t.bootstrapHook(st)
 		}
+		if st.IsProblem() {
+			problem = st
+			continue
+		}
+		status = st
+		bootstrapFinished = st.Progress == 100
+
 		// As long as forward progress is being made, reset the timer.
-		if newPct > pct {
-			pct = newPct
+		if st.Progress > pct {
+			pct = st.Progress
 			nTicks = 0
 		}
 	}
 	if !bootstrapFinished {
-		return fmt.Errorf("tor: timeout connecting to the tor network")
+		if clockSkew == "" {
+			tag := ""
+			if problem != nil {
+				tag = problem.Tag
+			} else if status != nil {
+				tag = status.Tag
+			}
+			clockSkew = queryConsensusClockSkew(ctx, ctrl, tag)
+		}
+		bErr := &BootstrapError{
+			Status:    status,
+			Problem:   problem,
+			ClockSkew: clockSkew,
+		}
+		bErr.Advice, bErr.NeedsBridges = bootstrapAdvice(status, problem, clockSkew, cfg.Tor.UseBridges, cfg.Tor.UseProxy)
+		return bErr
 	}
 
 	// Squelch the events, and drain the event queue.
-	if _, err = ctrl.Request("SETEVENTS"); err != nil {
+	if _, err = ctrl.Request(ctx, "SETEVENTS"); err != nil {
 		return err
 	}
 	for len(t.ctrlEvents) > 0 {
@@ -441,42 +705,229 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 	return nil
 }
 
+// connectSandboxedCtrl waits for the sandboxed tor's control port to be
+// ready, and connects and authenticates with it.
+func (t *Tor) connectSandboxedCtrl(cfg *config.Config, async *Async) (err error) {
+	hz := time.NewTicker(1 * time.Second)
+	defer hz.Stop()
+
+	// Wait for the control port to be ready.
+	var ctrlPortAddr []byte
+	for nTicks := 0; nTicks < 10; { // 10 sec timeout (control port).
+		if ctrlPortAddr, err = ioutil.ReadFile(ControlPortFile(cfg)); err == nil {
+			break
+		}
+
+		if os.IsNotExist(err) {
+			select {
+			case <-hz.C:
+				nTicks++
+				continue
+			case <-async.Cancel:
+				return ErrCanceled
+			}
+		}
+		return err
+	}
+	if ctrlPortAddr == nil {
+		return ErrCtrlPortTimeout
+	}
+
+	Debugf("tor: control port is: %v", string(ctrlPortAddr))
+
+	// Dial and authenticate with the control port.
+	if t.ctrl, t.torVersion, err = dialCtrl(t.ctrlNet, t.ctrlAddr, cfg.Tor.CtrlPassword, ""); err != nil {
+		return err
+	}
+	if cfg.Tor.CustomTorPath != "" && !versionAtLeast(t.torVersion, customTorMinVersion) {
+		log.Printf("tor: Custom tor version: %v", t.torVersion)
+		return ErrCustomTorTooOld
+	}
+	return nil
+}
+
 // CfgToSandboxTorrc converts the `ui/config/Config` to a sandboxed tor ready
-// torrc.
-func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte, error) {
-	torrc, err := data.Asset("torrc")
+// torrc, for the bundle described by the manifest.
+func CfgToSandboxTorrc(cfg *config.Config, manif *config.Manifest, bridges map[string][]string) ([]byte, error) {
+	// No seed was set. Generate one with math.Rand, since this is purely for
+	// load balancing and doesn't require high grade entropy.
+	if cfg.Tor.UseBridges && !cfg.Tor.UseCustomBridges && cfg.Tor.InternalBridgeSeed == 0 {
+		seed := mrand.Int63()
+		cfg.Tor.SetInternalBridgeSeed(seed)
+		if err := cfg.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	torrc, err := cfgToTorrc(cfg, manif, bridges, cfg.Tor.ExtraTorrc)
 	if err != nil {
 		return nil, err
 	}
 
+	// Generate a random control port password.
+	var entropy [16]byte
+	if _, err := rand.Read(entropy[:]); err != nil {
+		return nil, fmt.Errorf("tor: Failed to generate a password: %v", err)
+	}
+	cfg.Tor.CtrlPassword = hex.EncodeToString(entropy[:])
+
+	// Convert it to the RFC2440 S2K variant that Tor understands and expects.
+	// (SHA1, with the first 2 bytes of the descriptor that specify
+	// iterated/salted, and the hash omitted).
+	b := &bytes.Buffer{}
+	key := make([]byte, 20)
+	if err := s2k.Serialize(b, key, rand.Reader, []byte(cfg.Tor.CtrlPassword), nil); err != nil {
+		return nil, fmt.Errorf("tor: Failed to hash password: %v", err)
+	}
+	b.Write(key)
+	hashedPasswd := "16:" + hex.EncodeToString(b.Bytes()[2:])
+
+	torrc = append(torrc, []byte("\nHashedControlPassword ")...)
+	torrc = append(torrc, []byte(hashedPasswd)...)
+
+	return torrc, nil
+}
+
+// PreviewSandboxTorrc returns the torrc that would be generated from the
+// `ui/config/Config` and the supplied extra torrc lines, without modifying
+// the config.  The control port password is generated at launch time, and
+// is omitted.
+func PreviewSandboxTorrc(cfg *config.Config, manif *config.Manifest, bridges map[string][]string, extra string) ([]byte, error) {
+	torrc, err := cfgToTorrc(cfg, manif, bridges, extra)
+	if err != nil {
+		return nil, err
+	}
+	torrc = append(torrc, []byte("\nHashedControlPassword (Generated at launch)\n")...)
+	return torrc, nil
+}
+
+const (
+	sandboxDataDir = "/home/amnesia/tor/data"
+
+	socksSocket  = "socks"
+	ctrlSocket   = "control"
+	ctrlPortFile = "control_port"
+
+	// sandboxEphemeralDataDir is the DataDirectory when the state is
+	// ephemeral.  The sandbox home directory is never persisted, so tor
+	// creating it there is all that is needed.
+	sandboxEphemeralDataDir = "/home/amnesia/tor/state"
+)
+
+// ControlPortFile returns the path of the file that the sandboxed tor
+// instance writes the control port address to.
+func ControlPortFile(cfg *config.Config) string {
+	return filepath.Join(cfg.TorDataDir, cfg.TorSocketName(ctrlPortFile))
+}
+
+// SandboxSocksPort returns the `SocksPort` address of the instance, as seen
+// from inside the tor sandbox.
+func SandboxSocksPort(cfg *config.Config) string {
+	return "unix:" + path.Join(sandboxDataDir, cfg.TorSocketName(socksSocket))
+}
+
+// instanceTorrcPaths are the torrc directives that refer to sockets (and
+// files) in the data directory, that must be unique per instance, and their
+// default values.
+var instanceTorrcPaths = map[string]string{
+	"SocksPort":              "unix:" + path.Join(sandboxDataDir, socksSocket),
+	"ControlPort":            "unix:" + path.Join(sandboxDataDir, ctrlSocket),
+	"ControlPortWriteToFile": path.Join(sandboxDataDir, ctrlPortFile),
+}
+
+// instanceTorrc rewrites the socket paths in torrc to the ones of the
+// instance.
+func instanceTorrc(cfg *config.Config, torrc []byte) ([]byte, error) {
+	found := make(map[string]bool)
+	lines := strings.Split(string(torrc), "\n")
+	for i, l := range lines {
+		f := strings.Fields(l)
+		if len(f) < 2 || instanceTorrcPaths[f[0]] != f[1] {
+			continue
+		}
+		f[1] = path.Join(path.Dir(f[1]), cfg.TorSocketName(path.Base(f[1])))
+		lines[i] = strings.Join(f, " ")
+		found[f[0]] = true
+	}
+	for k := range instanceTorrcPaths {
+		if !found[k] {
+			return nil, fmt.Errorf("tor: torrc has no default %v", k)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// IsInstanceTorrc returns true if torrc is for the instance, going by the
+// `SocksPort`.
+func IsInstanceTorrc(cfg *config.Config, torrc []byte) bool {
+	socksPort := SandboxSocksPort(cfg)
+	for _, l := range strings.Split(string(torrc), "\n") {
+		if f := strings.Fields(l); len(f) >= 2 && f[0] == "SocksPort" && f[1] == socksPort {
+			return true
+		}
+	}
+	return false
+}
+
+func cfgToTorrc(cfg *config.Config, manif *config.Manifest, bridges map[string][]string, extra string) ([]byte, error) {
+	torrc, err := policy.Asset("torrc")
+	if err != nil {
+		return nil, err
+	}
+
+	// Give each instance its own sockets.
+	if cfg.InstanceID != "" {
+		if torrc, err = instanceTorrc(cfg, torrc); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the channel specific defaults, if any, based on the installed
+	// bundle rather than the configured channel, since they can differ
+	// until the next install.
+	channel := cfg.Channel
+	if manif != nil {
+		channel = manif.Channel
+	}
+	if torrcChannel, err := policy.Asset("torrc-" + channel); err == nil {
+		torrc = append(torrc, []byte("\n"+string(torrcChannel))...)
+	}
+
+	// Move the state to the tmpfs, leaving the sockets (and optionally the
+	// caches) in the persistent data directory.
+	if cfg.Tor.EphemeralState {
+		dataDirLine := []byte("DataDirectory " + sandboxDataDir + "\n")
+		if !bytes.Contains(torrc, dataDirLine) {
+			return nil, fmt.Errorf("tor: torrc has no DataDirectory")
+		}
+		torrc = bytes.Replace(torrc, dataDirLine, []byte("DataDirectory "+sandboxEphemeralDataDir+"\n"), 1)
+		if cfg.Tor.KeepConsensusCache {
+			torrc = append(torrc, []byte("\nCacheDirectory "+sandboxDataDir+"\n")...)
+		}
+	}
+
 	// Apply proxy/bridge config.
 	if cfg.Tor.UseBridges {
-		torrcBridges, err := data.Asset("torrc-bridges")
+		torrcBridges, err := policy.Asset("torrc-bridges")
 		if err != nil {
 			return nil, err
 		}
 		bridgeArgs := []string{string(torrcBridges)}
 		if !cfg.Tor.UseCustomBridges {
-			// No seed was set. Generate one with math.Rand, since this is
-			// purely for load balancing and doesn't require high grade
-			// entropy.
-			if cfg.Tor.InternalBridgeSeed == 0 {
-				seed := mrand.Int63()
-				cfg.Tor.SetInternalBridgeSeed(seed)
-				if err = cfg.Sync(); err != nil {
-					return nil, err
-				}
-			}
-
 			// Initialize the deterministic random bit generator, using
 			// the persisted seed.
 			drbgSrc := mrand.NewSource(cfg.Tor.InternalBridgeSeed)
 			drbg := mrand.New(drbgSrc)
 
+			var lines []string
 			shuf := drbg.Perm(len(bridges[cfg.Tor.InternalBridgeType]))
 			for _, i := range shuf {
-				bridgeArgs = append(bridgeArgs, bridges[cfg.Tor.InternalBridgeType][i])
+				lines = append(lines, bridges[cfg.Tor.InternalBridgeType][i])
+			}
+			if cfg.Tor.ProbeBridges {
+				lines = orderBridges(lines, cfg.Tor.BridgeStats)
 			}
+			bridgeArgs = append(bridgeArgs, lines...)
 		} else {
 			// The caller is responsible for making sure that this is indeed
 			// bridge lines, and not random other bullshit.
@@ -489,7 +940,7 @@ func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte,
 
 	if cfg.Tor.UseProxy {
 		proxyArgs := []string{}
-		proxyAddr := cfg.Tor.ProxyAddress + ":" + cfg.Tor.ProxyPort
+		proxyAddr := net.JoinHostPort(cfg.Tor.ProxyAddress, cfg.Tor.ProxyPort)
 		proxyUser := cfg.Tor.ProxyUsername
 		proxyPasswd := cfg.Tor.ProxyPassword
 
@@ -515,84 +966,61 @@ func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte,
 		torrc = append(torrc, []byte(s)...)
 	}
 
-	// Generate a random control port password.
-	var entropy [16]byte
-	if _, err := rand.Read(entropy[:]); err != nil {
-		return nil, fmt.Errorf("tor: Failed to generate a password: %v", err)
+	// Apply the user supplied extra torrc lines.
+	if extra, err = ValidateExtraTorrc(extra); err != nil {
+		return nil, err
+	} else if extra != "" {
+		torrc = append(torrc, []byte("\n"+extra+"\n")...)
 	}
-	cfg.Tor.CtrlPassword = hex.EncodeToString(entropy[:])
-
-	// Convert it to the RFC2440 S2K variant that Tor understands and expects.
-	// (SHA1, with the first 2 bytes of the descriptor that specify
-	// iterated/salted, and the hash omitted).
-	b := &bytes.Buffer{}
-	key := make([]byte, 20)
-	if err := s2k.Serialize(b, key, rand.Reader, []byte(cfg.Tor.CtrlPassword), nil); err != nil {
-		return nil, fmt.Errorf("tor: Failed to hash password: %v", err)
-	}
-	b.Write(key)
-	hashedPasswd := "16:" + hex.EncodeToString(b.Bytes()[2:])
-
-	torrc = append(torrc, []byte("\nHashedControlPassword ")...)
-	torrc = append(torrc, []byte(hashedPasswd)...)
 
 	return torrc, nil
 }
 
-func handleBootstrapEvent(async *Async, s string) (bool, int) {
-	const bootstrapPrefix = "NOTICE BOOTSTRAP "
-	if !strings.HasPrefix(s, bootstrapPrefix) {
-		return false, 0
+func handleBootstrapEvent(async *Async, s string) *BootstrapStatus {
+	st := parseBootstrapStatus(s)
+	if st == nil || st.Summary == "" {
+		return nil
 	}
 
-	split := splitQuoted(strings.TrimPrefix(s, bootstrapPrefix))
-
-	var progress, summary string
-	for _, v := range split {
-		const (
-			progressPrefix = "PROGRESS="
-			summaryPrefix  = "SUMMARY="
-		)
-
-		if strings.HasPrefix(v, progressPrefix) {
-			progress = strings.TrimPrefix(v, progressPrefix)
-		} else if strings.HasPrefix(v, summaryPrefix) {
-			summary = strings.TrimPrefix(v, summaryPrefix)
-			summary = strings.Trim(summary, "\"")
-		}
+	if st.IsProblem() {
+		log.Printf("tor: Bootstrap problem: %v (%v, count: %v)", st.Warning, st.Reason, st.Count)
+		async.UpdateProgress(fmt.Sprintf("Bootstrap: %s (Problem: %s)", st.Summary, st.Warning))
+	} else {
+		async.UpdateProgress(fmt.Sprintf("Bootstrap: %s", st.Summary))
 	}
-	progressPct, err := strconv.Atoi(progress)
+	return st
+}
+
+// queryConsensusClockSkew checks the local clock against tor's current
+// consensus, if any.
+func queryConsensusClockSkew(ctx context.Context, ctrl *ctrlConn, tag string) string {
+	info, err := ctrl.GetInfo(ctx, "consensus/valid-after", "consensus/valid-until")
 	if err != nil {
-		progressPct = 0
+		// No consensus yet.
+		return ""
 	}
-
-	if progress != "" && summary != "" {
-		async.UpdateProgress(fmt.Sprintf("Bootstrap: %s", summary))
-		if progress == "100" {
-			return true, progressPct
-		}
+	skew := consensusClockSkew(info["consensus/valid-after"], info["consensus/valid-until"], time.Now(), tag)
+	if skew != "" {
+		log.Printf("tor: Clock skew detected: %v", skew)
 	}
-	return false, progressPct
-}
-
-// Random quoted split function stolen and modified from the intertubes.
-// https://groups.google.com/forum/#!topic/golang-nuts/pNwqLyfl2co
-func splitQuoted(s string) []string {
-	lastQuote := rune(0)
-	f := func(c rune) bool {
-		switch {
-		case c == lastQuote:
-			lastQuote = rune(0)
-			return false
-		case lastQuote != rune(0):
-			return false
-		case c == '"':
-			lastQuote = c
-			return false
-		default:
-			return unicode.IsSpace(c)
-		}
+	return skew
+}
+
+// parseClockSkew parses the body of a `STATUS_GENERAL` event, and returns a
+// description of the clock skew if it is a `CLOCK_SKEW` event.
+func parseClockSkew(s string) string {
+	split := torctl.Split(s)
+	if len(split) < 2 || split[1] != "CLOCK_SKEW" {
+		return ""
 	}
 
-	return strings.FieldsFunc(s, f)
+	kw := torctl.Keywords(split[2:])
+	skew, source := kw["SKEW"], kw["SOURCE"]
+	if n, err := strconv.Atoi(skew); err == nil {
+		skew = (time.Duration(n) * time.Second).String()
+	}
+	if skew == "" {
+		return "unknown offset"
+	}
+	return fmt.Sprintf("off by %v according to %v", skew, source)
 }
@@ -0,0 +1,78 @@
+// tor_test.go - Tor daemon interface tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/policy"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+func TestInstanceTorrc(t *testing.T) {
+	torrc, err := policy.Asset("torrc")
+	if err != nil {
+		t.Fatalf("policy.Asset(torrc): %v", err)
+	}
+
+	defaultCfg := &config.Config{}
+	instCfg := &config.Config{InstanceID: "1"}
+	otherCfg := &config.Config{InstanceID: "2"}
+
+	if !IsInstanceTorrc(defaultCfg, torrc) {
+		t.Errorf("IsInstanceTorrc: default torrc is not for the default instance")
+	}
+	if IsInstanceTorrc(instCfg, torrc) {
+		t.Errorf("IsInstanceTorrc: default torrc is for instance 1")
+	}
+
+	b, err := instanceTorrc(instCfg, torrc)
+	if err != nil {
+		t.Fatalf("instanceTorrc: %v", err)
+	}
+	if !IsInstanceTorrc(instCfg, b) {
+		t.Errorf("IsInstanceTorrc: instance torrc is not for instance 1")
+	}
+	for _, c := range []*config.Config{defaultCfg, otherCfg} {
+		if IsInstanceTorrc(c, b) {
+			t.Errorf("IsInstanceTorrc: instance torrc is for instance '%v'", c.InstanceID)
+		}
+	}
+
+	s := string(b)
+	for _, want := range []string{
+		"SocksPort unix:" + sandboxDataDir + "/socks-1 IPv6Traffic",
+		"ControlPort unix:" + sandboxDataDir + "/control-1\n",
+		"ControlPortWriteToFile " + sandboxDataDir + "/control_port-1\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("instanceTorrc: missing '%v'", strings.TrimSpace(want))
+		}
+	}
+	if len(strings.Split(s, "\n")) != len(strings.Split(string(torrc), "\n")) {
+		t.Errorf("instanceTorrc: line count changed")
+	}
+
+	// The rewritten sockets are no longer the defaults.
+	if _, err = instanceTorrc(otherCfg, b); err == nil {
+		t.Errorf("instanceTorrc: rewrote an instance torrc")
+	}
+	if _, err = instanceTorrc(instCfg, []byte("SocksPort 9050\n")); err == nil {
+		t.Errorf("instanceTorrc: accepted a torrc with no default sockets")
+	}
+}
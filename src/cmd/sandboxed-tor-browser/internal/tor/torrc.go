@@ -0,0 +1,102 @@
+// torrc.go - User supplied torrc validation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// extraTorrcOptions is the set of torrc options that the user may specify in
+// addition to the generated torrc.  Anything that involves paths, listeners,
+// the control port or the process itself would break the sandbox, and is
+// deliberately excluded.
+var extraTorrcOptions = []string{
+	"AvoidDiskWrites",
+	"CircuitBuildTimeout",
+	"CircuitPadding",
+	"ClientPreferIPv6ORPort",
+	"ClientUseIPv4",
+	"ClientUseIPv6",
+	"ConfluxClientUX",
+	"ConnectionPadding",
+	"EnforceDistinctSubnets",
+	"EntryNodes",
+	"ExcludeExitNodes",
+	"ExcludeNodes",
+	"ExitNodes",
+	"FascistFirewall",
+	"GeoIPExcludeUnknown",
+	"KeepalivePeriod",
+	"LearnCircuitBuildTimeout",
+	"LongLivedPorts",
+	"MaxCircuitDirtiness",
+	"NewCircuitPeriod",
+	"NumEntryGuards",
+	"NumPrimaryGuards",
+	"ReachableAddresses",
+	"ReducedCircuitPadding",
+	"ReducedConnectionPadding",
+	"RejectPlaintextPorts",
+	"SafeLogging",
+	"StrictNodes",
+	"TestSocks",
+	"WarnPlaintextPorts",
+}
+
+// ValidateExtraTorrc validates the user supplied torrc lines against the
+// option whitelist, and returns the normalized lines.
+func ValidateExtraTorrc(s string) (string, error) {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		for _, r := range l {
+			if unicode.IsControl(r) {
+				return "", fmt.Errorf("torrc line contains control characters: %q", l)
+			}
+		}
+		if strings.HasSuffix(l, "\\") {
+			return "", fmt.Errorf("torrc line continuations are not supported: '%v'", l)
+		}
+
+		kv := strings.Fields(l)
+		if len(kv) < 2 {
+			return "", fmt.Errorf("torrc option has no value: '%v'", l)
+		}
+		opt := canonicalTorrcOption(kv[0])
+		if opt == "" {
+			return "", fmt.Errorf("torrc option not permitted: '%v'", kv[0])
+		}
+		lines = append(lines, opt+" "+strings.Join(kv[1:], " "))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func canonicalTorrcOption(opt string) string {
+	// tor treats option names case insensitively.
+	for _, v := range extraTorrcOptions {
+		if strings.EqualFold(v, opt) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+// quote.go - Control port QuotedString handling.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package torctl implements the tor control port wire format, as specified
+// in control-spec.txt, for the bits that the launcher and the control port
+// surrogate need to parse.
+package torctl
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	errUnterminatedQuote = errors.New("torctl: unterminated QuotedString")
+	errNotQuoted         = errors.New("torctl: not a QuotedString")
+)
+
+// Quote returns s as a QuotedString.
+func Quote(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Unquote returns the value of the QuotedString s.  The C style escapes
+// that tor emits (`\n`, `\t`, `\r`, and up to 3 octal digits) are decoded,
+// and any other escaped character stands for itself.
+func Unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' {
+		return "", errNotQuoted
+	}
+
+	var b bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			if i != len(s)-1 {
+				return "", errors.New("torctl: trailing data after QuotedString")
+			}
+			return b.String(), nil
+		case '\\':
+		default:
+			b.WriteByte(c)
+			continue
+		}
+
+		if i++; i >= len(s) {
+			break
+		}
+		switch c = s[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			v := 0
+			for n := 0; n < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; n++ {
+				v = v<<3 | int(s[i]-'0')
+				i++
+			}
+			if v > 0xff {
+				return "", errors.New("torctl: octal escape out of range")
+			}
+			b.WriteByte(byte(v))
+			i--
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errUnterminatedQuote
+}
+
+// Split splits s into space separated fields, where spaces inside a
+// QuotedString (including ones that start part way into a field, as in
+// `KEY="VALUE"`) do not separate fields.  The fields are returned as is,
+// use Unquote or Keyword to get at the values.
+func Split(s string) []string {
+	var fields []string
+	start, inQuote := -1, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inQuote && c == '\\':
+			i++
+		case c == '"':
+			inQuote = !inQuote
+		case !inQuote && (c == ' ' || c == '\t'):
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+	return fields
+}
+
+// Keyword splits a `KEY=VALUE` field, unquoting the value if it is a
+// QuotedString.  ok is false if the field is not a keyword argument, or
+// the value is malformed.
+func Keyword(field string) (key, value string, ok bool) {
+	idx := strings.IndexByte(field, '=')
+	if idx <= 0 {
+		return "", "", false
+	}
+	key, value = field[:idx], field[idx+1:]
+	if strings.HasPrefix(value, "\"") {
+		var err error
+		if value, err = Unquote(value); err != nil {
+			return "", "", false
+		}
+	}
+	return key, value, true
+}
+
+// Keywords returns the keyword arguments in fields, keyed by name.
+// Positional arguments and malformed values are skipped.
+func Keywords(fields []string) map[string]string {
+	ret := make(map[string]string)
+	for _, f := range fields {
+		if k, v, ok := Keyword(f); ok {
+			ret[k] = v
+		}
+	}
+	return ret
+}
@@ -0,0 +1,130 @@
+// quote_test.go - Control port quoting tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torctl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	for _, v := range []struct {
+		in, want string
+	}{
+		{"", `""`},
+		{"plain", `"plain"`},
+		{"with spaces", `"with spaces"`},
+		{`a"b`, `"a\"b"`},
+		{`C:\tor`, `"C:\\tor"`},
+		{"line\nbreak\r\ttab", `"line\nbreak\r\ttab"`},
+	} {
+		if got := Quote(v.in); got != v.want {
+			t.Errorf("Quote(%q): got %v, want %v", v.in, got, v.want)
+		}
+		if got, err := Unquote(Quote(v.in)); err != nil || got != v.in {
+			t.Errorf("Unquote(Quote(%q)): got %q, %v", v.in, got, err)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	for _, v := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: `""`, want: ""},
+		{in: `"with spaces"`, want: "with spaces"},
+		{in: `"a\"b"`, want: `a"b`},
+		{in: `"a\\b"`, want: `a\b`},
+		{in: `"\n\r\t"`, want: "\n\r\t"},
+		{in: `"\x"`, want: "x"},           // Unknown escapes stand for themselves.
+		{in: `"\101\7a"`, want: "A\x07a"}, // Octal, up to 3 digits.
+		{in: `"\0"`, want: "\x00"},
+		{in: `"\1234"`, want: "S4"},
+		{in: `"\377"`, want: "\xff"},
+		{in: `"\400"`, wantErr: true},
+		{in: ``, wantErr: true},
+		{in: `"`, wantErr: true},
+		{in: `unquoted`, wantErr: true},
+		{in: `"unterminated`, wantErr: true},
+		{in: `"escaped end\"`, wantErr: true},
+		{in: `"trailing backslash\`, wantErr: true},
+		{in: `"trailing" data`, wantErr: true},
+	} {
+		got, err := Unquote(v.in)
+		switch {
+		case v.wantErr && err == nil:
+			t.Errorf("Unquote(%v): got %q, want error", v.in, got)
+		case !v.wantErr && err != nil:
+			t.Errorf("Unquote(%v): %v", v.in, err)
+		case got != v.want:
+			t.Errorf("Unquote(%v): got %q, want %q", v.in, got, v.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, v := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"a b  c", []string{"a", "b", "c"}},
+		{" \ta\t", []string{"a"}},
+		{`"quoted string" b`, []string{`"quoted string"`, "b"}},
+		{`KEY="VALUE WITH SPACES" OTHER=x`, []string{`KEY="VALUE WITH SPACES"`, "OTHER=x"}},
+		{`K="escaped \" quote" x`, []string{`K="escaped \" quote"`, "x"}},
+		{`K="escaped \\" x`, []string{`K="escaped \\"`, "x"}},
+		{`K="unterminated x y`, []string{`K="unterminated x y`}},
+	} {
+		if got := Split(v.in); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Split(%v): got %q, want %q", v.in, got, v.want)
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	fields := Split(`BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done with spaces" ="no key" EMPTY="" BAD="unterminated`)
+	want := map[string]string{
+		"PROGRESS": "100",
+		"TAG":      "done",
+		"SUMMARY":  "Done with spaces",
+		"EMPTY":    "",
+	}
+	if got := Keywords(fields); !reflect.DeepEqual(got, want) {
+		t.Errorf("Keywords(%q): got %q, want %q", fields, got, want)
+	}
+
+	for _, v := range []struct {
+		in, key, value string
+		ok             bool
+	}{
+		{"K=V", "K", "V", true},
+		{"K=", "K", "", true},
+		{`K=""`, "K", "", true},
+		{`K="a=b c"`, "K", "a=b c", true},
+		{"positional", "", "", false},
+		{"=V", "", "", false},
+		{`K="bad`, "", "", false},
+	} {
+		k, val, ok := Keyword(v.in)
+		if k != v.key || val != v.value || ok != v.ok {
+			t.Errorf("Keyword(%v): got %q, %q, %v", v.in, k, val, ok)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// reply.go - Control port reply and event parsing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torctl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusAsyncEvent is the status code of asynchronous events.
+const StatusAsyncEvent = 650
+
+// ReplyLine is a single line of a control port reply.
+type ReplyLine struct {
+	// Status is the status code of the line.
+	Status int
+
+	// Text is the text following the status code and separator.
+	Text string
+
+	// Data is the dot decoded data following a DataReplyLine, or nil.
+	Data []string
+}
+
+// ParseReply parses the raw lines (sans CRLFs) of a single control port
+// reply, as returned by bulb, into ReplyLines.  The last line must be an
+// EndReplyLine.
+func ParseReply(raw []string) ([]ReplyLine, error) {
+	var lines []ReplyLine
+	for i := 0; i < len(raw); i++ {
+		l := raw[i]
+		if len(l) < 4 {
+			return nil, fmt.Errorf("torctl: truncated reply line: '%v'", l)
+		}
+		status, err := strconv.Atoi(l[:3])
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("torctl: malformed status code: '%v'", l)
+		}
+		if len(lines) > 0 && lines[0].Status != status {
+			return nil, fmt.Errorf("torctl: inconsistent status code: '%v'", l)
+		}
+		rl := ReplyLine{Status: status, Text: l[4:]}
+
+		switch l[3] {
+		case ' ':
+			if i != len(raw)-1 {
+				return nil, fmt.Errorf("torctl: trailing data after EndReplyLine")
+			}
+			return append(lines, rl), nil
+		case '-':
+		case '+':
+			rl.Data = []string{}
+			for i++; ; i++ {
+				if i >= len(raw) {
+					return nil, fmt.Errorf("torctl: unterminated data in reply")
+				}
+				d := raw[i]
+				if d == "." {
+					break
+				}
+				rl.Data = append(rl.Data, strings.TrimPrefix(d, "."))
+			}
+		default:
+			return nil, fmt.Errorf("torctl: malformed reply line separator: '%v'", l)
+		}
+		lines = append(lines, rl)
+	}
+	return nil, fmt.Errorf("torctl: missing EndReplyLine")
+}
+
+// ParseGetInfo parses a GETINFO reply, and returns the values keyed by
+// name.  Multi-line values are returned with the lines separated by "\n".
+func ParseGetInfo(raw []string) (map[string]string, error) {
+	lines, err := ParseReply(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Of the form:
+	//   250-key=value
+	//   250+key=
+	//   multi-line value
+	//   .
+	//   250 OK
+	ret := make(map[string]string)
+	for _, l := range lines[:len(lines)-1] {
+		idx := strings.IndexByte(l.Text, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("torctl: malformed GETINFO reply: '%v'", l.Text)
+		}
+		k := l.Text[:idx]
+		if l.Data != nil {
+			ret[k] = strings.Join(l.Data, "\n")
+		} else {
+			ret[k] = l.Text[idx+1:]
+		}
+	}
+	return ret, nil
+}
+
+// ParseGetConf parses a GETCONF reply, and returns the values keyed by
+// name.  Options that are set to their default values will have no values.
+func ParseGetConf(raw []string) (map[string][]string, error) {
+	lines, err := ParseReply(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Of the form:
+	//   250-key=value
+	//   250-key
+	//   250 key=value
+	ret := make(map[string][]string)
+	for _, l := range lines {
+		idx := strings.IndexByte(l.Text, '=')
+		if idx < 0 {
+			if _, ok := ret[l.Text]; !ok {
+				ret[l.Text] = nil
+			}
+			continue
+		}
+		k, v := l.Text[:idx], l.Text[idx+1:]
+		if strings.HasPrefix(v, "\"") {
+			if v, err = Unquote(v); err != nil {
+				return nil, fmt.Errorf("torctl: malformed GETCONF value for '%v': %v", k, err)
+			}
+		}
+		ret[k] = append(ret[k], v)
+	}
+	return ret, nil
+}
+
+// Event is an asynchronous event.
+type Event struct {
+	// Type is the event type (eg: `STATUS_CLIENT`).
+	Type string
+
+	// Args are the space separated fields following the type, on the first
+	// line of the event.
+	Args []string
+
+	// Data is the dot decoded data following the first line, if it is a
+	// DataReplyLine, or nil.
+	Data []string
+
+	// Lines are the remaining lines of multi-line events.
+	Lines []ReplyLine
+}
+
+// ParseEvent parses the raw lines of an asynchronous event.
+func ParseEvent(raw []string) (*Event, error) {
+	lines, err := ParseReply(raw)
+	if err != nil {
+		return nil, err
+	}
+	if lines[0].Status != StatusAsyncEvent {
+		return nil, fmt.Errorf("torctl: not an asynchronous event: %d", lines[0].Status)
+	}
+
+	fields := Split(lines[0].Text)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("torctl: event with no type")
+	}
+	return &Event{
+		Type:  fields[0],
+		Args:  fields[1:],
+		Data:  lines[0].Data,
+		Lines: lines[1:],
+	}, nil
+}
@@ -0,0 +1,188 @@
+// reply_test.go - Control port reply parsing tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torctl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReply(t *testing.T) {
+	for _, v := range []struct {
+		name    string
+		raw     []string
+		want    []ReplyLine
+		wantErr bool
+	}{
+		{
+			name: "single",
+			raw:  []string{"250 OK"},
+			want: []ReplyLine{{Status: 250, Text: "OK"}},
+		},
+		{
+			name: "empty text",
+			raw:  []string{"250 "},
+			want: []ReplyLine{{Status: 250}},
+		},
+		{
+			name: "multi-line",
+			raw:  []string{"250-version=0.3.0.10", "250-config-file=/etc/tor/torrc", "250 OK"},
+			want: []ReplyLine{
+				{Status: 250, Text: "version=0.3.0.10"},
+				{Status: 250, Text: "config-file=/etc/tor/torrc"},
+				{Status: 250, Text: "OK"},
+			},
+		},
+		{
+			name: "data",
+			raw:  []string{"250+config-text=", "SocksPort 9150", "..leading dot", "", ".", "250 OK"},
+			want: []ReplyLine{
+				{Status: 250, Text: "config-text=", Data: []string{"SocksPort 9150", ".leading dot", ""}},
+				{Status: 250, Text: "OK"},
+			},
+		},
+		{
+			name: "empty data",
+			raw:  []string{"250+ns/all=", ".", "250-version=0.3.0.10", "250 OK"},
+			want: []ReplyLine{
+				{Status: 250, Text: "ns/all=", Data: []string{}},
+				{Status: 250, Text: "version=0.3.0.10"},
+				{Status: 250, Text: "OK"},
+			},
+		},
+		{
+			name: "error",
+			raw:  []string{"552 Unrecognized key \"foo\""},
+			want: []ReplyLine{{Status: 552, Text: "Unrecognized key \"foo\""}},
+		},
+		{name: "no lines", raw: nil, wantErr: true},
+		{name: "truncated", raw: []string{"250"}, wantErr: true},
+		{name: "bad status", raw: []string{"2x0 OK"}, wantErr: true},
+		{name: "status range", raw: []string{"050 OK"}, wantErr: true},
+		{name: "bad separator", raw: []string{"250=OK"}, wantErr: true},
+		{name: "no end line", raw: []string{"250-a=b", "250-c=d"}, wantErr: true},
+		{name: "inconsistent status", raw: []string{"250-a=b", "251 OK"}, wantErr: true},
+		{name: "trailing lines", raw: []string{"250 OK", "250 OK"}, wantErr: true},
+		{name: "unterminated data", raw: []string{"250+a=", "line", "250 OK"}, wantErr: true},
+	} {
+		got, err := ParseReply(v.raw)
+		switch {
+		case v.wantErr && err == nil:
+			t.Errorf("%v: ParseReply(%q): got %+v, want error", v.name, v.raw, got)
+		case !v.wantErr && err != nil:
+			t.Errorf("%v: ParseReply(%q): %v", v.name, v.raw, err)
+		case !reflect.DeepEqual(got, v.want):
+			t.Errorf("%v: ParseReply(%q): got %+v, want %+v", v.name, v.raw, got, v.want)
+		}
+	}
+}
+
+func TestParseGetInfo(t *testing.T) {
+	raw := []string{
+		"250-version=0.3.0.10 (git-abcdef)",
+		"250+config-text=",
+		"SocksPort 9150",
+		"..dotted",
+		".",
+		"250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\"",
+		"250 OK",
+	}
+	want := map[string]string{
+		"version":                "0.3.0.10 (git-abcdef)",
+		"config-text":            "SocksPort 9150\n.dotted",
+		"status/bootstrap-phase": "NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\"",
+	}
+	got, err := ParseGetInfo(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseGetInfo: got %q, want %q", got, want)
+	}
+
+	for _, raw := range [][]string{
+		{"250-novalue", "250 OK"},
+		{"250-=value", "250 OK"},
+		{"250-a=b", "250"},
+	} {
+		if _, err := ParseGetInfo(raw); err == nil {
+			t.Errorf("ParseGetInfo(%q): no error", raw)
+		}
+	}
+}
+
+func TestParseGetConf(t *testing.T) {
+	raw := []string{
+		"250-SocksPort=9150",
+		"250-SocksPort=\"unix:/run/tor/socks with space\"",
+		"250-Bridge",
+		"250 DataDirectory=/var/lib/tor",
+	}
+	want := map[string][]string{
+		"SocksPort":     {"9150", "unix:/run/tor/socks with space"},
+		"Bridge":        nil,
+		"DataDirectory": {"/var/lib/tor"},
+	}
+	got, err := ParseGetConf(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseGetConf: got %q, want %q", got, want)
+	}
+
+	if _, err = ParseGetConf([]string{"250 Log=\"unterminated"}); err == nil {
+		t.Errorf("ParseGetConf: malformed QuotedString accepted")
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	ev, err := ParseEvent([]string{"650 STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=85 TAG=handshake_or SUMMARY=\"Finishing handshake with first hop\""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "STATUS_CLIENT" || len(ev.Lines) != 0 {
+		t.Errorf("ParseEvent: got %+v", ev)
+	}
+	wantArgs := []string{"NOTICE", "BOOTSTRAP", "PROGRESS=85", "TAG=handshake_or", "SUMMARY=\"Finishing handshake with first hop\""}
+	if !reflect.DeepEqual(ev.Args, wantArgs) {
+		t.Errorf("ParseEvent: args: got %q, want %q", ev.Args, wantArgs)
+	}
+	if kw := Keywords(ev.Args); kw["SUMMARY"] != "Finishing handshake with first hop" {
+		t.Errorf("ParseEvent: SUMMARY: got %q", kw["SUMMARY"])
+	}
+
+	// Multi-line events, with data.
+	ev, err = ParseEvent([]string{"650+NS", "r relay AAAA", ".", "650 OK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines := []ReplyLine{{Status: StatusAsyncEvent, Text: "OK"}}
+	if ev.Type != "NS" || len(ev.Args) != 0 || !reflect.DeepEqual(ev.Data, []string{"r relay AAAA"}) || !reflect.DeepEqual(ev.Lines, wantLines) {
+		t.Errorf("ParseEvent: got %+v", ev)
+	}
+
+	for _, raw := range [][]string{
+		{"250 OK"},
+		{"650 "},
+		{"650-CIRC 1 BUILT"},
+	} {
+		if ev, err := ParseEvent(raw); err == nil {
+			t.Errorf("ParseEvent(%q): got %+v, want error", raw, ev)
+		}
+	}
+}
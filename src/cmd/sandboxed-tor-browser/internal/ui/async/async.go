@@ -54,44 +54,66 @@ type Async struct {
 // Grab asynchronously downloads the provided URL using the provided grab
 // client, periodically invoking the hzFn on forward progress.
 func (async *Async) Grab(client *grab.Client, url string, hzFn func(string)) []byte {
-	if req, err := grab.NewRequest(url); err != nil {
+	req, err := grab.NewRequest(url)
+	if err != nil {
 		async.Err = err
 		return nil
-	} else {
-		req.Buffer = &bytes.Buffer{}
-		var resp *grab.Response
+	}
+	req.Buffer = &bytes.Buffer{}
+	if !async.doGrab(client, req, hzFn) {
+		return nil
+	}
+	return req.Buffer.Bytes()
+}
 
-		ch := client.DoAsync(req)
+// GrabFile asynchronously downloads the provided URL to the specified file
+// using the provided grab client, periodically invoking the hzFn on forward
+// progress.  A previous partial download to the same file will be resumed
+// if the server allows it.  If size is non-zero, it is enforced.
+func (async *Async) GrabFile(client *grab.Client, url, filename string, size uint64, hzFn func(string)) {
+	req, err := grab.NewRequest(url)
+	if err != nil {
+		async.Err = err
+		return
+	}
+	req.Filename = filename
+	req.Size = size
+	async.doGrab(client, req, hzFn)
+}
+
+func (async *Async) doGrab(client *grab.Client, req *grab.Request, hzFn func(string)) bool {
+	var resp *grab.Response
+
+	ch := client.DoAsync(req)
+	select {
+	case resp = <-ch:
+	case <-async.Cancel:
+		client.CancelRequest(req)
+		async.Err = ErrCanceled
+		return false
+	}
+
+	// Wait for the transfer to complete.
+	t := time.NewTicker(1000 * time.Millisecond)
+	defer t.Stop()
+	for {
 		select {
-		case resp = <-ch:
 		case <-async.Cancel:
 			client.CancelRequest(req)
 			async.Err = ErrCanceled
-			return nil
-		}
-
-		// Wait for the transfer to complete.
-		t := time.NewTicker(1000 * time.Millisecond)
-		defer t.Stop()
-		for {
-			select {
-			case <-async.Cancel:
-				client.CancelRequest(req)
-				async.Err = ErrCanceled
-				return nil
-			case <-t.C:
-				if resp.IsComplete() {
-					if resp.Error != nil {
-						async.Err = resp.Error
-						return nil
-					}
-					return req.Buffer.Bytes()
-				} else if hzFn != nil {
-					remaining := resp.ETA().Sub(time.Now()).Seconds()
-					hzFn(fmt.Sprintf("%vs remaining", int(remaining)))
+			return false
+		case <-t.C:
+			if resp.IsComplete() {
+				if resp.Error != nil {
+					async.Err = resp.Error
+					return false
 				}
-				runtime.Gosched()
+				return true
+			} else if hzFn != nil {
+				remaining := resp.ETA().Sub(time.Now()).Seconds()
+				hzFn(fmt.Sprintf("%vs remaining", int(remaining)))
 			}
+			runtime.Gosched()
 		}
 	}
 }
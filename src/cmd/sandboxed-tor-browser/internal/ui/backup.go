@@ -0,0 +1,320 @@
+// backup.go - Tor Browser profile backup and restore.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"archive/tar"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// ErrBadPassphrase is the error returned when a backup fails to decrypt.
+var ErrBadPassphrase = errors.New("incorrect passphrase, or not a backup")
+
+// The profile entries that are backed up by default: the bookmarks, the
+// certificate overrides, and the NoScript settings.
+var backupEntries = []string{
+	"places.sqlite",
+	"favicons.sqlite",
+	"bookmarkbackups",
+	"cert_override.txt",
+	"browser-extension-data/{73a6fe31-595d-460b-a920-fcc0f8843232}", // NoScript.
+}
+
+// The profile entries that are never backed up, even for a full backup.
+// The bundled extensions must be the ones that ship with the installed
+// bundle, and the lock files only make sense for the running browser.
+var backupSkipEntries = []string{
+	"extensions",
+	".parentlock",
+	"lock",
+}
+
+// backupConfig is the OpenPGP configuration used for backups, which can be
+// decrypted with `gpg --decrypt` if need be.
+var backupConfig = &packet.Config{
+	DefaultHash:            crypto.SHA256,
+	DefaultCipher:          packet.CipherAES256,
+	DefaultCompressionAlgo: packet.CompressionZLIB,
+	S2KCount:               65011712,
+}
+
+// Backup archives the Tor Browser profile into an OpenPGP symmetrically
+// encrypted tarball.  Only the bookmarks, certificate overrides and NoScript
+// settings are included, unless full is set.
+func (c *Common) Backup(path string, passphrase []byte, full bool) (err error) {
+	if c.Sandbox != nil {
+		return fmt.Errorf("backup failed, Tor Browser is running")
+	}
+	if len(passphrase) == 0 {
+		return fmt.Errorf("backup failed, no passphrase")
+	}
+	profileDir := c.ProfileDir()
+	if !utils.DirExists(profileDir) {
+		return fmt.Errorf("backup failed, no profile")
+	}
+
+	entries := backupEntries
+	if full {
+		if entries, err = listProfileEntries(profileDir); err != nil {
+			return err
+		}
+	}
+	log.Printf("backup: Backing up profile to: %v (full: %v)", path, full)
+
+	// Write to a temporary file, so that a failed backup never clobbers an
+	// existing one.
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, utils.FileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	w, err := openpgp.SymmetricallyEncrypt(f, passphrase, &openpgp.FileHints{IsBinary: true}, backupConfig)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	n := 0
+	for _, ent := range entries {
+		src := filepath.Join(profileDir, ent)
+		if _, err := os.Lstat(src); err != nil {
+			continue
+		}
+		if err = tarTree(tw, profileDir, src); err != nil {
+			return fmt.Errorf("backup failed: %v", err)
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("backup failed, nothing to back up")
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func listProfileEntries(profileDir string) ([]string, error) {
+	ents, err := ioutil.ReadDir(profileDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+entLoop:
+	for _, ent := range ents {
+		for _, v := range backupSkipEntries {
+			if ent.Name() == v {
+				continue entLoop
+			}
+		}
+		entries = append(entries, ent.Name())
+	}
+	return entries, nil
+}
+
+func tarTree(tw *tar.Writer, baseDir, src string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			log.Printf("backup: Skipping non-regular file: %v", rel)
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Uid, hdr.Gid = 0, 0
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// Restore restores a backup created by Backup into the Tor Browser profile,
+// replacing the existing copies of everything contained in the backup.
+func (c *Common) Restore(path string, passphrase []byte) error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("restore failed, Tor Browser is running")
+	}
+	profileDir := c.ProfileDir()
+	if !utils.DirExists(profileDir) {
+		return fmt.Errorf("restore failed, Tor Browser is not installed")
+	}
+
+	log.Printf("backup: Restoring profile from: %v", path)
+
+	// Decrypt and extract to a staging directory next to the profile, so
+	// that a malformed backup doesn't leave the profile half restored.  The
+	// integrity check only happens at the end of the message, so nothing is
+	// moved into the profile until the entire backup has been read.
+	stagingDir := profileDir + ".restore"
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := os.MkdirAll(stagingDir, utils.DirMode); err != nil {
+		return err
+	}
+	if err := decryptBackup(path, stagingDir, passphrase); err != nil {
+		return err
+	}
+
+	ents, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		dst := filepath.Join(profileDir, ent.Name())
+		if ent.IsDir() {
+			// Directories (eg: `browser-extension-data`) are merged.
+			if err = copyTree(filepath.Join(stagingDir, ent.Name()), dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.Rename(filepath.Join(stagingDir, ent.Name()), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptBackup decrypts the backup at src, and extracts it to dstDir.
+func decryptBackup(src, dstDir string, passphrase []byte) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if !symmetric || tried {
+			return nil, ErrBadPassphrase
+		}
+		tried = true
+		return passphrase, nil
+	}
+	md, err := openpgp.ReadMessage(f, nil, prompt, backupConfig)
+	if err != nil {
+		return ErrBadPassphrase
+	}
+
+	if err = untar(md.UnverifiedBody, dstDir); err != nil {
+		return fmt.Errorf("restore failed: %v", err)
+	}
+
+	// The tar reader stops at the end of archive marker, so consume the
+	// rest of the message to get to the MDC check.
+	if _, err = io.Copy(ioutil.Discard, md.UnverifiedBody); err != nil {
+		return fmt.Errorf("restore failed, backup is corrupted: %v", err)
+	}
+	return nil
+}
+
+func untar(r io.Reader, dstDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Refuse anything that would escape the destination.
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in backup: %v", hdr.Name)
+		}
+		dst := filepath.Join(dstDir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(dst, utils.DirMode); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(dst), utils.DirMode); err != nil {
+				return err
+			}
+			d, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, utils.FileMode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(d, tr)
+			d.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			log.Printf("backup: Skipping non-regular file: %v", hdr.Name)
+		}
+	}
+}
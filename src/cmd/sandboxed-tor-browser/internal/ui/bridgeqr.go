@@ -0,0 +1,96 @@
+// bridgeqr.go - Bridge line QR code import.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/qr"
+)
+
+// The limits on the image files that will be scanned for a bridge line QR
+// code, since the decoder works on the entire uncompressed image.
+const (
+	maxBridgeImageSize   = 16 * 1024 * 1024
+	maxBridgeImagePixels = 5000 * 5000
+)
+
+var pyStringRe = regexp.MustCompile(`'([^']*)'|"([^"]*)"`)
+
+// BridgesFromImage decodes the QR code in the image file, and returns the
+// bridge lines it contains, validated and sanitized.
+func BridgesFromImage(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return "", err
+	} else if fi.Size() > maxBridgeImageSize {
+		return "", fmt.Errorf("image is too large")
+	}
+	if cfg, _, err := image.DecodeConfig(f); err != nil {
+		return "", fmt.Errorf("failed to load image: %v", err)
+	} else if cfg.Width*cfg.Height > maxBridgeImagePixels {
+		return "", fmt.Errorf("image dimensions are too large")
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to load image: %v", err)
+	}
+	b, err := qr.Decode(img)
+	if err != nil {
+		return "", err
+	}
+
+	s, err := ValidateBridgeLines(parseBridgeQR(string(b)))
+	if err != nil {
+		return "", err
+	} else if s == "" {
+		return "", fmt.Errorf("the QR code does not contain any bridges")
+	}
+	return s, nil
+}
+
+// parseBridgeQR returns the bridge lines from the contents of a QR code.
+// BridgeDB encodes the bridges as a Python list literal, everything else
+// uses one bridge per line.
+func parseBridgeQR(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return s
+	}
+
+	var lines []string
+	for _, m := range pyStringRe.FindAllStringSubmatch(s, -1) {
+		lines = append(lines, m[1]+m[2])
+	}
+	return strings.Join(lines, "\n")
+}
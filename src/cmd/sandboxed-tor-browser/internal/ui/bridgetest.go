@@ -0,0 +1,96 @@
+// bridgetest.go - Custom bridge reachability testing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+const bridgeTestDir = "bridge-test"
+
+// TestCustomBridges tests the reachability of each of the custom bridge
+// lines, with a temporary sandboxed tor instance that uses a throwaway data
+// directory.  The running tor instance (if any), and the config are left
+// untouched.  The per-line results are stored in results, before the task
+// is signaled as done.
+func (c *Common) TestCustomBridges(async *Async, lines string, results *[]*tor.BridgeTestResult) {
+	async.Err = nil
+	defer func() {
+		if len(async.Cancel) > 0 {
+			<-async.Cancel
+		}
+		if async.Err != nil {
+			log.Printf("ui: Bridge test failed: %v", async.Err)
+		}
+		runtime.GC()
+		async.Done <- true
+	}()
+
+	lines, err := ValidateBridgeLines(lines)
+	if err != nil {
+		async.Err = err
+		return
+	}
+	if lines == "" {
+		async.Err = fmt.Errorf("no bridges to test")
+		return
+	}
+	if c.NeedsInstall() {
+		async.Err = fmt.Errorf("Tor Browser must be installed to test bridges")
+		return
+	}
+
+	// The temporary tor gets a config of it's own, so that nothing
+	// (the generated control port password included) leaks back into the
+	// real one.
+	cfg := *c.Cfg
+	cfg.TorDataDir = filepath.Join(c.Cfg.RuntimeDir, bridgeTestDir)
+	cfg.Tor.UseBridges = true
+	cfg.Tor.UseCustomBridges = true
+	cfg.Tor.CustomBridges = lines
+	cfg.Tor.EphemeralState = true
+	cfg.Tor.KeepConsensusCache = false
+
+	os.RemoveAll(cfg.TorDataDir)
+	defer os.RemoveAll(cfg.TorDataDir)
+
+	torrc, err := tor.CfgToSandboxTorrc(&cfg, c.Manif, Bridges)
+	if err != nil {
+		async.Err = err
+		return
+	}
+
+	async.UpdateProgress("Launching Tor executable.")
+	process, err := sandbox.RunTor(&cfg, c.Manif, torrc)
+	if err != nil {
+		async.Err = err
+		return
+	}
+	t := tor.NewSandboxedTor(&cfg, process)
+	defer t.Shutdown()
+
+	*results, async.Err = t.TestBridges(&cfg, strings.Split(lines, "\n"), async)
+}
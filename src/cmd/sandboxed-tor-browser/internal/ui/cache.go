@@ -0,0 +1,108 @@
+// cache.go - Persistent disk cache management.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime int64
+}
+
+func (c *Common) cacheFiles() ([]*cacheFile, int64, error) {
+	var files []*cacheFile
+	var total int64
+	err := filepath.Walk(c.Cfg.BrowserCacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, &cacheFile{path, info.Size(), info.ModTime().UnixNano()})
+			total += info.Size()
+		}
+		return nil
+	})
+	return files, total, err
+}
+
+// BrowserCacheSize returns the size of the persistent disk cache in bytes.
+func (c *Common) BrowserCacheSize() (int64, error) {
+	_, total, err := c.cacheFiles()
+	return total, err
+}
+
+// TrimBrowserCache removes the least recently modified entries from the
+// persistent disk cache until it is under the configured size limit.  Tor
+// Browser must not be running.
+func (c *Common) TrimBrowserCache() error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("failed to trim the cache, Tor Browser is running")
+	}
+	files, total, err := c.cacheFiles()
+	if err != nil {
+		return err
+	}
+	limit := c.Cfg.Sandbox.GetPersistentCacheSize()
+	if total <= limit {
+		return nil
+	}
+
+	log.Printf("ui: Trimming the disk cache (%d bytes, limit %d).", total, limit)
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime < files[j].modTime })
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= f.size
+	}
+
+	// The cache index no longer matches the entries, so have Firefox
+	// rebuild it.
+	indexes, _ := filepath.Glob(filepath.Join(c.Cfg.BrowserCacheDir, "*", "cache2", "index"))
+	for _, p := range indexes {
+		os.Remove(p)
+	}
+	return nil
+}
+
+// ClearBrowserCache deletes the persistent disk cache.  Tor Browser must not
+// be running.
+func (c *Common) ClearBrowserCache() error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("failed to clear the cache, Tor Browser is running")
+	}
+	if !utils.DirExists(c.Cfg.BrowserCacheDir) {
+		return nil
+	}
+	log.Printf("ui: Clearing the disk cache.")
+	return os.RemoveAll(c.Cfg.BrowserCacheDir)
+}
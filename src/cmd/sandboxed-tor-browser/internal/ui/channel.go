@@ -0,0 +1,163 @@
+// channel.go - Bundle channel switching.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const profileChannelBackupPrefix = "profile-backup-"
+
+// ErrProfileDowngrade is the error returned when switching channels would
+// downgrade firefox, while keeping the existing profile.
+var ErrProfileDowngrade = errors.New("switching channels would downgrade firefox, which corrupts existing profiles")
+
+// ChannelSwitch returns the installed and configured channels, and true if
+// installing would switch channels.
+func (c *Common) ChannelSwitch() (string, string, bool) {
+	if c.Manif == nil || c.Manif.Channel == c.Cfg.Channel {
+		return "", "", false
+	}
+	return c.Manif.Channel, c.Cfg.Channel, true
+}
+
+// ChannelBackupDir returns the path where the profile from the specified
+// channel is backed up to when switching channels.
+func (c *Common) ChannelBackupDir(channel string) string {
+	return filepath.Join(c.Cfg.UserDataDir, profileChannelBackupPrefix+channel)
+}
+
+// migrateProfile carries the existing profile over to the staged bundle
+// when switching channels, optionally backing it up first.  Downgrading
+// firefox with an existing profile is refused, unless a fresh profile is
+// requested.
+func (c *Common) migrateProfile(staged *installer.StagedInstall) error {
+	from, to, ok := c.ChannelSwitch()
+	oldProfile := c.ProfileDir()
+	if !ok || !utils.DirExists(oldProfile) {
+		return nil
+	}
+
+	log.Printf("install: Switching channel: %v -> %v", from, to)
+
+	if c.ProfileBackup {
+		backupDir := c.ChannelBackupDir(from)
+		log.Printf("install: Backing up profile to: %v", backupDir)
+		if err := os.RemoveAll(backupDir); err != nil {
+			return err
+		}
+		if err := copyTree(oldProfile, backupDir); err != nil {
+			return fmt.Errorf("failed to back up profile: %v", err)
+		}
+	}
+	if c.FreshProfile {
+		log.Printf("install: Using a fresh profile.")
+		return nil
+	}
+
+	oldVer, err := installer.FirefoxMajorVersion(c.Cfg.BundleInstallDir)
+	if err != nil {
+		return fmt.Errorf("failed to determine installed firefox version: %v", err)
+	}
+	newVer, err := installer.FirefoxMajorVersion(staged.Dir())
+	if err != nil {
+		return fmt.Errorf("failed to determine new firefox version: %v", err)
+	}
+	if newVer < oldVer {
+		log.Printf("install: Refusing to downgrade firefox with an existing profile: %v -> %v", oldVer, newVer)
+		return ErrProfileDowngrade
+	}
+
+	// The old profile is copied rather than moved, so that the existing
+	// installation is intact if the install fails from here on out.  The
+	// bundled extensions must be the ones from the new bundle.
+	log.Printf("install: Migrating profile.")
+	newProfile := profileDirIn(staged.Dir())
+	bundledProfile := newProfile + ".bundled"
+	if utils.DirExists(newProfile) {
+		if err = os.Rename(newProfile, bundledProfile); err != nil {
+			return err
+		}
+		defer os.RemoveAll(bundledProfile)
+	}
+	if err = copyTree(oldProfile, newProfile); err != nil {
+		return fmt.Errorf("failed to migrate profile: %v", err)
+	}
+
+	extDir := filepath.Join(newProfile, "extensions")
+	if err = os.RemoveAll(extDir); err != nil {
+		return err
+	}
+	if bundledExtDir := filepath.Join(bundledProfile, "extensions"); utils.DirExists(bundledExtDir) {
+		if err = os.Rename(bundledExtDir, extDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(dstPath, utils.DirMode)
+		case fi.Mode().IsRegular():
+			return copyFile(path, dstPath, fi.Mode())
+		default:
+			// Firefox's profile lock is a symlink, and nothing else in a
+			// profile should be anything but regular files.
+			log.Printf("install: Skipping non-regular file: %v", rel)
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(d, s); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -18,14 +18,24 @@
 package config
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	gonet "net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	butils "git.schwanenlied.me/yawning/bulb.git/utils"
 	xdg "github.com/cep21/xdgbasedir"
@@ -41,15 +51,137 @@ const (
 	defaultLocale  = "en-US"
 	archLinux32    = "linux32"
 	archLinux64    = "linux64"
+	maxCPUWeight   = 10000
+
+	defaultTmpfsSizeLimit = 512
+
+	defaultPersistentCacheSize = 256
+	minPersistentCacheSize     = 16
+	maxPersistentCacheSize     = 16384
+
+	minBandwidthLimit = 16
+
+	defaultShutdownGracePeriod = 10
+	maxShutdownGracePeriod     = 120
+
+	maxWindowClassLen = 128
+	maxWindowIconSize = 1024 * 1024
 
 	appDir           = "sandboxed-tor-browser"
 	bundleInstallDir = "tor-browser"
 	torDataDir       = "tor"
+	browserCacheDir  = "browser-cache"
 )
 
+// DefaultWindowClass is the WM_CLASS class of the Tor Browser windows, when
+// not overridden by the user.
+const DefaultWindowClass = "Tor Browser"
+
 // TorProxyTypes are the proxy protocols supported by tor.
 var TorProxyTypes = []string{"SOCKS 4", "SOCKS 5", "HTTP(S)"}
 
+// The conflux modes supported by the launcher.
+const (
+	ConfluxAutomatic = "Automatic"
+	ConfluxEnabled   = "Enabled"
+	ConfluxDisabled  = "Disabled"
+)
+
+// TorConfluxModes are the conflux modes, in display order.
+var TorConfluxModes = []string{ConfluxAutomatic, ConfluxEnabled, ConfluxDisabled}
+
+// The X11 modes supported by the sandbox.
+const (
+	// X11ModeSurrogate proxies X11 via the filtering surrogate.
+	X11ModeSurrogate = "surrogate"
+
+	// X11ModeDirect binds the host X11 socket into the sandbox, with no
+	// filtering what so ever.
+	X11ModeDirect = "direct"
+
+	// X11ModeDisabled does not provide X11 access, so Tor Browser will not
+	// be launched.
+	X11ModeDisabled = "disabled"
+)
+
+// The ways Tor Browser may connect to the SOCKS surrogate.
+const (
+	// SocksListenerAuto uses the AF_LOCAL socket directly if the bundle is
+	// new enough to support it, and TCP otherwise.
+	SocksListenerAuto = "auto"
+
+	// SocksListenerTCP uses the (fake) TCP listener via the stub.
+	SocksListenerTCP = "tcp"
+
+	// SocksListenerUnix uses the AF_LOCAL socket directly.
+	SocksListenerUnix = "unix"
+)
+
+// The ways the SOCKS passthrough for host applications may be exposed.
+const (
+	// SocksPassthroughTCP listens on a loopback TCP address.
+	SocksPassthroughTCP = "tcp"
+
+	// SocksPassthroughUnix listens on an AF_LOCAL socket in the runtime
+	// directory, so only the user can connect.
+	SocksPassthroughUnix = "unix"
+
+	// SocksPassthroughAbstract listens on an abstract AF_LOCAL socket.  Like
+	// the TCP listener, any process in the host network namespace can
+	// connect.
+	SocksPassthroughAbstract = "abstract"
+
+	// SocksPassthroughDisabled does not provide a passthrough.
+	SocksPassthroughDisabled = "disabled"
+
+	// DefaultSocksPassthroughAddr is the default TCP passthrough address,
+	// matching the Tor Browser Bundle.
+	DefaultSocksPassthroughAddr = "127.0.0.1:9150"
+)
+
+// The schemes used to generate the SOCKS isolation credentials.
+const (
+	// IsolationSchemeLaunch uses a random credential that is regenerated
+	// every launch, and on New Identity.
+	IsolationSchemeLaunch = "launch"
+
+	// IsolationSchemeProfile uses a random credential that is stored in the
+	// config, so that it is stable across launches.  It is still
+	// regenerated on New Identity.
+	IsolationSchemeProfile = "profile"
+
+	// IsolationSchemePrefix is IsolationSchemeLaunch, with the user
+	// supplied IsolationPrefix prepended to each credential.
+	IsolationSchemePrefix = "prefix"
+
+	// maxIsolationPrefix is the maximum length of an isolation prefix.
+	maxIsolationPrefix = 64
+
+	// IsolationTagSize is the size of a random isolation credential.
+	IsolationTagSize = 16
+)
+
+// The behaviors when the HPKP pins for install/update related hosts have
+// expired.
+const (
+	// PinPolicyFailOpen ignores the expired pins, and relies on the system
+	// certificate store alone.
+	PinPolicyFailOpen = "fail-open"
+
+	// PinPolicyFailClosed refuses to connect to the hosts with expired
+	// pins, until fresh pins are obtained via a policy pack.
+	PinPolicyFailClosed = "fail-closed"
+)
+
+// The optional sandbox subsystems that can be forcibly disabled when
+// attempting to recover from a crash loop.
+const (
+	SafeModeAVCodec = 1 << iota
+	SafeModePulseAudio
+	SafeModeTheme
+	SafeModeAmnesiacProfile
+)
+
 // Tor contains the Tor network config options.
 type Tor struct {
 	cfg *Config
@@ -86,11 +218,135 @@ type Tor struct {
 	// bridges for load balancing purposes.
 	InternalBridgeSeed int64 `json:"internalBridgeSeed"`
 
+	// ProbeBridges is if the internal bridges should be probed for
+	// reachability prior to launching tor.
+	ProbeBridges bool `json:"probeBridges"`
+
+	// BridgeStats is the probe history of the internal bridges, by address.
+	BridgeStats map[string]*BridgeStat `json:"bridgeStats,omitEmpty"`
+
 	// UseCustomBridges is if the user provided bridges should be used.
 	UseCustomBridges bool `json:"useCustomBridges"`
 
 	// CustomBridges is the user provided bridge lines.
 	CustomBridges string `json:"customBridges"`
+
+	// ConfluxMode is if tor should use conflux (multipath circuits), when
+	// supported.  If omitted, the network consensus decides.
+	ConfluxMode string `json:"confluxMode,omitEmpty"`
+
+	// ExtraTorrc is the user provided torrc lines, appended to the generated
+	// torrc.
+	ExtraTorrc string `json:"extraTorrc,omitEmpty"`
+
+	// KeepRunning is if the sandboxed tor daemon should be kept running
+	// across browser restarts and updates, and only stopped when the
+	// launcher exits.
+	KeepRunning bool `json:"keepRunning,omitEmpty"`
+
+	// EphemeralState is if the sandboxed tor daemon should keep it's state
+	// (including the guards) in a tmpfs, so that each launch starts afresh.
+	EphemeralState bool `json:"ephemeralState,omitEmpty"`
+
+	// KeepConsensusCache is if the consensus and descriptor caches should
+	// still be persisted when EphemeralState is set.
+	KeepConsensusCache bool `json:"keepConsensusCache,omitEmpty"`
+
+	// KillStrayTor is if sandboxed tor processes that outlive their
+	// sandbox being shut down should be killed, instead of just logged.
+	KillStrayTor bool `json:"killStrayTor,omitEmpty"`
+
+	// CustomTorPath is the host tor binary to use instead of the bundled
+	// one.  Pluggable transport binaries in the same directory, that share
+	// a name with a bundled transport, are used instead of the bundled ones.
+	CustomTorPath string `json:"customTorPath,omitEmpty"`
+
+	// SocksPassthrough is how the SOCKS passthrough for host applications
+	// is exposed.  If omitted, `SocksPassthroughTCP` will be used.
+	SocksPassthrough string `json:"socksPassthrough,omitEmpty"`
+
+	// SocksPassthroughAddr is the address of the TCP SOCKS passthrough.  If
+	// omitted, `DefaultSocksPassthroughAddr` will be used.
+	SocksPassthroughAddr string `json:"socksPassthroughAddr,omitEmpty"`
+
+	// BandwidthLimit is the limit in KiB/s on the traffic through the SOCKS
+	// surrogate and passthrough, shared by every connection, and applied to
+	// each direction separately.  0 is unlimited.
+	BandwidthLimit int `json:"bandwidthLimit,omitEmpty"`
+
+	// ConnBandwidthLimit is the limit in KiB/s on the traffic of each
+	// connection through the SOCKS surrogate and passthrough, applied to
+	// each direction separately.  0 is unlimited.
+	ConnBandwidthLimit int `json:"connBandwidthLimit,omitEmpty"`
+
+	// Containers are the named stream isolation containers.
+	Containers []*Container `json:"containers,omitEmpty"`
+
+	// Container is the name of the container Tor Browser should use.  If
+	// omitted, a throwaway isolation credential is used.
+	Container string `json:"container,omitEmpty"`
+
+	// IsolationScheme is how the SOCKS isolation credentials are generated.
+	// If omitted, `IsolationSchemeLaunch` will be used.
+	IsolationScheme string `json:"isolationScheme,omitEmpty"`
+
+	// IsolationPrefix is the user supplied prefix of the SOCKS isolation
+	// credentials, used with `IsolationSchemePrefix`.
+	IsolationPrefix string `json:"isolationPrefix,omitEmpty"`
+
+	// IsolationTag is the stored isolation credential, as hex, used with
+	// `IsolationSchemeProfile`.
+	IsolationTag string `json:"isolationTag,omitEmpty"`
+}
+
+// Container is a named stream isolation container.  Each container has it's
+// own SOCKS isolation credential, so streams from different containers never
+// share circuits.
+type Container struct {
+	// Name is the human readable name of the container.
+	Name string `json:"name"`
+
+	// Persistent is if the isolation credential should be kept across
+	// launches and New Identity, instead of being regenerated.
+	Persistent bool `json:"persistent"`
+
+	// Tag is the isolation credential of a persistent container, as hex.
+	Tag string `json:"tag,omitEmpty"`
+}
+
+const (
+	// maxContainerName is the maximum length of a container name.
+	maxContainerName = 64
+
+	// ContainerTagSize is the size of a container isolation credential.
+	ContainerTagSize = 16
+)
+
+// ValidateContainerName returns nil iff the container name is usable.
+func ValidateContainerName(s string) error {
+	if s == "" {
+		return fmt.Errorf("container name is empty")
+	} else if len(s) > maxContainerName {
+		return fmt.Errorf("container name is longer than %d bytes", maxContainerName)
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("container name has non-printable characters")
+		}
+	}
+	return nil
+}
+
+// BridgeStat is the reachability probe history of a bridge.
+type BridgeStat struct {
+	// Failures is the number of consecutive failed probes.
+	Failures int `json:"failures"`
+
+	// RTT is the time taken by the last successful probe in milliseconds.
+	RTT int64 `json:"rtt"`
+
+	// LastProbe is the time of the last probe in seconds since the epoch.
+	LastProbe int64 `json:"lastProbe"`
 }
 
 // SetUseProxy sets if the Tor network should be reached via a local proxy and
@@ -120,6 +376,23 @@ func (t *Tor) SetProxyAddress(s string) {
 	}
 }
 
+// ValidateProxyAddress validates a proxy address, and returns it in the
+// form stored in the config.  Bracketed IPv6 literals are accepted, but IPv6
+// zone IDs are not, since tor does not support them.
+func ValidateProxyAddress(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if strings.Contains(s, "%") {
+		return "", fmt.Errorf("IPv6 zone IDs are not supported: '%v'", s)
+	}
+	if gonet.ParseIP(s) == nil {
+		return "", fmt.Errorf("malformed proxy address: '%v'", s)
+	}
+	return s, nil
+}
+
 // SetProxyPort sets the proxy port to be used by tor and marks the config
 // dirty.
 func (t *Tor) SetProxyPort(s string) {
@@ -183,6 +456,51 @@ func (t *Tor) SetCustomBridges(s string) {
 	}
 }
 
+// SetProbeBridges sets if the internal bridges should be probed for
+// reachability, and marks the config dirty.
+func (t *Tor) SetProbeBridges(b bool) {
+	if t.ProbeBridges != b {
+		t.ProbeBridges = b
+		t.cfg.isDirty = true
+	}
+}
+
+// RecordBridgeProbe records the result of a bridge reachability probe, and
+// marks the config dirty.
+func (t *Tor) RecordBridgeProbe(addr string, ok bool, rtt time.Duration) {
+	if t.BridgeStats == nil {
+		t.BridgeStats = make(map[string]*BridgeStat)
+	}
+	st := t.BridgeStats[addr]
+	if st == nil {
+		st = new(BridgeStat)
+		t.BridgeStats[addr] = st
+	}
+	if ok {
+		st.Failures = 0
+		st.RTT = int64(rtt / time.Millisecond)
+	} else {
+		st.Failures++
+	}
+	st.LastProbe = time.Now().Unix()
+	t.cfg.isDirty = true
+}
+
+// PruneBridgeStats removes the probe history of every bridge that is not in
+// addrs, and marks the config dirty if anything was removed.
+func (t *Tor) PruneBridgeStats(addrs []string) {
+	keep := make(map[string]bool)
+	for _, v := range addrs {
+		keep[v] = true
+	}
+	for k := range t.BridgeStats {
+		if !keep[k] {
+			delete(t.BridgeStats, k)
+			t.cfg.isDirty = true
+		}
+	}
+}
+
 // SetUseCustomBridges sets if the user provided custom bridges should be used
 // and marks the config dirty.
 func (t *Tor) SetUseCustomBridges(b bool) {
@@ -192,77 +510,771 @@ func (t *Tor) SetUseCustomBridges(b bool) {
 	}
 }
 
+// SetConfluxMode sets the conflux mode and marks the config dirty.
+func (t *Tor) SetConfluxMode(s string) {
+	if t.ConfluxMode != s {
+		t.ConfluxMode = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetSocksPassthrough sets the SOCKS passthrough mode and marks the config
+// dirty.
+func (t *Tor) SetSocksPassthrough(s string) {
+	if t.SocksPassthrough != s {
+		t.SocksPassthrough = s
+		t.cfg.isDirty = true
+	}
+}
+
+// GetSocksPassthrough returns the SOCKS passthrough mode.
+func (t *Tor) GetSocksPassthrough() string {
+	if t.SocksPassthrough == "" {
+		return SocksPassthroughTCP
+	}
+	return t.SocksPassthrough
+}
+
+// SetSocksPassthroughAddr sets the TCP SOCKS passthrough address and marks
+// the config dirty.
+func (t *Tor) SetSocksPassthroughAddr(s string) {
+	if t.SocksPassthroughAddr != s {
+		t.SocksPassthroughAddr = s
+		t.cfg.isDirty = true
+	}
+}
+
+// GetSocksPassthroughAddr returns the TCP SOCKS passthrough address.
+func (t *Tor) GetSocksPassthroughAddr() string {
+	if t.SocksPassthroughAddr == "" {
+		return DefaultSocksPassthroughAddr
+	}
+	return t.SocksPassthroughAddr
+}
+
+// SetBandwidthLimit sets the total surrogate bandwidth limit and marks the
+// config dirty.
+func (t *Tor) SetBandwidthLimit(i int) {
+	if t.BandwidthLimit != i {
+		t.BandwidthLimit = i
+		t.cfg.isDirty = true
+	}
+}
+
+// GetBandwidthLimit returns the total surrogate bandwidth limit in bytes per
+// second, or 0 if unlimited.
+func (t *Tor) GetBandwidthLimit() int64 {
+	return int64(t.BandwidthLimit) * 1024
+}
+
+// SetConnBandwidthLimit sets the per-connection surrogate bandwidth limit and
+// marks the config dirty.
+func (t *Tor) SetConnBandwidthLimit(i int) {
+	if t.ConnBandwidthLimit != i {
+		t.ConnBandwidthLimit = i
+		t.cfg.isDirty = true
+	}
+}
+
+// GetConnBandwidthLimit returns the per-connection surrogate bandwidth limit
+// in bytes per second, or 0 if unlimited.
+func (t *Tor) GetConnBandwidthLimit() int64 {
+	return int64(t.ConnBandwidthLimit) * 1024
+}
+
+// ParseBandwidthLimit parses a bandwidth limit in KiB/s.  An empty string or
+// 0 is unlimited.
+func ParseBandwidthLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("malformed bandwidth limit: '%v'", s)
+	}
+	if i > 0 && i < minBandwidthLimit {
+		return 0, fmt.Errorf("bandwidth limit must be at least %d KiB/s", minBandwidthLimit)
+	}
+	return int(i), nil
+}
+
+// ParseMemoryLimit parses a sandbox memory limit in MiB.  An empty string or
+// 0 is unlimited.
+func ParseMemoryLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("malformed memory limit: '%v'", s)
+	}
+	return int(i), nil
+}
+
+// ParseCPUWeight parses a sandbox CPU weight.  An empty string or 0 leaves
+// the weight unchanged.
+func ParseCPUWeight(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("malformed CPU weight: '%v'", s)
+	}
+	if i > maxCPUWeight {
+		return 0, fmt.Errorf("CPU weight must be at most %d", maxCPUWeight)
+	}
+	return int(i), nil
+}
+
+// ValidateSocksPassthroughAddr returns nil iff the address is a usable TCP
+// SOCKS passthrough address.  Only loopback addresses are allowed, since the
+// passthrough is unauthenticated.
+func ValidateSocksPassthroughAddr(s string) error {
+	host, port, err := gonet.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if ip := gonet.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("'%v' is not a loopback address", host)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port: '%v'", port)
+	}
+	return nil
+}
+
+// GetContainer returns the container Tor Browser should use, or nil if a
+// throwaway isolation credential should be used.
+func (t *Tor) GetContainer() *Container {
+	for _, c := range t.Containers {
+		if c.Name == t.Container {
+			return c
+		}
+	}
+	return nil
+}
+
+// SetContainer sets the name of the container Tor Browser should use and
+// marks the config dirty.
+func (t *Tor) SetContainer(s string) {
+	if t.Container != s {
+		t.Container = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetContainerTag sets the isolation credential of the named container and
+// marks the config dirty.
+func (t *Tor) SetContainerTag(name, tag string) {
+	for _, c := range t.Containers {
+		if c.Name == name && c.Tag != tag {
+			c.Tag = tag
+			t.cfg.isDirty = true
+		}
+	}
+}
+
+// SetIsolationScheme sets the SOCKS isolation credential scheme and marks
+// the config dirty.
+func (t *Tor) SetIsolationScheme(s string) {
+	if t.IsolationScheme != s {
+		t.IsolationScheme = s
+		t.cfg.isDirty = true
+	}
+}
+
+// GetIsolationScheme returns the SOCKS isolation credential scheme.
+func (t *Tor) GetIsolationScheme() string {
+	if t.IsolationScheme == "" {
+		return IsolationSchemeLaunch
+	}
+	return t.IsolationScheme
+}
+
+// SetIsolationPrefix sets the SOCKS isolation credential prefix and marks
+// the config dirty.
+func (t *Tor) SetIsolationPrefix(s string) {
+	if t.IsolationPrefix != s {
+		t.IsolationPrefix = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetIsolationTag sets the stored SOCKS isolation credential and marks the
+// config dirty.
+func (t *Tor) SetIsolationTag(s string) {
+	if t.IsolationTag != s {
+		t.IsolationTag = s
+		t.cfg.isDirty = true
+	}
+}
+
+// ValidateIsolationPrefix returns nil iff the isolation prefix is usable.
+// The prefix ends up in the SOCKS username and password, so it is limited
+// to a short run of printable ASCII.
+func ValidateIsolationPrefix(s string) error {
+	if s == "" {
+		return fmt.Errorf("isolation prefix is empty")
+	} else if len(s) > maxIsolationPrefix {
+		return fmt.Errorf("isolation prefix is longer than %d bytes", maxIsolationPrefix)
+	}
+	for _, r := range s {
+		if r <= ' ' || r > '~' {
+			return fmt.Errorf("isolation prefix contains an invalid character")
+		}
+	}
+	return nil
+}
+
+// SetKeepRunning sets if the sandboxed tor daemon should be kept running
+// across browser restarts and marks the config dirty.
+func (t *Tor) SetKeepRunning(b bool) {
+	if t.KeepRunning != b {
+		t.KeepRunning = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetEphemeralState sets if the sandboxed tor state should be ephemeral and
+// marks the config dirty.
+func (t *Tor) SetEphemeralState(b bool) {
+	if t.EphemeralState != b {
+		t.EphemeralState = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetKeepConsensusCache sets if the consensus cache should be persisted with
+// ephemeral tor state and marks the config dirty.
+func (t *Tor) SetKeepConsensusCache(b bool) {
+	if t.KeepConsensusCache != b {
+		t.KeepConsensusCache = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetKillStrayTor sets if stray sandboxed tor processes should be killed and
+// marks the config dirty.
+func (t *Tor) SetKillStrayTor(b bool) {
+	if t.KillStrayTor != b {
+		t.KillStrayTor = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetCustomTorPath sets the host tor binary to use instead of the bundled
+// one and marks the config dirty.
+func (t *Tor) SetCustomTorPath(s string) {
+	if t.CustomTorPath != s {
+		t.CustomTorPath = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetExtraTorrc sets the user provided torrc lines and marks the config
+// dirty.
+func (t *Tor) SetExtraTorrc(s string) {
+	if t.ExtraTorrc != s {
+		t.ExtraTorrc = s
+		t.cfg.isDirty = true
+	}
+}
+
 // Sandbox contains the sandbox specific config options.
 type Sandbox struct {
 	cfg *Config
 
-	// Display is the X11 DISPLAY to use in the sandbox.  If omitted, the
-	// host system DISPLAY from the env var will be used.
-	Display string `json:"display,omitEmpty"`
+	// Display is the X11 DISPLAY to use in the sandbox.  If omitted, the
+	// host system DISPLAY from the env var will be used.
+	Display string `json:"display,omitEmpty"`
+
+	// Screen is the host X11 screen to expose to the sandbox.  If omitted,
+	// the screen number from the display (eg: `:0.1`) will be used.
+	Screen int `json:"screen,omitEmpty"`
+
+	// NormalizeX11Screens hides the monitor layout from Tor Browser, so
+	// that only a single screen the size of the root window is visible.
+	NormalizeX11Screens bool `json:"normalizeX11Screens"`
+
+	// SocksListener is how Tor Browser connects to the SOCKS surrogate.  If
+	// omitted, `SocksListenerAuto` will be used.
+	SocksListener string `json:"socksListener,omitEmpty"`
+
+	// X11Mode is how X11 access is provided to the sandbox.  If omitted,
+	// `X11ModeSurrogate` will be used.
+	X11Mode string `json:"x11Mode,omitEmpty"`
+
+	// X11EnableExtensions is the list of additional X11 extensions that the
+	// surrogate allows (eg: `XVideo`, `DPMS`).  Extensions known to be
+	// unsafe are rejected.
+	X11EnableExtensions []string `json:"x11EnableExtensions,omitEmpty"`
+
+	// X11DisableExtensions is the list of X11 extensions that the surrogate
+	// denies, that would otherwise be allowed.
+	X11DisableExtensions []string `json:"x11DisableExtensions,omitEmpty"`
+
+	// WindowClass is the X11 WM_CLASS class of the Tor Browser windows.  If
+	// omitted, `DefaultWindowClass` will be used.
+	WindowClass string `json:"windowClass,omitEmpty"`
+
+	// WindowName is the X11 WM_CLASS instance name of the Tor Browser
+	// windows.  If omitted, firefox's default will be used.
+	WindowName string `json:"windowName,omitEmpty"`
+
+	// WindowIcon is the absolute path to a PNG icon used for the Tor Browser
+	// windows and the launcher, so that the instances for different
+	// profiles can be told apart.  If omitted, the bundle's icon will be
+	// used.
+	WindowIcon string `json:"windowIcon,omitEmpty"`
+
+	// EnablePulseAudio enables access to the host PulseAudio daemon inside the
+	// sandbox.
+	EnablePulseAudio bool `json:"enablePulseAudio"`
+
+	// EnableAVCodec enables extra codecs via ffmpeg's libavcodec.so inside
+	// the sandbox.
+	EnableAVCodec bool `json:"enableAVCodec"`
+
+	// EnableCircuitDisplay enables the Tor Browser circuit display.
+	EnableCircuitDisplay bool `json:"enableCircuitDisplay"`
+
+	// BrokerClipboard denies Tor Browser access to the host clipboard,
+	// except for individual transfers explicitly allowed by the user.
+	BrokerClipboard bool `json:"brokerClipboard"`
+
+	// EnableHostDictionaries enables access to the host hunspell
+	// dictionaries inside the sandbox, for locales that the bundle does not
+	// have dictionaries for.
+	EnableHostDictionaries bool `json:"enableHostDictionaries"`
+
+	// StrictMediaProcesses enables an additional seccomp filter that denies
+	// networking and exec to the GPU and RDD processes.
+	StrictMediaProcesses bool `json:"strictMediaProcesses"`
+
+	// ConsistentFonts restricts fontconfig to the bundled fonts, with a per
+	// session cache, so that the host fonts can not be fingerprinted.
+	ConsistentFonts bool `json:"consistentFonts,omitEmpty"`
+
+	// EnableAmnesiacProfileDirectory enables amnesiac profile directories.
+	EnableAmnesiacProfileDirectory bool `json:"enableAmnesiacProfileDirectory"`
+
+	// PersistExtensionSettings keeps the settings of the security related
+	// extensions (NoScript, HTTPS Everywhere) across launches, when the
+	// amnesiac profile directory is enabled.
+	PersistExtensionSettings bool `json:"persistExtensionSettings,omitEmpty"`
+
+	// DesktopDir is the directory to be bind mounted instead of the default
+	// bundle Desktop directory.
+	DesktopDir string `json:"desktopDir,omitEmpty"`
+
+	// DownloadsDir is the directory to be bind mounted instead of the default
+	// bundle Downloads directory.
+	DownloadsDir string `json:"downloadsDir,omitEmpty"`
+
+	// WatchDownloads enables notifications for completed downloads, from
+	// the host side of the Downloads directory.
+	WatchDownloads bool `json:"watchDownloads"`
+
+	// WatchBundle enables alerting on modifications to the bundle's binaries
+	// while Tor Browser is running, which can only come from the host.
+	WatchBundle bool `json:"watchBundle"`
+
+	// DownloadsCommand is the command (eg: `["clamscan", "--no-summary"]`)
+	// to be run on the host with the path of each completed download
+	// appended, if WatchDownloads is enabled.
+	DownloadsCommand []string `json:"downloadsCommand,omitEmpty"`
+
+	// RelabelSharedDirs resets the SELinux labels of files written to the
+	// Desktop and Downloads directories to the host policy defaults, by
+	// running `restorecon` on the host, so that other confined applications
+	// can use them.
+	RelabelSharedDirs bool `json:"relabelSharedDirs,omitEmpty"`
+
+	// ViewerCommand is the document viewer (eg: `["evince"]`) that
+	// completed downloads can be opened with from the download
+	// notification.  The viewer is run in its own sandbox, without network
+	// access, and with the Downloads directory mounted read-only.
+	ViewerCommand []string `json:"viewerCommand,omitEmpty"`
+
+	// MemoryLimit is the maximum amount of memory in MiB that the Tor
+	// Browser sandbox may use, enforced via cgroups.  0 is unlimited.
+	MemoryLimit int `json:"memoryLimit,omitEmpty"`
+
+	// TmpfsSizeLimit is the maximum size in MiB of each of the Tor Browser
+	// sandbox tmpfs mounts (`/tmp` and the caches).  0 is the default
+	// (512 MiB), and -1 is unlimited.
+	TmpfsSizeLimit int `json:"tmpfsSizeLimit,omitEmpty"`
+
+	// PersistentCache is if the Tor Browser disk cache should be kept on
+	// disk across sessions, instead of in a tmpfs.  This trades privacy
+	// (the cache records what was visited, and can be used to track the
+	// user across sessions) for bandwidth.  It is ignored when the amnesiac
+	// profile directory is enabled.
+	PersistentCache bool `json:"persistentCache,omitEmpty"`
+
+	// PersistentCacheSize is the maximum size in MiB of the persistent disk
+	// cache, enforced by the launcher.  0 is the default (256 MiB).
+	PersistentCacheSize int `json:"persistentCacheSize,omitEmpty"`
+
+	// ShutdownGracePeriod is the time in seconds that Tor Browser is given to
+	// exit cleanly when the launcher is terminated, or restarts the browser,
+	// before it is killed.  0 is the default (10 seconds), and -1 kills the
+	// browser immediately.
+	ShutdownGracePeriod int `json:"shutdownGracePeriod,omitEmpty"`
+
+	// CPUWeight is the cgroup CPU weight (1-10000, default 100) of the Tor
+	// Browser sandbox.  0 leaves the weight unchanged.
+	CPUWeight int `json:"cpuWeight,omitEmpty"`
+
+	// EnablePause allows the Tor Browser sandbox to be paused (SIGUSR1) and
+	// resumed (SIGUSR2), which requires a dedicated cgroup.
+	EnablePause bool `json:"enablePause,omitEmpty"`
+
+	// ContainerCompat enables a degraded sandbox for when the launcher is
+	// run inside a container (Docker, LXC, etc), which skips the cgroup
+	// namespace and limits, and falls back to a skeletal `/proc` if the
+	// container masks the host's.
+	ContainerCompat bool `json:"containerCompat,omitEmpty"`
+
+	// ExtraEnv is additional environment variables to set in the Tor
+	// Browser sandbox (eg: `MOZ_X11_EGL`).  Variables that the sandbox sets,
+	// or that leak information about the host are ignored.
+	ExtraEnv map[string]string `json:"extraEnv,omitEmpty"`
+
+	// SafeMode is the set of optional subsystems that are disabled for the
+	// current launch, regardless of the configuration.
+	SafeMode int `json:"-"`
+
+	// Relink forces the Tor Browser libraries to be re-resolved on the next
+	// launch, instead of reusing the pinned set.
+	Relink bool `json:"-"`
+}
+
+// SetDisplay sets the sandbox `DISPLAY` override and marks the config dirty.
+func (sb *Sandbox) SetDisplay(s string) {
+	if sb.Display != s {
+		sb.Display = s
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetScreen sets the sandbox X11 screen override and marks the config dirty.
+func (sb *Sandbox) SetScreen(i int) {
+	if sb.Screen != i {
+		sb.Screen = i
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetNormalizeX11Screens sets the X11 screen normalization enable and marks
+// the config dirty.
+func (sb *Sandbox) SetNormalizeX11Screens(b bool) {
+	if sb.NormalizeX11Screens != b {
+		sb.NormalizeX11Screens = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetSocksListener sets the SOCKS listener mode and marks the config dirty.
+func (sb *Sandbox) SetSocksListener(s string) {
+	if sb.SocksListener != s {
+		sb.SocksListener = s
+		sb.cfg.isDirty = true
+	}
+}
+
+// GetSocksListener returns the SOCKS listener mode.
+func (sb *Sandbox) GetSocksListener() string {
+	if sb.SocksListener == "" {
+		return SocksListenerAuto
+	}
+	return sb.SocksListener
+}
+
+// SetX11Mode sets the X11 mode and marks the config dirty.
+func (sb *Sandbox) SetX11Mode(s string) {
+	if sb.X11Mode != s {
+		sb.X11Mode = s
+		sb.cfg.isDirty = true
+	}
+}
+
+// GetX11Mode returns the X11 mode.
+func (sb *Sandbox) GetX11Mode() string {
+	if sb.X11Mode == "" {
+		return X11ModeSurrogate
+	}
+	return sb.X11Mode
+}
+
+// SetWindowClass sets the Tor Browser WM_CLASS class override and marks the
+// config dirty.
+func (sb *Sandbox) SetWindowClass(s string) {
+	if sb.WindowClass != s {
+		sb.WindowClass = s
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetWindowName sets the Tor Browser WM_CLASS instance name override and marks
+// the config dirty.
+func (sb *Sandbox) SetWindowName(s string) {
+	if sb.WindowName != s {
+		sb.WindowName = s
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetWindowIcon sets the Tor Browser window icon override and marks the
+// config dirty.
+func (sb *Sandbox) SetWindowIcon(s string) {
+	if sb.WindowIcon != s {
+		sb.WindowIcon = s
+		sb.cfg.isDirty = true
+	}
+}
+
+// GetWindowClass returns the WM_CLASS class of the Tor Browser windows.
+func (sb *Sandbox) GetWindowClass() string {
+	if sb.WindowClass == "" {
+		return DefaultWindowClass
+	}
+	return sb.WindowClass
+}
+
+// ValidateWindowClass returns an error if the string is not suitable for use
+// as a WM_CLASS class or instance name.
+func ValidateWindowClass(s string) error {
+	if s == "" {
+		return fmt.Errorf("empty window class")
+	}
+	if len(s) > maxWindowClassLen {
+		return fmt.Errorf("window class too long: %d bytes", len(s))
+	}
+	// Passed as a command line argument to firefox, so it must not be
+	// mistaken for an option.
+	if s[0] == '-' {
+		return fmt.Errorf("window class begins with '-': '%s'", s)
+	}
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("window class contains non-printable characters: %q", s)
+		}
+	}
+	return nil
+}
+
+// ValidateWindowIcon returns an error if the file is not suitable for use as
+// the window icon.
+func ValidateWindowIcon(path string) error {
+	pngMagic := []byte("\x89PNG\r\n\x1a\n")
+
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("window icon path is not absolute: '%s'", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	} else if !fi.Mode().IsRegular() {
+		return fmt.Errorf("window icon is not a regular file: '%s'", path)
+	} else if fi.Size() > maxWindowIconSize {
+		return fmt.Errorf("window icon too large: %d bytes", fi.Size())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := make([]byte, len(pngMagic))
+	if _, err = io.ReadFull(f, hdr); err != nil || !bytes.Equal(hdr, pngMagic) {
+		return fmt.Errorf("window icon is not a PNG: '%s'", path)
+	}
+	return nil
+}
+
+// SetEnablePulseAudio sets the sandbox pulse audo enable and marks the config
+// dirty.
+func (sb *Sandbox) SetEnablePulseAudio(b bool) {
+	if sb.EnablePulseAudio != b {
+		sb.EnablePulseAudio = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetEnableAVCodec sets the sandbox libavcodec enable and marks the config
+// dirty.
+func (sb *Sandbox) SetEnableAVCodec(b bool) {
+	if sb.EnableAVCodec != b {
+		sb.EnableAVCodec = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetEnableCircuitDisplay sets the circit display enable and marks the config
+// dirty.
+func (sb *Sandbox) SetEnableCircuitDisplay(b bool) {
+	if sb.EnableCircuitDisplay != b {
+		sb.EnableCircuitDisplay = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetBrokerClipboard sets the clipboard broker enable and marks the config
+// dirty.
+func (sb *Sandbox) SetBrokerClipboard(b bool) {
+	if sb.BrokerClipboard != b {
+		sb.BrokerClipboard = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetEnableHostDictionaries sets the host dictionary enable and marks the
+// config dirty.
+func (sb *Sandbox) SetEnableHostDictionaries(b bool) {
+	if sb.EnableHostDictionaries != b {
+		sb.EnableHostDictionaries = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetStrictMediaProcesses sets the strict media process enable and marks the
+// config dirty.
+func (sb *Sandbox) SetStrictMediaProcesses(b bool) {
+	if sb.StrictMediaProcesses != b {
+		sb.StrictMediaProcesses = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetConsistentFonts sets the consistent fonts enable and marks the config
+// dirty.
+func (sb *Sandbox) SetConsistentFonts(b bool) {
+	if sb.ConsistentFonts != b {
+		sb.ConsistentFonts = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetEnableAmnesiacProfileDirectory sets the amnesiac profile directory enable
+// and marks the config dirty.
+func (sb *Sandbox) SetEnableAmnesiacProfileDirectory(b bool) {
+	if sb.EnableAmnesiacProfileDirectory != b {
+		sb.EnableAmnesiacProfileDirectory = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetPersistExtensionSettings sets the extension settings persistence enable
+// and marks the config dirty.
+func (sb *Sandbox) SetPersistExtensionSettings(b bool) {
+	if sb.PersistExtensionSettings != b {
+		sb.PersistExtensionSettings = b
+		sb.cfg.isDirty = true
+	}
+}
 
-	// EnablePulseAudio enables access to the host PulseAudio daemon inside the
-	// sandbox.
-	EnablePulseAudio bool `json:"enablePulseAudio"`
+// SetMemoryLimit sets the sandbox memory limit and marks the config dirty.
+func (sb *Sandbox) SetMemoryLimit(i int) {
+	if sb.MemoryLimit != i {
+		sb.MemoryLimit = i
+		sb.cfg.isDirty = true
+	}
+}
 
-	// EnableAVCodec enables extra codecs via ffmpeg's libavcodec.so inside
-	// the sandbox.
-	EnableAVCodec bool `json:"enableAVCodec"`
+// SetTmpfsSizeLimit sets the sandbox tmpfs size limit and marks the config
+// dirty.
+func (sb *Sandbox) SetTmpfsSizeLimit(i int) {
+	if sb.TmpfsSizeLimit != i {
+		sb.TmpfsSizeLimit = i
+		sb.cfg.isDirty = true
+	}
+}
 
-	// EnableCircuitDisplay enables the Tor Browser circuit display.
-	EnableCircuitDisplay bool `json:"enableCircuitDisplay"`
+// GetTmpfsSizeLimit returns the sandbox tmpfs size limit in bytes, or 0 if
+// the size is unlimited.
+func (sb *Sandbox) GetTmpfsSizeLimit() uint64 {
+	switch {
+	case sb.TmpfsSizeLimit < 0:
+		return 0
+	case sb.TmpfsSizeLimit == 0:
+		return defaultTmpfsSizeLimit * 1024 * 1024
+	default:
+		return uint64(sb.TmpfsSizeLimit) * 1024 * 1024
+	}
+}
 
-	// EnableAmnesiacProfileDirectory enables amnesiac profile directories.
-	EnableAmnesiacProfileDirectory bool `json:"enableAmnesiacProfileDirectory"`
+// SetPersistentCache sets if the disk cache should be persistent and marks
+// the config dirty.
+func (sb *Sandbox) SetPersistentCache(b bool) {
+	if sb.PersistentCache != b {
+		sb.PersistentCache = b
+		sb.cfg.isDirty = true
+	}
+}
 
-	// DesktopDir is the directory to be bind mounted instead of the default
-	// bundle Desktop directory.
-	DesktopDir string `json:"desktopDir,omitEmpty"`
+// SetPersistentCacheSize sets the persistent disk cache size limit and marks
+// the config dirty.
+func (sb *Sandbox) SetPersistentCacheSize(i int) {
+	if sb.PersistentCacheSize != i {
+		sb.PersistentCacheSize = i
+		sb.cfg.isDirty = true
+	}
+}
 
-	// DownloadsDir is the directory to be bind mounted instead of the default
-	// bundle Downloads directory.
-	DownloadsDir string `json:"downloadsDir,omitEmpty"`
+// GetPersistentCacheSize returns the persistent disk cache size limit in
+// bytes.
+func (sb *Sandbox) GetPersistentCacheSize() int64 {
+	if sb.PersistentCacheSize == 0 {
+		return defaultPersistentCacheSize * 1024 * 1024
+	}
+	return int64(sb.PersistentCacheSize) * 1024 * 1024
 }
 
-// SetDisplay sets the sandbox `DISPLAY` override and marks the config dirty.
-func (sb *Sandbox) SetDisplay(s string) {
-	if sb.Display != s {
-		sb.Display = s
+// SetShutdownGracePeriod sets the browser shutdown grace period and marks the
+// config dirty.
+func (sb *Sandbox) SetShutdownGracePeriod(i int) {
+	if sb.ShutdownGracePeriod != i {
+		sb.ShutdownGracePeriod = i
 		sb.cfg.isDirty = true
 	}
 }
 
-// SetEnablePulseAudio sets the sandbox pulse audo enable and marks the config
-// dirty.
-func (sb *Sandbox) SetEnablePulseAudio(b bool) {
-	if sb.EnablePulseAudio != b {
-		sb.EnablePulseAudio = b
-		sb.cfg.isDirty = true
+// GetShutdownGracePeriod returns the browser shutdown grace period, or 0 if
+// the browser is to be killed immediately.
+func (sb *Sandbox) GetShutdownGracePeriod() time.Duration {
+	switch {
+	case sb.ShutdownGracePeriod < 0:
+		return 0
+	case sb.ShutdownGracePeriod == 0:
+		return defaultShutdownGracePeriod * time.Second
+	default:
+		return time.Duration(sb.ShutdownGracePeriod) * time.Second
 	}
 }
 
-// SetEnableAVCodec sets the sandbox libavcodec enable and marks the config
-// dirty.
-func (sb *Sandbox) SetEnableAVCodec(b bool) {
-	if sb.EnableAVCodec != b {
-		sb.EnableAVCodec = b
+// SetCPUWeight sets the sandbox CPU weight and marks the config dirty.
+func (sb *Sandbox) SetCPUWeight(i int) {
+	if sb.CPUWeight != i {
+		sb.CPUWeight = i
 		sb.cfg.isDirty = true
 	}
 }
 
-// SetEnableCircuitDisplay sets the circit display enable and marks the config
-// dirty.
-func (sb *Sandbox) SetEnableCircuitDisplay(b bool) {
-	if sb.EnableCircuitDisplay != b {
-		sb.EnableCircuitDisplay = b
+// SetEnablePause sets the sandbox pause enable and marks the config dirty.
+func (sb *Sandbox) SetEnablePause(b bool) {
+	if sb.EnablePause != b {
+		sb.EnablePause = b
 		sb.cfg.isDirty = true
 	}
 }
 
-// SetEnableAmnesiacProfileDirectory sets the amnesiac profile directory enable
-// and marks the config dirty.
-func (sb *Sandbox) SetEnableAmnesiacProfileDirectory(b bool) {
-	if sb.EnableAmnesiacProfileDirectory != b {
-		sb.EnableAmnesiacProfileDirectory = b
+// SetContainerCompat sets the container compatibility mode enable and marks
+// the config dirty.
+func (sb *Sandbox) SetContainerCompat(b bool) {
+	if sb.ContainerCompat != b {
+		sb.ContainerCompat = b
 		sb.cfg.isDirty = true
 	}
 }
@@ -276,6 +1288,32 @@ func (sb *Sandbox) SetDownloadsDir(s string) {
 	}
 }
 
+// SetWatchDownloads sets the downloads watcher enable and marks the config
+// dirty.
+func (sb *Sandbox) SetWatchDownloads(b bool) {
+	if sb.WatchDownloads != b {
+		sb.WatchDownloads = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetRelabelSharedDirs sets the shared directory relabeling enable and marks
+// the config dirty.
+func (sb *Sandbox) SetRelabelSharedDirs(b bool) {
+	if sb.RelabelSharedDirs != b {
+		sb.RelabelSharedDirs = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetWatchBundle sets the bundle watcher enable and marks the config dirty.
+func (sb *Sandbox) SetWatchBundle(b bool) {
+	if sb.WatchBundle != b {
+		sb.WatchBundle = b
+		sb.cfg.isDirty = true
+	}
+}
+
 // SetDesktopDir sets the sandbox `~/Desktop` bind mount source and marks the
 // config dirty.
 func (sb *Sandbox) SetDesktopDir(s string) {
@@ -285,6 +1323,81 @@ func (sb *Sandbox) SetDesktopDir(s string) {
 	}
 }
 
+// Mirror is the install/update mirror configuration, for managed deployments
+// that can not use the Tor Project's servers directly.  The bundle and update
+// signatures are verified as usual.
+type Mirror struct {
+	cfg *Config
+
+	// DownloadsURL is the `downloads.json` URL to use instead of the
+	// channel's.  If omitted, the channel's URL will be used.
+	DownloadsURL string `json:"downloadsURL,omitEmpty"`
+
+	// UpdateURL is the update check base URL to use instead of the
+	// channel's.  If omitted, the channel's URL will be used.
+	UpdateURL string `json:"updateURL,omitEmpty"`
+
+	// Hosts is the TLS verification override for install/update related
+	// hosts (eg: an internal mirror, or `dist.torproject.org` behind a
+	// TLS-intercepting proxy), by host name.  An override replaces the HPKP
+	// pins for the host.
+	Hosts map[string]*MirrorHost `json:"hosts,omitEmpty"`
+}
+
+// MirrorHost is the TLS verification override for a single host.
+type MirrorHost struct {
+	// CAFile is the absolute path to a PEM encoded CA bundle that the host's
+	// certificate is verified against, instead of the system roots.
+	CAFile string `json:"caFile,omitEmpty"`
+
+	// Pins is the base64 encoded SHA256 SPKI pins, one of which must be
+	// present in the host's certificate chain.
+	Pins []string `json:"pins,omitEmpty"`
+}
+
+// SetDownloadsURL sets the `downloads.json` URL override and marks the config
+// dirty.
+func (m *Mirror) SetDownloadsURL(s string) {
+	if m.DownloadsURL != s {
+		m.DownloadsURL = s
+		m.cfg.isDirty = true
+	}
+}
+
+// SetUpdateURL sets the update check base URL override and marks the config
+// dirty.
+func (m *Mirror) SetUpdateURL(s string) {
+	if m.UpdateURL != s {
+		m.UpdateURL = s
+		m.cfg.isDirty = true
+	}
+}
+
+// ValidateMirrorURL returns nil iff the mirror URL is usable.
+func ValidateMirrorURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("mirror URL is not https")
+	} else if u.Host == "" {
+		return fmt.Errorf("mirror URL has no host")
+	}
+	return nil
+}
+
+// ValidateMirrorPin returns nil iff the pin is a base64 encoded SHA256 hash.
+func ValidateMirrorPin(s string) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("malformed pin: %v", err)
+	} else if len(b) != 32 {
+		return fmt.Errorf("pin is not a SHA256 hash")
+	}
+	return nil
+}
+
 // Config is the sandboxed-tor-browser configuration instance.
 type Config struct {
 	// Architecture is the current architecture derived at runtime ("linux32",
@@ -297,22 +1410,53 @@ type Config struct {
 	// Locale is the Tor Browser locale to install ("en-US", "ja").
 	Locale string `json:"locale,omitempty"`
 
+	// UILocale is the locale of the launcher's user interface ("es", "ja").
+	// If omitted, the locale will be detected from the environment.
+	UILocale string `json:"uiLocale,omitEmpty"`
+
 	// LastUpdateCheck is the UNIX time when the last update check was
 	// sucessfully completed.
 	LastUpdateCheck int64 `json:"lastUpdateCheck,omitEmpty"`
 
+	// LastPolicyCheck is the UNIX time when the last policy pack check was
+	// sucessfully completed.
+	LastPolicyCheck int64 `json:"lastPolicyCheck,omitEmpty"`
+
+	// EnableMARUpdates is set to check for, and apply MAR updates to the
+	// installed bundle.  Updates are disabled by default, until the MARs for
+	// the current bundles are known to apply cleanly.
+	EnableMARUpdates bool `json:"enableMARUpdates,omitEmpty"`
+
+	// UpdateWindow is the daily maintenance window (eg: `02:00-05:00`, in
+	// local time), during which updates found by the background update
+	// check are downloaded and staged, as long as the browser is idle.  If
+	// omitted, updates are staged as soon as they are found.
+	UpdateWindow string `json:"updateWindow,omitEmpty"`
+
 	// ForceUpdate is set if the installed bundle is known to be obsolete.
 	ForceUpdate bool `json:"forceUpdate"`
 
 	// SkipPartialUpdate is set if the partial update has failed to apply.
 	SkipPartialUpdate bool `json:"skipPartialUpdate"`
 
+	// PinPolicy is the behavior when the HPKP pins have expired.  If
+	// omitted, `PinPolicyFailOpen` will be used.
+	PinPolicy string `json:"pinPolicy,omitEmpty"`
+
+	// EventFeed is if the launcher should stream events (launches, exits,
+	// update and bootstrap progress) as JSON over an AF_LOCAL socket in the
+	// runtime directory, for external monitoring tools.
+	EventFeed bool `json:"eventFeed,omitEmpty"`
+
 	// Tor is the Tor network configuration.
 	Tor Tor `json:"tor,omitEmpty"`
 
 	// Sandbox is the sandbox configuration.
 	Sandbox Sandbox `json:"sandbox,omitEmpty"`
 
+	// Mirror is the install/update mirror configuration.
+	Mirror Mirror `json:"mirror,omitEmpty"`
+
 	// FirstLaunch is set for the first launch post install.
 	FirstLaunch bool `json:"firstLaunch"`
 
@@ -320,6 +1464,10 @@ type Config struct {
 	// the config file.
 	LastVersion string `json:"lastVersion"`
 
+	// CrashCount is the number of consecutive launches where Tor Browser
+	// exited shortly after being started.
+	CrashCount int `json:"crashCount"`
+
 	// UseSystemTor indicates if a system tor daemon should be used.
 	UseSystemTor bool `json:"-"`
 
@@ -329,9 +1477,22 @@ type Config struct {
 	// SystemTorControlAddr is the system tor daemon control port address.
 	SystemTorControlAddr string `json:"-"`
 
-	// RumtineDir is `$XDG_RUNTIME_DIR/appDir`.
+	// SystemTorControlPassword is the system tor daemon control port
+	// password, if any.
+	SystemTorControlPassword string `json:"-"`
+
+	// SystemTorControlCookieFile is the system tor daemon control port
+	// auth cookie path, if the one reported by tor should not be used.
+	SystemTorControlCookieFile string `json:"-"`
+
+	// RumtineDir is `$XDG_RUNTIME_DIR/appDir`, or a private directory under
+	// the system temporary directory if `XDG_RUNTIME_DIR` is unavailable.
 	RuntimeDir string `json:"-"`
 
+	// RuntimeDirIsFallback indicates that `XDG_RUNTIME_DIR` is unavailable,
+	// and the fallback runtime directory is being used.
+	RuntimeDirIsFallback bool `json:"-"`
+
 	// UserDataDir is `$XDG_USER_DATA_DIR/appDir`.
 	UserDataDir string `json:"-"`
 
@@ -341,6 +1502,16 @@ type Config struct {
 	// TorDataDir is `UserDataDir/torDataDir`.
 	TorDataDir string `json:"-"`
 
+	// InstanceID is the suffix of the tor and surrogate socket names, and is
+	// "" for the default instance.  Nothing sets it yet: running instances
+	// side by side also requires a lock file, tor data directory, and browser
+	// profile per instance, which is left to the multi-profile support.
+	InstanceID string `json:"-"`
+
+	// BrowserCacheDir is `UserDataDir/browserCacheDir`, the persistent
+	// disk cache, if enabled.
+	BrowserCacheDir string `json:"-"`
+
 	// ConfigDir is `XDG_CONFIG_HOME/appDir`.
 	ConfigDir string `json:"-"`
 
@@ -349,10 +1520,20 @@ type Config struct {
 	ConfigVersionChanged bool `json:"-"`
 
 	isDirty      bool
+	isNew        bool
 	path         string
 	manifestPath string
 }
 
+// SetUILocale sets the user interface locale override, and marks the config
+// dirty.
+func (cfg *Config) SetUILocale(l string) {
+	if l != cfg.UILocale {
+		cfg.UILocale = l
+		cfg.isDirty = true
+	}
+}
+
 // SetLocale sets the configured locale, and marks the config dirty.
 func (cfg *Config) SetLocale(l string) {
 	if l != cfg.Locale {
@@ -377,6 +1558,14 @@ func (cfg *Config) SetFirstLaunch(b bool) {
 	}
 }
 
+// SetCrashCount sets the consecutive crash count and marks the config dirty.
+func (cfg *Config) SetCrashCount(i int) {
+	if cfg.CrashCount != i {
+		cfg.CrashCount = i
+		cfg.isDirty = true
+	}
+}
+
 // NeedsUpdateCheck returns true if the bundle needs to be checked for updates,
 // and possibly updated.
 func (cfg *Config) NeedsUpdateCheck() bool {
@@ -394,6 +1583,116 @@ func (cfg *Config) SetLastUpdateCheck(t int64) {
 	}
 }
 
+// SetUpdateWindow sets the update maintenance window and marks the config
+// dirty.
+func (cfg *Config) SetUpdateWindow(s string) {
+	if cfg.UpdateWindow != s {
+		cfg.UpdateWindow = s
+		cfg.isDirty = true
+	}
+}
+
+// ParseUpdateWindow parses a `HH:MM-HH:MM` maintenance window, and returns
+// the start and end as offsets from midnight.  The window may wrap around
+// midnight.
+func ParseUpdateWindow(s string) (time.Duration, time.Duration, error) {
+	parseClock := func(c string) (time.Duration, error) {
+		var h, m int
+		if n, err := fmt.Sscanf(c, "%d:%d", &h, &m); err != nil || n != 2 || len(c) != 5 {
+			return 0, fmt.Errorf("malformed time: '%v'", c)
+		} else if h < 0 || h > 23 || m < 0 || m > 59 {
+			return 0, fmt.Errorf("invalid time: '%v'", c)
+		}
+		return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+	}
+
+	v := strings.Split(s, "-")
+	if len(v) != 2 {
+		return 0, 0, fmt.Errorf("malformed update window: '%v'", s)
+	}
+	start, err := parseClock(v[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(v[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("empty update window: '%v'", s)
+	}
+	return start, end, nil
+}
+
+// InUpdateWindow returns true iff t is inside the update maintenance window.
+// If no window is configured, updates are always allowed.
+func (cfg *Config) InUpdateWindow(t time.Time) bool {
+	if cfg.UpdateWindow == "" {
+		return true
+	}
+	start, end, err := ParseUpdateWindow(cfg.UpdateWindow)
+	if err != nil {
+		return true
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// NeedsPolicyCheck returns true if the policy pack check interval has
+// passed.
+func (cfg *Config) NeedsPolicyCheck() bool {
+	const policyInterval = 60 * 60 * 24 // 24 hours.
+	now := time.Now().Unix()
+	return (now > cfg.LastPolicyCheck+policyInterval) || cfg.LastPolicyCheck > now
+}
+
+// SetLastPolicyCheck sets the last policy pack check time and marks the
+// config dirty.
+func (cfg *Config) SetLastPolicyCheck(t int64) {
+	if cfg.LastPolicyCheck != t {
+		cfg.LastPolicyCheck = t
+		cfg.isDirty = true
+	}
+}
+
+// SetPinPolicy sets the expired HPKP pin policy and marks the config dirty.
+func (cfg *Config) SetPinPolicy(s string) {
+	if cfg.PinPolicy != s {
+		cfg.PinPolicy = s
+		cfg.isDirty = true
+	}
+}
+
+// GetPinPolicy returns the expired HPKP pin policy.
+func (cfg *Config) GetPinPolicy() string {
+	if cfg.PinPolicy == "" {
+		return PinPolicyFailOpen
+	}
+	return cfg.PinPolicy
+}
+
+// SetEventFeed sets if the event feed socket should be enabled and marks
+// the config dirty.
+func (cfg *Config) SetEventFeed(b bool) {
+	if cfg.EventFeed != b {
+		cfg.EventFeed = b
+		cfg.isDirty = true
+	}
+}
+
+// SetEnableMARUpdates sets if MAR updates are enabled and marks the config
+// dirty.
+func (cfg *Config) SetEnableMARUpdates(b bool) {
+	if cfg.EnableMARUpdates != b {
+		cfg.EnableMARUpdates = b
+		cfg.isDirty = true
+	}
+}
+
 // SetForceUpdate sets the bundle as needed an update and marks the config
 // dirty.
 func (cfg *Config) SetForceUpdate(b bool) {
@@ -412,14 +1711,237 @@ func (cfg *Config) SetSkipPartialUpdate(b bool) {
 	}
 }
 
+// TorSocketName returns the file name of the named tor or surrogate socket
+// (eg: `socks`, `control`), for the instance.
+func (cfg *Config) TorSocketName(name string) string {
+	if cfg.InstanceID == "" {
+		return name
+	}
+	return name + "-" + cfg.InstanceID
+}
+
+// HostDownloadsDir returns the host directory that is bind mounted as the
+// sandbox `~/Downloads`.
+func (cfg *Config) HostDownloadsDir() string {
+	if cfg.Sandbox.DownloadsDir != "" {
+		return cfg.Sandbox.DownloadsDir
+	}
+	return filepath.Join(cfg.BundleInstallDir, "Browser", "Downloads")
+}
+
+// HostDesktopDir returns the host directory that is bind mounted as the
+// sandbox `~/Desktop`.
+func (cfg *Config) HostDesktopDir() string {
+	if cfg.Sandbox.DesktopDir != "" {
+		return cfg.Sandbox.DesktopDir
+	}
+	return filepath.Join(cfg.BundleInstallDir, "Browser", "Desktop")
+}
+
+// XDGUserDir returns the host directory for the specified `user-dirs.dirs`
+// entry (eg: `XDG_DOWNLOAD_DIR`), or "" if it is not set, disabled, or does
+// not exist.
+func XDGUserDir(name string) string {
+	configHome, err := xdg.ConfigHomeDirectory()
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(filepath.Join(configHome, "user-dirs.dirs"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	home := os.Getenv("HOME")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Of the form `XDG_DOWNLOAD_DIR="$HOME/Downloads"`, where the path
+		// is either absolute, or relative to `$HOME`.
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || kv[0] != name {
+			continue
+		}
+		dir := strings.Trim(kv[1], "\"")
+		if dir == "$HOME" || strings.HasPrefix(dir, "$HOME/") {
+			if home == "" {
+				return ""
+			}
+			dir = home + strings.TrimPrefix(dir, "$HOME")
+		}
+		dir = filepath.Clean(dir)
+
+		// A directory set to `$HOME` is disabled.
+		if !filepath.IsAbs(dir) || dir == filepath.Clean(home) || !utils.DirExists(dir) {
+			return ""
+		}
+		return dir
+	}
+	return ""
+}
+
 // Sanitize validates the config, and brings it inline with reality.
 func (cfg *Config) Sanitize() {
-	if !utils.DirExists(cfg.Sandbox.DownloadsDir) {
+	// These get passed to bubblewrap, and must be absolute.
+	if !filepath.IsAbs(cfg.Sandbox.DownloadsDir) || !utils.DirExists(cfg.Sandbox.DownloadsDir) {
 		cfg.Sandbox.SetDownloadsDir("")
 	}
-	if !utils.DirExists(cfg.Sandbox.DesktopDir) {
+	if !filepath.IsAbs(cfg.Sandbox.DesktopDir) || !utils.DirExists(cfg.Sandbox.DesktopDir) {
 		cfg.Sandbox.SetDesktopDir("")
 	}
+	if p := cfg.Tor.CustomTorPath; p != "" && (!filepath.IsAbs(p) || !utils.FileExists(p)) {
+		cfg.Tor.SetCustomTorPath("")
+	}
+	if cfg.UpdateWindow != "" {
+		if _, _, err := ParseUpdateWindow(cfg.UpdateWindow); err != nil {
+			cfg.SetUpdateWindow("")
+		}
+	}
+	switch cfg.PinPolicy {
+	case "", PinPolicyFailOpen, PinPolicyFailClosed:
+	default:
+		cfg.SetPinPolicy("")
+	}
+	switch cfg.Tor.ConfluxMode {
+	case "", ConfluxAutomatic, ConfluxEnabled, ConfluxDisabled:
+	default:
+		cfg.Tor.SetConfluxMode("")
+	}
+	switch cfg.Tor.SocksPassthrough {
+	case "", SocksPassthroughTCP, SocksPassthroughUnix, SocksPassthroughAbstract, SocksPassthroughDisabled:
+	default:
+		cfg.Tor.SetSocksPassthrough("")
+	}
+	if cfg.Tor.SocksPassthroughAddr != "" && ValidateSocksPassthroughAddr(cfg.Tor.SocksPassthroughAddr) != nil {
+		cfg.Tor.SetSocksPassthroughAddr("")
+	}
+	if cfg.Tor.BandwidthLimit < 0 {
+		cfg.Tor.SetBandwidthLimit(0)
+	} else if cfg.Tor.BandwidthLimit > 0 && cfg.Tor.BandwidthLimit < minBandwidthLimit {
+		cfg.Tor.SetBandwidthLimit(minBandwidthLimit)
+	}
+	if cfg.Tor.ConnBandwidthLimit < 0 {
+		cfg.Tor.SetConnBandwidthLimit(0)
+	} else if cfg.Tor.ConnBandwidthLimit > 0 && cfg.Tor.ConnBandwidthLimit < minBandwidthLimit {
+		cfg.Tor.SetConnBandwidthLimit(minBandwidthLimit)
+	}
+	if len(cfg.Tor.Containers) > 0 {
+		seen := make(map[string]bool)
+		containers := make([]*Container, 0, len(cfg.Tor.Containers))
+		for _, c := range cfg.Tor.Containers {
+			if c == nil || ValidateContainerName(c.Name) != nil || seen[c.Name] {
+				continue
+			}
+			seen[c.Name] = true
+			// Invalid credentials get regenerated at launch.
+			if b, err := hex.DecodeString(c.Tag); c.Tag != "" && (!c.Persistent || err != nil || len(b) != ContainerTagSize) {
+				c.Tag = ""
+				cfg.isDirty = true
+			}
+			containers = append(containers, c)
+		}
+		if len(containers) != len(cfg.Tor.Containers) {
+			cfg.Tor.Containers = containers
+			cfg.isDirty = true
+		}
+	}
+	if cfg.Tor.Container != "" && cfg.Tor.GetContainer() == nil {
+		cfg.Tor.SetContainer("")
+	}
+	switch cfg.Tor.IsolationScheme {
+	case "", IsolationSchemeLaunch, IsolationSchemeProfile, IsolationSchemePrefix:
+	default:
+		cfg.Tor.SetIsolationScheme("")
+	}
+	if cfg.Tor.IsolationPrefix != "" && ValidateIsolationPrefix(cfg.Tor.IsolationPrefix) != nil {
+		cfg.Tor.SetIsolationPrefix("")
+	}
+	if cfg.Tor.GetIsolationScheme() == IsolationSchemePrefix && cfg.Tor.IsolationPrefix == "" {
+		cfg.Tor.SetIsolationScheme("")
+	}
+	// Invalid stored credentials get regenerated at launch.
+	if b, err := hex.DecodeString(cfg.Tor.IsolationTag); cfg.Tor.IsolationTag != "" && (cfg.Tor.GetIsolationScheme() != IsolationSchemeProfile || err != nil || len(b) != IsolationTagSize) {
+		cfg.Tor.SetIsolationTag("")
+	}
+	switch cfg.Sandbox.SocksListener {
+	case "", SocksListenerAuto, SocksListenerTCP, SocksListenerUnix:
+	default:
+		cfg.Sandbox.SetSocksListener("")
+	}
+	switch cfg.Sandbox.X11Mode {
+	case "", X11ModeSurrogate, X11ModeDirect, X11ModeDisabled:
+	default:
+		cfg.Sandbox.SetX11Mode("")
+	}
+	if cfg.Sandbox.WindowClass != "" && ValidateWindowClass(cfg.Sandbox.WindowClass) != nil {
+		cfg.Sandbox.SetWindowClass("")
+	}
+	if cfg.Sandbox.WindowName != "" && ValidateWindowClass(cfg.Sandbox.WindowName) != nil {
+		cfg.Sandbox.SetWindowName("")
+	}
+	if cfg.Sandbox.WindowIcon != "" && ValidateWindowIcon(cfg.Sandbox.WindowIcon) != nil {
+		cfg.Sandbox.SetWindowIcon("")
+	}
+	if cfg.Sandbox.MemoryLimit < 0 {
+		cfg.Sandbox.SetMemoryLimit(0)
+	}
+	if cfg.Sandbox.PersistentCacheSize < 0 {
+		cfg.Sandbox.SetPersistentCacheSize(0)
+	} else if cfg.Sandbox.PersistentCacheSize > 0 && cfg.Sandbox.PersistentCacheSize < minPersistentCacheSize {
+		cfg.Sandbox.SetPersistentCacheSize(minPersistentCacheSize)
+	} else if cfg.Sandbox.PersistentCacheSize > maxPersistentCacheSize {
+		cfg.Sandbox.SetPersistentCacheSize(maxPersistentCacheSize)
+	}
+	if cfg.Sandbox.TmpfsSizeLimit < -1 {
+		cfg.Sandbox.SetTmpfsSizeLimit(-1)
+	}
+	if cfg.Mirror.DownloadsURL != "" && ValidateMirrorURL(cfg.Mirror.DownloadsURL) != nil {
+		cfg.Mirror.SetDownloadsURL("")
+	}
+	if cfg.Mirror.UpdateURL != "" && ValidateMirrorURL(cfg.Mirror.UpdateURL) != nil {
+		cfg.Mirror.SetUpdateURL("")
+	}
+	for host, mh := range cfg.Mirror.Hosts {
+		if mh == nil || host == "" {
+			delete(cfg.Mirror.Hosts, host)
+			cfg.isDirty = true
+			continue
+		}
+		if mh.CAFile != "" && (!filepath.IsAbs(mh.CAFile) || !utils.FileExists(mh.CAFile)) {
+			mh.CAFile = ""
+			cfg.isDirty = true
+		}
+		pins := make([]string, 0, len(mh.Pins))
+		for _, pin := range mh.Pins {
+			if ValidateMirrorPin(pin) == nil {
+				pins = append(pins, pin)
+			}
+		}
+		if len(pins) != len(mh.Pins) {
+			mh.Pins = pins
+			cfg.isDirty = true
+		}
+
+		// An override with nothing to verify against would use the
+		// system roots without HPKP, so drop it entirely.
+		if mh.CAFile == "" && len(mh.Pins) == 0 {
+			delete(cfg.Mirror.Hosts, host)
+			cfg.isDirty = true
+		}
+	}
+	if cfg.Sandbox.ShutdownGracePeriod < -1 {
+		cfg.Sandbox.SetShutdownGracePeriod(-1)
+	} else if cfg.Sandbox.ShutdownGracePeriod > maxShutdownGracePeriod {
+		cfg.Sandbox.SetShutdownGracePeriod(maxShutdownGracePeriod)
+	}
+	if cfg.Sandbox.CPUWeight < 0 {
+		cfg.Sandbox.SetCPUWeight(0)
+	} else if cfg.Sandbox.CPUWeight > maxCPUWeight {
+		cfg.Sandbox.SetCPUWeight(maxCPUWeight)
+	}
 }
 
 // Sync flushes config changes to disk, if the config is dirty.
@@ -444,12 +1966,55 @@ func (cfg *Config) ResetDirty() {
 	cfg.isDirty = false
 }
 
+// parseControlPassword parses a `TOR_CONTROL_PASSWD` value, which like with
+// Tor Browser, is either a quoted string or hex encoded.
+func parseControlPassword(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
+		return s[1 : len(s)-1]
+	}
+	if b, err := hex.DecodeString(s); err == nil {
+		return string(b)
+	}
+	return s
+}
+
+// fallbackRuntimeDir returns the runtime directory to use when
+// `XDG_RUNTIME_DIR` is not set (eg: ssh X11 forwarding, some minimal window
+// managers), creating it if needed.
+func fallbackRuntimeDir() (string, error) {
+	uid := os.Getuid()
+	d := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", appDir, uid))
+	if err := os.Mkdir(d, utils.DirMode); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	// The temporary directory is shared, so the directory may have been
+	// created by someone else.  Ensure that it is a real directory, owned
+	// by the user, that no one else has access to.
+	fi, err := os.Lstat(d)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("'%v' is not a directory", d)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+		return "", fmt.Errorf("'%v' is not owned by the user", d)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("'%v' has insecure permissions: %v", d, fi.Mode().Perm())
+	}
+	return d, nil
+}
+
 // New creates a new config object and populates it with the configuration
 // from disk if available, default values otherwise.
 func New(version string) (*Config, error) {
 	const (
-		envControlPort = "TOR_CONTROL_PORT"
-		envRuntimeDir  = "XDG_RUNTIME_DIR"
+		envControlPort       = "TOR_CONTROL_PORT"
+		envControlPasswd     = "TOR_CONTROL_PASSWD"
+		envControlCookieFile = "TOR_CONTROL_COOKIE_AUTH_FILE"
+		envRuntimeDir        = "XDG_RUNTIME_DIR"
 	)
 
 	cfg := new(Config)
@@ -478,15 +2043,20 @@ func New(version string) (*Config, error) {
 			cfg.UseSystemTor = true
 			cfg.SystemTorControlNet = net
 			cfg.SystemTorControlAddr = addr
+			cfg.SystemTorControlPassword = parseControlPassword(os.Getenv(envControlPasswd))
+			cfg.SystemTorControlCookieFile = os.Getenv(envControlCookieFile)
 		}
 	}
 
 	// Initialize the directories that have files in them.  The paths are not
 	// serialized but part of the config struct.
-	if d := os.Getenv(envRuntimeDir); d == "" {
-		return nil, fmt.Errorf("no `%s` set in the enviornment", envRuntimeDir)
-	} else {
+	if d := os.Getenv(envRuntimeDir); d != "" && filepath.IsAbs(d) && utils.DirExists(d) {
 		cfg.RuntimeDir = filepath.Join(d, appDir)
+	} else if d, err := fallbackRuntimeDir(); err != nil {
+		return nil, fmt.Errorf("no usable `%s` set in the enviornment, and no fallback: %v", envRuntimeDir, err)
+	} else {
+		cfg.RuntimeDir = d
+		cfg.RuntimeDirIsFallback = true
 	}
 	if d, err := xdg.DataHomeDirectory(); err != nil {
 		return nil, err
@@ -494,6 +2064,7 @@ func New(version string) (*Config, error) {
 		cfg.UserDataDir = filepath.Join(d, appDir)
 		cfg.BundleInstallDir = filepath.Join(cfg.UserDataDir, bundleInstallDir)
 		cfg.TorDataDir = filepath.Join(cfg.UserDataDir, torDataDir)
+		cfg.BrowserCacheDir = filepath.Join(cfg.UserDataDir, browserCacheDir)
 		cfg.manifestPath = filepath.Join(cfg.UserDataDir, manifestFile)
 	}
 
@@ -516,6 +2087,7 @@ func New(version string) (*Config, error) {
 		if !os.IsNotExist(err) {
 			return nil, err
 		}
+		cfg.isNew = true
 	} else if err = json.Unmarshal(b, &cfg); err != nil {
 		return nil, err
 	} else if cfg.LastVersion != version {
@@ -535,6 +2107,7 @@ func New(version string) (*Config, error) {
 	}
 	cfg.Tor.cfg = cfg
 	cfg.Sandbox.cfg = cfg
+	cfg.Mirror.cfg = cfg
 
 	return cfg, nil
 }
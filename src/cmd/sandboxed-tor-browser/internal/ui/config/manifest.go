@@ -42,6 +42,10 @@ type Manifest struct {
 	// Locale is the installed Tor Browser locale.
 	Locale string `json:"locale,omitEmpty"`
 
+	// Extensions is the file names of the extensions that shipped with the
+	// installed Tor Browser.
+	Extensions []string `json:"extensions,omitEmpty"`
+
 	isDirty bool
 	path    string
 }
@@ -54,6 +58,14 @@ func (m *Manifest) SetVersion(v string) {
 	}
 }
 
+// SetExtensions sets the bundled extensions and marks the config dirty.
+func (m *Manifest) SetExtensions(exts []string) {
+	if strings.Join(m.Extensions, "\n") != strings.Join(exts, "\n") {
+		m.isDirty = true
+		m.Extensions = exts
+	}
+}
+
 // Sync flushes the manifest to disk, if the manifest is dirty.
 func (m *Manifest) Sync() error {
 	if m.isDirty {
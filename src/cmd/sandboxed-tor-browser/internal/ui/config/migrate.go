@@ -0,0 +1,119 @@
+// migrate.go - Legacy install location migration.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// LegacyInstall is a prior install at the default XDG base directory
+// locations, that is no longer found because `XDG_DATA_HOME` and or
+// `XDG_CONFIG_HOME` changed.
+type LegacyInstall struct {
+	// DataDir is the legacy user data directory (the bundle, the tor state,
+	// and the manifest), or "" if only the config file moved.
+	DataDir string
+
+	// ConfigFile is the legacy config file, or "" if only the user data
+	// directory moved.
+	ConfigFile string
+
+	cfg *Config
+}
+
+// FindLegacyInstall returns the prior install at a legacy location, or nil
+// if there is none, or the current locations are already in use.
+func FindLegacyInstall(cfg *Config) *LegacyInstall {
+	home := os.Getenv("HOME")
+	if home == "" || !filepath.IsAbs(home) {
+		return nil
+	}
+
+	l := &LegacyInstall{cfg: cfg}
+	if !hasInstall(cfg.UserDataDir) {
+		d := filepath.Join(home, ".local", "share", appDir)
+		if d != cfg.UserDataDir && hasInstall(d) {
+			l.DataDir = d
+		}
+	}
+	if cfg.isNew {
+		f := filepath.Join(home, ".config", appDir, configFile)
+		if f != cfg.path && utils.FileExists(f) {
+			l.ConfigFile = f
+		}
+	}
+	if l.DataDir == "" && l.ConfigFile == "" {
+		return nil
+	}
+	return l
+}
+
+// hasInstall returns true if d is a user data directory with a manifest.
+func hasInstall(d string) bool {
+	return utils.FileExists(filepath.Join(d, manifestFile))
+}
+
+// Migrate moves the legacy install to the current locations, or if symlink
+// is set, leaves it in place and symlinks the current locations to it.  The
+// config and manifest must be reloaded afterwards.
+func (l *LegacyInstall) Migrate(symlink bool) error {
+	if l.DataDir != "" {
+		if err := migratePath(l.DataDir, l.cfg.UserDataDir, symlink); err != nil {
+			return fmt.Errorf("failed to migrate the user data: %v", err)
+		}
+	}
+	if l.ConfigFile != "" {
+		// The fresh config has already been written, and is discarded.
+		os.Remove(l.cfg.path)
+		if err := migratePath(l.ConfigFile, l.cfg.path, symlink); err != nil {
+			return fmt.Errorf("failed to migrate the config: %v", err)
+		}
+	}
+	return nil
+}
+
+func migratePath(src, dst string, symlink bool) error {
+	// The launcher creates the user data directory before the migration can
+	// be offered, so it is fine to replace it, as long as it is empty.
+	if fi, err := os.Lstat(dst); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("'%v' already exists", dst)
+		}
+		if err = os.Remove(dst); err != nil {
+			return fmt.Errorf("'%v' already exists, and is not empty", dst)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), utils.DirMode); err != nil {
+		return err
+	}
+
+	if symlink {
+		return os.Symlink(src, dst)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if lErr, ok := err.(*os.LinkError); ok && lErr.Err == syscall.EXDEV {
+			return fmt.Errorf("'%v' is on a different filesystem, symlink it instead", src)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// downloads.go - Downloads directory watcher.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+)
+
+// partialDownloadSuffix is the suffix of in progress firefox downloads.
+const partialDownloadSuffix = ".part"
+
+// downloadsWatcher watches the host side of the Downloads directory for
+// completed downloads, and optionally relabels the files created in the
+// Desktop and Downloads directories.  This is done entirely outside the
+// sandbox, so Tor Browser gains no new access.
+type downloadsWatcher struct {
+	f       *os.File
+	wds     map[int32]string
+	dir     string
+	cmd     []string
+	notify  bool
+	relabel bool
+	ch      chan string
+
+	lastPath string
+	lastFi   os.FileInfo
+}
+
+func newDownloadsWatcher(dir, desktopDir string, cmd []string, notify, relabel bool) (*downloadsWatcher, error) {
+	dirs := []string{dir}
+	if relabel && desktopDir != dir {
+		dirs = append(dirs, desktopDir)
+	}
+
+	// Firefox downloads to a `.part` file and renames it on completion,
+	// but small files may be written in place.
+	f, wds, err := newInotify(dirs, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &downloadsWatcher{
+		f:       f,
+		wds:     wds,
+		dir:     dir,
+		cmd:     cmd,
+		notify:  notify,
+		relabel: relabel,
+		ch:      make(chan string, 16),
+	}
+	go w.worker()
+	return w, nil
+}
+
+func (w *downloadsWatcher) worker() {
+	defer close(w.ch)
+
+	readInotify(w.f, func(wd int32, mask uint32, name string) {
+		if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, partialDownloadSuffix) {
+			return
+		}
+		dir := w.wds[wd]
+		w.onCompleted(filepath.Join(dir, name), dir == w.dir)
+	})
+}
+
+func (w *downloadsWatcher) onCompleted(path string, isDownload bool) {
+	// Firefox creates an empty placeholder for the final file when a
+	// download starts.
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return
+	}
+
+	// The placeholder's event may be processed after the rename, so
+	// suppress reporting the same file twice.
+	if path == w.lastPath && os.SameFile(fi, w.lastFi) && fi.Size() == w.lastFi.Size() && fi.ModTime().Equal(w.lastFi.ModTime()) {
+		return
+	}
+	w.lastPath, w.lastFi = path, fi
+
+	// Relabel before anything on the host gets to look at the file.
+	if w.relabel {
+		if err := sandbox.RelabelFile(path); err != nil {
+			log.Printf("ui: Failed to relabel %v: %v", path, err)
+		}
+	}
+	if !isDownload || !w.notify {
+		return
+	}
+	log.Printf("ui: Download completed: %v", path)
+
+	if len(w.cmd) > 0 {
+		// The path is always absolute, so it can't be mistaken for an
+		// option by the command.
+		args := append(append([]string{}, w.cmd[1:]...), path)
+		cmd := exec.Command(w.cmd[0], args...)
+		go func() {
+			if err := cmd.Run(); err != nil {
+				log.Printf("ui: Downloads command failed for %v: %v", path, err)
+			}
+		}()
+	}
+
+	select {
+	case w.ch <- path:
+	default:
+		// The UI is not keeping up, drop the notification.
+	}
+}
+
+func (w *downloadsWatcher) close() {
+	w.f.Close()
+}
+
+// WatchDownloads starts watching the host Downloads directory if enabled in
+// the config, and returns a channel that will receive the path of each
+// completed download.  The returned channel is nil if notifications are
+// disabled or the watcher fails to start.
+func (c *Common) WatchDownloads() <-chan string {
+	c.stopWatchingDownloads()
+	notify := c.Cfg.Sandbox.WatchDownloads
+	relabel := c.Cfg.Sandbox.RelabelSharedDirs && sandbox.SELinuxMode() != ""
+	if !notify && !relabel {
+		return nil
+	}
+
+	dir := c.Cfg.HostDownloadsDir()
+	w, err := newDownloadsWatcher(dir, c.Cfg.HostDesktopDir(), c.Cfg.Sandbox.DownloadsCommand, notify, relabel)
+	if err != nil {
+		log.Printf("ui: Failed to watch the Downloads directory: %v", err)
+		return nil
+	}
+	log.Printf("ui: Watching the Downloads directory: %v", dir)
+	c.downloads = w
+	if !notify {
+		return nil
+	}
+	return w.ch
+}
+
+func (c *Common) stopWatchingDownloads() {
+	if c.downloads != nil {
+		c.downloads.close()
+		c.downloads = nil
+	}
+}
+
+// CanViewDownloads returns true if a document viewer is configured.
+func (c *Common) CanViewDownloads() bool {
+	return len(c.Cfg.Sandbox.ViewerCommand) > 0
+}
+
+// ViewDownload opens the completed download at path with the configured
+// document viewer, in a separate sandbox.
+func (c *Common) ViewDownload(path string) error {
+	proc, err := sandbox.RunViewer(c.Cfg, path)
+	if err != nil {
+		return err
+	}
+	log.Printf("ui: Opened download in the document viewer: %v", path)
+	go proc.Wait()
+	return nil
+}
@@ -0,0 +1,183 @@
+// events.go - External monitoring event feed.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	eventFeedSocket       = "events"
+	eventFeedBacklog      = 64
+	eventFeedWriteTimeout = 5 * time.Second
+
+	evLaunch    = "launch"
+	evExit      = "exit"
+	evUpdate    = "update"
+	evBootstrap = "bootstrap"
+)
+
+// feedEvent is a single event, sent to each client as a line of JSON.
+//
+// nb: There is no event for seccomp violations, because the filters fail
+// the offending calls with `ENOSYS` instead of trapping, and bwrap does not
+// report how the sandboxed processes exited, so there is nothing to observe.
+type feedEvent struct {
+	Type      string      `json:"type"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// eventFeed is the AF_LOCAL socket that external monitoring tools (eg:
+// status bars) can connect to, instead of scraping the log.  Clients that
+// fall behind are disconnected, since the launcher must never block on them.
+type eventFeed struct {
+	sync.Mutex
+
+	l       net.Listener
+	clients map[net.Conn]chan []byte
+}
+
+func (f *eventFeed) acceptLoop() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+
+		ch := make(chan []byte, eventFeedBacklog)
+		f.Lock()
+		f.clients[conn] = ch
+		f.Unlock()
+		go f.writer(conn, ch)
+	}
+}
+
+func (f *eventFeed) writer(conn net.Conn, ch chan []byte) {
+	defer f.drop(conn)
+	for b := range ch {
+		conn.SetWriteDeadline(time.Now().Add(eventFeedWriteTimeout))
+		if _, err := conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (f *eventFeed) drop(conn net.Conn) {
+	f.Lock()
+	defer f.Unlock()
+	if ch, ok := f.clients[conn]; ok {
+		close(ch)
+		delete(f.clients, conn)
+	}
+	conn.Close()
+}
+
+func (f *eventFeed) emit(ev *feedEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("ui: Failed to serialize event: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	f.Lock()
+	defer f.Unlock()
+	for conn, ch := range f.clients {
+		select {
+		case ch <- b:
+		default:
+			log.Printf("ui: Event feed client fell behind, disconnecting")
+			close(ch)
+			delete(f.clients, conn)
+			conn.Close()
+		}
+	}
+}
+
+func (f *eventFeed) close() {
+	f.l.Close()
+	f.Lock()
+	defer f.Unlock()
+	for conn, ch := range f.clients {
+		close(ch)
+		delete(f.clients, conn)
+		conn.Close()
+	}
+}
+
+func (c *Common) eventFeedPath() string {
+	return filepath.Join(c.Cfg.RuntimeDir, eventFeedSocket)
+}
+
+// startEventFeed opens the event feed socket, if enabled.  Failure is not
+// fatal, since the feed is purely informational.
+func (c *Common) startEventFeed() {
+	if !c.Cfg.EventFeed || c.events != nil {
+		return
+	}
+
+	p := c.eventFeedPath()
+	os.Remove(p)
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		log.Printf("ui: Failed to open the event feed: %v", err)
+		return
+	}
+	if err = os.Chmod(p, 0600); err != nil {
+		log.Printf("ui: Failed to restrict the event feed: %v", err)
+		l.Close()
+		return
+	}
+	log.Printf("ui: Event feed listening on: %v", p)
+
+	c.events = &eventFeed{
+		l:       l,
+		clients: make(map[net.Conn]chan []byte),
+	}
+	go c.events.acceptLoop()
+}
+
+// stopEventFeed closes the event feed socket, and disconnects the clients.
+// Events emitted afterwards are discarded.
+func (c *Common) stopEventFeed() {
+	if c.events != nil {
+		c.events.close()
+		os.Remove(c.eventFeedPath())
+	}
+}
+
+// emitEvent sends an event to the event feed clients, if any.
+func (c *Common) emitEvent(typ string, data interface{}) {
+	if c.events == nil {
+		return
+	}
+	c.events.emit(&feedEvent{
+		Type:      typ,
+		Timestamp: time.Now().Unix(),
+		Data:      data,
+	})
+}
@@ -0,0 +1,399 @@
+// fetch.go - Install/update fetch helper.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"git.schwanenlied.me/yawning/grab.git"
+	"golang.org/x/net/proxy"
+
+	"cmd/sandboxed-tor-browser/internal/policy"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const fetchHelperFile = "download"
+
+// systemRootCAFiles are the locations of the host CA bundle, as per the Go
+// runtime.  The sandbox never has the host `/etc`, so the bundle is passed
+// to the helper.
+var systemRootCAFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+}
+
+// fetchRequest is a single fetch, done by the fetch helper.
+type fetchRequest struct {
+	URL  string `json:"url"`
+	Head bool   `json:"head,omitempty"`
+	File string `json:"file,omitempty"`
+	Size uint64 `json:"size,omitempty"`
+
+	// The SOCKS port is an argument to the helper if it is an AF_LOCAL
+	// socket.
+	SocksAddr     string `json:"socksAddr,omitempty"`
+	SocksUser     string `json:"socksUser,omitempty"`
+	SocksPassword string `json:"socksPassword,omitempty"`
+
+	// Everything the HTTP client needs from the launcher.
+	PinPolicy  string                        `json:"pinPolicy,omitempty"`
+	Mirror     map[string]*config.MirrorHost `json:"mirror,omitempty"`
+	MirrorCAs  map[string][]byte             `json:"mirrorCAs,omitempty"`
+	RootCAs    []byte                        `json:"rootCAs,omitempty"`
+	PolicyPack []byte                        `json:"policyPack,omitempty"`
+	PolicySig  []byte                        `json:"policySig,omitempty"`
+}
+
+// fetchStatus is a status update from the fetch helper.
+type fetchStatus struct {
+	Progress string `json:"progress,omitempty"`
+
+	Done          bool   `json:"done,omitempty"`
+	Err           string `json:"err,omitempty"`
+	StatusCode    int    `json:"statusCode,omitempty"`
+	Status        string `json:"status,omitempty"`
+	ContentLength int64  `json:"contentLength,omitempty"`
+}
+
+// fetcher does the install/update related fetches via the fetch helper, so
+// that the TLS, HTTP, and SOCKS handling happens in a sandbox instead of in
+// the launcher.
+type fetcher struct {
+	cfg       *config.Config
+	base      fetchRequest
+	socksPath string
+	direct    bool
+}
+
+// newFetcher returns a fetcher that connects via tor, or directly if tor is
+// not running and allowDirect is set.
+func (c *Common) newFetcher(allowDirect bool) (*fetcher, error) {
+	f := &fetcher{cfg: c.Cfg}
+	f.base.PinPolicy = c.Cfg.PinPolicy
+
+	if c.tor == nil {
+		if !allowDirect {
+			return nil, tor.ErrTorNotRunning
+		}
+		f.direct = true
+	} else {
+		socksNet, socksAddr, auth, err := c.tor.DialerParams()
+		if err != nil {
+			return nil, err
+		}
+		f.base.SocksUser, f.base.SocksPassword = auth.User, auth.Password
+		if socksNet == "unix" {
+			f.socksPath = socksAddr
+		} else {
+			// System tor, with a TCP SocksPort.
+			f.base.SocksAddr = socksAddr
+			f.direct = true
+		}
+	}
+
+	if len(c.Cfg.Mirror.Hosts) > 0 {
+		f.base.Mirror = make(map[string]*config.MirrorHost)
+		f.base.MirrorCAs = make(map[string][]byte)
+		for host, mh := range c.Cfg.Mirror.Hosts {
+			h := *mh
+			if h.CAFile != "" {
+				b, err := ioutil.ReadFile(h.CAFile)
+				if err != nil {
+					return nil, err
+				}
+				f.base.MirrorCAs[host] = b
+				h.CAFile = ""
+			}
+			f.base.Mirror[host] = &h
+		}
+	}
+
+	roots := systemRootCAFiles
+	if v := os.Getenv("SSL_CERT_FILE"); v != "" {
+		roots = append([]string{v}, roots...)
+	}
+	for _, v := range roots {
+		if b, err := ioutil.ReadFile(v); err == nil {
+			f.base.RootCAs = b
+			break
+		}
+	}
+	if f.base.RootCAs == nil {
+		return nil, fmt.Errorf("unable to find the system CA certificates")
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(c.Cfg.UserDataDir, policy.PackFile)); err == nil {
+		if sig, err := ioutil.ReadFile(filepath.Join(c.Cfg.UserDataDir, policy.SigFile)); err == nil {
+			f.base.PolicyPack, f.base.PolicySig = b, sig
+		}
+	}
+
+	return f, nil
+}
+
+// run runs the fetch helper in a new sandbox, writing to outDir, and
+// returns the final status.
+func (f *fetcher) run(async *Async, req *fetchRequest, outDir string, hzFn func(string)) (*fetchStatus, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like with the probes, the output is read via a pipe.
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	process, err := sandbox.RunFetchHelper(f.cfg, &sandbox.FetchHelper{
+		Request:   b,
+		OutDir:    outDir,
+		SocksPath: f.socksPath,
+		Direct:    f.direct,
+		Stdout:    wr,
+	})
+	wr.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer process.Wait()
+
+	statusCh := make(chan *fetchStatus)
+	go func() {
+		defer close(statusCh)
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			st := new(fetchStatus)
+			if err := json.Unmarshal(scanner.Bytes(), st); err != nil {
+				Debugf("fetch: Malformed status: %v", err)
+				continue
+			}
+			statusCh <- st
+		}
+	}()
+
+	for {
+		select {
+		case st := <-statusCh:
+			if st == nil {
+				return nil, fmt.Errorf("fetch helper exited unexpectedly")
+			}
+			if st.Done {
+				process.Kill()
+				for range statusCh {
+				}
+				if st.Err != "" {
+					return nil, fmt.Errorf("%s", st.Err)
+				}
+				return st, nil
+			}
+			if hzFn != nil && st.Progress != "" {
+				hzFn(st.Progress)
+			}
+		case <-async.Cancel:
+			process.Kill()
+			for range statusCh {
+			}
+			return nil, ErrCanceled
+		}
+	}
+}
+
+func (f *fetcher) request(url string) *fetchRequest {
+	req := f.base
+	req.URL = url
+	return &req
+}
+
+// grab downloads the URL to memory, like `Async.Grab`.
+func (f *fetcher) grab(async *Async, url string, hzFn func(string)) []byte {
+	dir, err := ioutil.TempDir(f.cfg.RuntimeDir, "fetch")
+	if err != nil {
+		async.Err = err
+		return nil
+	}
+	defer os.RemoveAll(dir)
+
+	req := f.request(url)
+	req.File = fetchHelperFile
+	if _, async.Err = f.run(async, req, dir, hzFn); async.Err != nil {
+		return nil
+	}
+
+	var b []byte
+	if b, async.Err = ioutil.ReadFile(filepath.Join(dir, fetchHelperFile)); async.Err != nil {
+		return nil
+	}
+	return b
+}
+
+// grabFile downloads the URL to the file, like `Async.GrabFile`.  Partial
+// downloads are resumed, and removed if they are clearly garbage.
+func (f *fetcher) grabFile(async *Async, url, filename string, size uint64, hzFn func(string)) {
+	req := f.request(url)
+	req.File = filepath.Base(filename)
+	req.Size = size
+	_, async.Err = f.run(async, req, filepath.Dir(filename), hzFn)
+}
+
+// head does a HEAD request for the URL.
+func (f *fetcher) head(async *Async, url string) (*fetchStatus, error) {
+	dir, err := ioutil.TempDir(f.cfg.RuntimeDir, "fetch")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	req := f.request(url)
+	req.Head = true
+	return f.run(async, req, dir, nil)
+}
+
+// RunFetchHelper is the entry point of the launcher when re-executed with
+// `sandbox.FetchHelperArg` inside the fetch helper sandbox.  It does the
+// request in the file args[0], writing to the directory args[1], via the
+// SOCKS socket args[2] if any, and writes the status updates to stdout as
+// JSON, and returns the exit status.
+func RunFetchHelper(args []string) int {
+	if len(args) != 3 {
+		return -1
+	}
+	enc := json.NewEncoder(os.Stdout)
+
+	st, err := doFetchHelper(args[0], args[1], args[2], func(s string) {
+		enc.Encode(&fetchStatus{Progress: s})
+	})
+	if err != nil {
+		log.Printf("fetch: Failed: %v", err)
+		st = &fetchStatus{Err: err.Error()}
+	}
+	st.Done = true
+	if err = enc.Encode(st); err != nil {
+		return -1
+	}
+	return 0
+}
+
+func doFetchHelper(reqPath, outDir, socksPath string, hzFn func(string)) (*fetchStatus, error) {
+	b, err := ioutil.ReadFile(reqPath)
+	if err != nil {
+		return nil, err
+	}
+	req := new(fetchRequest)
+	if err = json.Unmarshal(b, req); err != nil {
+		return nil, err
+	}
+
+	// All of the certificates, and the policy pack live in `/tmp`.
+	tmpDir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		return nil, err
+	}
+	writeTmp := func(name string, b []byte) (string, error) {
+		p := filepath.Join(tmpDir, name)
+		return p, ioutil.WriteFile(p, b, FileMode)
+	}
+	if p, err := writeTmp("roots.pem", req.RootCAs); err != nil {
+		return nil, err
+	} else {
+		os.Setenv("SSL_CERT_FILE", p)
+	}
+	if req.PolicyPack != nil {
+		if _, err = writeTmp(policy.PackFile, req.PolicyPack); err != nil {
+			return nil, err
+		}
+		if _, err = writeTmp(policy.SigFile, req.PolicySig); err != nil {
+			return nil, err
+		}
+		policy.Load(tmpDir)
+	}
+
+	cfg := &config.Config{PinPolicy: req.PinPolicy}
+	cfg.Mirror.Hosts = req.Mirror
+	i := 0
+	for host, mh := range cfg.Mirror.Hosts {
+		if ca, ok := req.MirrorCAs[host]; ok {
+			if mh.CAFile, err = writeTmp("mirror-"+strconv.Itoa(i)+".pem", ca); err != nil {
+				return nil, err
+			}
+			i++
+		}
+	}
+
+	// Build the same client that the launcher used to.
+	var dialFn dialFunc
+	if socksPath != "" || req.SocksAddr != "" {
+		socksNet, socksAddr := "unix", socksPath
+		if socksPath == "" {
+			socksNet, socksAddr = "tcp", req.SocksAddr
+		}
+		var auth *proxy.Auth
+		if req.SocksUser != "" {
+			auth = &proxy.Auth{User: req.SocksUser, Password: req.SocksPassword}
+		}
+		d, err := proxy.SOCKS5(socksNet, socksAddr, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		dialFn = d.Dial
+	} else {
+		dialFn = net.Dial
+	}
+	client, err := newHPKPGrabClient(cfg, dialFn)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Head {
+		resp, err := client.HTTPClient.Head(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return &fetchStatus{StatusCode: resp.StatusCode, Status: resp.Status, ContentLength: resp.ContentLength}, nil
+	}
+
+	if req.File == "" || filepath.Base(req.File) != req.File {
+		return nil, fmt.Errorf("invalid output file: '%v'", req.File)
+	}
+	dst := filepath.Join(outDir, req.File)
+	async := NewAsync()
+	if async.GrabFile(client, req.URL, dst, req.Size, hzFn); async.Err != nil {
+		if grab.IsContentLengthMismatch(async.Err) {
+			os.Remove(dst)
+		}
+		return nil, async.Err
+	}
+	return &fetchStatus{StatusCode: http.StatusOK}, nil
+}
@@ -0,0 +1,151 @@
+// backup.go - Gtk+ backup and restore user interface routines.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+	"os"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
+)
+
+const defaultBackupName = "tor-browser-backup.tar.gpg"
+
+// runBackup backs up, or restores the Tor Browser profile.
+func (ui *gtkUI) runBackup(restore bool) {
+	path := ui.BackupFile
+	if path == "" {
+		var ok bool
+		if path, ok = ui.chooseBackupFile(restore); !ok {
+			return
+		}
+	}
+	if !restore {
+		if _, err := os.Lstat(path); err == nil && !ui.ask("`%s` already exists.\n\nOverwrite it?", path) {
+			return
+		}
+	}
+
+	passphrase, ok := ui.askPassphrase(!restore)
+	if !ok {
+		return
+	}
+
+	var err error
+	if restore {
+		err = ui.Restore(path, passphrase)
+	} else {
+		err = ui.Backup(path, passphrase, ui.BackupFull)
+	}
+	if err != nil {
+		log.Printf("ui: Backup/restore failed: %v", err)
+		ui.bitch("%v", err)
+		return
+	}
+	if restore {
+		ui.inform("The backup was restored from `%s`.", path)
+	} else {
+		ui.inform("The backup was written to `%s`.\n\nThe passphrase is required to restore it, and can not be recovered.", path)
+	}
+}
+
+func (ui *gtkUI) chooseBackupFile(restore bool) (string, bool) {
+	title, action, button := "Back Up Tor Browser", gtk3.FILE_CHOOSER_ACTION_SAVE, "Save"
+	if restore {
+		title, action, button = "Restore Tor Browser", gtk3.FILE_CHOOSER_ACTION_OPEN, "Open"
+	}
+
+	fc, err := gtk3.FileChooserDialogNewWith2Buttons(title, ui.mainWindow, action, "Cancel", gtk3.RESPONSE_CANCEL, button, gtk3.RESPONSE_ACCEPT)
+	if err != nil {
+		log.Printf("ui: Failed to create the file chooser: %v", err)
+		return "", false
+	}
+	defer func() {
+		fc.Destroy()
+		ui.forceRedraw()
+	}()
+	if !restore {
+		fc.SetCurrentName(defaultBackupName)
+	}
+	if gtk3.ResponseType(fc.Run()) != gtk3.RESPONSE_ACCEPT {
+		return "", false
+	}
+	path := fc.GetFilename()
+	return path, path != ""
+}
+
+func (ui *gtkUI) askPassphrase(confirm bool) ([]byte, bool) {
+	d, err := gtk3.DialogNew()
+	if err != nil {
+		log.Printf("ui: Failed to create the passphrase dialog: %v", err)
+		return nil, false
+	}
+	defer func() {
+		d.Destroy()
+		ui.forceRedraw()
+	}()
+	d.SetTitle(i18n.T("Backup Passphrase"))
+	d.SetIcon(ui.iconPixbuf)
+	d.SetTransientFor(ui.mainWindow)
+	d.AddButton(i18n.T("Cancel"), gtk3.RESPONSE_CANCEL)
+	d.AddButton(i18n.T("OK"), gtk3.RESPONSE_OK)
+	d.SetDefaultResponse(gtk3.RESPONSE_OK)
+
+	box, err := d.GetContentArea()
+	if err != nil {
+		return nil, false
+	}
+	newEntry := func(placeholder string) *gtk3.Entry {
+		e, err := gtk3.EntryNew()
+		if err != nil {
+			return nil
+		}
+		e.SetVisibility(false)
+		e.SetActivatesDefault(true)
+		e.SetPlaceholderText(placeholder)
+		box.PackStart(e, false, false, 4)
+		return e
+	}
+	entry := newEntry("Passphrase")
+	var confirmEntry *gtk3.Entry
+	if confirm {
+		confirmEntry = newEntry("Confirm Passphrase")
+	}
+	if entry == nil || (confirm && confirmEntry == nil) {
+		return nil, false
+	}
+	d.ShowAll()
+
+	for {
+		if gtk3.ResponseType(d.Run()) != gtk3.RESPONSE_OK {
+			return nil, false
+		}
+		passphrase, _ := entry.GetText()
+		if passphrase == "" {
+			continue
+		}
+		if confirm {
+			if s, _ := confirmEntry.GetText(); s != passphrase {
+				ui.bitch("The passphrases do not match.")
+				continue
+			}
+		}
+		return []byte(passphrase), true
+	}
+}
@@ -0,0 +1,115 @@
+// circuits.go - Gtk+ circuit panel user interface routines.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
+)
+
+func formatCircuits(circs []*tor.Circuit) string {
+	if len(circs) == 0 {
+		return "There are no Tor Browser circuits."
+	}
+
+	var b bytes.Buffer
+	for i, circ := range circs {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		domain := circ.Domain
+		if domain == "" {
+			domain = "(no domain)"
+		}
+		fmt.Fprintf(&b, "%s - Circuit %d [%s]\n", domain, circ.ID, circ.Status)
+		for j, r := range circ.Relays {
+			fmt.Fprintf(&b, "  %d. %s\n", j+1, r)
+		}
+	}
+	return b.String()
+}
+
+func (ui *gtkUI) showCircuits() {
+	const responseRefresh = gtk3.RESPONSE_APPLY
+
+	circs, err := ui.Circuits()
+	if err != nil {
+		log.Printf("ui: Failed to query circuits: %v", err)
+		ui.bitch("Failed to query the Tor Browser circuits: %v", err)
+		return
+	}
+
+	d, err := gtk3.DialogNew()
+	if err != nil {
+		log.Printf("ui: Failed to create the circuit panel: %v", err)
+		return
+	}
+	defer func() {
+		d.Destroy()
+		ui.forceRedraw()
+	}()
+	d.SetTitle(i18n.T("Tor Browser Circuits"))
+	d.SetIcon(ui.iconPixbuf)
+	d.SetDefaultSize(640, 480)
+	d.SetTransientFor(ui.mainWindow)
+	d.AddButton(i18n.T("Refresh"), responseRefresh)
+	d.AddButton(i18n.T("Close"), gtk3.RESPONSE_CLOSE)
+
+	box, err := d.GetContentArea()
+	if err != nil {
+		return
+	}
+	sw, err := gtk3.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		return
+	}
+	sw.SetPolicy(gtk3.POLICY_AUTOMATIC, gtk3.POLICY_AUTOMATIC)
+	tv, err := gtk3.TextViewNew()
+	if err != nil {
+		return
+	}
+	tv.SetEditable(false)
+	tv.SetCursorVisible(false)
+	tv.SetWrapMode(gtk3.WRAP_NONE)
+	buf, err := tv.GetBuffer()
+	if err != nil {
+		return
+	}
+	sw.Add(tv)
+	box.PackStart(sw, true, true, 0)
+	d.ShowAll()
+
+	text := formatCircuits(circs)
+	for {
+		buf.SetText(text)
+		if gtk3.ResponseType(d.Run()) != responseRefresh {
+			return
+		}
+		if circs, err = ui.Circuits(); err != nil {
+			log.Printf("ui: Failed to refresh circuits: %v", err)
+			text = fmt.Sprintf("Failed to query the Tor Browser circuits: %v", err)
+		} else {
+			text = formatCircuits(circs)
+		}
+	}
+}
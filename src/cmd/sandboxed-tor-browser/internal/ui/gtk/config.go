@@ -18,14 +18,18 @@ package gtk
 
 import (
 	"fmt"
-	"net"
+	"log"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	gtk3 "github.com/gotk3/gotk3/gtk"
 
+	"cmd/sandboxed-tor-browser/internal/tor"
 	sbui "cmd/sandboxed-tor-browser/internal/ui"
+	"cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
 )
 
 type configDialog struct {
@@ -55,7 +59,23 @@ type configDialog struct {
 	torBridgeCustomEntry    *gtk3.TextView
 	torBridgeCustomEntryBuf *gtk3.TextBuffer
 
+	torConfluxBox  *gtk3.Box
+	torConfluxMode *gtk3.ComboBoxText
+
+	torKeepRunningBox    *gtk3.Box
+	torKeepRunningSwitch *gtk3.Switch
+
+	torEphemeralStateBox    *gtk3.Box
+	torEphemeralStateSwitch *gtk3.Switch
+
+	torrcBox              *gtk3.Box
+	torExtraTorrcEntry    *gtk3.TextView
+	torExtraTorrcEntryBuf *gtk3.TextBuffer
+	torrcPreview          *gtk3.TextView
+	torrcPreviewBuf       *gtk3.TextBuffer
+
 	entryInsensitive *gtk3.TextTag
+	entryError       *gtk3.TextTag
 
 	torSystemIndicator *gtk3.Box
 
@@ -63,14 +83,38 @@ type configDialog struct {
 	pulseAudioSwitch      *gtk3.Switch
 	avCodecSwitch         *gtk3.Switch
 	circuitDisplaySwitch  *gtk3.Switch
+	brokerClipboardSwitch *gtk3.Switch
 	amnesiacProfileBox    *gtk3.Box
 	amnesiacProfileSwitch *gtk3.Switch
+	extSettingsBox        *gtk3.Box
+	extSettingsSwitch     *gtk3.Switch
+	persistentCacheBox    *gtk3.Box
+	persistentCacheSwitch *gtk3.Switch
 	displayBox            *gtk3.Box
 	displayEntry          *gtk3.Entry
+	x11ModeBox            *gtk3.Box
+	x11ModeCombo          *gtk3.ComboBoxText
 	downloadsDirBox       *gtk3.Box
 	downloadsDirChooser   *gtk3.FileChooserButton
 	desktopDirBox         *gtk3.Box
 	desktopDirChooser     *gtk3.FileChooserButton
+
+	bandwidthLimitBox       *gtk3.Box
+	bandwidthLimitEntry     *gtk3.Entry
+	connBandwidthLimitEntry *gtk3.Entry
+
+	marUpdatesBox     *gtk3.Box
+	marUpdatesSwitch  *gtk3.Switch
+	updateWindowBox   *gtk3.Box
+	updateWindowEntry *gtk3.Entry
+
+	uiLocaleCombo *gtk3.ComboBoxText
+
+	resourceLimitBox  *gtk3.Box
+	memoryLimitEntry  *gtk3.Entry
+	cpuWeightEntry    *gtk3.Entry
+	enablePauseBox    *gtk3.Box
+	enablePauseSwitch *gtk3.Switch
 }
 
 const proxySOCKS4 = "SOCKS 4"
@@ -80,6 +124,7 @@ func (d *configDialog) loadFromConfig() {
 		return
 	}
 	// Populate the fields from the config.
+	forceAdv := false
 
 	d.torProxyToggle.SetActive(d.ui.Cfg.Tor.UseProxy)
 	d.proxyTypeFromCfg()
@@ -102,6 +147,23 @@ func (d *configDialog) loadFromConfig() {
 	d.torBridgeCustom.SetActive(d.ui.Cfg.Tor.UseCustomBridges)
 	d.torBridgeCustomEntryBuf.SetText(d.ui.Cfg.Tor.CustomBridges)
 	d.onBridgeTypeChanged()
+	d.confluxModeFromCfg()
+	if d.ui.Cfg.Tor.ConfluxMode != "" && d.ui.Cfg.Tor.ConfluxMode != config.ConfluxAutomatic {
+		forceAdv = true
+	}
+	d.torKeepRunningSwitch.SetActive(d.ui.Cfg.Tor.KeepRunning)
+	if d.ui.Cfg.Tor.KeepRunning {
+		forceAdv = true
+	}
+	d.torEphemeralStateSwitch.SetActive(d.ui.Cfg.Tor.EphemeralState)
+	if d.ui.Cfg.Tor.EphemeralState {
+		forceAdv = true
+	}
+	d.torExtraTorrcEntryBuf.SetText(d.ui.Cfg.Tor.ExtraTorrc)
+	if d.ui.Cfg.Tor.ExtraTorrc != "" {
+		forceAdv = true
+	}
+	d.updateTorrcPreview()
 
 	// Set the sensitivity based on the toggles.
 	d.torProxyConfigBox.SetSensitive(d.torProxyToggle.GetActive())
@@ -109,18 +171,60 @@ func (d *configDialog) loadFromConfig() {
 	d.torConfigBox.SetSensitive(!d.ui.Cfg.UseSystemTor)
 	d.torSystemIndicator.SetVisible(d.ui.Cfg.UseSystemTor)
 
-	forceAdv := false
 	d.pulseAudioSwitch.SetActive(d.ui.Cfg.Sandbox.EnablePulseAudio)
 	d.avCodecSwitch.SetActive(d.ui.Cfg.Sandbox.EnableAVCodec)
 	d.circuitDisplaySwitch.SetActive(d.ui.Cfg.Sandbox.EnableCircuitDisplay)
+	d.brokerClipboardSwitch.SetActive(d.ui.Cfg.Sandbox.BrokerClipboard)
 	d.amnesiacProfileSwitch.SetActive(d.ui.Cfg.Sandbox.EnableAmnesiacProfileDirectory)
 	if d.ui.Cfg.Sandbox.EnableAmnesiacProfileDirectory {
 		forceAdv = true
 	}
+	d.extSettingsSwitch.SetActive(d.ui.Cfg.Sandbox.PersistExtensionSettings)
+	d.extSettingsBox.SetSensitive(d.ui.Cfg.Sandbox.EnableAmnesiacProfileDirectory)
+	d.persistentCacheSwitch.SetActive(d.ui.Cfg.Sandbox.PersistentCache)
+	if d.ui.Cfg.Sandbox.PersistentCache {
+		forceAdv = true
+	}
 	if d.ui.Cfg.Sandbox.Display != "" {
 		d.displayEntry.SetText(d.ui.Cfg.Sandbox.Display)
 		forceAdv = true
 	}
+	d.x11ModeCombo.SetActiveID(d.ui.Cfg.Sandbox.GetX11Mode())
+	if d.ui.Cfg.Sandbox.GetX11Mode() != config.X11ModeSurrogate {
+		forceAdv = true
+	}
+	if d.ui.Cfg.Tor.BandwidthLimit > 0 {
+		d.bandwidthLimitEntry.SetText(strconv.Itoa(d.ui.Cfg.Tor.BandwidthLimit))
+		forceAdv = true
+	}
+	if d.ui.Cfg.Tor.ConnBandwidthLimit > 0 {
+		d.connBandwidthLimitEntry.SetText(strconv.Itoa(d.ui.Cfg.Tor.ConnBandwidthLimit))
+		forceAdv = true
+	}
+	d.marUpdatesSwitch.SetActive(d.ui.Cfg.EnableMARUpdates)
+	if d.ui.Cfg.EnableMARUpdates {
+		forceAdv = true
+	}
+	d.updateWindowEntry.SetText(d.ui.Cfg.UpdateWindow)
+	d.updateWindowBox.SetSensitive(d.ui.Cfg.EnableMARUpdates)
+	if !d.uiLocaleCombo.SetActiveID(d.ui.Cfg.UILocale) {
+		// Keep a hand edited override that has no catalog of it's own (eg:
+		// `es-AR`), instead of silently resetting it.
+		d.uiLocaleCombo.Append(d.ui.Cfg.UILocale, d.ui.Cfg.UILocale)
+		d.uiLocaleCombo.SetActiveID(d.ui.Cfg.UILocale)
+	}
+	if d.ui.Cfg.Sandbox.MemoryLimit > 0 {
+		d.memoryLimitEntry.SetText(strconv.Itoa(d.ui.Cfg.Sandbox.MemoryLimit))
+		forceAdv = true
+	}
+	if d.ui.Cfg.Sandbox.CPUWeight > 0 {
+		d.cpuWeightEntry.SetText(strconv.Itoa(d.ui.Cfg.Sandbox.CPUWeight))
+		forceAdv = true
+	}
+	d.enablePauseSwitch.SetActive(d.ui.Cfg.Sandbox.EnablePause)
+	if d.ui.Cfg.Sandbox.EnablePause {
+		forceAdv = true
+	}
 	if d.ui.Cfg.Sandbox.DownloadsDir != "" {
 		d.downloadsDirChooser.SetCurrentFolder(d.ui.Cfg.Sandbox.DownloadsDir)
 		forceAdv = true
@@ -131,9 +235,10 @@ func (d *configDialog) loadFromConfig() {
 	}
 
 	// Hide certain options from the masses, that are probably confusing.
-	for _, w := range []*gtk3.Box{d.amnesiacProfileBox, d.displayBox, d.downloadsDirBox, d.desktopDirBox} {
+	for _, w := range []*gtk3.Box{d.torConfluxBox, d.torKeepRunningBox, d.torEphemeralStateBox, d.amnesiacProfileBox, d.extSettingsBox, d.persistentCacheBox, d.displayBox, d.x11ModeBox, d.bandwidthLimitBox, d.marUpdatesBox, d.updateWindowBox, d.resourceLimitBox, d.enablePauseBox, d.downloadsDirBox, d.desktopDirBox} {
 		w.SetVisible(d.ui.AdvancedConfig || forceAdv)
 	}
+	d.torrcBox.SetVisible((d.ui.AdvancedConfig || forceAdv) && !d.ui.Cfg.UseSystemTor)
 	d.loaded = true
 }
 
@@ -146,8 +251,8 @@ func (d *configDialog) onOk() error {
 		return err
 	} else if s = strings.TrimSpace(s); s == "" {
 		d.ui.Cfg.Tor.SetProxyAddress(s)
-	} else if net.ParseIP(s) == nil {
-		return fmt.Errorf("Malformed proxy address: '%v'", s)
+	} else if s, err = config.ValidateProxyAddress(s); err != nil {
+		return fmt.Errorf("Invalid proxy address: %v", err)
 	} else {
 		d.ui.Cfg.Tor.SetProxyAddress(s)
 	}
@@ -195,21 +300,101 @@ func (d *configDialog) onOk() error {
 	} else {
 		d.ui.Cfg.Tor.SetCustomBridges(s)
 	}
+	d.ui.Cfg.Tor.SetConfluxMode(d.torConfluxMode.GetActiveText())
+	d.ui.Cfg.Tor.SetKeepRunning(d.torKeepRunningSwitch.GetActive())
+	ephemeral := d.torEphemeralStateSwitch.GetActive()
+	if ephemeral && !d.ui.Cfg.Tor.EphemeralState && !d.ui.ask("Discard tor's state, including the entry guards, every time tor exits?\n\nWARNING: Picking new entry guards every launch makes it considerably more likely that a malicious guard is eventually used, and makes the tor network traffic stand out.  This is only recommended if the persistent state is a larger risk.") {
+		d.torEphemeralStateSwitch.SetActive(false)
+		ephemeral = false
+	}
+	d.ui.Cfg.Tor.SetEphemeralState(ephemeral)
+	if s, err := d.getExtraTorrc(); err != nil {
+		return err
+	} else if s, err = tor.ValidateExtraTorrc(s); err != nil {
+		return err
+	} else {
+		d.ui.Cfg.Tor.SetExtraTorrc(s)
+	}
 
 	d.ui.Cfg.Sandbox.SetEnablePulseAudio(d.pulseAudioSwitch.GetActive())
 	d.ui.Cfg.Sandbox.SetEnableAVCodec(d.avCodecSwitch.GetActive())
 	d.ui.Cfg.Sandbox.SetEnableCircuitDisplay(d.circuitDisplaySwitch.GetActive())
+	d.ui.Cfg.Sandbox.SetBrokerClipboard(d.brokerClipboardSwitch.GetActive())
 	d.ui.Cfg.Sandbox.SetEnableAmnesiacProfileDirectory(d.amnesiacProfileSwitch.GetActive())
+	d.ui.Cfg.Sandbox.SetPersistExtensionSettings(d.extSettingsSwitch.GetActive())
+	persistentCache := d.persistentCacheSwitch.GetActive()
+	if persistentCache && !d.ui.Cfg.Sandbox.PersistentCache && !d.ui.ask("Keep Tor Browser's disk cache across sessions?\n\nWARNING: The cache records the sites that were visited, is readable by anyone with access to the disk, and can be used by sites to recognize the browser across sessions.  This is only recommended on metered connections.\n\nThe disk cache is only used when \"Always use private browsing mode\" is disabled in Tor Browser.") {
+		d.persistentCacheSwitch.SetActive(false)
+		persistentCache = false
+	}
+	if !persistentCache && d.ui.Cfg.Sandbox.PersistentCache {
+		if err := d.ui.ClearBrowserCache(); err != nil {
+			log.Printf("ui: Failed to clear the disk cache: %v", err)
+		}
+	}
+	d.ui.Cfg.Sandbox.SetPersistentCache(persistentCache)
 	if s, err := d.displayEntry.GetText(); err != nil {
 		return err
 	} else {
 		d.ui.Cfg.Sandbox.SetDisplay(strings.TrimSpace(s))
 	}
+	x11Mode := d.x11ModeCombo.GetActiveID()
+	if x11Mode == config.X11ModeDirect && d.ui.Cfg.Sandbox.GetX11Mode() != config.X11ModeDirect && !d.ui.ask("Give Tor Browser direct access to the X11 display?\n\nWARNING: The X11 surrogate will not be used, so Tor Browser, and anything that compromises it, will be able to read the contents of, record the keystrokes sent to, and control every other application on the display.  This is only recommended if the surrogate is incompatible with the X server.") {
+		x11Mode = d.ui.Cfg.Sandbox.GetX11Mode()
+		d.x11ModeCombo.SetActiveID(x11Mode)
+	}
+	if x11Mode == config.X11ModeSurrogate {
+		x11Mode = ""
+	}
+	d.ui.Cfg.Sandbox.SetX11Mode(x11Mode)
+	if s, err := d.bandwidthLimitEntry.GetText(); err != nil {
+		return err
+	} else if i, err := config.ParseBandwidthLimit(strings.TrimSpace(s)); err != nil {
+		return fmt.Errorf("Invalid total bandwidth limit: %v", err)
+	} else {
+		d.ui.Cfg.Tor.SetBandwidthLimit(i)
+	}
+	if s, err := d.connBandwidthLimitEntry.GetText(); err != nil {
+		return err
+	} else if i, err := config.ParseBandwidthLimit(strings.TrimSpace(s)); err != nil {
+		return fmt.Errorf("Invalid per connection bandwidth limit: %v", err)
+	} else {
+		d.ui.Cfg.Tor.SetConnBandwidthLimit(i)
+	}
+	d.ui.Cfg.SetEnableMARUpdates(d.marUpdatesSwitch.GetActive())
+	if s, err := d.updateWindowEntry.GetText(); err != nil {
+		return err
+	} else if s = strings.TrimSpace(s); s == "" {
+		d.ui.Cfg.SetUpdateWindow(s)
+	} else if _, _, err = config.ParseUpdateWindow(s); err != nil {
+		return fmt.Errorf("Invalid update maintenance window: %v", err)
+	} else {
+		d.ui.Cfg.SetUpdateWindow(s)
+	}
+	d.ui.Cfg.SetUILocale(d.uiLocaleCombo.GetActiveID())
+	if s, err := d.memoryLimitEntry.GetText(); err != nil {
+		return err
+	} else if i, err := config.ParseMemoryLimit(strings.TrimSpace(s)); err != nil {
+		return fmt.Errorf("Invalid memory limit: %v", err)
+	} else {
+		d.ui.Cfg.Sandbox.SetMemoryLimit(i)
+	}
+	if s, err := d.cpuWeightEntry.GetText(); err != nil {
+		return err
+	} else if i, err := config.ParseCPUWeight(strings.TrimSpace(s)); err != nil {
+		return fmt.Errorf("Invalid CPU weight: %v", err)
+	} else {
+		d.ui.Cfg.Sandbox.SetCPUWeight(i)
+	}
+	d.ui.Cfg.Sandbox.SetEnablePause(d.enablePauseSwitch.GetActive())
 	d.ui.Cfg.Sandbox.SetDownloadsDir(d.downloadsDirChooser.GetFilename())
 	d.ui.Cfg.Sandbox.SetDesktopDir(d.desktopDirChooser.GetFilename())
 	return d.ui.Cfg.Sync()
 }
 
+// run shows the config dialog, and applies the config when the user clicks
+// OK.  The dialog stays open with the user's input intact if the config
+// fails to validate, and false is returned iff the user cancels.
 func (d *configDialog) run() bool {
 	d.loadFromConfig()
 	defer func() {
@@ -217,7 +402,16 @@ func (d *configDialog) run() bool {
 		d.ui.forceRedraw()
 	}()
 
-	return d.dialog.Run() == int(gtk3.RESPONSE_OK)
+	for {
+		if d.dialog.Run() != int(gtk3.RESPONSE_OK) {
+			return false
+		}
+		if err := d.onOk(); err != nil {
+			d.ui.bitch("Failed to write config: %v", err)
+			continue
+		}
+		return true
+	}
 }
 
 func (d *configDialog) proxyTypeFromCfg() {
@@ -238,6 +432,34 @@ func (d *configDialog) internalBridgeTypeFromCfg() {
 	d.torBridgeInternalType.SetActiveID(t)
 }
 
+func (d *configDialog) confluxModeFromCfg() {
+	m := d.ui.Cfg.Tor.ConfluxMode
+	if m == "" {
+		m = config.ConfluxAutomatic
+	}
+	d.torConfluxMode.SetActiveID(m)
+}
+
+func (d *configDialog) getExtraTorrc() (string, error) {
+	start := d.torExtraTorrcEntryBuf.GetStartIter()
+	end := d.torExtraTorrcEntryBuf.GetEndIter()
+	return d.torExtraTorrcEntryBuf.GetText(start, end, false)
+}
+
+func (d *configDialog) updateTorrcPreview() {
+	// The preview reflects the saved config, with the extra torrc lines
+	// that are currently being edited.
+	s, err := d.getExtraTorrc()
+	if err != nil {
+		return
+	}
+	if torrc, err := tor.PreviewSandboxTorrc(d.ui.Cfg, d.ui.Manif, sbui.Bridges, s); err != nil {
+		d.torrcPreviewBuf.SetText(fmt.Sprintf("# Invalid torrc: %v", err))
+	} else {
+		d.torrcPreviewBuf.SetText(string(torrc))
+	}
+}
+
 func (d *configDialog) onProxyTypeChanged() {
 	d.torProxyAuthBox.SetSensitive(d.torProxyType.GetActiveText() != proxySOCKS4)
 }
@@ -261,6 +483,131 @@ func (d *configDialog) updateBridgeEntrySensitive() {
 	}
 }
 
+// updateBridgeLineErrors highlights the custom bridge lines that fail
+// validation, and lists the reasons in the tooltip.
+func (d *configDialog) updateBridgeLineErrors() {
+	buf := d.torBridgeCustomEntryBuf
+	s, err := buf.GetText(buf.GetStartIter(), buf.GetEndIter(), false)
+	if err != nil {
+		return
+	}
+	buf.RemoveTag(d.entryError, buf.GetStartIter(), buf.GetEndIter())
+
+	errs := sbui.CheckBridgeLines(s)
+	if len(errs) == 0 {
+		d.torBridgeCustomEntry.SetTooltipText("")
+		return
+	}
+
+	// The buffer is indexed by character, not byte.
+	lines := strings.Split(s, "\n")
+	offsets := make([]int, len(lines))
+	for i, off := 1, 0; i < len(lines); i++ {
+		off += utf8.RuneCountInString(lines[i-1]) + 1
+		offsets[i] = off
+	}
+	reasons := make([]string, 0, len(errs))
+	for _, e := range errs {
+		start := offsets[e.Line]
+		end := start + utf8.RuneCountInString(lines[e.Line])
+		buf.ApplyTag(d.entryError, buf.GetIterAtOffset(start), buf.GetIterAtOffset(end))
+		reasons = append(reasons, fmt.Sprintf("Line %d: %v", e.Line+1, e.Reason))
+	}
+	d.torBridgeCustomEntry.SetTooltipText(strings.Join(reasons, "\n"))
+}
+
+// onImportBridges appends the bridge lines from a QR code in a user selected
+// image to the custom bridge lines.
+func (d *configDialog) onImportBridges() {
+	path, ok := d.ui.chooseImageFile()
+	if !ok {
+		return
+	}
+	s, err := sbui.BridgesFromImage(path)
+	if err != nil {
+		log.Printf("ui: Failed to import bridges from '%v': %v", path, err)
+		d.ui.bitch("Failed to import bridges: %v", err)
+		return
+	}
+
+	buf := d.torBridgeCustomEntryBuf
+	cur, err := buf.GetText(buf.GetStartIter(), buf.GetEndIter(), false)
+	if err != nil {
+		return
+	}
+	if cur = strings.TrimRight(cur, "\n"); cur != "" {
+		cur += "\n"
+	}
+	buf.SetText(cur + s)
+	d.torBridgeCustom.SetActive(true)
+	d.updateBridgeEntrySensitive()
+}
+
+// onTestBridges tests the reachability of each of the custom bridge lines
+// with a temporary tor instance, and displays the per-line results.  The
+// saved proxy configuration is used.
+func (d *configDialog) onTestBridges() {
+	buf := d.torBridgeCustomEntryBuf
+	s, err := buf.GetText(buf.GetStartIter(), buf.GetEndIter(), false)
+	if err != nil {
+		return
+	}
+	if _, err = sbui.ValidateBridgeLines(s); err != nil {
+		d.ui.bitch("Invalid bridges: %v", err)
+		return
+	}
+
+	d.ui.progressDialog.setTitle("Testing Bridges")
+	d.ui.progressDialog.setText("Initializing bridge test...")
+
+	var results []*tor.BridgeTestResult
+	a := async.NewAsync()
+	d.ui.progressDialog.run(a, func() { d.ui.TestCustomBridges(a, s, &results) })
+	if a.Err == async.ErrCanceled {
+		return
+	} else if a.Err != nil {
+		d.ui.bitch("Failed to test bridges: %v", a.Err)
+		return
+	}
+
+	var lines []string
+	nOk := 0
+	for _, r := range results {
+		if r.Reachable {
+			lines = append(lines, "\u2713 "+r.Line)
+			nOk++
+		} else {
+			lines = append(lines, fmt.Sprintf("\u2717 %s (%s)", r.Line, r.Reason))
+		}
+	}
+	d.ui.inform("%d of %d bridges are reachable.\n\n%s", nOk, len(results), strings.Join(lines, "\n"))
+}
+
+func (ui *gtkUI) chooseImageFile() (string, bool) {
+	fc, err := gtk3.FileChooserDialogNewWith2Buttons("Import Bridges", ui.mainWindow, gtk3.FILE_CHOOSER_ACTION_OPEN, "Cancel", gtk3.RESPONSE_CANCEL, "Open", gtk3.RESPONSE_ACCEPT)
+	if err != nil {
+		log.Printf("ui: Failed to create the file chooser: %v", err)
+		return "", false
+	}
+	defer func() {
+		fc.Destroy()
+		ui.forceRedraw()
+	}()
+	if filter, err := gtk3.FileFilterNew(); err == nil {
+		filter.SetName("Images")
+		for _, ext := range []string{"png", "jpg", "jpeg", "gif"} {
+			filter.AddPattern("*." + ext)
+			filter.AddPattern("*." + strings.ToUpper(ext))
+		}
+		fc.AddFilter(filter)
+	}
+	if gtk3.ResponseType(fc.Run()) != gtk3.RESPONSE_ACCEPT {
+		return "", false
+	}
+	path := fc.GetFilename()
+	return path, path != ""
+}
+
 func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 	d := new(configDialog)
 	d.ui = ui
@@ -376,6 +723,75 @@ func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 		}
 		tt.Add(d.entryInsensitive)
 	}
+	if button, err := getButton(b, "torBridgeImportButton"); err != nil {
+		return err
+	} else {
+		button.Connect("clicked", func() { d.onImportBridges() })
+	}
+	if button, err := getButton(b, "torBridgeTestButton"); err != nil {
+		return err
+	} else {
+		button.Connect("clicked", func() { d.onTestBridges() })
+	}
+	if d.entryError, err = gtk3.TextTagNew("error"); err != nil {
+		return err
+	} else {
+		d.entryError.SetProperty("background", "#f2c4c4")
+		tt, err := d.torBridgeCustomEntryBuf.GetTagTable()
+		if err != nil {
+			return err
+		}
+		tt.Add(d.entryError)
+		d.torBridgeCustomEntryBuf.Connect("changed", func() { d.updateBridgeLineErrors() })
+	}
+
+	// Tor feature config elements.
+	if d.torConfluxBox, err = getBox(b, "torConfluxBox"); err != nil {
+		return err
+	}
+	if d.torConfluxMode, err = getComboBoxText(b, "torConfluxMode"); err != nil {
+		return err
+	} else {
+		for _, v := range config.TorConfluxModes {
+			d.torConfluxMode.Append(v, v)
+		}
+	}
+	if d.torKeepRunningBox, err = getBox(b, "torKeepRunningBox"); err != nil {
+		return err
+	}
+	if d.torKeepRunningSwitch, err = getSwitch(b, "torKeepRunningSwitch"); err != nil {
+		return err
+	}
+	if d.torEphemeralStateBox, err = getBox(b, "torEphemeralStateBox"); err != nil {
+		return err
+	}
+	if d.torEphemeralStateSwitch, err = getSwitch(b, "torEphemeralStateSwitch"); err != nil {
+		return err
+	}
+
+	// torrc config elements.
+	if d.torrcBox, err = getBox(b, "torrcBox"); err != nil {
+		return err
+	}
+	if d.torExtraTorrcEntry, err = getTextView(b, "torExtraTorrcEntry"); err != nil {
+		return err
+	}
+	if d.torExtraTorrcEntryBuf, err = d.torExtraTorrcEntry.GetBuffer(); err != nil {
+		return err
+	} else {
+		d.torExtraTorrcEntryBuf.Connect("changed", func() { d.updateTorrcPreview() })
+	}
+	if d.torrcPreview, err = getTextView(b, "torrcPreview"); err != nil {
+		return err
+	}
+	if d.torrcPreviewBuf, err = d.torrcPreview.GetBuffer(); err != nil {
+		return err
+	}
+	for _, v := range []*gtk3.TextView{d.torExtraTorrcEntry, d.torrcPreview} {
+		if _, err = v.GetProperty("monospace"); err == nil { // Gtk+ >= 3.16
+			v.SetProperty("monospace", true)
+		}
+	}
 
 	// Sandbox config elements.
 	if d.pulseAudioSwitch, err = getSwitch(b, "pulseAudioSwitch"); err != nil {
@@ -387,18 +803,96 @@ func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 	if d.circuitDisplaySwitch, err = getSwitch(b, "circuitDisplaySwitch"); err != nil {
 		return err
 	}
+	if d.brokerClipboardSwitch, err = getSwitch(b, "brokerClipboardSwitch"); err != nil {
+		return err
+	}
 	if d.amnesiacProfileSwitch, err = getSwitch(b, "amnesiacProfileSwitch"); err != nil {
 		return err
+	} else {
+		d.amnesiacProfileSwitch.Connect("notify::active", func() {
+			d.extSettingsBox.SetSensitive(d.amnesiacProfileSwitch.GetActive())
+		})
 	}
 	if d.amnesiacProfileBox, err = getBox(b, "amnesiacProfileBox"); err != nil {
 		return err
 	}
+	if d.extSettingsSwitch, err = getSwitch(b, "persistExtensionSettingsSwitch"); err != nil {
+		return err
+	}
+	if d.extSettingsBox, err = getBox(b, "persistExtensionSettingsBox"); err != nil {
+		return err
+	}
+	if d.persistentCacheSwitch, err = getSwitch(b, "persistentCacheSwitch"); err != nil {
+		return err
+	}
+	if d.persistentCacheBox, err = getBox(b, "persistentCacheBox"); err != nil {
+		return err
+	}
 	if d.displayBox, err = getBox(b, "displayBox"); err != nil {
 		return err
 	}
 	if d.displayEntry, err = getEntry(b, "displayEntry"); err != nil {
 		return err
 	}
+	if d.x11ModeBox, err = getBox(b, "x11ModeBox"); err != nil {
+		return err
+	}
+	if d.x11ModeCombo, err = getComboBoxText(b, "x11ModeCombo"); err != nil {
+		return err
+	} else {
+		d.x11ModeCombo.Append(config.X11ModeSurrogate, i18n.T("Filtered (Surrogate)"))
+		d.x11ModeCombo.Append(config.X11ModeDirect, i18n.T("Direct (Unfiltered)"))
+		d.x11ModeCombo.Append(config.X11ModeDisabled, i18n.T("Disabled"))
+	}
+	if d.bandwidthLimitBox, err = getBox(b, "bandwidthLimitBox"); err != nil {
+		return err
+	}
+	if d.bandwidthLimitEntry, err = getEntry(b, "bandwidthLimitEntry"); err != nil {
+		return err
+	}
+	if d.connBandwidthLimitEntry, err = getEntry(b, "connBandwidthLimitEntry"); err != nil {
+		return err
+	}
+	if d.marUpdatesBox, err = getBox(b, "marUpdatesBox"); err != nil {
+		return err
+	}
+	if d.marUpdatesSwitch, err = getSwitch(b, "marUpdatesSwitch"); err != nil {
+		return err
+	} else {
+		d.marUpdatesSwitch.Connect("notify::active", func() {
+			d.updateWindowBox.SetSensitive(d.marUpdatesSwitch.GetActive())
+		})
+	}
+	if d.updateWindowBox, err = getBox(b, "updateWindowBox"); err != nil {
+		return err
+	}
+	if d.updateWindowEntry, err = getEntry(b, "updateWindowEntry"); err != nil {
+		return err
+	}
+	if d.uiLocaleCombo, err = getComboBoxText(b, "uiLocaleCombo"); err != nil {
+		return err
+	} else {
+		d.uiLocaleCombo.Append("", i18n.T("Automatic"))
+		d.uiLocaleCombo.Append(i18n.DefaultLocale, i18n.DefaultLocale)
+		for _, l := range i18n.Available() {
+			d.uiLocaleCombo.Append(l, l)
+		}
+	}
+	if d.resourceLimitBox, err = getBox(b, "resourceLimitBox"); err != nil {
+		return err
+	}
+	if d.memoryLimitEntry, err = getEntry(b, "memoryLimitEntry"); err != nil {
+		return err
+	}
+	if d.cpuWeightEntry, err = getEntry(b, "cpuWeightEntry"); err != nil {
+		return err
+	}
+	if d.enablePauseBox, err = getBox(b, "enablePauseBox"); err != nil {
+		return err
+	}
+	if d.enablePauseSwitch, err = getSwitch(b, "enablePauseSwitch"); err != nil {
+		return err
+	}
 	if d.downloadsDirBox, err = getBox(b, "downloadsDirBox"); err != nil {
 		return err
 	}
@@ -412,6 +906,32 @@ func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 		return err
 	}
 
+	if button, err := getButton(b, "configDiagnosticsButton"); err != nil {
+		return err
+	} else {
+		button.Connect("clicked", func() { ui.showDiagnostics() })
+	}
+	if button, err := getButton(b, "configBackupButton"); err != nil {
+		return err
+	} else {
+		button.Connect("clicked", func() { ui.runBackup(false) })
+	}
+	if button, err := getButton(b, "configRestoreButton"); err != nil {
+		return err
+	} else {
+		button.Connect("clicked", func() { ui.runBackup(true) })
+	}
+	if button, err := getButton(b, "configUninstallButton"); err != nil {
+		return err
+	} else {
+		button.Connect("clicked", func() {
+			// Nothing is left to configure or launch.
+			if ui.runUninstall(true) {
+				d.dialog.Response(gtk3.RESPONSE_CANCEL)
+			}
+		})
+	}
+
 	ui.configDialog = d
 	return nil
 }
@@ -0,0 +1,94 @@
+// container.go - Gtk+ stream isolation container selector.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
+)
+
+// chooseContainer asks which stream isolation container Tor Browser should
+// use, and returns false if the user canceled the launch.
+func (ui *gtkUI) chooseContainer() bool {
+	containers := ui.Cfg.Tor.Containers
+	if len(containers) == 0 {
+		return true
+	}
+
+	d, err := gtk3.DialogNew()
+	if err != nil {
+		log.Printf("ui: Failed to create the container dialog: %v", err)
+		return true
+	}
+	defer func() {
+		d.Destroy()
+		ui.forceRedraw()
+	}()
+	d.SetTitle(i18n.T("Choose Container"))
+	d.SetIcon(ui.iconPixbuf)
+	d.SetTransientFor(ui.mainWindow)
+	d.AddButton(i18n.T("Cancel"), gtk3.RESPONSE_CANCEL)
+	d.AddButton(i18n.T("Launch"), gtk3.RESPONSE_OK)
+	d.SetDefaultResponse(gtk3.RESPONSE_OK)
+
+	box, err := d.GetContentArea()
+	if err != nil {
+		return true
+	}
+	label, err := gtk3.LabelNew(i18n.T("Streams from different containers never share circuits.  Persistent containers keep their isolation across launches."))
+	if err != nil {
+		return true
+	}
+	label.SetLineWrap(true)
+	box.PackStart(label, false, false, 4)
+	combo, err := gtk3.ComboBoxTextNew()
+	if err != nil {
+		return true
+	}
+	box.PackStart(combo, false, false, 4)
+
+	// The first entry is the throwaway credential.
+	combo.AppendText("Throwaway")
+	combo.SetActive(0)
+	for i, c := range containers {
+		name := c.Name
+		if c.Persistent {
+			name += " (persistent)"
+		}
+		combo.AppendText(name)
+		if c.Name == ui.Cfg.Tor.Container {
+			combo.SetActive(i + 1)
+		}
+	}
+	d.ShowAll()
+
+	if gtk3.ResponseType(d.Run()) != gtk3.RESPONSE_OK {
+		return false
+	}
+	if idx := combo.GetActive(); idx > 0 {
+		ui.Cfg.Tor.SetContainer(containers[idx-1].Name)
+	} else {
+		ui.Cfg.Tor.SetContainer("")
+	}
+	if err := ui.Cfg.Sync(); err != nil {
+		ui.bitch("Failed to write config: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+// errors.go - Gtk+ error reporting routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+
+	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	sbui "cmd/sandboxed-tor-browser/internal/ui"
+)
+
+// onLaunchError reports a failed launch, and suggests the appropriate fix.
+// On return the launch loop drops back to the config dialog, unless the
+// user opted to retry immediately.
+func (ui *gtkUI) onLaunchError(err error) {
+	switch e := err.(type) {
+	case *tor.BootstrapError:
+		if e.NeedsBridges {
+			if ui.ask("Failed to launch Tor Browser: %v\n\nEnable the built-in bridges and try again?", err) {
+				log.Printf("ui: User enabled bridges after a bootstrap stall")
+				ui.enableBridges()
+			}
+			return
+		}
+		if ui.ask("Failed to launch Tor Browser: %v\n\nTry again?", err) {
+			ui.ForceConfig = false
+		}
+		return
+	case *sbui.ProfileError:
+		if ui.ask("The Tor Browser profile appears to be damaged:\n\n%s\n\nReset the profile?  Bookmarks and downloads will be preserved, and the old profile will be moved to `%s`.", e.String(), ui.ProfileBackupDir()) {
+			if err := ui.ResetProfile(); err != nil {
+				ui.bitch("Failed to reset profile: %v", err)
+				return
+			}
+		} else {
+			log.Printf("ui: User declined profile reset")
+			ui.IgnoreProfileProblems = true
+		}
+		ui.ForceConfig = false
+		return
+	case *installer.ChannelMismatchError:
+		if ui.ask("The installed Tor Browser is not from the `%s` channel.\n\nReinstall Tor Browser?", e.Configured) {
+			ui.ForceInstall = true
+		}
+		return
+	}
+
+	switch err {
+	case sbui.ErrInstallRequired, sandbox.ErrNoFirefox:
+		if ui.ask("Failed to launch Tor Browser: %v\n\nThe installed bundle appears to be incomplete.  Reinstall Tor Browser?", err) {
+			ui.ForceInstall = true
+		}
+	case sandbox.ErrBwrapMissing:
+		ui.bitch("Failed to launch Tor Browser: %v\n\nInstall bubblewrap (`bwrap`) from the distribution's packages, and try again.", err)
+	case sandbox.ErrBwrapTooOld:
+		ui.bitch("Failed to launch Tor Browser: %v\n\nUpgrade bubblewrap (`bwrap`) to 0.1.3 or later, and try again.", err)
+	case sandbox.ErrBwrapFailed, sandbox.ErrBwrapTimeout:
+		report, _ := ui.RunDiagnostics()
+		ui.bitch("Failed to launch Tor Browser: %v\n\nThis is usually caused by the host not allowing unprivileged user namespaces.\n\n%s", err, report)
+	case sandbox.ErrX11Disabled:
+		ui.bitch("Failed to launch Tor Browser: %v\n\nTor Browser requires X11 access, change `x11Mode` in the `sandbox` section of the config.", err)
+	case sandbox.ErrNoDisplay, sandbox.ErrRemoteDisplay:
+		ui.bitch("Failed to launch Tor Browser: %v\n\nTor Browser requires a local X11 display (eg: `:0`), run from an X11 session, or set the X11 Display in the configuration.", err)
+	case tor.ErrTorCrashed, tor.ErrCtrlPortTimeout:
+		if ui.ask("Failed to launch Tor Browser: %v\n\nThis may be transient.  Try again?", err) {
+			ui.ForceConfig = false
+		}
+	case tor.ErrCustomTorTooOld:
+		ui.bitch("Failed to launch Tor Browser: %v\n\nUpgrade the custom tor binary, or remove `customTorPath` from the `tor` section of the config to use the bundled tor.", err)
+	default:
+		ui.bitch("Failed to launch Tor Browser: %v", err)
+	}
+}
+
+// onInstallError reports a failed install, and suggests the appropriate fix.
+func (ui *gtkUI) onInstallError(err error) {
+	if e, ok := err.(*installer.InsufficientSpaceError); ok {
+		ui.bitch("Failed to install: %v\n\nFree up space in `%s`, and try again.", err, e.Dir)
+		return
+	}
+	ui.bitch("Failed to install: %v", err)
+}
@@ -17,6 +17,8 @@
 package gtk
 
 import (
+	"log"
+
 	gtk3 "github.com/gotk3/gotk3/gtk"
 
 	sbui "cmd/sandboxed-tor-browser/internal/ui"
@@ -30,9 +32,16 @@ type installDialog struct {
 	channelSelector    *gtk3.ComboBoxText
 	localeSelector     *gtk3.ComboBoxText
 	systemTorIndicator *gtk3.Box
+
+	preselected bool
 }
 
 func (d *installDialog) run() bool {
+	// The setup wizard already asked for the channel and locale.
+	if d.preselected {
+		d.preselected = false
+		return true
+	}
 	defer d.dialog.Hide()
 	return d.dialog.Run() == int(gtk3.RESPONSE_OK)
 }
@@ -55,8 +64,40 @@ func (d *installDialog) onOk() error {
 		return nil
 	}
 
+	// Switching channels reinstalls the bundle, so let the user know what
+	// will happen to the profile.
+	checkOnly := d.ui.InstallVerifyOnly || d.ui.InstallDryRun
+	if from, to, ok := d.ui.ChannelSwitch(); ok && !checkOnly {
+		d.ui.ProfileBackup = d.ui.ask("Switching from the `%s` channel to the `%s` channel will reinstall Tor Browser.  The existing profile will be carried over, unless the new channel has an older version of firefox.\n\nBack up the current profile to `%s` first?", from, to, d.ui.ChannelBackupDir(from))
+	}
+
+	err := d.runInstall()
+	if err == sbui.ErrProfileDowngrade {
+		from, to, _ := d.ui.ChannelSwitch()
+		if !d.ui.ask("The `%s` channel has an older version of firefox than the installed `%s` channel, and using the existing profile with it will corrupt the profile.\n\nInstall with a fresh profile?  The current profile will be backed up to `%s`.", to, from, d.ui.ChannelBackupDir(from)) {
+			// Revert to the installed channel, and return to the install
+			// dialog.
+			log.Printf("ui: User declined a fresh profile, reverting channel")
+			d.ui.Cfg.SetChannel(from)
+			d.channelSelector.SetActiveID(from)
+			if err = d.ui.Cfg.Sync(); err != nil {
+				return err
+			}
+			return async.ErrCanceled
+		}
+		d.ui.ProfileBackup, d.ui.FreshProfile = true, true
+		err = d.runInstall()
+	}
+	return err
+}
+
+func (d *installDialog) runInstall() error {
 	// Configure the progress bar dialog.
-	d.ui.progressDialog.setTitle("Installing Tor Browser")
+	if d.ui.InstallVerifyOnly || d.ui.InstallDryRun {
+		d.ui.progressDialog.setTitle("Checking Tor Browser Installation")
+	} else {
+		d.ui.progressDialog.setTitle("Installing Tor Browser")
+	}
 	d.ui.progressDialog.setText("Initializing installation process...")
 
 	// Display the progress dialog, and start the install task.
@@ -65,6 +106,14 @@ func (d *installDialog) onOk() error {
 	return async.Err
 }
 
+// preselect sets the selectors to the configured channel and locale, and
+// skips showing the dialog once.
+func (d *installDialog) preselect() {
+	d.channelSelector.SetActiveID(d.ui.Cfg.Channel)
+	d.localeSelector.SetActiveID(d.ui.Cfg.Locale)
+	d.preselected = true
+}
+
 func (d *installDialog) onChannelChanged() {
 	// Repopulate the locale dropdown, based on the currently selected locale,
 	// for the new channel.
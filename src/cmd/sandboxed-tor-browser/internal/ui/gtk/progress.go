@@ -17,10 +17,14 @@
 package gtk
 
 import (
+	"context"
+
+	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	gtk3 "github.com/gotk3/gotk3/gtk"
 
 	async "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
 )
 
 type progressDialog struct {
@@ -30,53 +34,102 @@ type progressDialog struct {
 	progressText   *gtk3.Label
 	progressCancel *gtk3.Button
 
-	updateCh chan string
+	detailsView    *gtk3.TextView
+	detailsBuf     *gtk3.TextBuffer
+	detailsEnd     *gtk3.TextMark
+	detailsCopyLog *gtk3.Button
 }
 
 func (d *progressDialog) setTitle(s string) {
-	d.dialog.SetTitle(s)
+	d.dialog.SetTitle(i18n.T(s))
 }
 
 func (d *progressDialog) setText(s string) {
-	d.progressText.SetText(s)
+	d.progressText.SetText(i18n.T(s))
 }
 
-func (d *progressDialog) run(async *async.Async, runFn func()) {
-	const updateInterval = 100 // ms
-	cancel := false
+func (d *progressDialog) appendDetail(s string) {
+	iter := d.detailsBuf.GetEndIter()
+	if d.detailsBuf.GetCharCount() > 0 {
+		s = "\n" + s
+	}
+	d.detailsBuf.Insert(iter, s)
+	d.detailsView.ScrollToMark(d.detailsEnd, 0, false, 0, 0)
+}
 
-	d.progressCancel.SetSensitive(true)
-	d.updateCh = make(chan string, 2) // HACKHACKHACKHACK
-	async.UpdateProgress = func(s string) { d.updateCh <- s }
+func (d *progressDialog) onCopyLog() {
+	start, end := d.detailsBuf.GetBounds()
+	s, err := d.detailsBuf.GetText(start, end, false)
+	if err != nil {
+		return
+	}
+	if clipboard, err := gtk3.ClipboardGet(gdk.SELECTION_CLIPBOARD); err == nil {
+		clipboard.SetText(s)
+	}
+}
 
-	var timeoutFn func() bool
-	timeoutFn = func() bool {
-		if cancel {
+func (d *progressDialog) run(async *async.Async, runFn func()) {
+	// The context is canceled (from the main thread) once the dialog is
+	// dismissed.  Since the dialog is reused, every UI update from the pump
+	// is tagged with it, so that late updates from a previous task never
+	// affect the current one.
+	ctx, cancelUI := context.WithCancel(context.Background())
+	defer cancelUI()
+
+	finished := false // Only accessed from the main thread.
+
+	// The details show everything that is logged while the task runs.
+	d.detailsBuf.SetText("")
+	untapLog := d.ui.TapLog(func(s string) {
+		glib.IdleAdd(func() bool {
+			if ctx.Err() == nil {
+				d.appendDetail(s)
+			}
 			return false
-		}
+		})
+	})
+	defer untapLog()
 
-		select {
-		case s := <-d.updateCh:
-			d.setText(s)
-		case <-async.Done:
-			if async.Err == nil {
-				d.emitOk()
-			} else {
-				cancel = true
-				d.emitCancel()
+	d.progressCancel.SetSensitive(true)
+	updateCh := make(chan string)
+	async.UpdateProgress = func(s string) { updateCh <- s }
+
+	// The pump forwards events from the task to the main thread via idle
+	// sources, and drains the task's channels until it completes, even
+	// after the dialog is dismissed.  The task never blocks on the UI.
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+
+		idleAdd := func(fn func()) {
+			glib.IdleAdd(func() bool {
+				if ctx.Err() == nil {
+					fn()
+				}
+				return false
+			})
+		}
+		for {
+			select {
+			case s := <-updateCh:
+				idleAdd(func() { d.setText(s) })
+			case t := <-async.ToUI:
+				allowCancel := t.(bool)
+				idleAdd(func() { d.progressCancel.SetSensitive(allowCancel) })
+			case <-async.Done:
+				ok := async.Err == nil
+				idleAdd(func() {
+					finished = true
+					if ok {
+						d.emitOk()
+					} else {
+						d.emitCancel()
+					}
+				})
+				return
 			}
-			return false
-		case t := <-async.ToUI:
-			allowCancel := t.(bool)
-			d.progressCancel.SetSensitive(allowCancel)
-		default:
 		}
-
-		// BUG: Returning true should re-add the timer, but it doesn't.
-		glib.TimeoutAdd(updateInterval, timeoutFn)
-		return false
-	}
-	glib.TimeoutAdd(updateInterval, timeoutFn)
+	}()
 
 	go runFn()
 
@@ -85,13 +138,14 @@ func (d *progressDialog) run(async *async.Async, runFn func()) {
 		d.dialog.Hide()
 		d.ui.forceRedraw()
 	}()
-	if d.dialog.Run() != int(gtk3.RESPONSE_OK) {
-		if !cancel {
-			cancel = true
-			async.Cancel <- true
-			<-async.Done
-		}
+	d.dialog.Run()
+	cancelUI()
+	if !finished {
+		// Dismissed by the user, signal cancelation (which the task may
+		// have already stopped checking for).
+		async.Cancel <- true
 	}
+	<-doneCh
 }
 
 func (d *progressDialog) emitOk() {
@@ -134,6 +188,17 @@ func (ui *gtkUI) initProgressDialog(b *gtk3.Builder) error {
 	if d.progressCancel, err = getButton(b, "progressCancelButton"); err != nil {
 		return err
 	}
+	if d.detailsView, err = getTextView(b, "progressDetailsView"); err != nil {
+		return err
+	}
+	if d.detailsBuf, err = d.detailsView.GetBuffer(); err != nil {
+		return err
+	}
+	d.detailsEnd = d.detailsBuf.CreateMark("end", d.detailsBuf.GetEndIter(), false)
+	if d.detailsCopyLog, err = getButton(b, "progressCopyLogButton"); err != nil {
+		return err
+	}
+	d.detailsCopyLog.Connect("clicked", func() { d.onCopyLog() })
 
 	ui.progressDialog = d
 	return nil
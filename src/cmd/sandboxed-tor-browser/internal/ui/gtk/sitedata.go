@@ -0,0 +1,147 @@
+// sitedata.go - Gtk+ site data clearing user interface routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+	"strings"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	sbui "cmd/sandboxed-tor-browser/internal/ui"
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
+)
+
+func (ui *gtkUI) runClearSiteData() {
+	all, err := ui.ListSiteData()
+	if err != nil {
+		ui.bitch("%v", err)
+		return
+	}
+	if len(all) == 0 {
+		ui.inform("The profile contains no site data.")
+		return
+	}
+
+	var sites []*sbui.SiteData
+	if len(ui.ClearSites) > 0 {
+		var missing []string
+		sites, missing = sbui.FindSiteData(all, ui.ClearSites)
+		if len(missing) > 0 {
+			ui.inform("No data was found for: %s", strings.Join(missing, ", "))
+		}
+		if len(sites) == 0 {
+			return
+		}
+	} else {
+		var ok bool
+		if sites, ok = ui.chooseSiteData(all); !ok || len(sites) == 0 {
+			return
+		}
+	}
+
+	names := make([]string, 0, len(sites))
+	for _, d := range sites {
+		names = append(names, d.String())
+	}
+	if !ui.ask("Clear the data for the following sites?\n\n%s", strings.Join(names, "\n")) {
+		return
+	}
+	if err = ui.ClearSiteData(sites); err != nil {
+		log.Printf("ui: Failed to clear site data: %v", err)
+		ui.bitch("Failed to clear site data: %v", err)
+		return
+	}
+	ui.inform("The site data was cleared.")
+}
+
+func (ui *gtkUI) runClearCache() {
+	size, err := ui.BrowserCacheSize()
+	if err != nil {
+		ui.bitch("%v", err)
+		return
+	}
+	if size == 0 {
+		ui.inform("The persistent disk cache is empty.")
+		return
+	}
+	if !ui.ask("Clear the persistent disk cache (%d MiB)?", (size+1024*1024-1)/(1024*1024)) {
+		return
+	}
+	if err = ui.ClearBrowserCache(); err != nil {
+		log.Printf("ui: Failed to clear the disk cache: %v", err)
+		ui.bitch("Failed to clear the disk cache: %v", err)
+		return
+	}
+	ui.inform("The persistent disk cache was cleared.")
+}
+
+func (ui *gtkUI) chooseSiteData(all []*sbui.SiteData) ([]*sbui.SiteData, bool) {
+	d, err := gtk3.DialogNew()
+	if err != nil {
+		log.Printf("ui: Failed to create the site data dialog: %v", err)
+		return nil, false
+	}
+	defer func() {
+		d.Destroy()
+		ui.forceRedraw()
+	}()
+	d.SetTitle(i18n.T("Clear Site Data"))
+	d.SetIcon(ui.iconPixbuf)
+	d.SetTransientFor(ui.mainWindow)
+	d.SetDefaultSize(480, 360)
+	d.AddButton(i18n.T("Cancel"), gtk3.RESPONSE_CANCEL)
+	d.AddButton(i18n.T("Clear"), gtk3.RESPONSE_OK)
+
+	box, err := d.GetContentArea()
+	if err != nil {
+		return nil, false
+	}
+	sw, err := gtk3.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		return nil, false
+	}
+	sw.SetPolicy(gtk3.POLICY_NEVER, gtk3.POLICY_AUTOMATIC)
+	box.PackStart(sw, true, true, 4)
+	list, err := gtk3.BoxNew(gtk3.ORIENTATION_VERTICAL, 2)
+	if err != nil {
+		return nil, false
+	}
+	sw.Add(list)
+
+	checks := make([]*gtk3.CheckButton, 0, len(all))
+	for _, v := range all {
+		cb, err := gtk3.CheckButtonNewWithLabel(v.String())
+		if err != nil {
+			return nil, false
+		}
+		list.PackStart(cb, false, false, 0)
+		checks = append(checks, cb)
+	}
+	d.ShowAll()
+
+	if gtk3.ResponseType(d.Run()) != gtk3.RESPONSE_OK {
+		return nil, false
+	}
+	var sites []*sbui.SiteData
+	for i, cb := range checks {
+		if cb.GetActive() {
+			sites = append(sites, all[i])
+		}
+	}
+	return sites, true
+}
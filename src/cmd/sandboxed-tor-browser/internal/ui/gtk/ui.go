@@ -18,9 +18,14 @@
 package gtk
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gotk3/gotk3/gdk"
@@ -28,13 +33,22 @@ import (
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
 	sbui "cmd/sandboxed-tor-browser/internal/ui"
 	"cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
 	"cmd/sandboxed-tor-browser/internal/ui/notify"
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
-const actionRestart = "restart"
+const (
+	actionRestart = "restart"
+	actionResume  = "resume"
+
+	actionOpenFolder = "open-folder"
+	actionView       = "view"
+)
 
 type gtkUI struct {
 	sbui.Common
@@ -46,9 +60,24 @@ type gtkUI struct {
 	installDialog  *installDialog
 	configDialog   *configDialog
 	progressDialog *progressDialog
+	setupDone      bool
 
 	updateNotification   *notify.Notification
 	updateNotificationCh chan string
+
+	pauseNotification   *notify.Notification
+	pauseNotificationCh chan string
+	pauseSigCh          chan os.Signal
+
+	clipboardNotification *notify.Notification
+	clipboardSigCh        chan os.Signal
+
+	circuitsSigCh chan os.Signal
+
+	downloadNotification   *notify.Notification
+	downloadNotificationCh chan string
+	downloadDir            string
+	downloadPath           string
 }
 
 func (ui *gtkUI) Run() error {
@@ -56,20 +85,58 @@ func (ui *gtkUI) Run() error {
 		updateMinInterval   = 30 * time.Second
 		updateCheckInterval = 2 * time.Hour
 		updateNagInterval   = 15 * time.Minute
+		updateWindowPoll    = 5 * time.Minute
 		gtkPumpInterval     = 1 * time.Second
 	)
 
-	if err := ui.Common.Run(); err != nil {
+	err := ui.Common.Run()
+	if lErr, ok := err.(*sbui.LockHeldError); ok && lErr.Stale {
+		if ui.ask("A previous instance (pid %d) exited uncleanly, and has left sandboxes or other state behind.\n\nKill the leftover sandboxes, and take over?", lErr.Pid) {
+			err = ui.TakeoverLock()
+		}
+	}
+	if err != nil {
 		ui.bitch("Failed to run common UI: %v", err)
 		return err
 	}
-	if ui.PrintVersion {
+	if ui.PrintVersion || ui.RemoteCommand {
 		return nil
 	}
 	if ui.updateNotification == nil {
 		log.Printf("ui: libnotify wasn't found, no desktop notifications possible")
 	}
 
+	if ui.ForceUninstall {
+		ui.runUninstall(false)
+		ui.onDestroy()
+		return nil
+	}
+
+	if l := ui.LegacyInstall(); l != nil {
+		ui.offerLegacyMigration(l)
+	}
+
+	if ui.ForceDiagnostics {
+		ui.showDiagnostics()
+		ui.onDestroy()
+		return nil
+	}
+	if ui.ForceBackup || ui.ForceRestore {
+		ui.runBackup(!ui.ForceBackup)
+		ui.onDestroy()
+		return nil
+	}
+	if ui.ForceClearSites {
+		ui.runClearSiteData()
+		ui.onDestroy()
+		return nil
+	}
+	if ui.ForceClearCache {
+		ui.runClearCache()
+		ui.onDestroy()
+		return nil
+	}
+
 	if ui.WasHardened {
 		log.Printf("ui: Previous `hardened` bundle detected")
 
@@ -81,42 +148,85 @@ func (ui *gtkUI) Run() error {
 		log.Printf("ui: User confirmed `hardened` bundle overwrite")
 	}
 
+	// Walk new users through the basic config, instead of starting with the
+	// install and config dialogs.
+	if ui.Cfg.FirstLaunch && ui.Manif == nil && !ui.AdvancedConfig && !ui.InstallVerifyOnly && !ui.InstallDryRun {
+		if !ui.runSetupWizard() {
+			ui.onDestroy()
+			return nil
+		}
+		ui.setupDone = true
+	}
+
 	if ui.NeedsInstall() || ui.ForceInstall {
-		for {
-			if !ui.installDialog.run() {
+		if ok, err := ui.install(); !ok {
+			return err
+		}
+
+		// Verification-only and dry-run installs never proceed to launch.
+		if ui.InstallVerifyOnly || ui.InstallDryRun {
+			ui.inform("Installation check succeeded.\n\n%s", ui.InstallReport())
+			ui.onDestroy()
+			return nil
+		}
+	}
+
+	// Check the host environment before the first launch, since the
+	// failure modes of a broken host are rather opaque.
+	if ui.Cfg.FirstLaunch {
+		if report, fatal := ui.RunDiagnostics(); fatal {
+			if !ui.ask("The host environment has problems that will likely prevent Tor Browser from launching:\n\n%s\n\nLaunch anyway?", report) {
+				log.Printf("ui: User declined to launch after failed diagnostics")
 				ui.onDestroy()
 				return nil
-			} else {
-				if err := ui.installDialog.onOk(); err != nil {
-					if err != async.ErrCanceled {
-						ui.bitch("Failed to install: %v", err)
-						return err
-					}
-					continue
-				}
-				ui.ForceInstall = false
-				break
 			}
 		}
 	}
 
+	// Offer to use the host's regular download and desktop directories,
+	// instead of the ones inside the bundle.
+	if ui.Cfg.FirstLaunch {
+		ui.offerXDGUserDirs()
+	}
+
+	// Offer to restore the session left behind by a crash.
+	if ui.CrashedSession() {
+		if ui.ask("Tor Browser did not exit cleanly the last time it was run.\n\nRestore the previous session?  Otherwise it will be discarded.") {
+			if err := ui.RestoreSession(); err != nil {
+				ui.bitch("Failed to restore the session: %v", err)
+			}
+		} else if err := ui.DiscardSession(); err != nil {
+			ui.bitch("Failed to discard the session: %v", err)
+		}
+	}
+
 	for {
+		// Reinstall, if a failed launch called for it.
+		if ui.ForceInstall {
+			if ok, err := ui.install(); !ok {
+				return err
+			}
+		}
+
 		// Configuration.
-		if ui.ForceConfig || ui.Cfg.FirstLaunch {
+		if ui.ForceConfig || (ui.Cfg.FirstLaunch && !ui.setupDone) {
 			if !ui.configDialog.run() {
 				ui.onDestroy()
 				return nil
-			} else if err := ui.configDialog.onOk(); err != nil {
-				ui.bitch("Failed to write config: %v", err)
-				continue
 			}
 		}
 		ui.ForceConfig = true // Drop back to the config on failures.
 
+		// Stream isolation container selection.  Scripted screenshots
+		// use whatever was last chosen.
+		if ui.ScreenshotURL == "" && !ui.chooseContainer() {
+			continue
+		}
+
 		// Launch
 		if err := ui.launch(); err != nil {
 			if err != async.ErrCanceled {
-				ui.bitch("Failed to launch Tor Browser: %v", err)
+				ui.onLaunchError(err)
 			}
 			continue
 		}
@@ -126,10 +236,28 @@ func (ui *gtkUI) Run() error {
 		ui.Cfg.SetFirstLaunch(false)
 		ui.Cfg.Sync()
 
+		// Headless screenshots are done once Tor Browser exits.  This is
+		// meant to be scripted, so the result goes to stdout instead of
+		// a dialog box.
+		if ui.ScreenshotURL != "" {
+			ui.Sandbox.Wait()
+			ui.onDestroy()
+			f := ui.ScreenshotFile()
+			if !FileExists(f) {
+				return fmt.Errorf("failed to take a screenshot of '%v'", ui.ScreenshotURL)
+			}
+			log.Printf("ui: Saved screenshot: %v", f)
+			fmt.Println(f)
+			return nil
+		}
+
+		browser := ui.Sandbox
 		waitCh := make(chan error)
 		go func() {
-			waitCh <- ui.Sandbox.Wait()
+			waitCh <- browser.Wait()
 		}()
+		downloadsCh := ui.WatchDownloads()
+		bundleCh := ui.WatchBundle()
 
 		// Determine the time for the initial update check.
 		initialUpdateInterval := updateMinInterval
@@ -146,16 +274,51 @@ func (ui *gtkUI) Run() error {
 
 		updateTimer := time.NewTimer(initialUpdateInterval)
 		defer updateTimer.Stop()
+		if !ui.Cfg.EnableMARUpdates {
+			// No background update checks or staging.
+			updateTimer.Stop()
+		}
 
 		gtkPumpTicker := time.NewTicker(gtkPumpInterval)
 		defer gtkPumpTicker.Stop()
 
-		var update *installer.UpdateEntry
+		// Crash loop detection.
+		crashTimer := time.NewTimer(sbui.CrashLoopExitTime)
+		defer crashTimer.Stop()
+		launchOk := false
+		relaunch := false
+
+		// Resume staging an update that was interrupted by a restart.  With
+		// a maintenance window, only notify once the update is ready, instead
+		// of nagging.
+		update := ui.StagedUpdate()
+		updateNotified := false
+		var stageAsync *async.Async
+		var stageDoneCh chan interface{}
+		if ui.Cfg.EnableMARUpdates && update != nil && !ui.UpdateStaged(update) && ui.UpdateWindowOpen() {
+			stageAsync = ui.stageUpdate(update)
+			stageDoneCh = stageAsync.Done
+		}
 	browserRunningLoop:
 		for {
 			select {
 			case err := <-waitCh:
+				if ui.Terminating() {
+					return err
+				}
+				// Only crashes count towards a crash loop, not the user
+				// quitting the browser right after it starts.
+				if !launchOk && browser.Failed() && ui.onQuickExit() {
+					relaunch = true
+					break browserRunningLoop
+				}
 				return err
+			case <-crashTimer.C:
+				launchOk = true
+				if culprit := ui.OnBrowserStarted(); culprit != "" {
+					ui.inform("Tor Browser was successfully started after disabling %v.\n\nIt is recommended that this be disabled in the configuration.", culprit)
+				}
+				continue
 			case <-gtkPumpTicker.C:
 				// This is so stupid, but is needed for notification actions
 				// to work.
@@ -168,6 +331,60 @@ func (ui *gtkUI) Run() error {
 					break browserRunningLoop
 				}
 				continue
+			case sig := <-ui.pauseSigCh:
+				// SIGUSR1 pauses, SIGUSR2 resumes the browser.
+				if sig == syscall.SIGUSR1 {
+					ui.pause()
+				} else {
+					ui.resume()
+				}
+				continue
+			case action := <-ui.pauseNotificationCh:
+				if action == actionResume {
+					ui.resume()
+				}
+				continue
+			case sig := <-ui.clipboardSigCh:
+				ui.allowClipboard(sig == sbui.SigClipboardPaste)
+				continue
+			case <-ui.circuitsSigCh:
+				ui.showCircuits()
+				continue
+			case path, ok := <-downloadsCh:
+				if !ok {
+					downloadsCh = nil
+				} else {
+					ui.notifyDownload(path)
+				}
+				continue
+			case path, ok := <-bundleCh:
+				if !ok {
+					bundleCh = nil
+				} else if ui.onBundleModified(path) {
+					ui.Sandbox.Kill()
+				}
+				continue
+			case action := <-ui.downloadNotificationCh:
+				switch action {
+				case actionOpenFolder:
+					ui.openDownloadDir()
+				case actionView:
+					ui.viewDownload()
+				}
+				continue
+			case <-stageDoneCh:
+				failed := stageAsync.Err != nil
+				if failed {
+					log.Printf("update: Failed to stage update: %v", stageAsync.Err)
+				}
+				stageAsync, stageDoneCh = nil, nil
+				if failed && ui.Cfg.UpdateWindow != "" {
+					// Retry staging later, still during the window.
+					continue
+				}
+				ui.notifyUpdate(update)
+				updateNotified = true
+				continue
 			case <-updateTimer.C:
 			}
 
@@ -208,30 +425,67 @@ func (ui *gtkUI) Run() error {
 			}
 
 			if ui.Cfg.ForceUpdate {
-				log.Printf("update: Displaying notification.")
-				ui.notifyUpdate(update)
-				updateTimer.Reset(updateNagInterval)
+				// Download and verify the update while the browser is
+				// running, the notification is displayed once it is staged.
+				if update != nil && !ui.UpdateStaged(update) {
+					if stageAsync == nil && ui.UpdateWindowOpen() {
+						log.Printf("update: Staging update in the background.")
+						stageAsync = ui.stageUpdate(update)
+						stageDoneCh = stageAsync.Done
+					}
+				} else if ui.Cfg.UpdateWindow == "" || !updateNotified {
+					log.Printf("update: Displaying notification.")
+					ui.notifyUpdate(update)
+					updateNotified = true
+				}
+				if ui.Cfg.UpdateWindow != "" {
+					updateTimer.Reset(updateWindowPoll)
+				} else {
+					updateTimer.Reset(updateNagInterval)
+				}
 			} else {
 				updateTimer.Reset(updateCheckInterval)
 			}
 		}
 
-		// If we are here, the user wants to restart to apply an update.
+		ui.StopWatchingBundle()
 		gtkPumpTicker.Stop()
+		crashTimer.Stop()
+		if ui.pauseNotification != nil {
+			ui.pauseNotification.Close()
+		}
+
+		// Stop staging, the partial download will be resumed by either the
+		// relaunch, or the update.
+		if stageAsync != nil {
+			stageAsync.Cancel <- true
+			<-stageAsync.Done
+		}
+
+		// If we are here, the browser crashed, and a safe launch should
+		// be attempted.
+		if relaunch {
+			ui.SetSandbox(nil)
+			ui.ForceConfig = false
+			ui.NoKillTor = true // Don't re-launch tor.
+			continue
+		}
+
+		// If we are here, the user wants to restart to apply an update.
 
 		if ui.updateNotification != nil {
 			ui.updateNotification.Close()
 		}
 
-		// Kill the browser.  It's not as if firefox does the right thing on
-		// SIGTERM/SIGINT and we have the pid of init inside the sandbox
-		// anyway...
+		// Stop the browser.  Firefox does the right thing on SIGTERM these
+		// days, so it gets a chance to save the session, but is killed if it
+		// takes too long.
 		//
 		// https://bugzilla.mozilla.org/show_bug.cgi?id=336193
-		ui.Sandbox.Kill()
+		ui.Sandbox.Terminate(ui.Cfg.Sandbox.GetShutdownGracePeriod())
 		<-waitCh
 
-		ui.Sandbox = nil
+		ui.SetSandbox(nil)
 		ui.PendingUpdate = update
 		ui.ForceConfig = false
 		ui.NoKillTor = true // Don't re-lauch tor on the first pass.
@@ -243,6 +497,14 @@ func (ui *gtkUI) Term() {
 	// can assume we have exclusive ownership of the UI state.
 	ui.Common.Term()
 
+	if ui.pauseNotification != nil {
+		ui.pauseNotification.Close()
+		ui.pauseNotification = nil
+	}
+	if ui.clipboardNotification != nil {
+		ui.clipboardNotification.Close()
+		ui.clipboardNotification = nil
+	}
 	if ui.updateNotification != nil {
 		ui.updateNotification.Close()
 		ui.updateNotification = nil
@@ -258,6 +520,9 @@ func Init() (sbui.UI, error) {
 	if err = ui.Init(); err != nil {
 		return nil, err
 	}
+	if l := i18n.SetLocale(i18n.Detect(ui.Cfg.UILocale)); l != i18n.DefaultLocale {
+		log.Printf("ui: Using locale: %v", l)
+	}
 
 	// Initialize Gtk+.  Past this point, we can use dialog boxes to
 	// convey fatal errors.
@@ -266,8 +531,15 @@ func Init() (sbui.UI, error) {
 	if ui.logoPixbuf, err = ui.pixbufFromAsset("ui/tbb-logo.svg"); err != nil {
 		return nil, err
 	}
-	if ui.iconPixbuf, err = ui.pixbufFromAsset("ui/default48.png"); err != nil {
-		return nil, err
+	if icon := ui.Cfg.Sandbox.WindowIcon; icon != "" {
+		if ui.iconPixbuf, err = gdk.PixbufNewFromFileAtScale(icon, 48, 48, true); err != nil {
+			log.Printf("ui: Failed to load the window icon: %v", err)
+		}
+	}
+	if ui.iconPixbuf == nil {
+		if ui.iconPixbuf, err = ui.pixbufFromAsset("ui/default48.png"); err != nil {
+			return nil, err
+		}
 	}
 	if ui.mainWindow, err = gtk3.WindowNew(gtk3.WINDOW_TOPLEVEL); err != nil {
 		return nil, err
@@ -278,7 +550,7 @@ func Init() (sbui.UI, error) {
 		return nil, err
 	} else if d, err := data.Asset("ui/gtkui.ui"); err != nil {
 		return nil, err
-	} else if err = b.AddFromString(string(d)); err != nil {
+	} else if err = b.AddFromString(i18n.TranslateBuilder(string(d))); err != nil {
 		return nil, err
 	} else {
 		// Installation dialog.
@@ -301,12 +573,43 @@ func Init() (sbui.UI, error) {
 	if err = notify.Init("Sandboxed Tor Browser"); err == nil {
 		ui.updateNotification = notify.New("", "", ui.iconPixbuf)
 		ui.updateNotification.SetTimeout(15 * 1000)
-		ui.updateNotification.AddAction(actionRestart, "Restart Now")
+		ui.updateNotification.AddAction(actionRestart, i18n.T("Restart Now"))
 		ui.updateNotificationCh = ui.updateNotification.ActionChan()
+
+		ui.pauseNotification = notify.New("", "", ui.iconPixbuf)
+		ui.pauseNotification.SetTimeout(0) // Never expire.
+		ui.pauseNotification.AddAction(actionResume, i18n.T("Resume"))
+		ui.pauseNotificationCh = ui.pauseNotification.ActionChan()
+
+		ui.clipboardNotification = notify.New("", "", ui.iconPixbuf)
+		ui.clipboardNotification.SetTimeout(int(x11.ClipboardWindow / time.Millisecond))
+
+		ui.downloadNotification = notify.New("", "", ui.iconPixbuf)
+		ui.downloadNotification.SetTimeout(15 * 1000)
+		ui.downloadNotification.AddAction(actionOpenFolder, i18n.T("Open Containing Folder"))
+		if ui.CanViewDownloads() {
+			ui.downloadNotification.AddAction(actionView, i18n.T("View in Sandbox"))
+		}
+		ui.downloadNotificationCh = ui.downloadNotification.ActionChan()
 	} else {
 		ui.updateNotificationCh = make(chan string)
+		ui.pauseNotificationCh = make(chan string)
+		ui.downloadNotificationCh = make(chan string)
 	}
 
+	// Pausing/resuming the browser is also possible via signals.
+	ui.pauseSigCh = make(chan os.Signal, 1)
+	signal.Notify(ui.pauseSigCh, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	// As are clipboard transfers, so that they can be bound to keyboard
+	// shortcuts via the `clipboard-paste` and `clipboard-copy` commands.
+	ui.clipboardSigCh = make(chan os.Signal, 1)
+	signal.Notify(ui.clipboardSigCh, sbui.SigClipboardPaste, sbui.SigClipboardCopy)
+
+	// And the circuit panel, via the `circuits` command.
+	ui.circuitsSigCh = make(chan os.Signal, 1)
+	signal.Notify(ui.circuitsSigCh, sbui.SigCircuits)
+
 	return ui, nil
 }
 
@@ -314,9 +617,29 @@ func (ui *gtkUI) onDestroy() {
 	ui.Cfg.ResetDirty()
 }
 
+// install runs the install dialog until an install succeeds, and returns
+// false if the user gave up, or the install failed.
+func (ui *gtkUI) install() (bool, error) {
+	for {
+		if !ui.installDialog.run() {
+			ui.onDestroy()
+			return false, nil
+		}
+		if err := ui.installDialog.onOk(); err != nil {
+			if err != async.ErrCanceled {
+				ui.onInstallError(err)
+				return false, err
+			}
+			continue
+		}
+		ui.ForceInstall = false
+		return true, nil
+	}
+}
+
 func (ui *gtkUI) launch() error {
 	// If we don't need to update, and would just launch, quash the UI.
-	checkUpdate := ui.Cfg.ForceUpdate || ui.Cfg.NeedsUpdateCheck()
+	checkUpdate := ui.Cfg.EnableMARUpdates && (ui.Cfg.ForceUpdate || ui.Cfg.NeedsUpdateCheck())
 	squelchUI := !checkUpdate && ui.Cfg.UseSystemTor
 
 	async := async.NewAsync()
@@ -333,16 +656,217 @@ func (ui *gtkUI) launch() error {
 	return async.Err
 }
 
+// enableBridges switches the config to use the built-in bridges, and arranges
+// for tor to be relaunched with them.
+func (ui *gtkUI) enableBridges() {
+	ui.Cfg.Tor.SetUseBridges(true)
+	if ui.Cfg.Tor.InternalBridgeType == "" {
+		ui.Cfg.Tor.SetInternalBridgeType(sbui.DefaultBridgeTransport)
+	}
+	ui.Cfg.Tor.SetUseCustomBridges(false)
+	if err := ui.Cfg.Sync(); err != nil {
+		ui.bitch("Failed to write config: %v", err)
+		return
+	}
+
+	// Skip straight to the relaunch, but ensure the config dialog reflects
+	// the change if it does get shown.
+	ui.configDialog.loaded = false
+	ui.ForceConfig = false
+}
+
 func (ui *gtkUI) bitch(format string, a ...interface{}) {
 	// XXX: Make this nicer with like, an icon and shit.
-	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_ERROR, gtk3.BUTTONS_OK, format, a...)
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_ERROR, gtk3.BUTTONS_OK, i18n.T(format), a...)
+	md.Run()
+	md.Hide()
+	ui.forceRedraw()
+}
+
+func (ui *gtkUI) inform(format string, a ...interface{}) {
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_INFO, gtk3.BUTTONS_OK, i18n.T(format), a...)
 	md.Run()
 	md.Hide()
 	ui.forceRedraw()
 }
 
+func (ui *gtkUI) onQuickExit() bool {
+	wasSafeMode := ui.InSafeMode()
+	if ui.OnBrowserQuickExit() {
+		return true
+	}
+
+	if wasSafeMode {
+		ui.bitch("Tor Browser failed to start even with all optional features disabled.")
+		return false
+	}
+	if ui.NeedsSafeMode() {
+		if ui.ask("Tor Browser appears to be crashing on startup.\n\nAttempt a safe launch, disabling optional features one by one to find the cause?") {
+			ui.StartSafeMode()
+			return true
+		}
+		log.Printf("ui: User declined safe mode launch")
+	}
+	return false
+}
+
+func (ui *gtkUI) pause() {
+	if err := ui.PauseBrowser(); err != nil {
+		log.Printf("ui: Failed to pause Tor Browser: %v", err)
+		return
+	}
+	if ui.pauseNotification != nil {
+		ui.pauseNotification.Update(i18n.T("Tor Browser is paused."), i18n.T("All browser activity has been suspended."), ui.iconPixbuf)
+		ui.pauseNotification.Show()
+	}
+}
+
+func (ui *gtkUI) resume() {
+	if err := ui.ResumeBrowser(); err != nil {
+		log.Printf("ui: Failed to resume Tor Browser: %v", err)
+		return
+	}
+	if ui.pauseNotification != nil {
+		ui.pauseNotification.Close()
+	}
+}
+
+func (ui *gtkUI) allowClipboard(paste bool) {
+	var err error
+	summary := i18n.T("Clipboard copy allowed.")
+	if paste {
+		summary = i18n.T("Clipboard paste allowed.")
+		err = ui.AllowClipboardPaste()
+	} else {
+		err = ui.AllowClipboardCopy()
+	}
+	if err != nil {
+		log.Printf("ui: Failed to allow clipboard access: %v", err)
+		return
+	}
+	if ui.clipboardNotification != nil {
+		ui.clipboardNotification.Update(summary, i18n.Sprintf("Tor Browser may access the clipboard for the next %v.", x11.ClipboardWindow), ui.iconPixbuf)
+		ui.clipboardNotification.Show()
+	}
+}
+
+func (ui *gtkUI) notifyDownload(path string) {
+	ui.downloadDir = filepath.Dir(path)
+	ui.downloadPath = path
+	if ui.downloadNotification != nil {
+		ui.downloadNotification.Update(i18n.T("Download complete."), filepath.Base(path), ui.iconPixbuf)
+		ui.downloadNotification.Show()
+	}
+}
+
+func (ui *gtkUI) openDownloadDir() {
+	if ui.downloadDir == "" {
+		return
+	}
+	// This runs on the host, with the user's file manager.
+	cmd := exec.Command("xdg-open", ui.downloadDir)
+	if err := cmd.Start(); err != nil {
+		log.Printf("ui: Failed to open the Downloads directory: %v", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+func (ui *gtkUI) viewDownload() {
+	if ui.downloadPath == "" {
+		return
+	}
+	if err := ui.ViewDownload(ui.downloadPath); err != nil {
+		log.Printf("ui: Failed to launch the document viewer: %v", err)
+		ui.bitch("Failed to launch the document viewer: %v", err)
+	}
+}
+
+func (ui *gtkUI) onBundleModified(path string) bool {
+	rel, err := filepath.Rel(ui.Cfg.BundleInstallDir, path)
+	if err != nil {
+		rel = path
+	}
+	return ui.ask("The Tor Browser bundle was modified from outside the sandbox while running:\n\n%s\n\nThis should never happen, and indicates either tampering, or a misbehaving backup or cleanup tool.  Reinstalling the bundle is recommended.\n\nKill Tor Browser now?", rel)
+}
+
+func (ui *gtkUI) showDiagnostics() {
+	report, fatal := ui.RunDiagnostics()
+	if fatal {
+		ui.bitch("The host environment has problems that will likely prevent Tor Browser from launching:\n\n%s", report)
+	} else {
+		ui.inform("Host environment diagnostics:\n\n%s", report)
+	}
+}
+
+func (ui *gtkUI) offerXDGUserDirs() {
+	if ui.Cfg.Sandbox.DownloadsDir != "" || ui.Cfg.Sandbox.DesktopDir != "" {
+		return
+	}
+	downloadsDir := config.XDGUserDir("XDG_DOWNLOAD_DIR")
+	desktopDir := config.XDGUserDir("XDG_DESKTOP_DIR")
+	if downloadsDir == "" && desktopDir == "" {
+		return
+	}
+
+	var dirs []string
+	if downloadsDir != "" {
+		dirs = append(dirs, fmt.Sprintf("Downloads: `%s`", downloadsDir))
+	}
+	if desktopDir != "" {
+		dirs = append(dirs, fmt.Sprintf("Desktop: `%s`", desktopDir))
+	}
+	if !ui.ask("By default, Tor Browser's Downloads and Desktop directories are kept inside the bundle directory.  Use the host directories instead?\n\n%s\n\nWARNING: Tor Browser will be able to read and modify everything in these directories, and any files it saves will be visible to the rest of the system.", strings.Join(dirs, "\n")) {
+		log.Printf("ui: User declined the host download/desktop directories")
+		return
+	}
+
+	log.Printf("ui: Using the host download/desktop directories")
+	ui.Cfg.Sandbox.SetDownloadsDir(downloadsDir)
+	ui.Cfg.Sandbox.SetDesktopDir(desktopDir)
+	if err := ui.Cfg.Sync(); err != nil {
+		ui.bitch("Failed to write config: %v", err)
+	}
+}
+
+// offerLegacyMigration offers to move or symlink a prior install that is
+// no longer found since the XDG base directories changed, instead of
+// silently reinstalling from scratch.
+func (ui *gtkUI) offerLegacyMigration(l *config.LegacyInstall) {
+	const (
+		responseMove    = gtk3.RESPONSE_YES
+		responseSymlink = gtk3.RESPONSE_APPLY
+	)
+
+	var locs []string
+	if l.DataDir != "" {
+		locs = append(locs, fmt.Sprintf("Bundle and tor state: `%s` -> `%s`", l.DataDir, ui.Cfg.UserDataDir))
+	}
+	if l.ConfigFile != "" {
+		locs = append(locs, fmt.Sprintf("Config: `%s` -> `%s`", l.ConfigFile, ui.Cfg.ConfigDir))
+	}
+	log.Printf("ui: Legacy install detected: %s", strings.Join(locs, ", "))
+
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_QUESTION, gtk3.BUTTONS_NONE, "An existing install was found at a previous location, likely due to `XDG_DATA_HOME` or `XDG_CONFIG_HOME` changing.  Migrate it to the current location?\n\n%s\n\nSymlinking leaves the files where they are.", strings.Join(locs, "\n"))
+	md.AddButton(i18n.T("Ignore"), gtk3.RESPONSE_CANCEL)
+	md.AddButton(i18n.T("Symlink"), responseSymlink)
+	md.AddButton(i18n.T("Move"), responseMove)
+	md.SetDefaultResponse(responseMove)
+	result := gtk3.ResponseType(md.Run())
+	md.Hide()
+	ui.forceRedraw()
+
+	if result != responseMove && result != responseSymlink {
+		log.Printf("ui: User declined the legacy install migration")
+		return
+	}
+	if err := ui.MigrateLegacyInstall(l, result == responseSymlink); err != nil {
+		ui.bitch("Failed to migrate the existing install: %v", err)
+	}
+}
+
 func (ui *gtkUI) ask(format string, a ...interface{}) bool {
-	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_QUESTION, gtk3.BUTTONS_OK_CANCEL, format, a...)
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_QUESTION, gtk3.BUTTONS_OK_CANCEL, i18n.T(format), a...)
 	result := md.Run()
 	md.Hide()
 	ui.forceRedraw()
@@ -356,11 +880,27 @@ func (ui *gtkUI) notifyUpdate(update *installer.UpdateEntry) {
 	}
 
 	if ui.updateNotification != nil {
-		ui.updateNotification.Update("A Tor Browser update is available.", "Please restart to update to version "+update.DisplayVersion+".", ui.iconPixbuf)
+		msg := i18n.Sprintf("Please restart to update to version %v.", update.DisplayVersion)
+		if ui.UpdateStaged(update) {
+			msg = i18n.Sprintf("Version %v is downloaded, please restart to apply it.", update.DisplayVersion)
+		}
+		ui.updateNotification.Update(i18n.T("A Tor Browser update is available."), msg, ui.iconPixbuf)
 		ui.updateNotification.Show()
 	}
 }
 
+// stageUpdate downloads and verifies the update in the background, returning
+// the Async that will be signaled on completion.
+func (ui *gtkUI) stageUpdate(update *installer.UpdateEntry) *async.Async {
+	a := async.NewAsync()
+	a.UpdateProgress = func(s string) {}
+	go func() {
+		ui.StageUpdate(a, update)
+		a.Done <- true
+	}()
+	return a
+}
+
 func (ui *gtkUI) pixbufFromAsset(asset string) (*gdk.Pixbuf, error) {
 	d, err := data.Asset(asset)
 	if err != nil {
@@ -0,0 +1,51 @@
+// uninstall.go - Gtk+ uninstall user interface routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import "log"
+
+// runUninstall confirms and runs the uninstall, and returns true iff
+// something was removed.  If askUserFiles is set, the user is asked about
+// removing the Downloads and Desktop content, instead of going by the
+// `--user-files` flag.
+func (ui *gtkUI) runUninstall(askUserFiles bool) bool {
+	plan := ui.PlanUninstall(ui.UninstallUserFiles)
+	if ui.UninstallDryRun {
+		ui.inform("Uninstalling would remove the following:\n\n%s", plan)
+		return false
+	}
+	if len(plan.Remove) == 0 {
+		ui.inform("Nothing is installed.")
+		return false
+	}
+	if askUserFiles && !ui.UninstallUserFiles {
+		if full := ui.PlanUninstall(true); full.HasUserFiles() && ui.ask("Also remove the content of the Downloads and Desktop directories in the bundle?  Host directories set in the config are always kept.\n\n%s", full) {
+			plan = full
+		}
+	}
+	if !ui.ask("Uninstall Tor Browser, and remove the following?\n\n%s\n\nWARNING: This can not be undone.", plan) {
+		log.Printf("ui: User declined to uninstall")
+		return false
+	}
+	if err := ui.Uninstall(plan); err != nil {
+		log.Printf("ui: Failed to uninstall: %v", err)
+		ui.bitch("Failed to uninstall: %v", err)
+		return true
+	}
+	ui.inform("Tor Browser was uninstalled.")
+	return true
+}
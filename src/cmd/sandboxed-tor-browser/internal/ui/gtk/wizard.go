@@ -0,0 +1,464 @@
+// wizard.go - Gtk+ first-run setup wizard.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	sbui "cmd/sandboxed-tor-browser/internal/ui"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	"cmd/sandboxed-tor-browser/internal/ui/i18n"
+)
+
+// setupWizard walks a new user through the handful of choices that matter
+// for the first launch, and writes the same config as the install and config
+// dialogs, which remain for later edits.
+type setupWizard struct {
+	ui *gtkUI
+
+	assistant *gtk3.Assistant
+	applied   bool
+
+	// Censorship page elements.
+	bridgesToggle *gtk3.RadioButton
+	bridgeType    *gtk3.ComboBoxText
+
+	// Proxy page elements.
+	proxyPage      *gtk3.Box
+	proxyToggle    *gtk3.CheckButton
+	proxyConfigBox *gtk3.Grid
+	proxyType      *gtk3.ComboBoxText
+	proxyAddress   *gtk3.Entry
+	proxyPort      *gtk3.Entry
+	proxyUsername  *gtk3.Entry
+	proxyPassword  *gtk3.Entry
+
+	// Bundle page elements.
+	channelSelector *gtk3.ComboBoxText
+	localeSelector  *gtk3.ComboBoxText
+
+	summary *gtk3.Label
+}
+
+// runSetupWizard runs the first-run setup wizard, and returns true iff the
+// config was written.
+func (ui *gtkUI) runSetupWizard() bool {
+	d := &setupWizard{ui: ui}
+	if err := d.init(); err != nil {
+		log.Printf("ui: Failed to create the setup wizard: %v", err)
+		return false
+	}
+	defer func() {
+		d.assistant.Destroy()
+		ui.forceRedraw()
+	}()
+
+	d.assistant.ShowAll()
+	gtk3.Main()
+
+	if d.applied {
+		// Skip the dialogs that would ask the same questions again.
+		ui.installDialog.preselect()
+		ui.configDialog.loaded = false
+	}
+	return d.applied
+}
+
+func (d *setupWizard) init() error {
+	var err error
+	if d.assistant, err = gtk3.AssistantNew(); err != nil {
+		return err
+	}
+	d.assistant.SetTitle(i18n.T("Sandboxed Tor Browser Setup"))
+	d.assistant.SetIcon(d.ui.iconPixbuf)
+	d.assistant.SetTransientFor(d.ui.mainWindow)
+	d.assistant.SetModal(true)
+	d.assistant.SetDefaultSize(560, 400)
+	d.assistant.SetPosition(gtk3.WIN_POS_CENTER)
+
+	intro, err := d.newPage(i18n.T("Welcome"), gtk3.ASSISTANT_PAGE_INTRO, i18n.T("This will walk through the basic configuration, and install Tor Browser.\n\nEverything can be changed later with `sandboxed-tor-browser config`."))
+	if err != nil {
+		return err
+	}
+	d.assistant.SetPageComplete(intro, true)
+
+	// The tor config is irrelevant if a system tor instance is used.
+	if d.ui.Cfg.UseSystemTor {
+		if err = addLabel(intro, i18n.T("A system tor instance is configured, so the network settings are skipped.")); err != nil {
+			return err
+		}
+	} else {
+		if err = d.initCensorshipPage(); err != nil {
+			return err
+		}
+		if err = d.initProxyPage(); err != nil {
+			return err
+		}
+	}
+	if err = d.initBundlePage(); err != nil {
+		return err
+	}
+
+	page, err := d.newPage(i18n.T("Summary"), gtk3.ASSISTANT_PAGE_CONFIRM, i18n.T("The following configuration will be used:"))
+	if err != nil {
+		return err
+	}
+	if d.summary, err = gtk3.LabelNew(""); err != nil {
+		return err
+	}
+	d.summary.SetHAlign(gtk3.ALIGN_START)
+	d.summary.SetSelectable(true)
+	page.PackStart(d.summary, false, false, 0)
+	d.assistant.SetPageComplete(page, true)
+
+	d.assistant.Connect("prepare", func() { d.updateSummary() })
+	d.assistant.Connect("apply", func() { d.onApply() })
+	d.assistant.Connect("cancel", func() { gtk3.MainQuit() })
+	d.assistant.Connect("close", func() { gtk3.MainQuit() })
+	d.assistant.Connect("delete-event", func() bool {
+		gtk3.MainQuit()
+		return true
+	})
+	return nil
+}
+
+func (d *setupWizard) initCensorshipPage() error {
+	page, err := d.newPage(i18n.T("Censorship"), gtk3.ASSISTANT_PAGE_CONTENT, i18n.T("Is access to the Tor network censored or blocked where you are?\n\nBridges are relays that are harder to block, and disguise the connection to the Tor network."))
+	if err != nil {
+		return err
+	}
+	direct, err := gtk3.RadioButtonNewWithLabel(nil, i18n.T("No, connect to the Tor network directly"))
+	if err != nil {
+		return err
+	}
+	page.PackStart(direct, false, false, 0)
+	if d.bridgesToggle, err = gtk3.RadioButtonNewWithLabelFromWidget(direct, i18n.T("Yes, use a built-in bridge")); err != nil {
+		return err
+	}
+	page.PackStart(d.bridgesToggle, false, false, 0)
+
+	if d.bridgeType, err = gtk3.ComboBoxTextNew(); err != nil {
+		return err
+	}
+	var transports []string
+	for transport := range sbui.Bridges {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	for _, v := range transports {
+		d.bridgeType.Append(v, v)
+	}
+	t := d.ui.Cfg.Tor.InternalBridgeType
+	if t == "" {
+		t = sbui.DefaultBridgeTransport
+	}
+	d.bridgeType.SetActiveID(t)
+	d.bridgeType.SetHAlign(gtk3.ALIGN_START)
+	page.PackStart(d.bridgeType, false, false, 0)
+	if err = addLabel(page, i18n.T("Custom bridges can be set in the configuration dialog.")); err != nil {
+		return err
+	}
+
+	d.bridgesToggle.SetActive(d.ui.Cfg.Tor.UseBridges)
+	d.bridgeType.SetSensitive(d.ui.Cfg.Tor.UseBridges)
+	d.bridgesToggle.Connect("toggled", func() {
+		d.bridgeType.SetSensitive(d.bridgesToggle.GetActive())
+	})
+	d.assistant.SetPageComplete(page, true)
+	return nil
+}
+
+func (d *setupWizard) initProxyPage() error {
+	var err error
+	if d.proxyPage, err = d.newPage(i18n.T("Proxy"), gtk3.ASSISTANT_PAGE_CONTENT, i18n.T("Does this computer need to use a proxy to access the Internet?\n\nIf unsure, it does not.")); err != nil {
+		return err
+	}
+	if d.proxyToggle, err = gtk3.CheckButtonNewWithLabel(i18n.T("Use a proxy")); err != nil {
+		return err
+	}
+	d.proxyPage.PackStart(d.proxyToggle, false, false, 0)
+
+	if d.proxyConfigBox, err = gtk3.GridNew(); err != nil {
+		return err
+	}
+	d.proxyConfigBox.SetRowSpacing(6)
+	d.proxyConfigBox.SetColumnSpacing(12)
+	d.proxyPage.PackStart(d.proxyConfigBox, false, false, 0)
+
+	if d.proxyType, err = gtk3.ComboBoxTextNew(); err != nil {
+		return err
+	}
+	for _, v := range config.TorProxyTypes {
+		d.proxyType.Append(v, v)
+	}
+	if t := d.ui.Cfg.Tor.ProxyType; t != "" {
+		d.proxyType.SetActiveID(t)
+	} else {
+		d.proxyType.SetActive(0)
+	}
+	if err = d.attachRow(0, i18n.T("Type:"), d.proxyType); err != nil {
+		return err
+	}
+	for i, v := range []struct {
+		label string
+		entry **gtk3.Entry
+		value string
+	}{
+		{i18n.T("Address:"), &d.proxyAddress, d.ui.Cfg.Tor.ProxyAddress},
+		{i18n.T("Port:"), &d.proxyPort, d.ui.Cfg.Tor.ProxyPort},
+		{i18n.T("Username (Optional):"), &d.proxyUsername, d.ui.Cfg.Tor.ProxyUsername},
+		{i18n.T("Password (Optional):"), &d.proxyPassword, d.ui.Cfg.Tor.ProxyPassword},
+	} {
+		if *v.entry, err = gtk3.EntryNew(); err != nil {
+			return err
+		}
+		(*v.entry).SetText(v.value)
+		(*v.entry).SetHExpand(true)
+		(*v.entry).Connect("changed", func() { d.updateProxyComplete() })
+		if err = d.attachRow(i+1, v.label, *v.entry); err != nil {
+			return err
+		}
+	}
+	d.proxyPassword.SetVisibility(false)
+
+	d.proxyToggle.SetActive(d.ui.Cfg.Tor.UseProxy)
+	d.proxyConfigBox.SetSensitive(d.ui.Cfg.Tor.UseProxy)
+	d.proxyToggle.Connect("toggled", func() {
+		d.proxyConfigBox.SetSensitive(d.proxyToggle.GetActive())
+		d.updateProxyComplete()
+	})
+	d.proxyType.Connect("changed", func() { d.updateProxyComplete() })
+	d.updateProxyComplete()
+	return nil
+}
+
+func (d *setupWizard) initBundlePage() error {
+	page, err := d.newPage(i18n.T("Tor Browser"), gtk3.ASSISTANT_PAGE_CONTENT, i18n.T("Which release channel and language of Tor Browser should be installed?\n\nThe `release` channel is recommended for most users."))
+	if err != nil {
+		return err
+	}
+	grid, err := gtk3.GridNew()
+	if err != nil {
+		return err
+	}
+	grid.SetRowSpacing(6)
+	grid.SetColumnSpacing(12)
+	page.PackStart(grid, false, false, 0)
+
+	if d.channelSelector, err = gtk3.ComboBoxTextNew(); err != nil {
+		return err
+	}
+	id := ""
+	for _, v := range sbui.BundleChannels[d.ui.Cfg.Architecture] {
+		if v == d.ui.Cfg.Channel {
+			id = v
+		}
+		d.channelSelector.Append(v, v)
+	}
+	if id != "" {
+		d.channelSelector.SetActiveID(id)
+	} else {
+		d.channelSelector.SetActive(0)
+	}
+	if d.localeSelector, err = gtk3.ComboBoxTextNew(); err != nil {
+		return err
+	}
+	d.onChannelChanged()
+	d.channelSelector.Connect("changed", func() { d.onChannelChanged() })
+
+	for i, v := range []struct {
+		label  string
+		widget *gtk3.ComboBoxText
+	}{
+		{i18n.T("Channel:"), d.channelSelector},
+		{i18n.T("Language:"), d.localeSelector},
+	} {
+		l, err := gtk3.LabelNew(v.label)
+		if err != nil {
+			return err
+		}
+		l.SetHAlign(gtk3.ALIGN_START)
+		grid.Attach(l, 0, i, 1, 1)
+		grid.Attach(v.widget, 1, i, 1, 1)
+	}
+	d.assistant.SetPageComplete(page, true)
+	return nil
+}
+
+// newPage appends a page with a wrapped explanatory label.
+func (d *setupWizard) newPage(title string, pageType gtk3.AssistantPageType, text string) (*gtk3.Box, error) {
+	page, err := gtk3.BoxNew(gtk3.ORIENTATION_VERTICAL, 6)
+	if err != nil {
+		return nil, err
+	}
+	page.SetBorderWidth(12)
+	if err = addLabel(page, text); err != nil {
+		return nil, err
+	}
+	d.assistant.AppendPage(page)
+	d.assistant.SetPageTitle(page, title)
+	d.assistant.SetPageType(page, pageType)
+	return page, nil
+}
+
+func addLabel(box *gtk3.Box, text string) error {
+	l, err := gtk3.LabelNew(text)
+	if err != nil {
+		return err
+	}
+	l.SetLineWrap(true)
+	l.SetMaxWidthChars(72)
+	l.SetHAlign(gtk3.ALIGN_START)
+	box.PackStart(l, false, false, 0)
+	return nil
+}
+
+func (d *setupWizard) attachRow(row int, label string, w gtk3.IWidget) error {
+	l, err := gtk3.LabelNew(label)
+	if err != nil {
+		return err
+	}
+	l.SetHAlign(gtk3.ALIGN_START)
+	d.proxyConfigBox.Attach(l, 0, row, 1, 1)
+	d.proxyConfigBox.Attach(w, 1, row, 1, 1)
+	return nil
+}
+
+func (d *setupWizard) onChannelChanged() {
+	// Like the install dialog, keep the selected locale if the new channel
+	// has it.
+	ch := d.channelSelector.GetActiveText()
+	l := d.localeSelector.GetActiveText()
+	if l == "" {
+		l = d.ui.Cfg.Locale
+	}
+	d.localeSelector.RemoveAll()
+	canSetLocale := false
+	for _, v := range sbui.BundleLocales[ch] {
+		if v == l {
+			canSetLocale = true
+		}
+		d.localeSelector.Append(v, v)
+	}
+	if canSetLocale {
+		d.localeSelector.SetActiveID(l)
+	} else {
+		d.localeSelector.SetActive(0)
+	}
+}
+
+// proxyConfig returns the validated proxy address, port, username and
+// password.
+func (d *setupWizard) proxyConfig() (addr, port, username, password string, err error) {
+	if addr, err = d.proxyAddress.GetText(); err != nil {
+		return
+	} else if addr, err = config.ValidateProxyAddress(addr); err != nil {
+		return
+	}
+	if port, err = d.proxyPort.GetText(); err != nil {
+		return
+	} else if port = strings.TrimSpace(port); port == "" {
+		err = fmt.Errorf("no proxy port")
+		return
+	} else if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return
+	}
+	if d.proxyType.GetActiveText() == proxySOCKS4 {
+		return
+	}
+	if username, err = d.proxyUsername.GetText(); err != nil {
+		return
+	}
+	if password, err = d.proxyPassword.GetText(); err != nil {
+		return
+	}
+	username, password = strings.TrimSpace(username), strings.TrimSpace(password)
+	if (username == "") != (password == "") {
+		err = fmt.Errorf("both a proxy username and password must be specified")
+	}
+	return
+}
+
+func (d *setupWizard) updateProxyComplete() {
+	isSOCKS4 := d.proxyType.GetActiveText() == proxySOCKS4
+	d.proxyUsername.SetSensitive(!isSOCKS4)
+	d.proxyPassword.SetSensitive(!isSOCKS4)
+
+	complete := true
+	if d.proxyToggle.GetActive() {
+		_, _, _, _, err := d.proxyConfig()
+		complete = err == nil
+	}
+	d.assistant.SetPageComplete(d.proxyPage, complete)
+}
+
+func (d *setupWizard) updateSummary() {
+	var lines []string
+	if !d.ui.Cfg.UseSystemTor {
+		if d.bridgesToggle.GetActive() {
+			lines = append(lines, i18n.Sprintf("Connection: Bridges (%s)", d.bridgeType.GetActiveText()))
+		} else {
+			lines = append(lines, i18n.T("Connection: Direct"))
+		}
+		if !d.proxyToggle.GetActive() {
+			lines = append(lines, i18n.T("Proxy: None"))
+		} else if addr, port, _, _, err := d.proxyConfig(); err == nil {
+			lines = append(lines, i18n.Sprintf("Proxy: %s %s:%s", d.proxyType.GetActiveText(), addr, port))
+		}
+	}
+	lines = append(lines, i18n.Sprintf("Channel: %s", d.channelSelector.GetActiveText()))
+	lines = append(lines, i18n.Sprintf("Language: %s", d.localeSelector.GetActiveText()))
+	d.summary.SetText(strings.Join(lines, "\n"))
+}
+
+func (d *setupWizard) onApply() {
+	cfg := d.ui.Cfg
+	if !cfg.UseSystemTor {
+		cfg.Tor.SetUseBridges(d.bridgesToggle.GetActive())
+		cfg.Tor.SetInternalBridgeType(d.bridgeType.GetActiveText())
+		cfg.Tor.SetUseCustomBridges(false)
+
+		useProxy := d.proxyToggle.GetActive()
+		cfg.Tor.SetUseProxy(useProxy)
+		if useProxy {
+			addr, port, username, password, err := d.proxyConfig()
+			if err != nil {
+				d.ui.bitch("Invalid proxy configuration: %v", err)
+				return
+			}
+			cfg.Tor.SetProxyType(d.proxyType.GetActiveText())
+			cfg.Tor.SetProxyAddress(addr)
+			cfg.Tor.SetProxyPort(port)
+			cfg.Tor.SetProxyUsername(username)
+			cfg.Tor.SetProxyPassword(password)
+		}
+	}
+	cfg.SetChannel(d.channelSelector.GetActiveText())
+	cfg.SetLocale(d.localeSelector.GetActiveText())
+	if err := cfg.Sync(); err != nil {
+		d.ui.bitch("Failed to write config: %v", err)
+		return
+	}
+	log.Printf("ui: Setup wizard completed")
+	d.applied = true
+}
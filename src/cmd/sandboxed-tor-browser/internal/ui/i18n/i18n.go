@@ -0,0 +1,148 @@
+// i18n.go - User interface translation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package i18n provides gettext style translation of the user interface
+// strings, from the JSON catalogs embedded under `ui/i18n/`.  Each catalog
+// maps the English string (the msgid) to the translation, and untranslated
+// strings are displayed in English.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+)
+
+// DefaultLocale is the locale of the untranslated strings.
+const DefaultLocale = "en-US"
+
+const catalogDir = "ui/i18n"
+
+var (
+	lock    sync.RWMutex
+	locale  = DefaultLocale
+	catalog map[string]string
+
+	// translatableRe matches the Gtk+ Builder properties marked for
+	// translation.
+	translatableRe = regexp.MustCompile(`(<property [^>]*translatable="yes"[^>]*>)([^<]*)(</property>)`)
+)
+
+// Available returns the locales that have a catalog.
+func Available() []string {
+	names, err := data.AssetDir(catalogDir)
+	if err != nil {
+		return nil
+	}
+	var locales []string
+	for _, n := range names {
+		if strings.HasSuffix(n, ".json") {
+			locales = append(locales, strings.TrimSuffix(n, ".json"))
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Detect returns the locale to use, from the override if set, or the
+// environment (`LC_ALL`, `LC_MESSAGES`, `LANG`), normalized to the same form
+// as the Tor Browser locales (eg: `ja_JP.UTF-8` -> `ja-JP`).
+func Detect(override string) string {
+	candidates := []string{override}
+	for _, k := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		candidates = append(candidates, os.Getenv(k))
+	}
+	for _, v := range candidates {
+		if idx := strings.IndexAny(v, ".@"); idx != -1 {
+			v = v[:idx]
+		}
+		switch v {
+		case "", "C", "POSIX":
+			continue
+		}
+		return strings.Replace(v, "_", "-", -1)
+	}
+	return DefaultLocale
+}
+
+// SetLocale loads the catalog for the locale, falling back to the catalog
+// for the language (eg: `es-AR` -> `es`), and returns the locale actually
+// used.
+func SetLocale(l string) string {
+	newLocale, newCatalog := DefaultLocale, map[string]string(nil)
+	for _, v := range []string{l, strings.SplitN(l, "-", 2)[0]} {
+		if v == "" || v == DefaultLocale {
+			break
+		}
+		b, err := data.Asset(path.Join(catalogDir, v+".json"))
+		if err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, &newCatalog); err != nil {
+			log.Printf("ui: Malformed translation catalog '%v': %v", v, err)
+			newCatalog = nil
+			continue
+		}
+		newLocale = v
+		break
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	locale, catalog = newLocale, newCatalog
+	return locale
+}
+
+// Locale returns the locale in use.
+func Locale() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return locale
+}
+
+// T returns the translation of msgid, or msgid if there is none.
+func T(msgid string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+	if s := catalog[msgid]; s != "" {
+		return s
+	}
+	return msgid
+}
+
+// Sprintf formats according to the translation of the format specifier.
+func Sprintf(format string, a ...interface{}) string {
+	return fmt.Sprintf(T(format), a...)
+}
+
+// TranslateBuilder returns the Gtk+ Builder XML, with the properties marked
+// as translatable translated.
+func TranslateBuilder(s string) string {
+	return translatableRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := translatableRe.FindStringSubmatch(m)
+		msgid := html.UnescapeString(sub[2])
+		return sub[1] + html.EscapeString(T(msgid)) + sub[3]
+	})
+}
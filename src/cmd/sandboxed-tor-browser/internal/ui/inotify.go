@@ -0,0 +1,70 @@
+// inotify.go - inotify helpers.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// newInotify creates a new inotify instance, watching each of the dirs for
+// the events in mask.  The returned os.File is non-blocking so that closing
+// it will interrupt `readInotify`.
+func newInotify(dirs []string, mask uint32) (*os.File, map[int32]string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wds := make(map[int32]string)
+	for _, dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, mask|syscall.IN_ONLYDIR)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, nil, err
+		}
+		wds[int32(wd)] = dir
+	}
+	return os.NewFile(uintptr(fd), "inotify"), wds, nil
+}
+
+// readInotify reads events from f until it is closed, and calls fn for each
+// event that is not for a directory.
+func readInotify(f *os.File, fn func(wd int32, mask uint32, name string)) {
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		n, err := f.Read(buf[:])
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameOff := off + syscall.SizeofInotifyEvent
+			off = nameOff + int(ev.Len)
+			if off > n {
+				break
+			}
+			if ev.Mask&syscall.IN_ISDIR != 0 {
+				continue
+			}
+			fn(ev.Wd, ev.Mask, strings.TrimRight(string(buf[nameOff:off]), "\x00"))
+		}
+	}
+}
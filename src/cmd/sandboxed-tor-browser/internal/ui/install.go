@@ -20,15 +20,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/installer"
-	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
 	"cmd/sandboxed-tor-browser/internal/utils"
@@ -61,22 +61,23 @@ func (c *Common) DoInstall(async *Async) {
 		c.tor = nil
 	}
 
-	// Get the Dial() routine used to reach the external network.
-	var dialFn dialFunc
+	if c.InstallFromFile != "" {
+		c.doLocalInstall(async)
+		return
+	}
+
+	// Get the fetcher used to reach the external network, directly if
+	// there is no system tor.
 	if err := c.launchTor(async, true); err != nil {
 		async.Err = err
 		return
 	}
-	if dialFn, err = c.getTorDialFunc(); err == tor.ErrTorNotRunning {
-		dialFn = net.Dial
-	} else if err != nil {
+	f, err := c.newFetcher(true)
+	if err != nil {
 		async.Err = err
 		return
 	}
 
-	// Create the async HTTP client.
-	client := newHPKPGrabClient(dialFn)
-
 	// Download the JSON file showing where the bundle files are.
 	log.Printf("install: Checking available downloads.")
 	async.UpdateProgress("Checking available downloads.")
@@ -88,7 +89,7 @@ func (c *Common) DoInstall(async *Async) {
 		return
 	} else {
 		log.Printf("install: Metadata URL: %v", url)
-		if b := async.Grab(client, url, nil); async.Err != nil {
+		if b := f.grab(async, url, nil); async.Err != nil {
 			return
 		} else if version, downloads, async.Err = installer.GetDownloadsEntry(c.Cfg, b); async.Err != nil {
 			return
@@ -98,12 +99,17 @@ func (c *Common) DoInstall(async *Async) {
 
 	log.Printf("install: Version: %v Downloads: %v", version, downloads)
 
+	if c.InstallVerifyOnly || c.InstallDryRun {
+		c.doInstallCheck(async, f, version, downloads)
+		return
+	}
+
 	// Download the bundle.
 	log.Printf("install: Downloading %v", downloads.Binary)
 	async.UpdateProgress("Downloading Tor Browser.")
 
 	var bundleTarXz []byte
-	if bundleTarXz = async.Grab(client, downloads.Binary, func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser: %s", s)) }); async.Err != nil {
+	if bundleTarXz = f.grab(async, downloads.Binary, func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser: %s", s)) }); async.Err != nil {
 		return
 	}
 
@@ -112,7 +118,7 @@ func (c *Common) DoInstall(async *Async) {
 	async.UpdateProgress("Downloading Tor Browser PGP Signature.")
 
 	/*var bundleSig []byte
-	if bundleSig = async.Grab(client, downloads.Sig, nil); async.Err != nil {
+	if bundleSig = f.grab(async, downloads.Sig, nil); async.Err != nil {
 		return
 	}*/
 
@@ -126,13 +132,88 @@ func (c *Common) DoInstall(async *Async) {
 		 return
 	 }*/
 
+	c.installBundle(async, version, bundleTarXz, checkAt)
+}
+
+// doInstallCheck validates that the configured bundle is available and
+// correctly signed without downloading it, and for dry-runs, that it can be
+// installed.  Nothing on disk is modified.
+func (c *Common) doInstallCheck(async *Async, f *fetcher, version string, downloads *installer.DownloadsEntry) {
+	c.installReport = []string{
+		fmt.Sprintf("Tor Browser %v is available (%v, %v, %v).", version, c.Cfg.Channel, c.Cfg.Locale, c.Cfg.Architecture),
+	}
+
+	// Download and check the signature.
+	log.Printf("install: Downloading %v", downloads.Sig)
+	async.UpdateProgress("Downloading Tor Browser PGP Signature.")
+
+	var bundleSig []byte
+	if bundleSig = f.grab(async, downloads.Sig, nil); async.Err != nil {
+		return
+	}
+	if async.Err = installer.CheckPGPSignatureIssuer(bundleSig); async.Err != nil {
+		return
+	}
+	c.installReport = append(c.installReport, "The PGP signature was issued by the Tor Browser signing key.")
+
+	// Ensure that the bundle actually exists, without downloading it.
+	log.Printf("install: Checking %v", downloads.Binary)
+	async.UpdateProgress("Checking Tor Browser download.")
+
+	resp, err := f.head(async, downloads.Binary)
+	if err != nil {
+		async.Err = err
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		async.Err = fmt.Errorf("bundle not available: %v", resp.Status)
+		return
+	}
+	bundleSize := resp.ContentLength
+	if bundleSize > 0 {
+		c.installReport = append(c.installReport, fmt.Sprintf("The bundle is available for download (%d MiB).", bundleSize/(1024*1024)))
+	} else {
+		c.installReport = append(c.installReport, "The bundle is available for download.")
+	}
+
+	if !c.InstallDryRun {
+		return
+	}
+
+	log.Printf("install: Checking the install directory.")
+	async.UpdateProgress("Checking the install directory.")
+
+	if async.Err = installer.CheckInstallDir(c.Cfg, bundleSize); async.Err != nil {
+		return
+	}
+	c.installReport = append(c.installReport, fmt.Sprintf("The install directory is writable, with sufficient free space (%d MiB required).", installer.InstallSpaceRequired(bundleSize)/(1024*1024)))
+}
+
+// doLocalInstall installs the bundle from the local filesystem, without any
+// network access.
+func (c *Common) doLocalInstall(async *Async) {
+	log.Printf("install: Reading local bundle: %v", c.InstallFromFile)
+	async.UpdateProgress("Reading Tor Browser.")
+
+	var bundle *installer.LocalBundle
+	if bundle, async.Err = installer.ReadLocalBundle(c.Cfg, c.InstallFromFile, c.InstallSigFile); async.Err != nil {
+		return
+	}
+
+	log.Printf("install: Version: %v (PGP signature valid)", bundle.Version)
+
+	c.installBundle(async, bundle.Version, bundle.Bundle, time.Now().Unix())
+}
+
+func (c *Common) installBundle(async *Async, version string, bundleTarXz []byte, checkAt int64) {
 	// Install the bundle.
 	log.Printf("install: Installing Tor Browser.")
 	async.UpdateProgress("Installing Tor Browser.")
 
-	os.RemoveAll(c.Cfg.TorDataDir) // Remove the tor directory.
-
-	if err := installer.ExtractBundle(c.Cfg.BundleInstallDir, bundleTarXz, async.Cancel); err != nil {
+	// Extract the bundle next to the existing installation, which is left
+	// intact until the new bundle is ready to replace it.
+	staged, err := installer.StageBundle(c.Cfg.BundleInstallDir, bundleTarXz, async.Cancel)
+	if err != nil {
 		async.Err = err
 		if async.Err == installer.ErrExtractionCanceled {
 			async.Err = ErrCanceled
@@ -140,16 +221,42 @@ func (c *Common) DoInstall(async *Async) {
 		return
 	}
 
+	// Ensure that the bundle is actually from the configured channel,
+	// which matters the most for bundles supplied by the user.
+	if async.Err = staged.Verify(c.Cfg.Channel); async.Err != nil {
+		staged.Abort()
+		return
+	}
+
+	// Carry over the profile if this is a channel switch.
+	async.UpdateProgress("Preparing profile.")
+	if async.Err = c.migrateProfile(staged); async.Err != nil {
+		staged.Abort()
+		return
+	}
+
 	// Lock out and ignore cancelation, since things are basically done.
 	async.ToUI <- false
 
 	// Install the autoconfig stuff.
-	if async.Err = writeAutoconfig(c.Cfg); async.Err != nil {
+	if async.Err = writeAutoconfig(staged.Dir()); async.Err != nil {
+		staged.Abort()
+		return
+	}
+
+	// Replace the existing installation.
+	if async.Err = staged.Commit(); async.Err != nil {
+		staged.Abort()
 		return
 	}
+	c.ProfileBackup, c.FreshProfile = false, false
+	os.RemoveAll(c.Cfg.TorDataDir) // Remove the tor directory.
 
 	// Set the manifest.
 	c.Manif = config.NewManifest(c.Cfg, version)
+	if async.Err = c.recordExtensions(c.Cfg.BundleInstallDir); async.Err != nil {
+		return
+	}
 	if async.Err = c.Manif.Sync(); async.Err != nil {
 		return
 	}
@@ -163,15 +270,21 @@ func (c *Common) DoInstall(async *Async) {
 	async.Err = c.Cfg.Sync()
 }
 
-func writeAutoconfig(cfg *config.Config) error {
-	autoconfigFile := filepath.Join(cfg.BundleInstallDir, "Browser", "defaults", "pref", "autoconfig.js")
+// InstallReport returns the results of a verification-only or dry-run
+// install.
+func (c *Common) InstallReport() string {
+	return strings.Join(c.installReport, "\n")
+}
+
+func writeAutoconfig(bundleDir string) error {
+	autoconfigFile := filepath.Join(bundleDir, "Browser", "defaults", "pref", "autoconfig.js")
 	if b, err := data.Asset("installer/autoconfig.js"); err != nil {
 		return err
 	} else if err = ioutil.WriteFile(autoconfigFile, b, utils.FileMode); err != nil {
 		return err
 	}
 
-	mozillacfgFile := filepath.Join(cfg.BundleInstallDir, "Browser", "mozilla.cfg")
+	mozillacfgFile := filepath.Join(bundleDir, "Browser", "mozilla.cfg")
 	if b, err := data.Asset("installer/mozilla.cfg"); err != nil {
 		return err
 	} else if err = ioutil.WriteFile(mozillacfgFile, b, utils.FileMode); err != nil {
@@ -17,14 +17,27 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
+	"time"
 
+	"cmd/sandboxed-tor-browser/internal/installer"
 	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
+	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 )
 
+const circuitsTimeout = 15 * time.Second
+
+// ErrInstallRequired is the error returned when launching without a usable
+// installation.
+var ErrInstallRequired = errors.New("launch failed, installation required")
+
 // DoLaunch executes the launch step based on the configured parameters.
 // This is blocking and should be run from a go routine, with the appropriate
 // Async structure used to communicate.
@@ -51,10 +64,24 @@ func (c *Common) DoLaunch(async *Async, checkUpdates bool) {
 
 	// Ensure that we actually can launch.
 	if c.NeedsInstall() {
-		async.Err = fmt.Errorf("launch failed, installation required")
+		async.Err = ErrInstallRequired
+		return
+	}
+
+	// Ensure that the installed bundle is from the configured channel.
+	if async.Err = installer.VerifyBundleChannel(c.Cfg); async.Err != nil {
 		return
 	}
 
+	// Check the profile for damage left behind by crashes, since firefox's
+	// failure modes with a damaged profile are rather opaque.
+	if !c.IgnoreProfileProblems {
+		if problems := c.CheckProfile(); problems != nil {
+			async.Err = &ProfileError{Problems: problems}
+			return
+		}
+	}
+
 	// Start tor if required.
 	log.Printf("launch: Connecting to the Tor network.")
 	async.UpdateProgress("Connecting to the Tor network.")
@@ -62,19 +89,110 @@ func (c *Common) DoLaunch(async *Async, checkUpdates bool) {
 		return
 	}
 
+	// Check for policy pack updates, which take effect immediately for
+	// the browser, and on the next restart for tor.
+	c.updatePolicyPack(async)
+	if async.Err != nil {
+		return
+	}
+
 	// If an update check is needed, check for updates.
-	//TODO: reenable mar updates
-	log.Printf("launch: TB updates are disabled, enabled later.")
-	/*if checkUpdates {
+	if checkUpdates && c.Cfg.EnableMARUpdates {
 		c.doUpdate(async)
 		if async.Err != nil {
 			return
 		}
-	}*/
+	} else if !c.Cfg.EnableMARUpdates {
+		log.Printf("launch: MAR updates are disabled.")
+	}
 
 	// Launch the sandboxed Tor Browser.
 	log.Printf("launch: Starting Tor Browser.")
 	async.UpdateProgress("Starting Tor Browser.")
 
-	c.Sandbox, async.Err = sandbox.RunTorBrowser(c.Cfg, c.Manif, c.tor)
+	// Installs that predate recording the bundled extensions get them
+	// recorded on the first launch.
+	if len(c.Manif.Extensions) == 0 {
+		if async.Err = c.recordExtensions(c.Cfg.BundleInstallDir); async.Err != nil {
+			return
+		}
+		if async.Err = c.Manif.Sync(); async.Err != nil {
+			return
+		}
+	}
+
+	// Keep the persistent disk cache under the size limit.  Failing to do
+	// so is not fatal, since Firefox enforces the same limit.
+	if c.Cfg.Sandbox.PersistentCache {
+		if err := c.TrimBrowserCache(); err != nil {
+			log.Printf("launch: Failed to trim the disk cache: %v", err)
+		}
+	}
+
+	c.clipboard = nil
+	if c.Cfg.Sandbox.BrokerClipboard {
+		c.clipboard = new(x11.Clipboard)
+	}
+	var p *process.Process
+	if p, async.Err = sandbox.RunTorBrowser(c.Cfg, c.Manif, c.tor, c.clipboard, c.screenshot()); async.Err == nil {
+		c.SetSandbox(p)
+		c.writeSessionStatus()
+		c.emitEvent(evLaunch, map[string]interface{}{
+			"sandbox":       "torbrowser",
+			"bundleVersion": c.Manif.Version,
+			"safeMode":      c.InSafeMode(),
+		})
+		p.AddTermHook(func() { c.emitEvent(evExit, map[string]string{"sandbox": "torbrowser"}) })
+	}
+}
+
+// PauseBrowser suspends every process in the Tor Browser sandbox, stopping
+// all CPU and network activity without losing state.
+func (c *Common) PauseBrowser() error {
+	if c.Sandbox == nil {
+		return fmt.Errorf("pause failed, Tor Browser is not running")
+	} else if !c.Cfg.Sandbox.EnablePause {
+		return fmt.Errorf("pause failed, pausing is disabled in the config")
+	}
+	log.Printf("launch: Pausing Tor Browser.")
+	return c.Sandbox.Freeze()
+}
+
+// AllowClipboardPaste allows Tor Browser to read the host clipboard for a
+// short period of time.
+func (c *Common) AllowClipboardPaste() error {
+	if c.Sandbox == nil || c.clipboard == nil {
+		return fmt.Errorf("paste failed, Tor Browser is not running with a brokered clipboard")
+	}
+	c.clipboard.AllowPaste()
+	return nil
+}
+
+// AllowClipboardCopy allows Tor Browser to set the host clipboard once,
+// within a short period of time.
+func (c *Common) AllowClipboardCopy() error {
+	if c.Sandbox == nil || c.clipboard == nil {
+		return fmt.Errorf("copy failed, Tor Browser is not running with a brokered clipboard")
+	}
+	c.clipboard.AllowCopy()
+	return nil
+}
+
+// Circuits returns the running Tor Browser's circuits.
+func (c *Common) Circuits() ([]*tor.Circuit, error) {
+	if c.Sandbox == nil || c.tor == nil {
+		return nil, fmt.Errorf("Tor Browser is not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), circuitsTimeout)
+	defer cancel()
+	return c.tor.Circuits(ctx)
+}
+
+// ResumeBrowser resumes a paused Tor Browser sandbox.
+func (c *Common) ResumeBrowser() error {
+	if c.Sandbox == nil {
+		return fmt.Errorf("resume failed, Tor Browser is not running")
+	}
+	log.Printf("launch: Resuming Tor Browser.")
+	return c.Sandbox.Thaw()
 }
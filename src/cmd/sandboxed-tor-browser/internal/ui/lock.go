@@ -0,0 +1,216 @@
+// lock.go - Lock file handling.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	lockFileName = "lock"
+
+	lockWaitTimeout  = 3 * time.Second
+	lockWaitInterval = 100 * time.Millisecond
+)
+
+// LockHeldError is the error returned when the lock file is held by another
+// process.
+type LockHeldError struct {
+	// Pid is the pid of the instance recorded in the lock file, if any.
+	Pid int
+
+	// Stale is set if the recorded instance is no longer running, and the
+	// lock is held by something it left behind (eg: an orphaned sandbox).
+	Stale bool
+}
+
+func (e *LockHeldError) Error() string {
+	switch {
+	case e.Stale:
+		return fmt.Sprintf("a previous `sandboxed-tor-browser` (pid %d) exited uncleanly, use `--takeover` to recover", e.Pid)
+	case e.Pid > 0:
+		return fmt.Sprintf("`sandboxed-tor-browser` is already running (pid %d)", e.Pid)
+	default:
+		return "`sandboxed-tor-browser` is already running"
+	}
+}
+
+// lockInfo is the lock file metadata, identifying the instance that holds
+// the lock.  The start time guards against pid reuse.
+type lockInfo struct {
+	Pid       int    `json:"pid"`
+	StartTime uint64 `json:"startTime"`
+}
+
+func (info *lockInfo) isAlive() bool {
+	st, err := processStartTime(info.Pid)
+	return err == nil && st == info.StartTime && isLauncher(info.Pid)
+}
+
+type lockFile struct {
+	f *os.File
+}
+
+func (l *lockFile) unlock() {
+	defer l.f.Close()
+}
+
+func lockPath(c *Common) string {
+	return filepath.Join(c.Cfg.RuntimeDir, lockFileName)
+}
+
+func newLockFile(c *Common) (*lockFile, error) {
+	l := new(lockFile)
+	p := lockPath(c)
+
+	var err error
+	if l.f, err = os.OpenFile(p, os.O_CREATE|os.O_RDWR, utils.FileMode); err != nil {
+		return nil, err
+	}
+
+	// Wait a little while for the lock, in case the previous instance is
+	// in the process of exiting.
+	fd := int(l.f.Fd())
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		if err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(lockWaitInterval)
+	}
+	if err != nil {
+		l.f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, lockHeldError(p)
+		}
+		return nil, err
+	}
+
+	if err = l.writeInfo(); err != nil {
+		l.unlock()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *lockFile) writeInfo() error {
+	st, err := processStartTime(os.Getpid())
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&lockInfo{Pid: os.Getpid(), StartTime: st})
+	if err != nil {
+		return err
+	}
+	if err = l.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = l.f.WriteAt(b, 0)
+	return err
+}
+
+// lockHeldError examines the metadata of a held lock file, and returns the
+// appropriate error.  Missing or malformed metadata (eg: from an older
+// version) is conservatively treated as a running instance.
+func lockHeldError(p string) error {
+	info, err := readLockInfo(p)
+	if err != nil {
+		log.Printf("ui: Failed to read the lock file metadata: %v", err)
+		return &LockHeldError{}
+	}
+	return &LockHeldError{Pid: info.Pid, Stale: !info.isAlive()}
+}
+
+func readLockInfo(p string) (*lockInfo, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	info := new(lockInfo)
+	if err = json.Unmarshal(b, info); err != nil {
+		return nil, err
+	}
+	if info.Pid <= 0 {
+		return nil, fmt.Errorf("invalid pid: %d", info.Pid)
+	}
+	return info, nil
+}
+
+// processStartTime returns the start time of a process, in clock ticks
+// since boot, per `/proc/<pid>/stat`.
+func processStartTime(pid int) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name can contain anything, including spaces and
+	// parenthesis, so the fields are parsed from after the last `)`.
+	s := string(b)
+	idx := strings.LastIndexByte(s, ')')
+	if idx < 0 {
+		return 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(s[idx+1:])
+	const startTimeIdx = 22 - 3 // Field 22, with the first 2 consumed.
+	if len(fields) <= startTimeIdx {
+		return 0, fmt.Errorf("truncated stat for pid %d", pid)
+	}
+	return strconv.ParseUint(fields[startTimeIdx], 10, 64)
+}
+
+// TakeoverLock recovers from a previous instance that exited uncleanly, by
+// killing every sandbox it left behind, removing the stale runtime state,
+// and acquiring the lock file, before finishing the runtime initialization.
+func (c *Common) TakeoverLock() error {
+	if info, err := readLockInfo(lockPath(c)); err == nil && info.isAlive() {
+		return &LockHeldError{Pid: info.Pid}
+	}
+
+	n, err := sandbox.Teardown(c.Cfg, false)
+	log.Printf("ui: Takeover killed %d stale sandbox(es)", n)
+	if err != nil {
+		return err
+	}
+
+	// The lock file is removed along with everything else, so that it is
+	// possible to proceed even if something that survived the teardown
+	// still holds the old one.
+	if err = os.RemoveAll(c.Cfg.RuntimeDir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.Cfg.RuntimeDir, utils.DirMode); err != nil {
+		return err
+	}
+	if c.lock, err = newLockFile(c); err != nil {
+		return err
+	}
+	return c.runLocked()
+}
@@ -0,0 +1,56 @@
+// logtap.go - Log output tap.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"strings"
+	"sync"
+)
+
+// logTap is a log output that forwards each line to a subscriber, so that
+// the UI can show what is being logged without console access.
+type logTap struct {
+	sync.Mutex
+	fn func(string)
+}
+
+func (t *logTap) Write(p []byte) (int, error) {
+	t.Lock()
+	fn := t.fn
+	t.Unlock()
+
+	if fn != nil {
+		// The log package calls Write() exactly once per entry.
+		fn(strings.TrimRight(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+// TapLog calls fn with each line that is logged, till the returned function
+// is called.  fn may be called from any goroutine, and must not log.  Only
+// one tap is supported at a time.
+func (c *Common) TapLog(fn func(string)) func() {
+	c.logTap.Lock()
+	defer c.logTap.Unlock()
+	c.logTap.fn = fn
+
+	return func() {
+		c.logTap.Lock()
+		defer c.logTap.Unlock()
+		c.logTap.fn = nil
+	}
+}
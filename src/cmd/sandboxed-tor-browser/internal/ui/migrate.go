@@ -0,0 +1,52 @@
+// migrate.go - Legacy install migration.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"log"
+
+	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// LegacyInstall returns the prior install at a legacy location, if the XDG
+// base directories changed since it was installed, or nil.
+func (c *Common) LegacyInstall() *config.LegacyInstall {
+	return config.FindLegacyInstall(c.Cfg)
+}
+
+// MigrateLegacyInstall moves (or symlinks) the legacy install to the current
+// locations, and reloads the config and manifest.
+func (c *Common) MigrateLegacyInstall(l *config.LegacyInstall, symlink bool) error {
+	log.Printf("ui: Migrating legacy install (data: '%v', config: '%v', symlink: %v)", l.DataDir, l.ConfigFile, symlink)
+	if err := l.Migrate(symlink); err != nil {
+		return err
+	}
+	if err := c.loadConfig(); err != nil {
+		return err
+	}
+	c.Cfg.Sandbox.Relink = c.Relink
+
+	// runLocked already did this, for the empty install.
+	if err := installer.RecoverInstall(c.Cfg.BundleInstallDir); err != nil {
+		log.Printf("install: %v", err)
+	}
+	if err := c.recoverUpdate(); err != nil {
+		log.Printf("update: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// policy.go - Policy pack update routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"log"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/policy"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+// updatePolicyPack fetches and installs a newer policy pack over tor, if
+// one is available.  Failures are logged but otherwise ignored, since the
+// embedded policy is always usable.
+func (c *Common) updatePolicyPack(async *Async) {
+	if !c.Cfg.NeedsPolicyCheck() {
+		return
+	}
+
+	f, err := c.newFetcher(false)
+	if err != nil {
+		log.Printf("launch: Unable to check for policy updates: %v", err)
+		return
+	}
+	url := policy.URL(true)
+	if url == "" {
+		return
+	}
+
+	log.Printf("launch: Checking for policy pack updates.")
+	async.UpdateProgress("Checking for policy updates.")
+
+	// fetcher.grab signals errors via async.Err, which must not leak out of
+	// here.
+	defer func() {
+		if async.Err != nil && async.Err != ErrCanceled {
+			log.Printf("launch: Policy pack check failed: %v", async.Err)
+			async.Err = nil
+		}
+	}()
+
+	b := f.grab(async, url, nil)
+	if async.Err != nil {
+		return
+	}
+	sig := f.grab(async, url+".sig", nil)
+	if async.Err != nil {
+		return
+	}
+
+	if ok, err := policy.Install(c.Cfg.UserDataDir, b, sig); err != nil {
+		async.Err = err
+		return
+	} else if ok {
+		log.Printf("launch: Installed policy pack version %d.", policy.Version())
+	}
+	c.Cfg.SetLastPolicyCheck(time.Now().Unix())
+	c.Cfg.Sync()
+}
@@ -0,0 +1,382 @@
+// profile.go - Tor Browser profile health checks.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const profileBackupSuffix = ".corrupted"
+
+var prefLineRe = regexp.MustCompile(`^(user_pref|pref|lockPref|sticky_pref)\(".*",.*\);$`)
+
+// The SQLite databases that firefox will refuse to start (or silently
+// misbehave) with if they are damaged.
+var profileDatabases = []string{
+	"places.sqlite",
+	"favicons.sqlite",
+	"cookies.sqlite",
+	"formhistory.sqlite",
+	"permissions.sqlite",
+	"content-prefs.sqlite",
+}
+
+// The profile entries that are preserved when resetting the profile.  The
+// bundled extensions (and their prefs) are required for the browser to
+// function, and the bookmarks are the only thing that people tend to care
+// about.  Downloads are kept outside of the profile, and are not touched.
+var profileKeepEntries = []string{
+	"extensions",
+	"preferences",
+	"bookmarkbackups",
+	"places.sqlite",
+	"favicons.sqlite",
+}
+
+// ProfileDir returns the path to the Tor Browser profile directory.
+func (c *Common) ProfileDir() string {
+	return profileDirIn(c.Cfg.BundleInstallDir)
+}
+
+func profileDirIn(bundleDir string) string {
+	return filepath.Join(bundleDir, "Browser", "TorBrowser", "Data", "Browser", "profile.default")
+}
+
+// bundledExtensions returns the file names of the extensions that are
+// present in the profile of the specified bundle, which is expected to be
+// as shipped, since the sandbox never allows writes to it.
+func bundledExtensions(bundleDir string) ([]string, error) {
+	extDir := filepath.Join(profileDirIn(bundleDir), "extensions")
+	ents, err := ioutil.ReadDir(extDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var exts []string
+	for _, ent := range ents {
+		// Extensions are either XPI files, or unpacked into directories.
+		if ent.IsDir() || (ent.Mode().IsRegular() && filepath.Ext(ent.Name()) == ".xpi") {
+			exts = append(exts, ent.Name())
+		}
+	}
+	sort.Strings(exts)
+	return exts, nil
+}
+
+// recordExtensions updates the manifest with the extensions that shipped
+// with the installed bundle.
+func (c *Common) recordExtensions(bundleDir string) error {
+	exts, err := bundledExtensions(bundleDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("install: Bundled extensions: %v", exts)
+	c.Manif.SetExtensions(exts)
+	return nil
+}
+
+// ProfileBackupDir returns the path where the old profile is kept after a
+// reset.
+func (c *Common) ProfileBackupDir() string {
+	return c.ProfileDir() + profileBackupSuffix
+}
+
+// ProfileError is the error returned when launching with a damaged profile.
+type ProfileError struct {
+	// Problems is the description of each problem found.
+	Problems []string
+}
+
+func (e *ProfileError) Error() string {
+	return "the Tor Browser profile appears to be damaged: " + strings.Join(e.Problems, ", ")
+}
+
+// String returns the problems, one per line.
+func (e *ProfileError) String() string {
+	return strings.Join(e.Problems, "\n")
+}
+
+// CheckProfile examines the Tor Browser profile for signs of corruption,
+// and returns a description of each problem found.  Stale lock files are
+// removed as part of the check, and are not considered problems.
+func (c *Common) CheckProfile() []string {
+	profileDir := c.ProfileDir()
+	if !utils.DirExists(profileDir) {
+		return nil
+	}
+
+	// The launcher holds an exclusive lock while running, so lock files
+	// left in the profile can only be from a crash.
+	for _, f := range []string{".parentlock", "lock"} {
+		p := filepath.Join(profileDir, f)
+		if _, err := os.Lstat(p); err != nil {
+			continue
+		}
+		log.Printf("profile: Removing stale lock: %v", f)
+		if err := os.Remove(p); err != nil {
+			log.Printf("profile: Failed to remove stale lock: %v", err)
+		}
+	}
+
+	var problems []string
+	if err := checkPrefsFile(filepath.Join(profileDir, "prefs.js")); err != nil {
+		problems = append(problems, err.Error())
+	}
+	var quickCheck []string
+	for _, db := range profileDatabases {
+		if err := checkSQLiteFile(filepath.Join(profileDir, db)); err != nil {
+			problems = append(problems, err.Error())
+		} else if utils.FileExists(filepath.Join(profileDir, db)) {
+			quickCheck = append(quickCheck, db)
+		}
+	}
+
+	// The header check only catches truncated and overwritten databases,
+	// so have SQLite itself check the rest, if the bundle's SQLite can be
+	// used.
+	if len(quickCheck) > 0 {
+		if resp, err := c.runSQLiteHelper(profileDir, &sqliteRequest{QuickCheck: quickCheck}); err != nil {
+			log.Printf("profile: Failed to run the database quick check: %v", err)
+		} else {
+			problems = append(problems, resp.Problems...)
+		}
+	}
+
+	for _, v := range problems {
+		log.Printf("profile: %v", v)
+	}
+	return problems
+}
+
+// CrashedSession returns true if a persistent profile has a session left
+// behind by Tor Browser not exiting cleanly.
+func (c *Common) CrashedSession() bool {
+	if c.Cfg.Sandbox.EnableAmnesiacProfileDirectory {
+		// The session store is never written to disk.
+		return false
+	}
+
+	profileDir := c.ProfileDir()
+	if !utils.FileExists(filepath.Join(profileDir, "sessionstore-backups", "recovery.jsonlz4")) {
+		return false
+	}
+
+	// Firefox records the shutdown progress, and truncates the file on
+	// startup, so a clean exit will have gotten past `profile-before-change`.
+	b, err := ioutil.ReadFile(filepath.Join(profileDir, "sessionCheckpoints.json"))
+	if err != nil {
+		return true
+	}
+	var checkpoints map[string]bool
+	if err = json.Unmarshal(b, &checkpoints); err != nil {
+		return true
+	}
+	return !checkpoints["profile-before-change"]
+}
+
+// RestoreSession has Tor Browser restore the crashed session on the next
+// launch.
+func (c *Common) RestoreSession() error {
+	log.Printf("profile: Restoring the crashed session")
+	return ioutil.WriteFile(filepath.Join(c.ProfileDir(), sandbox.SessionRestoreFile), nil, utils.FileMode)
+}
+
+// DiscardSession removes the session store from the profile.
+func (c *Common) DiscardSession() error {
+	log.Printf("profile: Discarding the crashed session")
+	profileDir := c.ProfileDir()
+	for _, ent := range sandbox.SessionStoreEntries {
+		if err := os.RemoveAll(filepath.Join(profileDir, ent)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetProfile resets the Tor Browser profile, preserving the bundled
+// extensions and the user's bookmarks.  The old profile is moved aside
+// rather than deleted.
+func (c *Common) ResetProfile() error {
+	profileDir := c.ProfileDir()
+	backupDir := c.ProfileBackupDir()
+
+	log.Printf("profile: Resetting profile, old profile: %v", backupDir)
+
+	if err := os.RemoveAll(backupDir); err != nil {
+		return err
+	}
+	if err := os.Rename(profileDir, backupDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(profileDir, utils.DirMode); err != nil {
+		return err
+	}
+
+	for _, ent := range profileKeepEntries {
+		src := filepath.Join(backupDir, ent)
+		if _, err := os.Lstat(src); err != nil {
+			continue
+		}
+
+		// Don't carry over a damaged database, firefox will rebuild the
+		// bookmarks from `bookmarkbackups` if `places.sqlite` is missing.
+		if strings.HasSuffix(ent, ".sqlite") && checkSQLiteFile(src) != nil {
+			log.Printf("profile: Discarding damaged database: %v", ent)
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(profileDir, ent)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkPrefsFile(f string) error {
+	_, fn := filepath.Split(f)
+
+	fd, err := os.Open(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%v: %v", fn, err)
+	}
+	defer fd.Close()
+
+	inComment := false
+	lineNr := 0
+	rd := bufio.NewReader(fd)
+	for {
+		l, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%v: %v", fn, err)
+		}
+		lineNr++
+
+		if strings.IndexByte(l, 0x00) != -1 {
+			return fmt.Errorf("%v: line %d contains NUL bytes", fn, lineNr)
+		}
+
+		s := strings.TrimSpace(l)
+		switch {
+		case inComment:
+			inComment = !strings.HasSuffix(s, "*/")
+		case s == "", strings.HasPrefix(s, "//"), strings.HasPrefix(s, "#"):
+		case strings.HasPrefix(s, "/*"):
+			inComment = !strings.HasSuffix(s, "*/")
+		case !prefLineRe.MatchString(s):
+			return fmt.Errorf("%v: line %d is malformed", fn, lineNr)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	if inComment {
+		return fmt.Errorf("%v: unterminated comment", fn)
+	}
+
+	return nil
+}
+
+func checkSQLiteFile(f string) error {
+	// This is not `PRAGMA quick_check`, which needs the bundle's SQLite in
+	// a sandbox, but it catches truncated and overwritten databases, which
+	// is how these tend to break.
+	const hdrSize = 100
+
+	sqliteMagic := []byte("SQLite format 3\x00")
+	_, fn := filepath.Split(f)
+
+	fi, err := os.Stat(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%v: %v", fn, err)
+	}
+	if fi.Size() == 0 {
+		// SQLite treats empty files as empty databases.
+		return nil
+	} else if fi.Size() < hdrSize {
+		return fmt.Errorf("%v: truncated database header", fn)
+	}
+
+	fd, err := os.Open(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", fn, err)
+	}
+	defer fd.Close()
+
+	var hdr [hdrSize]byte
+	if _, err = io.ReadFull(fd, hdr[:]); err != nil {
+		return fmt.Errorf("%v: %v", fn, err)
+	}
+	if !bytes.Equal(hdr[0:16], sqliteMagic) {
+		return fmt.Errorf("%v: invalid database header", fn)
+	}
+
+	// uint16_t page_size (Big Endian, 1 = 65536)
+	pageSize := int64(binary.BigEndian.Uint16(hdr[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("%v: invalid page size: %d", fn, pageSize)
+	}
+	if fi.Size()%pageSize != 0 {
+		return fmt.Errorf("%v: truncated database", fn)
+	}
+
+	// uint32_t change_counter (offset 24)
+	// uint32_t database_size (offset 28, in pages)
+	// uint32_t version_valid_for (offset 92)
+	//
+	// The in-header database size is only valid if the change counter
+	// matches version_valid_for, and is only guaranteed to be current if
+	// there is no write-ahead log.
+	if utils.FileExists(f + "-wal") {
+		return nil
+	}
+	changeCounter := binary.BigEndian.Uint32(hdr[24:])
+	validFor := binary.BigEndian.Uint32(hdr[92:])
+	dbSize := int64(binary.BigEndian.Uint32(hdr[28:]))
+	if changeCounter == validFor && dbSize != 0 && dbSize*pageSize != fi.Size() {
+		return fmt.Errorf("%v: database size mismatch", fn)
+	}
+
+	return nil
+}
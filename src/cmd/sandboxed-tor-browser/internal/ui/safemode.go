@@ -0,0 +1,129 @@
+// safemode.go - Crash loop detection and safe mode launch logic.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"log"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	// CrashLoopExitTime is the amount of time Tor Browser needs to stay
+	// running for a launch to be considered successful.
+	CrashLoopExitTime = 15 * time.Second
+
+	crashLoopThreshold = 3
+)
+
+type safeModeStep struct {
+	flag  int
+	descr string
+}
+
+// The optional subsystems, in the order that they will be disabled when
+// attempting a safe launch.  Each step also disables everything before it,
+// so the first step that results in a successful launch identifies the
+// culprit.
+var safeModeSteps = []safeModeStep{
+	{config.SafeModeAVCodec, "libavcodec"},
+	{config.SafeModePulseAudio, "PulseAudio"},
+	{config.SafeModeTheme, "the Gtk+ theme passthrough"},
+	{config.SafeModeAmnesiacProfile, "the amnesiac profile directory"},
+}
+
+// InSafeMode returns true if the current launch is a safe launch.
+func (c *Common) InSafeMode() bool {
+	return c.safeModeStep > 0
+}
+
+// NeedsSafeMode returns true if Tor Browser appears to be stuck in a crash
+// loop, and a safe launch should be offered.
+func (c *Common) NeedsSafeMode() bool {
+	return !c.InSafeMode() && c.Cfg.CrashCount >= crashLoopThreshold
+}
+
+// StartSafeMode starts a safe launch, with the first optional subsystem
+// disabled.
+func (c *Common) StartSafeMode() {
+	log.Printf("launch: Starting safe mode.")
+	c.safeModeStep = 1
+	c.applySafeMode()
+}
+
+func (c *Common) applySafeMode() {
+	flags := 0
+	for i := 0; i < c.safeModeStep && i < len(safeModeSteps); i++ {
+		flags |= safeModeSteps[i].flag
+	}
+	c.Cfg.Sandbox.SafeMode = flags
+}
+
+// OnBrowserQuickExit records that Tor Browser exited shortly after being
+// launched.  If a safe launch is in progress, the next optional subsystem is
+// disabled, and true is returned if another attempt should be made.
+func (c *Common) OnBrowserQuickExit() bool {
+	c.Cfg.SetCrashCount(c.Cfg.CrashCount + 1)
+	if err := c.Cfg.Sync(); err != nil {
+		log.Printf("launch: Failed to record crash count: %v", err)
+	}
+	log.Printf("launch: Tor Browser exited quickly (consecutive: %d).", c.Cfg.CrashCount)
+
+	// The pinned libraries may be the cause, so re-resolve them.
+	c.Cfg.Sandbox.Relink = true
+
+	if !c.InSafeMode() {
+		return false
+	}
+
+	log.Printf("launch: Safe mode: Still crashing with %v disabled.", safeModeSteps[c.safeModeStep-1].descr)
+	if c.safeModeStep >= len(safeModeSteps) {
+		log.Printf("launch: Safe mode: Exhausted all options.")
+		c.safeModeStep = 0
+		c.applySafeMode()
+		return false
+	}
+	c.safeModeStep++
+	c.applySafeMode()
+	return true
+}
+
+// OnBrowserStarted records that Tor Browser appears to have launched
+// successfully.  If a safe launch was in progress, a description of the
+// subsystem that was disabled last (the probable culprit) is returned.
+func (c *Common) OnBrowserStarted() string {
+	c.Cfg.SetCrashCount(0)
+	if err := c.Cfg.Sync(); err != nil {
+		log.Printf("launch: Failed to reset crash count: %v", err)
+	}
+	if err := sandbox.PinLibraries(c.Cfg); err != nil {
+		log.Printf("launch: Failed to pin the Tor Browser libraries: %v", err)
+	}
+
+	if !c.InSafeMode() {
+		return ""
+	}
+
+	// The safe mode flags are left as is for the rest of the session, since
+	// the culprit is still present.
+	culprit := safeModeSteps[c.safeModeStep-1].descr
+	log.Printf("launch: Safe mode: Tor Browser started with %v disabled.", culprit)
+	c.safeModeStep = 0
+	return culprit
+}
@@ -0,0 +1,90 @@
+// screenshot.go - Headless screenshot mode.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+)
+
+var windowSizeRe = regexp.MustCompile(`^[1-9][0-9]{0,4}(,[1-9][0-9]{0,4})?$`)
+
+// parseScreenshotFlags parses the `screenshot` command's flags and URL
+// argument, and returns the remaining arguments.
+func (c *Common) parseScreenshotFlags(args []string) []string {
+	fs := flag.NewFlagSet(cmdScreenshot, flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&c.ScreenshotWindowSize, "window-size", "", "The window size (WIDTH[,HEIGHT]).")
+	fs.Parse(args)
+
+	args = fs.Args()
+	if len(args) == 0 || isCommand(args[0]) {
+		fmt.Fprintf(os.Stderr, "screenshot requires a URL.\n")
+		usage()
+	}
+	u, err := validateScreenshotURL(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	if c.ScreenshotWindowSize != "" && !windowSizeRe.MatchString(c.ScreenshotWindowSize) {
+		fmt.Fprintf(os.Stderr, "Invalid window size: '%v'\n", c.ScreenshotWindowSize)
+		usage()
+	}
+	c.ScreenshotURL = u
+	c.screenshotName = "screenshot-" + time.Now().Format("20060102-150405") + ".png"
+
+	return args[1:]
+}
+
+// validateScreenshotURL returns the normalized URL, if it is an absolute
+// http or https URL.  The URL is passed to firefox as an argument, so
+// anything else (especially things that look like flags) is rejected.
+func validateScreenshotURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("Invalid URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Invalid URL: '%v', must be an absolute http or https URL", s)
+	}
+	return u.String(), nil
+}
+
+// ScreenshotFile returns the host path that the headless screenshot is
+// written to.
+func (c *Common) ScreenshotFile() string {
+	return filepath.Join(c.Cfg.HostDownloadsDir(), c.screenshotName)
+}
+
+func (c *Common) screenshot() *sandbox.Screenshot {
+	if c.ScreenshotURL == "" {
+		return nil
+	}
+	return &sandbox.Screenshot{
+		URL:        c.ScreenshotURL,
+		File:       c.screenshotName,
+		WindowSize: c.ScreenshotWindowSize,
+	}
+}
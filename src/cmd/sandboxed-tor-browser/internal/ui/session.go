@@ -0,0 +1,174 @@
+// session.go - Session status file.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	sessionFile = "session.json"
+
+	torFeaturesTimeout = 5 * time.Second
+)
+
+// sessionStatus is the status of the running Tor Browser sandbox, written
+// to the runtime directory for the benefit of external tooling (eg: window
+// manager rules and scripts).
+type sessionStatus struct {
+	Pid            int    `json:"pid"`
+	Version        string `json:"version"`
+	BundleVersion  string `json:"bundleVersion"`
+	Channel        string `json:"channel"`
+	WindowClass    string `json:"windowClass"`
+	WindowName     string `json:"windowName,omitempty"`
+	WindowIcon     string `json:"windowIcon,omitempty"`
+	SafeMode       bool   `json:"safeMode"`
+	StartTimestamp int64  `json:"startTimestamp"`
+
+	// PidStartTime is the start time of the launcher process, in clock
+	// ticks since boot, used to detect pid reuse.
+	PidStartTime uint64 `json:"pidStartTime"`
+
+	TorFeatures *tor.Features `json:"torFeatures,omitempty"`
+}
+
+func (c *Common) sessionPath() string {
+	return filepath.Join(c.Cfg.RuntimeDir, sessionFile)
+}
+
+func (c *Common) writeSessionStatus() {
+	st := &sessionStatus{
+		Pid:            os.Getpid(),
+		Version:        Version,
+		Channel:        c.Cfg.Channel,
+		WindowClass:    c.Cfg.Sandbox.GetWindowClass(),
+		WindowName:     c.Cfg.Sandbox.WindowName,
+		WindowIcon:     c.Cfg.Sandbox.WindowIcon,
+		SafeMode:       c.InSafeMode(),
+		StartTimestamp: time.Now().Unix(),
+	}
+	if pst, err := processStartTime(st.Pid); err == nil {
+		st.PidStartTime = pst
+	}
+	if c.Manif != nil {
+		st.BundleVersion = c.Manif.Version
+	}
+	if c.tor != nil {
+		ctx, cancelFn := context.WithTimeout(context.Background(), torFeaturesTimeout)
+		defer cancelFn()
+		if f, err := c.tor.Features(ctx); err != nil {
+			log.Printf("launch: Failed to query tor features: %v", err)
+		} else {
+			log.Printf("launch: %v", f)
+			st.TorFeatures = f
+		}
+	}
+
+	// Failure to write the status file is not fatal, it is purely
+	// informational.
+	if b, err := json.Marshal(st); err != nil {
+		log.Printf("launch: Failed to serialize session status: %v", err)
+	} else if err = ioutil.WriteFile(c.sessionPath(), b, utils.FileMode); err != nil {
+		log.Printf("launch: Failed to write session status: %v", err)
+	}
+}
+
+// signalSession sends a signal to the running instance, as recorded in the
+// session status file.
+func (c *Common) signalSession(sig syscall.Signal) error {
+	b, err := ioutil.ReadFile(c.sessionPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Tor Browser is not running")
+		}
+		return err
+	}
+	st := new(sessionStatus)
+	if err = json.Unmarshal(b, st); err != nil {
+		return fmt.Errorf("failed to parse session status: %v", err)
+	}
+	if st.Pid <= 0 || st.Pid == os.Getpid() {
+		return fmt.Errorf("invalid pid in session status: %v", st.Pid)
+	}
+	if !st.isAlive() {
+		return fmt.Errorf("Tor Browser is not running (stale session status)")
+	}
+	return syscall.Kill(st.Pid, sig)
+}
+
+// killSession immediately kills every sandbox and the running instance,
+// without giving anything a chance to clean up, and then wipes the runtime
+// directory, which contains the surrogate sockets.
+func (c *Common) killSession() error {
+	n, err := sandbox.Teardown(c.Cfg, c.KillShred)
+	log.Printf("ui: Killed %d sandbox(es)", n)
+	if err != nil {
+		return err
+	}
+
+	// Killing the sandboxes will make the launcher exit on it's own, but
+	// it is killed as well, in case it is wedged.
+	if b, err := ioutil.ReadFile(c.sessionPath()); err == nil {
+		st := new(sessionStatus)
+		if err = json.Unmarshal(b, st); err == nil && st.Pid > 0 && st.Pid != os.Getpid() && st.isAlive() {
+			if err = syscall.Kill(st.Pid, syscall.SIGKILL); err != nil {
+				return fmt.Errorf("failed to kill the launcher: %v", err)
+			}
+			log.Printf("ui: Killed the launcher (%d)", st.Pid)
+		}
+	}
+
+	return os.RemoveAll(c.Cfg.RuntimeDir)
+}
+
+// isAlive returns true iff the session status was written by a launcher that
+// is still running, and not some other process that reused the pid.
+func (st *sessionStatus) isAlive() bool {
+	info := &lockInfo{Pid: st.Pid, StartTime: st.PidStartTime}
+	return info.isAlive()
+}
+
+// isLauncher returns true iff pid is another instance of this executable,
+// to guard against a stale session status file.
+func isLauncher(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	return err == nil && exe == self
+}
+
+func (c *Common) removeSessionStatus() {
+	if c.Cfg != nil {
+		os.Remove(c.sessionPath())
+	}
+}
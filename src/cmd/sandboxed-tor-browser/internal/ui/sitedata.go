@@ -0,0 +1,278 @@
+// sitedata.go - Per-site persistent profile data.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// SiteData is the data stored in the persistent profile for a single site.
+type SiteData struct {
+	// Site is the first party domain that the data is keyed to.
+	Site string
+
+	// Cookies is the number of cookies.
+	Cookies int
+
+	// Storage is the `storage/default` origin directories.
+	Storage []string
+
+	// Cache is the `cache2` entry files.
+	Cache []string
+}
+
+func (d *SiteData) String() string {
+	return fmt.Sprintf("%v (%d cookies, %d storage origins, %d cache entries)", d.Site, d.Cookies, len(d.Storage), len(d.Cache))
+}
+
+// ListSiteData enumerates the cookies, storage and cache entries in the
+// persistent profile, by site.  The cookies are counted with the bundled
+// SQLite, inside a sandbox.  Tor Browser must not be running.
+func (c *Common) ListSiteData() ([]*SiteData, error) {
+	if c.Sandbox != nil {
+		return nil, fmt.Errorf("failed to list site data, Tor Browser is running")
+	}
+	profileDir := c.ProfileDir()
+	if !utils.DirExists(profileDir) {
+		return nil, fmt.Errorf("failed to list site data, no profile")
+	}
+
+	sites := make(map[string]*SiteData)
+	get := func(site string) *SiteData {
+		site = siteKey(site)
+		d := sites[site]
+		if d == nil {
+			d = &SiteData{Site: site}
+			sites[site] = d
+		}
+		return d
+	}
+
+	// Cookies, which are read with the bundled SQLite, inside a sandbox,
+	// since the database is written by Tor Browser.
+	if resp, err := c.runSQLiteHelper(profileDir, &sqliteRequest{CountCookies: true}); err != nil {
+		log.Printf("ui: Failed to read cookies: %v", err)
+	} else {
+		for site, n := range resp.Cookies {
+			get(site).Cookies += n
+		}
+	}
+
+	// DOM storage (IndexedDB, Cache API, localStorage), by origin.
+	storageDir := filepath.Join(profileDir, "storage", "default")
+	if ents, err := ioutil.ReadDir(storageDir); err == nil {
+		for _, ent := range ents {
+			if !ent.IsDir() {
+				continue
+			}
+			if site := siteForStorageDir(ent.Name()); site != "" {
+				d := get(site)
+				d.Storage = append(d.Storage, filepath.Join(storageDir, ent.Name()))
+			}
+		}
+	}
+
+	// The disk cache, which Tor Browser normally has disabled.
+	cacheDir := filepath.Join(profileDir, "cache2", "entries")
+	if ents, err := ioutil.ReadDir(cacheDir); err == nil {
+		for _, ent := range ents {
+			if !ent.Mode().IsRegular() {
+				continue
+			}
+			p := filepath.Join(cacheDir, ent.Name())
+			if site := siteForCacheEntry(p); site != "" {
+				d := get(site)
+				d.Cache = append(d.Cache, p)
+			}
+		}
+	}
+
+	ret := make([]*SiteData, 0, len(sites))
+	for _, d := range sites {
+		ret = append(ret, d)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Site < ret[j].Site })
+	return ret, nil
+}
+
+// ClearSiteData deletes the cookies, storage and cache entries for the sites
+// from the persistent profile.  The cookies are deleted with the bundled
+// SQLite, inside a sandbox.  Tor Browser must not be running.
+func (c *Common) ClearSiteData(sites []*SiteData) error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("failed to clear site data, Tor Browser is running")
+	}
+
+	var withCookies []string
+	for _, d := range sites {
+		log.Printf("ui: Clearing site data: %v", d)
+		for _, p := range d.Storage {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+		for _, p := range d.Cache {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if d.Cookies > 0 {
+			withCookies = append(withCookies, d.Site)
+		}
+	}
+	if len(withCookies) == 0 {
+		return nil
+	}
+
+	resp, err := c.runSQLiteHelper(c.ProfileDir(), &sqliteRequest{ClearCookies: withCookies})
+	if err != nil {
+		return fmt.Errorf("failed to clear cookies: %v", err)
+	}
+	log.Printf("ui: Cleared %d cookies", resp.ClearedCookies)
+	return nil
+}
+
+// FindSiteData returns the site data matching the named sites, and the
+// names that have no data.
+func FindSiteData(all []*SiteData, names []string) ([]*SiteData, []string) {
+	var found []*SiteData
+	var missing []string
+	for _, name := range names {
+		name = siteKey(name)
+		ok := false
+		for _, d := range all {
+			if d.Site == name {
+				found = append(found, d)
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			missing = append(missing, name)
+		}
+	}
+	return found, missing
+}
+
+// siteKey normalizes a site name.
+func siteKey(site string) string {
+	return strings.TrimPrefix(strings.ToLower(site), ".")
+}
+
+// siteFor returns the site that data for host, with the origin attributes
+// suffix attrs (`firstPartyDomain=example.com&...`) belongs to.  Tor Browser
+// isolates data to the first party domain, so that is preferred over the
+// host.
+func siteFor(host, attrs string) string {
+	attrs = strings.TrimPrefix(attrs, "^")
+	if v, err := url.ParseQuery(attrs); err == nil {
+		if fpd := v.Get("firstPartyDomain"); fpd != "" {
+			return fpd
+		}
+		// partitionKey=(https,example.com[,port])
+		if pk := strings.Trim(v.Get("partitionKey"), "()"); pk != "" {
+			if parts := strings.Split(pk, ","); len(parts) >= 2 && parts[1] != "" {
+				return parts[1]
+			}
+		}
+	}
+	return host
+}
+
+// siteForStorageDir returns the site for a `storage/default` directory name
+// (`https+++example.com+8080^firstPartyDomain=example.com`).
+func siteForStorageDir(name string) string {
+	origin, attrs := name, ""
+	if i := strings.IndexByte(name, '^'); i >= 0 {
+		origin, attrs = name[:i], name[i+1:]
+	}
+	var host string
+	switch {
+	case strings.HasPrefix(origin, "https+++"):
+		host = strings.TrimPrefix(origin, "https+++")
+	case strings.HasPrefix(origin, "http+++"):
+		host = strings.TrimPrefix(origin, "http+++")
+	default:
+		// moz-extension, file, and the like.
+		return ""
+	}
+	if i := strings.LastIndexByte(host, '+'); i >= 0 {
+		host = host[:i]
+	}
+	return siteFor(host, attrs)
+}
+
+// siteForCacheEntry returns the site for a `cache2` entry file, based on the
+// key (`O^firstPartyDomain=example.com,a,:https://example.com/`) in the
+// entry's metadata.
+func siteForCacheEntry(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) < 4 {
+		return ""
+	}
+
+	// The metadata follows the data, and starts with the hashes (a 4 byte
+	// hash of the hashes, and 2 bytes per 256 KiB chunk).  The fixed size
+	// header (8 uint32_ts, KeySize being the 7th) and the key follow.
+	const chunkSize = 256 * 1024
+	metaOff := int(binary.BigEndian.Uint32(b[len(b)-4:]))
+	nChunks := (metaOff + chunkSize - 1) / chunkSize
+	hdrOff := metaOff + 4 + 2*nChunks
+	if metaOff < 0 || hdrOff+32 > len(b)-4 {
+		return ""
+	}
+	keyOff := hdrOff + 28
+	if binary.BigEndian.Uint32(b[hdrOff:]) >= 2 {
+		keyOff += 4 // Flags.
+	}
+	keySize := int(binary.BigEndian.Uint32(b[hdrOff+24:]))
+	if keySize <= 0 || keyOff+keySize > len(b)-4 {
+		return ""
+	}
+	key := string(b[keyOff : keyOff+keySize])
+
+	// The tags are comma separated, and terminated by `:`.
+	var attrs, rawURL string
+	if strings.HasPrefix(key, ":") {
+		rawURL = key[1:]
+	} else if i := strings.Index(key, ",:"); i >= 0 {
+		rawURL = key[i+2:]
+		for _, tag := range strings.Split(key[:i], ",") {
+			if strings.HasPrefix(tag, "O^") {
+				attrs = tag[2:]
+			}
+		}
+	} else {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return siteFor(u.Hostname(), attrs)
+}
@@ -0,0 +1,262 @@
+// sqlitehelper.go - SQLite helper.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/sqlite3"
+)
+
+// sqliteRequest is a request to the SQLite helper.  All of the databases are
+// relative to the directory the helper has access to.
+type sqliteRequest struct {
+	// CountCookies is set to count the cookies in `cookies.sqlite`, by
+	// site.
+	CountCookies bool `json:"countCookies,omitEmpty"`
+
+	// ClearCookies is the sites to delete the cookies of, from
+	// `cookies.sqlite`.
+	ClearCookies []string `json:"clearCookies,omitEmpty"`
+
+	// QuickCheck is the databases to run `PRAGMA quick_check` on.
+	QuickCheck []string `json:"quickCheck,omitEmpty"`
+}
+
+// sqliteResponse is the response from the SQLite helper.
+type sqliteResponse struct {
+	// Err is the error that the helper failed with, if any.
+	Err string `json:"err,omitEmpty"`
+
+	// Cookies is the number of cookies, by site.
+	Cookies map[string]int `json:"cookies,omitEmpty"`
+
+	// ClearedCookies is the number of cookies deleted.
+	ClearedCookies int `json:"clearedCookies"`
+
+	// Problems is the problems found by the quick check, if any.
+	Problems []string `json:"problems,omitEmpty"`
+}
+
+// runSQLiteHelper runs the SQLite helper on the databases in dir.  Tor
+// Browser must not be running.
+func (c *Common) runSQLiteHelper(dir string, req *sqliteRequest) (*sqliteResponse, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(sqliteResponse)
+	if err = sandbox.RunSQLiteHelper(c.Cfg, dir, b, resp); err != nil {
+		return nil, err
+	}
+	if resp.Err != "" {
+		return nil, fmt.Errorf("%v", resp.Err)
+	}
+	return resp, nil
+}
+
+// RunSQLiteHelper is the entry point of the launcher when re-executed with
+// `sandbox.SQLiteHelperArg` inside the SQLite helper sandbox.  It loads the
+// SQLite library args[0], does the request in the file args[1] on the
+// databases in the directory args[2], writes the response to stdout as JSON,
+// and returns the exit status.
+func RunSQLiteHelper(args []string) int {
+	if len(args) != 3 {
+		return -1
+	}
+
+	resp, err := doSQLiteHelper(args[0], args[1], args[2])
+	if err != nil {
+		log.Printf("sqlite: Failed: %v", err)
+		resp = &sqliteResponse{Err: err.Error()}
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(resp); err != nil {
+		return -1
+	}
+	return 0
+}
+
+func doSQLiteHelper(libPath, reqPath, dir string) (*sqliteResponse, error) {
+	b, err := ioutil.ReadFile(reqPath)
+	if err != nil {
+		return nil, err
+	}
+	req := new(sqliteRequest)
+	if err = json.Unmarshal(b, req); err != nil {
+		return nil, err
+	}
+	if err = sqlite3.Load(libPath); err != nil {
+		return nil, err
+	}
+
+	resp := new(sqliteResponse)
+	for _, db := range req.QuickCheck {
+		if db != filepath.Base(db) {
+			return nil, fmt.Errorf("invalid database: '%v'", db)
+		}
+		resp.Problems = append(resp.Problems, quickCheck(filepath.Join(dir, db))...)
+	}
+	if req.CountCookies {
+		if resp.Cookies, err = countCookies(filepath.Join(dir, "cookies.sqlite")); err != nil {
+			return nil, err
+		}
+	}
+	if len(req.ClearCookies) > 0 {
+		if resp.ClearedCookies, err = clearCookies(filepath.Join(dir, "cookies.sqlite"), req.ClearCookies); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// quickCheck runs `PRAGMA quick_check` on the database, and returns the
+// problems found, if any.
+func quickCheck(path string) []string {
+	const maxProblems = 10
+
+	_, fn := filepath.Split(path)
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		// Missing and empty databases are fine.
+		return nil
+	}
+
+	// Opened read-write, so that a journal left behind by a crash can be
+	// recovered the same way Firefox would.
+	db, err := sqlite3.Open(path, false)
+	if err != nil {
+		return []string{fmt.Sprintf("%v: %v", fn, err)}
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA quick_check(" + strconv.Itoa(maxProblems) + ")")
+	if err != nil {
+		return []string{fmt.Sprintf("%v: %v", fn, err)}
+	}
+	var problems []string
+	for _, row := range rows {
+		if len(row) != 1 || row[0] == nil || *row[0] == "ok" {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%v: %v", fn, *row[0]))
+	}
+	return problems
+}
+
+func countCookies(path string) (map[string]int, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	db, err := sqlite3.Open(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT host, originAttributes FROM moz_cookies")
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, row := range rows {
+		if len(row) != 2 || row[0] == nil {
+			continue
+		}
+		attrs := ""
+		if row[1] != nil {
+			attrs = *row[1]
+		}
+		if site := siteFor(*row[0], attrs); site != "" {
+			counts[siteKey(site)]++
+		}
+	}
+	return counts, nil
+}
+
+func clearCookies(path string, sites []string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	db, err := sqlite3.Open(path, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	toClear := make(map[string]bool)
+	for _, site := range sites {
+		toClear[siteKey(site)] = true
+	}
+
+	// The site is derived the same way as when listing the site data, so
+	// the rows are matched here rather than in SQL.
+	rows, err := db.Query("SELECT rowid, host, originAttributes FROM moz_cookies")
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for _, row := range rows {
+		if len(row) != 3 || row[0] == nil || row[1] == nil {
+			continue
+		}
+		attrs := ""
+		if row[2] != nil {
+			attrs = *row[2]
+		}
+		if !toClear[siteKey(siteFor(*row[1], attrs))] {
+			continue
+		}
+		id, err := strconv.ParseInt(*row[0], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if _, err = db.Exec("BEGIN IMMEDIATE"); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		changed, err := db.Exec("DELETE FROM moz_cookies WHERE rowid = ?", id)
+		if err != nil {
+			db.Exec("ROLLBACK")
+			return 0, err
+		}
+		n += changed
+	}
+	if _, err = db.Exec("COMMIT"); err != nil {
+		db.Exec("ROLLBACK")
+		return 0, err
+	}
+	return n, nil
+}
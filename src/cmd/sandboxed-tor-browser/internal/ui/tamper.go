@@ -0,0 +1,124 @@
+// tamper.go - Bundle modification detection.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// bundleWatchDirs are the directories (relative to the bundle install
+// directory) containing the browser and tor binaries, and `omni.ja`.  Each of
+// these is bind mounted read-only into the sandboxes, so nothing should be
+// changing them while Tor Browser is running.
+var bundleWatchDirs = []string{
+	"Browser",
+	filepath.Join("Browser", "browser"),
+	filepath.Join("Browser", "TorBrowser", "Tor"),
+	filepath.Join("Browser", "TorBrowser", "Tor", "PluggableTransports"),
+}
+
+// bundleWatcher watches the bundle install directory for modifications to
+// the binaries, that could only have been done from the host.  Changes to
+// the attributes are deliberately ignored, since backup tools tend to hard
+// link files.
+type bundleWatcher struct {
+	f  *os.File
+	ch chan string
+
+	reported map[string]bool
+}
+
+func newBundleWatcher(installDir string) (*bundleWatcher, error) {
+	var dirs []string
+	for _, v := range bundleWatchDirs {
+		if d := filepath.Join(installDir, v); utils.DirExists(d) {
+			dirs = append(dirs, d)
+		}
+	}
+
+	const mask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	f, wds, err := newInotify(dirs, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &bundleWatcher{
+		f:        f,
+		ch:       make(chan string, 16),
+		reported: make(map[string]bool),
+	}
+	go func() {
+		defer close(w.ch)
+		readInotify(w.f, func(wd int32, mask uint32, name string) {
+			w.onModified(filepath.Join(wds[wd], name))
+		})
+	}()
+	return w, nil
+}
+
+func (w *bundleWatcher) onModified(path string) {
+	// Each write will generate an event, only report each file once.
+	if w.reported[path] {
+		return
+	}
+	w.reported[path] = true
+
+	log.Printf("ui: WARNING: Bundle modified while running: %v", path)
+	select {
+	case w.ch <- path:
+	default:
+		// The UI is not keeping up, drop the alert.
+	}
+}
+
+func (w *bundleWatcher) close() {
+	w.f.Close()
+}
+
+// WatchBundle starts watching the bundle install directory for modification
+// while Tor Browser is running if enabled in the config, and returns a
+// channel that will receive the path of each modified file.  The returned
+// channel is nil if the watcher is disabled or fails to start.
+func (c *Common) WatchBundle() <-chan string {
+	c.StopWatchingBundle()
+	if !c.Cfg.Sandbox.WatchBundle {
+		return nil
+	}
+
+	w, err := newBundleWatcher(c.Cfg.BundleInstallDir)
+	if err != nil {
+		log.Printf("ui: Failed to watch the bundle: %v", err)
+		return nil
+	}
+	log.Printf("ui: Watching the bundle for modifications")
+	c.bundleWatcher = w
+	return w.ch
+}
+
+// StopWatchingBundle stops watching the bundle install directory, and must
+// be called before the bundle is legitimately modified (eg: by an update).
+func (c *Common) StopWatchingBundle() {
+	if c.bundleWatcher != nil {
+		c.bundleWatcher.close()
+		c.bundleWatcher = nil
+	}
+}
@@ -19,17 +19,23 @@
 package ui
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"git.schwanenlied.me/yawning/grab.git"
@@ -37,8 +43,10 @@ import (
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/policy"
 	"cmd/sandboxed-tor-browser/internal/sandbox"
 	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
 	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
@@ -78,11 +86,128 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "\n Commands:\n\n")
 	fmt.Fprintf(os.Stderr, "   install\tForce (re)installation.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --from-file FILE  Install from a local bundle.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --sig FILE        The local bundle's PGP signature.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --verify-only     Only verify the bundle availability and signature.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --dry-run         Verify, and check disk space and permissions.\n")
 	fmt.Fprintf(os.Stderr, "   config\tForce (re)configuration.\n")
+	fmt.Fprintf(os.Stderr, "   diagnose\tCheck the host environment and exit.\n")
+	fmt.Fprintf(os.Stderr, "   backup [FILE]\tBack up the bookmarks, certificate overrides, and NoScript settings.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --full            Back up the entire profile.\n")
+	fmt.Fprintf(os.Stderr, "   restore [FILE]\tRestore a backup into the profile.\n")
+	fmt.Fprintf(os.Stderr, "   clear-site-data [SITE]...\tClear the cookies, storage and cache of sites.\n")
+	fmt.Fprintf(os.Stderr, "   clear-cache\tClear the persistent disk cache.\n")
+	fmt.Fprintf(os.Stderr, "   clipboard-paste\tAllow the running Tor Browser to read the clipboard.\n")
+	fmt.Fprintf(os.Stderr, "   clipboard-copy\tAllow the running Tor Browser to set the clipboard.\n")
+	fmt.Fprintf(os.Stderr, "   circuits\tShow the running Tor Browser's circuits.\n")
+	fmt.Fprintf(os.Stderr, "   pause\t\tPause the running Tor Browser, if enabled in the config.\n")
+	fmt.Fprintf(os.Stderr, "   resume\tResume the paused Tor Browser.\n")
+	fmt.Fprintf(os.Stderr, "   screenshot URL\tHeadlessly screenshot a URL into the Downloads directory.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --window-size W[,H] The window size.\n")
+	fmt.Fprintf(os.Stderr, "   kill\t\tImmediately kill every sandbox, and the launcher.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --shred           Overwrite the sandboxes' tmpfs contents first.\n")
+	fmt.Fprintf(os.Stderr, "   uninstall\tRemove Tor Browser, and all of the state and config.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --dry-run         Only list what would be removed.\n")
+	fmt.Fprintf(os.Stderr, "   \t\t  --user-files      Also remove the Downloads and Desktop content in the bundle.\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	os.Exit(-1)
 }
 
+// printFingerprint prints the version and host environment fingerprint as
+// JSON, since most bug reports require it.
+func printFingerprint() {
+	fp := struct {
+		Version     string               `json:"version"`
+		Revision    string               `json:"revision"`
+		Environment *sandbox.Fingerprint `json:"environment"`
+	}{Version, Revision, sandbox.GetFingerprint()}
+	if b, err := json.MarshalIndent(&fp, "", "  "); err == nil {
+		fmt.Printf("%s\n", b)
+	}
+}
+
+// parseInstallFlags parses the `install` command's flags, and returns the
+// remaining arguments.
+func (c *Common) parseInstallFlags(args []string) []string {
+	fs := flag.NewFlagSet(cmdInstall, flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&c.InstallFromFile, "from-file", "", "Install from a local bundle.")
+	fs.StringVar(&c.InstallSigFile, "sig", "", "The local bundle's PGP signature.")
+	fs.BoolVar(&c.InstallVerifyOnly, "verify-only", false, "Only verify that the bundle is available and signed.")
+	fs.BoolVar(&c.InstallDryRun, "dry-run", false, "Verify, and check that the bundle can be installed.")
+	fs.Parse(args)
+
+	if c.InstallFromFile != "" || c.InstallSigFile != "" {
+		if c.InstallFromFile == "" || c.InstallSigFile == "" {
+			fmt.Fprintf(os.Stderr, "Both --from-file and --sig must be specified.\n")
+			usage()
+		}
+		if c.InstallVerifyOnly || c.InstallDryRun {
+			fmt.Fprintf(os.Stderr, "--verify-only and --dry-run require a network install.\n")
+			usage()
+		}
+	}
+
+	return fs.Args()
+}
+
+// parseBackupFlags parses the `backup` and `restore` commands' flags and
+// optional file argument, and returns the remaining arguments.
+func (c *Common) parseBackupFlags(cmd string, args []string) []string {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = usage
+	if cmd == cmdBackup {
+		fs.BoolVar(&c.BackupFull, "full", false, "Back up the entire profile.")
+	}
+	fs.Parse(args)
+
+	args = fs.Args()
+	if len(args) > 0 && !isCommand(args[0]) {
+		c.BackupFile, args = args[0], args[1:]
+	}
+	return args
+}
+
+// parseKillFlags parses the `kill` command's flags, and returns the remaining
+// arguments.
+func (c *Common) parseKillFlags(args []string) []string {
+	fs := flag.NewFlagSet(cmdKill, flag.ExitOnError)
+	fs.Usage = usage
+	fs.BoolVar(&c.KillShred, "shred", false, "Overwrite the sandboxes' tmpfs contents first.")
+	fs.Parse(args)
+
+	return fs.Args()
+}
+
+// parseUninstallFlags parses the `uninstall` command's flags, and returns the
+// remaining arguments.
+func (c *Common) parseUninstallFlags(args []string) []string {
+	fs := flag.NewFlagSet(cmdUninstall, flag.ExitOnError)
+	fs.Usage = usage
+	fs.BoolVar(&c.UninstallDryRun, "dry-run", false, "Only list what would be removed.")
+	fs.BoolVar(&c.UninstallUserFiles, "user-files", false, "Also remove the Downloads and Desktop content in the bundle.")
+	fs.Parse(args)
+
+	return fs.Args()
+}
+
+// parseClearSiteDataArgs parses the `clear-site-data` command's optional
+// site arguments, and returns the remaining arguments.
+func (c *Common) parseClearSiteDataArgs(args []string) []string {
+	for len(args) > 0 && !isCommand(args[0]) {
+		c.ClearSites, args = append(c.ClearSites, args[0]), args[1:]
+	}
+	return args
+}
+
+func isCommand(s string) bool {
+	switch strings.ToLower(s) {
+	case cmdInstall, cmdConfig, cmdDiagnose, cmdBackup, cmdRestore, cmdClearSiteData, cmdClearCache, cmdClipboardPaste, cmdClipboardCopy, cmdCircuits, cmdPause, cmdResume, cmdScreenshot, cmdKill, cmdUninstall:
+		return true
+	}
+	return false
+}
+
 // UI is a user interface implementation.
 type UI interface {
 	// Run runs the user interface.
@@ -92,40 +217,124 @@ type UI interface {
 	Term()
 }
 
+const (
+	cmdInstall        = "install"
+	cmdConfig         = "config"
+	cmdDiagnose       = "diagnose"
+	cmdBackup         = "backup"
+	cmdRestore        = "restore"
+	cmdClearSiteData  = "clear-site-data"
+	cmdClearCache     = "clear-cache"
+	cmdClipboardPaste = "clipboard-paste"
+	cmdClipboardCopy  = "clipboard-copy"
+	cmdCircuits       = "circuits"
+	cmdPause          = "pause"
+	cmdResume         = "resume"
+	cmdScreenshot     = "screenshot"
+	cmdKill           = "kill"
+	cmdUninstall      = "uninstall"
+)
+
+var (
+	// SigClipboardPaste is the signal (SIGRTMIN+1) that allows the running
+	// Tor Browser to read the host clipboard.
+	SigClipboardPaste = syscall.Signal(35)
+
+	// SigClipboardCopy is the signal (SIGRTMIN+2) that allows the running
+	// Tor Browser to set the host clipboard.
+	SigClipboardCopy = syscall.Signal(36)
+
+	// SigCircuits is the signal (SIGRTMIN+3) that shows the running Tor
+	// Browser's circuits.
+	SigCircuits = syscall.Signal(37)
+)
+
 // Common holds ui implementation agnostic state.
 type Common struct {
 	Cfg     *config.Config
 	Manif   *config.Manifest
 	Sandbox *process.Process
 	tor     *tor.Tor
+	torrc   []byte
 	lock    *lockFile
 
+	// sandboxLock protects Sandbox against Term, which is called from the
+	// signal handling path while the UI goroutine is still running.
+	sandboxLock sync.Mutex
+
+	clipboard     *x11.Clipboard
+	downloads     *downloadsWatcher
+	bundleWatcher *bundleWatcher
+
 	logQuiet bool
 	logPath  string
 	logFile  *os.File
+	logTap   logTap
+	events   *eventFeed
 
 	PendingUpdate *installer.UpdateEntry
 
-	ForceInstall   bool
-	ForceConfig    bool
-	NoKillTor      bool
-	AdvancedConfig bool
-	PrintVersion   bool
-	WasHardened    bool
+	safeModeStep int
+	terminating  int32
+
+	InstallFromFile   string
+	InstallSigFile    string
+	InstallVerifyOnly bool
+	InstallDryRun     bool
+	installReport     []string
+
+	ProfileBackup         bool
+	FreshProfile          bool
+	IgnoreProfileProblems bool
+
+	BackupFile string
+	BackupFull bool
+
+	ClearSites []string
+
+	UninstallDryRun    bool
+	UninstallUserFiles bool
+
+	ScreenshotURL        string
+	ScreenshotWindowSize string
+	screenshotName       string
+
+	ForceInstall     bool
+	ForceConfig      bool
+	ForceDiagnostics bool
+	ForceBackup      bool
+	ForceRestore     bool
+	ForceClearSites  bool
+	ForceClearCache  bool
+	ForceUninstall   bool
+	RemoteCommand    bool
+	ForceKill        bool
+	KillShred        bool
+	NoKillTor        bool
+	AdvancedConfig   bool
+	PrintVersion     bool
+	Relink           bool
+	Takeover         bool
+	WasHardened      bool
 }
 
 // Init initializes the common interface state.
 func (c *Common) Init() error {
-	var err error
-
 	// Register the common command line flags.
 	flag.Usage = usage
 	flag.BoolVar(&c.AdvancedConfig, "advanced", false, "Show advanced config options.")
-	flag.BoolVar(&c.PrintVersion, "version", false, "Print the version and exit.")
+	flag.BoolVar(&c.PrintVersion, "version", false, "Print the version and host environment fingerprint, and exit.")
+	flag.BoolVar(&c.Relink, "relink", false, "Re-resolve the Tor Browser libraries instead of using the pinned set.")
+	flag.BoolVar(&c.Takeover, "takeover", false, "Take over from a previous instance that exited uncleanly.")
 	flag.BoolVar(&c.logQuiet, "q", false, "Suppress logging to console.")
 	flag.StringVar(&c.logPath, "l", "", "Specify a log file.")
 
-	// Initialize/load the config file.
+	return c.loadConfig()
+}
+
+// loadConfig initializes/loads the config file and the manifest.
+func (c *Common) loadConfig() error {
+	var err error
 	if c.Cfg, err = config.New(Version + "-" + Revision); err != nil {
 		return err
 	}
@@ -133,6 +342,7 @@ func (c *Common) Init() error {
 		return err
 	}
 	c.Cfg.Sanitize()
+	policy.Load(c.Cfg.UserDataDir)
 
 	if c.Manif != nil {
 		if err = c.Manif.Sync(); err != nil {
@@ -142,7 +352,7 @@ func (c *Common) Init() error {
 		// If the config is clearly from an old version, re-assert our will
 		// over firefox, by re-writing the autoconfig files.
 		if c.Cfg.ConfigVersionChanged {
-			if err = writeAutoconfig(c.Cfg); err != nil {
+			if err = writeAutoconfig(c.Cfg.BundleInstallDir); err != nil {
 				return err
 			}
 		}
@@ -158,31 +368,80 @@ func (c *Common) Init() error {
 
 // Run handles initiailzing the at-runtime state.
 func (c *Common) Run() error {
-	const (
-		cmdInstall = "install"
-		cmdConfig  = "config"
-	)
-
 	// Parse the command line flags.
 	halp := flag.Bool("h", false, "Print usage and esit.")
 	flag.Parse()
 	if *halp {
 		flag.Usage()
 	}
-	for _, v := range flag.Args() {
+	args := flag.Args()
+	var sig syscall.Signal
+	for len(args) > 0 {
+		v := args[0]
+		args = args[1:]
 		switch strings.ToLower(v) {
 		case cmdInstall:
 			c.ForceInstall = true
+			args = c.parseInstallFlags(args)
 		case cmdConfig:
 			c.ForceConfig = true
+		case cmdDiagnose:
+			c.ForceDiagnostics = true
+		case cmdBackup:
+			c.ForceBackup = true
+			args = c.parseBackupFlags(cmdBackup, args)
+		case cmdRestore:
+			c.ForceRestore = true
+			args = c.parseBackupFlags(cmdRestore, args)
+		case cmdClearSiteData:
+			c.ForceClearSites = true
+			args = c.parseClearSiteDataArgs(args)
+		case cmdClearCache:
+			c.ForceClearCache = true
+		case cmdClipboardPaste:
+			c.RemoteCommand = true
+			sig = SigClipboardPaste
+		case cmdClipboardCopy:
+			c.RemoteCommand = true
+			sig = SigClipboardCopy
+		case cmdCircuits:
+			c.RemoteCommand = true
+			sig = SigCircuits
+		case cmdPause:
+			c.RemoteCommand = true
+			sig = syscall.SIGUSR1
+		case cmdResume:
+			c.RemoteCommand = true
+			sig = syscall.SIGUSR2
+		case cmdScreenshot:
+			args = c.parseScreenshotFlags(args)
+		case cmdKill:
+			c.RemoteCommand = true
+			c.ForceKill = true
+			args = c.parseKillFlags(args)
+		case cmdUninstall:
+			c.ForceUninstall = true
+			args = c.parseUninstallFlags(args)
 		default:
 			flag.Usage()
 		}
 	}
+	c.Cfg.Sandbox.Relink = c.Relink
 	if c.PrintVersion {
 		fmt.Printf("sandboxed-tor-browser %s (%s)\n", Version, Revision)
+		printFingerprint()
 		return nil // Skip the lock, because we will exit.
 	}
+	if c.RemoteCommand {
+		// Skip the lock, since the running instance holds it.
+		if c.ForceKill {
+			return c.killSession()
+		}
+		if sig == syscall.SIGUSR1 && !c.Cfg.Sandbox.EnablePause {
+			return fmt.Errorf("pausing is disabled in the config")
+		}
+		return c.signalSession(sig)
+	}
 
 	// Create the directories required.
 	if !utils.DirExists(c.Cfg.UserDataDir) {
@@ -215,11 +474,10 @@ func (c *Common) Run() error {
 	if !c.logQuiet {
 		logWriters = append(logWriters, os.Stdout)
 	}
-	if len(logWriters) == 0 {
-		log.SetOutput(ioutil.Discard)
-	} else {
-		w := io.MultiWriter(logWriters...)
-		log.SetOutput(w)
+	logWriters = append(logWriters, &c.logTap)
+	log.SetOutput(io.MultiWriter(logWriters...))
+	if c.Cfg.RuntimeDirIsFallback {
+		log.Printf("ui: No usable `XDG_RUNTIME_DIR`, using '%v'.", c.Cfg.RuntimeDir)
 	}
 
 	// Set sensible rlimits.
@@ -227,16 +485,65 @@ func (c *Common) Run() error {
 		return err
 	}
 
-	// Acquire the lock file.
+	// Acquire the lock file, taking over from an instance that exited
+	// uncleanly if requested.
 	if c.lock, err = newLockFile(c); err != nil {
+		if lErr, ok := err.(*LockHeldError); !ok || !lErr.Stale || !c.Takeover {
+			return err
+		}
+		return c.TakeoverLock()
+	}
+	return c.runLocked()
+}
+
+// runLocked handles the runtime state initialization that requires the lock
+// file to be held.
+func (c *Common) runLocked() error {
+	var err error
+	if err = sandbox.InitRegistry(c.Cfg); err != nil {
 		return err
 	}
 
+	// Clean up after an interrupted install, now that no other instance
+	// can be installing.
+	if err = installer.RecoverInstall(c.Cfg.BundleInstallDir); err != nil {
+		log.Printf("install: %v", err)
+	}
+	if err = c.recoverUpdate(); err != nil {
+		log.Printf("update: %v", err)
+	}
+	c.startEventFeed()
+
 	return nil
 }
 
+// SetSandbox sets the running Tor Browser sandbox instance.
+func (c *Common) SetSandbox(p *process.Process) {
+	c.sandboxLock.Lock()
+	defer c.sandboxLock.Unlock()
+	c.Sandbox = p
+}
+
 // Term handles the common interface state cleanup, prior to termination.
 func (c *Common) Term() {
+	atomic.StoreInt32(&c.terminating, 1)
+
+	// Give Tor Browser a chance to exit cleanly, so that the session store
+	// is flushed to disk, before tor goes away.
+	c.sandboxLock.Lock()
+	p := c.Sandbox
+	c.sandboxLock.Unlock()
+	if p != nil && c.Cfg != nil {
+		grace := c.Cfg.Sandbox.GetShutdownGracePeriod()
+		log.Printf("ui: Stopping Tor Browser (grace period: %v)", grace)
+		p.Terminate(grace)
+	}
+
+	c.removeSessionStatus()
+	c.stopEventFeed()
+	c.stopWatchingDownloads()
+	c.StopWatchingBundle()
+
 	// Flush the config to disk.
 	if c.Cfg != nil {
 		c.Cfg.Sync()
@@ -253,6 +560,60 @@ func (c *Common) Term() {
 	}
 }
 
+// Terminating returns true if the launcher is shutting down, and Tor Browser
+// exiting should not be treated as a crash.
+func (c *Common) Terminating() bool {
+	return atomic.LoadInt32(&c.terminating) != 0
+}
+
+// RunDiagnostics checks the host environment, logs the results, and returns
+// a human readable report, and true if the sandbox is unlikely to work.
+func (c *Common) RunDiagnostics() (string, bool) {
+	results := sandbox.RunDiagnostics(c.Cfg)
+	if c.tor != nil {
+		results = append(results, c.diagSelfTest())
+	}
+	if r := c.diagMirror(); r != nil {
+		results = append(results, r)
+	}
+	for _, r := range results {
+		log.Printf("diagnostics: %v", r)
+	}
+	return sandbox.FormatDiagnostics(results)
+}
+
+func (c *Common) diagSelfTest() *sandbox.DiagnosticResult {
+	r := &sandbox.DiagnosticResult{Name: "SOCKS surrogate"}
+	if err := c.tor.SelfTest(); err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	r.Passed = true
+	r.Detail = "connections via the browser's SOCKS path work"
+	return r
+}
+
+func (c *Common) diagMirror() *sandbox.DiagnosticResult {
+	m := &c.Cfg.Mirror
+	if m.DownloadsURL == "" && m.UpdateURL == "" && len(m.Hosts) == 0 {
+		return nil
+	}
+
+	var notes []string
+	if m.DownloadsURL != "" || m.UpdateURL != "" {
+		notes = append(notes, "the install/update URLs are overridden")
+	}
+	hosts := make([]string, 0, len(m.Hosts))
+	for host := range m.Hosts {
+		hosts = append(hosts, host)
+	}
+	if len(hosts) > 0 {
+		sort.Strings(hosts)
+		notes = append(notes, fmt.Sprintf("TLS verification is overridden for: %v", strings.Join(hosts, ", ")))
+	}
+	return &sandbox.DiagnosticResult{Name: "Mirror", Detail: strings.Join(notes, ", ")}
+}
+
 // NeedsInstall returns true if the bundle needs to be (re)installed.
 func (c *Common) NeedsInstall() bool {
 	if c.Manif == nil {
@@ -272,16 +633,22 @@ func (c *Common) NeedsInstall() bool {
 
 type dialFunc func(string, string) (net.Conn, error)
 
-func (c *Common) getTorDialFunc() (dialFunc, error) {
-	if c.tor == nil {
-		return nil, tor.ErrTorNotRunning
-	}
+func (c *Common) probeBridges(async *Async) error {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
 
-	dialer, err := c.tor.Dialer()
-	if err != nil {
-		return nil, err
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tor.ProbeBridges(ctx, c.Cfg, Bridges)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-async.Cancel:
+		cancelFn()
+		<-errCh
+		return ErrCanceled
 	}
-	return dialer.Dial, nil
 }
 
 func (c *Common) launchTor(async *Async, onlySystem bool) error {
@@ -293,30 +660,48 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 		}
 	}()
 
-	if c.tor != nil && !c.NoKillTor {
+	if c.tor != nil && !c.NoKillTor && !c.canReuseTor() {
 		log.Printf("launch: Shutting down old tor.")
 		c.tor.Shutdown()
 		c.tor = nil
 	}
 
-	if c.tor != nil && c.NoKillTor {
+	if c.tor != nil {
 		// Only the first re-launch should be skipped.
 		log.Printf("launch: Reusing old tor.")
 		c.NoKillTor = false
+
+		// The container may have been changed since tor was launched.
+		if err = c.tor.SetContainer(c.Cfg); err != nil {
+			async.Err = err
+			return err
+		}
 	} else if c.Cfg.UseSystemTor {
 		if c.tor, err = tor.NewSystemTor(c.Cfg); err != nil {
 			async.Err = err
 			return err
 		}
 	} else if !onlySystem {
+		// Probe the internal bridges, if enabled.  Failure is not fatal,
+		// since tor will try all of them anyway.
+		if c.Cfg.Tor.ProbeBridges && c.Cfg.Tor.UseBridges && !c.Cfg.Tor.UseCustomBridges {
+			async.UpdateProgress("Probing bridges.")
+			if err := c.probeBridges(async); err == ErrCanceled {
+				async.Err = err
+				return err
+			} else if err != nil {
+				log.Printf("launch: Failed to probe bridges: %v", err)
+			}
+		}
+
 		// Build the torrc.
-		torrc, err := tor.CfgToSandboxTorrc(c.Cfg, Bridges)
+		torrc, err := tor.CfgToSandboxTorrc(c.Cfg, c.Manif, Bridges)
 		if err != nil {
 			async.Err = err
 			return err
 		}
 
-		os.Remove(filepath.Join(c.Cfg.TorDataDir, "control_port"))
+		os.Remove(tor.ControlPortFile(c.Cfg))
 
 		async.UpdateProgress("Launching Tor executable.")
 		process, err := sandbox.RunTor(c.Cfg, c.Manif, torrc)
@@ -325,12 +710,16 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 			return err
 		}
 
+		process.AddTermHook(func() { c.emitEvent(evExit, map[string]string{"sandbox": "tor"}) })
+
 		async.UpdateProgress("Waiting on Tor bootstrap.")
 		c.tor = tor.NewSandboxedTor(c.Cfg, process)
+		c.tor.SetBootstrapHook(func(st *tor.BootstrapStatus) { c.emitEvent(evBootstrap, st) })
 		if err = c.tor.DoBootstrap(c.Cfg, async); err != nil {
 			async.Err = err
 			return err
 		}
+		c.torrc = c.currentTorrc()
 	} else if !(c.NeedsInstall() || c.ForceInstall) {
 		// That's odd, we only asked for a system tor, but we should be capable
 		// of launching tor ourselves.  Don't use a direct connection.
@@ -346,82 +735,176 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 	return tor.ErrTorNotRunning
 }
 
-type lockFile struct {
-	f *os.File
+// canReuseTor returns true if the existing sandboxed tor instance should be
+// kept running, instead of being relaunched.
+func (c *Common) canReuseTor() bool {
+	if !c.Cfg.Tor.KeepRunning || c.Cfg.UseSystemTor || c.tor.IsSystem() {
+		return false
+	}
+	if !c.tor.IsRunning() {
+		log.Printf("launch: Old tor is no longer running.")
+		return false
+	}
+
+	// The tor config can't be changed on the fly, so if the user changed
+	// the config, tor needs to be relaunched.
+	if torrc := c.currentTorrc(); torrc == nil || !bytes.Equal(torrc, c.torrc) {
+		log.Printf("launch: Tor configuration changed.")
+		return false
+	}
+	return true
 }
 
-func (l *lockFile) unlock() {
-	defer l.f.Close()
+func (c *Common) currentTorrc() []byte {
+	torrc, err := tor.PreviewSandboxTorrc(c.Cfg, c.Manif, Bridges, c.Cfg.Tor.ExtraTorrc)
+	if err != nil {
+		return nil
+	}
+
+	// Conflux is configured via the control port after launch.
+	return append(torrc, []byte("\n# ConfluxMode "+c.Cfg.Tor.ConfluxMode)...)
 }
 
-func newLockFile(c *Common) (*lockFile, error) {
-	const lockFileName = "lock"
+// BridgeLineError is the reason a single bridge line failed validation.
+type BridgeLineError struct {
+	// Line is the bad line's index into the bridge lines.
+	Line int
 
-	l := new(lockFile)
-	p := filepath.Join(c.Cfg.RuntimeDir, lockFileName)
+	// Reason is why the line is bad.
+	Reason string
+}
 
-	var err error
-	if l.f, err = os.OpenFile(p, os.O_CREATE, utils.FileMode); err != nil {
-		return nil, err
-	}
+func (e *BridgeLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line+1, e.Reason)
+}
 
-	fd := int(l.f.Fd())
-	if err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		if err == syscall.EWOULDBLOCK {
-			return nil, fmt.Errorf("`sandboxed-tor-browser` is already running")
+// CheckBridgeLines validates each of the bridge lines, and returns the
+// errors, if any, in line order.
+func CheckBridgeLines(ls string) []*BridgeLineError {
+	var errs []*BridgeLineError
+	for i, l := range strings.Split(ls, "\n") {
+		if _, err := sanitizeBridgeLine(l); err != nil {
+			errs = append(errs, &BridgeLineError{Line: i, Reason: err.Error()})
 		}
-		return nil, err
 	}
-
-	return l, nil
+	return errs
 }
 
-// ValidateBridgeLines validates and sanitizes bridge lines.
+// ValidateBridgeLines validates and sanitizes bridge lines.  On failure, the
+// bridge lines are returned unaltered along with the first error, so that
+// the caller never has to discard the user's input.
 func ValidateBridgeLines(ls string) (string, error) {
 	var ret []string
 
 	for _, l := range strings.Split(ls, "\n") {
-		l = strings.TrimSpace(l)
-		if len(l) == 0 {
-			continue
-		}
-		sp := strings.Split(l, " ")
-		if len(sp) == 0 {
-			continue
+		sl, err := sanitizeBridgeLine(l)
+		if err != nil {
+			return ls, fmt.Errorf("invalid Bridge: '%v', %v", strings.TrimSpace(l), err)
+		} else if sl != "" {
+			ret = append(ret, sl)
 		}
-		if strings.ToLower(sp[0]) == "bridge" { // Assume well formed...
-			ret = append(ret, l)
-			continue
+	}
+
+	return strings.Join(ret, "\n"), nil
+}
+
+// sanitizeBridgeLine validates a single bridge line, and returns it in the
+// form tor expects, or "" if the line is blank.
+func sanitizeBridgeLine(l string) (string, error) {
+	sp := strings.Fields(l)
+	if len(sp) == 0 {
+		return "", nil
+	}
+
+	// BridgeDB entries lack the "Bridge".
+	hasKeyword := strings.ToLower(sp[0]) == "bridge"
+	if hasKeyword {
+		if sp = sp[1:]; len(sp) == 0 {
+			return "", fmt.Errorf("missing IP")
 		}
+	}
 
-		// XXX: This obliterates the user's changes if there's an error,
-		// which is probably likely somewhat obnoxious.
+	// Validate that there is at least either:
+	addrIdx := 0
+	if !isBridgeAddr(sp[0]) { // A transport and host:port.
+		// Bridge lines that were explicitly specified as such may use
+		// transports that are not built in.
+		if !hasKeyword && Bridges[sp[0]] == nil {
+			return "", fmt.Errorf("unknown transport: %v", sp[0])
+		}
+		if len(sp) < 2 {
+			return "", fmt.Errorf("missing IP")
+		}
+		addrIdx = 1
+	}
+	if err := validateBridgeAddr(sp[addrIdx]); err != nil { // Or a host:port.
+		return "", err
+	}
 
-		// Validate that there is at least either:
-		if ip, _, err := net.SplitHostPort(sp[0]); err != nil {
-			if net.ParseIP(sp[0]) != nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', missing port", l)
-			}
-			if Bridges[sp[0]] == nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', unknown transport: %v", l, sp[0])
-			}
-			if len(sp) < 2 {
-				return "", fmt.Errorf("invalid Bridge: '%v', missing IP", l)
+	// Followed by the optional fingerprint, and for transports, `k=v`
+	// arguments.  Like tor, a vanilla bridge's fingerprint may be split
+	// into space separated groups.
+	args := sp[addrIdx+1:]
+	if addrIdx == 0 {
+		if len(args) > 0 && !isFingerprint(strings.Join(args, "")) {
+			return "", fmt.Errorf("bad fingerprint: %v", strings.Join(args, " "))
+		}
+	} else {
+		if len(args) > 0 && !strings.Contains(args[0], "=") {
+			if !isFingerprint(args[0]) {
+				return "", fmt.Errorf("bad fingerprint: %v", args[0])
 			}
-			if ip, _, err = net.SplitHostPort(sp[1]); err != nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', bad IP/port", l)
-			} else if net.ParseIP(ip) == nil {
-				return "", fmt.Errorf("invalid Bridge: '%v'", l)
+			args = args[1:]
+		}
+		for _, v := range args {
+			if strings.IndexByte(v, '=') <= 0 {
+				return "", fmt.Errorf("bad transport argument: %v", v)
 			}
-		} else if net.ParseIP(ip) == nil { // Or a host:port.
-			return "", fmt.Errorf("invalid Bridge IP/port: %v", sp[0])
 		}
+	}
+
+	return "Bridge " + strings.Join(sp, " "), nil
+}
 
-		// BridgeDB entries lack the "Bridge".
-		ret = append(ret, "Bridge "+l)
+// isFingerprint returns true iff s is a hex encoded relay identity
+// fingerprint.
+func isFingerprint(s string) bool {
+	if len(s) != 40 {
+		return false
 	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
 
-	return strings.Join(ret, "\n"), nil
+// isBridgeAddr returns true if the bridge line field looks like an address
+// rather than a transport name.
+func isBridgeAddr(s string) bool {
+	return strings.HasPrefix(s, "[") || strings.Contains(s, ":") || strings.Contains(s, ".")
+}
+
+// validateBridgeAddr validates a bridge `address:port`.  IPv6 addresses must
+// be bracketed, and can not have a zone ID, since tor does not support them.
+func validateBridgeAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+			if ip.To4() == nil {
+				return fmt.Errorf("IPv6 addresses must be bracketed, with a port")
+			}
+			return fmt.Errorf("missing port")
+		}
+		return fmt.Errorf("bad IP/port")
+	}
+	if strings.Contains(host, "%") {
+		return fmt.Errorf("IPv6 zone IDs are not supported")
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("bad IP: %v", host)
+	}
+	if v, err := strconv.ParseUint(port, 10, 16); err != nil || v == 0 {
+		return fmt.Errorf("bad port: %v", port)
+	}
+	return nil
 }
 
 func newGrabClient(dialFn dialFunc, dialTLSFn dialFunc) *grab.Client {
@@ -436,14 +919,22 @@ func newGrabClient(dialFn dialFunc, dialTLSFn dialFunc) *grab.Client {
 	return client
 }
 
-func newHPKPGrabClient(dialFn dialFunc) *grab.Client {
+func newHPKPGrabClient(cfg *config.Config, dialFn dialFunc) (*grab.Client, error) {
+	pins, err := installer.HPKPPins(cfg)
+	if err != nil {
+		return nil, err
+	}
 	dialConf := &hpkp.DialerConfig{
-		Storage:   installer.StaticHPKPPins,
+		Storage:   pins,
 		PinOnly:   false,
 		TLSConfig: nil,
 		Dial:      dialFn,
 	}
-	return newGrabClient(dialFn, dialConf.NewDialer())
+	mirrorDialFn, mirrorDialTLSFn, err := installer.MirrorDialers(cfg, dialFn, dialConf.NewDialer())
+	if err != nil {
+		return nil, err
+	}
+	return newGrabClient(mirrorDialFn, mirrorDialTLSFn), nil
 }
 
 func init() {
@@ -0,0 +1,121 @@
+// ui_test.go - Bridge line validation tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import "testing"
+
+const (
+	testFingerprint = "8FB9F4319E89E5C6223052AA525A192AFBC85D55"
+	testCert        = "cert=GGGS1TX4R81m3r0HBl79wKy1OtPPNR2CZUIrHjkRg65Vc2VR8fOyo64f9kmT1UAFG7j0HQ"
+)
+
+func TestValidateBridgeLines(t *testing.T) {
+	for _, v := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "", want: ""},
+		{in: "\n  \n", want: ""},
+		{in: "83.212.101.3:80", want: "Bridge 83.212.101.3:80"},
+		{in: "83.212.101.3:80 " + testFingerprint, want: "Bridge 83.212.101.3:80 " + testFingerprint},
+		{in: "Bridge 83.212.101.3:80 8FB9 F431 9E89 E5C6 2230 52AA 525A 192A FBC8 5D55", want: "Bridge 83.212.101.3:80 8FB9 F431 9E89 E5C6 2230 52AA 525A 192A FBC8 5D55"},
+		{in: "  obfs4 154.35.22.10:15937 " + testFingerprint + " " + testCert + " iat-mode=0  ", want: "Bridge obfs4 154.35.22.10:15937 " + testFingerprint + " " + testCert + " iat-mode=0"},
+		{in: "obfs4 154.35.22.10:15937 " + testCert, want: "Bridge obfs4 154.35.22.10:15937 " + testCert},
+		{in: "obfs4 [2001:db8::1]:443 " + testFingerprint + " " + testCert + " iat-mode=1", want: "Bridge obfs4 [2001:db8::1]:443 " + testFingerprint + " " + testCert + " iat-mode=1"},
+		{in: "[2001:db8::1]:9001", want: "Bridge [2001:db8::1]:9001"},
+		{in: "bridge exampletransport 192.0.2.1:1", want: "Bridge exampletransport 192.0.2.1:1"},
+		{in: "192.0.2.1:443\n\nobfs4 192.0.2.2:80 " + testFingerprint + "\n", want: "Bridge 192.0.2.1:443\nBridge obfs4 192.0.2.2:80 " + testFingerprint},
+
+		{in: "Bridge", wantErr: true},
+		{in: "obfs4", wantErr: true},
+		{in: "exampletransport 192.0.2.1:1", wantErr: true}, // Not built in.
+		{in: "obfs4 192.0.2.1", wantErr: true},
+		{in: "192.0.2.1", wantErr: true},
+		{in: "192.0.2.1:0", wantErr: true},
+		{in: "192.0.2.1:65536", wantErr: true},
+		{in: "192.0.2.1:http", wantErr: true},
+		{in: "256.0.2.1:443", wantErr: true},
+		{in: "bridge.example.com:443", wantErr: true},
+		{in: "2001:db8::1", wantErr: true},
+		{in: "2001:db8::1:443", wantErr: true},
+		{in: "[2001:db8::1]", wantErr: true},
+		{in: "[2001:db8::1%eth0]:443", wantErr: true},
+		{in: "[192.0.2.1]:443x", wantErr: true},
+		{in: "192.0.2.1:443 " + testFingerprint[:39], wantErr: true},
+		{in: "192.0.2.1:443 " + testFingerprint + "00", wantErr: true},
+		{in: "192.0.2.1:443 " + testFingerprint[:39] + "G", wantErr: true},
+		{in: "192.0.2.1:443 $" + testFingerprint, wantErr: true},
+		{in: "obfs4 192.0.2.1:443 ABCD " + testCert, wantErr: true},
+		{in: "obfs4 192.0.2.1:443 " + testFingerprint + " iat-mode", wantErr: true},
+		{in: "obfs4 192.0.2.1:443 " + testFingerprint + " =0", wantErr: true},
+		{in: "192.0.2.1:443\nobfs4", wantErr: true},
+	} {
+		got, err := ValidateBridgeLines(v.in)
+		switch {
+		case v.wantErr && err == nil:
+			t.Errorf("ValidateBridgeLines(%q): got %q, want error", v.in, got)
+		case !v.wantErr && err != nil:
+			t.Errorf("ValidateBridgeLines(%q): %v", v.in, err)
+		case !v.wantErr && got != v.want:
+			t.Errorf("ValidateBridgeLines(%q): got %q, want %q", v.in, got, v.want)
+		}
+	}
+}
+
+func TestValidateBuiltinBridges(t *testing.T) {
+	// The built in bridges are real BridgeDB lines.
+	for transport, bridges := range Bridges {
+		for _, l := range bridges {
+			if got, err := ValidateBridgeLines(l); err != nil {
+				t.Errorf("%v: ValidateBridgeLines(%q): %v", transport, l, err)
+			} else if got != l {
+				t.Errorf("%v: ValidateBridgeLines(%q): got %q", transport, l, got)
+			}
+		}
+	}
+}
+
+func TestValidateBridgeAddr(t *testing.T) {
+	for _, v := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"192.0.2.1:1", true},
+		{"192.0.2.1:65535", true},
+		{"[2001:db8::1]:443", true},
+		{"[::ffff:192.0.2.1]:443", true},
+		{"[::1]:9001", true},
+		{"192.0.2.1", false},
+		{"192.0.2.1:", false},
+		{"192.0.2.1:-1", false},
+		{"192.0.2.1:0", false},
+		{"192.0.2.1:65536", false},
+		{"192.0.2.1:443:1", false},
+		{":443", false},
+		{"example.com:443", false},
+		{"2001:db8::1", false},
+		{"[2001:db8::1]", false},
+		{"[2001:db8::1]:", false},
+		{"[fe80::1%eth0]:443", false},
+		{"[fe80::1%25eth0]:443", false},
+		{"[2001:db8::g]:443", false},
+	} {
+		if err := validateBridgeAddr(v.addr); (err == nil) != v.ok {
+			t.Errorf("validateBridgeAddr(%v): %v, want ok: %v", v.addr, err, v.ok)
+		}
+	}
+}
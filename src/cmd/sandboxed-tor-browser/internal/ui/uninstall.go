@@ -0,0 +1,265 @@
+// uninstall.go - Uninstallation routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xdg "github.com/cep21/xdgbasedir"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// desktopEntryGlob matches the desktop entries for `sandboxed-tor-browser`,
+// under the `applications` and `autostart` directories.
+const desktopEntryGlob = "sandboxed-tor-browser*.desktop"
+
+// UninstallItem is a path that is removed when uninstalling.
+type UninstallItem struct {
+	// Path is the file or directory.
+	Path string
+
+	// Description describes what is at Path.
+	Description string
+
+	// ContentOnly is set if only the contents of the directory at Path are
+	// removed, and not the directory itself.
+	ContentOnly bool
+}
+
+func (i *UninstallItem) String() string {
+	return fmt.Sprintf("%s: `%s`", i.Description, i.Path)
+}
+
+// UninstallPlan is the set of paths that uninstalling removes, and keeps.
+type UninstallPlan struct {
+	// Remove is the list of paths to remove.
+	Remove []*UninstallItem
+
+	// Keep is the list of paths under Remove that are kept.
+	Keep []string
+
+	// HostDirs is the list of host Downloads or Desktop directories that
+	// were configured by the user, the content of which is never removed.
+	HostDirs []string
+}
+
+// HasUserFiles returns true iff the plan removes the content of the
+// Downloads or Desktop directories.
+func (p *UninstallPlan) HasUserFiles() bool {
+	for _, v := range p.Remove {
+		if v.ContentOnly {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UninstallPlan) isHostDir(dir string) bool {
+	for _, v := range p.HostDirs {
+		if v == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UninstallPlan) String() string {
+	var lines []string
+	for _, v := range p.Remove {
+		lines = append(lines, v.String())
+	}
+	for _, v := range p.Keep {
+		if !p.isHostDir(v) {
+			lines = append(lines, fmt.Sprintf("Kept: `%s`", v))
+		}
+	}
+	for _, v := range p.HostDirs {
+		lines = append(lines, fmt.Sprintf("Kept, host directory: `%s`", v))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PlanUninstall returns what uninstalling removes.  The content of the
+// Downloads and Desktop directories inside the bundle is only removed if
+// userFiles is set, and otherwise kept.  The content of host directories
+// set via the config is never removed, since they can be the user's real
+// `~/Downloads` and `~/Desktop`.
+func (c *Common) PlanUninstall(userFiles bool) *UninstallPlan {
+	p := new(UninstallPlan)
+	add := func(path, desc string, contentOnly bool) {
+		if _, err := os.Lstat(path); err == nil {
+			p.Remove = append(p.Remove, &UninstallItem{path, desc, contentOnly})
+		}
+	}
+
+	add(c.Cfg.BundleInstallDir, "Tor Browser", false)
+	add(c.Cfg.TorDataDir, "Tor state", false)
+	add(c.Cfg.BrowserCacheDir, "Disk cache", false)
+	add(c.Cfg.UserDataDir, "Other data, including profile backups", false)
+	add(c.Cfg.RuntimeDir, "Runtime sockets", false)
+	add(c.Cfg.ConfigDir, "Config", false)
+	for _, v := range desktopEntries() {
+		add(v, "Desktop entry", false)
+	}
+
+	for _, v := range []struct {
+		dir, desc string
+		isHost    bool
+	}{
+		{c.Cfg.HostDownloadsDir(), "Downloads content", c.Cfg.Sandbox.DownloadsDir != ""},
+		{c.Cfg.HostDesktopDir(), "Desktop content", c.Cfg.Sandbox.DesktopDir != ""},
+	} {
+		if v.isHost {
+			// Never touched, even if under something that is removed.
+			if utils.DirExists(v.dir) {
+				p.HostDirs = append(p.HostDirs, v.dir)
+				p.keepIfWithinRemoved(v.dir)
+			}
+			continue
+		}
+		if isEmptyDir(v.dir) {
+			continue
+		}
+		switch {
+		case userFiles:
+			add(v.dir, v.desc, true)
+		default:
+			p.keepIfWithinRemoved(v.dir)
+		}
+	}
+	return p
+}
+
+// keepIfWithinRemoved adds dir to Keep iff it is under a path in Remove.
+func (p *UninstallPlan) keepIfWithinRemoved(dir string) {
+	for _, r := range p.Remove {
+		if isWithin(dir, r.Path) {
+			p.Keep = append(p.Keep, dir)
+			return
+		}
+	}
+}
+
+// Uninstall removes everything in the plan.  Tor Browser must not be
+// running.
+func (c *Common) Uninstall(p *UninstallPlan) error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("failed to uninstall, Tor Browser is running")
+	}
+	if c.tor != nil {
+		c.tor.Shutdown()
+		c.tor = nil
+	}
+
+	// The config directory is about to go away, so don't write it back out
+	// on exit.
+	c.Cfg.ResetDirty()
+
+	for _, v := range p.Remove {
+		log.Printf("ui: Uninstall: removing %v", v)
+		var err error
+		if v.ContentOnly {
+			err = removeContents(v.Path)
+		} else {
+			err = removeAllExcept(v.Path, p.Keep)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAllExcept is os.RemoveAll, that leaves the paths in keep (and their
+// parent directories) alone.
+func removeAllExcept(path string, keep []string) error {
+	holdsKept := false
+	for _, v := range keep {
+		if v == path {
+			return nil
+		}
+		holdsKept = holdsKept || isWithin(v, path)
+	}
+	if !holdsKept {
+		err := os.RemoveAll(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err = removeAllExcept(filepath.Join(path, fi.Name()), keep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeContents(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil // Removed with the bundle.
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err = os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isWithin returns true iff path is dir, or is under dir.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+func isEmptyDir(dir string) bool {
+	fis, err := ioutil.ReadDir(dir)
+	return err != nil || len(fis) == 0
+}
+
+func desktopEntries() []string {
+	var dirs []string
+	if d, err := xdg.DataHomeDirectory(); err == nil {
+		dirs = append(dirs, filepath.Join(d, "applications"))
+	}
+	if d, err := xdg.ConfigHomeDirectory(); err == nil {
+		dirs = append(dirs, filepath.Join(d, "autostart"))
+	}
+
+	var entries []string
+	for _, d := range dirs {
+		if matches, err := filepath.Glob(filepath.Join(d, desktopEntryGlob)); err == nil {
+			entries = append(entries, matches...)
+		}
+	}
+	return entries
+}
@@ -20,46 +20,49 @@ import (
 	"bytes"
 	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"cmd/sandboxed-tor-browser/internal/installer"
 	"cmd/sandboxed-tor-browser/internal/sandbox"
-	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
 // CheckUpdate queries the update server to see if an update for the current
-// bundle is available.
+// bundle is available.  nil is returned if MAR updates are disabled.
 func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
-	//Disable Updating until we work on the new .mar updates
-	return nil
+	if !c.Cfg.EnableMARUpdates {
+		return nil
+	}
 
-	
 	// Check for updates.
 	log.Printf("update: Checking for updates.")
 	async.UpdateProgress("Checking for updates.")
 
 	// Create the async HTTP client.
-	if c.tor == nil {
-		async.Err = tor.ErrTorNotRunning
-		return nil
-	}
-	dialFn, err := c.getTorDialFunc()
+	f, err := c.newFetcher(false)
 	if err != nil {
 		async.Err = err
 		return nil
 	}
 
-	client := newHPKPGrabClient(dialFn)
-
 	// Determine where the update metadata should be fetched from.
 	updateURLs := []string{}
 	for _, b := range []bool{true, false} { // Prioritize .onions.
-		if url, err := installer.UpdateURL(c.Manif, b); err != nil {
+		if url, err := installer.UpdateURL(c.Cfg, c.Manif, b); err != nil {
 			log.Printf("update: Failed to get update URL (onion: %v): %v", b, err)
-		} else {
+		} else if len(updateURLs) == 0 || updateURLs[0] != url {
+			// A mirror has no separate .onion URL.
 			updateURLs = append(updateURLs, url)
 		}
 	}
@@ -75,7 +78,7 @@ func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 	for _, url := range updateURLs {
 		log.Printf("update: Metadata URL: %v", url)
 		async.Err = nil // Clear errors per fetch.
-		if b := async.Grab(client, url, nil); async.Err == ErrCanceled {
+		if b := f.grab(async, url, nil); async.Err == ErrCanceled {
 			return nil
 		} else if async.Err != nil {
 			log.Printf("update: Metadata download failed: %v", async.Err)
@@ -108,6 +111,7 @@ func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 	} else {
 		log.Printf("update: Installed bundle needs updating.")
 		c.Cfg.SetForceUpdate(true)
+		c.emitEvent(evUpdate, map[string]string{"state": "available", "version": update.DisplayVersion})
 	}
 	c.Cfg.SetLastUpdateCheck(checkAt)
 
@@ -119,80 +123,344 @@ func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 	return update
 }
 
-// FetchUpdate downloads the update specified by the patch over tor, and
-// validates it with the hash in the patch datastructure, and the known MAR
-// signing keys.
-func (c *Common) FetchUpdate(async *Async, patch *installer.Patch) []byte {
+// marDownloadDir is the directory, relative to the user data directory,
+// that MARs are downloaded to.  Anything in it is either a download in
+// progress, or a verified MAR that has yet to be applied.
+const marDownloadDir = "mar"
+
+// stagedUpdateFile is the file in the MAR download directory that records
+// the update being staged, so that an interrupted download or a staged MAR
+// survives launcher restarts.
+const stagedUpdateFile = "staged.json"
+
+const (
+	patchPartial  = "partial"
+	patchComplete = "complete"
+)
+
+type stagedUpdate struct {
+	Update    *installer.UpdateEntry `json:"update"`
+	PatchType string                 `json:"patchType"`
+	MarName   string                 `json:"marName"`
+	Verified  bool                   `json:"verified"`
+}
+
+func (c *Common) stagedUpdatePath() string {
+	return filepath.Join(c.Cfg.UserDataDir, marDownloadDir, stagedUpdateFile)
+}
+
+// loadStagedUpdate returns the persisted staging state, if any, discarding
+// it if it is unparsable, or no longer an update for the installed bundle.
+func (c *Common) loadStagedUpdate() *stagedUpdate {
+	b, err := ioutil.ReadFile(c.stagedUpdatePath())
+	if err != nil {
+		return nil
+	}
+	st := new(stagedUpdate)
+	if err = json.Unmarshal(b, st); err != nil || st.Update == nil {
+		log.Printf("update: Discarding invalid staged update state.")
+		os.Remove(c.stagedUpdatePath())
+		return nil
+	}
+	if c.Manif == nil || !c.Manif.BundleUpdateVersionValid(st.Update.AppVersion) {
+		log.Printf("update: Discarding stale staged update: '%v'", st.Update.AppVersion)
+		os.Remove(c.stagedUpdatePath())
+		return nil
+	}
+	return st
+}
+
+func (c *Common) saveStagedUpdate(st *stagedUpdate) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.stagedUpdatePath(), b, FileMode)
+}
+
+// StagedUpdate returns the update that is staged or partially staged from
+// a previous run, if any.
+func (c *Common) StagedUpdate() *installer.UpdateEntry {
+	if st := c.loadStagedUpdate(); st != nil {
+		return st.Update
+	}
+	return nil
+}
+
+// UpdateStaged returns true iff a verified MAR for the update is present,
+// and the update can be applied without downloading anything.
+func (c *Common) UpdateStaged(update *installer.UpdateEntry) bool {
+	st := c.loadStagedUpdate()
+	return st != nil && st.Verified && update != nil && st.Update.AppVersion == update.AppVersion
+}
+
+// updateIdleTime is how long the browser must be without user input before
+// updates are staged during the maintenance window.
+const updateIdleTime = 10 * time.Minute
+
+// UpdateWindowOpen returns true iff updates found by the background update
+// check may be staged now, as in, either no maintenance window is
+// configured, or the window is open and the browser is idle.  If the X11
+// surrogate isn't in use, input can not be monitored, and only the window
+// is considered.
+func (c *Common) UpdateWindowOpen() bool {
+	now := time.Now()
+	if c.Cfg.UpdateWindow == "" {
+		return true
+	} else if !c.Cfg.InUpdateWindow(now) {
+		return false
+	}
+	if t := x11.LastInput(); !t.IsZero() && now.Sub(t) < updateIdleTime {
+		Debugf("update: Browser is not idle, last input: %v", t)
+		return false
+	}
+	return true
+}
+
+// StageUpdate downloads and verifies the best MAR for the update, without
+// applying it, so that the update can be done in the background while Tor
+// Browser is running, and the restart to apply it is near-instant.
+func (c *Common) StageUpdate(async *Async, update *installer.UpdateEntry) {
+	patches, err := c.updatePatches(update)
+	if err != nil {
+		async.Err = err
+		return
+	}
+
+	for _, patch := range patches {
+		async.Err = nil
+		if c.FetchUpdate(async, update, patch); async.Err == nil {
+			log.Printf("update: Staged %v update to %v.", patch.Type, update.DisplayVersion)
+			c.emitEvent(evUpdate, map[string]string{"state": "staged", "version": update.DisplayVersion})
+			return
+		} else if async.Err == ErrCanceled {
+			return
+		}
+		log.Printf("update: Failed to stage %v update: %v", patch.Type, async.Err)
+	}
+	if async.Err == nil {
+		async.Err = fmt.Errorf("no suitable MAR file found")
+	}
+}
+
+// updatePatches returns the update's patches, in the order they should be
+// tried.
+func (c *Common) updatePatches(update *installer.UpdateEntry) ([]*installer.Patch, error) {
+	byType := make(map[string]*installer.Patch)
+	for i := 0; i < len(update.Patch); i++ {
+		v := &update.Patch[i]
+		if byType[v.Type] != nil {
+			return nil, fmt.Errorf("duplicate patch entry for kind: '%v'", v.Type)
+		}
+		byType[v.Type] = v
+	}
+
+	patchTypes := []string{}
+	if !c.Cfg.SkipPartialUpdate {
+		patchTypes = append(patchTypes, patchPartial)
+	}
+	patchTypes = append(patchTypes, patchComplete)
+
+	var patches []*installer.Patch
+	for _, patchType := range patchTypes {
+		if patch := byType[patchType]; patch != nil {
+			patches = append(patches, patch)
+		}
+	}
+	return patches, nil
+}
+
+// FetchUpdate downloads the update specified by the patch over tor to the
+// user data directory, and validates it with the hash in the patch
+// datastructure, and the known MAR signing keys.  The path to the MAR is
+// returned.  A previous partial download of the same MAR will be resumed,
+// and a MAR that was already staged will not be downloaded again.
+func (c *Common) FetchUpdate(async *Async, update *installer.UpdateEntry, patch *installer.Patch) string {
+	// Skip everything if the MAR is already staged.
+	if marPath, ok := c.stagedMAR(update, patch); ok {
+		return marPath
+	}
+
 	// Launch the tor daemon if needed.
 	if c.tor == nil {
 		async.Err = c.launchTor(async, false)
 		if async.Err != nil {
-			return nil
+			return ""
 		}
 	}
-	dialFn, err := c.getTorDialFunc()
+	f, err := c.newFetcher(false)
 	if err != nil {
 		async.Err = err
-		return nil
+		return ""
+	}
+
+	if patch.HashFunction != "SHA512" {
+		async.Err = fmt.Errorf("unsupported hash function: '%v'", patch.HashFunction)
+		return ""
+	}
+	expectedHash, err := hex.DecodeString(patch.HashValue)
+	if err != nil || len(expectedHash) != sha512.Size {
+		async.Err = fmt.Errorf("failed to decode HashValue: %v", err)
+		return ""
+	}
+	if patch.Size <= 0 {
+		async.Err = fmt.Errorf("invalid patch size: %v", patch.Size)
+		return ""
+	}
+
+	// The file name is derived from the hash, so that only a partial
+	// download of the same MAR is ever resumed.
+	dir := filepath.Join(c.Cfg.UserDataDir, marDownloadDir)
+	if async.Err = os.MkdirAll(dir, DirMode); async.Err != nil {
+		return ""
+	}
+	marName := hex.EncodeToString(expectedHash[:16]) + ".mar"
+	marPath := filepath.Join(dir, marName)
+	cleanMarDownloadDir(dir, marName)
+
+	// Record what is being staged before downloading, so that an
+	// interrupted download is resumed after a restart.
+	st := &stagedUpdate{Update: update, PatchType: patch.Type, MarName: marName}
+	if async.Err = c.saveStagedUpdate(st); async.Err != nil {
+		return ""
 	}
 
 	// Download the MAR file.
-	log.Printf("update: Downloading %v", patch.Url)
+	if fi, err := os.Stat(marPath); err == nil {
+		log.Printf("update: Resuming download of %v (%v bytes present)", patch.Url, fi.Size())
+	} else {
+		log.Printf("update: Downloading %v", patch.Url)
+	}
 	async.UpdateProgress("Downloading Tor Browser Update.")
 
-	var mar []byte
-	client := newHPKPGrabClient(dialFn)
-	if mar = async.Grab(client, patch.Url, func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser Update: %s", s)) }); async.Err != nil {
-		return nil
+	// The partial download is kept around so that it can be resumed,
+	// unless it's clearly garbage.
+	if f.grabFile(async, patch.Url, marPath, uint64(patch.Size), func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser Update: %s", s)) }); async.Err != nil {
+		return ""
 	}
 
 	log.Printf("update: Validating Tor Browser Update.")
 	async.UpdateProgress("Validating Tor Browser Update.")
 
-	// Validate the size against that listed in the XML file.
-	if len(mar) != patch.Size {
-		async.Err = fmt.Errorf("downloaded patch size does not match patch metadata")
-		return nil
+	if async.Err = verifyMARFile(c.Cfg, marPath, int64(patch.Size), expectedHash); async.Err != nil {
+		os.Remove(marPath)
+		return ""
+	}
+
+	st.Verified = true
+	if async.Err = c.saveStagedUpdate(st); async.Err != nil {
+		return ""
 	}
 
-	// Validate the hash against that listed in the XML file.
+	return marPath
+}
+
+// stagedMAR returns the path to the staged MAR for the patch, and true iff
+// it was previously verified, and still passes verification.
+func (c *Common) stagedMAR(update *installer.UpdateEntry, patch *installer.Patch) (string, bool) {
+	st := c.loadStagedUpdate()
+	if st == nil || !st.Verified || st.PatchType != patch.Type || st.Update.AppVersion != update.AppVersion {
+		return "", false
+	}
 	expectedHash, err := hex.DecodeString(patch.HashValue)
+	if err != nil || len(expectedHash) != sha512.Size || st.MarName != hex.EncodeToString(expectedHash[:16])+".mar" {
+		return "", false
+	}
+
+	// Re-verify, the file could have been tampered with since.
+	marPath := filepath.Join(c.Cfg.UserDataDir, marDownloadDir, st.MarName)
+	if err = verifyMARFile(c.Cfg, marPath, int64(patch.Size), expectedHash); err != nil {
+		log.Printf("update: Staged MAR failed verification: %v", err)
+		os.Remove(marPath)
+		return "", false
+	}
+	log.Printf("update: Using staged %v update to %v.", patch.Type, update.DisplayVersion)
+	return marPath, true
+}
+
+// verifyMARFile validates the size and hash against those listed in the XML
+// file, the signature block in the MAR with our copy of the key, and that
+// the MAR is for a channel the bundle will accept.
+func verifyMARFile(cfg *config.Config, marPath string, size int64, expectedHash []byte) error {
+	f, err := os.Open(marPath)
 	if err != nil {
-		async.Err = fmt.Errorf("failed to decode HashValue: %v", err)
-		return nil
+		return err
 	}
-	switch patch.HashFunction {
-	case "SHA512":
-		derivedHash := sha512.Sum512(mar)
-		if !bytes.Equal(expectedHash, derivedHash[:]) {
-			async.Err = fmt.Errorf("downloaded hash does not match patch metadata")
-			return nil
-		}
-	default:
-		async.Err = fmt.Errorf("unsupported hash function: '%v'", patch.HashFunction)
-		return nil
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("downloaded patch size does not match patch metadata")
 	}
 
-	// ... and verify the signature block in the MAR with our copy of the key.
-	if async.Err = installer.VerifyTorBrowserMAR(mar); async.Err != nil {
-		return nil
+	h := sha512.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(expectedHash, h.Sum(nil)) {
+		return fmt.Errorf("downloaded hash does not match patch metadata")
+	}
+
+	// The signature verification needs the entire MAR, so map it instead
+	// of reading it all into memory.
+	mar, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return fmt.Errorf("failed to map MAR: %v", err)
 	}
+	defer syscall.Munmap(mar)
 
-	return mar
+	if err = installer.VerifyTorBrowserMAR(mar); err != nil {
+		return err
+	}
+	return installer.VerifyMARChannel(cfg, mar)
+}
+
+// cleanMarDownloadDir removes any stale downloads, other than the one being
+// fetched, and the staging state.
+func cleanMarDownloadDir(dir, keep string) {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, ent := range ents {
+		if ent.Name() != keep && ent.Name() != stagedUpdateFile {
+			log.Printf("update: Removing stale download: %v", ent.Name())
+			os.RemoveAll(filepath.Join(dir, ent.Name()))
+		}
+	}
+}
+
+// recoverUpdate cleans up after an interrupted update, forcing a complete
+// update if the bundle may have been left in an inconsistent state.
+func (c *Common) recoverUpdate() error {
+	interrupted, err := sandbox.RecoverUpdate(c.Cfg)
+	if err != nil {
+		return err
+	}
+	if interrupted {
+		log.Printf("update: Previous update was interrupted, a complete update is required.")
+		c.Cfg.SetForceUpdate(true)
+		c.Cfg.SetSkipPartialUpdate(true)
+		return c.Cfg.Sync()
+	}
+	return nil
 }
 
 func (c *Common) doUpdate(async *Async) {
 	// This attempts to follow the process that Firefox uses to check for
 	// updates.  https://wiki.mozilla.org/Software_Update:Checking_For_Updates
 
-	const (
-		patchPartial  = "partial"
-		patchComplete = "complete"
-	)
-
-	// Check for updates, unless we have sufficiently fresh metatdata already.
+	// Resume a staged update if there is one, otherwise check for updates,
+	// unless we have sufficiently fresh metatdata already.
 	var update *installer.UpdateEntry
-	if c.PendingUpdate != nil && !c.Cfg.NeedsUpdateCheck() {
+	if staged := c.StagedUpdate(); staged != nil && (c.PendingUpdate == nil || c.PendingUpdate.AppVersion == staged.AppVersion) {
+		log.Printf("update: Resuming staged update to %v.", staged.DisplayVersion)
+		update = staged
+		c.PendingUpdate = nil
+	} else if c.PendingUpdate != nil && !c.Cfg.NeedsUpdateCheck() {
 		update = c.PendingUpdate
 		c.PendingUpdate = nil
 	} else {
@@ -207,46 +475,33 @@ func (c *Common) doUpdate(async *Async) {
 	}
 
 	// Figure out the best MAR to download.
-	patches := make(map[string]*installer.Patch)
-	for i := 0; i < len(update.Patch); i++ {
-		v := &update.Patch[i]
-		if patches[v.Type] != nil {
-			async.Err = fmt.Errorf("duplicate patch entry for kind: '%v'", v.Type)
-			return
-		}
-		patches[v.Type] = v
-	}
-
-	patchTypes := []string{}
-	if !c.Cfg.SkipPartialUpdate {
-		patchTypes = append(patchTypes, patchPartial)
+	patches, err := c.updatePatches(update)
+	if err != nil {
+		async.Err = err
+		return
 	}
-	patchTypes = append(patchTypes, patchComplete)
 
 	// Cycle through the patch types, and apply the "best" one.
 	nrAttempts := 0
-	for _, patchType := range patchTypes {
+	for _, patch := range patches {
 		async.Err = nil
 
-		patch := patches[patchType]
-		if patch == nil {
-			continue
-		}
-
 		nrAttempts++
-		mar := c.FetchUpdate(async, patch)
+		marPath := c.FetchUpdate(async, update, patch)
 		if async.Err == ErrCanceled {
 			return
 		} else if async.Err != nil {
 			log.Printf("update: Failed to fetch update: %v", async.Err)
 			continue
 		}
-		if mar == nil {
+		if marPath == "" {
 			panic("update: no MAR returned from successful fetch")
 		}
 
-		// Shutdown the old tor now.
-		if c.tor != nil {
+		// Shutdown the old tor now, unless it should be kept running, in
+		// which case the updated tor will be used the next time tor is
+		// launched.
+		if c.tor != nil && !c.Cfg.Tor.KeepRunning {
 			log.Printf("update: Shutting down old tor.")
 			c.tor.Shutdown()
 			c.tor = nil
@@ -258,9 +513,10 @@ func (c *Common) doUpdate(async *Async) {
 
 		async.ToUI <- false //  Lock out canceling.
 
-		if async.Err = sandbox.RunUpdate(c.Cfg, mar); async.Err != nil {
+		if async.Err = sandbox.RunUpdate(c.Cfg, marPath, func(s string) { async.UpdateProgress(fmt.Sprintf("Updating Tor Browser: %s", s)) }); async.Err != nil {
 			log.Printf("update: Failed to apply update: %v", async.Err)
-			if patchType == patchPartial {
+			c.emitEvent(evUpdate, map[string]string{"state": "failed", "version": update.DisplayVersion, "error": async.Err.Error()})
+			if patch.Type == patchPartial {
 				c.Cfg.SetSkipPartialUpdate(true)
 				if async.Err = c.Cfg.Sync(); async.Err != nil {
 					return
@@ -272,14 +528,18 @@ func (c *Common) doUpdate(async *Async) {
 
 		// Failures past this point are catastrophic in that, the on-disk
 		// bundle is up to date, but the post-update tasks have failed.
+		os.RemoveAll(filepath.Join(c.Cfg.UserDataDir, marDownloadDir))
 
 		// Reinstall the autoconfig stuff.
-		if async.Err = writeAutoconfig(c.Cfg); async.Err != nil {
+		if async.Err = writeAutoconfig(c.Cfg.BundleInstallDir); async.Err != nil {
 			return
 		}
 
 		// Update the maniftest and config.
 		c.Manif.SetVersion(update.AppVersion)
+		if async.Err = c.recordExtensions(c.Cfg.BundleInstallDir); async.Err != nil {
+			return
+		}
 		if async.Err = c.Manif.Sync(); async.Err != nil {
 			return
 		}
@@ -288,6 +548,7 @@ func (c *Common) doUpdate(async *Async) {
 		if async.Err = c.Cfg.Sync(); async.Err != nil {
 			return
 		}
+		c.emitEvent(evUpdate, map[string]string{"state": "applied", "version": update.DisplayVersion})
 
 		async.ToUI <- true // Unlock canceling.
 
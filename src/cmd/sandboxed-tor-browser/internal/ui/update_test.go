@@ -0,0 +1,231 @@
+// update_test.go - Update logic tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+func newUpdateTestCommon(t *testing.T) (*Common, func()) {
+	dir, err := ioutil.TempDir("", "update_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, marDownloadDir), 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	c := &Common{
+		Cfg:   &config.Config{UserDataDir: dir},
+		Manif: &config.Manifest{Version: "8.0.3", Channel: "release"},
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckUpdateEnabled(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	a := async.NewAsync()
+	checked := false
+	a.UpdateProgress = func(string) { checked = true }
+	if update := c.CheckUpdate(a); update != nil || a.Err != nil || checked {
+		t.Errorf("CheckUpdate: disabled updates were checked: %v, %v", update, a.Err)
+	}
+
+	// Without tor, the check fails at fetching the metadata, rather than
+	// being skipped.
+	c.Cfg.SetEnableMARUpdates(true)
+	if update := c.CheckUpdate(a); update != nil || a.Err != tor.ErrTorNotRunning || !checked {
+		t.Errorf("CheckUpdate: enabled updates were not checked: %v, %v", update, a.Err)
+	}
+}
+
+func TestStagedUpdate(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	if c.StagedUpdate() != nil {
+		t.Fatalf("StagedUpdate: staged update with no state")
+	}
+
+	update := &installer.UpdateEntry{AppVersion: "8.0.4", DisplayVersion: "8.0.4"}
+	st := &stagedUpdate{Update: update, PatchType: patchPartial, MarName: "partial.mar"}
+	if err := c.saveStagedUpdate(st); err != nil {
+		t.Fatalf("saveStagedUpdate: %v", err)
+	}
+	if got := c.StagedUpdate(); got == nil || got.AppVersion != "8.0.4" {
+		t.Errorf("StagedUpdate: %v, want 8.0.4", got)
+	}
+	if c.UpdateStaged(update) {
+		t.Errorf("UpdateStaged: unverified update is staged")
+	}
+	st.Verified = true
+	if err := c.saveStagedUpdate(st); err != nil {
+		t.Fatalf("saveStagedUpdate: %v", err)
+	}
+	if !c.UpdateStaged(update) {
+		t.Errorf("UpdateStaged: verified update is not staged")
+	}
+	if c.UpdateStaged(&installer.UpdateEntry{AppVersion: "8.0.5"}) {
+		t.Errorf("UpdateStaged: a different update is staged")
+	}
+
+	// Once the bundle is at (or past) the staged version, the state is
+	// discarded.
+	c.Manif.SetVersion("8.0.4")
+	if c.StagedUpdate() != nil {
+		t.Errorf("StagedUpdate: stale update was not discarded")
+	}
+	if _, err := os.Stat(c.stagedUpdatePath()); !os.IsNotExist(err) {
+		t.Errorf("StagedUpdate: stale state was not removed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(c.stagedUpdatePath(), []byte("{\"update\":"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile: %v", err)
+	}
+	if c.StagedUpdate() != nil {
+		t.Errorf("StagedUpdate: malformed state was not discarded")
+	}
+	if _, err := os.Stat(c.stagedUpdatePath()); !os.IsNotExist(err) {
+		t.Errorf("StagedUpdate: malformed state was not removed: %v", err)
+	}
+}
+
+func TestCleanMarDownloadDir(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	dir := filepath.Join(c.Cfg.UserDataDir, marDownloadDir)
+	for _, n := range []string{"keep.mar", "stale.mar", stagedUpdateFile} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), nil, 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "stale"), 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+
+	cleanMarDownloadDir(dir, "keep.mar")
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ioutil.ReadDir: %v", err)
+	}
+	var got []string
+	for _, ent := range ents {
+		got = append(got, ent.Name())
+	}
+	if len(got) != 2 || got[0] != "keep.mar" || got[1] != stagedUpdateFile {
+		t.Errorf("cleanMarDownloadDir: left %v", got)
+	}
+}
+
+func TestUpdatePatches(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	update := &installer.UpdateEntry{Patch: []installer.Patch{
+		{Type: patchComplete, Url: "complete"},
+		{Type: patchPartial, Url: "partial"},
+		{Type: "bogus", Url: "bogus"},
+	}}
+	patches, err := c.updatePatches(update)
+	if err != nil {
+		t.Fatalf("updatePatches: %v", err)
+	}
+	if len(patches) != 2 || patches[0].Url != "partial" || patches[1].Url != "complete" {
+		t.Errorf("updatePatches: %v, want partial, complete", patches)
+	}
+
+	c.Cfg.SetSkipPartialUpdate(true)
+	if patches, err = c.updatePatches(update); err != nil {
+		t.Fatalf("updatePatches: %v", err)
+	} else if len(patches) != 1 || patches[0].Url != "complete" {
+		t.Errorf("updatePatches: %v, want complete", patches)
+	}
+
+	update.Patch = append(update.Patch, installer.Patch{Type: patchComplete})
+	if _, err = c.updatePatches(update); err == nil {
+		t.Errorf("updatePatches: accepted duplicate patches")
+	}
+}
+
+func TestVerifyMARFile(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	mar := []byte("MAR1 not actually a MAR")
+	marPath := filepath.Join(c.Cfg.UserDataDir, marDownloadDir, "test.mar")
+	if err := ioutil.WriteFile(marPath, mar, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile: %v", err)
+	}
+	h := sha512.Sum512(mar)
+	badHash := sha512.Sum512(nil)
+
+	if err := verifyMARFile(c.Cfg, marPath, int64(len(mar))+1, h[:]); err == nil {
+		t.Errorf("verifyMARFile: accepted a size mismatch")
+	}
+	if err := verifyMARFile(c.Cfg, marPath, int64(len(mar)), badHash[:]); err == nil {
+		t.Errorf("verifyMARFile: accepted a hash mismatch")
+	}
+	if err := verifyMARFile(c.Cfg, marPath, int64(len(mar)), h[:]); err == nil {
+		t.Errorf("verifyMARFile: accepted an unsigned MAR")
+	}
+}
+
+func TestStageUpdateNoPatches(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	a := async.NewAsync()
+	c.StageUpdate(a, &installer.UpdateEntry{AppVersion: "8.0.4", Patch: []installer.Patch{{Type: "bogus"}}})
+	if a.Err == nil {
+		t.Errorf("StageUpdate: staged an update with no usable patches")
+	}
+	if c.StagedUpdate() != nil {
+		t.Errorf("StageUpdate: recorded an update with no usable patches")
+	}
+}
+
+func TestUpdateWindowOpen(t *testing.T) {
+	c, cleanup := newUpdateTestCommon(t)
+	defer cleanup()
+
+	if !c.UpdateWindowOpen() {
+		t.Errorf("UpdateWindowOpen: closed with no window")
+	}
+
+	now := time.Now()
+	clock := func(d time.Duration) string { return now.Add(d).Format("15:04") }
+	c.Cfg.SetUpdateWindow(clock(-time.Hour) + "-" + clock(time.Hour))
+	if !c.UpdateWindowOpen() {
+		t.Errorf("UpdateWindowOpen: closed during the window %v", c.Cfg.UpdateWindow)
+	}
+	c.Cfg.SetUpdateWindow(clock(time.Hour) + "-" + clock(2*time.Hour))
+	if c.UpdateWindowOpen() {
+		t.Errorf("UpdateWindowOpen: open outside the window %v", c.Cfg.UpdateWindow)
+	}
+}
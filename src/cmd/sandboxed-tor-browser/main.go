@@ -22,6 +22,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	sbui "cmd/sandboxed-tor-browser/internal/ui"
 	"cmd/sandboxed-tor-browser/internal/ui/gtk"
 )
 
@@ -32,9 +34,32 @@ func main() {
 		return
 	}
 
-	// Install the signal handlers before initializing the UI.
+	// The DNS leak and font self-tests re-execute the launcher inside a
+	// sandbox.
+	if len(os.Args) > 1 && os.Args[1] == sandbox.DNSProbeArg {
+		os.Exit(sandbox.RunDNSProbe(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == sandbox.FontProbeArg {
+		os.Exit(sandbox.RunFontProbe(os.Args[2:]))
+	}
+
+	// The install/update downloads are done by the launcher re-executed
+	// inside a sandbox as well.
+	if len(os.Args) > 1 && os.Args[1] == sandbox.FetchHelperArg {
+		os.Exit(sbui.RunFetchHelper(os.Args[2:]))
+	}
+
+	// As are the modifications to Tor Browser's databases, which use the
+	// bundled SQLite.
+	if len(os.Args) > 1 && os.Args[1] == sandbox.SQLiteHelperArg {
+		os.Exit(sbui.RunSQLiteHelper(os.Args[2:]))
+	}
+
+	// Install the signal handlers before initializing the UI.  SIGHUP is
+	// included since the session ending may be the first notice of a system
+	// shutdown, and Tor Browser should get a chance to exit cleanly.
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Initialize the UI.
 	ui, err := gtk.Init()
@@ -43,6 +68,12 @@ func main() {
 	}
 	defer ui.Term()
 
+	// Confine the launcher itself, now that the UI (which loads and probes
+	// all sorts of things) is initialized.
+	if err := sandbox.ConfineLauncher(); err != nil {
+		log.Printf("failed to confine the launcher: %v", err)
+	}
+
 	// Launch the UI in a go routine so that clean up happens.
 	doneCh := make(chan interface{})
 	go func() {
@@ -57,7 +88,7 @@ func main() {
 	case _ = <-doneCh:
 		// Goroutine terminated.
 	case sig := <-sigCh:
-		// Caught a signal handler.
+		// Caught a signal handler, the deferred Term() stops the browser.
 		log.Printf("exiting on signal: %v", sig)
 	}
 }
@@ -31,18 +31,25 @@
 #include <sys/types.h>
 #include <sys/syscall.h>
 #include <sys/resource.h>
+#include <sys/prctl.h>
+#include <sys/stat.h>
 #include <sys/socket.h>
 #include <sys/un.h>
 #include <arpa/inet.h>
 #include <netinet/in.h>
+#include <linux/filter.h>
+#include <linux/seccomp.h>
 #include <dlfcn.h>
 #include <errno.h>
+#include <fcntl.h>
 #include <pthread.h>
 #include <stdbool.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
 #include <unistd.h>
 #include <inttypes.h>
+#include <limits.h>
 
 static int (*real_connect)(int, const struct sockaddr *, socklen_t) = NULL;
 static int (*real_socket)(int, int, int) = NULL;
@@ -58,6 +65,14 @@ extern char **environ;
 #define TBB_SOCKS_PORT 9150
 #define TBB_CONTROL_PORT 9151
 
+/*
+ * The stub version, which the launcher checks against the bundle versions
+ * that the build is vetted for.  Bump this whenever the interface between
+ * the launcher and the stub changes.
+ */
+__attribute__((used, section(".tbb_stub_version")))
+static const char tbb_stub_version[] = "2";
+
 int
 connect(int fd, const struct sockaddr *address, socklen_t address_len)
 {
@@ -303,12 +318,231 @@ pthread_attr_getstack(const pthread_attr_t *attr, void **stackaddr, size_t *stac
   return ret;
 }
 
+/* Firefox's GPU and RDD (media decoding) processes need far less than
+ * the rest, so if the launcher provided an additional filter, install it
+ * before firefox gets around to installing it's own.  The process type
+ * is always the last argument passed to a child process.
+ */
+static int
+is_media_process(int argc, char **argv)
+{
+  const char *type;
+
+  if (argc < 3 || strcmp(argv[1], "-contentproc") != 0)
+    return 0;
+  type = argv[argc-1];
+  return strcmp(type, "gpu") == 0 || strcmp(type, "rdd") == 0;
+}
+
+static void
+install_media_seccomp(const char *path)
+{
+  struct sock_fprog prog;
+  struct stat st;
+  size_t len, off = 0;
+  ssize_t n;
+  void *buf;
+  int fd;
+
+  if ((fd = open(path, O_RDONLY | O_CLOEXEC)) < 0) {
+    fprintf(stderr, "ERROR: Failed to open the media seccomp filter: %d\n", errno);
+    abort();
+  }
+  if (fstat(fd, &st) != 0) {
+    fprintf(stderr, "ERROR: Failed to stat the media seccomp filter: %d\n", errno);
+    abort();
+  }
+  len = (size_t)st.st_size;
+  if (len == 0 || len % sizeof(struct sock_filter) != 0 ||
+      len / sizeof(struct sock_filter) > 0xffff) {
+    fprintf(stderr, "ERROR: Invalid media seccomp filter size: %zu\n", len);
+    abort();
+  }
+  if ((buf = malloc(len)) == NULL) {
+    fprintf(stderr, "ERROR: Failed to allocate the media seccomp filter.\n");
+    abort();
+  }
+  while (off < len) {
+    if ((n = read(fd, (char *)buf + off, len - off)) <= 0) {
+      if (n < 0 && errno == EINTR)
+        continue;
+      fprintf(stderr, "ERROR: Failed to read the media seccomp filter: %d\n", errno);
+      abort();
+    }
+    off += (size_t)n;
+  }
+  close(fd);
+
+  prog.len = (unsigned short)(len / sizeof(struct sock_filter));
+  prog.filter = buf;
+  if (prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) != 0) {
+    fprintf(stderr, "ERROR: Failed to set no_new_privs: %d\n", errno);
+    abort();
+  }
+  if (prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, &prog) != 0) {
+    fprintf(stderr, "ERROR: Failed to install the media seccomp filter: %d\n", errno);
+    abort();
+  }
+  free(buf);
+}
+
+/* The amnesiac profile is copied into the tmpfs by the stub, rather than
+ * by bwrap, so that the launcher doesn't need to hold every file in memory,
+ * and so that the permission bits are preserved.  The manifest is the
+ * source and destination directories, followed by a `<type> <mode> <path>`
+ * line for every directory and file to copy, parents first.
+ */
+static void
+shadow_copy_file(const char *src, const char *dest, mode_t mode)
+{
+  char buf[65536];
+  struct stat st;
+  ssize_t n, w, off;
+  int in, out;
+
+  if ((in = open(src, O_RDONLY | O_NOFOLLOW | O_CLOEXEC)) < 0) {
+    fprintf(stderr, "ERROR: Failed to open shadow source '%s': %d\n", src, errno);
+    abort();
+  }
+  if (fstat(in, &st) != 0 || !S_ISREG(st.st_mode)) {
+    fprintf(stderr, "ERROR: Shadow source '%s' is not a regular file.\n", src);
+    abort();
+  }
+  if ((out = open(dest, O_WRONLY | O_CREAT | O_EXCL | O_NOFOLLOW | O_CLOEXEC, 0600)) < 0) {
+    fprintf(stderr, "ERROR: Failed to create shadow file '%s': %d\n", dest, errno);
+    abort();
+  }
+  for (;;) {
+    if ((n = read(in, buf, sizeof(buf))) < 0) {
+      if (errno == EINTR)
+        continue;
+      fprintf(stderr, "ERROR: Failed to read shadow source '%s': %d\n", src, errno);
+      abort();
+    } else if (n == 0) {
+      break;
+    }
+    for (off = 0; off < n; off += w) {
+      if ((w = write(out, buf + off, (size_t)(n - off))) < 0) {
+        if (errno == EINTR) {
+          w = 0;
+          continue;
+        }
+        fprintf(stderr, "ERROR: Failed to write shadow file '%s': %d\n", dest, errno);
+        abort();
+      }
+    }
+  }
+  if (fchmod(out, mode) != 0) {
+    fprintf(stderr, "ERROR: Failed to chmod shadow file '%s': %d\n", dest, errno);
+    abort();
+  }
+  close(out);
+  close(in);
+}
+
+static void
+shadow_copy(const char *path)
+{
+  char src_path[PATH_MAX], dest_path[PATH_MAX];
+  char *buf, *line, *next, *src, *dest;
+  unsigned long mode;
+  struct stat st;
+  size_t len, off = 0;
+  ssize_t n;
+  int fd;
+
+  if ((fd = open(path, O_RDONLY | O_CLOEXEC)) < 0) {
+    fprintf(stderr, "ERROR: Failed to open the shadow manifest: %d\n", errno);
+    abort();
+  }
+  if (fstat(fd, &st) != 0) {
+    fprintf(stderr, "ERROR: Failed to stat the shadow manifest: %d\n", errno);
+    abort();
+  }
+  len = (size_t)st.st_size;
+  if ((buf = malloc(len + 1)) == NULL) {
+    fprintf(stderr, "ERROR: Failed to allocate the shadow manifest.\n");
+    abort();
+  }
+  while (off < len) {
+    if ((n = read(fd, buf + off, len - off)) <= 0) {
+      if (n < 0 && errno == EINTR)
+        continue;
+      fprintf(stderr, "ERROR: Failed to read the shadow manifest: %d\n", errno);
+      abort();
+    }
+    off += (size_t)n;
+  }
+  buf[len] = '\0';
+  close(fd);
+
+  src = buf;
+  if ((dest = strchr(src, '\n')) == NULL)
+    goto malformed;
+  *dest++ = '\0';
+  if ((line = strchr(dest, '\n')) == NULL)
+    goto malformed;
+  *line++ = '\0';
+
+  for (; *line != '\0'; line = next) {
+    char *rel, *end;
+
+    if ((next = strchr(line, '\n')) == NULL)
+      goto malformed;
+    *next++ = '\0';
+
+    if (strlen(line) < 8 || line[1] != ' ' || line[6] != ' ')
+      goto malformed;
+    mode = strtoul(line + 2, &end, 8);
+    if (end != line + 6 || mode > 07777)
+      goto malformed;
+    rel = line + 7;
+    if (rel[0] == '/' || strcmp(rel, "..") == 0 || strncmp(rel, "../", 3) == 0 || strstr(rel, "/../") != NULL)
+      goto malformed;
+    if ((size_t)snprintf(src_path, sizeof(src_path), "%s/%s", src, rel) >= sizeof(src_path) ||
+        (size_t)snprintf(dest_path, sizeof(dest_path), "%s/%s", dest, rel) >= sizeof(dest_path)) {
+      fprintf(stderr, "ERROR: Shadow path too long: '%s'\n", rel);
+      abort();
+    }
+
+    switch (line[0]) {
+    case 'd':
+      /* Mount points for the binds over the copy will already exist, and
+       * the owner needs to be able to populate the directory.
+       */
+      if (mkdir(dest_path, 0700) != 0 && errno != EEXIST) {
+        fprintf(stderr, "ERROR: Failed to create shadow directory '%s': %d\n", dest_path, errno);
+        abort();
+      }
+      if (chmod(dest_path, (mode_t)mode | S_IRWXU) != 0) {
+        fprintf(stderr, "ERROR: Failed to chmod shadow directory '%s': %d\n", dest_path, errno);
+        abort();
+      }
+      break;
+    case 'f':
+      shadow_copy_file(src_path, dest_path, (mode_t)mode);
+      break;
+    default:
+      goto malformed;
+    }
+  }
+
+  free(buf);
+  return;
+
+malformed:
+  fprintf(stderr, "ERROR: Malformed shadow manifest.\n");
+  abort();
+}
+
 /*  Initialize the stub. */
 __attribute__((constructor)) static void
-stub_init(void)
+stub_init(int argc, char **argv, char **envp)
 {
+  char *media_path = secure_getenv("TOR_STUB_MEDIA_SECCOMP");
   char *socks_path = secure_getenv("TOR_STUB_SOCKS_SOCKET");
   char *control_path = secure_getenv("TOR_STUB_CONTROL_SOCKET");
+  char *shadow_path = secure_getenv("TOR_STUB_SHADOW_MANIFEST");
   size_t dest_len = sizeof(socks_addr.sun_path);
 
   /* If `TOR_STUB_SOCKS_SOCKET` isn't set, bail. */
@@ -363,6 +597,18 @@ stub_init(void)
   /* Save this since firefox at least will overwrite it. */
   cached_environ = environ;
 
+  /* Only the first process copies the profile, so that a restart doesn't
+   * clobber what firefox wrote in the mean time.
+   */
+  if (shadow_path != NULL) {
+    shadow_copy(shadow_path);
+    unsetenv("TOR_STUB_SHADOW_MANIFEST");
+  }
+
+  (void)envp;
+  if (media_path != NULL && is_media_process(argc, argv))
+    install_media_seccomp(media_path);
+
   return;
 
 out: